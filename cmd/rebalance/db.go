@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/sirupsen/logrus"
+)
+
+// runDBCommand runs "rebalance db <command> [options]" and returns the exit status
+func runDBCommand(log *logrus.Logger, args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "destroy":
+			return runDBDestroy(log, args[1:])
+		case "export":
+			return runDBExport(log, args[1:])
+		case "import":
+			return runDBImport(log, args[1:])
+		case "prune":
+			return runDBPrune(log, args[1:])
+		}
+	}
+	fmt.Println("Usage:")
+	fmt.Println("  rebalance db destroy --db-path FILE [--yes]   Delete a state database and its journal files")
+	fmt.Println("  rebalance db export --db-path FILE [--format json] [--output FILE]   Write the state as JSON (default: stdout)")
+	fmt.Println("  rebalance db import --db-path FILE [--format json] [--input FILE]   Merge an export into a state database (default: stdin)")
+	fmt.Println("  rebalance db prune --db-path FILE [--dry-run] [PATH...]   Remove records of files that no longer exist, under PATHs if given")
+	return 1
+}
+
+// runDBDestroy runs "rebalance db destroy"
+func runDBDestroy(log *logrus.Logger, args []string) int {
+	fs := flag.NewFlagSet("db destroy", flag.ContinueOnError)
+	dbPath := fs.String("db-path", "", "State database to delete")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *dbPath == "" || fs.NArg() > 0 {
+		log.Error("db destroy takes --db-path FILE and no other arguments")
+		return 1
+	}
+
+	if !*yes && !confirm(os.Stdin, fmt.Sprintf("Delete %s with all recorded pass counts and checksums? Type \"yes\" to confirm: ", *dbPath)) {
+		log.Warn("Not confirmed, database kept")
+		return 1
+	}
+	if err := database.Destroy(*dbPath); err != nil {
+		log.Errorf("Cannot destroy database: %v", err)
+		return 1
+	}
+	log.Warnf("Deleted %s", *dbPath)
+	return 0
+}
+
+// runDBExport runs "rebalance db export". The database is opened read-only, so a
+// rebalance can keep running while it is exported.
+func runDBExport(log *logrus.Logger, args []string) int {
+	fs := flag.NewFlagSet("db export", flag.ContinueOnError)
+	dbPath := fs.String("db-path", "", "State database to export")
+	format := fs.String("format", "json", "Export format; only json is supported")
+	output := fs.String("output", "-", "File to write, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *dbPath == "" || fs.NArg() > 0 {
+		log.Error("db export takes --db-path FILE, --format and --output, and no other arguments")
+		return 1
+	}
+	if *format != "json" {
+		log.Errorf("Unsupported export format %q: only json is supported", *format)
+		return 1
+	}
+
+	db, err := database.OpenSQLiteDBWithOptions(*dbPath, database.Options{ReadOnly: true})
+	if err != nil {
+		log.Errorf("Cannot open %s: %v", *dbPath, err)
+		return 1
+	}
+	defer db.Close(false)
+
+	if *output == "-" {
+		if err := db.ExportJSON(os.Stdout); err != nil {
+			log.Errorf("Export of %s failed: %v", *dbPath, err)
+			return 1
+		}
+		return 0
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Errorf("Cannot create export: %v", err)
+		return 1
+	}
+	err = db.ExportJSON(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Export of %s failed: %v", *dbPath, err)
+		return 1
+	}
+	log.Infof("Exported %s to %s", *dbPath, *output)
+	return 0
+}
+
+// runDBImport runs "rebalance db import", creating the database if it does not exist
+func runDBImport(log *logrus.Logger, args []string) int {
+	fs := flag.NewFlagSet("db import", flag.ContinueOnError)
+	dbPath := fs.String("db-path", "", "State database to import into, created if missing")
+	format := fs.String("format", "json", "Import format; only json is supported")
+	input := fs.String("input", "-", "Export to read, - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *dbPath == "" || fs.NArg() > 0 {
+		log.Error("db import takes --db-path FILE, --format and --input, and no other arguments")
+		return 1
+	}
+	if *format != "json" {
+		log.Errorf("Unsupported import format %q: only json is supported", *format)
+		return 1
+	}
+
+	r := io.Reader(os.Stdin)
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Errorf("Cannot open export: %v", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := database.OpenSQLiteDBAt(*dbPath)
+	if err != nil {
+		log.Errorf("Cannot open %s: %v", *dbPath, err)
+		return 1
+	}
+	defer db.Close(false)
+	stats, err := db.ImportJSON(r)
+	if err != nil {
+		log.Errorf("Import into %s failed, nothing was changed: %v", *dbPath, err)
+		return 1
+	}
+	log.Infof("Imported %d pass counts, %d checksums, %d runs (%d already recorded) and %d recovered files into %s",
+		stats.Rebalances, stats.Checksums, stats.Runs, stats.RunsKnown, stats.Recovered, *dbPath)
+	return 0
+}
+
+// runDBPrune runs "rebalance db prune", removing the records of deleted files under the
+// given paths, or all of them
+func runDBPrune(log *logrus.Logger, args []string) int {
+	fs := flag.NewFlagSet("db prune", flag.ContinueOnError)
+	dbPath := fs.String("db-path", "", "State database to prune")
+	dryRun := fs.Bool("dry-run", false, "Count the records of missing files without removing them")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *dbPath == "" {
+		log.Error("db prune takes --db-path FILE, --dry-run and the paths to prune under")
+		return 1
+	}
+
+	db, err := database.OpenSQLiteDBWithOptions(*dbPath, database.Options{ReadOnly: *dryRun})
+	if err != nil {
+		log.Errorf("Cannot open %s: %v", *dbPath, err)
+		return 1
+	}
+	defer db.Close(false)
+	for _, path := range fs.Args() {
+		if _, err := os.Stat(path); err != nil {
+			log.Warnf("Skipping %s: %v", path, err)
+		}
+	}
+	stats, err := db.Prune(fs.Args(), *dryRun)
+	if err != nil {
+		log.Errorf("Pruning %s failed: %v", *dbPath, err)
+		return 1
+	}
+	verb, moveVerb := "removed", "Moved"
+	if *dryRun {
+		verb, moveVerb = "would remove", "Would move"
+	}
+	log.Infof("Checked %d records: %s %d pass counts, %d checksums, %d recovered files and %d inventory entries of missing files from %s",
+		stats.Checked, verb, stats.Rebalances, stats.Checksums, stats.Recovered, stats.Inventory, *dbPath)
+	if stats.Moved > 0 {
+		log.Infof("%s %d pass counts to the new names of renamed files", moveVerb, stats.Moved)
+	}
+	return 0
+}
+
+// confirm prints prompt and reports whether the answer read from in is "yes"
+func confirm(in io.Reader, prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
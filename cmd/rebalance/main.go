@@ -1,19 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
-	"strconv"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/astundzia/go-zfs-rebalance/internal/configfile"
+	"github.com/astundzia/go-zfs-rebalance/internal/daemon"
 	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
 	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/instancelock"
+	"github.com/astundzia/go-zfs-rebalance/internal/notify"
+	"github.com/astundzia/go-zfs-rebalance/internal/status"
+	"github.com/astundzia/go-zfs-rebalance/internal/sysinfo"
+	"github.com/astundzia/go-zfs-rebalance/internal/tui"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
 	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
 	"github.com/sirupsen/logrus"
 )
@@ -33,9 +47,22 @@ const (
 	colorBold   = "\033[1m"
 )
 
+// Policies of --force-exit
+const (
+	forceExitTimeout = "timeout"
+	forceExitSignal  = "signal"
+	forceExitNever   = "never"
+)
+
+// forcedCleanupWait bounds how long a forced exit waits for originals being replaced
+// before it removes the copies of the files in progress
+const forcedCleanupWait = 5 * time.Second
+
 // CustomFormatter is a custom logrus formatter that uses a simpler timestamp format
 type CustomFormatter struct {
 	logrus.TextFormatter
+	// Units renders the copy speed of each file
+	Units units.Units
 }
 
 // Format implements logrus.Formatter interface
@@ -43,147 +70,72 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	// Use a timestamp format with seconds: "11:25:59 PM"
 	timestamp := entry.Time.Format("3:04:05 PM")
 
-	// Get operation type and file path from the message
-	operation := ""
-	filePath := ""
+	// Per-file entries carry their operation and path as fields
+	op, _ := entry.Data[rebalance.FieldOperation].(string)
+	filePath, _ := entry.Data[rebalance.FieldPath].(string)
+	target, _ := entry.Data[rebalance.FieldTarget].(string)
+	showFullPaths, _ := entry.Data[rebalance.FieldShowFullPaths].(bool)
 	color := ""
 
-	// Extract speed information if available
-	speedStr := ""
-
 	// Set color based on log level
 	switch entry.Level {
 	case logrus.ErrorLevel:
 		color = colorRed
 	case logrus.WarnLevel:
 		// Only use yellow for warnings, success messages get special handling
-		if !strings.Contains(entry.Message, "Successfully rebalanced") {
+		if op != rebalance.OpRebalanced {
 			color = colorYellow
 		}
 	}
 
-	// Check if message contains copy speed
-	if strings.Contains(entry.Message, "completed at") {
-		parts := strings.Split(entry.Message, "completed at")
-		if len(parts) > 1 {
-			speedPart := strings.TrimSpace(parts[1])
-			if strings.HasSuffix(speedPart, "MB/s") {
-				operation = "Copying"
-				speedStr = fmt.Sprintf("at %.2f MB/s", parseSpeed(speedPart))
-			}
-		}
-	} else if strings.Contains(entry.Message, "Copying '") {
+	operation := ""
+	detail := ""
+	switch op {
+	case rebalance.OpCopy:
 		operation = "Copying"
-
-		// Extract file path
-		parts := strings.Split(entry.Message, "Copying '")
-		if len(parts) > 1 {
-			pathParts := strings.Split(parts[1], "' to '")
-			if len(pathParts) > 0 {
-				filePath = pathParts[0]
-			}
-		}
-	} else if strings.Contains(entry.Message, "Removing original") {
+	case rebalance.OpRemove:
 		operation = "Removing"
-
-		// Extract file path
-		parts := strings.Split(entry.Message, "Removing original '")
-		if len(parts) > 1 {
-			pathParts := strings.Split(parts[1], "'...")
-			if len(pathParts) > 0 {
-				filePath = pathParts[0]
-			}
-		}
-	} else if strings.Contains(entry.Message, "Renaming") {
+	case rebalance.OpRename:
 		operation = "Renaming"
-
-		// Extract filenames from the format: Renaming 'source.ext.balance' to 'dest.ext'
-		parts := strings.Split(entry.Message, "Renaming '")
-		if len(parts) > 1 {
-			pathParts := strings.Split(parts[1], "' to '")
-			if len(pathParts) > 1 {
-				sourceFile := pathParts[0]
-				destFile := strings.TrimSuffix(pathParts[1], "'")
-				// Use both source and destination in the formatted message
-				filePath = fmt.Sprintf("%s to %s", sourceFile, destFile)
-			}
-		}
-	} else if strings.Contains(entry.Message, "Failed to rebalance") {
+		// Show both names: "file.ext.balance to file.ext"
+		filePath = fmt.Sprintf("%s to %s", filepath.Base(filePath), filepath.Base(target))
+	case rebalance.OpFailed:
 		operation = "Error"
 		color = colorRed
-
-		// Extract file path
-		parts := strings.Split(entry.Message, "Failed to rebalance ")
-		if len(parts) > 1 {
-			pathParts := strings.Split(parts[1], ":")
-			if len(pathParts) > 0 {
-				filePath = pathParts[0]
-			}
+		if err, ok := entry.Data[logrus.ErrorKey].(error); ok {
+			detail = "- " + err.Error()
 		}
-	} else if strings.Contains(entry.Message, "Successfully rebalanced") {
+	case rebalance.OpRebalanced:
 		operation = "Success"
 		color = colorGreen // Always green for success
-
-		// Extract file path and get just the filename
-		parts := strings.Split(entry.Message, "Successfully rebalanced ")
-		if len(parts) > 1 {
-			fullPath := parts[1]
-
-			// If path contains a speed component, remove it before extracting filename
-			if strings.Contains(fullPath, " at ") {
-				fullPath = strings.Split(fullPath, " at ")[0]
-			}
-
-			// Check if we should show full paths
-			// We need to check entry.Data for custom fields passed from rebalancer
-			showFullPathsVal, ok := entry.Data["show_full_paths"]
-			showFullPaths := false
-			if ok {
-				if boolVal, ok := showFullPathsVal.(bool); ok {
-					showFullPaths = boolVal
-				}
-			}
-
-			if showFullPaths {
-				// Use the full path directly
-				filePath = fullPath
-			} else {
-				// Extract just the filename from the full path
-				_, filePath = filepath.Split(fullPath)
-			}
-
-			// If there's a speed measurement, preserve it
-			if strings.Contains(parts[1], " at ") {
-				speedPart := strings.Split(parts[1], " at ")[1]
-				speedStr = "at " + speedPart
-			}
+		if !showFullPaths {
+			// Just the filename
+			_, filePath = filepath.Split(filePath)
+		}
+		if speed, ok := entry.Data[rebalance.FieldSpeed].(float64); ok {
+			detail = "at " + f.Units.Rate(speed*1024*1024)
+		}
+	default:
+		if strings.Contains(entry.Message, "permission") ||
+			strings.Contains(entry.Message, "no longer on disk") {
+			color = colorYellow
 		}
-	} else if strings.Contains(entry.Message, "permission") {
-		color = colorYellow
-	} else if strings.Contains(entry.Message, "File missing") ||
-		strings.Contains(entry.Message, "no longer on disk") {
-		color = colorYellow
 	}
 
 	// Construct the formatted log message
 	var msg string
 	if operation != "" && filePath != "" {
 		// Format with double quotes around filename and hyphens between elements
-		if speedStr != "" {
-			if operation == "Success" {
-				// Bold success messages
-				msg = fmt.Sprintf("%s - %s%s%s%s - \"%s\" %s\n", timestamp, color, colorBold, operation, colorReset, filePath, speedStr)
-			} else {
-				msg = fmt.Sprintf("%s - %s%s%s - \"%s\" %s\n", timestamp, color, operation, colorReset, filePath, speedStr)
-			}
-		} else {
-			if operation == "Success" {
-				// Bold success messages
-				msg = fmt.Sprintf("%s - %s%s%s%s - \"%s\"\n", timestamp, color, colorBold, operation, colorReset, filePath)
-			} else {
-				msg = fmt.Sprintf("%s - %s%s%s - \"%s\"\n", timestamp, color, operation, colorReset, filePath)
-			}
+		label := color + operation + colorReset
+		if operation == "Success" {
+			// Bold success messages
+			label = color + colorBold + operation + colorReset
+		}
+		msg = fmt.Sprintf("%s - %s - \"%s\"", timestamp, label, filePath)
+		if detail != "" {
+			msg += " " + detail
 		}
+		msg += "\n"
 	} else {
 		// For other messages apply any color if set, with hyphens
 		if color != "" {
@@ -196,12 +148,216 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return []byte(msg), nil
 }
 
-// parseSpeed extracts a float speed value from a string like "110.04 MB/s"
-func parseSpeed(speedStr string) float64 {
-	speedStr = strings.TrimSuffix(strings.TrimSpace(speedStr), "MB/s")
-	speedStr = strings.TrimSpace(speedStr)
-	speed, _ := strconv.ParseFloat(speedStr, 64)
-	return speed
+// verificationMode describes how copies are checked against their originals
+func verificationMode(noVerify, readback bool) string {
+	switch {
+	case noVerify:
+		return "disabled"
+	case readback:
+		return "read-back (original and copy re-read after copying)"
+	default:
+		return "streaming (original hashed while copying, copy read back)"
+	}
+}
+
+// formatClockAdjustment renders a wall-clock adjustment with its direction
+func formatClockAdjustment(d time.Duration) string {
+	if d < 0 {
+		return "-" + (-d).Round(time.Second).String()
+	}
+	return "+" + d.Round(time.Second).String()
+}
+
+// writeReport writes the run report to path, if set, as CSV or JSON depending on its extension
+func writeReport(log *logrus.Logger, path string, base64Paths bool, rebalancer *rebalance.Rebalancer) {
+	if path == "" {
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Errorf("Cannot write report: %v", err)
+		return
+	}
+	rep := rebalancer.Report()
+	rep.Base64Paths = base64Paths
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = rep.WriteCSV(f)
+	} else {
+		err = rep.WriteJSON(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Cannot write report %s: %v", path, err)
+		return
+	}
+	log.Infof("Report written to %s", path)
+}
+
+// printSummary prints the end-of-run totals and the tool's own I/O footprint
+func printSummary(summary rebalance.Summary, u units.Units) {
+	timestamp := time.Now().Format("3:04:05 PM")
+	title, color := "Summary", colorBlue
+	if summary.Interrupted {
+		title, color = "Summary (INTERRUPTED, partial)", colorYellow
+	}
+	if summary.TooManyErrors {
+		title, color = "Summary (STOPPED after too many errors, partial)", colorRed
+	}
+	if summary.PoolFull {
+		title, color = "Summary (STOPPED at the pool capacity limit, partial)", colorYellow
+	}
+	if summary.ByteBudgetSpent {
+		title, color = "Summary (STOPPED at the --max-bytes limit, partial)", colorYellow
+	}
+	if summary.RuntimeSpent {
+		title, color = "Summary (STOPPED at the --max-runtime limit, partial)", colorYellow
+	}
+	fmt.Printf("%s %s%s%s: %d files rebalanced, %s logical in %s%s\n",
+		timestamp, color, colorBold, title,
+		summary.FilesRebalanced, u.Size(uint64(summary.BytesRebalanced)),
+		summary.Elapsed.Round(time.Second), colorReset)
+	fmt.Printf("%s %sFiles: %d processed (%d rebalanced, %d skipped, %d failed), %d remaining%s\n",
+		timestamp, color,
+		summary.FilesRebalanced+summary.FilesSkipped+summary.FilesFailed,
+		summary.FilesRebalanced, summary.FilesSkipped, summary.FilesFailed,
+		summary.FilesRemaining, colorReset)
+
+	if summary.ClockAdjustment != 0 {
+		fmt.Printf("%s %sThe wall clock was adjusted by %s during the run (NTP step or suspend); durations and speeds are unaffected%s\n",
+			timestamp, colorYellow, formatClockAdjustment(summary.ClockAdjustment), colorReset)
+	}
+
+	if summary.RetryAttempts > 0 {
+		fmt.Printf("%s %s%d transient failures retried across %d files%s\n",
+			timestamp, colorYellow, summary.RetryAttempts, summary.FilesRetried, colorReset)
+	}
+
+	if summary.DirtyPauses > 0 {
+		fmt.Printf("%s %sCopies paused %d times, %s in total, to let dirty data be written out%s\n",
+			timestamp, colorBlue, summary.DirtyPauses, summary.DirtyPaused.Round(time.Second), colorReset)
+	}
+
+	if q := summary.QueueLatency; q != nil {
+		fmt.Printf("%s %sQueue wait: p50 %s, p90 %s, p99 %s, max %s (%s)%s\n",
+			timestamp, colorBlue,
+			q.P50.Round(time.Millisecond), q.P90.Round(time.Millisecond), q.P99.Round(time.Millisecond),
+			q.Max.Round(time.Millisecond), q.MaxFile, colorReset)
+	}
+
+	if arc := summary.ARC; arc != nil {
+		fmt.Printf("%s %sZFS ARC: %.1f%% hit ratio during the run, %s of %s%s\n",
+			timestamp, colorBlue, arc.RunHitRatio*100, u.Size(arc.Size), u.Size(arc.Max), colorReset)
+	}
+
+	if summary.FilesDeferred > 0 {
+		fmt.Printf("%s %s%d files deferred to the end of their pass because other processes had opened them%s\n",
+			timestamp, colorBlue, summary.FilesDeferred, colorReset)
+	}
+
+	if summary.FilesAlreadyBalanced > 0 {
+		fmt.Printf("%s %s%d files skipped as already balanced, laid out in fewer than --min-extents extents%s\n",
+			timestamp, colorBlue, summary.FilesAlreadyBalanced, colorReset)
+	}
+
+	if summary.FilesTooLarge > 0 {
+		fmt.Printf("%s %s%d files (%s) larger than --skip-larger-than left for a maintenance window%s\n",
+			timestamp, colorYellow, summary.FilesTooLarge, u.Size(uint64(summary.BytesTooLarge)), colorReset)
+	}
+
+	if summary.FilesLowSpace > 0 || summary.SpaceWaits > 0 {
+		fmt.Printf("%s %s%d files skipped and %d copies delayed to keep the --reserve-free space free%s\n",
+			timestamp, colorYellow, summary.FilesLowSpace, summary.SpaceWaits, colorReset)
+	}
+
+	if summary.CapacityPauses > 0 {
+		fmt.Printf("%s %sNew files held back %d times while the pool was above --max-pool-capacity%s\n",
+			timestamp, colorYellow, summary.CapacityPauses, colorReset)
+	}
+
+	if summary.WindowPauses > 0 {
+		fmt.Printf("%s %sNew files held back %d times outside the --window hours%s\n",
+			timestamp, colorYellow, summary.WindowPauses, colorReset)
+	}
+
+	if summary.FilesProtected > 0 {
+		fmt.Printf("%s %s%d files skipped because they are immutable or append-only (use --clear-immutable to include them)%s\n",
+			timestamp, colorYellow, summary.FilesProtected, colorReset)
+	}
+
+	if summary.FilesInUse > 0 {
+		fmt.Printf("%s %s%d files skipped because clients held leases or mandatory locks on them%s\n",
+			timestamp, colorYellow, summary.FilesInUse, colorReset)
+	}
+
+	if summary.TempNamesShortened > 0 {
+		fmt.Printf("%s %s%d files had names too long for the temp suffix and used shortened temp names%s\n",
+			timestamp, colorBlue, summary.TempNamesShortened, colorReset)
+	}
+
+	if summary.VerificationDisabled {
+		fmt.Printf("%s %s%sChecksum verification was DISABLED (--no-verify): copies were not compared against their originals%s\n",
+			timestamp, colorYellow, colorBold, colorReset)
+	}
+
+	for _, d := range summary.UnsupportedMetadata {
+		fmt.Printf("%s %s%s does not support %s: not preserved for %d files%s\n",
+			timestamp, colorYellow, d.Filesystem, d.Class, d.Files, colorReset)
+	}
+
+	if summary.FilesReplaceVerified > 0 {
+		fmt.Printf("%s %s%d files verified after replacement%s\n",
+			timestamp, colorBlue, summary.FilesReplaceVerified, colorReset)
+	}
+
+	if summary.FilesVerified > 0 {
+		color := colorBlue
+		if summary.VerifyMismatches > 0 {
+			color = colorRed
+		}
+		fmt.Printf("%s %sBackground verify: %d files checked, %d checksum mismatches%s\n",
+			timestamp, color, summary.FilesVerified, summary.VerifyMismatches, colorReset)
+	}
+
+	if summary.IO == nil {
+		return
+	}
+
+	io := summary.IO
+	if io.ReadSyscalls > 0 || io.WriteSyscalls > 0 {
+		fmt.Printf("%s %sProcess I/O: read %s in %d syscalls (%s from storage), wrote %s in %d syscalls (%s to storage)%s\n",
+			timestamp, colorBlue,
+			u.Size(io.ReadChars), io.ReadSyscalls, u.Size(io.ReadBytes),
+			u.Size(io.WriteChars), io.WriteSyscalls, u.Size(io.WriteBytes),
+			colorReset)
+		if summary.BytesRebalanced > 0 {
+			logical := float64(summary.BytesRebalanced)
+			fmt.Printf("%s %sI/O per logical byte: %.2fx read, %.2fx written%s\n",
+				timestamp, colorBlue,
+				float64(io.ReadChars)/logical, float64(io.WriteChars)/logical,
+				colorReset)
+		}
+	} else {
+		fmt.Printf("%s %sProcess I/O: %d block input operations, %d block output operations%s\n",
+			timestamp, colorBlue, io.BlockInputOps, io.BlockOutputOps, colorReset)
+	}
+}
+
+// printVerifyReport prints the outcome of a verify-only run
+func printVerifyReport(report rebalance.VerifyReport) {
+	timestamp := time.Now().Format("3:04:05 PM")
+	color := colorBlue
+	if len(report.Mismatched) > 0 || report.Failed > 0 {
+		color = colorRed
+	}
+	fmt.Printf("%s %s%sVerify: %d files checked, %d match, %d MISMATCH, %d unreadable, %d changed since recorded, %d without stored checksum%s\n",
+		timestamp, color, colorBold,
+		report.Checked, report.Matched, len(report.Mismatched), report.Failed, report.Modified, report.Unrecorded,
+		colorReset)
+	for _, path := range report.Mismatched {
+		fmt.Printf("%s %sMISMATCH: %s%s\n", timestamp, colorRed, path, colorReset)
+	}
 }
 
 // printUsage prints a detailed help message with examples
@@ -212,24 +368,121 @@ func printUsage() {
 	fmt.Println("This helps redistribute data blocks and can improve performance on fragmented pools.")
 	fmt.Println()
 	fmt.Println("Usage:")
-	fmt.Println("  rebalance [options] <path>")
+	fmt.Println("  rebalance [options] <path> [path...]")
+	fmt.Println("  rebalance plan [options] <path> [path...]   Print the files a run would process, in order, without touching them")
+	fmt.Println("  rebalance scan --db-path FILE [options] <path> [path...]   Record the files a run would process in the database and exit")
+	fmt.Println("  rebalance run --from-inventory --db-path FILE [options] <path> [path...]   Process the files of the last scan without walking the tree")
+	fmt.Println("  rebalance db destroy --db-path FILE [--yes]   Delete a state database after confirmation")
+	fmt.Println("  rebalance db export --db-path FILE [--format json] [--output FILE]   Write the state database as JSON")
+	fmt.Println("  rebalance db import --db-path FILE [--format json] [--input FILE]   Merge an export into a state database")
+	fmt.Println("  rebalance db prune --db-path FILE [--dry-run] [PATH...]   Remove records of files that no longer exist")
+	fmt.Println("  rebalance stats --db-path FILE [--all-runs] [--by day|week|month]   Show the runs recorded in a state database")
+	fmt.Println("  rebalance recover [--db-path FILE] [--audit-log FILE] [--dry-run] PATH...   Restore verified copies left in place of removed originals")
 	fmt.Println()
 	fmt.Println("Options:")
+	fmt.Println("  --config FILE        Read options from a YAML file of flag names and values; command line options take precedence")
 	fmt.Println("  --process-hardlinks  Process files with multiple hardlinks (skipped by default)")
+	fmt.Println("  --relink-hardlinks   Rebalance each hardlink group once and recreate its links to the new copy")
+	fmt.Println("  --clear-immutable    Process immutable and append-only files by clearing the flags and setting them again on the new copy (skipped by default, usually needs root)")
 	fmt.Println("  --passes X           Number of times a file may be rebalanced (default: 10, 0 for unlimited)")
 	fmt.Println("  --concurrency X      Number of files to process concurrently (default: auto - half of CPU cores, minimum 2, maximum 128)")
+	fmt.Println("  --max-workers-per-dataset X  Maximum files processed concurrently within one dataset (default: 0, unlimited)")
+	fmt.Println("  --max-workers-per-pool X     Maximum files processed concurrently within one pool (default: 0, unlimited)")
+	fmt.Println("  --include-mount PATH Process a nested foreign mount (bind, NFS, other pool) instead of skipping it (repeatable)")
+	fmt.Println("  --one-file-system    Stay on the filesystems of the paths: skip nested datasets of the same pool too, unless named with --include-mount")
+	fmt.Println("  --no-ignore-files    Process files matched by .rebalanceignore files instead of skipping them")
+	fmt.Println("  --files-from FILE    Process exactly the files listed, in order: the output of plan, a --report or one path per line (- for stdin)")
+	fmt.Println("  --from-inventory     Process the files recorded below the paths by rebalance scan in --db-path instead of walking the tree")
+	fmt.Println("  --inodes-from FILE   Only rebalance the files listed by inode (\"INODE\" or \"DEVICE INODE\" per line, - for stdin)")
+	fmt.Println("  --exclude-inodes-from FILE  Skip the files listed by inode (same format as --inodes-from)")
+	fmt.Println("  --db-path FILE       Keep pass counts and checksums in FILE across runs (default: temporary database)")
+	fmt.Println("  --db-cache-mb X      SQLite page cache per connection in MB (default: scaled to system memory)")
+	fmt.Println("  --db-temp-store MODE SQLite temp store: default, file or memory (default: memory with 4 GB RAM or more)")
+	fmt.Println("  --db-mmap-mb X       Memory-map up to X MB of the SQLite file, -1 to disable (default: scaled to system memory)")
+	fmt.Println("  --db-busy-timeout D  Wait up to D for a database lock held elsewhere, e.g. 30s (default: 10s)")
+	fmt.Println("  --db-read-only       Open --db-path without modifying it (audit mode); only with plan or --verify-only")
+	fmt.Println("  --no-db-prune        Keep the records of deleted files in --db-path after a completed run")
+	fmt.Println("  --verify-only        Compare files against the checksums stored in --db-path, without copying anything")
+	fmt.Println("  --report FILE        Write every file's outcome and the run totals to FILE (CSV if it ends in .csv, JSON otherwise)")
+	fmt.Println("  --report-base64-paths  Add the base64 encoded bytes of every path to --report, not only of paths that are not valid UTF-8")
+	fmt.Println("  --audit-log FILE     Append a synced record of every removal and rename to FILE before it happens")
+	fmt.Println("  --pre-file-cmd CMD   Run CMD through the shell before each file is copied, with the file path as $1")
+	fmt.Println("  --post-file-cmd CMD  Run CMD after each copied file, with $REBALANCE_STATUS set to rebalanced, failed or interrupted")
+	fmt.Println("  --abort-on-hook-failure  Skip a file, counting it as failed, when --pre-file-cmd exits non-zero")
+	fmt.Println("  --webhook URL        POST a JSON event to URL when a run starts, finishes, fails or reaches --max-errors (repeatable)")
+	fmt.Println("  --webhook-events LIST  Events posted to webhooks: all (default) or a list of start, finish, failure and error-threshold")
+	fmt.Println("  --webhook-timeout D  Time limit of each webhook request (default: 10s)")
+	fmt.Println("  --webhook-retries X  Retry a webhook request failing with a network or server error X times (default: 3)")
 	fmt.Println("  --no-cleanup-balance Disable automatic removal of stale .balance files (enabled by default)")
-	fmt.Println("  --no-random          Process files in directory order instead of random order (default)")
+	fmt.Println("  --temp-suffix S      Suffix of the temporary copies (default: .balance)")
+	fmt.Println("  --temp-subdir        Make the temporary copies in a hidden .rebalance-tmp directory next to each file")
+	fmt.Println("  --order ORDER        Processing order: random (default), path, largest, smallest or fragmented (most extents first)")
+	fmt.Println("  --no-random          Same as --order path, kept for existing scripts")
+	fmt.Println("  --reuse-file-list    Walk the paths once and process the same files in every pass")
+	fmt.Println("  --shuffle-passes     Process the files of every pass after the first in a new random order")
+	fmt.Println("  --min-extents N      Skip files laid out in fewer than N extents as already balanced (Linux FIEMAP)")
+	fmt.Println("  --reserve-free X     Keep X free on each dataset, e.g. 5% or 50G: copies wait for others to finish or are skipped")
 	fmt.Println("  --debug              Enable debug logging (shows all operations, not just successes/errors)")
-	fmt.Println("  --size-threshold X   Only show success messages for files >= X MB (default: 0)")
-	fmt.Println("  --checksum TYPE      Checksum type to use (sha256 or md5, default: sha256)")
+	fmt.Println("  --quiet              Print only errors and the final summary: no per-file success lines, warnings or progress")
+	fmt.Println("  --status-addr ADDR   Serve a read-only web dashboard and JSON status at ADDR, e.g. localhost:8080")
+	fmt.Println("  --tui                Show a live dashboard of workers, progress and errors; p pauses, +/- change concurrency")
+	fmt.Println("  --log-format FORMAT  text (default) or json, one object per line with per-file fields")
+	fmt.Println("  --units UNITS        binary (KiB, MiB, default), si (kB, MB), binary-bits or si-bits for speeds in bits per second")
+	fmt.Println("  --size-threshold X   Only show success messages for files of at least X, e.g. 512K or 20M; plain numbers are MiB (default: 0)")
+	fmt.Println("  --min-size X         Only rebalance files of at least X, e.g. 512K or 1.5G (default: 0, no minimum)")
+	fmt.Println("  --max-size X         Only rebalance files of at most X, e.g. 512K or 1.5G (default: 0, no maximum)")
+	fmt.Println("  --skip-larger-than X Skip files larger than X, e.g. 500G, logging each and counting them in the summary (default: 0, none)")
+	fmt.Println("  --checksum TYPE      Checksum type to use (sha256, md5, blake3 or xxh3, default: sha256)")
+	fmt.Println("  --checksum-by-size RULES  Use another checksum for files of at least a size, e.g. 1G:xxh3 (comma-separated SIZE:TYPE)")
 	fmt.Println("  --halt-on-missing    Halt processing when a file is no longer on disk")
+	fmt.Println("  --ssd-write-budget X Warn at startup when the estimated writes to flash vdevs exceed X, e.g. 500G; plain numbers are GiB (default: 0, no budget)")
+	fmt.Println("  --temp-timeout D     Warn when a .balance file makes no progress for duration D, e.g. 30m (default: 0, disabled)")
+	fmt.Println("  --max-errors X       Stop the run once X files have failed (default: 0, no limit)")
+	fmt.Println("  --retries X          Retry copies, removes and renames failing with transient errors X times (default: 2)")
+	fmt.Println("  --retry-backoff D    Wait before the first retry, doubled after each one (default: 1s)")
+	fmt.Println("  --pool-bandwidth X   Cap the combined copy rate of all instances on the same pool at X per second, e.g. 200M; plain numbers are MiB/s (default: 0, unlimited)")
+	fmt.Println("  --bandwidth-state-dir DIR  Directory shared by instances using --pool-bandwidth (default: system temp directory)")
+	fmt.Println("  --lock-dir DIR       Directory holding the locks of running instances (default: system temp directory)")
+	fmt.Println("  --force-unlock       Remove locks left by instances that are no longer running")
+	fmt.Println("  --only-if-frag-above X  Do nothing unless the pool's fragmentation is above X percent (default: 0, always run)")
+	fmt.Println("  --max-pool-capacity X  Stop once the pool is more than X percent full, checked during the run (default: 0, no limit)")
+	fmt.Println("  --pause-at-capacity  Hold back new files above --max-pool-capacity until the pool is below it again, instead of stopping")
+	fmt.Println("  --max-bytes X        Stop cleanly once X has been rebalanced, e.g. 2T; a later run with the same --db-path carries on (default: 0, no limit)")
+	fmt.Println("  --max-runtime D      Stop cleanly after running for duration D, e.g. 6h; a later run with the same --db-path carries on (default: 0, no limit)")
+	fmt.Println("  --window HH:MM-HH:MM Only start files during these local hours, e.g. 01:00-07:00, waiting outside them (default: any time)")
+	fmt.Println("  --gentle             Run with the lowest CPU priority and the idle I/O class where available, so other workloads win")
+	fmt.Println("  --max-procs N        Use at most N CPUs for copying and hashing; also bounds the auto --concurrency (default: 0, all CPUs)")
+	fmt.Println("  --hash-workers N     Hash at most N files at once to spare the CPU (default: 0, no limit)")
+	fmt.Println("  --memory-limit X     Soft limit of the memory used, e.g. 1G, reached by collecting garbage more often (default: 0, no limit)")
+	fmt.Println("  --force-exit POLICY  After a shutdown signal, force the exit: timeout (default), signal (on a second signal) or never")
+	fmt.Println("  --shutdown-timeout D How long --force-exit timeout waits for the files in progress (default: 90s)")
+	fmt.Println("  --daemon             Keep running and rebalance the paths again every --interval, skipping runs while one is active")
+	fmt.Println("  --interval D         Time between the starts of two runs in --daemon mode (default: 168h)")
+	fmt.Println("  --watch              After the passes, keep rebalancing files as they are created or written")
+	fmt.Println("  --watch-settle D     Time without changes before --watch rebalances a file (default: 1m)")
+	fmt.Println("  --requeue-stalled    Cancel and requeue files flagged by --temp-timeout instead of only warning")
+	fmt.Println("  --verify-readback    Re-read the original after copying instead of hashing it while copying")
+	fmt.Println("  --verify-after-replace  Hash each file again once its copy replaced the original and compare it with the copy's checksum")
+	fmt.Println("  --batch-size N       Replace originals in batches of N, once every copy of the batch was written and read back")
+	fmt.Println("  --recovery-dir DIR   Save copies that cannot be renamed into place below DIR instead of next to the original")
+	fmt.Println("  --arc-throttle       Lower the concurrency while the ZFS ARC thrashes, and raise it again once it settles")
+	fmt.Println("  --no-verify          Skip checksum comparison of each copy and rely on ZFS's own checksums (faster, less safe)")
+	fmt.Println("  --no-fsync           Do not flush each copy and its directory to disk before removing the original (faster, less safe)")
+	fmt.Println("  --background-verify  Store checksums of rebalanced files and re-check stored checksums while workers are idle")
 	fmt.Println("  --filename-only      Display only filenames instead of full paths in logs (full paths by default)")
+	fmt.Println("  --no-sparse          Write sparse files out in full instead of preserving holes")
+	fmt.Println("  --cache-bypass MODE  Keep the copies out of the caches: direct (O_DIRECT, skips the ARC on OpenZFS 2.3+) or fadvise (page cache only)")
+	fmt.Println("  --io-engine ENGINE   Copy with sync (read/write loop, default) or uring (io_uring batches, Linux 5.6+, falls back to sync)")
+	fmt.Println("  --parallel-copy N    Copy files above --parallel-copy-above with N concurrent streams (default: 1)")
+	fmt.Println("  --parallel-copy-above X  Smallest file copied with --parallel-copy streams, e.g. 100G (default: 16G)")
+	fmt.Println("  --no-dirty-pacing    Keep copying while much dirty data is waiting for writeback (paused by default)")
+	fmt.Println("  --chown-early        Chown each temp copy to the file's owner when it is created, and check per-owner quota headroom first")
+	fmt.Println("  --defer-opened-within D  Put files other processes opened within D (e.g. 10m) off to the end of the pass; Linux with CAP_SYS_ADMIN (default: 0, disabled)")
 	fmt.Println("  --version            Show version information")
 	fmt.Println("  --help               Show this help message")
 	fmt.Println()
 	fmt.Println("Features:")
-	fmt.Println("  * Files are verified using SHA256 checksums (or MD5 if specified) to ensure data integrity")
+	fmt.Println("  * Files are verified using SHA256 checksums (or MD5/BLAKE3/XXH3 if specified) to ensure data integrity (original hashed while copying, copy read back from disk)")
 	fmt.Println("  * File attributes (permissions, timestamps, ownership) are preserved")
 	fmt.Println("  * Graceful shutdown on CTRL+C - finishes in-progress files")
 	fmt.Println()
@@ -240,11 +493,20 @@ func printUsage() {
 	fmt.Println("  # Process hardlinks as well (potentially increasing space usage)")
 	fmt.Println("  rebalance --process-hardlinks --concurrency 8 /path/to/data")
 	fmt.Println()
+	fmt.Println("  # Rebalance hardlinked files while keeping them linked together")
+	fmt.Println("  rebalance --relink-hardlinks /path/to/data")
+	fmt.Println()
 	fmt.Println("  # Rebalance files multiple times (useful for severely fragmented pools)")
 	fmt.Println("  rebalance --passes 3 /path/to/data")
 	fmt.Println()
-	fmt.Println("  # Disable random file processing order")
-	fmt.Println("  rebalance --no-random /path/to/data")
+	fmt.Println("  # Spread workers evenly across child datasets sharing the same vdevs")
+	fmt.Println("  rebalance --concurrency 8 --max-workers-per-dataset 2 /tank")
+	fmt.Println()
+	fmt.Println("  # Rebalance several trees with one worker pool and a combined summary")
+	fmt.Println("  rebalance /tank/media /tank/backups")
+	fmt.Println()
+	fmt.Println("  # Start with the largest files, so the longest copies do not come last")
+	fmt.Println("  rebalance --order largest /path/to/data")
 	fmt.Println()
 	fmt.Println("  # Disable automatic cleanup of stale .balance files")
 	fmt.Println("  rebalance --no-cleanup-balance /path/to/data")
@@ -252,18 +514,102 @@ func printUsage() {
 	fmt.Println("  # Enable verbose debugging output")
 	fmt.Println("  rebalance --debug /path/to/data")
 	fmt.Println()
-	fmt.Println("  # Only show success messages for files 20MB or larger")
-	fmt.Println("  rebalance --size-threshold 20 /path/to/data")
+	fmt.Println("  # Only show success messages for files 20MiB or larger")
+	fmt.Println("  rebalance --size-threshold 20M /path/to/data")
+	fmt.Println()
+	fmt.Println("  # Only rebalance files between 1MiB and 1.5GiB")
+	fmt.Println("  rebalance --min-size 1M --max-size 1.5G /path/to/data")
 	fmt.Println()
 	fmt.Println("  # Halt processing when a file is found to be missing during rebalance")
 	fmt.Println("  rebalance --halt-on-missing /path/to/data")
 }
 
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+// String implements flag.Value
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sizeFlag is a flag.Value for a size such as 512K or 1.5G, read by units.ParseSizeUnit
+// so plain numbers count in unit bytes as before sizes took suffixes. Rates may end in
+// "/s". Invalid values are reported by the flag package with the name of the flag.
+type sizeFlag struct {
+	bytes int64
+	unit  int64
+	rate  bool
+}
+
+// String implements flag.Value
+func (f *sizeFlag) String() string {
+	switch {
+	case f == nil || f.bytes == 0:
+		return "0"
+	case f.rate:
+		return units.Units{}.Rate(float64(f.bytes))
+	default:
+		return units.Units{}.Size(uint64(f.bytes))
+	}
+}
+
+// Set implements flag.Value
+func (f *sizeFlag) Set(value string) error {
+	if f.rate {
+		value = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(value), "/s"), "/S")
+	}
+	n, err := units.ParseSizeUnit(value, max(f.unit, 1))
+	if err != nil {
+		return err
+	}
+	f.bytes = n
+	return nil
+}
+
+// timeFormats are the layouts a timeFlag accepts, read in local time
+var timeFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// timeFlag is a flag.Value for a point in time: a date such as 2024-06-01, a local date
+// and time, RFC 3339, or a duration such as 72h counted back from now
+type timeFlag struct {
+	t time.Time
+}
+
+// String implements flag.Value
+func (f *timeFlag) String() string {
+	if f == nil || f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format("2006-01-02 15:04:05")
+}
+
+// Set implements flag.Value
+func (f *timeFlag) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if d, err := time.ParseDuration(value); err == nil {
+		f.t = time.Now().Add(-d)
+		return nil
+	}
+	for _, layout := range timeFormats {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			f.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("expected a date such as 2024-06-01, a date and time, or a duration such as 72h")
+}
+
 // concurrencyStr returns a string representation of the concurrency setting
 func concurrencyStr(concurrency int) string {
 	if concurrency <= 0 {
 		// For auto concurrency, calculate and include the actual worker count
-		cpuCount := runtime.NumCPU()
+		cpuCount := runtime.GOMAXPROCS(0)
 		autoConcurrency := cpuCount / 2
 		if autoConcurrency < 2 {
 			autoConcurrency = 2
@@ -288,7 +634,7 @@ func calculateConcurrency(concurrency int) int {
 	}
 
 	// Auto concurrency: half the number of CPU cores, minimum 2
-	cpuCount := runtime.NumCPU()
+	cpuCount := runtime.GOMAXPROCS(0)
 	autoConcurrency := cpuCount / 2
 	if autoConcurrency < 2 {
 		autoConcurrency = 2
@@ -310,19 +656,122 @@ func main() {
 		},
 	}
 
+	// "rebalance db ..." manages the state database and takes no rebalance options
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		os.Exit(runDBCommand(log, os.Args[2:]))
+	}
+	// "rebalance stats ..." reports the runs recorded in a state database
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		os.Exit(runStatsCommand(log, os.Args[2:]))
+	}
+	// "rebalance recover ..." restores the copies that runs left in place of removed originals
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		os.Exit(runRecoverCommand(log, os.Args[2:]))
+	}
+
 	var (
 		processHardlinks  bool
 		passesFlag        int
 		concurrency       int
 		showHelp          bool
 		noCleanupBalance  bool
+		tempSuffix        string
+		tempSubdir        bool
 		noRandomOrder     bool
+		orderName         string
+		minExtents        int
+		reserveFreeSpec   string
 		debugLogging      bool
-		sizeThreshold     int
+		quiet             bool
+		tuiMode           bool
+		statusAddr        string
+		sizeThreshold     = sizeFlag{unit: 1 << 20}
+		minSize           sizeFlag
+		since             timeFlag
+		sinceLastRun      bool
+		maxSize           sizeFlag
+		skipLargerThan    sizeFlag
 		showVersion       bool
 		checksumType      string
+		checksumBySize    string
+		configPath        string
 		haltOnFileMissing bool
 		showFullPaths     bool
+		noSparse          bool
+		cacheBypassName   string
+		ioEngineName      string
+		parallelCopy      int
+		parallelCopyAbove = sizeFlag{bytes: 16 << 30, unit: 1 << 30}
+		chownEarly        bool
+		deferOpened       time.Duration
+		noDirtyPacing     bool
+		relinkHardlinks   bool
+		clearImmutable    bool
+		maxPerDataset     int
+		maxPerPool        int
+		includeMounts     stringList
+		oneFileSystem     bool
+		noIgnoreFiles     bool
+		backgroundVerify  bool
+		noVerify          bool
+		noFsync           bool
+		tempTimeout       time.Duration
+		requeueStalled    bool
+		ssdWriteBudget    = sizeFlag{unit: 1 << 30}
+		verifyReadback    bool
+		verifyReplaced    bool
+		batchSize         int
+		recoveryDir       string
+		arcThrottle       bool
+		inodesFrom        string
+		filesFrom         string
+		fromInventory     bool
+		excludeInodesFrom string
+		dbPath            string
+		verifyOnly        bool
+		dbCacheMB         int
+		dbTempStore       string
+		dbMmapMB          int
+		dbBusyTimeout     time.Duration
+		dbReadOnly        bool
+		noDBPrune         bool
+		auditLogPath      string
+		reportPath        string
+		reportBase64      bool
+		preFileCmd        string
+		postFileCmd       string
+		abortOnHookFail   bool
+		logFormat         string
+		retries           int
+		maxErrors         int
+		retryBackoff      time.Duration
+		poolBandwidth     = sizeFlag{unit: 1 << 20, rate: true}
+		bandwidthStateDir string
+		lockDir           string
+		forceUnlock       bool
+		onlyIfFragAbove   int
+		maxPoolCapacity   int
+		maxBytes          sizeFlag
+		maxRuntime        time.Duration
+		windowSpec        string
+		gentle            bool
+		maxProcs          int
+		hashWorkers       int
+		memoryLimit       = sizeFlag{unit: 1 << 20}
+		pauseAtCapacity   bool
+		daemonMode        bool
+		watchMode         bool
+		watchSettle       time.Duration
+		reuseFileList     bool
+		shufflePasses     bool
+		unitsName         string
+		interval          time.Duration
+		forceExit         string
+		shutdownTimeout   time.Duration
+		webhooks          stringList
+		webhookEvents     string
+		webhookTimeout    time.Duration
+		webhookRetries    int
 	)
 
 	flag.BoolVar(&processHardlinks, "process-hardlinks", false, "Process files with multiple hardlinks")
@@ -330,96 +779,622 @@ func main() {
 	flag.IntVar(&concurrency, "concurrency", 0, "Number of files to process concurrently (default: auto - half of CPU cores, minimum 2, maximum 128)")
 	flag.BoolVar(&showHelp, "help", false, "Show usage")
 	flag.BoolVar(&noCleanupBalance, "no-cleanup-balance", false, "Disable automatic removal of stale .balance files")
-	flag.BoolVar(&noRandomOrder, "no-random", false, "Process files in directory order instead of random order")
+	flag.StringVar(&tempSuffix, "temp-suffix", rebalance.DefaultTempSuffix, "Suffix of the temporary copies; stale copies are only cleaned up with the suffix they were made with")
+	flag.BoolVar(&tempSubdir, "temp-subdir", false, "Make the temporary copies in a hidden "+rebalance.TempSubdirName+" directory next to each file, so only the files there are treated as temporary copies")
+	flag.StringVar(&orderName, "order", string(rebalance.OrderRandom), "Processing order: random, path (directory order), largest or smallest (largest or smallest files first), or fragmented (files with the most extents first, Linux FIEMAP)")
+	flag.BoolVar(&noRandomOrder, "no-random", false, "Same as --order path")
+	flag.BoolVar(&reuseFileList, "reuse-file-list", false, "Walk the paths for the first pass only and process the same files in the later passes; files created meanwhile are left for the next run")
+	flag.BoolVar(&shufflePasses, "shuffle-passes", false, "Process the files of every pass after the first in a new random order, whatever --order is")
+	flag.StringVar(&reserveFreeSpec, "reserve-free", "", "Free space to keep on each dataset, a percentage such as 5% or a size such as 50G; a copy that would cut into it waits for the copies in progress or is skipped")
+	flag.IntVar(&minExtents, "min-extents", 0, "Skip files laid out in fewer than this many extents as already balanced (Linux FIEMAP), 0 = rewrite every file")
 	flag.BoolVar(&debugLogging, "debug", false, "Enable debug logging")
-	flag.IntVar(&sizeThreshold, "size-threshold", 0, "Only show success messages for files >= this size in MB")
-	flag.StringVar(&checksumType, "checksum", "sha256", "Checksum type to use (sha256 or md5)")
+	flag.BoolVar(&quiet, "quiet", false, "Print only errors and the final summary")
+	flag.StringVar(&statusAddr, "status-addr", "", "Serve a read-only web dashboard of progress, throughput, datasets and errors, and its JSON at /api/status, on this address")
+	flag.BoolVar(&tuiMode, "tui", false, "Show a live dashboard with keys to pause/resume and change concurrency")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text, or json with operation, path, bytes and speed_mbps fields")
+	flag.Var(&sizeThreshold, "size-threshold", "Only show success messages for files of at least this size, e.g. 512K or 20M (plain numbers are MiB)")
+	flag.Var(&minSize, "min-size", "Only rebalance files of at least this size, e.g. 512K or 1.5G")
+	flag.Var(&since, "since", "Only rebalance files modified since this date (2024-06-01), date and time, or duration ago (72h)")
+	flag.BoolVar(&sinceLastRun, "since-last-run", false, "Only rebalance files modified since the start of the last complete run recorded in --db-path")
+	flag.Var(&maxSize, "max-size", "Only rebalance files of at most this size, e.g. 512K or 1.5G")
+	flag.Var(&skipLargerThan, "skip-larger-than", "Skip and report files larger than this size, e.g. 500G, to leave them for a maintenance window")
+	flag.StringVar(&checksumType, "checksum", "sha256", "Checksum type to use (sha256, md5, blake3 or xxh3)")
+	flag.StringVar(&checksumBySize, "checksum-by-size", "", "Use other checksums for files of at least a size, e.g. 1G:xxh3 or 100M:blake3,1G:xxh3")
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
 	flag.BoolVar(&haltOnFileMissing, "halt-on-missing", false, "Halt processing when a file is no longer on disk")
 	flag.BoolVar(&showFullPaths, "filename-only", false, "Display only filenames in logs instead of full paths (default: show full paths)")
-	flag.Parse()
+	flag.BoolVar(&noSparse, "no-sparse", false, "Disable hole preservation and write sparse files out in full")
+	flag.IntVar(&parallelCopy, "parallel-copy", 1, "Copy files of at least --parallel-copy-above with this many concurrent streams, each reading and writing its own chunks")
+	flag.Var(&parallelCopyAbove, "parallel-copy-above", "Smallest file copied with --parallel-copy streams, e.g. 100G (plain numbers are GiB)")
+	flag.StringVar(&ioEngineName, "io-engine", "sync", "How copies move their data: sync (a read/write loop) or uring (batches of reads and writes through io_uring on Linux 5.6+, falling back to sync where unavailable)")
+	flag.StringVar(&cacheBypassName, "cache-bypass", "", "Keep the data of the copies out of the caches: direct (O_DIRECT, or F_NOCACHE on macOS) or fadvise (POSIX_FADV_DONTNEED, page cache only)")
+	flag.BoolVar(&noDirtyPacing, "no-dirty-pacing", false, "Do not pause copies while the pool or page cache holds much dirty data waiting to be written out")
+	flag.DurationVar(&deferOpened, "defer-opened-within", 0, "Put files other processes opened within this window, e.g. 10m, off to the end of the pass (Linux fanotify, needs CAP_SYS_ADMIN; 0 to disable)")
+	flag.BoolVar(&chownEarly, "chown-early", false, "Give each temporary copy the owner of its file when it is created, so quotas charge the copy to the owner, and check quota headroom per owner before the run")
+	flag.BoolVar(&relinkHardlinks, "relink-hardlinks", false, "Rebalance hardlink groups once and recreate their links")
+	flag.BoolVar(&clearImmutable, "clear-immutable", false, "Process immutable and append-only files by clearing and restoring the flags")
+	flag.IntVar(&maxPerDataset, "max-workers-per-dataset", 0, "Maximum files processed concurrently within one dataset (0 for unlimited)")
+	flag.IntVar(&maxPerPool, "max-workers-per-pool", 0, "Maximum files processed concurrently within one pool when included nested mounts span several pools (0 for unlimited)")
+	flag.Var(&includeMounts, "include-mount", "Process a nested foreign mount instead of skipping it (repeatable)")
+	flag.BoolVar(&oneFileSystem, "one-file-system", false, "Do not cross into any other filesystem below the paths, nested datasets of the same pool included, unless named with --include-mount")
+	flag.BoolVar(&noIgnoreFiles, "no-ignore-files", false, "Do not read .rebalanceignore files; process the files and directories they list")
+	flag.BoolVar(&backgroundVerify, "background-verify", false, "Store checksums of rebalanced files and re-check stored checksums while workers are idle")
+	flag.BoolVar(&noVerify, "no-verify", false, "Skip checksum comparison of each copy and rely on ZFS's own checksums")
+	flag.BoolVar(&noFsync, "no-fsync", false, "Do not flush each copy and its directory to disk before removing the original")
+	flag.DurationVar(&tempTimeout, "temp-timeout", 0, "Warn when a .balance file makes no progress for this long, e.g. 30m (0 to disable)")
+	flag.IntVar(&maxErrors, "max-errors", 0, "Stop the run once this many files have failed, e.g. when a dying disk makes every copy fail (0 = no limit)")
+	flag.IntVar(&retries, "retries", 2, "Retry a copy, remove or rename failing with a transient error (EBUSY, stale handle, permission race) this many times")
+	flag.DurationVar(&retryBackoff, "retry-backoff", time.Second, "Wait before the first retry, doubled after each one")
+	flag.Var(&poolBandwidth, "pool-bandwidth", "Cap the combined copy rate of all instances working on the same pool, e.g. 200M or 1.5G/s (plain numbers are MiB/s, 0 for unlimited)")
+	flag.StringVar(&bandwidthStateDir, "bandwidth-state-dir", "", "Directory holding the state shared by instances using --pool-bandwidth (default: system temp directory)")
+	flag.BoolVar(&requeueStalled, "requeue-stalled", false, "Cancel and requeue files flagged by --temp-timeout")
+	flag.Var(&ssdWriteBudget, "ssd-write-budget", "Warn when the estimated writes to flash vdevs exceed this size, e.g. 500G or 2T (plain numbers are GiB, 0 for no budget)")
+	flag.BoolVar(&verifyReadback, "verify-readback", false, "Re-read the original after copying instead of hashing it while copying")
+	flag.BoolVar(&verifyReplaced, "verify-after-replace", false, "Hash each file again once its copy replaced the original")
+	flag.IntVar(&batchSize, "batch-size", 0, "Hold verified copies until this many are written, read them all back and only then remove the originals of the batch (0 or 1 to replace each file right away)")
+	flag.StringVar(&recoveryDir, "recovery-dir", "", "Save a copy that cannot be renamed over its removed original below this directory, ideally on another filesystem, instead of next to it as NAME.recovered")
+	flag.BoolVar(&arcThrottle, "arc-throttle", false, "Lower the concurrency while the ZFS ARC thrashes, i.e. reads keep asking for data it just evicted, and raise it again once the ARC settles (Linux, FreeBSD)")
+	flag.StringVar(&filesFrom, "files-from", "", "Process exactly the files listed in this file, in its order: a plan printed by the plan command, a JSON or CSV report written by --report, or one path per line (- for stdin)")
+	flag.BoolVar(&fromInventory, "from-inventory", false, "Process the files recorded below the paths by rebalance scan in --db-path instead of walking the tree")
+	flag.StringVar(&inodesFrom, "inodes-from", "", "Only rebalance the files listed by inode in this file (- for stdin)")
+	flag.StringVar(&excludeInodesFrom, "exclude-inodes-from", "", "Skip the files listed by inode in this file (- for stdin)")
+	flag.StringVar(&dbPath, "db-path", "", "Keep the state database at this path across runs instead of a temporary one")
+	flag.IntVar(&dbCacheMB, "db-cache-mb", 0, "SQLite page cache per connection in MB (0 = scaled to system memory)")
+	flag.StringVar(&dbTempStore, "db-temp-store", "", "SQLite temp store: default, file or memory (empty = memory on systems with 4 GB or more)")
+	flag.IntVar(&dbMmapMB, "db-mmap-mb", 0, "Memory-map up to this many MB of the SQLite file, -1 disables (0 = scaled to system memory)")
+	flag.DurationVar(&dbBusyTimeout, "db-busy-timeout", 10*time.Second, "Wait this long for a database lock held by another connection or process before failing")
+	flag.BoolVar(&dbReadOnly, "db-read-only", false, "Open --db-path read-only for plan or --verify-only, so investigating a database cannot change it")
+	flag.BoolVar(&noDBPrune, "no-db-prune", false, "Do not remove the records of files that no longer exist from --db-path after a completed run")
+	flag.BoolVar(&verifyOnly, "verify-only", false, "Compare files against the checksums stored in --db-path by a previous run, without copying")
+	flag.StringVar(&reportPath, "report", "", "Write the outcome of every file and the run totals to this file, as CSV if it ends in .csv and JSON otherwise")
+	flag.BoolVar(&reportBase64, "report-base64-paths", false, "Add the base64 encoded bytes of every path to --report, not only of paths that are not valid UTF-8")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Append a record of every removal and rename to this file before carrying it out")
+	flag.StringVar(&preFileCmd, "pre-file-cmd", "", "Shell command run before each file is copied, with the file path as $1")
+	flag.StringVar(&postFileCmd, "post-file-cmd", "", "Shell command run after each copied file, with the outcome in $REBALANCE_STATUS")
+	flag.BoolVar(&abortOnHookFail, "abort-on-hook-failure", false, "Skip a file when --pre-file-cmd fails instead of only logging the failure")
+	flag.Var(&webhooks, "webhook", "POST a JSON event with the run totals to this URL when a run starts, finishes, fails or reaches --max-errors (repeatable)")
+	flag.StringVar(&webhookEvents, "webhook-events", "all", "Events posted to --webhook: all, or a comma-separated list of start, finish, failure and error-threshold")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 10*time.Second, "Time limit of each webhook request")
+	flag.IntVar(&webhookRetries, "webhook-retries", 3, "Retry a webhook request failing with a network error, a timeout or a server error this many times")
+	flag.StringVar(&lockDir, "lock-dir", "", "Directory holding the locks that keep instances off overlapping trees (default: system temp directory)")
+	flag.BoolVar(&forceUnlock, "force-unlock", false, "Remove locks left by instances that are no longer running")
+	flag.IntVar(&onlyIfFragAbove, "only-if-frag-above", 0, "Exit successfully without rebalancing unless the pool's FRAG percentage is above this (0 to always run)")
+	flag.IntVar(&maxPoolCapacity, "max-pool-capacity", 0, "Stop the run once the pool's CAP percentage is above this, checked before and every 30s during the run (0 for no limit)")
+	flag.BoolVar(&pauseAtCapacity, "pause-at-capacity", false, "Hold back new files while the pool is above --max-pool-capacity, until it is below again, instead of stopping")
+	flag.Var(&maxBytes, "max-bytes", "Stop the run cleanly once the files it rebalanced add up to this size, e.g. 2T, finishing the files in progress; the pass counts in --db-path let the next run carry on (0 for no limit)")
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "Stop the run cleanly after running this long, e.g. 6h, finishing the files in progress; the pass counts in --db-path let the next run carry on (0 for no limit)")
+	flag.StringVar(&windowSpec, "window", "", "Only start files between these local times, e.g. 01:00-07:00 or 22:00-06:00; outside them new files wait and the files in progress are finished")
+	flag.BoolVar(&gentle, "gentle", false, "Lower the CPU priority to the minimum and use the idle I/O scheduling class where the platform has one, so foreground workloads on the pool always win")
+	flag.IntVar(&maxProcs, "max-procs", 0, "Use at most this many CPUs (GOMAXPROCS); the auto --concurrency follows (0 for all)")
+	flag.IntVar(&hashWorkers, "hash-workers", 0, "Hash at most this many files at once, whether while copying, reading back or verifying (0 for no limit)")
+	flag.Var(&memoryLimit, "memory-limit", "Soft limit of the memory the process uses, e.g. 1G (plain numbers are MiB); the runtime collects garbage more often near it (0 for no limit)")
+	flag.StringVar(&unitsName, "units", units.Binary, "Units of sizes and speeds in the output: binary (MiB), si (MB), binary-bits or si-bits (speeds in Mibit/s or Mbit/s)")
+	flag.BoolVar(&daemonMode, "daemon", false, "Keep running and rebalance the paths again every --interval")
+	flag.BoolVar(&watchMode, "watch", false, "After the passes, watch the paths and rebalance files created or written there once they settle")
+	flag.DurationVar(&watchSettle, "watch-settle", time.Minute, "How long a file must go without changes before --watch rebalances it")
+	flag.DurationVar(&interval, "interval", 168*time.Hour, "Time between the starts of two runs in --daemon mode")
+	flag.StringVar(&forceExit, "force-exit", forceExitTimeout, "When to force the exit after a shutdown signal: timeout, signal (a second signal) or never")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 90*time.Second, "How long --force-exit timeout waits for the files in progress to finish")
+	flag.StringVar(&configPath, "config", "", "Read options from this YAML file; options given on the command line take precedence")
+
+	// "rebalance plan [options] <path>..." prints the work list instead of processing it,
+	// "rebalance scan" records it in the database, and "rebalance run" is the default
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 {
+		switch args[0] {
+		case "plan", "scan", "run":
+			command = args[0]
+			args = args[1:]
+		}
+	}
+	planMode := command == "plan"
+	scanMode := command == "scan"
+	flag.CommandLine.Parse(args)
+
+	// Fill in the options not given on the command line from the config file
+	var fromConfig, configPaths []string
+	if configPath != "" {
+		cfg, err := configfile.Load(configPath)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		fromConfig, err = cfg.Apply(flag.CommandLine, "config", "help", "version")
+		if err != nil {
+			log.Errorf("%s: %v", configPath, err)
+			os.Exit(1)
+		}
+		configPaths = cfg.Paths
+	}
 
 	if showVersion {
 		fmt.Printf("go-zfs-rebalance version %s\n", VERSION)
 		os.Exit(0)
 	}
 
-	if showHelp || flag.NArg() < 1 {
+	switch logFormat {
+	case "text":
+	case "json":
+		log.Formatter = &logrus.JSONFormatter{}
+	default:
+		log.Errorf("Invalid log format %q: expected text or json", logFormat)
+		os.Exit(1)
+	}
+
+	outputUnits, err := units.Parse(unitsName)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if formatter, ok := log.Formatter.(*CustomFormatter); ok {
+		formatter.Units = outputUnits
+	}
+
+	rootPaths := flag.Args()
+	if len(rootPaths) == 0 {
+		rootPaths = configPaths
+	}
+
+	if showHelp || len(rootPaths) < 1 {
 		printUsage()
 		os.Exit(0)
 	}
 
-	rootPath := flag.Arg(0)
+	if planMode && (verifyOnly || daemonMode) {
+		log.Error("plan cannot be combined with --verify-only or --daemon")
+		os.Exit(1)
+	}
+
+	if scanMode && (dbPath == "" || verifyOnly || daemonMode || fromInventory || filesFrom != "") {
+		log.Error("scan requires --db-path and cannot be combined with --verify-only, --daemon, --from-inventory or --files-from")
+		os.Exit(1)
+	}
+
+	if fromInventory && (dbPath == "" || filesFrom != "") {
+		log.Error("--from-inventory requires --db-path holding a scan and cannot be combined with --files-from")
+		os.Exit(1)
+	}
+
+	if dbReadOnly && (dbPath == "" || !(planMode || verifyOnly)) {
+		log.Error("--db-read-only requires --db-path and plan or --verify-only: a rebalancing run must record its work")
+		os.Exit(1)
+	}
+
+	if verifyOnly && dbPath == "" {
+		log.Error("--verify-only requires --db-path pointing at the database of a previous run")
+		os.Exit(1)
+	}
+
+	if requeueStalled && tempTimeout <= 0 {
+		log.Error("--requeue-stalled requires --temp-timeout")
+		os.Exit(1)
+	}
+
+	if sinceLastRun && (dbPath == "" || !since.t.IsZero()) {
+		log.Error("--since-last-run requires --db-path and cannot be combined with --since")
+		os.Exit(1)
+	}
+
+	if maxSize.bytes > 0 && minSize.bytes > maxSize.bytes {
+		log.Errorf("--min-size %s is larger than --max-size %s", &minSize, &maxSize)
+		os.Exit(1)
+	}
 
-	// Open DB in a temp directory
-	db, err := database.OpenSQLiteDB()
+	if skipLargerThan.bytes > 0 && minSize.bytes > skipLargerThan.bytes {
+		log.Errorf("--min-size %s is larger than --skip-larger-than %s", &minSize, &skipLargerThan)
+		os.Exit(1)
+	}
+
+	if quiet && debugLogging {
+		log.Error("--quiet and --debug cannot be combined")
+		os.Exit(1)
+	}
+
+	if tuiMode && (quiet || debugLogging || planMode || scanMode || verifyOnly || daemonMode) {
+		log.Error("--tui cannot be combined with --quiet, --debug, --verify-only, --daemon, plan or scan")
+		os.Exit(1)
+	}
+
+	if noVerify && verifyReadback {
+		log.Error("--no-verify and --verify-readback cannot be combined")
+		os.Exit(1)
+	}
+	if noVerify && verifyReplaced {
+		log.Error("--no-verify and --verify-after-replace cannot be combined: there is no checksum to compare with")
+		os.Exit(1)
+	}
+
+	if noRandomOrder {
+		if orderName != string(rebalance.OrderRandom) && orderName != string(rebalance.OrderPath) {
+			log.Errorf("--no-random cannot be combined with --order %s", orderName)
+			os.Exit(1)
+		}
+		orderName = string(rebalance.OrderPath)
+	}
+	order, err := rebalance.ParseOrder(orderName)
 	if err != nil {
-		log.Errorf("Failed to open SQLite DB: %v", err)
+		log.Errorf("%v", err)
 		os.Exit(1)
 	}
 
-	// Clean up
-	defer func() {
-		_ = db.Close(true) // true to remove the temp DB directory
-	}()
+	cacheBypass, err := fileutil.ParseCacheBypass(cacheBypassName)
+	if err != nil {
+		log.Errorf("Invalid --cache-bypass: %v", err)
+		os.Exit(1)
+	}
+	ioEngine, err := fileutil.ParseIOEngine(ioEngineName)
+	if err != nil {
+		log.Errorf("Invalid --io-engine: %v", err)
+		os.Exit(1)
+	}
+	if parallelCopy < 1 {
+		log.Error("--parallel-copy must be at least 1")
+		os.Exit(1)
+	}
+	if err := fileutil.IOEngineAvailable(ioEngine); err != nil {
+		log.Warnf("Cannot use the %s I/O engine, copying with %s instead: %v", ioEngine, fileutil.IOEngineSync, err)
+		ioEngine = fileutil.IOEngineSync
+	}
+
+	if err := rebalance.CheckTempSuffix(tempSuffix); err != nil {
+		log.Errorf("Invalid --temp-suffix: %v", err)
+		os.Exit(1)
+	}
+
+	var window rebalance.Window
+	if windowSpec != "" {
+		if window, err = rebalance.ParseWindow(windowSpec); err != nil {
+			log.Errorf("Invalid --window: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var reserveFree rebalance.SpaceReserve
+	if reserveFreeSpec != "" {
+		if reserveFree, err = rebalance.ParseSpaceReserve(reserveFreeSpec); err != nil {
+			log.Errorf("Invalid --reserve-free: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if minExtents < 0 {
+		log.Error("--min-extents must be at least 0")
+		os.Exit(1)
+	}
+
+	if batchSize < 0 {
+		log.Error("--batch-size must be at least 0")
+		os.Exit(1)
+	}
+
+	if recoveryDir != "" && !planMode && !scanMode && !verifyOnly {
+		var warning string
+		recoveryDir, warning, err = prepareRecoveryDir(recoveryDir, rootPaths)
+		if err != nil {
+			log.Errorf("Invalid --recovery-dir: %v", err)
+			os.Exit(1)
+		}
+		if warning != "" {
+			log.Warnf("--recovery-dir: %s", warning)
+		}
+	}
+
+	// Test deployments can make chosen operations fail, see internal/faultinject
+	if faults, err := faultinject.Load(); err != nil {
+		log.Errorf("Invalid fault injection: %v", err)
+		os.Exit(1)
+	} else if faults != "" {
+		log.Warnf("%sFault injection is active (%s=%s): operations will fail on purpose%s", colorYellow, faultinject.EnvVar, faults, colorReset)
+	}
+
+	if onlyIfFragAbove < 0 || onlyIfFragAbove > 100 {
+		log.Error("--only-if-frag-above must be a percentage between 0 and 100")
+		os.Exit(1)
+	}
+	if maxPoolCapacity < 0 || maxPoolCapacity > 100 {
+		log.Error("--max-pool-capacity must be a percentage between 0 and 100")
+		os.Exit(1)
+	}
+	if pauseAtCapacity && maxPoolCapacity == 0 {
+		log.Error("--pause-at-capacity requires --max-pool-capacity")
+		os.Exit(1)
+	}
+
+	switch forceExit {
+	case forceExitTimeout, forceExitSignal, forceExitNever:
+	default:
+		log.Errorf("Invalid --force-exit %q: expected timeout, signal or never", forceExit)
+		os.Exit(1)
+	}
+	if shutdownTimeout <= 0 {
+		log.Error("--shutdown-timeout must be positive")
+		os.Exit(1)
+	}
+
+	selectedEvents, err := notify.ParseEvents(webhookEvents)
+	if err != nil {
+		log.Errorf("Invalid --webhook-events: %v", err)
+		os.Exit(1)
+	}
+	if webhookTimeout <= 0 || webhookRetries < 0 {
+		log.Error("--webhook-timeout must be positive and --webhook-retries at least 0")
+		os.Exit(1)
+	}
+	for _, u := range webhooks {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			log.Errorf("Invalid --webhook %q: expected an http or https URL", u)
+			os.Exit(1)
+		}
+	}
+
+	if daemonMode && interval <= 0 {
+		log.Error("--interval must be positive")
+		os.Exit(1)
+	}
+
+	if watchMode && (daemonMode || planMode || scanMode || verifyOnly) {
+		log.Error("--watch cannot be combined with --daemon, --verify-only, plan or scan")
+		os.Exit(1)
+	}
+	if watchMode && (maxBytes.bytes > 0 || maxRuntime > 0) {
+		log.Error("--watch cannot be combined with --max-bytes or --max-runtime")
+		os.Exit(1)
+	}
+	if maxRuntime < 0 {
+		log.Error("--max-runtime cannot be negative")
+		os.Exit(1)
+	}
+	if maxBytes.bytes > 0 && dbPath == "" {
+		log.Warn("--max-bytes without --db-path: the files rebalanced are not recorded, so the next run starts over")
+	}
+	if maxProcs < 0 || hashWorkers < 0 {
+		log.Error("--max-procs and --hash-workers cannot be negative")
+		os.Exit(1)
+	}
+	if maxProcs > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+	}
+	if memoryLimit.bytes > 0 {
+		debug.SetMemoryLimit(memoryLimit.bytes)
+	}
+	if maxRuntime > 0 && dbPath == "" {
+		log.Warn("--max-runtime without --db-path: the files rebalanced are not recorded, so the next run starts over")
+	}
+
+	if watchSettle <= 0 {
+		log.Error("--watch-settle must be positive")
+		os.Exit(1)
+	}
+
+	if noVerify && backgroundVerify {
+		log.Error("--no-verify and --background-verify cannot be combined: no checksums are computed to verify later")
+		os.Exit(1)
+	}
+
+	// The settings below are printed at info level before the level is lowered; a quiet
+	// run hides them too
+	if quiet {
+		log.SetLevel(logrus.ErrorLevel)
+	}
 
 	log.Infof("Start rebalancing at %s", time.Now().Format("2006-01-02 15:04:05"))
 	log.Infof("OS: %s", runtime.GOOS)
-	log.Infof("Path: %s", rootPath)
+	log.Infof("Config File: %s", configPath)
+	log.Infof("Options From Config File: %s", strings.Join(fromConfig, ", "))
+	log.Infof("Paths: %s", strings.Join(rootPaths, ", "))
+	log.Infof("Verify Only: %t", verifyOnly)
+	log.Infof("DB Cache MB: %d", dbCacheMB)
+	log.Infof("DB Temp Store: %s", dbTempStore)
+	log.Infof("DB Mmap MB: %d", dbMmapMB)
+	log.Infof("DB Busy Timeout: %s", dbBusyTimeout)
+	log.Infof("DB Driver: %s", database.DriverName)
+	log.Infof("DB Read Only: %t", dbReadOnly)
+	log.Infof("DB Prune: %t", !noDBPrune)
+	log.Infof("Audit Log: %s", auditLogPath)
+	log.Infof("Report: %s", reportPath)
+	log.Infof("Report Base64 Paths: %t", reportBase64)
+	log.Infof("Pre-File Command: %s", preFileCmd)
+	log.Infof("Post-File Command: %s", postFileCmd)
+	log.Infof("Abort On Hook Failure: %t", abortOnHookFail)
+	log.Infof("Webhooks: %d (events %s, timeout %s, %d retries)", len(webhooks), webhookEvents, webhookTimeout, webhookRetries)
 	log.Infof("Passes: %d", passesFlag)
 	log.Infof("Process Hardlinks: %t", processHardlinks)
+	log.Infof("Relink Hardlink Groups: %t", relinkHardlinks)
+	log.Infof("Clear Immutable Flags: %t", clearImmutable)
 	log.Infof("Concurrency: %s", concurrencyStr(concurrency))
+	log.Infof("Max Workers Per Dataset: %d", maxPerDataset)
+	log.Infof("Max Workers Per Pool: %d", maxPerPool)
+	log.Infof("Included Nested Mounts: %s", includeMounts.String())
+	log.Infof("One File System: %t", oneFileSystem)
+	log.Infof("Ignore Files: %t", !noIgnoreFiles)
+	log.Infof("Plan Only: %t", planMode)
+	log.Infof("Scan Only: %t", scanMode)
+	log.Infof("Files From: %s", filesFrom)
+	log.Infof("From Inventory: %t", fromInventory)
+	log.Infof("Inodes From: %s", inodesFrom)
+	log.Infof("Exclude Inodes From: %s", excludeInodesFrom)
 	log.Infof("Cleanup Balance Files: %t", !noCleanupBalance)
-	log.Infof("Random Order: %t", !noRandomOrder)
+	log.Infof("Temp Suffix: %s", tempSuffix)
+	log.Infof("Temp Subdir: %t", tempSubdir)
+	log.Infof("Order: %s", order)
+	log.Infof("Reuse File List: %t", reuseFileList)
+	log.Infof("Shuffle Passes: %t", shufflePasses)
+	log.Infof("Min Extents: %d", minExtents)
+	log.Infof("Reserve Free: %s", reserveFreeSpec)
 	log.Infof("Debug Logging: %t", debugLogging)
-	log.Infof("Size Threshold: %d MB", sizeThreshold)
-	log.Infof("Checksum Type: %s", checksumType)
+	log.Infof("Quiet: %t", quiet)
+	log.Infof("TUI: %t", tuiMode)
+	log.Infof("Status Address: %s", statusAddr)
+	log.Infof("Size Threshold: %s", &sizeThreshold)
+	log.Infof("Min Size: %s", &minSize)
+	log.Infof("Since: %s", &since)
+	log.Infof("Since Last Run: %t", sinceLastRun)
+	log.Infof("Max Size: %s", &maxSize)
+	log.Infof("Skip Larger Than: %s", &skipLargerThan)
+	if noVerify {
+		log.Infof("Checksum Type: none (verification disabled)")
+	} else if strings.ToLower(checksumType) == "xxh3" {
+		log.Infof("Checksum Type: %s (non-cryptographic: detects copy corruption, not tampering)", checksumType)
+	} else {
+		log.Infof("Checksum Type: %s", checksumType)
+	}
+	log.Infof("Checksum By Size: %s", checksumBySize)
 	log.Infof("Halt On Missing Files: %t", haltOnFileMissing)
+	log.Infof("Verification Mode: %s", verificationMode(noVerify, verifyReadback))
+	log.Infof("Verify After Replace: %t", verifyReplaced)
+	log.Infof("Sync Before Remove: %t", !noFsync)
+	log.Infof("Batch Size: %d", batchSize)
+	log.Infof("Recovery Directory: %s", recoveryDir)
+	log.Infof("ARC Throttle: %t", arcThrottle)
+	log.Infof("Background Verify: %t", backgroundVerify)
+	log.Infof("SSD Write Budget: %s", &ssdWriteBudget)
+	log.Infof("Temp File Timeout: %s", tempTimeout)
+	log.Infof("Requeue Stalled Files: %t", requeueStalled)
+	log.Infof("Retries: %d (backoff %s)", retries, retryBackoff)
+	log.Infof("Max Errors: %d", maxErrors)
+	log.Infof("Pool Bandwidth: %s", &poolBandwidth)
+	log.Infof("Lock Directory: %s", lockDir)
+	log.Infof("Force Unlock: %t", forceUnlock)
+	log.Infof("Only If Fragmentation Above: %d%%", onlyIfFragAbove)
+	log.Infof("Max Pool Capacity: %d%% (pause: %t)", maxPoolCapacity, pauseAtCapacity)
+	log.Infof("Max Bytes: %s", &maxBytes)
+	log.Infof("Max Runtime: %s", maxRuntime)
+	log.Infof("Window: %s", window)
+	log.Infof("Gentle: %t", gentle)
+	log.Infof("Max Procs: %d", runtime.GOMAXPROCS(0))
+	log.Infof("Hash Workers: %d", hashWorkers)
+	log.Infof("Memory Limit: %s", &memoryLimit)
 	log.Infof("Show Full Paths: %t", !showFullPaths)
-	log.Infof("SQLite DB Path: %s", db.Path)
+	log.Infof("Preserve Sparse Files: %t", !noSparse)
+	log.Infof("Cache Bypass: %s", cacheBypassName)
+	log.Infof("I/O Engine: %s", ioEngine)
+	log.Infof("Parallel Copy: %d streams for files of at least %s", parallelCopy, &parallelCopyAbove)
+	log.Infof("Chown Early: %t", chownEarly)
+	log.Infof("Defer Opened Within: %s", deferOpened)
+	log.Infof("Dirty Data Pacing: %t", !noDirtyPacing)
+	log.Infof("Units: %s", outputUnits)
+	log.Infof("Daemon: %t", daemonMode)
+	log.Infof("Interval: %s", interval)
+	log.Infof("Watch: %t", watchMode)
+	log.Infof("Watch Settle: %s", watchSettle)
+	log.Infof("Force Exit: %s", forceExit)
+	log.Infof("Shutdown Timeout: %s", shutdownTimeout)
 
 	// Set up log level filtering
-	if !debugLogging {
+	switch {
+	case quiet:
+		log.SetLevel(logrus.ErrorLevel) // Successes are logged as warnings, so this hides them too
+	case !debugLogging:
 		// Only show important messages when not in debug mode
 		log.SetLevel(logrus.WarnLevel) // Only show warnings and errors by default
-	} else {
+	default:
 		log.SetLevel(logrus.InfoLevel) // Show all messages in debug mode
 	}
 
+	// Make way for the other workloads on the pool
+	if gentle {
+		switch idleIO, err := sysinfo.LowerPriority(); {
+		case err != nil:
+			log.Warnf("--gentle: %v", err)
+		case !idleIO:
+			log.Warn("--gentle: lowered the CPU priority, but the idle I/O class is not available on this platform")
+		default:
+			log.Info("Lowered the CPU priority and switched to the idle I/O class")
+		}
+	}
+
 	// Convert checksum string to ChecksumType
-	var checksumTypeEnum fileutil.ChecksumType
-	switch strings.ToLower(checksumType) {
-	case "md5":
-		checksumTypeEnum = fileutil.ChecksumMD5
-	case "sha256":
-		checksumTypeEnum = fileutil.ChecksumSHA256
-	default:
-		log.Errorf("Invalid checksum type: %s. Must be sha256 or md5", checksumType)
+	checksumTypeEnum, err := fileutil.ParseChecksumType(checksumType)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	checksumRules, err := rebalance.ParseChecksumRules(checksumBySize)
+	if err != nil {
+		log.Errorf("Invalid --checksum-by-size: %v", err)
 		os.Exit(1)
 	}
 
-	// Calculate the actual concurrency to use
-	actualConcurrency := calculateConcurrency(concurrency)
+	// Load the inode selection lists
+	var includeInodes, excludeInodes *rebalance.InodeSet
+	if inodesFrom != "" {
+		includeInodes, err = rebalance.LoadInodeSet(inodesFrom)
+		if err != nil {
+			log.Errorf("Failed to read inode list %s: %v", inodesFrom, err)
+			os.Exit(1)
+		}
+		log.Infof("Loaded %d inodes to rebalance from %s", includeInodes.Len(), inodesFrom)
+	}
+	if excludeInodesFrom != "" {
+		excludeInodes, err = rebalance.LoadInodeSet(excludeInodesFrom)
+		if err != nil {
+			log.Errorf("Failed to read inode list %s: %v", excludeInodesFrom, err)
+			os.Exit(1)
+		}
+		log.Infof("Loaded %d inodes to skip from %s", excludeInodes.Len(), excludeInodesFrom)
+	}
 
-	config := &rebalance.Config{
-		SkipHardlinks:       !processHardlinks,
-		PassesLimit:         passesFlag,
-		Concurrency:         actualConcurrency,
-		RootPath:            rootPath,
-		Logger:              log,
-		CleanupBalanceFiles: !noCleanupBalance,
-		RandomOrder:         !noRandomOrder,
-		SizeThresholdMB:     sizeThreshold,
-		ChecksumType:        checksumTypeEnum,
-		HaltOnFileMissing:   haltOnFileMissing,
-		ShowFullPaths:       !showFullPaths,
+	// Load the list of files replacing the scan
+	var listedFiles []string
+	if filesFrom != "" {
+		listedFiles, err = rebalance.LoadFileList(filesFrom)
+		if err != nil {
+			log.Errorf("Failed to read file list %s: %v", filesFrom, err)
+			os.Exit(1)
+		}
+		log.Infof("Loaded %d files to rebalance from %s", len(listedFiles), filesFrom)
 	}
 
-	rebalancer := rebalance.NewRebalancer(config, db)
+	// Open the audit log before anything can be removed
+	var auditLog *rebalance.AuditLog
+	if auditLogPath != "" {
+		auditLog, err = rebalance.OpenAuditLog(auditLogPath)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+	}
 
-	// Set up signal handling for graceful shutdown
+	// Calculate the actual concurrency to use
+	actualConcurrency := calculateConcurrency(concurrency)
+
+	// Set up signal handling for graceful shutdown. The first signal stops the daemon
+	// schedule and asks the current run to finish the files in progress.
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	live := &runState{}
+
+	// Webhooks are posted from goroutines of their own; Close delivers those still queued
+	hooks := make([]notify.Webhook, 0, len(webhooks))
+	for _, u := range webhooks {
+		hooks = append(hooks, notify.Webhook{URL: u, Events: selectedEvents})
+	}
+	notifier := newRunNotifier(notify.New(hooks, notify.Options{
+		Timeout: webhookTimeout,
+		Retries: webhookRetries,
+		Logger:  log,
+	}), rootPaths, outputUnits)
+
+	// Errors are collected for the dashboards, which hide or outlive the log
+	recentErrors := tui.NewRecentErrors(50)
+	if tuiMode || statusAddr != "" {
+		log.AddHook(recentErrors)
+	}
+	if statusAddr != "" {
+		serveCtx, stopServing := context.WithCancel(context.Background())
+		defer stopServing()
+		err := startStatusServer(serveCtx, log, statusAddr, func() status.Snapshot {
+			return statusSnapshot(live, rootPaths, daemonMode, recentErrors)
+		})
+		if err != nil {
+			log.Errorf("Cannot serve the status dashboard: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	// Create a done channel that will be closed when we need to force exit
 	done := make(chan struct{})
@@ -430,153 +1405,513 @@ func main() {
 		log.Warnf("%sReceived signal %v, initiating graceful shutdown...%s", colorYellow, sig, colorReset)
 
 		// Signal the rebalancer to start graceful shutdown
-		rebalancer.InitiateShutdown()
+		stop()
+		if r := live.current(); r != nil {
+			r.InitiateShutdown()
+		}
 
-		// Start a timer to force exit if shutdown takes too long
-		go func() {
-			// Give processes 90 seconds to clean up
-			time.Sleep(90 * time.Second)
-			log.Warn("Shutdown timeout reached, forcing exit")
-			close(done)
-		}()
+		// Force the exit as the policy says if the files in progress take too long
+		var timeout <-chan time.Time
+		if forceExit == forceExitTimeout {
+			timeout = time.After(shutdownTimeout)
+		}
+		for {
+			select {
+			case sig := <-signalChan:
+				if forceExit == forceExitSignal {
+					log.Warnf("Received signal %v again, forcing exit", sig)
+					close(done)
+					return
+				}
+				log.Warnf("Received signal %v again: still finishing the files in progress (--force-exit %s)", sig, forceExit)
+			case <-timeout:
+				log.Warn("Shutdown timeout reached, forcing exit")
+				close(done)
+				return
+			}
+		}
 	}()
 
-	// Create a shared progress tracker
-	progressChan := make(chan int, 100)
-	files, err := rebalancer.GetFiles()
-	if err != nil {
-		log.Errorf("Error getting file list: %v", err)
-		os.Exit(1)
-	}
-	totalFiles := len(files)
-	processedFiles := 0
+	// runOnce rebalances the paths once and returns the exit status. Daemon mode calls
+	// it on every scheduled run, each with a fresh database unless --db-path is set.
+	runOnce := func() int {
+		// Open DB in a temp directory unless a persistent location was given
+		db, err := database.OpenSQLiteDBWithOptions(dbPath, database.Options{
+			CacheSizeMB: dbCacheMB,
+			TempStore:   dbTempStore,
+			MmapSizeMB:  dbMmapMB,
+			ReadOnly:    dbReadOnly,
+			BusyTimeout: dbBusyTimeout,
+		})
+		if err != nil {
+			log.Errorf("Failed to open SQLite DB: %v", err)
+			return 1
+		}
 
-	// Get pass information
-	currentPass, totalPasses := rebalancer.GetPassInfo()
+		// Clean up
+		defer func() {
+			_ = db.Close(dbPath == "") // remove the DB directory only if it is temporary
+		}()
+
+		log.Infof("SQLite DB Path: %s", db.Path)
 
-	// Function to print progress report
-	printProgress := func() {
-		// Calculate completion percentage for the current pass
-		currentPassPercentage := 0
-		if totalFiles > 0 {
-			currentPassPercentage = int(float64(processedFiles) / float64(totalFiles) * 100)
+		// Pick up where the last complete run started; daemon mode looks again every run
+		modifiedSince := since.t
+		if sinceLastRun {
+			runs, err := db.Runs()
+			if err != nil {
+				log.Errorf("Cannot read the runs recorded in %s: %v", dbPath, err)
+				return 1
+			}
+			if last, ok := rebalance.LastCompleteRun(runs, rootPaths); ok {
+				modifiedSince = last
+				log.Warnf("Only rebalancing files modified since the last complete run, started %s", last.Format("2006-01-02 15:04:05"))
+			} else {
+				log.Warnf("No complete run of these paths recorded in %s: rebalancing every file", dbPath)
+			}
 		}
 
-		// Calculate overall completion percentage across all passes
-		overallPercentage := 0
-		if totalPasses > 0 && totalFiles > 0 {
-			passWeight := 100.0 / float64(totalPasses)
-			overallPercentage = int(float64(currentPass-1)*passWeight + float64(currentPassPercentage)*passWeight/100.0)
+		// Take the work list from the last scan; daemon mode reads it again every run
+		listed := listedFiles
+		if fromInventory {
+			var scanned time.Time
+			listed, scanned, err = rebalance.InventoryFiles(db, rootPaths)
+			if err != nil {
+				log.Errorf("%v", err)
+				return 1
+			}
+			log.Infof("Loaded %d files to rebalance from the inventory scanned %s", len(listed), scanned.Format("2006-01-02 15:04:05"))
 		}
 
-		// Print progress in blue and bold with pass information
-		fmt.Printf("%s %s%s%sPass %d of %d: %d/%d files (%d%% of pass, %d%% overall)%s\n",
-			time.Now().Format("3:04:05 PM"),
-			colorBlue, colorBold, "",
-			currentPass, totalPasses,
-			processedFiles, totalFiles,
-			currentPassPercentage,
-			overallPercentage,
-			colorReset)
-	}
+		config := &rebalance.Config{
+			SkipHardlinks:        !processHardlinks,
+			PassesLimit:          passesFlag,
+			Concurrency:          actualConcurrency,
+			RootPaths:            rootPaths,
+			Logger:               log,
+			CleanupBalanceFiles:  !noCleanupBalance,
+			TempSuffix:           tempSuffix,
+			TempSubdir:           tempSubdir,
+			Order:                order,
+			ReuseFileList:        reuseFileList,
+			ShufflePasses:        shufflePasses,
+			MinExtents:           minExtents,
+			ReserveFree:          reserveFree,
+			SizeThreshold:        sizeThreshold.bytes,
+			MinSize:              minSize.bytes,
+			Since:                modifiedSince,
+			MaxSize:              maxSize.bytes,
+			SkipLargerThan:       skipLargerThan.bytes,
+			ChecksumType:         checksumTypeEnum,
+			ChecksumBySize:       checksumRules,
+			HashWorkers:          hashWorkers,
+			HaltOnFileMissing:    haltOnFileMissing,
+			ShowFullPaths:        !showFullPaths,
+			Units:                outputUnits,
+			PreserveSparse:       !noSparse,
+			CacheBypass:          cacheBypass,
+			IOEngine:             ioEngine,
+			ParallelCopy:         parallelCopy,
+			ParallelCopyMinSize:  parallelCopyAbove.bytes,
+			ChownEarly:           chownEarly,
+			DeferOpenedWithin:    deferOpened,
+			PaceDirty:            !noDirtyPacing,
+			RelinkHardlinks:      relinkHardlinks,
+			ClearProtection:      clearImmutable,
+			MaxWorkersPerDataset: maxPerDataset,
+			MaxWorkersPerPool:    maxPerPool,
+			IncludeMounts:        includeMounts,
+			OneFileSystem:        oneFileSystem,
+			NoIgnoreFiles:        noIgnoreFiles,
+			BackgroundVerify:     backgroundVerify,
+			NoVerify:             noVerify,
+			NoSync:               noFsync,
+			VerifyReadback:       verifyReadback,
+			VerifyAfterReplace:   verifyReplaced,
+			BatchSize:            batchSize,
+			RecoveryDir:          recoveryDir,
+			ARCThrottle:          arcThrottle,
+			MaxPoolCapacity:      maxPoolCapacity,
+			PauseAtCapacity:      pauseAtCapacity,
+			MaxBytes:             maxBytes.bytes,
+			MaxRuntime:           maxRuntime,
+			Window:               window,
+			RecordChecksums:      dbPath != "",
+			TempFileTimeout:      tempTimeout,
+			RequeueStalled:       requeueStalled,
+			SSDWriteBudget:       ssdWriteBudget.bytes,
+			ReportFiles:          reportPath != "",
+			Files:                listed,
+			OrderListedFiles:     fromInventory,
+			IncludeInodes:        includeInodes,
+			ExcludeInodes:        excludeInodes,
+			AuditLog:             auditLog,
+			Hooks:                rebalance.CommandHooks(preFileCmd, postFileCmd, abortOnHookFail),
+			Retries:              retries,
+			MaxErrors:            maxErrors,
+			RetryBackoff:         retryBackoff,
+			PoolBandwidth:        poolBandwidth.bytes,
+			BandwidthStateDir:    bandwidthStateDir,
+		}
 
-	// Show initial progress
-	printProgress()
+		config.Hooks.MaxErrors = notifier.errorThreshold
+		rebalancer := rebalance.NewRebalancer(config, db)
+		// A signal received before the Rebalancer was published canceled ctx already
+		live.setRebalancer(rebalancer)
+		if ctx.Err() != nil {
+			rebalancer.InitiateShutdown()
+		}
+		live.running.Store(true)
+		defer live.running.Store(false)
+
+		// Keep other instances off these trees while files are being replaced. The locks are
+		// also released explicitly before a forced os.Exit, which skips deferred calls.
+		var instanceLocks []*instancelock.Lock
+		releaseLocks := func() {
+			for _, l := range instanceLocks {
+				l.Release()
+			}
+		}
+		defer releaseLocks()
+		if !verifyOnly && !planMode && !scanMode {
+			// Let an unconditional cron entry do nothing while no pool is fragmented enough
+			if onlyIfFragAbove > 0 {
+				frags, err := rebalancer.PoolFragmentation()
+				if err != nil {
+					log.Errorf("Cannot check pool fragmentation: %v", err)
+					return 1
+				}
+				fragmented := false
+				for pool, frag := range frags {
+					if frag > onlyIfFragAbove {
+						log.Infof("Pool %s is %d%% fragmented, above %d%%: rebalancing", pool, frag, onlyIfFragAbove)
+						fragmented = true
+					} else {
+						log.Infof("Pool %s is %d%% fragmented, not above %d%%", pool, frag, onlyIfFragAbove)
+					}
+				}
+				if !fragmented {
+					log.Warnf("No pool is more than %d%% fragmented: nothing to do", onlyIfFragAbove)
+					return 0
+				}
+			}
 
-	// Start a periodic progress reporter
-	progressReporter := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
+			if err := rebalancer.Preflight(); err != nil {
+				log.Errorf("Preflight check failed: %v", err)
+				return 1
+			}
 
-		for {
-			select {
-			case <-ticker.C:
-				printProgress()
+			if lockDir == "" {
+				lockDir = instancelock.DefaultDir()
+			}
+			for _, rootPath := range rootPaths {
+				lock, err := instancelock.Acquire(lockDir, rootPath, forceUnlock)
+				var locked *instancelock.LockedError
+				if errors.As(err, &locked) && locked.Stale {
+					log.Errorf("%v; rerun with --force-unlock to remove it", err)
+					return 1
+				} else if errors.As(err, &locked) && daemonMode {
+					// Another instance got there first; try again at the next scheduled run
+					log.Warnf("Skipping this run: %v", err)
+					return 0
+				} else if err != nil {
+					log.Errorf("Cannot lock %s: %v", rootPath, err)
+					return 1
+				}
+				instanceLocks = append(instanceLocks, lock)
+				for _, h := range lock.Removed {
+					log.Warnf("Removed stale lock of pid %d on %s, started %s", h.PID, h.Root, h.Started.Format(time.RFC3339))
+				}
+			}
+		}
 
-			case count := <-progressChan:
-				processedFiles = count
+		// Print the work list without touching anything
+		if planMode {
+			plan, err := rebalancer.Plan()
+			if err != nil {
+				log.Errorf("Cannot plan: %v", err)
+				return 1
+			}
+			out := bufio.NewWriter(os.Stdout)
+			for _, e := range plan {
+				fmt.Fprintln(out, e.String())
+			}
+			if err := out.Flush(); err != nil {
+				log.Errorf("Cannot write plan: %v", err)
+				return 1
+			}
+			log.Infof("Planned %d files", len(plan))
+			return 0
+		}
 
-			case <-progressReporter:
-				return
+		// Record the work list for a later run without touching anything
+		if scanMode {
+			n, scanned, err := rebalancer.Scan()
+			if err != nil {
+				log.Errorf("Scan failed: %v", err)
+				return 1
 			}
+			log.Warnf("Recorded %d files (%s) in the inventory of %s", n, outputUnits.Size(uint64(scanned)), dbPath)
+			return 0
 		}
-	}()
 
-	// Track if any passes had failures
-	overallFailure := false
+		// Audit stored checksums without copying anything
+		if verifyOnly {
+			report, err := rebalancer.VerifyOnly()
+			if err != nil {
+				log.Errorf("Verify-only run failed: %v", err)
+			}
+			printVerifyReport(report)
+			if err != nil || len(report.Mismatched) > 0 || report.Failed > 0 {
+				return 1
+			}
+			return 0
+		}
 
-	// Run all passes in sequence
-	for pass := currentPass; pass <= totalPasses; pass++ {
-		// Reset for the new pass
-		processedFiles = 0
+		// Create a shared progress tracker, filled in by the reporter as passes start
+		progressChan := make(chan rebalance.Progress, 100)
+		totalFiles := 0
+		processedFiles := 0
+		notifier.started()
+
+		// Plan the passes up to the limit; the run stops early once every file reached it
+		currentPass, totalPasses := 1, passesFlag
+		if totalPasses <= 0 {
+			// No limit on the count, so a large number of passes
+			totalPasses = 999
+		}
 
-		// Get updated file list (some may have reached pass limit)
-		files, err = rebalancer.GetFiles()
-		if err != nil {
-			log.Errorf("Error getting file list for pass %d: %v", pass, err)
-			overallFailure = true
-			break
+		// The dashboard replaces the log and the progress lines until the summary
+		var dash *dashboard
+		if tuiMode {
+			dash, err = openDashboard(log, rebalancer, live, recentErrors, rootPaths, outputUnits)
+			if err != nil {
+				log.Errorf("Cannot show the dashboard: %v", err)
+				return 1
+			}
+			defer dash.Close()
 		}
 
-		totalFiles = len(files)
-		if totalFiles == 0 {
-			log.Infof("No files to process in pass %d.", pass)
-			break
+		// passRunning is set while the byte progress of the Rebalancer is the current pass's
+		var passRunning atomic.Bool
+
+		// Function to print progress report
+		printProgress := func() {
+			if quiet || dash != nil {
+				return
+			}
+
+			// Calculate completion percentage for the current pass, by bytes once the run
+			// knows them: a few large files can take most of the time
+			currentPassPercentage := 0
+			data := ""
+			if bytes := rebalancer.ByteProgress(); passRunning.Load() && bytes.Total > 0 {
+				currentPassPercentage = int(bytes.Fraction() * 100)
+				data = fmt.Sprintf(", %s of %s", outputUnits.Size(uint64(bytes.Done)), outputUnits.Size(uint64(bytes.Total)))
+				if bytes.ETA > 0 {
+					data += fmt.Sprintf(" at %s, ETA %s", outputUnits.Rate(bytes.Rate), formatETA(bytes.ETA))
+				}
+			} else if totalFiles > 0 {
+				currentPassPercentage = int(float64(processedFiles) / float64(totalFiles) * 100)
+			}
+
+			// Calculate overall completion percentage across all passes
+			overallPercentage := 0
+			if totalPasses > 0 && totalFiles > 0 {
+				passWeight := 100.0 / float64(totalPasses)
+				overallPercentage = int(float64(currentPass-1)*passWeight + float64(currentPassPercentage)*passWeight/100.0)
+			}
+
+			// Print progress in blue and bold with pass information
+			fmt.Printf("%s %s%s%sPass %d of %d: %d/%d files (%d%% of pass, %d%% overall)%s%s\n",
+				time.Now().Format("3:04:05 PM"),
+				colorBlue, colorBold, "",
+				currentPass, totalPasses,
+				processedFiles, totalFiles,
+				currentPassPercentage,
+				overallPercentage,
+				data,
+				colorReset)
+
+			// Pool throughput driven by the tool, over all files and passes so far
+			if t := rebalancer.Throughput(); t.BytesRead > 0 || t.BytesWritten > 0 {
+				fmt.Printf("%s %s%sThroughput: read %s (1m), %s (5m); write %s (1m), %s (5m); %s read, %s written%s\n",
+					time.Now().Format("3:04:05 PM"),
+					colorBlue, colorBold,
+					outputUnits.Rate(t.Read1m), outputUnits.Rate(t.Read5m),
+					outputUnits.Rate(t.Write1m), outputUnits.Rate(t.Write5m),
+					outputUnits.Size(uint64(t.BytesRead)), outputUnits.Size(uint64(t.BytesWritten)),
+					colorReset)
+			}
 		}
 
-		// Get updated pass info
-		currentPass, _ = rebalancer.GetPassInfo()
+		// Start a periodic progress reporter, which follows the passes of the run until
+		// progressChan is closed
+		progressReporter := make(chan struct{})
+		reporterDone := make(chan struct{})
+		go func() {
+			defer close(reporterDone)
+			ticker := time.NewTicker(1 * time.Minute)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					printProgress()
+
+				case p, ok := <-progressChan:
+					if !ok {
+						return
+					}
+					if p.Pass != currentPass || totalFiles == 0 {
+						// Show progress update with new pass info
+						currentPass, totalFiles = p.Pass, p.FilesTotal
+						processedFiles = 0
+						printProgress()
+					}
+					processedFiles = p.FilesDone
+
+				case <-progressReporter:
+					return
+				}
+			}
+		}()
 
-		// Skip iteration if we've moved beyond our intended pass
-		// (could happen if another process has incremented file counts)
-		if currentPass > pass {
-			continue
+		// forcedExit abandons the files in progress after a timeout or a second signal
+		forcedExit := func() {
+			log.Error("Forced exit: the files in progress were not finished")
+			removed, kept := rebalancer.AbandonInflight(forcedCleanupWait)
+			for _, tmpPath := range removed {
+				log.Warnf("Removed the unfinished copy %s", tmpPath)
+			}
+			for _, filePath := range kept {
+				log.Errorf("Left the copy of %s in place: it was replacing the original, check the file and its temporary copy", filePath)
+			}
+			printSummary(rebalancer.Summary(), outputUnits)
+			writeReport(log, reportPath, reportBase64, rebalancer)
+			releaseLocks()
+			notifier.finished(rebalancer.Summary(), true)
+			notifier.Close()
+			os.Exit(1)
 		}
 
-		// Show progress update with new pass info
-		printProgress()
+		// Track if any passes had failures
+		overallFailure := false
 
-		// Run the current pass
-		log.Infof("Starting pass %d of %d with %d files", currentPass, totalPasses, totalFiles)
+		// Run the passes; a pass skips the files that reached the limit
+		config.Passes = totalPasses
 
 		// Run the rebalancer in a goroutine
-		passDone := make(chan struct{})
+		runDone := make(chan struct{})
+		passRunning.Store(true)
 		go func() {
 			err = rebalancer.Run(progressChan)
-			close(passDone)
+			close(runDone)
 		}()
 
 		// Wait for either rebalancer to finish or a forced exit
 		select {
-		case <-passDone:
-			// Normal completion - print final progress for this pass
+		case <-runDone:
+			// Normal completion - print final progress once the reporter caught up
+			close(progressChan)
+			<-reporterDone
 			printProgress()
 
-			// Check for errors in this pass
 			if err != nil {
-				log.Warnf("Pass %d completed with some failures: %v", currentPass, err)
+				log.Warnf("Passes completed with some failures: %v", err)
 				overallFailure = true
-			} else {
-				log.Infof("Pass %d completed successfully", currentPass)
 			}
 
 		case <-done:
-			// Forced exit due to timeout
 			close(progressReporter)
-			log.Error("Forced exit: rebalance operation did not complete gracefully in time")
-			os.Exit(1)
+			if dash != nil {
+				dash.Close()
+			}
+			forcedExit()
 		}
-	}
 
-	// Stop the progress reporter
-	close(progressReporter)
+		// Stop the progress reporter
+		close(progressReporter)
+		if dash != nil {
+			dash.Close()
+		}
 
-	// Show completion message
-	if overallFailure {
-		log.Error("Some files failed to rebalance during one or more passes")
-		os.Exit(1)
-	} else {
+		// Keep up with the files written from now on until a shutdown
+		if summary := rebalancer.Summary(); watchMode && !summary.Interrupted && !summary.TooManyErrors && !summary.PoolFull {
+			watchDone := make(chan struct{})
+			go func() {
+				err = rebalancer.Watch(ctx, watchSettle)
+				close(watchDone)
+			}()
+			select {
+			case <-watchDone:
+				if err != nil {
+					log.Errorf("Watch stopped: %v", err)
+					overallFailure = true
+				}
+			case <-done:
+				forcedExit()
+			}
+		}
+
+		// Keep a record of the run for "rebalance stats", when the database outlives it
+		if dbPath != "" {
+			if err := rebalancer.RecordRun(); err != nil {
+				log.Errorf("%v", err)
+			}
+		}
+
+		// Forget the files deleted since they were counted; an interrupted run may not
+		// have seen the tree as it is
+		if dbPath != "" && !noDBPrune && !rebalancer.Summary().Interrupted {
+			pruned, err := rebalancer.PruneDatabase()
+			if err != nil {
+				log.Errorf("%v", err)
+			} else if pruned.Removed() > 0 || pruned.Moved > 0 {
+				log.Infof("Pruned %d pass counts, %d checksums, %d recovered files and %d inventory entries of deleted files from the database, moved %d pass counts to renamed files",
+					pruned.Rebalances, pruned.Checksums, pruned.Recovered, pruned.Inventory, pruned.Moved)
+			}
+		}
+
+		printSummary(rebalancer.Summary(), outputUnits)
+		writeReport(log, reportPath, reportBase64, rebalancer)
+		notifier.finished(rebalancer.Summary(), overallFailure)
+
+		// Show completion message
+		if overallFailure {
+			log.Error("Some files failed to rebalance during one or more passes")
+			return 1
+		}
 		log.Info("All passes completed successfully")
+		return 0
 	}
+
+	if !daemonMode {
+		status := runOnce()
+		notifier.Close()
+		if status != 0 {
+			os.Exit(status)
+		}
+		return
+	}
+
+	runs := 0
+	schedule := &daemon.Schedule{
+		Interval: interval,
+		Skipped: func(missed int, next time.Time) {
+			log.Warnf("The last run outlasted --interval: skipped %d scheduled run(s)", missed)
+		},
+		Idle: func(next time.Time) {
+			log.Warnf("Idle after %d run(s), next run at %s", runs, next.Format("2006-01-02 15:04:05"))
+		},
+	}
+	schedule.Run(ctx, func(context.Context) {
+		runs++
+		log.Warnf("Starting scheduled run %d", runs)
+		if status := runOnce(); status != 0 {
+			log.Errorf("Scheduled run %d failed", runs)
+		}
+	})
+	notifier.Close()
+	log.Warnf("Daemon stopped after %d run(s)", runs)
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
+	"github.com/sirupsen/logrus"
+)
+
+// prepareRecoveryDir creates the --recovery-dir and returns its absolute path. It must
+// not lie below a root path, where saved copies would be rebalanced; warning notes that
+// it shares a filesystem with a root path, which leaves the copies on the same dataset.
+func prepareRecoveryDir(dir string, rootPaths []string) (abs, warning string, err error) {
+	abs, err = filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for _, root := range rootPaths {
+		rootAbs, err := filepath.Abs(root)
+		if err != nil {
+			return "", "", err
+		}
+		if rel, err := filepath.Rel(rootAbs, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", "", fmt.Errorf("%s lies below the root path %s", abs, root)
+		}
+	}
+
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", "", err
+	}
+	dirID, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		return abs, "", nil
+	}
+	for _, root := range rootPaths {
+		rootInfo, err := os.Stat(root)
+		if err != nil {
+			continue
+		}
+		if rootID, err := fileutil.GetFileIDFromFileInfo(rootInfo); err == nil && rootID.Dev == dirID.Dev {
+			return abs, fmt.Sprintf("%s is on the same filesystem as %s, so a failing dataset may hold the saved copies too", abs, root), nil
+		}
+	}
+	return abs, "", nil
+}
+
+// runRecoverCommand runs "rebalance recover [options] PATH..." and returns the exit
+// status: 1 if any copy found was left where it is
+func runRecoverCommand(log *logrus.Logger, args []string) int {
+	fs := flag.NewFlagSet("recover", flag.ContinueOnError)
+	dbPath := fs.String("db-path", "", "State database of the runs, for the copies it registered and the checksums it stored")
+	auditLogPath := fs.String("audit-log", "", "Audit log of the runs, for the checksums of the removed originals")
+	tempSuffix := fs.String("temp-suffix", rebalance.DefaultTempSuffix, "Suffix of the temporary copies of the runs")
+	tempSubdir := fs.Bool("temp-subdir", false, "The runs made their temporary copies in "+rebalance.TempSubdirName+" directories")
+	dryRun := fs.Bool("dry-run", false, "Find and validate the copies without restoring them")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println("  rebalance recover [--db-path FILE] [--audit-log FILE] [--temp-suffix S] [--temp-subdir] [--dry-run] PATH...")
+		fmt.Println()
+		fmt.Println("Restore the copies that runs left in place of removed originals: the NAME.recovered")
+		fmt.Println("copies of failed renames and the copies registered in the database, and temporary")
+		fmt.Println("copies whose original is missing. A copy is only restored when it matches the checksum")
+		fmt.Println("recorded in the database or the audit log, and its original is still missing.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+	if err := rebalance.CheckTempSuffix(*tempSuffix); err != nil {
+		log.Errorf("Invalid --temp-suffix: %v", err)
+		return 1
+	}
+	for _, path := range fs.Args() {
+		if _, err := os.Stat(path); err != nil {
+			log.Errorf("Cannot recover below %s: %v", path, err)
+			return 1
+		}
+	}
+
+	var db *database.DB
+	var err error
+	if *dbPath != "" {
+		db, err = database.OpenSQLiteDBWithOptions(*dbPath, database.Options{ReadOnly: *dryRun})
+	} else {
+		db, err = database.OpenSQLiteDB()
+	}
+	if err != nil {
+		log.Errorf("Cannot open the database: %v", err)
+		return 1
+	}
+	defer db.Close(*dbPath == "")
+
+	var auditLog *rebalance.AuditLog
+	if *auditLogPath != "" {
+		// Opened for appending, the restores are recorded as renames
+		if _, err := os.Stat(*auditLogPath); err != nil {
+			log.Errorf("Cannot read the audit log: %v", err)
+			return 1
+		}
+		if auditLog, err = rebalance.OpenAuditLog(*auditLogPath); err != nil {
+			log.Errorf("%v", err)
+			return 1
+		}
+		defer auditLog.Close()
+	}
+
+	rebalancer := rebalance.NewRebalancer(&rebalance.Config{
+		RootPaths:  fs.Args(),
+		Logger:     log,
+		TempSuffix: *tempSuffix,
+		TempSubdir: *tempSubdir,
+		AuditLog:   auditLog,
+	}, db)
+	copies, err := rebalancer.RecoverCopies(context.Background(), *dryRun)
+	if err != nil {
+		log.Errorf("Recovery failed: %v", err)
+		return 1
+	}
+
+	restored, verified, left := 0, 0, 0
+	for _, c := range copies {
+		switch {
+		case c.Restored:
+			restored++
+		case c.Err != nil:
+			left++
+		case c.Verified:
+			verified++
+		}
+	}
+	switch {
+	case len(copies) == 0:
+		log.Info("No copies to recover")
+	case *dryRun:
+		log.Infof("Found %d copies: %d would be restored, %d cannot be", len(copies), verified, left)
+	default:
+		log.Infof("Found %d copies: %d restored, %d left where they are", len(copies), restored, left)
+	}
+	if left > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
+	"github.com/sirupsen/logrus"
+)
+
+// runStatsCommand runs "rebalance stats [options]" and returns the exit status
+func runStatsCommand(log *logrus.Logger, args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	dbPath := fs.String("db-path", "", "State database the runs were recorded in")
+	allRuns := fs.Bool("all-runs", false, "Aggregate every recorded run instead of showing the last one")
+	by := fs.String("by", "month", "Group the throughput and error trend by day, week or month")
+	unitsName := fs.String("units", "binary", "Units of sizes and speeds: binary, si, binary-bits or si-bits")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println("  rebalance stats --db-path FILE [--all-runs] [--by day|week|month] [--units UNITS]")
+		fmt.Println()
+		fmt.Println("Show the last run recorded in a state database, or with --all-runs the totals of every")
+		fmt.Println("run, per dataset and per period.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *dbPath == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 1
+	}
+	period, err := rebalance.ParsePeriod(*by)
+	if err != nil {
+		log.Errorf("Invalid --by: %v", err)
+		return 1
+	}
+	u, err := units.Parse(*unitsName)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+
+	db, err := database.OpenSQLiteDBWithOptions(*dbPath, database.Options{ReadOnly: true})
+	if err != nil {
+		log.Errorf("Cannot open %s: %v", *dbPath, err)
+		return 1
+	}
+	defer db.Close(false)
+	runs, err := db.Runs()
+	if err != nil {
+		log.Errorf("Cannot read the runs of %s: %v", *dbPath, err)
+		return 1
+	}
+	if len(runs) == 0 {
+		fmt.Printf("No runs recorded in %s\n", *dbPath)
+		return 0
+	}
+
+	if !*allRuns {
+		printRun(runs[len(runs)-1], u)
+		return 0
+	}
+	printHistory(rebalance.SummarizeRuns(runs, period), period, u)
+	return 0
+}
+
+// printRun prints the totals of one recorded run
+func printRun(run database.RunRecord, u units.Units) {
+	status := ""
+	if run.Interrupted {
+		status = " (interrupted)"
+	}
+	totals := rebalance.HistoryTotals{
+		FilesRebalanced: run.FilesRebalanced,
+		BytesRebalanced: run.BytesRebalanced,
+		FilesSkipped:    run.FilesSkipped,
+		FilesFailed:     run.FilesFailed,
+		Duration:        run.Finished.Sub(run.Started),
+	}
+
+	fmt.Printf("Last run%s: %s, %s\n", status, run.Started.Local().Format("2006-01-02 15:04:05"), strings.Join(run.Paths, " "))
+	printTotals(totals, u)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nDataset\tFiles\tData\tSkipped\tFailed")
+	for _, d := range run.Datasets {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\n", d.Dataset, d.FilesRebalanced, u.Size(uint64(d.BytesRebalanced)), d.FilesSkipped, d.FilesFailed)
+	}
+	w.Flush()
+}
+
+// printHistory prints the totals of every recorded run, per dataset and per period
+func printHistory(h rebalance.History, period rebalance.Period, u units.Units) {
+	fmt.Printf("Runs: %d (%d interrupted), from %s to %s\n", h.Runs, h.Interrupted,
+		h.First.Local().Format("2006-01-02"), h.Last.Local().Format("2006-01-02"))
+	printTotals(h.HistoryTotals, u)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nDataset\tRuns\tFiles\tData\tFailed\tError rate")
+	for _, d := range h.Datasets {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%.2f%%\n", d.Dataset, d.Runs, d.FilesRebalanced,
+			u.Size(uint64(d.BytesRebalanced)), d.FilesFailed, d.ErrorRate()*100)
+	}
+	fmt.Fprintf(w, "\n%s\tRuns\tFiles\tData\tThroughput\tError rate\n", strings.ToUpper(string(period[:1]))+string(period[1:]))
+	for _, p := range h.Periods {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%.2f%%\n", p.Label, p.Runs, p.FilesRebalanced,
+			u.Size(uint64(p.BytesRebalanced)), u.Rate(p.BytesPerSecond()), p.ErrorRate()*100)
+	}
+	w.Flush()
+}
+
+// printTotals prints the amount rewritten, the time it took and the failures
+func printTotals(t rebalance.HistoryTotals, u units.Units) {
+	fmt.Printf("Rewritten: %s in %d files over %s, %s on average\n",
+		u.Size(uint64(t.BytesRebalanced)), t.FilesRebalanced, t.Duration.Round(time.Second), u.Rate(t.BytesPerSecond()))
+	fmt.Printf("Failed: %d of %d files processed (%.2f%%), %d skipped\n",
+		t.FilesFailed, t.FilesRebalanced+t.FilesSkipped+t.FilesFailed, t.ErrorRate()*100, t.FilesSkipped)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/status"
+	"github.com/astundzia/go-zfs-rebalance/internal/tui"
+	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
+	"github.com/sirupsen/logrus"
+)
+
+// runState is what the dashboards show of the runs: the current Rebalancer and whether
+// it is running
+type runState struct {
+	mu         sync.Mutex
+	rebalancer *rebalance.Rebalancer
+
+	running atomic.Bool
+}
+
+// setRebalancer makes r the Rebalancer of the current run
+func (s *runState) setRebalancer(r *rebalance.Rebalancer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rebalancer = r
+}
+
+// current returns the Rebalancer of the current or last run, nil before the first
+func (s *runState) current() *rebalance.Rebalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebalancer
+}
+
+// formatETA rounds an estimate to what is worth showing: seconds in the last hour,
+// minutes before
+func formatETA(d time.Duration) string {
+	if d >= time.Hour {
+		return d.Round(time.Minute).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// fileSpeed is the average copy rate of a file in progress
+func fileSpeed(f rebalance.ActiveFile, now time.Time) float64 {
+	if elapsed := now.Sub(f.Started).Seconds(); elapsed > 0 {
+		return float64(f.Copied) / elapsed
+	}
+	return 0
+}
+
+// statusSnapshot describes the runs for the web dashboard
+func statusSnapshot(s *runState, rootPaths []string, daemonMode bool, errors *tui.RecentErrors) status.Snapshot {
+	snap := status.Snapshot{
+		Title:  strings.Join(rootPaths, " "),
+		State:  status.StateStarting,
+		Errors: errors.Lines(),
+	}
+	r := s.current()
+	if r == nil {
+		return snap
+	}
+
+	stats := r.Stats()
+	switch {
+	case !s.running.Load() && daemonMode:
+		snap.State = status.StateIdle
+	case !s.running.Load():
+		snap.State = status.StateFinished
+	case stats.Interrupted:
+		snap.State = status.StateStopping
+	case r.Paused():
+		snap.State = status.StatePaused
+	default:
+		snap.State = status.StateRunning
+	}
+	snap.Pass, snap.Passes = stats.Pass, stats.Passes
+	snap.Done, snap.Total = stats.Done, stats.Queued
+	snap.BytesDone, snap.BytesTotal = stats.Bytes.Done, stats.Bytes.Total
+	snap.BytesPerSecond, snap.ETASeconds = stats.Bytes.Rate, stats.Bytes.ETA.Seconds()
+	snap.FilesRebalanced = stats.Rebalanced
+	snap.FilesSkipped = stats.Skipped
+	snap.FilesFailed = stats.Failed
+	snap.BytesRebalanced = stats.BytesRebalanced
+	snap.ElapsedSeconds = stats.Elapsed.Seconds()
+	for reason, n := range stats.SkippedBy {
+		if snap.SkippedBy == nil {
+			snap.SkippedBy = make(map[string]int64)
+		}
+		snap.SkippedBy[string(reason)] = n
+	}
+	snap.Concurrency = r.Concurrency()
+	if arc, ok := r.ARC(); ok {
+		snap.ARC = &status.ARC{
+			Bytes:       arc.Size,
+			MaxBytes:    arc.Max,
+			HitRatio:    arc.HitRatio,
+			RunHitRatio: arc.RunHitRatio,
+			GhostShare:  arc.GhostShare,
+			Thrashing:   arc.Thrashing,
+			Throttled:   arc.Throttled,
+		}
+	}
+
+	now := time.Now()
+	for _, f := range r.ActiveFiles() {
+		snap.Workers = append(snap.Workers, status.Worker{
+			Path: f.Path, Stage: f.Stage, Size: f.Size, Copied: f.Copied, BytesPerSecond: fileSpeed(f, now),
+		})
+	}
+	for _, d := range r.DatasetStats() {
+		snap.Datasets = append(snap.Datasets, status.Dataset{
+			Name:            d.Dataset,
+			FilesRebalanced: d.FilesRebalanced,
+			BytesRebalanced: d.BytesRebalanced,
+			FilesSkipped:    d.FilesSkipped,
+			FilesFailed:     d.FilesFailed,
+		})
+	}
+	return snap
+}
+
+// startStatusServer serves the web dashboard on addr until ctx is done
+func startStatusServer(ctx context.Context, log *logrus.Logger, addr string, source func() status.Snapshot) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Warnf("Serving the status dashboard at http://%s/", ln.Addr())
+	srv := status.NewServer(source, 10*time.Second)
+	go func() {
+		if err := srv.Serve(ctx, ln); err != nil {
+			log.Errorf("Status server stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/tui"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
+	"github.com/sirupsen/logrus"
+)
+
+// maxTUIConcurrency caps the concurrency the + key can reach
+const maxTUIConcurrency = 128
+
+// dashboard shows the --tui dashboard of a run. Logging is silenced while it is open;
+// errors are collected by a hook and shown on it instead.
+type dashboard struct {
+	term       *tui.Terminal
+	log        *logrus.Logger
+	rebalancer *rebalance.Rebalancer
+	state      *runState
+	errors     *tui.RecentErrors
+	title      string
+	units      units.Units
+
+	savedOut  io.Writer
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// openDashboard takes over the terminal and starts refreshing the dashboard
+func openDashboard(log *logrus.Logger, r *rebalance.Rebalancer, state *runState, errors *tui.RecentErrors, rootPaths []string, u units.Units) (*dashboard, error) {
+	term, err := tui.Open(os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	d := &dashboard{
+		term:       term,
+		log:        log,
+		rebalancer: r,
+		state:      state,
+		errors:     errors,
+		title:      strings.Join(rootPaths, " "),
+		units:      u,
+		stop:       make(chan struct{}),
+	}
+	d.savedOut = log.Out
+	log.SetOutput(io.Discard)
+
+	d.stopped.Add(1)
+	go d.loop()
+	return d, nil
+}
+
+// loop redraws the dashboard twice a second and handles key presses until Close
+func (d *dashboard) loop() {
+	defer d.stopped.Done()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	keys := d.term.Keys()
+	d.draw()
+	for {
+		select {
+		case <-ticker.C:
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil // input ended; keep drawing
+				continue
+			}
+			d.handleKey(key)
+		case <-d.stop:
+			return
+		}
+		d.draw()
+	}
+}
+
+// handleKey acts on a key press
+func (d *dashboard) handleKey(key byte) {
+	r := d.rebalancer
+	switch key {
+	case 'p', 'P', ' ':
+		if r.Paused() {
+			r.Resume()
+		} else {
+			r.Pause()
+		}
+	case '+', '=':
+		if n := r.Concurrency(); n < maxTUIConcurrency {
+			r.SetConcurrency(n + 1)
+		}
+	case '-', '_':
+		if n := r.Concurrency(); n > 1 {
+			r.SetConcurrency(n - 1)
+		}
+	case 'q', 'Q':
+		r.InitiateShutdown()
+	}
+}
+
+// draw renders the current state of the run
+func (d *dashboard) draw() {
+	r := d.rebalancer
+	stats := r.Stats()
+
+	state := tui.State{
+		Title:       d.title,
+		Pass:        stats.Pass,
+		Passes:      stats.Passes,
+		Done:        stats.Done,
+		Total:       stats.Queued,
+		BytesDone:   stats.Bytes.Done,
+		BytesTotal:  stats.Bytes.Total,
+		Rate:        stats.Bytes.Rate,
+		ETA:         stats.Bytes.ETA,
+		Rebalanced:  stats.Rebalanced,
+		Skipped:     stats.Skipped,
+		Failed:      stats.Failed,
+		Bytes:       stats.BytesRebalanced,
+		Elapsed:     stats.Elapsed,
+		Paused:      r.Paused(),
+		Stopping:    stats.Interrupted,
+		Concurrency: r.Concurrency(),
+		Errors:      d.errors.Lines(),
+		Units:       d.units,
+	}
+	now := time.Now()
+	for _, f := range r.ActiveFiles() {
+		state.Workers = append(state.Workers, tui.Worker{
+			Path: f.Path, Stage: f.Stage, Size: f.Size, Copied: f.Copied, Speed: fileSpeed(f, now),
+		})
+	}
+
+	width, height := d.term.Size()
+	d.term.Draw(tui.Render(state, width, height))
+}
+
+// Close stops the dashboard, restores the terminal and turns logging back on
+func (d *dashboard) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		d.stopped.Wait()
+		err := d.term.Close()
+		d.log.SetOutput(d.savedOut)
+		if err != nil {
+			d.log.Warnf("Cannot restore the terminal: %v", err)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/notify"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
+)
+
+// runNotifier posts the lifecycle events of runs to the --webhook endpoints
+type runNotifier struct {
+	*notify.Notifier
+	host      string
+	rootPaths []string
+	units     units.Units
+}
+
+// newRunNotifier describes the runs over rootPaths to n, with sizes in u
+func newRunNotifier(n *notify.Notifier, rootPaths []string, u units.Units) *runNotifier {
+	host, _ := os.Hostname()
+	return &runNotifier{Notifier: n, host: host, rootPaths: rootPaths, units: u}
+}
+
+// started posts the start event of a run
+func (n *runNotifier) started() {
+	n.Notify(n.event(notify.EventStart, "started", 2, "Rebalancing "+strings.Join(n.rootPaths, ", "), nil))
+}
+
+// finished posts the finish event of a run, or the failure event when files failed
+func (n *runNotifier) finished(summary rebalance.Summary, failed bool) {
+	kind, verb, priority := notify.EventFinish, "finished", 5
+	switch {
+	case failed:
+		kind, verb, priority = notify.EventFailure, "failed", 8
+	case summary.Interrupted:
+		verb = "stopped"
+	}
+	n.Notify(n.event(kind, verb, priority, n.totals(summary), &summary))
+}
+
+// errorThreshold posts the error-threshold event of a run reaching --max-errors
+func (n *runNotifier) errorThreshold(summary rebalance.Summary) {
+	message := fmt.Sprintf("%d files failed, stopping once the files in progress are done. %s",
+		summary.FilesFailed, n.totals(summary))
+	n.Notify(n.event(notify.EventErrorThreshold, "reached --max-errors", 8, message, &summary))
+}
+
+// totals describes the totals of a run in a sentence
+func (n *runNotifier) totals(s rebalance.Summary) string {
+	return fmt.Sprintf("Rebalanced %d files (%s) in %s: %d skipped, %d failed.",
+		s.FilesRebalanced, n.units.Size(uint64(s.BytesRebalanced)), s.Elapsed.Round(time.Second), s.FilesSkipped, s.FilesFailed)
+}
+
+// event builds an event titled "Rebalance on HOST <verb>"
+func (n *runNotifier) event(kind, verb string, priority int, message string, summary *rebalance.Summary) notify.Event {
+	ev := notify.Event{
+		Event:    kind,
+		Title:    fmt.Sprintf("Rebalance on %s %s", n.host, verb),
+		Message:  message,
+		Priority: priority,
+		Time:     time.Now(),
+		Host:     n.host,
+		Paths:    n.rootPaths,
+	}
+	if summary != nil {
+		totals := summary.Totals()
+		ev.Totals = &totals
+		ev.Interrupted = summary.Interrupted
+	}
+	return ev
+}
@@ -0,0 +1,123 @@
+// Package accesswatch records which files other processes open, so work on files in
+// active use can be put off. Only Linux provides the notifications, through fanotify,
+// which needs CAP_SYS_ADMIN; elsewhere Start returns ErrUnsupported.
+package accesswatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnsupported is returned by Start on platforms without file access notifications
+var ErrUnsupported = errors.New("file access notifications are not supported on this platform")
+
+// File identifies a file by its device number and inode, as reported by stat
+type File struct {
+	Dev, Ino uint64
+}
+
+// pruneEvery is how many recorded opens trigger dropping those older than the window
+const pruneEvery = 4096
+
+// Watcher remembers when other processes last opened each file below the watched
+// mounts, for as long as the window given to Start
+type Watcher struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	opened   map[File]time.Time
+	recorded int
+
+	overflows atomic.Int64
+
+	// close stops the reader, which closes done once it returned
+	close func() error
+	done  chan struct{}
+}
+
+// newWatcher creates a Watcher without a source of events
+func newWatcher(window time.Duration) *Watcher {
+	return &Watcher{
+		window: window,
+		opened: make(map[File]time.Time),
+		close:  func() error { return nil },
+		done:   make(chan struct{}),
+	}
+}
+
+// OpenedWithin returns when another process last opened the file, if that was within
+// the window. Only opens since Start are known.
+func (w *Watcher) OpenedWithin(f File) (time.Time, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	at, ok := w.opened[f]
+	if !ok || time.Since(at) > w.window {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// Overflows counts the times the kernel dropped events because they were not read fast
+// enough; opens in between are missed
+func (w *Watcher) Overflows() int64 {
+	return w.overflows.Load()
+}
+
+// Close stops watching and waits for the reader to return
+func (w *Watcher) Close() error {
+	err := w.close()
+	<-w.done
+	return err
+}
+
+// record notes an open of f at t, dropping expired entries now and then so a busy
+// filesystem does not grow the table without bound
+func (w *Watcher) record(f File, t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.opened[f] = t
+	w.recorded++
+	if w.recorded%pruneEvery != 0 {
+		return
+	}
+	for file, at := range w.opened {
+		if t.Sub(at) > w.window {
+			delete(w.opened, file)
+		}
+	}
+}
+
+// event is the part of a fanotify event the watcher uses
+type event struct {
+	mask uint64
+	fd   int32
+	pid  int32
+}
+
+// metadataLen is the size of struct fanotify_event_metadata
+const metadataLen = 24
+
+// parseEvents decodes the fanotify events read into buf. It stops at a truncated event
+// and reports an unknown metadata version, as the layout would not be understood.
+func parseEvents(buf []byte, version uint8) ([]event, error) {
+	var events []event
+	for len(buf) >= metadataLen {
+		eventLen := binary.NativeEndian.Uint32(buf[0:4])
+		if buf[4] != version {
+			return events, errors.New("unsupported fanotify metadata version")
+		}
+		if eventLen < metadataLen || int(eventLen) > len(buf) {
+			break
+		}
+		events = append(events, event{
+			mask: binary.NativeEndian.Uint64(buf[8:16]),
+			fd:   int32(binary.NativeEndian.Uint32(buf[16:20])),
+			pid:  int32(binary.NativeEndian.Uint32(buf[20:24])),
+		})
+		buf = buf[eventLen:]
+	}
+	return events, nil
+}
@@ -0,0 +1,62 @@
+package accesswatch
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Start watches the mounts holding paths for files opened by other processes and
+// remembers each open for window. It fails without CAP_SYS_ADMIN.
+func Start(paths []string, window time.Duration) (*Watcher, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK,
+		unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("fanotify_init: %w", err)
+	}
+	for _, path := range paths {
+		if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_OPEN, unix.AT_FDCWD, path); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("fanotify_mark %s: %w", path, err)
+		}
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so Close interrupts Read
+	f := os.NewFile(uintptr(fd), "fanotify")
+	w := newWatcher(window)
+	w.close = f.Close
+	go w.read(f, int32(os.Getpid()))
+	return w, nil
+}
+
+// read records the files opened by processes other than self until f is closed
+func (w *Watcher) read(f *os.File, self int32) {
+	defer close(w.done)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		events, err := parseEvents(buf[:n], unix.FANOTIFY_METADATA_VERSION)
+		for _, e := range events {
+			if e.mask&unix.FAN_Q_OVERFLOW != 0 {
+				w.overflows.Add(1)
+			}
+			if e.fd == unix.FAN_NOFD {
+				continue
+			}
+			var st unix.Stat_t
+			if e.pid != self && unix.Fstat(int(e.fd), &st) == nil && st.Mode&unix.S_IFMT == unix.S_IFREG {
+				w.record(File{Dev: uint64(st.Dev), Ino: st.Ino}, now)
+			}
+			unix.Close(int(e.fd))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
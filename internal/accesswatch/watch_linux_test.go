@@ -0,0 +1,54 @@
+package accesswatch
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	w, err := Start([]string{dir}, time.Minute)
+	if err != nil {
+		t.Skipf("fanotify unavailable: %v", err)
+	}
+	defer w.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	file := File{Dev: uint64(st.Dev), Ino: st.Ino}
+
+	// Opens by this process are not reported
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := w.OpenedWithin(file); ok {
+		t.Error("Expected the watcher to ignore its own process")
+	}
+
+	if out, err := exec.Command("cat", path).CombinedOutput(); err != nil {
+		t.Fatalf("cat failed: %v: %s", err, out)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := w.OpenedWithin(file); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the open by another process to be reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package accesswatch
+
+import "time"
+
+// Start returns ErrUnsupported: the platform has no file access notifications
+func Start(paths []string, window time.Duration) (*Watcher, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,76 @@
+package accesswatch
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// encodeEvent builds a fanotify event as the kernel lays it out
+func encodeEvent(version uint8, mask uint64, fd, pid int32) []byte {
+	buf := make([]byte, metadataLen)
+	binary.NativeEndian.PutUint32(buf[0:4], metadataLen)
+	buf[4] = version
+	binary.NativeEndian.PutUint16(buf[6:8], metadataLen)
+	binary.NativeEndian.PutUint64(buf[8:16], mask)
+	binary.NativeEndian.PutUint32(buf[16:20], uint32(fd))
+	binary.NativeEndian.PutUint32(buf[20:24], uint32(pid))
+	return buf
+}
+
+func TestParseEvents(t *testing.T) {
+	buf := append(encodeEvent(3, 0x20, 7, 100), encodeEvent(3, 0x4000, -1, 0)...)
+	// A truncated event at the end is left for the next read
+	buf = append(buf, encodeEvent(3, 0x20, 8, 101)[:10]...)
+
+	events, err := parseEvents(buf, 3)
+	if err != nil {
+		t.Fatalf("parseEvents failed: %v", err)
+	}
+	want := []event{{mask: 0x20, fd: 7, pid: 100}, {mask: 0x4000, fd: -1, pid: 0}}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want[i], events[i])
+		}
+	}
+
+	if _, err := parseEvents(encodeEvent(2, 0x20, 7, 100), 3); err == nil {
+		t.Error("Expected an error for an unknown metadata version")
+	}
+}
+
+func TestWatcherWindow(t *testing.T) {
+	w := newWatcher(time.Minute)
+	recent, old := File{Dev: 1, Ino: 10}, File{Dev: 1, Ino: 11}
+	w.record(recent, time.Now())
+	w.record(old, time.Now().Add(-2*time.Minute))
+
+	if _, ok := w.OpenedWithin(recent); !ok {
+		t.Error("Expected a file opened just now to be reported")
+	}
+	if _, ok := w.OpenedWithin(old); ok {
+		t.Error("Expected an open before the window to be ignored")
+	}
+	if _, ok := w.OpenedWithin(File{Dev: 2, Ino: 10}); ok {
+		t.Error("Expected a file on another device to be unknown")
+	}
+
+	// Expired entries are dropped as opens accumulate
+	for i := 0; i < pruneEvery; i++ {
+		w.record(File{Dev: 3, Ino: uint64(i)}, time.Now())
+	}
+	w.mu.Lock()
+	_, kept := w.opened[old]
+	w.mu.Unlock()
+	if kept {
+		t.Error("Expected the expired open to be pruned")
+	}
+
+	close(w.done)
+	if err := w.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
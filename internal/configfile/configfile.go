@@ -0,0 +1,121 @@
+// Package configfile sets command line flags from a YAML file whose keys are flag names,
+// so long option lists don't have to live in shell scripts.
+package configfile
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PathsKey lists the root paths in the file, used when none are given on the command line
+const PathsKey = "paths"
+
+// File is a parsed config file
+type File struct {
+	// Values maps flag names to their values; repeatable flags may have several
+	Values map[string][]string
+	// Paths are the root paths listed under PathsKey
+	Paths []string
+}
+
+// Load reads a YAML config file. Keys are flag names without dashes, with either dashes
+// or underscores between words; values are scalars, or lists for repeatable flags.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses the content of a config file
+func Parse(data []byte) (*File, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+
+	f := &File{Values: make(map[string][]string)}
+	for key, value := range raw {
+		name := strings.ReplaceAll(key, "_", "-")
+		values, err := scalars(value)
+		if err != nil {
+			return nil, fmt.Errorf("config key %s: %w", key, err)
+		}
+		if _, dup := f.Values[name]; dup {
+			return nil, fmt.Errorf("config key %s is set twice", name)
+		}
+		if name == PathsKey {
+			f.Paths = values
+			continue
+		}
+		f.Values[name] = values
+	}
+	return f, nil
+}
+
+// scalars flattens a YAML value into the strings passed to flag.Value.Set
+func scalars(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return []string{""}, nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if _, isList := item.([]interface{}); isList {
+				return nil, fmt.Errorf("nested lists are not supported")
+			}
+			s, err := scalars(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s...)
+		}
+		return values, nil
+	case map[string]interface{}:
+		return nil, fmt.Errorf("nested mappings are not supported")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// Apply sets the flags of fs from the file, except those already set on the command
+// line, which take precedence. Keys in reserved cannot be set from a file. It returns
+// the names of the flags it set, sorted.
+func (f *File) Apply(fs *flag.FlagSet, reserved ...string) ([]string, error) {
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { onCommandLine[fl.Name] = true })
+
+	names := make([]string, 0, len(f.Values))
+	for name := range f.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var applied []string
+	for _, name := range names {
+		for _, r := range reserved {
+			if name == r {
+				return nil, fmt.Errorf("%s cannot be set in a config file", name)
+			}
+		}
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %s in config file", name)
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		for _, value := range f.Values[name] {
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("config option %s: %w", name, err)
+			}
+		}
+		applied = append(applied, name)
+	}
+	return applied, nil
+}
@@ -0,0 +1,101 @@
+package configfile
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listFlag is a repeatable flag like --include-mount
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+const sample = `
+# Weekly run
+concurrency: 8
+checksum: xxh3
+no_random: true
+temp-timeout: 30m
+include-mount:
+  - /tank/a
+  - /tank/b
+paths: [/tank, /backup]
+`
+
+func TestLoadAndApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rebalance.yaml")
+	if err := os.WriteFile(path, []byte(sample), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if strings.Join(f.Paths, " ") != "/tank /backup" {
+		t.Errorf("Unexpected paths %v", f.Paths)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	concurrency := fs.Int("concurrency", 0, "")
+	checksum := fs.String("checksum", "sha256", "")
+	noRandom := fs.Bool("no-random", false, "")
+	timeout := fs.Duration("temp-timeout", 0, "")
+	var mounts listFlag
+	fs.Var(&mounts, "include-mount", "")
+	fs.String("config", "", "")
+
+	// Command line flags win over the file
+	if err := fs.Parse([]string{"--checksum", "blake3", "/data"}); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := f.Apply(fs, "config")
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if *concurrency != 8 || *checksum != "blake3" || !*noRandom || *timeout != 30*time.Minute {
+		t.Errorf("Unexpected values: concurrency=%d checksum=%s no-random=%t temp-timeout=%s", *concurrency, *checksum, *noRandom, *timeout)
+	}
+	if strings.Join(mounts, " ") != "/tank/a /tank/b" {
+		t.Errorf("Expected both mounts to be included, got %v", mounts)
+	}
+	if strings.Join(applied, " ") != "concurrency include-mount no-random temp-timeout" {
+		t.Errorf("Unexpected applied options %v", applied)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("concurrency", 0, "")
+	fs.String("config", "", "")
+
+	for _, content := range []string{
+		"unknown-option: 1",
+		"concurrency: many",
+		"config: /etc/other.yaml",
+	} {
+		f, err := Parse([]byte(content))
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", content, err)
+		}
+		if _, err := f.Apply(fs, "config"); err == nil {
+			t.Errorf("Expected Apply to fail for %q", content)
+		}
+	}
+
+	for _, content := range []string{
+		"concurrency: {workers: 2}",
+		"concurrency: 2\nconcurrency: 3",
+		"concurrency: 2\nconcurrency_x: [[1]]",
+		"- not a mapping",
+	} {
+		if _, err := Parse([]byte(content)); err == nil {
+			t.Errorf("Expected Parse to fail for %q", content)
+		}
+	}
+}
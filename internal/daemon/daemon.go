@@ -0,0 +1,80 @@
+// Package daemon repeats a job at a fixed interval for as long as the process runs.
+// Runs never overlap: a run that outlasts the interval makes the schedule skip the
+// start times it missed instead of queueing them up.
+package daemon
+
+import (
+	"context"
+	"time"
+)
+
+// defaultStatusEvery is how often Idle is repeated while waiting for the next run
+const defaultStatusEvery = time.Hour
+
+// Schedule runs a job every Interval, counted from the start of the first run
+type Schedule struct {
+	// Interval must be positive
+	Interval time.Duration
+	// Skipped is called when a run took longer than the interval, with the number of
+	// start times that passed while it was active and the time of the next run
+	Skipped func(missed int, next time.Time)
+	// Idle is called when the schedule starts waiting for the next run, and again every
+	// StatusEvery (default one hour) while it waits
+	Idle        func(next time.Time)
+	StatusEvery time.Duration
+
+	// now and after are replaced in tests
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// Run calls job immediately and then at every interval until ctx is canceled. A
+// canceled ctx does not interrupt a running job; the job is passed ctx to watch itself.
+func (s *Schedule) Run(ctx context.Context, job func(ctx context.Context)) {
+	now, after := s.now, s.after
+	if now == nil {
+		now = time.Now
+	}
+	if after == nil {
+		after = time.After
+	}
+	statusEvery := s.StatusEvery
+	if statusEvery <= 0 {
+		statusEvery = defaultStatusEvery
+	}
+
+	next := now()
+	for ctx.Err() == nil {
+		job(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Skip the start times that passed while the job was running
+		next = next.Add(s.Interval)
+		finished := now()
+		missed := 0
+		for !next.After(finished) {
+			next = next.Add(s.Interval)
+			missed++
+		}
+		if missed > 0 && s.Skipped != nil {
+			s.Skipped(missed, next)
+		}
+
+		for {
+			wait := next.Sub(now())
+			if wait <= 0 {
+				break
+			}
+			if s.Idle != nil {
+				s.Idle(next)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-after(min(wait, statusEvery)):
+			}
+		}
+	}
+}
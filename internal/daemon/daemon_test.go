@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the schedule waits or a job says so
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.t = c.t.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func TestScheduleRun(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	start := clock.t
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Run 1 is short, run 2 outlasts two intervals, run 3 is short again
+	durations := []time.Duration{time.Hour, 50 * time.Hour, time.Hour}
+	var starts []time.Duration
+	var skipped []int
+	idle := 0
+	s := &Schedule{
+		Interval:    24 * time.Hour,
+		StatusEvery: 6 * time.Hour,
+		Skipped:     func(missed int, next time.Time) { skipped = append(skipped, missed) },
+		Idle:        func(next time.Time) { idle++ },
+		now:         clock.now,
+		after:       clock.after,
+	}
+	s.Run(ctx, func(ctx context.Context) {
+		starts = append(starts, clock.t.Sub(start))
+		clock.t = clock.t.Add(durations[len(starts)-1])
+		if len(starts) == len(durations) {
+			cancel()
+		}
+	})
+
+	want := []time.Duration{0, 24 * time.Hour, 96 * time.Hour}
+	if len(starts) != len(want) {
+		t.Fatalf("Expected %d runs, got %v", len(want), starts)
+	}
+	for i := range want {
+		if starts[i] != want[i] {
+			t.Errorf("Run %d started at %s, want %s", i+1, starts[i], want[i])
+		}
+	}
+	if len(skipped) != 1 || skipped[0] != 2 {
+		t.Errorf("Expected one report of 2 skipped runs, got %v", skipped)
+	}
+	// 23h idle after run 1 and 22h after run 2, reported every 6h
+	if idle != 4+4 {
+		t.Errorf("Expected 8 idle reports, got %d", idle)
+	}
+}
+
+func TestScheduleCancelWhileIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	s := &Schedule{
+		Interval: time.Hour,
+		Idle:     func(next time.Time) { cancel() },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, func(ctx context.Context) { runs++ })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+	if runs != 1 {
+		t.Errorf("Expected 1 run, got %d", runs)
+	}
+}
@@ -1,46 +1,150 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-
-	_ "github.com/mattn/go-sqlite3"
+	"sync"
+	"time"
 )
 
 // DB represents a database connection and its path
 type DB struct {
 	*sql.DB
 	Path string
+	// ReadOnly is set when the database was opened with Options.ReadOnly; writes fail
+	ReadOnly bool
+	// version is the schema version, older than LatestSchemaVersion only when read-only
+	version int
+	// writeMu serializes the writes of the workers, which would otherwise contend for
+	// SQLite's single write lock and wait out the busy timeout
+	writeMu sync.Mutex
 }
 
 // OpenSQLiteDB creates a temporary directory for the SQLite file and returns a DB.
 func OpenSQLiteDB() (*DB, error) {
-	tmpDir, err := os.MkdirTemp("", "rebalance_db_")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	return OpenSQLiteDBWithOptions("", Options{})
+}
+
+// OpenSQLiteDBAt opens (or creates) the SQLite file at dbPath so pass counts and
+// checksums survive across runs. Missing parent directories are created.
+func OpenSQLiteDBAt(dbPath string) (*DB, error) {
+	return OpenSQLiteDBWithOptions(dbPath, Options{})
+}
+
+// OpenSQLiteDBWithOptions is OpenSQLiteDBAt with tuning pragmas applied to every connection.
+// An empty dbPath opens a new database in a temporary directory, as OpenSQLiteDB does.
+// The schema of a database written by an older version is migrated forward; a database
+// written by a newer version is refused with ErrNewerSchema. A read-only database must
+// already exist and is not migrated.
+func OpenSQLiteDBWithOptions(dbPath string, opts Options) (*DB, error) {
+	if opts.ReadOnly {
+		return openReadOnly(dbPath, opts)
+	}
+	if dbPath == "" {
+		tmpDir, err := os.MkdirTemp("", "rebalance_db_")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		dbPath = filepath.Join(tmpDir, "rebalance.db")
 	}
-	dbPath := filepath.Join(tmpDir, "rebalance.db")
 
-	db, err := sql.Open("sqlite3", dbPath)
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database dir: %w", err)
+	}
+
+	pragmas, err := opts.withDefaults().pragmas()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
+	}
+	// Transactions take the write lock when they begin, so a transaction that read first
+	// cannot fail to upgrade its lock halfway through
+	db := sql.OpenDB(&connector{dsn: dbPath + "?_txlock=immediate", driver: newDriver(), pragmas: pragmas})
+
+	// With write-ahead logging, readers such as rebalance stats do not block the writers
+	// and the other way round. The mode is stored in the file.
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to enable WAL mode: %w", err)
+	}
+
+	// Create the tables of a new database, or bring those of an older one up to date
+	if err := migrate(db, dbPath); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	// Create table if not exists
-	createTable := `
-    CREATE TABLE IF NOT EXISTS rebalances (
-        file_path TEXT PRIMARY KEY,
-        count INT
-    );`
-	_, err = db.Exec(createTable)
+	return &DB{DB: db, Path: dbPath, version: LatestSchemaVersion()}, nil
+}
+
+// openReadOnly opens the existing database at dbPath for queries only
+func openReadOnly(dbPath string, opts Options) (*DB, error) {
+	if dbPath == "" {
+		return nil, errors.New("a read-only database needs a path")
+	}
+	if err := checkSQLiteFile(dbPath); err != nil {
+		return nil, err
+	}
+
+	pragmas, err := opts.withDefaults().pragmas()
 	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(&connector{dsn: dbPath, driver: newDriver(), pragmas: pragmas})
+	if err := db.Ping(); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
+		return nil, fmt.Errorf("failed to open %s: %w", dbPath, err)
+	}
+	// An older schema is read as it is, the queries handle missing tables
+	version, err := schemaVersion(db)
+	if err == nil {
+		err = checkSchema(dbPath, version)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{DB: db, Path: dbPath, ReadOnly: true, version: version}, nil
+}
+
+// sqliteHeader starts every SQLite database file
+const sqliteHeader = "SQLite format 3\x00"
+
+// checkSQLiteFile returns an error unless path is an existing SQLite database
+func checkSQLiteFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	return &DB{DB: db, Path: dbPath}, nil
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil || string(header) != sqliteHeader {
+		return fmt.Errorf("%s is not a SQLite database", path)
+	}
+	return nil
+}
+
+// Destroy deletes the database at dbPath together with its journal files. It refuses
+// to delete a file that is not a SQLite database; the containing directory is kept.
+func Destroy(dbPath string) error {
+	if err := checkSQLiteFile(dbPath); err != nil {
+		return err
+	}
+	if err := os.Remove(dbPath); err != nil {
+		return err
+	}
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetRebalanceCount retrieves the current rebalance count for a file from the SQLite DB.
@@ -56,6 +160,8 @@ func (db *DB) GetRebalanceCount(filePath string) (int, error) {
 
 // SetRebalanceCount updates (or inserts) the rebalance count for a file in the DB.
 func (db *DB) SetRebalanceCount(filePath string, newCount int) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
 	_, err := db.DB.Exec(`
         INSERT INTO rebalances (file_path, count)
         VALUES (?, ?)
@@ -65,6 +171,256 @@ func (db *DB) SetRebalanceCount(filePath string, newCount int) error {
 	return err
 }
 
+// RebalanceRecord is the pass count of a file together with the size, copy duration and
+// speed of its last rebalance. Files counted by a version that did not record them have
+// zero values.
+type RebalanceRecord struct {
+	FilePath string
+	// Device and Inode identify the file, so that its count follows it when it is renamed
+	// or its dataset is mounted elsewhere. Zero when unknown, the record is then found by
+	// path alone.
+	Device       uint64
+	Inode        uint64
+	Count        int
+	Size         int64
+	Duration     time.Duration
+	BytesPerSec  float64
+	RebalancedAt time.Time
+}
+
+// RecordRebalance stores (or replaces) the pass count and transfer figures of a file.
+func (db *DB) RecordRebalance(rec RebalanceRecord) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	// An unknown identity is stored as NULL
+	var device, inode any
+	if rec.Inode != 0 {
+		device, inode = int64(rec.Device), int64(rec.Inode)
+	}
+	_, err := db.DB.Exec(`
+        INSERT INTO rebalances (file_path, device, inode, count, size, duration, bytes_per_sec, rebalanced_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(file_path) DO UPDATE SET
+        device = excluded.device,
+        inode = excluded.inode,
+        count = excluded.count,
+        size = excluded.size,
+        duration = excluded.duration,
+        bytes_per_sec = excluded.bytes_per_sec,
+        rebalanced_at = excluded.rebalanced_at
+    `, rec.FilePath, device, inode, rec.Count, rec.Size, int64(rec.Duration), rec.BytesPerSec, unixNano(rec.RebalancedAt))
+	return err
+}
+
+// DeleteRebalance forgets the record stored under filePath, once it moved to another path
+func (db *DB) DeleteRebalance(filePath string) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, err := db.DB.Exec("DELETE FROM rebalances WHERE file_path = ?", filePath)
+	return err
+}
+
+// LookupRebalance finds the record of the file at filePath with the given device and
+// inode: first by device and inode, which finds it under the path it was counted at
+// before a rename, then by path. A record found by path must have the same inode, or
+// none recorded, so a different file created at the path starts from zero; its device
+// may differ, as device numbers can change when a dataset is mounted again. With
+// inode 0 the record is found by path alone.
+func (db *DB) LookupRebalance(filePath string, device, inode uint64) (RebalanceRecord, bool, error) {
+	if inode == 0 || db.version < 6 {
+		return db.GetRebalance(filePath)
+	}
+	// Hardlinks share an inode; prefer the record of this path
+	row := db.DB.QueryRow("SELECT "+db.rebalanceColumns()+` FROM rebalances
+        WHERE inode = ? AND device = ? ORDER BY file_path = ? DESC LIMIT 1`, int64(inode), int64(device), filePath)
+	rec, err := scanRebalance(row)
+	if err == nil {
+		return rec, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return RebalanceRecord{}, false, err
+	}
+
+	row = db.DB.QueryRow("SELECT "+db.rebalanceColumns()+` FROM rebalances
+        WHERE file_path = ? AND (inode IS NULL OR inode = ?)`, filePath, int64(inode))
+	rec, err = scanRebalance(row)
+	if err == sql.ErrNoRows {
+		return RebalanceRecord{}, false, nil
+	}
+	if err != nil {
+		return RebalanceRecord{}, false, err
+	}
+	return rec, true, nil
+}
+
+// GetRebalance retrieves the record of a file. The boolean is false if it was never rebalanced.
+func (db *DB) GetRebalance(filePath string) (RebalanceRecord, bool, error) {
+	row := db.DB.QueryRow("SELECT "+db.rebalanceColumns()+" FROM rebalances WHERE file_path = ?", filePath)
+	rec, err := scanRebalance(row)
+	if err == sql.ErrNoRows {
+		return RebalanceRecord{}, false, nil
+	}
+	if err != nil {
+		return RebalanceRecord{}, false, err
+	}
+	return rec, true, nil
+}
+
+// rebalanceColumns is the select list of a rebalance record, with constants in place of
+// the columns a read-only database of an older schema lacks
+func (db *DB) rebalanceColumns() string {
+	switch {
+	case db.version < 4:
+		return "file_path, 0, 0, count, 0, 0, 0, 0"
+	case db.version < 6:
+		return "file_path, 0, 0, count, COALESCE(size, 0), COALESCE(duration, 0), COALESCE(bytes_per_sec, 0), COALESCE(rebalanced_at, 0)"
+	}
+	return "file_path, COALESCE(device, 0), COALESCE(inode, 0), count, COALESCE(size, 0), COALESCE(duration, 0), " +
+		"COALESCE(bytes_per_sec, 0), COALESCE(rebalanced_at, 0)"
+}
+
+// scanRebalance reads a rebalance record from a row of a rebalances query
+func scanRebalance(row interface{ Scan(...any) error }) (RebalanceRecord, error) {
+	var rec RebalanceRecord
+	var device, inode, duration, rebalancedAt int64
+	err := row.Scan(&rec.FilePath, &device, &inode, &rec.Count, &rec.Size, &duration, &rec.BytesPerSec, &rebalancedAt)
+	if err != nil {
+		return RebalanceRecord{}, err
+	}
+	rec.Device, rec.Inode = uint64(device), uint64(inode)
+	rec.Duration = time.Duration(duration)
+	rec.RebalancedAt = fromUnixNano(rebalancedAt)
+	return rec, nil
+}
+
+// ChecksumRecord is the digest of a file's content as of its recorded size and modification time
+type ChecksumRecord struct {
+	FilePath  string
+	Algorithm string
+	// Digest is the checksum of the original as it was read, CopyDigest that of the copy
+	// that replaced it, empty in records written before copies were hashed separately
+	Digest     string
+	CopyDigest string
+	Size       int64
+	ModTime    time.Time
+	// HashedAt is when both were computed, VerifiedAt when the file was last checked since
+	HashedAt   time.Time
+	VerifiedAt time.Time
+}
+
+// checksumColumns is the select list of a checksum record, with constants in place of
+// the columns a read-only database of an older schema lacks
+func (db *DB) checksumColumns() string {
+	if db.version < 5 {
+		return "file_path, algorithm, digest, '', size, mtime, 0, verified_at"
+	}
+	return "file_path, algorithm, digest, COALESCE(copy_digest, ''), size, mtime, COALESCE(hashed_at, 0), verified_at"
+}
+
+// SetChecksum stores (or replaces) the checksum record for a file.
+func (db *DB) SetChecksum(rec ChecksumRecord) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, err := db.DB.Exec(`
+        INSERT INTO checksums (file_path, algorithm, digest, copy_digest, size, mtime, hashed_at, verified_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(file_path) DO UPDATE SET
+        algorithm = excluded.algorithm,
+        digest = excluded.digest,
+        copy_digest = excluded.copy_digest,
+        size = excluded.size,
+        mtime = excluded.mtime,
+        hashed_at = excluded.hashed_at,
+        verified_at = excluded.verified_at
+    `, rec.FilePath, rec.Algorithm, rec.Digest, rec.CopyDigest, rec.Size, unixNano(rec.ModTime),
+		unixNano(rec.HashedAt), unixNano(rec.VerifiedAt))
+	return err
+}
+
+// GetChecksum retrieves the checksum record for a file. The boolean is false if none is stored.
+func (db *DB) GetChecksum(filePath string) (ChecksumRecord, bool, error) {
+	row := db.DB.QueryRow("SELECT "+db.checksumColumns()+" FROM checksums WHERE file_path = ?", filePath)
+	rec, err := scanChecksum(row)
+	if err == sql.ErrNoRows {
+		return ChecksumRecord{}, false, nil
+	}
+	if err != nil {
+		return ChecksumRecord{}, false, err
+	}
+	return rec, true, nil
+}
+
+// ChecksumsToVerify returns up to limit records ordered by path, starting after the given path,
+// that have not been verified since the given time.
+func (db *DB) ChecksumsToVerify(after string, notVerifiedSince time.Time, limit int) ([]ChecksumRecord, error) {
+	rows, err := db.DB.Query(`
+        SELECT `+db.checksumColumns()+`
+        FROM checksums
+        WHERE file_path > ? AND verified_at < ?
+        ORDER BY file_path
+        LIMIT ?`, after, unixNano(notVerifiedSince), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ChecksumRecord
+	for rows.Next() {
+		rec, err := scanChecksum(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// MarkChecksumVerified records when a file's stored checksum was last checked.
+func (db *DB) MarkChecksumVerified(filePath string, at time.Time) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, err := db.DB.Exec("UPDATE checksums SET verified_at = ? WHERE file_path = ?", unixNano(at), filePath)
+	return err
+}
+
+// DeleteChecksum removes the checksum record for a file.
+func (db *DB) DeleteChecksum(filePath string) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, err := db.DB.Exec("DELETE FROM checksums WHERE file_path = ?", filePath)
+	return err
+}
+
+// scanChecksum reads a checksum record from a row of a checksums query
+func scanChecksum(row interface{ Scan(...any) error }) (ChecksumRecord, error) {
+	var rec ChecksumRecord
+	var mtime, hashedAt, verifiedAt int64
+	err := row.Scan(&rec.FilePath, &rec.Algorithm, &rec.Digest, &rec.CopyDigest, &rec.Size, &mtime, &hashedAt, &verifiedAt)
+	if err != nil {
+		return ChecksumRecord{}, err
+	}
+	rec.ModTime = fromUnixNano(mtime)
+	rec.HashedAt = fromUnixNano(hashedAt)
+	rec.VerifiedAt = fromUnixNano(verifiedAt)
+	return rec, nil
+}
+
+// unixNano stores times as nanoseconds since the epoch, with the zero time as 0
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
 // Close closes the database and optionally removes the database directory
 func (db *DB) Close(removeDir bool) error {
 	err := db.DB.Close()
@@ -73,3 +429,33 @@ func (db *DB) Close(removeDir bool) error {
 	}
 	return err
 }
+
+// connector opens connections to one database file and runs the pragmas on each,
+// so per-connection settings hold for every connection in the pool
+type connector struct {
+	dsn     string
+	driver  driver.Driver
+	pragmas []string
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return conn, nil
+	}
+	for _, pragma := range c.pragmas {
+		if _, err := execer.ExecContext(ctx, pragma, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s failed: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
@@ -1,10 +1,17 @@
 package database
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -80,6 +87,79 @@ func TestRebalanceCountFunctions(t *testing.T) {
 	}
 }
 
+func TestRecordRebalance(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+
+	_, ok, err := db.GetRebalance("/tank/a")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rec := RebalanceRecord{FilePath: "/tank/a", Count: 2, Size: 4096, Duration: 2 * time.Second, BytesPerSec: 2048, RebalancedAt: at}
+	require.NoError(t, db.RecordRebalance(rec))
+	got, ok, err := db.GetRebalance("/tank/a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, got.RebalancedAt.Equal(at))
+	got.RebalancedAt = at
+	require.Equal(t, rec, got)
+
+	count, err := db.GetRebalanceCount("/tank/a")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// A count set alone leaves the figures of the last rebalance
+	require.NoError(t, db.SetRebalanceCount("/tank/a", 3))
+	got, _, err = db.GetRebalance("/tank/a")
+	require.NoError(t, err)
+	require.Equal(t, 3, got.Count)
+	require.Equal(t, int64(4096), got.Size)
+}
+
+func TestLookupRebalance(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+
+	require.NoError(t, db.RecordRebalance(RebalanceRecord{FilePath: "/tank/a", Device: 7, Inode: 100, Count: 2}))
+	require.NoError(t, db.SetRebalanceCount("/tank/legacy", 1))
+
+	// Found by inode under the name it was counted at
+	rec, ok, err := db.LookupRebalance("/tank/renamed", 7, 100)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "/tank/a", rec.FilePath)
+	require.Equal(t, 2, rec.Count)
+
+	// By path with the same inode on another device, as after a remount
+	rec, ok, err = db.LookupRebalance("/tank/a", 8, 100)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 2, rec.Count)
+
+	// Another file at the path is not the counted one
+	_, ok, err = db.LookupRebalance("/tank/a", 7, 101)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Records without an inode are found by path
+	rec, ok, err = db.LookupRebalance("/tank/legacy", 7, 200)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 1, rec.Count)
+	rec, ok, err = db.LookupRebalance("/tank/a", 0, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(100), rec.Inode)
+
+	require.NoError(t, db.DeleteRebalance("/tank/a"))
+	_, ok, err = db.LookupRebalance("/tank/renamed", 7, 100)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
 func TestDBClose(t *testing.T) {
 	// Open database
 	db, err := OpenSQLiteDB()
@@ -122,3 +202,592 @@ func TestDBClose(t *testing.T) {
 		_ = os.RemoveAll(dbDir)
 	}
 }
+
+func TestChecksumFunctions(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	if err != nil {
+		t.Fatalf("OpenSQLiteDB failed: %v", err)
+	}
+	defer db.Close(true)
+
+	// Missing record
+	_, found, err := db.GetChecksum("/test/a")
+	if err != nil || found {
+		t.Fatalf("Expected no record, got found=%t err=%v", found, err)
+	}
+
+	runStart := time.Now()
+	mtime := time.Unix(1700000000, 123456789)
+	for _, path := range []string{"/test/a", "/test/b", "/test/c"} {
+		err := db.SetChecksum(ChecksumRecord{FilePath: path, Algorithm: "sha256", Digest: "abc", Size: 42, ModTime: mtime})
+		if err != nil {
+			t.Fatalf("SetChecksum failed: %v", err)
+		}
+	}
+
+	rec, found, err := db.GetChecksum("/test/a")
+	if err != nil || !found {
+		t.Fatalf("GetChecksum failed: found=%t err=%v", found, err)
+	}
+	if rec.Digest != "abc" || rec.Size != 42 || !rec.ModTime.Equal(mtime) {
+		t.Errorf("Unexpected record: %+v", rec)
+	}
+
+	// The copy's digest and the hash time are kept next to the original's
+	hashedAt := time.Unix(1700000100, 0)
+	err = db.SetChecksum(ChecksumRecord{FilePath: "/test/a", Algorithm: "sha256", Digest: "abc", CopyDigest: "abc", Size: 42, ModTime: mtime, HashedAt: hashedAt})
+	if err != nil {
+		t.Fatalf("SetChecksum failed: %v", err)
+	}
+	rec, _, err = db.GetChecksum("/test/a")
+	if err != nil || rec.CopyDigest != "abc" || !rec.HashedAt.Equal(hashedAt) {
+		t.Errorf("Unexpected record with copy digest: %+v (err=%v)", rec, err)
+	}
+
+	// Verified records drop out of the candidates, and paging continues after the given path
+	if err := db.MarkChecksumVerified("/test/b", time.Now()); err != nil {
+		t.Fatalf("MarkChecksumVerified failed: %v", err)
+	}
+	records, err := db.ChecksumsToVerify("", runStart, 10)
+	if err != nil {
+		t.Fatalf("ChecksumsToVerify failed: %v", err)
+	}
+	if len(records) != 2 || records[0].FilePath != "/test/a" || records[1].FilePath != "/test/c" {
+		t.Errorf("Unexpected candidates: %+v", records)
+	}
+	records, err = db.ChecksumsToVerify("/test/a", runStart, 10)
+	if err != nil || len(records) != 1 || records[0].FilePath != "/test/c" {
+		t.Errorf("Unexpected candidates after /test/a: %+v (err=%v)", records, err)
+	}
+
+	if err := db.DeleteChecksum("/test/a"); err != nil {
+		t.Fatalf("DeleteChecksum failed: %v", err)
+	}
+	if _, found, _ := db.GetChecksum("/test/a"); found {
+		t.Errorf("Record still present after DeleteChecksum")
+	}
+}
+
+func TestOpenSQLiteDBAt(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rebalance_db_at_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "state", "rebalance.db")
+	db, err := OpenSQLiteDBAt(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, db.SetRebalanceCount("/data/file", 2))
+	require.NoError(t, db.Close(false))
+
+	// Reopening the same file keeps the state of the previous run
+	db, err = OpenSQLiteDBAt(dbPath)
+	require.NoError(t, err)
+	defer db.Close(false)
+
+	count, err := db.GetRebalanceCount("/data/file")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	rec, ok, err := db.GetRebalance("/data/file")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, RebalanceRecord{FilePath: "/data/file", Count: 2}, rec)
+}
+
+func TestOpenSQLiteDBWithOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rebalance_db_opts_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenSQLiteDBWithOptions(filepath.Join(dir, "rebalance.db"), Options{
+		CacheSizeMB: 64,
+		TempStore:   TempStoreMemory,
+		MmapSizeMB:  -1,
+	})
+	require.NoError(t, err)
+	defer db.Close(false)
+
+	// Every pooled connection gets the pragmas, so check a few of them
+	db.SetMaxIdleConns(3)
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var cacheSize, tempStore, mmapSize, busyTimeout int64
+		var journalMode string
+		require.NoError(t, conn.QueryRowContext(context.Background(), "PRAGMA cache_size").Scan(&cacheSize))
+		require.NoError(t, conn.QueryRowContext(context.Background(), "PRAGMA temp_store").Scan(&tempStore))
+		require.NoError(t, conn.QueryRowContext(context.Background(), "PRAGMA mmap_size").Scan(&mmapSize))
+		require.NoError(t, conn.QueryRowContext(context.Background(), "PRAGMA busy_timeout").Scan(&busyTimeout))
+		require.NoError(t, conn.QueryRowContext(context.Background(), "PRAGMA journal_mode").Scan(&journalMode))
+		require.Equal(t, int64(-64*1024), cacheSize)
+		require.Equal(t, int64(2), tempStore) // 2 = MEMORY
+		require.Equal(t, int64(0), mmapSize)
+		require.Equal(t, defaultBusyTimeout.Milliseconds(), busyTimeout)
+		require.Equal(t, "wal", journalMode)
+	}
+
+	_, err = OpenSQLiteDBWithOptions(filepath.Join(dir, "other.db"), Options{TempStore: "ram"})
+	require.Error(t, err)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+
+	// Many workers recording at once must not see "database is locked"
+	const workers, files = 16, 50
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			for i := 0; i < files; i++ {
+				path := fmt.Sprintf("/tank/%d/%d", w, i)
+				if err := db.RecordRebalance(RebalanceRecord{FilePath: path, Count: 1, Size: int64(i)}); err != nil {
+					errs <- err
+					return
+				}
+				if err := db.SetChecksum(ChecksumRecord{FilePath: path, Algorithm: "sha256", Digest: "ab"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < workers; w++ {
+		require.NoError(t, <-errs)
+	}
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM rebalances").Scan(&n))
+	require.Equal(t, workers*files, n)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "rebalance.db")
+
+	_, err := OpenSQLiteDBWithOptions(dbPath, Options{ReadOnly: true})
+	require.Error(t, err, "A read-only database must exist")
+
+	db, err := OpenSQLiteDBAt(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, db.SetRebalanceCount("/data/file", 3))
+	require.NoError(t, db.Close(false))
+
+	db, err = OpenSQLiteDBWithOptions(dbPath, Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close(false)
+	require.True(t, db.ReadOnly)
+
+	count, err := db.GetRebalanceCount("/data/file")
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.Error(t, db.SetRebalanceCount("/data/file", 4))
+}
+
+func TestDestroy(t *testing.T) {
+	dir := t.TempDir()
+
+	other := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(other, []byte("not a database"), 0644))
+	require.Error(t, Destroy(other))
+	require.FileExists(t, other)
+	require.Error(t, Destroy(filepath.Join(dir, "missing.db")))
+
+	dbPath := filepath.Join(dir, "rebalance.db")
+	db, err := OpenSQLiteDBAt(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, db.SetRebalanceCount("/data/file", 1))
+	require.NoError(t, db.Close(false))
+	require.NoError(t, os.WriteFile(dbPath+"-journal", nil, 0644))
+
+	require.NoError(t, Destroy(dbPath))
+	require.NoFileExists(t, dbPath)
+	require.NoFileExists(t, dbPath+"-journal")
+	require.DirExists(t, dir)
+}
+
+func TestDefaultOptions(t *testing.T) {
+	small := DefaultOptions(512 << 20)
+	require.Equal(t, 16, small.CacheSizeMB)
+	require.Equal(t, TempStoreDefault, small.TempStore)
+	require.Equal(t, 32, small.MmapSizeMB)
+
+	large := DefaultOptions(128 << 30)
+	require.Equal(t, 1024, large.CacheSizeMB)
+	require.Equal(t, TempStoreMemory, large.TempStore)
+	require.Equal(t, 1024, large.MmapSizeMB)
+
+	unknown := DefaultOptions(0)
+	require.Equal(t, -1, unknown.MmapSizeMB)
+}
+
+func TestRuns(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+
+	runs, err := db.Runs()
+	require.NoError(t, err)
+	require.Empty(t, runs)
+
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	second := RunRecord{
+		Started: started.Add(24 * time.Hour), Finished: started.Add(25 * time.Hour), Paths: []string{"/tank/a"},
+		FilesRebalanced: 1, BytesRebalanced: 10, Interrupted: true,
+	}
+	first := RunRecord{
+		Started: started, Finished: started.Add(time.Hour), Paths: []string{"/tank/a", "/tank/b\nc"},
+		FilesRebalanced: 3, BytesRebalanced: 300, FilesSkipped: 2, FilesFailed: 1, FilesVerified: 3,
+		Datasets: []DatasetRecord{
+			{Dataset: "tank/b", FilesRebalanced: 1, BytesRebalanced: 100, FilesFailed: 1},
+			{Dataset: "tank/a", FilesRebalanced: 2, BytesRebalanced: 200, FilesSkipped: 2},
+		},
+	}
+	// Stored out of order, listed by start time
+	_, err = db.AddRun(second)
+	require.NoError(t, err)
+	id, err := db.AddRun(first)
+	require.NoError(t, err)
+
+	runs, err = db.Runs()
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.Equal(t, id, runs[0].ID)
+	require.True(t, runs[0].Started.Equal(first.Started) && runs[0].Finished.Equal(first.Finished))
+	require.Equal(t, first.Paths, runs[0].Paths)
+	require.Equal(t, int64(300), runs[0].BytesRebalanced)
+	require.Equal(t, int64(3), runs[0].FilesVerified)
+	require.Equal(t, []DatasetRecord{first.Datasets[1], first.Datasets[0]}, runs[0].Datasets)
+	require.True(t, runs[1].Interrupted)
+	require.Empty(t, runs[1].Datasets)
+
+	// Databases from before runs were recorded have none
+	_, err = db.Exec("DROP TABLE run_datasets; DROP TABLE runs")
+	require.NoError(t, err)
+	runs, err = db.Runs()
+	require.NoError(t, err)
+	require.Empty(t, runs)
+}
+
+func TestRecoveredFiles(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+
+	savedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := RecoveredFile{OriginalPath: "/tank/b", SavedPath: "/safe/tank/b", Size: 20, SavedAt: savedAt.Add(time.Hour)}
+	first := RecoveredFile{OriginalPath: "/tank/a", SavedPath: "/tank/a.recovered", Algorithm: "sha256", Digest: "ab", Size: 10, SavedAt: savedAt}
+	require.NoError(t, db.AddRecovered(later))
+	require.NoError(t, db.AddRecovered(first))
+
+	files, err := db.RecoveredFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.True(t, files[0].SavedAt.Equal(savedAt))
+	files[0].SavedAt, files[1].SavedAt = first.SavedAt, later.SavedAt
+	require.Equal(t, []RecoveredFile{first, later}, files)
+
+	require.NoError(t, db.DeleteRecovered(first.SavedPath))
+	files, err = db.RecoveredFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, later.SavedPath, files[0].SavedPath)
+
+	// Databases from before copies were registered have none
+	_, err = db.Exec("DROP TABLE recovered_files")
+	require.NoError(t, err)
+	files, err = db.RecoveredFiles()
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "tank", "kept")
+	require.NoError(t, os.MkdirAll(filepath.Dir(kept), 0755))
+	require.NoError(t, os.WriteFile(kept, []byte("data"), 0644))
+	gone := filepath.Join(dir, "tank", "gone")
+	elsewhere := filepath.Join(dir, "other", "gone")
+	unmounted := filepath.Join(dir, "unmounted", "file")
+
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+	for _, path := range []string{kept, gone, elsewhere, unmounted} {
+		require.NoError(t, db.SetRebalanceCount(path, 1))
+	}
+	require.NoError(t, db.SetChecksum(ChecksumRecord{FilePath: gone, Algorithm: "md5", Digest: "x"}))
+	require.NoError(t, db.AddRecovered(RecoveredFile{OriginalPath: kept, SavedPath: filepath.Join(dir, "tank", "saved")}))
+
+	// A dry run counts without removing
+	stats, err := db.Prune([]string{filepath.Join(dir, "tank")}, true)
+	require.NoError(t, err)
+	require.Equal(t, PruneStats{Checked: 4, Rebalances: 1, Checksums: 1, Recovered: 1}, stats)
+	_, found, err := db.GetRebalance(gone)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	// Only paths under the roots are pruned, and a missing root is left alone
+	stats, err = db.Prune([]string{filepath.Join(dir, "tank"), filepath.Join(dir, "unmounted")}, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Removed())
+	for path, want := range map[string]bool{kept: true, gone: false, elsewhere: true, unmounted: true} {
+		_, found, err := db.GetRebalance(path)
+		require.NoError(t, err)
+		require.Equal(t, want, found, path)
+	}
+	_, found, err = db.GetChecksum(gone)
+	require.NoError(t, err)
+	require.False(t, found)
+	recovered, err := db.RecoveredFiles()
+	require.NoError(t, err)
+	require.Empty(t, recovered)
+
+	// Without roots every path is checked
+	stats, err = db.Prune(nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Rebalances)
+	count, err := db.GetRebalanceCount(kept)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestPruneFollowsRenames(t *testing.T) {
+	dir := t.TempDir()
+	renamed := filepath.Join(dir, "tank", "sub", "renamed")
+	require.NoError(t, os.MkdirAll(filepath.Dir(renamed), 0755))
+	require.NoError(t, os.WriteFile(renamed, []byte("data"), 0644))
+	info, err := os.Lstat(renamed)
+	require.NoError(t, err)
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	require.NoError(t, err)
+	if id.Ino == 0 {
+		t.Skip("inode numbers are not available")
+	}
+
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+	// Counted under the name it had before a rename, and never seen under the new one
+	old := filepath.Join(dir, "tank", "old")
+	require.NoError(t, db.RecordRebalance(RebalanceRecord{FilePath: old, Device: id.Dev, Inode: id.Ino, Count: 3, Size: 4}))
+	deleted := filepath.Join(dir, "tank", "deleted")
+	require.NoError(t, db.RecordRebalance(RebalanceRecord{FilePath: deleted, Device: id.Dev, Inode: id.Ino + 1, Count: 1, Size: 4}))
+
+	stats, err := db.Prune([]string{filepath.Join(dir, "tank")}, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Moved)
+	require.Equal(t, 1, stats.Rebalances)
+	_, found, err := db.GetRebalance(old)
+	require.NoError(t, err)
+	require.True(t, found, "a dry run moves nothing")
+
+	stats, err = db.Prune([]string{filepath.Join(dir, "tank")}, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Moved)
+	require.Equal(t, 1, stats.Rebalances)
+	count, err := db.GetRebalanceCount(renamed)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	for _, path := range []string{old, deleted} {
+		_, found, err := db.GetRebalance(path)
+		require.NoError(t, err)
+		require.False(t, found, path)
+	}
+}
+
+func TestPruneUnmounted(t *testing.T) {
+	dir := t.TempDir()
+	// The mountpoint of an unmounted dataset is an empty directory
+	mountpoint := filepath.Join(dir, "tank", "data")
+	require.NoError(t, os.MkdirAll(mountpoint, 0755))
+
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+	file := filepath.Join(mountpoint, "file")
+	require.NoError(t, db.SetRebalanceCount(file, 2))
+	require.NoError(t, db.SetChecksum(ChecksumRecord{FilePath: file, Algorithm: "md5", Digest: "x"}))
+
+	stats, err := db.Prune([]string{mountpoint}, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Removed())
+	count, err := db.GetRebalanceCount(file)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// Once a recorded file is there again, the missing ones are pruned
+	kept := filepath.Join(mountpoint, "kept")
+	require.NoError(t, os.WriteFile(kept, []byte("data"), 0644))
+	require.NoError(t, db.SetRebalanceCount(kept, 1))
+	stats, err = db.Prune([]string{mountpoint}, false)
+	require.NoError(t, err)
+	require.Equal(t, PruneStats{Checked: 3, Rebalances: 1, Checksums: 1}, stats)
+}
+
+func TestInventory(t *testing.T) {
+	db, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer db.Close(true)
+
+	scanned := time.Unix(1700000000, 0)
+	require.NoError(t, db.ReplaceInventory([]string{"/tank/a"}, []InventoryEntry{
+		{FilePath: "/tank/a/2", Size: 2, Dataset: "tank/a", ScannedAt: scanned},
+		{FilePath: "/tank/a/1", Size: 1, Dataset: "tank/a", ScannedAt: scanned},
+	}))
+	require.NoError(t, db.ReplaceInventory([]string{"/tank/b/"}, []InventoryEntry{
+		{FilePath: "/tank/b/1", Size: 3, Dataset: "tank/b", ScannedAt: scanned},
+	}))
+
+	entries, err := db.Inventory(nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, InventoryEntry{FilePath: "/tank/a/1", Size: 1, Dataset: "tank/a", ScannedAt: scanned}, entries[0])
+
+	// A new scan of a root replaces its entries and keeps those of other roots
+	require.NoError(t, db.ReplaceInventory([]string{"/tank/a"}, []InventoryEntry{
+		{FilePath: "/tank/a/3", Size: 4, Dataset: "tank/a", ScannedAt: scanned},
+	}))
+	entries, err = db.Inventory([]string{"/tank"})
+	require.NoError(t, err)
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.FilePath)
+	}
+	require.Equal(t, []string{"/tank/a/3", "/tank/b/1"}, paths)
+
+	entries, err = db.Inventory([]string{"/tank/b"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	entries, err = db.Inventory([]string{"/tank/c"})
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "rebalance.db")
+
+	// A database from before versions were tracked, with the tables of the first releases
+	db, err := OpenSQLiteDBAt(dbPath)
+	require.NoError(t, err)
+	_, err = db.Exec(`DROP TABLE schema_version; DROP TABLE recovered_files; DROP TABLE run_datasets; DROP TABLE runs;
+        DROP TABLE inventory; DROP TABLE rebalances; CREATE TABLE rebalances (file_path TEXT PRIMARY KEY, count INT)`)
+	require.NoError(t, err)
+	require.NoError(t, db.SetRebalanceCount("/data/file", 2))
+	_, err = db.Exec(`DROP TABLE checksums; CREATE TABLE checksums (file_path TEXT PRIMARY KEY, algorithm TEXT,
+        digest TEXT, size INT, mtime INT, verified_at INT);
+        INSERT INTO checksums VALUES ('/data/file', 'sha256', 'abc', 42, 0, 0)`)
+	require.NoError(t, err)
+	version, err := db.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+	require.NoError(t, db.Close(false))
+
+	// Read-only it is read as it is
+	db, err = OpenSQLiteDBWithOptions(dbPath, Options{ReadOnly: true})
+	require.NoError(t, err)
+	runs, err := db.Runs()
+	require.NoError(t, err)
+	require.Empty(t, runs)
+	sum, found, err := db.GetChecksum("/data/file")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "abc", sum.Digest)
+	require.Empty(t, sum.CopyDigest)
+	rec, found, err := db.GetRebalance("/data/file")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 2, rec.Count)
+	require.NoError(t, db.Close(false))
+
+	// Opened for writing it is migrated, keeping its data
+	db, err = OpenSQLiteDBAt(dbPath)
+	require.NoError(t, err)
+	version, err = db.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, LatestSchemaVersion(), version)
+	count, err := db.GetRebalanceCount("/data/file")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	_, err = db.AddRun(RunRecord{Paths: []string{"/data"}})
+	require.NoError(t, err)
+
+	// A newer version's database is refused, read-only as well
+	_, err = db.Exec("INSERT INTO schema_version (version) VALUES (?)", LatestSchemaVersion()+1)
+	require.NoError(t, err)
+	require.NoError(t, db.Close(false))
+	for _, opts := range []Options{{}, {ReadOnly: true}} {
+		_, err = OpenSQLiteDBWithOptions(dbPath, opts)
+		require.ErrorIs(t, err, ErrNewerSchema)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer src.Close(true)
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 123, time.UTC)
+	latin1 := "/tank/caf\xe9"
+	require.NoError(t, src.RecordRebalance(RebalanceRecord{FilePath: "/tank/a", Count: 2, Size: 4096, Duration: time.Second, BytesPerSec: 4096, RebalancedAt: at}))
+	require.NoError(t, src.SetRebalanceCount(latin1, 1))
+	sum := ChecksumRecord{FilePath: latin1, Algorithm: "sha256", Digest: "ab", CopyDigest: "ab", Size: 10, ModTime: at, HashedAt: at, VerifiedAt: at}
+	require.NoError(t, src.SetChecksum(sum))
+	run := RunRecord{Started: at, Finished: at.Add(time.Hour), Paths: []string{"/tank"}, FilesRebalanced: 2, BytesRebalanced: 4106, FilesVerified: 2,
+		Datasets: []DatasetRecord{{Dataset: "tank", FilesRebalanced: 2, BytesRebalanced: 4106}}}
+	_, err = src.AddRun(run)
+	require.NoError(t, err)
+	require.NoError(t, src.AddRecovered(RecoveredFile{OriginalPath: "/tank/b", SavedPath: "/safe/b", Size: 5, SavedAt: at}))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportJSON(&buf))
+	require.True(t, json.Valid(buf.Bytes()), buf.String())
+	require.Contains(t, buf.String(), `"path":"/tank/caf\\xe9"`)
+
+	dst, err := OpenSQLiteDB()
+	require.NoError(t, err)
+	defer dst.Close(true)
+	for i := 0; i < 2; i++ {
+		stats, err := dst.ImportJSON(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, int64(2), stats.Rebalances)
+		require.Equal(t, int64(1), stats.Checksums)
+		require.Equal(t, int64(1), stats.Recovered)
+		// A second import finds the run already recorded
+		require.Equal(t, int64(1-i), stats.Runs)
+		require.Equal(t, int64(i), stats.RunsKnown)
+	}
+
+	rec, ok, err := dst.GetRebalance("/tank/a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 2, rec.Count)
+	require.Equal(t, time.Second, rec.Duration)
+	require.True(t, rec.RebalancedAt.Equal(at))
+	got, ok, err := dst.GetChecksum(latin1)
+	require.NoError(t, err)
+	require.True(t, ok, "the exact bytes of a non-UTF-8 path are restored")
+	require.Equal(t, sum.CopyDigest, got.CopyDigest)
+	require.True(t, got.ModTime.Equal(at))
+	runs, err := dst.Runs()
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	require.Equal(t, run.Datasets, runs[0].Datasets)
+	require.Equal(t, run.FilesVerified, runs[0].FilesVerified)
+	recovered, err := dst.RecoveredFiles()
+	require.NoError(t, err)
+	require.Len(t, recovered, 1)
+
+	// A failed import changes nothing
+	_, err = dst.ImportJSON(strings.NewReader(`{"rebalances": [{"path": "/tank/c", "count": 1}], "checksums": [1]}`))
+	require.Error(t, err)
+	_, ok, err = dst.GetRebalance("/tank/c")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = dst.ImportJSON(strings.NewReader(`{"schema_version": 99}`))
+	require.ErrorIs(t, err, ErrNewerSchema)
+}
@@ -0,0 +1,18 @@
+//go:build cgo && !purego
+
+package database
+
+import (
+	"database/sql/driver"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// DriverName names the SQLite implementation the binary was built with
+const DriverName = "mattn/go-sqlite3 (cgo)"
+
+// newDriver returns the SQLite driver: the C library through cgo, unless the binary is
+// built with CGO_ENABLED=0 or the purego tag
+func newDriver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
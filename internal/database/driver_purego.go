@@ -0,0 +1,18 @@
+//go:build !cgo || purego
+
+package database
+
+import (
+	"database/sql/driver"
+
+	"modernc.org/sqlite"
+)
+
+// DriverName names the SQLite implementation the binary was built with
+const DriverName = "modernc.org/sqlite (pure Go)"
+
+// newDriver returns the SQLite driver: a translation of the C library to Go, so the
+// binary can be built with CGO_ENABLED=0 and cross-compiled without a C toolchain
+func newDriver() driver.Driver {
+	return &sqlite.Driver{}
+}
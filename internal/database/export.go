@@ -0,0 +1,490 @@
+package database
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// An export is one JSON document holding every table of the state database, so state can
+// be moved between hosts, backed up or inspected with jq:
+//
+//	{"schema_version": 5, "exported_at": "...", "rebalances": [...], "checksums": [...],
+//	 "runs": [...], "recovered_files": [...]}
+//
+// Rows are written and read one at a time, so databases of tens of millions of files are
+// never held in memory. Paths that are not valid UTF-8 are written with their invalid
+// bytes escaped as \xNN and their exact bytes in a *_base64 field next to them.
+
+// ImportStats counts the rows read by ImportJSON
+type ImportStats struct {
+	Rebalances int64
+	Checksums  int64
+	// Runs counts the runs added; RunsKnown those skipped as already recorded
+	Runs      int64
+	RunsKnown int64
+	Recovered int64
+}
+
+type exportedRebalance struct {
+	Path            string     `json:"path"`
+	PathBase64      string     `json:"path_base64,omitempty"`
+	Device          uint64     `json:"device,omitempty"`
+	Inode           uint64     `json:"inode,omitempty"`
+	Count           int        `json:"count"`
+	Size            int64      `json:"size"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	BytesPerSecond  float64    `json:"bytes_per_second"`
+	RebalancedAt    *time.Time `json:"rebalanced_at,omitempty"`
+}
+
+type exportedChecksum struct {
+	Path       string     `json:"path"`
+	PathBase64 string     `json:"path_base64,omitempty"`
+	Algorithm  string     `json:"algorithm"`
+	Digest     string     `json:"digest"`
+	CopyDigest string     `json:"copy_digest,omitempty"`
+	Size       int64      `json:"size"`
+	ModTime    *time.Time `json:"mtime,omitempty"`
+	HashedAt   *time.Time `json:"hashed_at,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+type exportedRun struct {
+	ID              int64             `json:"id"`
+	Started         *time.Time        `json:"started,omitempty"`
+	Finished        *time.Time        `json:"finished,omitempty"`
+	Paths           []string          `json:"paths"`
+	Interrupted     bool              `json:"interrupted"`
+	FilesRebalanced int64             `json:"files_rebalanced"`
+	BytesRebalanced int64             `json:"bytes_rebalanced"`
+	FilesSkipped    int64             `json:"files_skipped"`
+	FilesFailed     int64             `json:"files_failed"`
+	FilesVerified   int64             `json:"files_verified,omitempty"`
+	Datasets        []exportedDataset `json:"datasets,omitempty"`
+}
+
+type exportedDataset struct {
+	Dataset         string `json:"dataset"`
+	FilesRebalanced int64  `json:"files_rebalanced"`
+	BytesRebalanced int64  `json:"bytes_rebalanced"`
+	FilesSkipped    int64  `json:"files_skipped"`
+	FilesFailed     int64  `json:"files_failed"`
+}
+
+type exportedRecovered struct {
+	SavedPath          string     `json:"saved_path"`
+	SavedPathBase64    string     `json:"saved_path_base64,omitempty"`
+	OriginalPath       string     `json:"original_path"`
+	OriginalPathBase64 string     `json:"original_path_base64,omitempty"`
+	Algorithm          string     `json:"algorithm,omitempty"`
+	Digest             string     `json:"digest,omitempty"`
+	Size               int64      `json:"size"`
+	SavedAt            *time.Time `json:"saved_at,omitempty"`
+}
+
+// ExportJSON writes the content of the database to w as one JSON document. It works on
+// a read-only database of an older schema as well, leaving out what that schema lacks.
+func (db *DB) ExportJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "{\n  \"schema_version\": %d,\n  \"exported_at\": %q", db.version, time.Now().UTC().Format(time.RFC3339Nano))
+
+	if err := db.exportRebalances(bw); err != nil {
+		return err
+	}
+	if err := db.exportChecksums(bw); err != nil {
+		return err
+	}
+	runs, err := db.Runs()
+	if err != nil {
+		return err
+	}
+	array := newJSONArray(bw, "runs")
+	for _, run := range runs {
+		if err := array.add(exportRun(run)); err != nil {
+			return err
+		}
+	}
+	array.close()
+	recovered, err := db.RecoveredFiles()
+	if err != nil {
+		return err
+	}
+	array = newJSONArray(bw, "recovered_files")
+	for _, rec := range recovered {
+		saved, savedB64 := encodePath(rec.SavedPath)
+		original, originalB64 := encodePath(rec.OriginalPath)
+		err := array.add(exportedRecovered{
+			SavedPath: saved, SavedPathBase64: savedB64,
+			OriginalPath: original, OriginalPathBase64: originalB64,
+			Algorithm: rec.Algorithm, Digest: rec.Digest, Size: rec.Size, SavedAt: timeOrNil(rec.SavedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	array.close()
+
+	bw.WriteString("\n}\n")
+	return bw.Flush()
+}
+
+// exportRebalances writes the rebalances array
+func (db *DB) exportRebalances(bw *bufio.Writer) error {
+	array := newJSONArray(bw, "rebalances")
+	defer array.close()
+	if ok, err := hasTable(db.DB, "rebalances"); err != nil || !ok {
+		return err
+	}
+	rows, err := db.DB.Query("SELECT " + db.rebalanceColumns() + " FROM rebalances ORDER BY file_path")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec, err := scanRebalance(rows)
+		if err != nil {
+			return err
+		}
+		path, b64 := encodePath(rec.FilePath)
+		err = array.add(exportedRebalance{
+			Path: path, PathBase64: b64, Device: rec.Device, Inode: rec.Inode, Count: rec.Count, Size: rec.Size,
+			DurationSeconds: rec.Duration.Seconds(), BytesPerSecond: rec.BytesPerSec,
+			RebalancedAt: timeOrNil(rec.RebalancedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportChecksums writes the checksums array
+func (db *DB) exportChecksums(bw *bufio.Writer) error {
+	array := newJSONArray(bw, "checksums")
+	defer array.close()
+	if ok, err := hasTable(db.DB, "checksums"); err != nil || !ok {
+		return err
+	}
+	rows, err := db.DB.Query("SELECT " + db.checksumColumns() + " FROM checksums ORDER BY file_path")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec, err := scanChecksum(rows)
+		if err != nil {
+			return err
+		}
+		path, b64 := encodePath(rec.FilePath)
+		err = array.add(exportedChecksum{
+			Path: path, PathBase64: b64, Algorithm: rec.Algorithm, Digest: rec.Digest,
+			CopyDigest: rec.CopyDigest, Size: rec.Size, ModTime: timeOrNil(rec.ModTime),
+			HashedAt: timeOrNil(rec.HashedAt), VerifiedAt: timeOrNil(rec.VerifiedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportRun converts a run and its datasets to their exported form
+func exportRun(run RunRecord) exportedRun {
+	out := exportedRun{
+		ID: run.ID, Started: timeOrNil(run.Started), Finished: timeOrNil(run.Finished),
+		Paths: run.Paths, Interrupted: run.Interrupted,
+		FilesRebalanced: run.FilesRebalanced, BytesRebalanced: run.BytesRebalanced,
+		FilesSkipped: run.FilesSkipped, FilesFailed: run.FilesFailed, FilesVerified: run.FilesVerified,
+	}
+	for _, d := range run.Datasets {
+		out.Datasets = append(out.Datasets, exportedDataset(d))
+	}
+	return out
+}
+
+// jsonArray writes the elements of a named array of the export one per line
+type jsonArray struct {
+	w     *bufio.Writer
+	empty bool
+}
+
+// newJSONArray starts the array name of the export object
+func newJSONArray(w *bufio.Writer, name string) *jsonArray {
+	fmt.Fprintf(w, ",\n  %q: [", name)
+	return &jsonArray{w: w, empty: true}
+}
+
+// add writes one element
+func (a *jsonArray) add(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !a.empty {
+		a.w.WriteByte(',')
+	}
+	a.empty = false
+	a.w.WriteString("\n    ")
+	_, err = a.w.Write(data)
+	return err
+}
+
+// close ends the array
+func (a *jsonArray) close() {
+	if !a.empty {
+		a.w.WriteString("\n  ")
+	}
+	a.w.WriteByte(']')
+}
+
+// ImportJSON merges a document written by ExportJSON into the database, in a single
+// transaction: pass counts, checksums and recovered files replace the records of the
+// same path, and runs are added unless a run with the same start, end and paths is
+// already recorded, so importing the same export twice changes nothing.
+func (db *DB) ImportJSON(r io.Reader) (ImportStats, error) {
+	var stats ImportStats
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if err := expectDelim(dec, '{'); err != nil {
+		return stats, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return stats, err
+		}
+		key, _ := tok.(string)
+		switch key {
+		case "schema_version":
+			var version int
+			if err := dec.Decode(&version); err != nil {
+				return stats, fmt.Errorf("schema_version: %w", err)
+			}
+			if version > LatestSchemaVersion() {
+				return stats, fmt.Errorf("%w: the export has schema version %d, this version of go-zfs-rebalance supports up to %d",
+					ErrNewerSchema, version, LatestSchemaVersion())
+			}
+		case "rebalances":
+			err = importArray(dec, key, func(e exportedRebalance) error {
+				path, err := decodePath(e.Path, e.PathBase64)
+				if err != nil {
+					return err
+				}
+				stats.Rebalances++
+				var device, inode any
+				if e.Inode != 0 {
+					device, inode = int64(e.Device), int64(e.Inode)
+				}
+				_, err = tx.Exec(`
+                    INSERT INTO rebalances (file_path, device, inode, count, size, duration, bytes_per_sec, rebalanced_at)
+                    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+                    ON CONFLICT(file_path) DO UPDATE SET
+                    device = excluded.device,
+                    inode = excluded.inode,
+                    count = excluded.count,
+                    size = excluded.size,
+                    duration = excluded.duration,
+                    bytes_per_sec = excluded.bytes_per_sec,
+                    rebalanced_at = excluded.rebalanced_at
+                `, path, device, inode, e.Count, e.Size, int64(e.DurationSeconds*float64(time.Second)), e.BytesPerSecond, unixNanoOf(e.RebalancedAt))
+				return err
+			})
+		case "checksums":
+			err = importArray(dec, key, func(e exportedChecksum) error {
+				path, err := decodePath(e.Path, e.PathBase64)
+				if err != nil {
+					return err
+				}
+				stats.Checksums++
+				_, err = tx.Exec(`
+                    INSERT INTO checksums (file_path, algorithm, digest, copy_digest, size, mtime, hashed_at, verified_at)
+                    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+                    ON CONFLICT(file_path) DO UPDATE SET
+                    algorithm = excluded.algorithm,
+                    digest = excluded.digest,
+                    copy_digest = excluded.copy_digest,
+                    size = excluded.size,
+                    mtime = excluded.mtime,
+                    hashed_at = excluded.hashed_at,
+                    verified_at = excluded.verified_at
+                `, path, e.Algorithm, e.Digest, e.CopyDigest, e.Size, unixNanoOf(e.ModTime),
+					unixNanoOf(e.HashedAt), unixNanoOf(e.VerifiedAt))
+				return err
+			})
+		case "runs":
+			err = importArray(dec, key, func(e exportedRun) error {
+				added, err := importRun(tx, e)
+				if added {
+					stats.Runs++
+				} else {
+					stats.RunsKnown++
+				}
+				return err
+			})
+		case "recovered_files":
+			err = importArray(dec, key, func(e exportedRecovered) error {
+				saved, err := decodePath(e.SavedPath, e.SavedPathBase64)
+				if err != nil {
+					return err
+				}
+				original, err := decodePath(e.OriginalPath, e.OriginalPathBase64)
+				if err != nil {
+					return err
+				}
+				stats.Recovered++
+				_, err = tx.Exec(`
+                    INSERT INTO recovered_files (saved_path, original_path, algorithm, digest, size, saved_at)
+                    VALUES (?, ?, ?, ?, ?, ?)
+                    ON CONFLICT(saved_path) DO UPDATE SET
+                    original_path = excluded.original_path,
+                    algorithm = excluded.algorithm,
+                    digest = excluded.digest,
+                    size = excluded.size,
+                    saved_at = excluded.saved_at
+                `, saved, original, e.Algorithm, e.Digest, e.Size, unixNanoOf(e.SavedAt))
+				return err
+			})
+		default:
+			// Keys of later versions, and exported_at
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return stats, err
+	}
+	return stats, tx.Commit()
+}
+
+// importRun adds a run unless one with the same start, end and paths is recorded
+func importRun(tx *sql.Tx, e exportedRun) (added bool, err error) {
+	paths, err := json.Marshal(e.Paths)
+	if err != nil {
+		return false, err
+	}
+	started, finished := unixNanoOf(e.Started), unixNanoOf(e.Finished)
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM runs WHERE started = ? AND finished = ? AND paths = ?",
+		started, finished, string(paths)).Scan(&n)
+	if err != nil || n > 0 {
+		return false, err
+	}
+
+	res, err := tx.Exec(`
+        INSERT INTO runs (started, finished, paths, files_rebalanced, bytes_rebalanced, files_skipped, files_failed, files_verified, interrupted)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		started, finished, string(paths), e.FilesRebalanced, e.BytesRebalanced, e.FilesSkipped, e.FilesFailed,
+		e.FilesVerified, e.Interrupted)
+	if err != nil {
+		return false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	for _, d := range e.Datasets {
+		_, err := tx.Exec(`
+            INSERT INTO run_datasets (run_id, dataset, files_rebalanced, bytes_rebalanced, files_skipped, files_failed)
+            VALUES (?, ?, ?, ?, ?, ?)`,
+			id, d.Dataset, d.FilesRebalanced, d.BytesRebalanced, d.FilesSkipped, d.FilesFailed)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// importArray decodes the elements of the array named key one at a time and passes each to fn
+func importArray[T any](dec *json.Decoder, key string, fn func(T) error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	for i := 0; dec.More(); i++ {
+		var e T
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("%s[%d]: %w", key, i, err)
+		}
+		if err := fn(e); err != nil {
+			return fmt.Errorf("%s[%d]: %w", key, i, err)
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token, which must be want
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("invalid export: expected %q, found %v", want, tok)
+	}
+	return nil
+}
+
+// timeOrNil leaves unset times out of the export
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// unixNanoOf is unixNano for an optional time of an export
+func unixNanoOf(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return unixNano(*t)
+}
+
+// encodePath returns the text form of path with invalid UTF-8 bytes escaped as \xNN,
+// and its exact bytes in base64 when it is not valid UTF-8
+func encodePath(path string) (text, b64 string) {
+	if utf8.ValidString(path) {
+		return path, ""
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); {
+		r, size := utf8.DecodeRuneInString(path[i:])
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, `\x%02x`, path[i])
+		} else {
+			b.WriteString(path[i : i+size])
+		}
+		i += size
+	}
+	return b.String(), base64.StdEncoding.EncodeToString([]byte(path))
+}
+
+// decodePath returns the exact path of an exported record
+func decodePath(text, b64 string) (string, error) {
+	if b64 == "" {
+		return text, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 path %q: %w", b64, err)
+	}
+	return string(raw), nil
+}
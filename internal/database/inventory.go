@@ -0,0 +1,111 @@
+package database
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// InventoryEntry is a file recorded by a scan as a candidate for rebalancing
+type InventoryEntry struct {
+	FilePath  string
+	Size      int64
+	Dataset   string
+	ScannedAt time.Time
+}
+
+// ReplaceInventory stores the entries of a scan of roots in one transaction, replacing
+// the entries an earlier scan recorded below those roots. The entries of other roots
+// are kept.
+func (db *DB) ReplaceInventory(roots []string, entries []InventoryEntry) error {
+	clean := make([]string, len(roots))
+	for i, root := range roots {
+		clean[i] = filepath.Clean(root)
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT file_path FROM inventory")
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		if withinAny(path, clean) {
+			stale = append(stale, path)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	del, err := tx.Prepare("DELETE FROM inventory WHERE file_path = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+	for _, path := range stale {
+		if _, err := del.Exec(path); err != nil {
+			return err
+		}
+	}
+
+	ins, err := tx.Prepare(`
+        INSERT INTO inventory (file_path, size, dataset, scanned_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT(file_path) DO UPDATE SET
+        size = excluded.size,
+        dataset = excluded.dataset,
+        scanned_at = excluded.scanned_at`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for _, e := range entries {
+		if _, err := ins.Exec(e.FilePath, e.Size, e.Dataset, unixNano(e.ScannedAt)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Inventory returns the entries recorded by scans below roots, all of them when roots is
+// empty, ordered by path. A database without an inventory has none.
+func (db *DB) Inventory(roots []string) ([]InventoryEntry, error) {
+	if ok, err := hasTable(db.DB, "inventory"); err != nil || !ok {
+		return nil, err
+	}
+	clean := make([]string, len(roots))
+	for i, root := range roots {
+		clean[i] = filepath.Clean(root)
+	}
+
+	rows, err := db.DB.Query("SELECT file_path, size, dataset, scanned_at FROM inventory ORDER BY file_path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []InventoryEntry
+	for rows.Next() {
+		var e InventoryEntry
+		var scannedAt int64
+		if err := rows.Scan(&e.FilePath, &e.Size, &e.Dataset, &scannedAt); err != nil {
+			return nil, err
+		}
+		if len(clean) > 0 && !withinAny(e.FilePath, clean) {
+			continue
+		}
+		e.ScannedAt = fromUnixNano(scannedAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
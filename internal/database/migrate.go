@@ -0,0 +1,186 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNewerSchema is returned when a database was written by a newer version of the tool,
+// whose schema this version does not know
+var ErrNewerSchema = errors.New("database schema is newer than this version supports")
+
+// migration moves the schema forward by one version
+type migration struct {
+	description string
+	statements  string
+}
+
+// migrations lists every schema change in order; migration i brings the schema to
+// version i+1. Databases from before versions were tracked are at version 0, and the
+// migrations up to the recovered files only create tables if missing, so they apply to
+// such a database whatever tables it already has. Later migrations may assume the schema
+// of the version before them. Never change a released migration, append a new one.
+var migrations = []migration{
+	{"pass counts and checksums", `
+    CREATE TABLE IF NOT EXISTS rebalances (
+        file_path TEXT PRIMARY KEY,
+        count INT
+    );
+    CREATE TABLE IF NOT EXISTS checksums (
+        file_path TEXT PRIMARY KEY,
+        algorithm TEXT,
+        digest TEXT,
+        size INT,
+        mtime INT,
+        verified_at INT
+    );`},
+	{"run history", `
+    CREATE TABLE IF NOT EXISTS runs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        started INT,
+        finished INT,
+        paths TEXT,
+        files_rebalanced INT,
+        bytes_rebalanced INT,
+        files_skipped INT,
+        files_failed INT,
+        interrupted INT
+    );
+    CREATE TABLE IF NOT EXISTS run_datasets (
+        run_id INT REFERENCES runs(id) ON DELETE CASCADE,
+        dataset TEXT,
+        files_rebalanced INT,
+        bytes_rebalanced INT,
+        files_skipped INT,
+        files_failed INT,
+        PRIMARY KEY (run_id, dataset)
+    );`},
+	{"recovered files", `
+    CREATE TABLE IF NOT EXISTS recovered_files (
+        saved_path TEXT PRIMARY KEY,
+        original_path TEXT,
+        algorithm TEXT,
+        digest TEXT,
+        size INT,
+        saved_at INT
+    );`},
+	{"per-file size, duration and speed", `
+    ALTER TABLE rebalances ADD COLUMN size INT;
+    ALTER TABLE rebalances ADD COLUMN duration INT;
+    ALTER TABLE rebalances ADD COLUMN bytes_per_sec REAL;
+    ALTER TABLE rebalances ADD COLUMN rebalanced_at INT;`},
+	{"copy checksums and hash times", `
+    ALTER TABLE checksums ADD COLUMN copy_digest TEXT;
+    ALTER TABLE checksums ADD COLUMN hashed_at INT;`},
+	{"device and inode of counted files", `
+    ALTER TABLE rebalances ADD COLUMN device INT;
+    ALTER TABLE rebalances ADD COLUMN inode INT;
+    CREATE INDEX rebalances_inode ON rebalances (inode, device);`},
+	{"inventory of scanned files", `
+    CREATE TABLE inventory (
+        file_path TEXT PRIMARY KEY,
+        size INT,
+        dataset TEXT,
+        scanned_at INT
+    );`},
+	{"files verified after replacement", `
+    ALTER TABLE runs ADD COLUMN files_verified INT;`},
+}
+
+// LatestSchemaVersion is the schema version this version of the tool writes
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the schema version of the database, 0 for a database from
+// before versions were tracked
+func (db *DB) SchemaVersion() (int, error) {
+	return schemaVersion(db.DB)
+}
+
+// querier is what schemaVersion needs of a database or transaction
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func schemaVersion(q querier) (int, error) {
+	tracked, err := hasTable(q, "schema_version")
+	if err != nil || !tracked {
+		return 0, err
+	}
+	var version int
+	err = q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// hasTable reports whether the database has the named table
+func hasTable(q querier, name string) (bool, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// checkSchema returns an ErrNewerSchema error if the database at path has a schema
+// version newer than this version of the tool knows
+func checkSchema(path string, version int) error {
+	if latest := LatestSchemaVersion(); version > latest {
+		return fmt.Errorf("%w: %s has schema version %d, this version of go-zfs-rebalance supports up to %d; upgrade the tool to use it",
+			ErrNewerSchema, path, version, latest)
+	}
+	return nil
+}
+
+// migrate brings the schema of db up to LatestSchemaVersion. Each migration is applied
+// in a transaction together with its version record, so an interrupted upgrade resumes
+// from the last complete version.
+func migrate(db *sql.DB, path string) error {
+	if _, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        description TEXT,
+        applied INT
+    );`); err != nil {
+		return err
+	}
+
+	for {
+		done, err := migrateStep(db, path)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateStep applies the migration after the current version, if any, and reports
+// whether the schema is up to date
+func migrateStep(db *sql.DB, path string) (done bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Read the version in the transaction, another instance may be migrating as well
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if err := checkSchema(path, version); err != nil {
+		return false, err
+	}
+	if version == LatestSchemaVersion() {
+		return true, nil
+	}
+
+	m := migrations[version]
+	if _, err := tx.Exec(m.statements); err != nil {
+		return false, fmt.Errorf("schema migration to version %d (%s): %w", version+1, m.description, err)
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?)",
+		version+1, m.description, unixNano(time.Now())); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
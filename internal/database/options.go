@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/sysinfo"
+)
+
+// Temp store modes for Options.TempStore
+const (
+	TempStoreDefault = "default"
+	TempStoreFile    = "file"
+	TempStoreMemory  = "memory"
+)
+
+// Default tuning bounds; SQLite's own defaults (2 MB of cache, no mmap) crawl once a
+// table of tens of millions of rows no longer fits in the cache
+const (
+	minCacheBytes = 16 << 20
+	maxCacheBytes = 1 << 30
+	maxMmapBytes  = 1 << 30
+	// memoryTempStoreMin is the system memory above which temp tables and indexes are kept in RAM
+	memoryTempStoreMin = 4 << 30
+	// defaultBusyTimeout is how long a statement waits for a lock held by another connection
+	// or process before failing with "database is locked"
+	defaultBusyTimeout = 10 * time.Second
+)
+
+// Options tunes SQLite for large databases. Zero values are replaced by defaults scaled
+// to the system memory.
+type Options struct {
+	// CacheSizeMB is the page cache of each connection (PRAGMA cache_size)
+	CacheSizeMB int
+	// TempStore is TempStoreDefault, TempStoreFile or TempStoreMemory (PRAGMA temp_store)
+	TempStore string
+	// MmapSizeMB is how much of the file is memory-mapped (PRAGMA mmap_size); negative disables mmap
+	MmapSizeMB int
+	// ReadOnly opens an existing database without allowing any change to it (PRAGMA query_only)
+	ReadOnly bool
+	// BusyTimeout is how long a statement waits for a lock (PRAGMA busy_timeout); negative
+	// fails at once
+	BusyTimeout time.Duration
+}
+
+// DefaultOptions returns the tuning used for zero Options on a system with the given
+// memory in bytes, 0 meaning unknown
+func DefaultOptions(totalMemory uint64) Options {
+	if totalMemory == 0 {
+		return Options{CacheSizeMB: minCacheBytes >> 20, TempStore: TempStoreDefault, MmapSizeMB: -1}
+	}
+
+	cache := min(max(totalMemory/64, minCacheBytes), maxCacheBytes)
+	mmap := min(totalMemory/16, maxMmapBytes)
+	tempStore := TempStoreDefault
+	if totalMemory >= memoryTempStoreMin {
+		tempStore = TempStoreMemory
+	}
+	return Options{
+		CacheSizeMB: int(cache >> 20),
+		TempStore:   tempStore,
+		MmapSizeMB:  int(mmap >> 20),
+	}
+}
+
+// withDefaults fills the zero fields of o from DefaultOptions
+func (o Options) withDefaults() Options {
+	if o.BusyTimeout == 0 {
+		o.BusyTimeout = defaultBusyTimeout
+	}
+	if o.CacheSizeMB != 0 && o.TempStore != "" && o.MmapSizeMB != 0 {
+		return o
+	}
+
+	totalMemory, err := sysinfo.TotalMemory()
+	if err != nil {
+		totalMemory = 0
+	}
+	defaults := DefaultOptions(totalMemory)
+	if o.CacheSizeMB == 0 {
+		o.CacheSizeMB = defaults.CacheSizeMB
+	}
+	if o.TempStore == "" {
+		o.TempStore = defaults.TempStore
+	}
+	if o.MmapSizeMB == 0 {
+		o.MmapSizeMB = defaults.MmapSizeMB
+	}
+	return o
+}
+
+// pragmas returns the statements applying o to a connection
+func (o Options) pragmas() ([]string, error) {
+	switch o.TempStore {
+	case TempStoreDefault, TempStoreFile, TempStoreMemory:
+	default:
+		return nil, fmt.Errorf("invalid temp store %q: expected %s, %s or %s", o.TempStore, TempStoreDefault, TempStoreFile, TempStoreMemory)
+	}
+	if o.CacheSizeMB < 0 {
+		return nil, fmt.Errorf("invalid cache size %d MB", o.CacheSizeMB)
+	}
+
+	mmapBytes := int64(0)
+	if o.MmapSizeMB > 0 {
+		mmapBytes = int64(o.MmapSizeMB) << 20
+	}
+	pragmas := []string{
+		// A negative cache_size is in KiB rather than pages
+		fmt.Sprintf("PRAGMA cache_size = -%d", int64(o.CacheSizeMB)<<10),
+		fmt.Sprintf("PRAGMA temp_store = %s", o.TempStore),
+		fmt.Sprintf("PRAGMA mmap_size = %d", mmapBytes),
+		fmt.Sprintf("PRAGMA busy_timeout = %d", max(o.BusyTimeout, 0).Milliseconds()),
+	}
+	if o.ReadOnly {
+		pragmas = append(pragmas, "PRAGMA query_only = ON")
+	}
+	return pragmas, nil
+}
@@ -0,0 +1,376 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// pruneBatchSize is the number of paths checked, and deleted, at a time
+const pruneBatchSize = 1000
+
+// PruneStats counts the records Prune removed, or would remove in a dry run
+type PruneStats struct {
+	Checked    int
+	Rebalances int
+	Checksums  int
+	Recovered  int
+	Inventory  int
+	// Moved counts the pass counts of missing paths moved to the file renamed since
+	Moved int
+}
+
+// Removed is the number of records removed from all tables
+func (s PruneStats) Removed() int {
+	return s.Rebalances + s.Checksums + s.Recovered + s.Inventory
+}
+
+// Prune removes the records of files that no longer exist: the pass counts and checksums
+// of deleted files, their inventory entries, and recovered files whose saved copy is gone.
+// Only paths within roots are checked, all paths when roots is empty. A root that does not
+// exist, or where none of the files recorded below it exists, such as the empty mountpoint
+// of an unmounted dataset, is left alone rather than emptied, and a record is only removed
+// when its file is reported missing, not when it cannot be checked. A pass count whose
+// device and inode are those of a file below the roots belongs to a file renamed since it
+// was counted, and is moved to its new path instead. With dryRun nothing is changed.
+func (db *DB) Prune(roots []string, dryRun bool) (PruneStats, error) {
+	var stats PruneStats
+	if db.ReadOnly && !dryRun {
+		return stats, errors.New("cannot prune a read-only database")
+	}
+
+	var present []string
+	for _, root := range roots {
+		if _, err := os.Stat(root); err != nil {
+			continue
+		}
+		root = filepath.Clean(root)
+		if mounted, err := db.holdsRecordedFile(root); err != nil {
+			return stats, err
+		} else if !mounted {
+			continue
+		}
+		present = append(present, root)
+	}
+	if len(roots) > 0 && len(present) == 0 {
+		return stats, nil
+	}
+
+	moved, err := db.followRenames(present, dryRun)
+	stats.Moved = len(moved)
+	if err != nil {
+		return stats, err
+	}
+
+	tables := []struct {
+		name, column string
+		removed      *int
+	}{
+		{"rebalances", "file_path", &stats.Rebalances},
+		{"checksums", "file_path", &stats.Checksums},
+		{"recovered_files", "saved_path", &stats.Recovered},
+		{"inventory", "file_path", &stats.Inventory},
+	}
+	for _, t := range tables {
+		if ok, err := hasTable(db.DB, t.name); err != nil {
+			return stats, err
+		} else if !ok {
+			continue
+		}
+		// A dry run did not move the records it found renamed
+		var keep map[string]bool
+		if t.name == "rebalances" {
+			keep = moved
+		}
+		checked, removed, err := db.pruneTable(t.name, t.column, present, keep, dryRun)
+		stats.Checked += checked
+		*t.removed += removed
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// pruneTable removes the rows of table whose path in column is missing, except those of
+// keep, a batch at a time in path order, and returns the number of paths checked and rows
+// removed
+func (db *DB) pruneTable(table, column string, roots []string, keep map[string]bool, dryRun bool) (checked, removed int, err error) {
+	after := ""
+	for {
+		paths, err := db.pathsAfter(table, column, after)
+		if err != nil {
+			return checked, removed, err
+		}
+		if len(paths) == 0 {
+			return checked, removed, nil
+		}
+		after = paths[len(paths)-1]
+
+		var missing []string
+		for _, path := range paths {
+			if len(roots) > 0 && !withinAny(path, roots) {
+				continue
+			}
+			checked++
+			if _, err := os.Lstat(path); os.IsNotExist(err) && !keep[path] {
+				missing = append(missing, path)
+			}
+		}
+		if dryRun {
+			removed += len(missing)
+			continue
+		}
+		if err := db.deletePaths(table, column, missing); err != nil {
+			return checked, removed, err
+		}
+		removed += len(missing)
+	}
+}
+
+// holdsRecordedFile reports whether a file recorded below root still exists, root is on
+// the device recorded for a file below it, or none is recorded. The mountpoint of an
+// unmounted dataset holds none of its files and is on the parent's device. A device
+// alone cannot tell it is unmounted, as device numbers can change when a dataset is
+// mounted again.
+func (db *DB) holdsRecordedFile(root string) (bool, error) {
+	info, statErr := os.Stat(root)
+	if statErr == nil && !info.IsDir() {
+		return true, nil
+	}
+	// Paths below root sort between root + "/" and root + "0", the next byte
+	low := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
+	high := low[:len(low)-1] + string(filepath.Separator+1)
+	recorded := false
+	for _, table := range []string{"rebalances", "checksums", "inventory"} {
+		if ok, err := hasTable(db.DB, table); err != nil {
+			return false, err
+		} else if !ok {
+			continue
+		}
+		after := low
+		for {
+			rows, err := db.DB.Query("SELECT file_path FROM "+table+
+				" WHERE file_path > ? AND file_path < ? ORDER BY file_path LIMIT ?", after, high, pruneBatchSize)
+			if err != nil {
+				return false, err
+			}
+			var paths []string
+			for rows.Next() {
+				var path string
+				if err := rows.Scan(&path); err != nil {
+					rows.Close()
+					return false, err
+				}
+				paths = append(paths, path)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return false, err
+			}
+			if len(paths) == 0 {
+				break
+			}
+			recorded = true
+			for _, path := range paths {
+				if _, err := os.Lstat(path); !os.IsNotExist(err) {
+					return true, nil
+				}
+			}
+			after = paths[len(paths)-1]
+		}
+	}
+	if !recorded || statErr != nil || db.version < 6 {
+		return !recorded, nil
+	}
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		return false, nil
+	}
+	var one int
+	err = db.DB.QueryRow("SELECT 1 FROM rebalances WHERE device = ? AND file_path > ? AND file_path < ? LIMIT 1",
+		int64(id.Dev), low, high).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// followRenames moves the pass counts of missing paths within roots to the file below
+// roots with their device and inode, one renamed since it was counted and never seen
+// under its new name, such as a file at its pass limit left out by --since. Without roots
+// the paths of the recorded runs are searched. It returns the paths whose count moved, or
+// would move in a dry run.
+func (db *DB) followRenames(roots []string, dryRun bool) (map[string]bool, error) {
+	if db.version < 6 {
+		return nil, nil
+	}
+	missing := make(map[fileutil.FileID]RebalanceRecord)
+	after := ""
+	for {
+		rows, err := db.DB.Query("SELECT "+db.rebalanceColumns()+
+			" FROM rebalances WHERE inode IS NOT NULL AND file_path > ? ORDER BY file_path LIMIT ?", after, pruneBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		var batch []RebalanceRecord
+		for rows.Next() {
+			rec, err := scanRebalance(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			batch = append(batch, rec)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		after = batch[len(batch)-1].FilePath
+		for _, rec := range batch {
+			if len(roots) > 0 && !withinAny(rec.FilePath, roots) {
+				continue
+			}
+			if _, err := os.Lstat(rec.FilePath); os.IsNotExist(err) {
+				missing[fileutil.FileID{Dev: rec.Device, Ino: rec.Inode}] = rec
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	search := roots
+	if len(search) == 0 {
+		runs, err := db.Runs()
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range runs {
+			search = append(search, run.Paths...)
+		}
+	}
+	moved := make(map[string]bool)
+	var moveErr error
+	for _, root := range search {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			id, err := fileutil.GetFileIDFromFileInfo(info)
+			if err != nil {
+				return nil
+			}
+			rec, ok := missing[id]
+			if !ok || (rec.Size > 0 && rec.Size != info.Size()) {
+				return nil
+			}
+			delete(missing, id)
+			// A hardlink of the file keeps its own count, the missing path is pruned
+			if _, counted, err := db.GetRebalance(path); err != nil || counted {
+				moveErr = err
+				return moveErr
+			}
+			moved[rec.FilePath] = true
+			if !dryRun {
+				if moveErr = db.moveRebalance(rec, path); moveErr != nil {
+					return moveErr
+				}
+			}
+			if len(missing) == 0 {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if moveErr != nil {
+			return moved, moveErr
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return moved, err
+		}
+		if len(missing) == 0 {
+			break
+		}
+	}
+	return moved, nil
+}
+
+// moveRebalance stores rec under path and forgets it under its old path
+func (db *DB) moveRebalance(rec RebalanceRecord, path string) error {
+	old := rec.FilePath
+	rec.FilePath = path
+	if err := db.RecordRebalance(rec); err != nil {
+		return err
+	}
+	return db.DeleteRebalance(old)
+}
+
+// pathsAfter returns the next batch of paths of table, in order, after the given one
+func (db *DB) pathsAfter(table, column, after string) ([]string, error) {
+	rows, err := db.DB.Query("SELECT "+column+" FROM "+table+" WHERE "+column+" > ? ORDER BY "+column+" LIMIT ?",
+		after, pruneBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// deletePaths deletes the rows of the given paths in one transaction
+func (db *DB) deletePaths(table, column string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("DELETE FROM " + table + " WHERE " + column + " = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, path := range paths {
+		if _, err := stmt.Exec(path); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// withinAny reports whether path is one of roots or lies below one of them
+func withinAny(path string, roots []string) bool {
+	for _, root := range roots {
+		if filepath.IsAbs(path) != filepath.IsAbs(root) {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"time"
+)
+
+// RecoveredFile is a copy saved aside when it could not be renamed over its removed
+// original, so that the data can be found and restored later
+type RecoveredFile struct {
+	// OriginalPath is where the file belongs, SavedPath where its data was saved
+	OriginalPath string
+	SavedPath    string
+	// Algorithm and Digest are the verified checksum of the data, empty without verification
+	Algorithm string
+	Digest    string
+	Size      int64
+	SavedAt   time.Time
+}
+
+// AddRecovered registers a saved copy, replacing an earlier record of the same saved path
+func (db *DB) AddRecovered(rec RecoveredFile) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, err := db.DB.Exec(`
+        INSERT INTO recovered_files (saved_path, original_path, algorithm, digest, size, saved_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT(saved_path) DO UPDATE SET
+        original_path = excluded.original_path,
+        algorithm = excluded.algorithm,
+        digest = excluded.digest,
+        size = excluded.size,
+        saved_at = excluded.saved_at
+    `, rec.SavedPath, rec.OriginalPath, rec.Algorithm, rec.Digest, rec.Size, unixNano(rec.SavedAt))
+	return err
+}
+
+// RecoveredFiles returns the registered copies, oldest first. A database created before
+// copies were registered has none.
+func (db *DB) RecoveredFiles() ([]RecoveredFile, error) {
+	if ok, err := hasTable(db.DB, "recovered_files"); err != nil || !ok {
+		return nil, err
+	}
+
+	rows, err := db.DB.Query(`
+        SELECT saved_path, original_path, algorithm, digest, size, saved_at
+        FROM recovered_files ORDER BY saved_at, saved_path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []RecoveredFile
+	for rows.Next() {
+		var rec RecoveredFile
+		var savedAt int64
+		if err := rows.Scan(&rec.SavedPath, &rec.OriginalPath, &rec.Algorithm, &rec.Digest, &rec.Size, &savedAt); err != nil {
+			return nil, err
+		}
+		rec.SavedAt = fromUnixNano(savedAt)
+		files = append(files, rec)
+	}
+	return files, rows.Err()
+}
+
+// DeleteRecovered forgets the copy saved at savedPath, once it was restored or discarded
+func (db *DB) DeleteRecovered(savedPath string) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, err := db.DB.Exec("DELETE FROM recovered_files WHERE saved_path = ?", savedPath)
+	return err
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RunRecord holds the totals of one finished run, kept so that a persistent database
+// also records what was rewritten over time
+type RunRecord struct {
+	ID       int64
+	Started  time.Time
+	Finished time.Time
+	Paths    []string
+	// Interrupted is set when a shutdown, too many failures, a full pool or the byte or time
+	// limit stopped the run before every file was processed
+	Interrupted     bool
+	FilesRebalanced int64
+	BytesRebalanced int64
+	FilesSkipped    int64
+	FilesFailed     int64
+	// FilesVerified counts the rewritten files that passed the check after replacement
+	FilesVerified int64
+	Datasets      []DatasetRecord
+}
+
+// DatasetRecord holds the totals of the files of one dataset in a run
+type DatasetRecord struct {
+	Dataset         string
+	FilesRebalanced int64
+	BytesRebalanced int64
+	FilesSkipped    int64
+	FilesFailed     int64
+}
+
+// AddRun stores a run with its datasets and returns its ID
+func (db *DB) AddRun(rec RunRecord) (int64, error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	paths, err := json.Marshal(rec.Paths)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+        INSERT INTO runs (started, finished, paths, files_rebalanced, bytes_rebalanced, files_skipped, files_failed, files_verified, interrupted)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		unixNano(rec.Started), unixNano(rec.Finished), string(paths),
+		rec.FilesRebalanced, rec.BytesRebalanced, rec.FilesSkipped, rec.FilesFailed, rec.FilesVerified, rec.Interrupted)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range rec.Datasets {
+		_, err := tx.Exec(`
+            INSERT INTO run_datasets (run_id, dataset, files_rebalanced, bytes_rebalanced, files_skipped, files_failed)
+            VALUES (?, ?, ?, ?, ?, ?)`,
+			id, d.Dataset, d.FilesRebalanced, d.BytesRebalanced, d.FilesSkipped, d.FilesFailed)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// runColumns is the select list of a run record, with a constant in place of the column a
+// read-only database of an older schema lacks
+func (db *DB) runColumns() string {
+	if db.version < 8 {
+		return "id, started, finished, paths, files_rebalanced, bytes_rebalanced, files_skipped, files_failed, 0, interrupted"
+	}
+	return "id, started, finished, paths, files_rebalanced, bytes_rebalanced, files_skipped, files_failed, " +
+		"COALESCE(files_verified, 0), interrupted"
+}
+
+// Runs returns every stored run with its datasets, oldest first. A database created
+// before runs were recorded has none.
+func (db *DB) Runs() ([]RunRecord, error) {
+	for _, table := range []string{"runs", "run_datasets"} {
+		if ok, err := hasTable(db.DB, table); err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	rows, err := db.DB.Query(`SELECT ` + db.runColumns() + ` FROM runs ORDER BY started, id`)
+	if err != nil {
+		return nil, err
+	}
+	var runs []RunRecord
+	index := make(map[int64]int)
+	for rows.Next() {
+		var rec RunRecord
+		var started, finished int64
+		var paths string
+		err := rows.Scan(&rec.ID, &started, &finished, &paths, &rec.FilesRebalanced, &rec.BytesRebalanced,
+			&rec.FilesSkipped, &rec.FilesFailed, &rec.FilesVerified, &rec.Interrupted)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rec.Started, rec.Finished = fromUnixNano(started), fromUnixNano(finished)
+		if err := json.Unmarshal([]byte(paths), &rec.Paths); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("run %d: invalid paths: %w", rec.ID, err)
+		}
+		index[rec.ID] = len(runs)
+		runs = append(runs, rec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.DB.Query(`
+        SELECT run_id, dataset, files_rebalanced, bytes_rebalanced, files_skipped, files_failed
+        FROM run_datasets ORDER BY run_id, dataset`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var d DatasetRecord
+		if err := rows.Scan(&id, &d.Dataset, &d.FilesRebalanced, &d.BytesRebalanced, &d.FilesSkipped, &d.FilesFailed); err != nil {
+			return nil, err
+		}
+		if i, ok := index[id]; ok {
+			runs[i].Datasets = append(runs[i].Datasets, d)
+		}
+	}
+	return runs, rows.Err()
+}
@@ -0,0 +1,213 @@
+// Package faultinject makes chosen operations of a rebalance fail on purpose, so the
+// code that recovers from failures can be exercised end to end: a rename failing after
+// the original was removed, a copy that does not match, a process dying half-way. It is
+// inert unless the REBALANCE_FAULTS environment variable is set and Load is called, or a
+// test calls Enable.
+//
+// A specification is a comma-separated list of rules of the form
+//
+//	[crash:]point[=pattern][@count]
+//
+// point is the operation to fail (copy, hash, remove, rename, fsync). pattern is a
+// filepath.Match pattern matched against the base name of the file, or against the whole
+// path if it contains a separator; without one every file matches. count limits how many
+// times the rule fires, unlimited by default. A rule with the crash: prefix stops the
+// process with CrashExitCode instead of failing the operation, leaving behind what a
+// power loss at that point would.
+//
+//	REBALANCE_FAULTS='rename=*.iso@1,crash:remove=/tank/media/*'
+package faultinject
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EnvVar is the environment variable Load reads the specification from
+const EnvVar = "REBALANCE_FAULTS"
+
+// CrashExitCode is the exit status of a process stopped by a crash rule
+const CrashExitCode = 70
+
+// Point is an operation a fault can be injected into
+type Point string
+
+// The operations that check for faults
+const (
+	Copy   Point = "copy"   // copying a file to its temporary copy
+	Hash   Point = "hash"   // comparing the checksums of a file and its copy
+	Remove Point = "remove" // removing the original
+	Rename Point = "rename" // renaming a copy into place
+	Fsync  Point = "fsync"  // syncing a file to disk
+)
+
+var points = []Point{Copy, Hash, Remove, Rename, Fsync}
+
+// ErrInjected is wrapped by the errors of injected faults
+var ErrInjected = errors.New("injected fault")
+
+// rule is one entry of a specification
+type rule struct {
+	point   Point
+	pattern string
+	crash   bool
+	// remaining is the number of times the rule still fires, -1 for unlimited
+	remaining int
+}
+
+// Faults is a parsed specification
+type Faults struct {
+	mu    sync.Mutex
+	rules []*rule
+}
+
+// active is the specification in effect, nil when fault injection is off
+var active atomic.Pointer[Faults]
+
+// exit stops the process for crash rules, replaced in tests
+var exit = os.Exit
+
+// Parse parses a specification
+func Parse(spec string) (*Faults, error) {
+	f := &Faults{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		r := &rule{remaining: -1}
+		if rest, ok := strings.CutPrefix(field, "crash:"); ok {
+			r.crash, field = true, rest
+		}
+		if at := strings.LastIndexByte(field, '@'); at >= 0 {
+			n, err := strconv.Atoi(field[at+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid count in fault %q", field)
+			}
+			r.remaining, field = n, field[:at]
+		}
+		name, pattern, _ := strings.Cut(field, "=")
+		r.point = Point(name)
+		if !validPoint(r.point) {
+			return nil, fmt.Errorf("unknown fault point %q, expected one of %s", name, pointNames())
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in fault %q: %w", field, err)
+		}
+		r.pattern = pattern
+		f.rules = append(f.rules, r)
+	}
+	if len(f.rules) == 0 {
+		return nil, errors.New("no faults given")
+	}
+	return f, nil
+}
+
+func validPoint(p Point) bool {
+	for _, known := range points {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+func pointNames() string {
+	names := make([]string, len(points))
+	for i, p := range points {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Load turns fault injection on if EnvVar is set and returns the specification in effect,
+// empty when it is not set
+func Load() (string, error) {
+	spec := os.Getenv(EnvVar)
+	if spec == "" {
+		return "", nil
+	}
+	f, err := Parse(spec)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", EnvVar, err)
+	}
+	active.Store(f)
+	return spec, nil
+}
+
+// Enable turns fault injection on with spec until the returned function is called
+func Enable(spec string) (disable func(), err error) {
+	f, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	active.Store(f)
+	return func() { active.CompareAndSwap(f, nil) }, nil
+}
+
+// Check returns an error wrapping ErrInjected if a rule fails the operation p on path.
+// A crash rule stops the process instead. Without fault injection it returns nil.
+func Check(p Point, path string) error {
+	f := active.Load()
+	if f == nil {
+		return nil
+	}
+	return f.Check(p, path)
+}
+
+// Check is Check for the rules of f instead of the ones in effect
+func (f *Faults) Check(p Point, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.rules {
+		if r.point != p || r.remaining == 0 || !r.matches(path) {
+			continue
+		}
+		if r.remaining > 0 {
+			r.remaining--
+		}
+		if r.crash {
+			fmt.Fprintf(os.Stderr, "faultinject: crashing before %s of %s\n", p, path)
+			exit(CrashExitCode)
+		}
+		return &fs.PathError{Op: string(p), Path: path, Err: ErrInjected}
+	}
+	return nil
+}
+
+func (r *rule) matches(path string) bool {
+	if r.pattern == "" {
+		return true
+	}
+	name := filepath.Base(path)
+	if strings.ContainsRune(r.pattern, filepath.Separator) {
+		name = path
+	}
+	ok, _ := filepath.Match(r.pattern, name)
+	return ok
+}
+
+// Digest returns digest, or a different digest if a hash fault fires for path, so a
+// verified copy can be made to look corrupt
+func Digest(path, digest string) string {
+	if Check(Hash, path) == nil {
+		return digest
+	}
+	if digest == "" {
+		return "0"
+	}
+	// Flip the last hex digit
+	last := digest[len(digest)-1]
+	flipped := byte('0')
+	if last == '0' {
+		flipped = '1'
+	}
+	return digest[:len(digest)-1] + string(flipped)
+}
@@ -0,0 +1,85 @@
+package faultinject
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	f, err := Parse("rename=*.iso@1, crash:remove=/tank/media/*,hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(f.rules))
+	}
+	if r := f.rules[0]; r.point != Rename || r.pattern != "*.iso" || r.remaining != 1 || r.crash {
+		t.Errorf("Unexpected first rule %+v", r)
+	}
+	if r := f.rules[1]; r.point != Remove || r.pattern != "/tank/media/*" || r.remaining != -1 || !r.crash {
+		t.Errorf("Unexpected second rule %+v", r)
+	}
+
+	for _, bad := range []string{"", "unlink", "rename@0", "rename@x", "copy=[", " , "} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check(Rename, "/tank/a.iso"); err != nil {
+		t.Fatalf("Expected no fault without a specification, got %v", err)
+	}
+
+	disable, err := Enable("rename=*.iso@1,remove=/tank/keep/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disable()
+
+	if err := Check(Rename, "/tank/a.txt"); err != nil {
+		t.Errorf("Expected no fault for a file not matching, got %v", err)
+	}
+	if err := Check(Rename, "/tank/a.iso"); !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected an injected fault, got %v", err)
+	}
+	if err := Check(Rename, "/tank/b.iso"); err != nil {
+		t.Errorf("Expected the rule to fire once only, got %v", err)
+	}
+	if err := Check(Remove, "/tank/keep/x"); !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected a fault matching the whole path, got %v", err)
+	}
+	if err := Check(Remove, "/tank/x"); err != nil {
+		t.Errorf("Expected no fault outside the pattern, got %v", err)
+	}
+
+	disable()
+	if err := Check(Remove, "/tank/keep/x"); err != nil {
+		t.Errorf("Expected no fault once disabled, got %v", err)
+	}
+}
+
+func TestCrashAndDigest(t *testing.T) {
+	code := -1
+	defer func(saved func(int)) { exit = saved }(exit)
+	exit = func(c int) { code = c }
+
+	disable, err := Enable("crash:rename@1,hash=*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disable()
+
+	Check(Rename, "/tank/a")
+	if code != CrashExitCode {
+		t.Errorf("Expected exit code %d, got %d", CrashExitCode, code)
+	}
+
+	if got := Digest("/tank/a.txt", "abc0"); got != "abc0" {
+		t.Errorf("Expected the digest unchanged, got %q", got)
+	}
+	if got := Digest("/tank/a.bin", "abc0"); got == "abc0" || len(got) != 4 {
+		t.Errorf("Expected a different digest of the same length, got %q", got)
+	}
+}
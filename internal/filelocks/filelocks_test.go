@@ -0,0 +1,38 @@
+package filelocks
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleLocks = `1: LEASE  ACTIVE    READ  2345 00:2e:131 0 EOF
+2: POSIX  ADVISORY  WRITE 812 08:01:5678 0 EOF
+3: FLOCK  MANDATORY WRITE 999 fd:00:42 0 EOF
+3: -> FLOCK  MANDATORY WRITE 1000 fd:00:42 0 EOF
+4: DELEG  ACTIVE    READ  0 00:35:77 0 EOF
+`
+
+func TestParseLocks(t *testing.T) {
+	table, err := parseLocks(strings.NewReader(sampleLocks))
+	if err != nil {
+		t.Fatalf("parseLocks failed: %v", err)
+	}
+	if len(table) != 3 {
+		t.Fatalf("Expected 3 locks without the advisory lock and the waiter, got %v", table)
+	}
+
+	lease := table[File{Major: 0, Minor: 0x2e, Ino: 131}]
+	if lease.Kind != "lease" || lease.PID != 2345 || lease.String() != "active lease held by pid 2345" {
+		t.Errorf("Unexpected lease %+v", lease)
+	}
+	if l := table[File{Major: 0xfd, Minor: 0, Ino: 42}]; l.Kind != "mandatory lock" || l.PID != 999 {
+		t.Errorf("Unexpected mandatory lock %+v", l)
+	}
+	if l := table[File{Major: 0, Minor: 0x35, Ino: 77}]; l.String() != "active delegation" {
+		t.Errorf("Unexpected delegation %+v", l)
+	}
+
+	if _, err := parseLocks(strings.NewReader("1: LEASE ACTIVE READ 1 zz:00:1 0 EOF\n")); err == nil {
+		t.Error("Expected an error for an invalid device")
+	}
+}
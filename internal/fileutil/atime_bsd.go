@@ -0,0 +1,19 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// AccessTime returns the last access time of the file info describes, its modification
+// time if the platform does not report one
+func AccessTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,16 @@
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// AccessTime returns the last access time of the file info describes, its modification
+// time if the platform does not report one
+func AccessTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package fileutil
+
+import (
+	"os"
+	"time"
+)
+
+// AccessTime returns the modification time of the file info describes, as this platform
+// does not report the last access time
+func AccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
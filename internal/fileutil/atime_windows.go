@@ -0,0 +1,16 @@
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// AccessTime returns the last access time of the file info describes, its modification
+// time if the platform does not report one
+func AccessTime(info os.FileInfo) time.Time {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, data.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
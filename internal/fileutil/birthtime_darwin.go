@@ -0,0 +1,28 @@
+package fileutil
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the birth time of path, false if the filesystem does not record it
+func birthTime(path string) (time.Time, bool, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return time.Time{}, false, err
+	}
+	if st.Btim.Sec <= 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(st.Btim.Unix()), true, nil
+}
+
+// setBirthTime sets the birth time of path with setattrlist
+func setBirthTime(path string, t time.Time) error {
+	attrs := unix.Attrlist{Bitmapcount: unix.ATTR_BIT_MAP_COUNT, Commonattr: unix.ATTR_CMN_CRTIME}
+	ts := unix.NsecToTimespec(t.UnixNano())
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts))
+	return unix.Setattrlist(path, &attrs, buf, unix.FSOPT_NOFOLLOW)
+}
@@ -0,0 +1,34 @@
+package fileutil
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the birth time of path, false if the filesystem does not record it
+func birthTime(path string) (time.Time, bool, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return time.Time{}, false, err
+	}
+	if st.Btim.Sec <= 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(st.Btim.Unix()), true, nil
+}
+
+// setBirthTime sets the birth time of path the only way FreeBSD offers: a modification
+// time before the birth time moves the birth time back to it, then the modification time
+// is restored
+func setBirthTime(path string, t time.Time) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return err
+	}
+	birth := unix.NsecToTimespec(t.UnixNano())
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{st.Atim, birth}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{st.Atim, st.Mtim}, unix.AT_SYMLINK_NOFOLLOW)
+}
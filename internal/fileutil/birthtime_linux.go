@@ -0,0 +1,30 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the birth time of path from statx, false if the filesystem does not
+// record it
+func birthTime(path string) (time.Time, bool, error) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil {
+		if errors.Is(err, unix.ENOSYS) {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true, nil
+}
+
+// setBirthTime fails: Linux has no call to set the birth time of a file
+func setBirthTime(path string, t time.Time) error {
+	return fmt.Errorf("Linux cannot set it: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package fileutil
+
+import (
+	"errors"
+	"time"
+)
+
+// birthTime reports no birth time: it is not read on this platform
+func birthTime(path string) (time.Time, bool, error) {
+	return time.Time{}, false, nil
+}
+
+// setBirthTime is not implemented on this platform
+func setBirthTime(path string, t time.Time) error {
+	return errors.ErrUnsupported
+}
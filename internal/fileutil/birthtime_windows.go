@@ -0,0 +1,39 @@
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// birthTime returns the creation time of path
+func birthTime(path string) (time.Time, bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, data.CreationTime.Nanoseconds()), true, nil
+}
+
+// setBirthTime sets the creation time of path with SetFileTime
+func setBirthTime(path string, t time.Time) error {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateFile(name, windows.FILE_WRITE_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_OPEN_REPARSE_POINT|windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "CreateFile", Path: path, Err: err}
+	}
+	defer windows.CloseHandle(h)
+	created := windows.NsecToFiletime(t.UnixNano())
+	return windows.SetFileTime(h, &created, nil, nil)
+}
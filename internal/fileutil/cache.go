@@ -0,0 +1,129 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// CacheBypass is how a copy keeps its data out of the caches of the operating system, so
+// rewriting a large tree does not evict the data other applications keep cached
+type CacheBypass string
+
+const (
+	// CacheBypassNone copies through the caches as usual
+	CacheBypassNone CacheBypass = ""
+	// CacheBypassFadvise drops the pages of both files from the page cache as the copy goes
+	// with posix_fadvise(POSIX_FADV_DONTNEED), writing the dirty pages of the copy out first.
+	// ZFS keeps its data in the ARC rather than the page cache, which this does not reach.
+	CacheBypassFadvise CacheBypass = "fadvise"
+	// CacheBypassDirect opens both files with O_DIRECT (F_NOCACHE on macOS). A file whose
+	// filesystem refuses a direct read or write falls back to cached I/O from then on. On
+	// ZFS the data skips the ARC from OpenZFS 2.3, unless the dataset has direct=disabled.
+	CacheBypassDirect CacheBypass = "direct"
+)
+
+// ErrCacheBypassUnsupported is returned by ParseCacheBypass for a mode the platform lacks
+var ErrCacheBypassUnsupported = errors.New("not supported on this platform")
+
+// ParseCacheBypass parses a cache bypass mode, fadvise or direct, empty for none
+func ParseCacheBypass(s string) (CacheBypass, error) {
+	mode := CacheBypass(strings.ToLower(strings.TrimSpace(s)))
+	switch mode {
+	case CacheBypassNone, CacheBypassFadvise, CacheBypassDirect:
+	default:
+		return "", fmt.Errorf("unknown cache bypass %q, expected fadvise or direct", s)
+	}
+	if mode != CacheBypassNone && !cacheBypassSupported(mode) {
+		return "", fmt.Errorf("cache bypass %s: %w", mode, ErrCacheBypassUnsupported)
+	}
+	return mode, nil
+}
+
+// dropInterval is how much a copy with CacheBypassFadvise writes between dropping the
+// cached pages of its files
+const dropInterval = 64 << 20
+
+// directAlignment is the alignment of the copy buffer for direct I/O, the page size
+const directAlignment = 4096
+
+// cacheBypass applies CopyOptions.CacheBypass to the files of a copy
+type cacheBypass struct {
+	mode     CacheBypass
+	src, dst *os.File
+	// pending counts the bytes written since the cached pages were last dropped
+	pending int64
+}
+
+// openForCopy opens path like os.OpenFile, for direct I/O with CacheBypassDirect where
+// the filesystem allows it
+func openForCopy(path string, flag int, perm os.FileMode, mode CacheBypass) (*os.File, error) {
+	if mode == CacheBypassDirect {
+		return openDirect(path, flag, perm)
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+// drop drops the cached pages of the files of the copy
+func (c *cacheBypass) drop() {
+	if c.mode == CacheBypassFadvise {
+		dropCached(c.src, false)
+		dropCached(c.dst, true)
+	}
+	c.pending = 0
+}
+
+// directRefused reports whether err is a filesystem refusing a direct read or write,
+// usually for a buffer, offset or length it cannot transfer without the cache
+func directRefused(err error) bool {
+	return errors.Is(err, syscall.EINVAL)
+}
+
+// bypassReader reads the source of a copy, retrying a read the filesystem refused to do
+// direct with cached I/O
+type bypassReader struct {
+	r io.Reader
+	c *cacheBypass
+}
+
+func (b bypassReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n == 0 && err != nil && b.c.mode == CacheBypassDirect && directRefused(err) && disableDirect(b.c.src) == nil {
+		return b.r.Read(p)
+	}
+	return n, err
+}
+
+// bypassWriter writes the destination of a copy, retrying a write the filesystem refused to
+// do direct with cached I/O and dropping the cached pages every dropInterval
+type bypassWriter struct {
+	w io.Writer
+	c *cacheBypass
+}
+
+func (b bypassWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	if err != nil && b.c.mode == CacheBypassDirect && directRefused(err) && disableDirect(b.c.dst) == nil {
+		var m int
+		m, err = b.w.Write(p[n:])
+		n += m
+	}
+	if b.c.pending += int64(n); b.c.pending >= dropInterval {
+		b.c.drop()
+	}
+	return n, err
+}
+
+// alignedBuffer returns a buffer of size bytes starting at a multiple of directAlignment
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directAlignment); rem != 0 {
+		offset = directAlignment - rem
+	}
+	return buf[offset : offset+size]
+}
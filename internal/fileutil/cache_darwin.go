@@ -0,0 +1,30 @@
+package fileutil
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cacheBypassSupported reports the modes macOS supports: it has F_NOCACHE but no posix_fadvise
+func cacheBypassSupported(mode CacheBypass) bool {
+	return mode == CacheBypassDirect
+}
+
+// openDirect opens path and turns its caching off with F_NOCACHE, which has no alignment
+// requirements; a file where it cannot be set is used with the cache
+func openDirect(path string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, perm)
+	if err == nil {
+		unix.FcntlInt(f.Fd(), unix.F_NOCACHE, 1)
+	}
+	return f, err
+}
+
+// disableDirect turns the caching of f back on
+func disableDirect(f *os.File) error {
+	_, err := unix.FcntlInt(f.Fd(), unix.F_NOCACHE, 0)
+	return err
+}
+
+func dropCached(f *os.File, written bool) {}
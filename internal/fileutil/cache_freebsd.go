@@ -0,0 +1,37 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func cacheBypassSupported(mode CacheBypass) bool {
+	return true
+}
+
+// openDirect opens path with O_DIRECT, or without it on filesystems that refuse it
+func openDirect(path string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flag|unix.O_DIRECT, perm)
+	if err != nil && errors.Is(err, unix.EINVAL) {
+		return os.OpenFile(path, flag, perm)
+	}
+	return f, err
+}
+
+// disableDirect clears O_DIRECT on f
+func disableDirect(f *os.File) error {
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.FcntlInt(f.Fd(), unix.F_SETFL, flags&^unix.O_DIRECT)
+	return err
+}
+
+// dropCached drops the cached pages of f. FreeBSD writes dirty pages out itself before
+// dropping them. Failures are ignored: the pages stay cached.
+func dropCached(f *os.File, written bool) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
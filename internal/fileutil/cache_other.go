@@ -0,0 +1,20 @@
+//go:build !linux && !freebsd && !darwin
+// +build !linux,!freebsd,!darwin
+
+package fileutil
+
+import "os"
+
+func cacheBypassSupported(mode CacheBypass) bool {
+	return false
+}
+
+func openDirect(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+func disableDirect(f *os.File) error {
+	return ErrCacheBypassUnsupported
+}
+
+func dropCached(f *os.File, written bool) {}
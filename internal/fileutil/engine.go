@@ -0,0 +1,226 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/uring"
+)
+
+// IOEngine is how a copy moves its data
+type IOEngine string
+
+const (
+	// IOEngineSync copies with a loop of read and write system calls, one chunk at a time
+	IOEngineSync IOEngine = "sync"
+	// IOEngineURing keeps several chunks in flight through an io_uring, reading the next
+	// chunks while the previous ones are written, with one system call per batch. It needs
+	// Linux 5.6; copies fall back to IOEngineSync where io_uring is unavailable.
+	IOEngineURing IOEngine = "uring"
+)
+
+// uringDepth is the number of chunks an io_uring copy reads, and writes, per batch
+const uringDepth = 4
+
+// uringMinSize is the smallest file copied through an io_uring; setting up a ring costs
+// more than it saves below
+const uringMinSize = 2 * copyBufferSize
+
+// ParseIOEngine parses an I/O engine name, empty for IOEngineSync
+func ParseIOEngine(s string) (IOEngine, error) {
+	switch e := IOEngine(strings.ToLower(strings.TrimSpace(s))); e {
+	case "", IOEngineSync:
+		return IOEngineSync, nil
+	case IOEngineURing, "io_uring":
+		return IOEngineURing, nil
+	default:
+		return "", fmt.Errorf("unknown I/O engine %q, expected sync or uring", s)
+	}
+}
+
+// IOEngineAvailable returns nil if copies can use e here, or why they fall back to IOEngineSync
+func IOEngineAvailable(e IOEngine) error {
+	if e == IOEngineURing {
+		return uring.Supported()
+	}
+	return nil
+}
+
+// copyRing copies through an io_uring with two sets of buffers: while the chunks of one
+// set are written, the next chunks are read into the other
+type copyRing struct {
+	ring *uring.Ring
+	bufs [2][][]byte
+}
+
+// newCopyRing returns a ring for a copy of size bytes with opts, nil to copy without one
+func newCopyRing(size int64, opts *CopyOptions) *copyRing {
+	if opts.Engine != IOEngineURing || size < uringMinSize {
+		return nil
+	}
+	ring, err := uring.New(2 * uringDepth)
+	if err != nil {
+		return nil
+	}
+	c := &copyRing{ring: ring}
+	for set := range c.bufs {
+		for i := 0; i < uringDepth; i++ {
+			c.bufs[set] = append(c.bufs[set], alignedBuffer(copyBufferSize))
+		}
+	}
+	return c
+}
+
+func (c *copyRing) close() {
+	c.ring.Close()
+}
+
+// copyRegion copies length bytes, or up to the end of s if length is negative, from offset
+// of s to the same offset of d. Both files are positioned at offset.
+func copyRegion(d, s *os.File, offset, length int64, opts *CopyOptions) error {
+	if opts.parallel {
+		if length < 0 {
+			length = opts.size - offset
+		}
+		return copyParallel(d, s, offset, length, opts)
+	}
+	if c := opts.ring; c != nil {
+		return c.copy(d, s, offset, length, opts)
+	}
+	if length < 0 {
+		return copyData(d, s, opts)
+	}
+	return copyData(d, io.LimitReader(s, length), opts)
+}
+
+// copy is copyRegion through the ring. It applies the same options as copyData: the
+// chunks are hashed, counted and paced in order as their reads complete.
+func (c *copyRing) copy(d, s *os.File, offset, length int64, opts *CopyOptions) error {
+	end := int64(math.MaxInt64)
+	if length >= 0 {
+		end = offset + length
+	}
+	sfd, dfd := int(s.Fd()), int(d.Fd())
+	next := offset
+	eof := false
+	var writes []*uring.Op
+	for set := 0; ; set ^= 1 {
+		if opts.Cancel != nil {
+			select {
+			case <-opts.Cancel:
+				return ErrCopyCanceled
+			default:
+			}
+		}
+
+		// Read the next chunks into this set while the previous set is written
+		var reads []*uring.Op
+		for i := 0; i < uringDepth && !eof && next < end; i++ {
+			n := min(int64(copyBufferSize), end-next)
+			reads = append(reads, &uring.Op{FD: sfd, Buf: c.bufs[set][i][:n], Off: next})
+			next += n
+		}
+		if len(reads) == 0 && len(writes) == 0 {
+			return nil
+		}
+		if err := c.ring.Run(append(append([]*uring.Op{}, writes...), reads...)); err != nil {
+			return err
+		}
+
+		for _, w := range writes {
+			if err := finishWrite(d, w, opts); err != nil {
+				return err
+			}
+		}
+		writes = writes[:0]
+		for _, r := range reads {
+			n, err := finishRead(s, r, opts)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				writes = append(writes, &uring.Op{Write: true, FD: dfd, Buf: r.Buf[:n], Off: r.Off})
+			}
+			if n < len(r.Buf) {
+				// The end of the file, earlier than expected if it shrank
+				eof = true
+				break
+			}
+		}
+	}
+}
+
+// finishRead completes a read of the ring: a short read is continued, and a read the
+// filesystem refused to do direct is done again with the cache. It returns the bytes read,
+// fewer than the buffer only at the end of the file, once they were paced, counted and hashed.
+func finishRead(s *os.File, r *uring.Op, opts *CopyOptions) (int, error) {
+	n := 0
+	if err := r.Err(); err != nil {
+		if !bypassingDirect(opts) || !directRefused(err) || disableDirect(s) != nil {
+			return 0, &os.PathError{Op: "read", Path: s.Name(), Err: err}
+		}
+	} else {
+		n = int(r.Res)
+	}
+	if n < len(r.Buf) && (n > 0 || r.Err() != nil) {
+		m, err := s.ReadAt(r.Buf[n:], r.Off+int64(n))
+		n += m
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+	}
+
+	if n > 0 {
+		if opts.Limiter != nil {
+			if err := opts.Limiter.Wait(n); err != nil {
+				return n, err
+			}
+		}
+		if opts.BytesRead != nil {
+			opts.BytesRead.Add(int64(n))
+		}
+		if opts.SourceHash != nil {
+			opts.SourceHash.Write(r.Buf[:n])
+		}
+	}
+	return n, nil
+}
+
+// finishWrite completes a write of the ring like finishRead, then counts and hashes it
+func finishWrite(d *os.File, w *uring.Op, opts *CopyOptions) error {
+	n := 0
+	if err := w.Err(); err != nil {
+		if !bypassingDirect(opts) || !directRefused(err) || disableDirect(d) != nil {
+			return &os.PathError{Op: "write", Path: d.Name(), Err: err}
+		}
+	} else {
+		n = int(w.Res)
+	}
+	if n < len(w.Buf) {
+		if _, err := d.WriteAt(w.Buf[n:], w.Off+int64(n)); err != nil {
+			return err
+		}
+	}
+
+	if opts.BytesWritten != nil {
+		opts.BytesWritten.Add(int64(len(w.Buf)))
+	}
+	if opts.DestHash != nil {
+		opts.DestHash.Write(w.Buf)
+	}
+	if c := opts.bypass; c != nil {
+		if c.pending += int64(len(w.Buf)); c.pending >= dropInterval {
+			c.drop()
+		}
+	}
+	return nil
+}
+
+// bypassingDirect reports whether the copy of opts uses direct I/O
+func bypassingDirect(opts *CopyOptions) bool {
+	return opts.bypass != nil && opts.bypass.mode == CacheBypassDirect
+}
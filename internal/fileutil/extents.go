@@ -0,0 +1,13 @@
+package fileutil
+
+import "errors"
+
+// ErrExtentsUnsupported is returned by ExtentCount where the platform or the filesystem
+// cannot map the extents of a file. OpenZFS does not implement FIEMAP, for one.
+var ErrExtentsUnsupported = errors.New("extent mapping not supported")
+
+// ExtentCount returns how many extents the data of the file at path occupies on disk,
+// a measure of its fragmentation: a contiguous file has one, an empty file none
+func ExtentCount(path string) (int, error) {
+	return extentCount(path)
+}
@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package fileutil
+
+import (
+	"errors"
+	"math"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsIocFiemap is FS_IOC_FIEMAP, _IOWR('f', 11, struct fiemap), on the architectures
+// sharing the generic ioctl encoding; elsewhere the call fails with ENOTTY and the
+// extents count as unsupported
+const fsIocFiemap = 0xC020660B
+
+// fiemap is the header of struct fiemap. Without room for extent records the kernel
+// only counts the extents of the range.
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+}
+
+// extentCount counts the extents of the file with FIEMAP
+func extentCount(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fm := fiemap{length: math.MaxUint64}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&fm)))
+	switch {
+	case errno == 0:
+		return int(fm.mappedExtents), nil
+	case errors.Is(errno, unix.EOPNOTSUPP), errors.Is(errno, unix.ENOTTY):
+		return 0, ErrExtentsUnsupported
+	default:
+		return 0, &os.PathError{Op: "fiemap", Path: path, Err: errno}
+	}
+}
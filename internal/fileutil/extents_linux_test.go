@@ -0,0 +1,35 @@
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtentCount(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	data := filepath.Join(dir, "data")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.WriteFile(data, bytes.Repeat([]byte("x"), 64*1024), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	n, err := ExtentCount(empty)
+	if errors.Is(err, ErrExtentsUnsupported) {
+		t.Skipf("No FIEMAP on the filesystem of %s", dir)
+	}
+	if err != nil || n != 0 {
+		t.Errorf("Expected no extents for an empty file, got %d, %v", n, err)
+	}
+	if n, err := ExtentCount(data); err != nil || n < 1 {
+		t.Errorf("Expected at least one extent, got %d, %v", n, err)
+	}
+	if _, err := ExtentCount(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
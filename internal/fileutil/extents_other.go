@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package fileutil
+
+// extentCount is not implemented on platforms without FIEMAP
+func extentCount(path string) (int, error) {
+	return 0, ErrExtentsUnsupported
+}
@@ -3,10 +3,17 @@ package fileutil
 import (
 	"crypto/md5"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
 )
 
 // GetLinkCount returns the number of hardlinks to a file.
@@ -16,14 +23,20 @@ func GetLinkCount(path string) (uint64, error) {
 		return 0, err
 	}
 
-	nlink, err := getLinkCountForPlatform(info)
+	nlink, err := getLinkCountForPlatform(path, info)
 	if err != nil {
-		return 0, fmt.Errorf("unsupported system for file %s: %w", path, err)
+		return 0, fmt.Errorf("cannot count the links of %s: %w", path, err)
 	}
 
 	return nlink, nil
 }
 
+// GetLinkCountFromFileInfo returns the number of hardlinks of the file at path, whose
+// os.Lstat info is given. Unix systems read it from info; on Windows the file is opened.
+func GetLinkCountFromFileInfo(path string, info os.FileInfo) (uint64, error) {
+	return getLinkCountForPlatform(path, info)
+}
+
 // CheckAttributes checks basic attributes: size, mode, uid, gid, and modification time.
 func CheckAttributes(orig, copy string) (bool, string) {
 	origInfo, err := os.Stat(orig)
@@ -77,8 +90,23 @@ const (
 	ChecksumSHA256 ChecksumType = "sha256"
 	// ChecksumMD5 uses MD5 for file verification
 	ChecksumMD5 ChecksumType = "md5"
+	// ChecksumBLAKE3 uses BLAKE3 for file verification
+	ChecksumBLAKE3 ChecksumType = "blake3"
+	// ChecksumXXH3 uses the non-cryptographic 64-bit XXH3 hash for file verification.
+	// It detects copy corruption but offers no protection against deliberate tampering.
+	ChecksumXXH3 ChecksumType = "xxh3"
 )
 
+// ParseChecksumType returns the checksum type named by s, ignoring case
+func ParseChecksumType(s string) (ChecksumType, error) {
+	switch t := ChecksumType(strings.ToLower(s)); t {
+	case ChecksumMD5, ChecksumSHA256, ChecksumBLAKE3, ChecksumXXH3:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid checksum type %q: must be sha256, md5, blake3 or xxh3", s)
+	}
+}
+
 // CompareFileChecksum compares two files by their checksums using the specified algorithm.
 // SHA256 is used by default.
 func CompareFileChecksum(orig, copy string, checksumType ChecksumType) (bool, string) {
@@ -87,12 +115,66 @@ func CompareFileChecksum(orig, copy string, checksumType ChecksumType) (bool, st
 		return CompareFileMD5(orig, copy)
 	case ChecksumSHA256:
 		return CompareFileSHA256(orig, copy)
+	case ChecksumBLAKE3:
+		return CompareFileBLAKE3(orig, copy)
+	case ChecksumXXH3:
+		return CompareFileXXH3(orig, copy)
 	default:
 		// Default to SHA256
 		return CompareFileSHA256(orig, copy)
 	}
 }
 
+// CompareFileChecksumDigest compares two files like CompareFileChecksum and also
+// returns the hexadecimal digest they share when they match.
+func CompareFileChecksumDigest(orig, copy string, checksumType ChecksumType) (string, bool, string) {
+	origHash, err := FileHash(orig, checksumType)
+	if err != nil {
+		return "", false, fmt.Sprintf("error hashing original: %v", err)
+	}
+
+	copyHash, err := FileHash(copy, checksumType)
+	if err != nil {
+		return "", false, fmt.Sprintf("error hashing copy: %v", err)
+	}
+
+	if origHash != copyHash {
+		return "", false, fmt.Sprintf("%s mismatch: %s != %s", strings.ToUpper(string(normalizeChecksumType(checksumType))), origHash, copyHash)
+	}
+
+	return origHash, true, ""
+}
+
+// NewHash returns a new hash for the specified checksum type.
+// SHA256 is used for an empty or unknown type.
+func NewHash(checksumType ChecksumType) hash.Hash {
+	switch normalizeChecksumType(checksumType) {
+	case ChecksumMD5:
+		return md5.New()
+	case ChecksumBLAKE3:
+		return blake3.New()
+	case ChecksumXXH3:
+		return xxh3.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// FileHash returns the hexadecimal checksum of a file using the specified algorithm.
+func FileHash(path string, checksumType ChecksumType) (string, error) {
+	return fileHash(path, NewHash(checksumType))
+}
+
+// normalizeChecksumType maps an empty or unknown type to the SHA256 default
+func normalizeChecksumType(checksumType ChecksumType) ChecksumType {
+	switch checksumType {
+	case ChecksumMD5, ChecksumSHA256, ChecksumBLAKE3, ChecksumXXH3:
+		return checksumType
+	default:
+		return ChecksumSHA256
+	}
+}
+
 // CompareFileMD5 compares two files by their MD5 checksums.
 func CompareFileMD5(orig, copy string) (bool, string) {
 	origHash, err := FileHashMD5(orig)
@@ -131,32 +213,72 @@ func CompareFileSHA256(orig, copy string) (bool, string) {
 	return true, ""
 }
 
-// FileHashMD5 returns the hexadecimal MD5 of a file.
-func FileHashMD5(path string) (string, error) {
-	f, err := os.Open(path)
+// CompareFileBLAKE3 compares two files by their BLAKE3 checksums.
+func CompareFileBLAKE3(orig, copy string) (bool, string) {
+	origHash, err := FileHashBLAKE3(orig)
 	if err != nil {
-		return "", err
+		return false, fmt.Sprintf("error hashing original: %v", err)
 	}
-	defer f.Close()
 
-	h := md5.New()
-	_, err = io.Copy(h, f)
+	copyHash, err := FileHashBLAKE3(copy)
 	if err != nil {
-		return "", err
+		return false, fmt.Sprintf("error hashing copy: %v", err)
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	if origHash != copyHash {
+		return false, fmt.Sprintf("BLAKE3 mismatch: %s != %s", origHash, copyHash)
+	}
+
+	return true, ""
+}
+
+// CompareFileXXH3 compares two files by their XXH3 checksums.
+func CompareFileXXH3(orig, copy string) (bool, string) {
+	origHash, err := FileHashXXH3(orig)
+	if err != nil {
+		return false, fmt.Sprintf("error hashing original: %v", err)
+	}
+
+	copyHash, err := FileHashXXH3(copy)
+	if err != nil {
+		return false, fmt.Sprintf("error hashing copy: %v", err)
+	}
+
+	if origHash != copyHash {
+		return false, fmt.Sprintf("XXH3 mismatch: %s != %s", origHash, copyHash)
+	}
+
+	return true, ""
+}
+
+// FileHashMD5 returns the hexadecimal MD5 of a file.
+func FileHashMD5(path string) (string, error) {
+	return fileHash(path, md5.New())
 }
 
 // FileHashSHA256 returns the hexadecimal SHA256 of a file.
 func FileHashSHA256(path string) (string, error) {
+	return fileHash(path, sha256.New())
+}
+
+// FileHashBLAKE3 returns the hexadecimal 256-bit BLAKE3 of a file.
+func FileHashBLAKE3(path string) (string, error) {
+	return fileHash(path, blake3.New())
+}
+
+// FileHashXXH3 returns the hexadecimal 64-bit XXH3 of a file.
+func FileHashXXH3(path string) (string, error) {
+	return fileHash(path, xxh3.New())
+}
+
+// fileHash streams the contents of path through h and returns the hexadecimal digest.
+func fileHash(path string, h hash.Hash) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	h := sha256.New()
 	_, err = io.Copy(h, f)
 	if err != nil {
 		return "", err
@@ -165,9 +287,71 @@ func FileHashSHA256(path string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// CopyOptions controls how CopyFileWithOptions writes the destination file.
+type CopyOptions struct {
+	// Sparse replicates holes in the source as holes in the destination
+	// instead of materializing them as zero-filled blocks.
+	Sparse bool
+	// Cancel aborts the copy with ErrCopyCanceled when closed. The partial
+	// destination file is left for the caller to remove.
+	Cancel <-chan struct{}
+	// SourceHash, if set, receives every byte read from the source while copying
+	SourceHash io.Writer
+	// DestHash, if set, receives every byte written to the destination while copying.
+	// Holes skipped by a sparse copy are fed to both hashes as zeros. It sees the buffers
+	// written, which are those read from the source: read the destination back to verify
+	// what it stores.
+	DestHash io.Writer
+	// Limiter, if set, paces the copy to a bandwidth budget
+	Limiter Limiter
+	// PreserveOwner gives the destination the owner and group of the source once the data
+	// is written. OwnerFirst does it right after creating the destination instead, so
+	// quotas charge the copy to the file's owner from its first block.
+	PreserveOwner bool
+	OwnerFirst    bool
+	// BytesRead and BytesWritten, if set, are increased by the bytes read from the source
+	// and written to the destination as the copy goes, e.g. for throughput statistics
+	BytesRead    *atomic.Int64
+	BytesWritten *atomic.Int64
+	// CacheBypass keeps the data of the copy out of the caches of the operating system
+	CacheBypass CacheBypass
+	// Sync flushes the destination to disk once it is written, before it is closed
+	Sync bool
+	// Engine moves the data, IOEngineSync when empty
+	Engine IOEngine
+	// Streams, above 1, copies files of at least ParallelMinSize with this many streams
+	// reading and writing chunks at their offsets, instead of Engine
+	Streams         int
+	ParallelMinSize int64
+
+	// bypass holds the files of a copy with CacheBypass, ring the io_uring of a copy with
+	// IOEngineURing; parallel is set for a copy with Streams, of size bytes
+	bypass   *cacheBypass
+	ring     *copyRing
+	parallel bool
+	size     int64
+}
+
+// Limiter paces I/O; Wait blocks until n more bytes may be transferred
+type Limiter interface {
+	Wait(n int) error
+}
+
+// ErrCopyCanceled is returned by CopyFileWithOptions when CopyOptions.Cancel is closed.
+var ErrCopyCanceled = errors.New("copy canceled")
+
+// copyBufferSize is the buffer size used for the read/write copy loop.
+const copyBufferSize = 1024 * 1024
+
 // CopyFile copies src to dst, preserving the mode and mod time. Does not handle reflinks.
 func CopyFile(src, dst string) error {
-	s, err := os.Open(src)
+	return CopyFileWithOptions(src, dst, CopyOptions{})
+}
+
+// CopyFileWithOptions copies src to dst according to opts, preserving the mode and mod time.
+// Data is always physically rewritten; reflinks and block cloning are never used.
+func CopyFileWithOptions(src, dst string, opts CopyOptions) error {
+	s, err := openForCopy(src, os.O_RDONLY, 0, opts.CacheBypass)
 	if err != nil {
 		return err
 	}
@@ -178,16 +362,207 @@ func CopyFile(src, dst string) error {
 		return err
 	}
 
-	d, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, statSrc.Mode())
+	d, err := openForCopy(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, statSrc.Mode(), opts.CacheBypass)
 	if err != nil {
 		return err
 	}
 	defer d.Close()
 
-	if _, err = io.Copy(d, s); err != nil {
+	if opts.CacheBypass != CacheBypassNone {
+		opts.bypass = &cacheBypass{mode: opts.CacheBypass, src: s, dst: d}
+		// Drop whatever the last chunk left cached, even if the copy failed
+		defer opts.bypass.drop()
+	}
+	if opts.Streams > 1 && statSrc.Size() >= max(opts.ParallelMinSize, parallelChunkSize+1) {
+		opts.parallel, opts.size = true, statSrc.Size()
+	} else if ring := newCopyRing(statSrc.Size(), &opts); ring != nil {
+		opts.ring = ring
+		defer ring.close()
+	}
+
+	if opts.PreserveOwner && opts.OwnerFirst {
+		if err := applyOwner(d, statSrc); err != nil {
+			return err
+		}
+	}
+
+	if opts.Sparse {
+		err = copySparse(d, s, statSrc.Size(), &opts)
+	} else {
+		err = copyRegion(d, s, 0, -1, &opts)
+	}
+	if err != nil {
 		return err
 	}
 
+	if opts.PreserveOwner && !opts.OwnerFirst {
+		if err := applyOwner(d, statSrc); err != nil {
+			return err
+		}
+	}
+	if opts.Sync {
+		if err := d.Sync(); err != nil {
+			return err
+		}
+	}
+
 	// Preserve mod time
 	return os.Chtimes(dst, statSrc.ModTime(), statSrc.ModTime())
 }
+
+// IsCrossDevice reports whether err is the failure of a rename between filesystems, which
+// only copying the file can do instead
+func IsCrossDevice(err error) bool {
+	return isCrossDeviceForPlatform(err)
+}
+
+// SyncDir flushes the entries of the directory at path to disk, so files created or
+// renamed in it survive a power loss. It does nothing on Windows.
+func SyncDir(path string) error {
+	return syncDirForPlatform(path)
+}
+
+// GetOwner returns the user and group IDs recorded in file info. Windows has no such IDs
+// and returns an error.
+func GetOwner(info os.FileInfo) (uid, gid uint32, err error) {
+	return getFileOwnership(info)
+}
+
+// applyOwner gives d the owner and group of src unless it already has them. The mode is
+// set again afterwards, as chown clears the setuid and setgid bits.
+func applyOwner(d *os.File, src os.FileInfo) error {
+	uid, gid, err := getFileOwnership(src)
+	if err != nil {
+		return nil // no owners on this platform
+	}
+	info, err := d.Stat()
+	if err != nil {
+		return err
+	}
+	if dUID, dGID, err := getFileOwnership(info); err == nil && dUID == uid && dGID == gid {
+		return nil
+	}
+	if err := d.Chown(int(uid), int(gid)); err != nil {
+		return fmt.Errorf("cannot give the copy the owner of the original: %w", err)
+	}
+	return d.Chmod(src.Mode())
+}
+
+// copyData copies the remainder of s into d with a plain read/write loop.
+// The files are wrapped so io.Copy cannot use copy_file_range, which ZFS may
+// satisfy with block cloning and so leave the data on its original vdevs; for
+// the same reason clonefile and copyfile are never used on macOS.
+// The cancel channel and hashes of opts are applied to the stream.
+func copyData(d io.Writer, s io.Reader, opts *CopyOptions) error {
+	var buf []byte
+	if c := opts.bypass; c != nil {
+		buf = alignedBuffer(copyBufferSize)
+		s = bypassReader{r: s, c: c}
+		d = bypassWriter{w: d, c: c}
+	} else {
+		buf = make([]byte, copyBufferSize)
+	}
+	if opts.BytesRead != nil {
+		s = countReader{r: s, n: opts.BytesRead}
+	}
+	if opts.BytesWritten != nil {
+		d = countWriter{w: d, n: opts.BytesWritten}
+	}
+	if opts.Limiter != nil {
+		s = limitReader{r: s, limiter: opts.Limiter}
+	}
+	if opts.Cancel != nil {
+		s = cancelReader{r: s, cancel: opts.Cancel}
+	}
+	if opts.SourceHash != nil {
+		s = io.TeeReader(s, opts.SourceHash)
+	}
+	if opts.DestHash != nil {
+		d = io.MultiWriter(d, opts.DestHash)
+	}
+	_, err := io.CopyBuffer(struct{ io.Writer }{d}, struct{ io.Reader }{s}, buf)
+	return err
+}
+
+// hashHole feeds n zero bytes, the content of a hole skipped by a sparse copy, to the hashes of opts
+func hashHole(opts *CopyOptions, n int64) {
+	if n <= 0 || (opts.SourceHash == nil && opts.DestHash == nil) {
+		return
+	}
+	zeros := make([]byte, min(n, copyBufferSize))
+	for n > 0 {
+		chunk := zeros[:min(n, int64(len(zeros)))]
+		if opts.SourceHash != nil {
+			opts.SourceHash.Write(chunk)
+		}
+		if opts.DestHash != nil {
+			opts.DestHash.Write(chunk)
+		}
+		n -= int64(len(chunk))
+	}
+}
+
+// cancelReader fails reads with ErrCopyCanceled once cancel is closed
+type cancelReader struct {
+	r      io.Reader
+	cancel <-chan struct{}
+}
+
+func (c cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.cancel:
+		return 0, ErrCopyCanceled
+	default:
+		return c.r.Read(p)
+	}
+}
+
+// countReader adds the bytes read to n
+type countReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countWriter adds the bytes written to n
+type countWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// limitReader waits for the limiter after every read
+type limitReader struct {
+	r       io.Reader
+	limiter Limiter
+}
+
+func (l limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if waitErr := l.limiter.Wait(n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// GetAllocatedSize returns the number of bytes actually allocated on disk for a file.
+// On platforms that do not expose block counts the logical size is returned.
+func GetAllocatedSize(path string) (int64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	return getAllocatedSizeForPlatform(info), nil
+}
@@ -1,9 +1,15 @@
 package fileutil
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"unsafe"
 )
 
 func TestFileOperations(t *testing.T) {
@@ -186,6 +192,78 @@ func TestFileOperations(t *testing.T) {
 			t.Errorf("FileHashSHA256 should fail for non-existent file but it didn't")
 		}
 	})
+
+	// Test CompareFileBLAKE3 and FileHashBLAKE3
+	t.Run("CompareFileBLAKE3", func(t *testing.T) {
+		err = CopyFile(srcPath, dstPath)
+		if err != nil {
+			t.Fatalf("Failed to reset destination file: %v", err)
+		}
+
+		ok, reason := CompareFileChecksum(srcPath, dstPath, ChecksumBLAKE3)
+		if !ok {
+			t.Errorf("CompareFileChecksum with BLAKE3 failed: %s", reason)
+		}
+
+		// Known-answer check: BLAKE3 of the empty input
+		emptyPath := filepath.Join(tempDir, "empty.txt")
+		if err := os.WriteFile(emptyPath, nil, 0644); err != nil {
+			t.Fatalf("Failed to create empty file: %v", err)
+		}
+		sum, err := FileHashBLAKE3(emptyPath)
+		if err != nil {
+			t.Fatalf("FileHashBLAKE3 failed: %v", err)
+		}
+		if sum != "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262" {
+			t.Errorf("Unexpected BLAKE3 of empty file: %s", sum)
+		}
+
+		err = os.WriteFile(dstPath, []byte("modified content"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to modify destination file: %v", err)
+		}
+
+		ok, _ = CompareFileBLAKE3(srcPath, dstPath)
+		if ok {
+			t.Errorf("CompareFileBLAKE3 should have failed due to content mismatch, but it passed")
+		}
+	})
+
+	// Test CompareFileXXH3 and FileHashXXH3
+	t.Run("CompareFileXXH3", func(t *testing.T) {
+		err = CopyFile(srcPath, dstPath)
+		if err != nil {
+			t.Fatalf("Failed to reset destination file: %v", err)
+		}
+
+		ok, reason := CompareFileChecksum(srcPath, dstPath, ChecksumXXH3)
+		if !ok {
+			t.Errorf("CompareFileChecksum with XXH3 failed: %s", reason)
+		}
+
+		// Known-answer check: XXH3-64 of the empty input
+		emptyPath := filepath.Join(tempDir, "empty.txt")
+		if err := os.WriteFile(emptyPath, nil, 0644); err != nil {
+			t.Fatalf("Failed to create empty file: %v", err)
+		}
+		sum, err := FileHashXXH3(emptyPath)
+		if err != nil {
+			t.Fatalf("FileHashXXH3 failed: %v", err)
+		}
+		if sum != "2d06800538d394c2" {
+			t.Errorf("Unexpected XXH3 of empty file: %s", sum)
+		}
+
+		err = os.WriteFile(dstPath, []byte("modified content"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to modify destination file: %v", err)
+		}
+
+		_, ok, _ = CompareFileChecksumDigest(srcPath, dstPath, ChecksumXXH3)
+		if ok {
+			t.Errorf("CompareFileChecksumDigest with XXH3 should have failed due to content mismatch, but it passed")
+		}
+	})
 }
 
 func TestGetLinkCount(t *testing.T) {
@@ -217,3 +295,386 @@ func TestGetLinkCount(t *testing.T) {
 		t.Errorf("GetLinkCount should have failed for non-existent file, but it passed")
 	}
 }
+
+func TestCopyFileSparse(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "sparse_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	srcPath := filepath.Join(tempDir, "sparse.img")
+	dstPath := filepath.Join(tempDir, "sparse.img.balance")
+
+	// Build a 16MB file with data only at the start, middle and end
+	const size = 16 * 1024 * 1024
+	f, err := os.Create(srcPath)
+	if err != nil {
+		t.Fatalf("Failed to create sparse file: %v", err)
+	}
+	for _, off := range []int64{0, size / 2, size - 4096} {
+		if _, err := f.WriteAt([]byte("sparse data block"), off); err != nil {
+			t.Fatalf("Failed to write sparse file: %v", err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Failed to size sparse file: %v", err)
+	}
+	f.Close()
+
+	srcHash, dstHash := NewHash(ChecksumSHA256), NewHash(ChecksumSHA256)
+	err = CopyFileWithOptions(srcPath, dstPath, CopyOptions{Sparse: true, SourceHash: srcHash, DestHash: dstHash})
+	if err != nil {
+		t.Fatalf("CopyFileWithOptions failed: %v", err)
+	}
+
+	ok, reason := CompareFileSHA256(srcPath, dstPath)
+	if !ok {
+		t.Errorf("Sparse copy content mismatch: %s", reason)
+	}
+
+	// Streaming hashes must cover the holes as zeros and match a full read of the file
+	fullHash, err := FileHashSHA256(srcPath)
+	if err != nil {
+		t.Fatalf("FileHashSHA256 failed: %v", err)
+	}
+	if got := fmt.Sprintf("%x", srcHash.Sum(nil)); got != fullHash {
+		t.Errorf("Streaming source hash %s does not match file hash %s", got, fullHash)
+	}
+	if got := fmt.Sprintf("%x", dstHash.Sum(nil)); got != fullHash {
+		t.Errorf("Streaming destination hash %s does not match file hash %s", got, fullHash)
+	}
+
+	info, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatalf("Failed to stat sparse copy: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("Expected logical size %d, got %d", size, info.Size())
+	}
+
+	// The copy should never allocate more than the logical size
+	allocated, err := GetAllocatedSize(dstPath)
+	if err != nil {
+		t.Fatalf("GetAllocatedSize failed: %v", err)
+	}
+	if allocated > size {
+		t.Errorf("Sparse copy allocated %d bytes, more than logical size %d", allocated, size)
+	}
+	t.Logf("Sparse copy: logical %d bytes, allocated %d bytes", size, allocated)
+}
+
+func TestCopyFileCanceled(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "copy_cancel_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	srcPath := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(srcPath, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	for _, sparse := range []bool{false, true} {
+		err := CopyFileWithOptions(srcPath, filepath.Join(tempDir, "dst.dat"), CopyOptions{Sparse: sparse, Cancel: cancel})
+		if !errors.Is(err, ErrCopyCanceled) {
+			t.Errorf("Expected ErrCopyCanceled (sparse=%t), got %v", sparse, err)
+		}
+	}
+}
+
+func TestCopyFileCounters(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "copy_counters_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const size = 3*copyBufferSize + 123
+	srcPath := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(srcPath, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	// Counters add up across copies
+	var read, written atomic.Int64
+	for _, sparse := range []bool{false, true} {
+		opts := CopyOptions{Sparse: sparse, BytesRead: &read, BytesWritten: &written}
+		if err := CopyFileWithOptions(srcPath, filepath.Join(tempDir, "dst.dat"), opts); err != nil {
+			t.Fatalf("CopyFileWithOptions failed (sparse=%t): %v", sparse, err)
+		}
+	}
+	if read.Load() != 2*size || written.Load() != 2*size {
+		t.Errorf("Expected %d bytes read and written, got %d and %d", 2*size, read.Load(), written.Load())
+	}
+}
+
+func TestParseChecksumType(t *testing.T) {
+	for s, want := range map[string]ChecksumType{"sha256": ChecksumSHA256, "XXH3": ChecksumXXH3, "Blake3": ChecksumBLAKE3, "md5": ChecksumMD5} {
+		if got, err := ParseChecksumType(s); err != nil || got != want {
+			t.Errorf("ParseChecksumType(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "crc32", "xxh64"} {
+		if _, err := ParseChecksumType(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestCopyFilePreserveOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing the owner of a file requires root")
+	}
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(src, []byte("owned"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	if err := os.Chown(src, 1234, 5678); err != nil {
+		t.Fatalf("Failed to chown source file: %v", err)
+	}
+	if err := os.Chmod(src, 0755|os.ModeSetgid); err != nil {
+		t.Fatalf("Failed to chmod source file: %v", err)
+	}
+
+	for _, first := range []bool{false, true} {
+		dst := filepath.Join(tempDir, fmt.Sprintf("dst-%t.dat", first))
+		if err := CopyFileWithOptions(src, dst, CopyOptions{PreserveOwner: true, OwnerFirst: first}); err != nil {
+			t.Fatalf("Copy failed (first=%t): %v", first, err)
+		}
+		info, err := os.Stat(dst)
+		if err != nil {
+			t.Fatalf("Failed to stat copy: %v", err)
+		}
+		uid, gid, err := GetOwner(info)
+		if err != nil || uid != 1234 || gid != 5678 {
+			t.Errorf("Expected owner 1234:5678 (first=%t), got %d:%d (%v)", first, uid, gid, err)
+		}
+		if info.Mode() != 0755|os.ModeSetgid {
+			t.Errorf("Expected the setgid mode to survive the chown (first=%t), got %v", first, info.Mode())
+		}
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	free, total, err := DiskSpace(t.TempDir())
+	if errors.Is(err, ErrSpaceUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("DiskSpace failed: %v", err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("Unexpected free %d of total %d bytes", free, total)
+	}
+	if _, _, err := DiskSpace(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing path")
+	}
+}
+
+func TestCopyFileCacheBypass(t *testing.T) {
+	for _, s := range []string{"", "fadvise", " Direct "} {
+		if _, err := ParseCacheBypass(s); err != nil && !errors.Is(err, ErrCacheBypassUnsupported) {
+			t.Errorf("ParseCacheBypass(%q) failed: %v", s, err)
+		}
+	}
+	if _, err := ParseCacheBypass("nocache"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+
+	tempDir := t.TempDir()
+	// Not a multiple of the page size, so the last direct write is refused by most filesystems
+	data := make([]byte, 2*copyBufferSize+1234)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	srcPath := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	for _, mode := range []CacheBypass{CacheBypassFadvise, CacheBypassDirect} {
+		if !cacheBypassSupported(mode) {
+			continue
+		}
+		for _, sparse := range []bool{false, true} {
+			dstPath := filepath.Join(tempDir, "dst.dat")
+			if err := CopyFileWithOptions(srcPath, dstPath, CopyOptions{Sparse: sparse, CacheBypass: mode}); err != nil {
+				t.Fatalf("CopyFileWithOptions failed (%s, sparse=%t): %v", mode, sparse, err)
+			}
+			copied, err := os.ReadFile(dstPath)
+			if err != nil {
+				t.Fatalf("Failed to read the copy: %v", err)
+			}
+			if !bytes.Equal(copied, data) {
+				t.Errorf("Copy differs from the source (%s, sparse=%t)", mode, sparse)
+			}
+		}
+	}
+
+	if buf := alignedBuffer(copyBufferSize); len(buf) != copyBufferSize || uintptr(unsafe.Pointer(&buf[0]))%directAlignment != 0 {
+		t.Errorf("Expected an aligned buffer of %d bytes, got %d bytes at %p", copyBufferSize, len(buf), &buf[0])
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	tempDir := t.TempDir()
+	srcPath := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(srcPath, []byte("synced"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	if err := CopyFileWithOptions(srcPath, filepath.Join(tempDir, "dst.dat"), CopyOptions{Sync: true}); err != nil {
+		t.Fatalf("CopyFileWithOptions failed: %v", err)
+	}
+	if err := SyncDir(tempDir); err != nil {
+		t.Errorf("SyncDir failed: %v", err)
+	}
+	if err := SyncDir(filepath.Join(tempDir, "missing")); err == nil && runtime.GOOS != "windows" {
+		t.Error("Expected an error for a missing directory")
+	}
+}
+
+func TestCopyFileURing(t *testing.T) {
+	if err := IOEngineAvailable(IOEngineURing); err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	for s, want := range map[string]IOEngine{"": IOEngineSync, "sync": IOEngineSync, "io_uring": IOEngineURing, "URING": IOEngineURing} {
+		if got, err := ParseIOEngine(s); err != nil || got != want {
+			t.Errorf("ParseIOEngine(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+
+	tempDir := t.TempDir()
+	// Several batches, and a tail that is not a multiple of the page size
+	data := make([]byte, (2*uringDepth+3)*copyBufferSize+1234)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	srcPath := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	fullHash, err := FileHashSHA256(srcPath)
+	if err != nil {
+		t.Fatalf("FileHashSHA256 failed: %v", err)
+	}
+	ring := newCopyRing(int64(len(data)), &CopyOptions{Engine: IOEngineURing})
+	if ring == nil {
+		t.Fatal("Expected the copy to use a ring")
+	}
+	ring.close()
+
+	for _, bypass := range []CacheBypass{CacheBypassNone, CacheBypassDirect} {
+		for _, sparse := range []bool{false, true} {
+			var read, written atomic.Int64
+			srcHash, dstHash := NewHash(ChecksumSHA256), NewHash(ChecksumSHA256)
+			dstPath := filepath.Join(tempDir, "dst.dat")
+			opts := CopyOptions{Engine: IOEngineURing, Sparse: sparse, CacheBypass: bypass,
+				SourceHash: srcHash, DestHash: dstHash, BytesRead: &read, BytesWritten: &written}
+			if err := CopyFileWithOptions(srcPath, dstPath, opts); err != nil {
+				t.Fatalf("CopyFileWithOptions failed (bypass=%q, sparse=%t): %v", bypass, sparse, err)
+			}
+			copied, err := os.ReadFile(dstPath)
+			if err != nil {
+				t.Fatalf("Failed to read the copy: %v", err)
+			}
+			if !bytes.Equal(copied, data) {
+				t.Errorf("Copy differs from the source (bypass=%q, sparse=%t)", bypass, sparse)
+			}
+			if src, dst := fmt.Sprintf("%x", srcHash.Sum(nil)), fmt.Sprintf("%x", dstHash.Sum(nil)); src != fullHash || dst != fullHash {
+				t.Errorf("Streaming hashes %s and %s do not match %s", src, dst, fullHash)
+			}
+			if read.Load() != int64(len(data)) || written.Load() != int64(len(data)) {
+				t.Errorf("Expected %d bytes read and written, got %d and %d", len(data), read.Load(), written.Load())
+			}
+		}
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	err = CopyFileWithOptions(srcPath, filepath.Join(tempDir, "dst.dat"), CopyOptions{Engine: IOEngineURing, Cancel: cancel})
+	if !errors.Is(err, ErrCopyCanceled) {
+		t.Errorf("Expected ErrCopyCanceled, got %v", err)
+	}
+}
+
+func TestCopyFileParallel(t *testing.T) {
+	tempDir := t.TempDir()
+	// More chunks than streams, and a last chunk that is not a multiple of the page size
+	data := make([]byte, 5*parallelChunkSize+1234)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	srcPath := filepath.Join(tempDir, "src.dat")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	fullHash, err := FileHashSHA256(srcPath)
+	if err != nil {
+		t.Fatalf("FileHashSHA256 failed: %v", err)
+	}
+
+	bypasses := []CacheBypass{CacheBypassNone}
+	if cacheBypassSupported(CacheBypassDirect) {
+		bypasses = append(bypasses, CacheBypassDirect)
+	}
+	for _, bypass := range bypasses {
+		for _, sparse := range []bool{false, true} {
+			var read, written atomic.Int64
+			srcHash, dstHash := NewHash(ChecksumSHA256), NewHash(ChecksumSHA256)
+			dstPath := filepath.Join(tempDir, "dst.dat")
+			opts := CopyOptions{Streams: 4, ParallelMinSize: 1, Sparse: sparse, CacheBypass: bypass,
+				SourceHash: srcHash, DestHash: dstHash, BytesRead: &read, BytesWritten: &written}
+			if err := CopyFileWithOptions(srcPath, dstPath, opts); err != nil {
+				t.Fatalf("CopyFileWithOptions failed (bypass=%q, sparse=%t): %v", bypass, sparse, err)
+			}
+			copied, err := os.ReadFile(dstPath)
+			if err != nil {
+				t.Fatalf("Failed to read the copy: %v", err)
+			}
+			if !bytes.Equal(copied, data) {
+				t.Errorf("Copy differs from the source (bypass=%q, sparse=%t)", bypass, sparse)
+			}
+			// The chunks are hashed in order, giving the digest of the whole file
+			if src, dst := fmt.Sprintf("%x", srcHash.Sum(nil)), fmt.Sprintf("%x", dstHash.Sum(nil)); src != fullHash || dst != fullHash {
+				t.Errorf("Streaming hashes %s and %s do not match %s", src, dst, fullHash)
+			}
+			if read.Load() != int64(len(data)) || written.Load() != int64(len(data)) {
+				t.Errorf("Expected %d bytes read and written, got %d and %d", len(data), read.Load(), written.Load())
+			}
+		}
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	err = CopyFileWithOptions(srcPath, filepath.Join(tempDir, "dst.dat"), CopyOptions{Streams: 4, Cancel: cancel})
+	if !errors.Is(err, ErrCopyCanceled) {
+		t.Errorf("Expected ErrCopyCanceled, got %v", err)
+	}
+}
+
+func TestParseProtection(t *testing.T) {
+	for _, n := range protectionNames {
+		p, err := ParseProtection(n.name)
+		if err != nil || p.String() != n.name {
+			t.Errorf("ParseProtection(%q) = %q, %v", n.name, p, err)
+		}
+	}
+	if len(protectionNames) > 1 {
+		both := Protection{flags: protectionNames[0].flag | protectionNames[1].flag}
+		if p, err := ParseProtection(both.String()); err != nil || p != both {
+			t.Errorf("ParseProtection(%q) = %q, %v", both, p, err)
+		}
+	}
+	if p, err := ParseProtection(""); err != nil || !p.IsZero() {
+		t.Errorf("Expected no protection, got %q, %v", p, err)
+	}
+	if _, err := ParseProtection("bogus"); err == nil {
+		t.Error("Expected an error for an unknown flag")
+	}
+}
@@ -4,6 +4,7 @@
 package fileutil
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
@@ -13,7 +14,7 @@ import (
 var _ = syscall.Stat
 
 // getLinkCountForPlatform returns the number of hardlinks for Unix-like systems
-func getLinkCountForPlatform(info os.FileInfo) (uint64, error) {
+func getLinkCountForPlatform(path string, info os.FileInfo) (uint64, error) {
 	sysInfo, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
 		return 0, fmt.Errorf("unable to get stat_t info")
@@ -31,3 +32,31 @@ func getFileOwnership(info os.FileInfo) (uint32, uint32, error) {
 	
 	return sysInfo.Uid, sysInfo.Gid, nil
 }
+
+// getAllocatedSizeForPlatform returns the allocated size from the 512-byte block count
+func getAllocatedSizeForPlatform(info os.FileInfo) int64 {
+	sysInfo, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+
+	return int64(sysInfo.Blocks) * 512
+}
+
+// syncDirForPlatform flushes the entries of the directory at path to disk
+func syncDirForPlatform(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// isCrossDeviceForPlatform reports whether err is EXDEV
+func isCrossDeviceForPlatform(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
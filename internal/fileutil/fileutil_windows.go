@@ -3,16 +3,35 @@
 package fileutil
 
 import (
+	"errors"
 	"fmt"
 	"os"
+
+	"golang.org/x/sys/windows"
 )
 
-// getLinkCountForPlatform returns the number of hardlinks for Windows systems
-// Note: Windows doesn't easily expose link count in the same way, so we always return 1
-func getLinkCountForPlatform(info os.FileInfo) (uint64, error) {
-	// Windows doesn't easily expose link count in the same way as Unix
-	// For simplicity, we'll return 1 (assumed to be one link)
-	return 1, nil
+// getLinkCountForPlatform returns the number of hardlinks for Windows systems from
+// GetFileInformationByHandle, as the attributes kept in os.FileInfo do not include it
+func getLinkCountForPlatform(path string, info os.FileInfo) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	// Only the attributes are read, without locking other processes out. Like Lstat, a
+	// symlink is opened itself; directories can only be opened with backup semantics.
+	h, err := windows.CreateFile(name, windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_OPEN_REPARSE_POINT|windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, &os.PathError{Op: "CreateFile", Path: path, Err: err}
+	}
+	defer windows.CloseHandle(h)
+
+	var data windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &data); err != nil {
+		return 0, &os.PathError{Op: "GetFileInformationByHandle", Path: path, Err: err}
+	}
+	return uint64(data.NumberOfLinks), nil
 }
 
 // getFileOwnership returns dummy values for Windows
@@ -21,3 +40,21 @@ func getFileOwnership(info os.FileInfo) (uint32, uint32, error) {
 	// Windows doesn't have the same UID/GID concept as Unix
 	return 0, 0, fmt.Errorf("ownership not supported on Windows")
 }
+
+// getAllocatedSizeForPlatform returns the logical size on Windows
+// Allocation information is not exposed through os.FileInfo
+func getAllocatedSizeForPlatform(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// syncDirForPlatform does nothing: Windows cannot flush a directory, and NTFS journals
+// the changes to its entries
+func syncDirForPlatform(path string) error {
+	return nil
+}
+
+// isCrossDeviceForPlatform reports whether err is ERROR_NOT_SAME_DEVICE, what MoveFileEx
+// fails with between volumes
+func isCrossDeviceForPlatform(err error) bool {
+	return errors.Is(err, windows.ERROR_NOT_SAME_DEVICE)
+}
@@ -0,0 +1,82 @@
+//go:build windows
+
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetLinkCountWindows(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "test.txt")
+	if err := os.WriteFile(filePath, []byte("link count test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	for _, name := range []string{"link1.txt", "link2.txt"} {
+		if err := os.Link(filePath, filepath.Join(tempDir, name)); err != nil {
+			t.Skipf("Hardlinks not supported on this volume: %v", err)
+		}
+	}
+
+	count, err := GetLinkCount(filePath)
+	if err != nil || count != 3 {
+		t.Errorf("Expected 3 links, got %d (%v)", count, err)
+	}
+
+	// The count is read from the file, not from the info
+	if err := os.Remove(filepath.Join(tempDir, "link2.txt")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := GetLinkCountFromFileInfo(filePath, info); err != nil || count != 2 {
+		t.Errorf("Expected 2 links after removing one, got %d (%v)", count, err)
+	}
+
+	// Files held open by another process can still be counted
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if count, err := GetLinkCount(filepath.Join(tempDir, "link1.txt")); err != nil || count != 2 {
+		t.Errorf("Expected 2 links of the open file, got %d (%v)", count, err)
+	}
+
+	if count, err := GetLinkCount(tempDir); err != nil || count != 1 {
+		t.Errorf("Expected a directory to have 1 link, got %d (%v)", count, err)
+	}
+	if _, err := GetLinkCount(filepath.Join(tempDir, "nonexistent.txt")); err == nil {
+		t.Error("GetLinkCount should have failed for a non-existent file")
+	}
+}
+
+func TestCopyBirthTimeWindows(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.dat")
+	dst := filepath.Join(tempDir, "dst.dat")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create %s: %v", src, err)
+	}
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := setBirthTime(src, created); err != nil {
+		t.Fatalf("Failed to set the birth time: %v", err)
+	}
+	if err := os.WriteFile(dst, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create %s: %v", dst, err)
+	}
+
+	failure, err := CopyBirthTime(src, dst)
+	if err != nil || failure != nil {
+		t.Fatalf("CopyBirthTime failed: %v %v", failure, err)
+	}
+	got, ok, err := birthTime(dst)
+	if err != nil || !ok || !got.Equal(created) {
+		t.Errorf("Expected birth time %v, got %v (%v)", created, got, err)
+	}
+}
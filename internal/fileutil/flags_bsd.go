@@ -0,0 +1,34 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package fileutil
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileFlags implements CopyFileFlags with chflags
+func copyFileFlags(src, dst string) (*MetadataError, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return nil, fmt.Errorf("cannot read the file flags of %s: %w", src, err)
+	}
+	flags := st.Flags & preservedFlags
+	if flags == 0 {
+		return nil, nil
+	}
+	if err := unix.Lstat(dst, &st); err != nil {
+		return nil, fmt.Errorf("cannot read the file flags of %s: %w", dst, err)
+	}
+	if err := unix.Chflags(dst, int(st.Flags|flags)); err != nil {
+		return &MetadataError{
+			Class:       MetadataFileFlags,
+			Name:        fmt.Sprintf("%#x", flags),
+			Err:         err,
+			Unsupported: isUnsupported(err),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,8 @@
+package fileutil
+
+import "golang.org/x/sys/unix"
+
+// preservedFlags are the flags copied by CopyFileFlags. The immutable and append-only
+// flags would keep the copy from being renamed, UF_COMPRESSED describes how the original
+// is stored rather than its content, and the system flags need root.
+const preservedFlags = unix.UF_NODUMP | unix.UF_HIDDEN | unix.UF_OPAQUE
@@ -0,0 +1,16 @@
+package fileutil
+
+// User file flags of chflags from sys/stat.h, which x/sys does not define for FreeBSD
+const (
+	ufNoDump  = 0x1
+	ufOpaque  = 0x8
+	ufSystem  = 0x80
+	ufArchive = 0x800
+	ufHidden  = 0x8000
+)
+
+// preservedFlags are the flags copied by CopyFileFlags. The immutable, append-only and
+// undeletable flags would keep the copy from being renamed, UF_READONLY from getting the
+// mode and times of the original, the sparse, offline and reparse flags describe how the
+// original is stored rather than its content, and the system flags need root.
+const preservedFlags = ufNoDump | ufOpaque | ufSystem | ufArchive | ufHidden
@@ -0,0 +1,71 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Inode flags of FS_IOC_GETFLAGS, as set by chattr, which x/sys does not define
+const (
+	fsComprFl   = 0x4
+	fsSyncFl    = 0x8
+	fsNoDumpFl  = 0x40
+	fsNoAtimeFl = 0x80
+	fsNoComprFl = 0x400
+)
+
+// preservedFlags are the flags copied by CopyFileFlags. The immutable and append-only
+// flags would keep the copy from being renamed, and the no-copy-on-write flag only takes
+// effect on empty files.
+const preservedFlags = fsComprFl | fsSyncFl | fsNoDumpFl | fsNoAtimeFl | fsNoComprFl
+
+// openForFlags opens path for the inode flag ioctls, which need a descriptor but no access
+// to the data
+func openForFlags(path string) (int, error) {
+	return unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// noFlags reports whether err is that of a filesystem without inode flags
+func noFlags(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EINVAL) || isUnsupported(err)
+}
+
+// copyFileFlags implements CopyFileFlags with FS_IOC_GETFLAGS and FS_IOC_SETFLAGS
+func copyFileFlags(src, dst string) (*MetadataError, error) {
+	fd, err := openForFlags(src)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the file flags of %s: %w", src, err)
+	}
+	srcFlags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	unix.Close(fd)
+	if err != nil {
+		if noFlags(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read the file flags of %s: %w", src, err)
+	}
+	flags := srcFlags & preservedFlags
+	if flags == 0 {
+		return nil, nil
+	}
+
+	if fd, err = openForFlags(dst); err != nil {
+		return nil, fmt.Errorf("cannot read the file flags of %s: %w", dst, err)
+	}
+	defer unix.Close(fd)
+	dstFlags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err == nil {
+		err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(dstFlags|flags))
+	}
+	if err != nil {
+		return &MetadataError{
+			Class:       MetadataFileFlags,
+			Name:        fmt.Sprintf("%#x", flags),
+			Err:         err,
+			Unsupported: noFlags(err),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package fileutil
+
+// copyFileFlags implements CopyFileFlags; file flags are not preserved on this platform
+func copyFileFlags(src, dst string) (*MetadataError, error) {
+	return nil, nil
+}
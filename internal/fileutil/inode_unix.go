@@ -29,4 +29,19 @@ func GetInodeFromFileInfo(info os.FileInfo) (uint64, error) {
 		return 0, fmt.Errorf("unable to get stat_t info")
 	}
 	return sysInfo.Ino, nil
-} 
\ No newline at end of file
+} 
+
+// FileID identifies a file by device and inode number
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// GetFileIDFromFileInfo extracts the device and inode numbers from file info
+func GetFileIDFromFileInfo(info os.FileInfo) (FileID, error) {
+	sysInfo, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, fmt.Errorf("unable to get stat_t info")
+	}
+	return FileID{Dev: uint64(sysInfo.Dev), Ino: sysInfo.Ino}, nil
+}
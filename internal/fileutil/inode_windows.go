@@ -19,4 +19,15 @@ func GetInode(path string) (uint64, error) {
 // GetInodeFromFileInfo returns a dummy value for Windows
 func GetInodeFromFileInfo(info os.FileInfo) (uint64, error) {
 	return 0, fmt.Errorf("inodes not supported on Windows")
-} 
\ No newline at end of file
+} 
+
+// FileID identifies a file by device and inode number
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// GetFileIDFromFileInfo returns an error on Windows as inodes are a Unix-specific concept
+func GetFileIDFromFileInfo(info os.FileInfo) (FileID, error) {
+	return FileID{}, fmt.Errorf("inodes not supported on Windows")
+}
@@ -0,0 +1,112 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MetadataClass names a kind of file metadata preserved besides mode and times
+type MetadataClass string
+
+const (
+	// MetadataXattr is user-visible extended attributes
+	MetadataXattr MetadataClass = "extended attributes"
+	// MetadataACL is access control lists stored as extended attributes
+	MetadataACL MetadataClass = "ACLs"
+	// MetadataResourceFork is the resource fork macOS stores as the com.apple.ResourceFork
+	// extended attribute
+	MetadataResourceFork MetadataClass = "resource forks"
+	// MetadataFileFlags is the file flags set with chflags or chattr, such as the hidden
+	// flag of the Finder on macOS or the no-dump flag
+	MetadataFileFlags MetadataClass = "file flags"
+	// MetadataBirthTime is the creation time of files, where the filesystem records it
+	MetadataBirthTime MetadataClass = "birth times"
+)
+
+// resourceForkXattr is the extended attribute holding the resource fork on macOS
+const resourceForkXattr = "com.apple.ResourceFork"
+
+// aclXattrs are the extended attributes holding ACLs
+var aclXattrs = []string{
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+	"system.nfs4_acl",
+	"system.richacl",
+}
+
+// xattrClass returns the metadata class of an extended attribute
+func xattrClass(name string) MetadataClass {
+	for _, acl := range aclXattrs {
+		if name == acl {
+			return MetadataACL
+		}
+	}
+	if name == resourceForkXattr {
+		return MetadataResourceFork
+	}
+	return MetadataXattr
+}
+
+// MetadataError is a failure to preserve one attribute
+type MetadataError struct {
+	Class MetadataClass
+	Name  string
+	Err   error
+	// Unsupported is set when the destination filesystem does not support the class
+	// at all, as opposed to failing for this one file
+	Unsupported bool
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("cannot preserve %s %s: %v", strings.TrimSuffix(string(e.Class), "s"), e.Name, e.Err)
+}
+
+func (e *MetadataError) Unwrap() error {
+	return e.Err
+}
+
+// CopyXattrs copies the extended attributes of src, including ACLs stored as extended
+// attributes, to dst. Each attribute is copied independently; the failures are returned.
+// A source filesystem without extended attribute support has nothing to copy.
+func CopyXattrs(src, dst string) ([]*MetadataError, error) {
+	return copyXattrs(src, dst)
+}
+
+// CopyFileFlags copies the file flags of src that describe its content, such as the hidden
+// flag on macOS or the no-dump and no-atime flags of chattr on Linux, to dst. Flags that
+// would keep the original from being replaced, such as immutable, are left out. Platforms
+// and filesystems without such flags copy nothing.
+func CopyFileFlags(src, dst string) (*MetadataError, error) {
+	return copyFileFlags(src, dst)
+}
+
+// errBirthTimeNotKept is the failure of a filesystem that accepted a birth time but did not
+// store it
+var errBirthTimeNotKept = errors.New("the filesystem did not keep it")
+
+// CopyBirthTime gives dst the birth time of src, where the platform can set it and the
+// filesystems record it, and checks it was kept. A birth time that cannot be preserved is
+// returned as an unsupported MetadataError: it never fails the file.
+func CopyBirthTime(src, dst string) (*MetadataError, error) {
+	birth, ok, err := birthTime(src)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the birth time of %s: %w", src, err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	err = setBirthTime(dst, birth)
+	if err == nil {
+		// Filesystems store birth times with their own precision
+		got, ok, readErr := birthTime(dst)
+		if readErr == nil && (!ok || !got.Truncate(time.Microsecond).Equal(birth.Truncate(time.Microsecond))) {
+			err = errBirthTimeNotKept
+		}
+	}
+	if err == nil {
+		return nil, nil
+	}
+	return &MetadataError{Class: MetadataBirthTime, Name: birth.Format(time.RFC3339), Err: err, Unsupported: true}, nil
+}
@@ -0,0 +1,169 @@
+package fileutil
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelChunkSize is the size of the chunks the streams of a parallel copy take in turn
+const parallelChunkSize = 8 * copyBufferSize
+
+// errCopyStopped stops a stream of a parallel copy another stream failed
+var errCopyStopped = errors.New("copy stopped")
+
+// chunkSequencer lets the streams of a parallel copy hash their chunks in file order
+type chunkSequencer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// next is the index of the chunk to hash next
+	next int64
+	// err is the first error of a stream, which stops the others
+	err error
+}
+
+func newChunkSequencer() *chunkSequencer {
+	q := &chunkSequencer{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// await blocks until chunk index is the next to hash, returning false if the copy failed
+func (q *chunkSequencer) await(index int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.next != index && q.err == nil {
+		q.cond.Wait()
+	}
+	return q.err == nil
+}
+
+// advance hands the turn to the next chunk
+func (q *chunkSequencer) advance() {
+	q.mu.Lock()
+	q.next++
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// fail stops the copy with err, unless it already failed
+func (q *chunkSequencer) fail(err error) {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// copyParallel copies length bytes from offset of s to the same offset of d with
+// opts.Streams streams reading and writing chunks at their offsets, so a single large
+// file keeps several requests in flight instead of one. Chunks are handed out in order
+// and hashed in order, which keeps the streaming hashes the digests of the whole file
+// that read-back, the audit log and the database compare against; a stream waits for
+// its turn to hash, so the streams stay within one chunk each of one another.
+func copyParallel(d, s *os.File, offset, length int64, opts *CopyOptions) error {
+	chunks := (length + parallelChunkSize - 1) / parallelChunkSize
+	streams := min(int64(opts.Streams), chunks)
+	q := newChunkSequencer()
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	for i := int64(0); i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := alignedBuffer(parallelChunkSize)
+			for {
+				index := taken.Add(1) - 1
+				if index >= chunks {
+					return
+				}
+				if err := copyChunk(d, s, buf, index, offset, length, q, opts); err != nil {
+					q.fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return q.err
+}
+
+// copyChunk copies chunk index of a parallel copy and hashes it once its turn comes
+func copyChunk(d, s *os.File, buf []byte, index, offset, length int64, q *chunkSequencer, opts *CopyOptions) error {
+	if opts.Cancel != nil {
+		select {
+		case <-opts.Cancel:
+			return ErrCopyCanceled
+		default:
+		}
+	}
+	start := index * parallelChunkSize
+	buf = buf[:min(parallelChunkSize, length-start)]
+	at := offset + start
+
+	n, err := readAt(s, buf, at, opts)
+	if err != nil {
+		return err
+	}
+	buf = buf[:n]
+	if n > 0 {
+		if opts.Limiter != nil {
+			if err := opts.Limiter.Wait(n); err != nil {
+				return err
+			}
+		}
+		if opts.BytesRead != nil {
+			opts.BytesRead.Add(int64(n))
+		}
+		if err := writeAt(d, buf, at, opts); err != nil {
+			return err
+		}
+		if opts.BytesWritten != nil {
+			opts.BytesWritten.Add(int64(n))
+		}
+	}
+
+	if !q.await(index) {
+		return errCopyStopped
+	}
+	defer q.advance()
+	if opts.SourceHash != nil {
+		opts.SourceHash.Write(buf)
+	}
+	if opts.DestHash != nil {
+		opts.DestHash.Write(buf)
+	}
+	if c := opts.bypass; c != nil {
+		if c.pending += int64(n); c.pending >= dropInterval {
+			c.drop()
+		}
+	}
+	return nil
+}
+
+// readAt fills buf from offset off of s, short only at the end of the file. A read the
+// filesystem refused to do direct is done again with the cache.
+func readAt(s *os.File, buf []byte, off int64, opts *CopyOptions) (int, error) {
+	n, err := s.ReadAt(buf, off)
+	if err != nil && bypassingDirect(opts) && directRefused(err) && disableDirect(s) == nil {
+		var m int
+		m, err = s.ReadAt(buf[n:], off+int64(n))
+		n += m
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// writeAt writes buf at offset off of d like readAt
+func writeAt(d *os.File, buf []byte, off int64, opts *CopyOptions) error {
+	n, err := d.WriteAt(buf, off)
+	if err != nil && bypassingDirect(opts) && directRefused(err) && disableDirect(d) == nil {
+		_, err = d.WriteAt(buf[n:], off+int64(n))
+	}
+	return err
+}
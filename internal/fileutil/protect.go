@@ -0,0 +1,81 @@
+package fileutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Protection is the set of flags keeping a file from being removed or rewritten, such as
+// the immutable and append-only flags of chattr and chflags, in the encoding of the
+// platform. The zero value is an unprotected file.
+type Protection struct {
+	flags uint32
+}
+
+// protectionName names a protection flag
+type protectionName struct {
+	flag uint32
+	name string
+}
+
+// IsZero reports whether no protection flag is set
+func (p Protection) IsZero() bool {
+	return p.flags == 0
+}
+
+func (p Protection) String() string {
+	var names []string
+	for _, n := range protectionNames {
+		if p.flags&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// ParseProtection parses the names of flags String returns. A flag this platform does
+// not know is an error.
+func ParseProtection(s string) (Protection, error) {
+	var p Protection
+	if s == "" {
+		return p, nil
+	}
+	for _, name := range strings.Split(s, ", ") {
+		known := false
+		for _, n := range protectionNames {
+			if n.name == name {
+				p.flags |= n.flag
+				known = true
+				break
+			}
+		}
+		if !known {
+			return Protection{}, fmt.Errorf("unknown protection flag %q", name)
+		}
+	}
+	return p, nil
+}
+
+// GetProtection returns the protection flags set on path. Filesystems without file flags
+// report none.
+func GetProtection(path string) (Protection, error) {
+	flags, err := getProtection(path)
+	return Protection{flags: flags}, err
+}
+
+// ClearProtection clears the flags of p on path, leaving its other flags alone. Clearing
+// the immutable and append-only flags usually needs root.
+func ClearProtection(path string, p Protection) error {
+	if p.IsZero() {
+		return nil
+	}
+	return updateProtection(path, func(flags uint32) uint32 { return flags &^ p.flags })
+}
+
+// RestoreProtection sets the flags of p on path again, leaving its other flags alone
+func RestoreProtection(path string, p Protection) error {
+	if p.IsZero() {
+		return nil
+	}
+	return updateProtection(path, func(flags uint32) uint32 { return flags | p.flags })
+}
@@ -0,0 +1,44 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package fileutil
+
+import "golang.org/x/sys/unix"
+
+// File flags of chflags from sys/stat.h, the same on macOS and FreeBSD. The user flags
+// can be changed by the owner, the system flags only by root.
+const (
+	ufImmutable = 0x2
+	ufAppend    = 0x4
+	ufNoUnlink  = 0x10
+	sfImmutable = 0x20000
+	sfAppend    = 0x40000
+	sfNoUnlink  = 0x100000
+)
+
+var protectionNames = []protectionName{
+	{ufImmutable, "immutable"},
+	{ufAppend, "append-only"},
+	{ufNoUnlink, "undeletable"},
+	{sfImmutable, "system immutable"},
+	{sfAppend, "system append-only"},
+	{sfNoUnlink, "system undeletable"},
+}
+
+// getProtection implements GetProtection from the flags of lstat
+func getProtection(path string) (uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint32(st.Flags) & (ufImmutable | ufAppend | ufNoUnlink | sfImmutable | sfAppend | sfNoUnlink), nil
+}
+
+// updateProtection implements ClearProtection and RestoreProtection with chflags
+func updateProtection(path string, update func(uint32) uint32) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return err
+	}
+	return unix.Chflags(path, int(update(uint32(st.Flags))))
+}
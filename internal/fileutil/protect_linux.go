@@ -0,0 +1,45 @@
+package fileutil
+
+import "golang.org/x/sys/unix"
+
+// Inode flags of FS_IOC_GETFLAGS that protect a file
+const (
+	fsImmutableFl = 0x10
+	fsAppendFl    = 0x20
+)
+
+var protectionNames = []protectionName{
+	{fsImmutableFl, "immutable"},
+	{fsAppendFl, "append-only"},
+}
+
+// getProtection implements GetProtection with FS_IOC_GETFLAGS
+func getProtection(path string) (uint32, error) {
+	fd, err := openForFlags(path)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if noFlags(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return flags & (fsImmutableFl | fsAppendFl), nil
+}
+
+// updateProtection implements ClearProtection and RestoreProtection with FS_IOC_SETFLAGS
+func updateProtection(path string, update func(uint32) uint32) error {
+	fd, err := openForFlags(path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(update(flags)))
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fileutil
+
+import "errors"
+
+var protectionNames []protectionName
+
+// getProtection reports no protection: file flags are not read on this platform
+func getProtection(path string) (uint32, error) {
+	return 0, nil
+}
+
+// updateProtection is not implemented on this platform
+func updateProtection(path string, update func(uint32) uint32) error {
+	return errors.ErrUnsupported
+}
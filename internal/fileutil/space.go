@@ -0,0 +1,13 @@
+package fileutil
+
+import "errors"
+
+// ErrSpaceUnsupported is returned by DiskSpace on platforms that cannot report free space
+var ErrSpaceUnsupported = errors.New("free space is not reported on this platform")
+
+// DiskSpace returns the space available to unprivileged users on the filesystem holding
+// path and its size, in bytes. On ZFS this is the space left to the dataset, which takes
+// its quota and the free space of the pool into account.
+func DiskSpace(path string) (free, total uint64, err error) {
+	return diskSpace(path)
+}
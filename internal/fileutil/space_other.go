@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package fileutil
+
+// diskSpace is not implemented on this platform
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, ErrSpaceUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fileutil
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// diskSpace reads the free and total blocks of the filesystem with statfs
+func diskSpace(path string) (free, total uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	blockSize := uint64(st.Bsize)
+	return uint64(st.Bavail) * blockSize, uint64(st.Blocks) * blockSize, nil
+}
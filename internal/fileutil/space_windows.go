@@ -0,0 +1,22 @@
+//go:build windows
+
+package fileutil
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// diskSpace asks for the free bytes of the volume available to the calling user
+func diskSpace(path string) (free, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree); err != nil {
+		return 0, 0, &os.PathError{Op: "GetDiskFreeSpaceEx", Path: path, Err: err}
+	}
+	return free, total, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fileutil
+
+import "os"
+
+// copySparse falls back to a full copy on platforms without SEEK_DATA/SEEK_HOLE.
+func copySparse(d, s *os.File, size int64, opts *CopyOptions) error {
+	return copyRegion(d, s, 0, -1, opts)
+}
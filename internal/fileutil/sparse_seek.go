@@ -0,0 +1,57 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fileutil
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copySparse copies s into d using SEEK_DATA/SEEK_HOLE so that holes in the
+// source stay unallocated in the destination. If the filesystem does not
+// support hole detection the whole file is copied with copyData.
+func copySparse(d, s *os.File, size int64, opts *CopyOptions) error {
+	var offset int64
+	for offset < size {
+		dataStart, err := s.Seek(offset, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				// No more data past offset - the rest of the file is a hole
+				break
+			}
+			if offset == 0 && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTSUP)) {
+				// Hole detection unsupported, fall back to a full copy
+				if _, err := s.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				return copyRegion(d, s, 0, -1, opts)
+			}
+			return err
+		}
+
+		dataEnd, err := s.Seek(dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.Seek(dataStart, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := d.Seek(dataStart, io.SeekStart); err != nil {
+			return err
+		}
+		hashHole(opts, dataStart-offset)
+		if err := copyRegion(d, s, dataStart, dataEnd-dataStart, opts); err != nil {
+			return err
+		}
+		offset = dataEnd
+	}
+
+	// Extend the destination over any trailing hole
+	hashHole(opts, size-offset)
+	return d.Truncate(size)
+}
@@ -0,0 +1,9 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package fileutil
+
+import "golang.org/x/sys/unix"
+
+// errNoAttr is returned when an extended attribute does not exist
+const errNoAttr = unix.ENOATTR
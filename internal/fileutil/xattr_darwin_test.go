@@ -0,0 +1,74 @@
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyMacOSMetadata(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.dat")
+	dst := filepath.Join(tempDir, "dst.dat")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+
+	finderInfo := make([]byte, 32)
+	copy(finderInfo, "TEXTttxt")
+	attrs := map[string][]byte{
+		"com.apple.FinderInfo":   finderInfo,
+		"com.apple.quarantine":   []byte("0081;5f000000;Safari;"),
+		"com.apple.ResourceFork": bytes.Repeat([]byte("r"), 70000),
+	}
+	for name, value := range attrs {
+		if err := unix.Setxattr(src, name, value, 0); err != nil {
+			if isUnsupported(err) {
+				t.Skip("Filesystem does not support extended attributes")
+			}
+			t.Fatalf("Failed to set %s: %v", name, err)
+		}
+	}
+	if err := unix.Chflags(src, unix.UF_HIDDEN); err != nil {
+		t.Fatalf("Failed to hide the file: %v", err)
+	}
+
+	failed, err := CopyXattrs(src, dst)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("CopyXattrs failed: %v %v", failed, err)
+	}
+	for name, value := range attrs {
+		if got, err := getXattr(dst, name); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Expected %s to be copied, got %d bytes (%v)", name, len(got), err)
+		}
+	}
+
+	if failure, err := CopyFileFlags(src, dst); err != nil || failure != nil {
+		t.Fatalf("CopyFileFlags failed: %v %v", failure, err)
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(dst, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Flags&unix.UF_HIDDEN == 0 {
+		t.Errorf("Expected the hidden flag to be copied, got flags %#x", st.Flags)
+	}
+
+	// Immutable files keep their flag to themselves, the copy must stay replaceable
+	if err := unix.Chflags(src, unix.UF_IMMUTABLE); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Chflags(src, 0)
+	if _, err := CopyFileFlags(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dst, dst+".renamed"); errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected the copy to stay renamable: %v", err)
+	}
+}
@@ -0,0 +1,6 @@
+package fileutil
+
+import "golang.org/x/sys/unix"
+
+// errNoAttr is returned when an extended attribute does not exist
+const errNoAttr = unix.ENODATA
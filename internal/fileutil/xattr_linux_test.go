@@ -0,0 +1,116 @@
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyXattrs(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.dat")
+	dst := filepath.Join(tempDir, "dst.dat")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+
+	value := bytes.Repeat([]byte("v"), 300)
+	if err := unix.Setxattr(src, "user.rebalance.test", value, 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("Filesystem does not support user extended attributes")
+		}
+		t.Fatalf("Failed to set extended attribute: %v", err)
+	}
+
+	failed, err := CopyXattrs(src, dst)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("CopyXattrs failed: %v %v", failed, err)
+	}
+	got, err := getXattr(dst, "user.rebalance.test")
+	if err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Expected the attribute to be copied, got %q (%v)", got, err)
+	}
+}
+
+func TestXattrClass(t *testing.T) {
+	if xattrClass("system.posix_acl_access") != MetadataACL {
+		t.Error("Expected POSIX ACLs to be classified as ACLs")
+	}
+	if xattrClass("user.comment") != MetadataXattr {
+		t.Error("Expected user attributes to be classified as extended attributes")
+	}
+	if xattrClass("com.apple.ResourceFork") != MetadataResourceFork {
+		t.Error("Expected the macOS resource fork to be classified as such")
+	}
+	e := &MetadataError{Class: MetadataACL, Name: "system.nfs4_acl", Err: unix.ENOTSUP}
+	if !errors.Is(e, unix.ENOTSUP) || e.Error() != "cannot preserve ACL system.nfs4_acl: operation not supported" {
+		t.Errorf("Unexpected error %q", e)
+	}
+}
+
+func TestCopyBirthTimeUnsupported(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.dat")
+	dst := filepath.Join(tempDir, "dst.dat")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+	if _, ok, err := birthTime(src); err != nil || !ok {
+		t.Skipf("Filesystem does not record birth times (%v)", err)
+	}
+
+	failure, err := CopyBirthTime(src, dst)
+	if err != nil {
+		t.Fatalf("CopyBirthTime failed: %v", err)
+	}
+	if failure == nil || failure.Class != MetadataBirthTime || !failure.Unsupported {
+		t.Errorf("Expected an unsupported birth time failure, got %v", failure)
+	}
+}
+
+func TestCopyFileFlags(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.dat")
+	dst := filepath.Join(tempDir, "dst.dat")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+	flagsOf := func(path string) (uint32, error) {
+		fd, err := openForFlags(path)
+		if err != nil {
+			return 0, err
+		}
+		defer unix.Close(fd)
+		return unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	}
+	flags, err := flagsOf(src)
+	if err == nil {
+		fd, openErr := openForFlags(src)
+		if openErr != nil {
+			t.Fatalf("Failed to open %s: %v", src, openErr)
+		}
+		err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags|fsNoDumpFl))
+		unix.Close(fd)
+	}
+	if err != nil {
+		t.Skipf("Filesystem does not support the no-dump flag (%v)", err)
+	}
+
+	failure, err := CopyFileFlags(src, dst)
+	if err != nil || failure != nil {
+		t.Fatalf("CopyFileFlags failed: %v %v", failure, err)
+	}
+	if got, err := flagsOf(dst); err != nil || got&fsNoDumpFl == 0 {
+		t.Errorf("Expected the no-dump flag to be copied, got %#x (%v)", got, err)
+	}
+}
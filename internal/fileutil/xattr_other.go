@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fileutil
+
+// copyXattrs implements CopyXattrs; extended attributes are not preserved on this platform
+func copyXattrs(src, dst string) ([]*MetadataError, error) {
+	return nil, nil
+}
@@ -0,0 +1,86 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs implements CopyXattrs
+func copyXattrs(src, dst string) ([]*MetadataError, error) {
+	names, err := listXattrs(src)
+	if err != nil {
+		if isUnsupported(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list extended attributes of %s: %w", src, err)
+	}
+
+	var failed []*MetadataError
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			if errors.Is(err, errNoAttr) {
+				continue // removed since it was listed
+			}
+			return failed, fmt.Errorf("cannot read extended attribute %s of %s: %w", name, src, err)
+		}
+		if err := unix.Setxattr(dst, name, value, 0); err != nil {
+			failed = append(failed, &MetadataError{
+				Class:       xattrClass(name),
+				Name:        name,
+				Err:         err,
+				Unsupported: isUnsupported(err),
+			})
+		}
+	}
+	return failed, nil
+}
+
+// isUnsupported reports whether err means the filesystem lacks the feature
+func isUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// listXattrs returns the names of the extended attributes of path
+func listXattrs(path string) ([]string, error) {
+	buf, err := readSized(func(dest []byte) (int, error) { return unix.Listxattr(path, dest) })
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(bytes.TrimRight(buf, "\x00"), []byte{0}) {
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+// getXattr returns the value of an extended attribute of path
+func getXattr(path, name string) ([]byte, error) {
+	return readSized(func(dest []byte) (int, error) { return unix.Getxattr(path, name, dest) })
+}
+
+// readSized calls a size-querying system call, first for the size and then for the
+// data, retrying if the data grew in between
+func readSized(call func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := call(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
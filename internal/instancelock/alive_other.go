@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+// +build !unix,!windows
+
+package instancelock
+
+// processAlive cannot check processes on this platform, so locks are never stale
+func processAlive(pid int) bool {
+	return true
+}
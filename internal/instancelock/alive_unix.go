@@ -0,0 +1,13 @@
+//go:build unix
+// +build unix
+
+package instancelock
+
+import "golang.org/x/sys/unix"
+
+// processAlive reports whether a process with this PID exists
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	// EPERM: the process exists but belongs to another user
+	return err == nil || err == unix.EPERM
+}
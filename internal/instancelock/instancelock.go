@@ -0,0 +1,246 @@
+// Package instancelock keeps two processes from rebalancing overlapping trees at once.
+// Each running instance owns a small lock file naming its process and root path; a lock
+// whose process is gone is stale and only removed on request.
+package instancelock
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockSuffix names the lock files in the lock directory
+const lockSuffix = ".lock"
+
+// Holder describes the process that owns a lock
+type Holder struct {
+	PID     int
+	Host    string
+	Root    string
+	Started time.Time
+}
+
+// LockedError is returned when an overlapping tree is locked by another instance
+type LockedError struct {
+	Path   string // lock file
+	Holder Holder
+	// Stale is set when the holder is no longer running on this host
+	Stale bool
+}
+
+func (e *LockedError) Error() string {
+	if e.Stale {
+		return fmt.Sprintf("stale lock %s: pid %d, which locked %s, is no longer running", e.Path, e.Holder.PID, e.Holder.Root)
+	}
+	return fmt.Sprintf("%s is being rebalanced by pid %d on %s since %s (lock %s)",
+		e.Holder.Root, e.Holder.PID, e.Holder.Host, e.Holder.Started.Format(time.RFC3339), e.Path)
+}
+
+// Lock is a held instance lock
+type Lock struct {
+	path string
+	// Removed lists the stale locks removed while acquiring this one
+	Removed []Holder
+}
+
+// DefaultDir is the lock directory used when none is configured
+func DefaultDir() string {
+	return filepath.Join(os.TempDir(), "go-zfs-rebalance")
+}
+
+// Acquire locks root, failing with a *LockedError if root, one of its parents or one of
+// its subdirectories is locked by another instance. With force, locks left by processes
+// that are no longer running are removed; locks of running processes never are.
+func Acquire(dir, root string, force bool) (*Lock, error) {
+	root, err := canonicalRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	l := &Lock{path: filepath.Join(dir, lockName(root))}
+	if err := l.create(root, force); err != nil {
+		return nil, err
+	}
+
+	// Another instance may have locked a parent or subdirectory of root. Both sides
+	// create their own lock before looking, so two overlapping starts cannot both win.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		l.Release()
+		return nil, fmt.Errorf("failed to read lock directory: %w", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if path == l.path || !strings.HasSuffix(entry.Name(), lockSuffix) {
+			continue
+		}
+		holder, err := readHolder(path)
+		if err != nil || !overlaps(root, holder.Root) {
+			continue // removed meanwhile, or unrelated
+		}
+		if err := l.checkHolder(path, holder, force); err != nil {
+			l.Release()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// create writes the lock file of root, replacing it if it is stale and force is set. The
+// holder is written to a temporary file first and linked into place, so other instances
+// never read a lock file without its holder.
+func (l *Lock) create(root string, force bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create lock file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = writeHolder(tmp, currentHolder(root))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	for {
+		err := os.Link(tmp.Name(), l.path)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		holder, err := readHolder(l.path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // released meanwhile
+		}
+		if err != nil {
+			return err
+		}
+		if err := l.checkHolder(l.path, holder, force); err != nil {
+			return err
+		}
+	}
+}
+
+// checkHolder returns a *LockedError for the lock at path unless it is stale and force is
+// set, in which case the lock is removed
+func (l *Lock) checkHolder(path string, holder Holder, force bool) error {
+	stale := !holder.alive()
+	if !stale || !force {
+		return &LockedError{Path: path, Holder: holder, Stale: stale}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale lock: %w", err)
+	}
+	l.Removed = append(l.Removed, holder)
+	return nil
+}
+
+// Release removes the lock file. It is safe to call more than once.
+func (l *Lock) Release() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	err := os.Remove(l.path)
+	l.path = ""
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// canonicalRoot resolves root to an absolute path without symlinks, so every spelling of
+// the same tree maps to the same lock
+func canonicalRoot(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	return filepath.Clean(abs), nil
+}
+
+// lockName derives the lock file name from the root path
+func lockName(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return hex.EncodeToString(sum[:8]) + lockSuffix
+}
+
+// overlaps reports whether a and b are the same directory or one contains the other
+func overlaps(a, b string) bool {
+	return within(a, b) || within(b, a)
+}
+
+// within reports whether path is dir or lies below it
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func currentHolder(root string) Holder {
+	host, _ := os.Hostname()
+	return Holder{PID: os.Getpid(), Host: host, Root: root, Started: time.Now()}
+}
+
+// alive reports whether the holder may still be running. Processes on other hosts
+// sharing the lock directory cannot be checked and count as running.
+func (h Holder) alive() bool {
+	if host, _ := os.Hostname(); h.Host != host {
+		return true
+	}
+	return processAlive(h.PID)
+}
+
+// writeHolder stores h as key=value lines
+func writeHolder(f *os.File, h Holder) error {
+	_, err := fmt.Fprintf(f, "pid=%d\nhost=%s\nroot=%s\nstarted=%s\n",
+		h.PID, h.Host, strconv.Quote(h.Root), h.Started.UTC().Format(time.RFC3339))
+	return err
+}
+
+// readHolder parses a lock file written by writeHolder
+func readHolder(path string) (Holder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Holder{}, err
+	}
+	defer f.Close()
+
+	var h Holder
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "pid":
+			h.PID, _ = strconv.Atoi(value)
+		case "host":
+			h.Host = value
+		case "root":
+			h.Root, _ = strconv.Unquote(value)
+		case "started":
+			h.Started, _ = time.Parse(time.RFC3339, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Holder{}, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	if h.PID <= 0 || h.Root == "" {
+		return Holder{}, fmt.Errorf("malformed lock file %s", path)
+	}
+	return h, nil
+}
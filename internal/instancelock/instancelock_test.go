@@ -0,0 +1,140 @@
+package instancelock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// deadPID is above the PID limit of every supported platform
+const deadPID = 1 << 30
+
+// writeLock creates a lock file for root as if another process held it
+func writeLock(t *testing.T, dir, root string, h Holder) string {
+	t.Helper()
+	root, err := canonicalRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Root = root
+	path := filepath.Join(dir, lockName(root))
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := writeHolder(f, h); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAcquire(t *testing.T) {
+	dir, tree := t.TempDir(), t.TempDir()
+	sub := filepath.Join(tree, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Acquire(dir, tree, false)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// The same tree, a subdirectory and a parent are all refused, even with force
+	for _, root := range []string{tree, sub, filepath.Dir(tree)} {
+		_, err := Acquire(dir, root, true)
+		var locked *LockedError
+		if !errors.As(err, &locked) || locked.Stale || locked.Holder.PID != os.Getpid() {
+			t.Errorf("Expected %s to be locked by this process, got %v", root, err)
+		}
+	}
+
+	// Only the complete lock file is left in the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != filepath.Base(l.path) {
+		t.Errorf("Expected only the lock file in %s, got %v (%v)", dir, entries, err)
+	}
+	if h, err := readHolder(l.path); err != nil || h.PID != os.Getpid() {
+		t.Errorf("Expected the lock to name this process, got %+v (%v)", h, err)
+	}
+
+	// An unrelated tree can be locked alongside
+	other, err := Acquire(dir, t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Expected an unrelated tree to be lockable: %v", err)
+	}
+	other.Release()
+
+	if err := l.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Errorf("Expected a second Release to be a no-op, got %v", err)
+	}
+	l, err = Acquire(dir, sub, false)
+	if err != nil {
+		t.Fatalf("Expected the tree to be lockable after release: %v", err)
+	}
+	l.Release()
+}
+
+func TestAcquireStale(t *testing.T) {
+	dir, tree := t.TempDir(), t.TempDir()
+	host, _ := os.Hostname()
+	stalePath := writeLock(t, dir, tree, Holder{PID: deadPID, Host: host, Started: time.Now()})
+
+	// A stale lock is reported, not silently taken over
+	_, err := Acquire(dir, filepath.Join(tree, "sub"), false)
+	var locked *LockedError
+	if !errors.As(err, &locked) || !locked.Stale || locked.Path != stalePath {
+		t.Fatalf("Expected a stale lock error, got %v", err)
+	}
+
+	l, err := Acquire(dir, tree, true)
+	if err != nil {
+		t.Fatalf("Expected force to remove the stale lock: %v", err)
+	}
+	defer l.Release()
+	if len(l.Removed) != 1 || l.Removed[0].PID != deadPID {
+		t.Errorf("Expected the stale holder to be reported, got %+v", l.Removed)
+	}
+	if h, err := readHolder(stalePath); err != nil || h.PID != os.Getpid() {
+		t.Errorf("Expected the lock to belong to this process, got %+v err=%v", h, err)
+	}
+}
+
+func TestAcquireOtherHost(t *testing.T) {
+	dir, tree := t.TempDir(), t.TempDir()
+	writeLock(t, dir, tree, Holder{PID: deadPID, Host: "elsewhere.invalid", Started: time.Now()})
+
+	// A process on another host cannot be checked, so its lock is never stale
+	_, err := Acquire(dir, tree, true)
+	var locked *LockedError
+	if !errors.As(err, &locked) || locked.Stale {
+		t.Errorf("Expected a live lock error for another host, got %v", err)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	sep := string(filepath.Separator)
+	tank := sep + "tank"
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{tank, tank, true},
+		{tank, filepath.Join(tank, "media"), true},
+		{filepath.Join(tank, "media"), tank, true},
+		{filepath.Join(tank, "media"), filepath.Join(tank, "backups"), false},
+		{tank, sep + "tank2", false},
+		{filepath.Join(tank, "..media"), tank, true},
+	}
+	for _, c := range cases {
+		if got := overlaps(c.a, c.b); got != c.want {
+			t.Errorf("overlaps(%q, %q) = %t, want %t", c.a, c.b, got, c.want)
+		}
+	}
+}
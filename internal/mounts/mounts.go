@@ -0,0 +1,143 @@
+// Package mounts enumerates mounted filesystems so nested mounts under a
+// rebalance root can be reported and skipped.
+package mounts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Mount describes a mounted filesystem
+type Mount struct {
+	// Path is the mount point
+	Path string
+	// Source is the mounted device, remote export or ZFS dataset name
+	Source string
+	// FSType is the filesystem type, e.g. zfs, nfs4 or ext4
+	FSType string
+	// Root is the directory of the source filesystem mounted at Path.
+	// It is "/" for regular mounts and a subdirectory for bind mounts;
+	// empty when the platform does not report it.
+	Root string
+}
+
+// String returns a human readable description of the mount
+func (m Mount) String() string {
+	return fmt.Sprintf("%s (%s from %s)", m.Path, m.FSType, m.Source)
+}
+
+// IsBind reports whether the mount exposes a subdirectory of another filesystem
+func (m Mount) IsBind() bool {
+	return m.Root != "" && m.Root != "/"
+}
+
+// Pool returns the ZFS pool of the mount, or "" for non-ZFS filesystems
+func (m Mount) Pool() string {
+	if m.FSType != "zfs" {
+		return ""
+	}
+	pool, _, _ := strings.Cut(m.Source, "/")
+	return pool
+}
+
+// IsForeign reports whether m is a different storage target than parent.
+// Child datasets of the parent's ZFS pool are not foreign; bind mounts,
+// other filesystem types and other pools are.
+func IsForeign(m, parent Mount) bool {
+	if m.IsBind() {
+		return true
+	}
+	if m.FSType == "zfs" && parent.FSType == "zfs" {
+		return m.Pool() != parent.Pool()
+	}
+	return true
+}
+
+// Containing returns the mount holding path, i.e. the mount with the longest matching mount point
+func Containing(all []Mount, path string) (Mount, bool) {
+	var best Mount
+	found := false
+	for _, m := range all {
+		if isWithin(path, m.Path) && (!found || len(m.Path) > len(best.Path)) {
+			best = m
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Nested returns the mounts located strictly below root, sorted by path
+func Nested(all []Mount, root string) []Mount {
+	var nested []Mount
+	for _, m := range all {
+		if m.Path != root && isWithin(m.Path, root) {
+			nested = append(nested, m)
+		}
+	}
+	sort.Slice(nested, func(i, j int) bool { return nested[i].Path < nested[j].Path })
+	return nested
+}
+
+// isWithin reports whether path equals dir or lies below it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// parseMountInfo parses the Linux /proc/self/mountinfo format
+func parseMountInfo(r io.Reader) ([]Mount, error) {
+	var all []Mount
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 6 || len(fields) < sep+3 {
+			continue
+		}
+		all = append(all, Mount{
+			Path:   unescape(fields[4]),
+			Root:   unescape(fields[3]),
+			FSType: fields[sep+1],
+			Source: unescape(fields[sep+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse mount table: %w", err)
+	}
+	return all, nil
+}
+
+// unescape decodes the octal escapes (\040 for space etc.) used in the mount table
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,43 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package mounts
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// List returns the mounts visible to the current process
+func List() ([]Mount, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	buf := make([]unix.Statfs_t, n)
+	n, err = unix.Getfsstat(buf, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	all := make([]Mount, 0, n)
+	for _, st := range buf[:n] {
+		all = append(all, Mount{
+			Path:   cString(st.Mntonname[:]),
+			Source: cString(st.Mntfromname[:]),
+			FSType: cString(st.Fstypename[:]),
+		})
+	}
+	return all, nil
+}
+
+// cString converts a NUL terminated byte array to a string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
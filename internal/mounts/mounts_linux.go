@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package mounts
+
+import (
+	"fmt"
+	"os"
+)
+
+// List returns the mounts visible to the current process
+func List() ([]Mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
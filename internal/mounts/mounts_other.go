@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package mounts
+
+// List returns no mounts on platforms without a supported mount table
+func List() ([]Mount, error) {
+	return nil, nil
+}
@@ -0,0 +1,80 @@
+package mounts
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleMountInfo = `22 1 0:21 / / rw,relatime shared:1 - zfs tank/root rw,xattr,posixacl
+23 22 0:22 / /tank/data rw,relatime shared:2 - zfs tank/data rw,xattr,posixacl
+24 23 0:23 / /tank/data/child rw,relatime shared:3 - zfs tank/data/child rw,xattr,posixacl
+25 23 0:24 / /tank/data/other rw,relatime shared:4 - zfs backup/other rw,xattr,posixacl
+26 23 0:25 / /tank/data/nfs\040share rw,relatime shared:5 - nfs4 server:/export rw,vers=4.2
+27 23 0:22 /media /tank/data/bind rw,relatime shared:2 - zfs tank/data rw,xattr,posixacl
+28 22 0:26 / /tank/database rw,relatime shared:6 - zfs tank/database rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	all, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatalf("parseMountInfo failed: %v", err)
+	}
+	if len(all) != 7 {
+		t.Fatalf("Expected 7 mounts, got %d", len(all))
+	}
+
+	nfs := all[4]
+	if nfs.Path != "/tank/data/nfs share" {
+		t.Errorf("Octal escape not decoded: %q", nfs.Path)
+	}
+	if nfs.FSType != "nfs4" || nfs.Source != "server:/export" {
+		t.Errorf("Unexpected NFS mount: %+v", nfs)
+	}
+	if !all[5].IsBind() {
+		t.Errorf("Expected %s to be detected as a bind mount", all[5].Path)
+	}
+	if all[2].Pool() != "tank" {
+		t.Errorf("Expected pool tank, got %q", all[2].Pool())
+	}
+}
+
+func TestNestedForeignMounts(t *testing.T) {
+	all, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatalf("parseMountInfo failed: %v", err)
+	}
+
+	parent, ok := Containing(all, "/tank/data/child/sub")
+	if !ok || parent.Path != "/tank/data/child" {
+		t.Fatalf("Expected /tank/data/child to contain the path, got %+v", parent)
+	}
+
+	root, _ := Containing(all, "/tank/data")
+	nested := Nested(all, "/tank/data")
+	if len(nested) != 4 {
+		t.Fatalf("Expected 4 nested mounts, got %d", len(nested))
+	}
+
+	// /tank/database shares a prefix with /tank/data but is not below it
+	for _, m := range nested {
+		if m.Path == "/tank/database" {
+			t.Errorf("Sibling mount %s reported as nested", m.Path)
+		}
+	}
+
+	foreign := map[string]bool{}
+	for _, m := range nested {
+		foreign[m.Path] = IsForeign(m, root)
+	}
+	expected := map[string]bool{
+		"/tank/data/bind":      true,
+		"/tank/data/child":     false,
+		"/tank/data/nfs share": true,
+		"/tank/data/other":     true,
+	}
+	for path, want := range expected {
+		if foreign[path] != want {
+			t.Errorf("IsForeign(%s) = %t, want %t", path, foreign[path], want)
+		}
+	}
+}
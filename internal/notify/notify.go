@@ -0,0 +1,202 @@
+// Package notify posts run lifecycle events to webhooks as JSON, e.g. to Gotify, ntfy
+// or home automation endpoints. Each webhook gets the events in order from a goroutine
+// of its own, so a slow endpoint never holds up the run; failed posts are retried.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types
+const (
+	EventStart          = "start"
+	EventFinish         = "finish"
+	EventFailure        = "failure"
+	EventErrorThreshold = "error-threshold"
+)
+
+// AllEvents lists every event type
+var AllEvents = []string{EventStart, EventFinish, EventFailure, EventErrorThreshold}
+
+// Event is the JSON payload posted to webhooks. Title, Message and Priority follow the
+// Gotify message format, so Gotify can take it as is.
+type Event struct {
+	Event    string    `json:"event"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Priority int       `json:"priority"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Paths    []string  `json:"paths"`
+	// Totals are the totals of the run so far; not set for start events
+	Totals      *report.RunTotals `json:"totals,omitempty"`
+	Interrupted bool              `json:"interrupted"`
+}
+
+// Webhook is an endpoint and the events posted to it
+type Webhook struct {
+	URL string
+	// Events selects the event types to post; nil posts all of them
+	Events map[string]bool
+}
+
+// ParseEvents parses a comma-separated list of event types; "all" selects every type
+func ParseEvents(s string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case "all":
+			return nil, nil
+		case EventStart, EventFinish, EventFailure, EventErrorThreshold:
+			events[name] = true
+		default:
+			return nil, fmt.Errorf("unknown event %q: expected %s or all", name, strings.Join(AllEvents, ", "))
+		}
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events selected")
+	}
+	return events, nil
+}
+
+// Options tune the HTTP calls of a Notifier
+type Options struct {
+	// Timeout bounds each attempt, 10 seconds if zero
+	Timeout time.Duration
+	// Retries is how many times a failed post is retried
+	Retries int
+	// Backoff is the wait before the first retry, doubled for each further one; 1 second if zero
+	Backoff time.Duration
+	Logger  *logrus.Logger
+	Client  *http.Client
+}
+
+// queueSize bounds the events waiting for a slow webhook; further ones are dropped
+const queueSize = 32
+
+// Notifier posts events to webhooks
+type Notifier struct {
+	opts   Options
+	queues []chan Event
+	hooks  []Webhook
+	wg     sync.WaitGroup
+}
+
+// New starts posting to the webhooks. Close must be called to deliver the events
+// still queued.
+func New(hooks []Webhook, opts Options) *Notifier {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+
+	n := &Notifier{opts: opts, hooks: hooks}
+	for _, hook := range hooks {
+		queue := make(chan Event, queueSize)
+		n.queues = append(n.queues, queue)
+		n.wg.Add(1)
+		go func(hook Webhook) {
+			defer n.wg.Done()
+			for ev := range queue {
+				if err := n.deliver(hook.URL, ev); err != nil {
+					n.opts.Logger.Errorf("Webhook %s: cannot post the %s event: %v", redact(hook.URL), ev.Event, err)
+				}
+			}
+		}(hook)
+	}
+	return n
+}
+
+// Notify queues ev for the webhooks that take its type. It does not block.
+func (n *Notifier) Notify(ev Event) {
+	for i, hook := range n.hooks {
+		if hook.Events != nil && !hook.Events[ev.Event] {
+			continue
+		}
+		select {
+		case n.queues[i] <- ev:
+		default:
+			n.opts.Logger.Errorf("Webhook %s: too many events waiting, dropped the %s event", redact(hook.URL), ev.Event)
+		}
+	}
+}
+
+// Close delivers the queued events, retries included, and stops the Notifier
+func (n *Notifier) Close() {
+	for _, queue := range n.queues {
+		close(queue)
+	}
+	n.wg.Wait()
+}
+
+// deliver posts ev to url, retrying network errors and server errors
+func (n *Notifier) deliver(url string, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	backoff := n.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(url, body)
+		if err == nil || !retry || attempt >= n.opts.Retries {
+			return err
+		}
+		n.opts.Logger.Infof("Webhook %s: %v, retrying in %s", redact(url), err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one attempt and reports whether a failure is worth retrying: network
+// errors, timeouts, 429 and 5xx are; other statuses mean the request itself is wrong
+func (n *Notifier) post(url string, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-zfs-rebalance")
+
+	res, err := n.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+	return retry, fmt.Errorf("HTTP status %s", res.Status)
+}
+
+// redact hides the query of a webhook URL in logs, where tokens are usually passed
+func redact(url string) string {
+	if base, _, found := strings.Cut(url, "?"); found {
+		return base + "?..."
+	}
+	return url
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestNotifier(t *testing.T) {
+	var mu sync.Mutex
+	var received []Event
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The first attempt fails, the retry goes through
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		if err := json.NewDecoder(req.Body).Decode(&ev); err != nil || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request: %v", err)
+		}
+		mu.Lock()
+		received = append(received, ev)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	finishOnly, err := ParseEvents("finish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New([]Webhook{{URL: srv.URL}, {URL: srv.URL + "/finish", Events: finishOnly}},
+		Options{Retries: 2, Backoff: time.Millisecond})
+	n.Notify(Event{Event: EventStart, Paths: []string{"/tank"}})
+	n.Notify(Event{Event: EventFinish, Totals: &report.RunTotals{FilesRebalanced: 3}})
+	n.Close()
+
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 deliveries, got %+v", received)
+	}
+	starts := 0
+	for _, ev := range received {
+		if ev.Event == EventStart {
+			starts++
+		} else if ev.Totals == nil || ev.Totals.FilesRebalanced != 3 {
+			t.Errorf("Expected the totals in the finish event, got %+v", ev)
+		}
+	}
+	if starts != 1 {
+		t.Errorf("Expected the start event to go to the first webhook only, got %d", starts)
+	}
+}
+
+func TestNotifierFailures(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		switch req.URL.Path {
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	opts := Options{Retries: 2, Backoff: time.Millisecond, Timeout: 50 * time.Millisecond, Logger: logger}
+
+	for _, tc := range []struct {
+		path     string
+		attempts int32
+	}{
+		{"/down?token=secret", 3}, // retried twice
+		{"/bad", 1},               // client errors are not retried
+		{"/slow", 3},              // timeouts are
+	} {
+		attempts.Store(0)
+		hook.Reset()
+		n := New([]Webhook{{URL: srv.URL + tc.path}}, opts)
+		n.Notify(Event{Event: EventFailure})
+		n.Close()
+		if got := attempts.Load(); got != tc.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", tc.path, tc.attempts, got)
+		}
+		last := hook.LastEntry()
+		if last == nil || last.Level != logrus.ErrorLevel {
+			t.Errorf("%s: expected the failure to be logged as an error", tc.path)
+		} else if tc.path == "/down?token=secret" && last.Message != "Webhook "+srv.URL+"/down?...: cannot post the failure event: HTTP status 500 Internal Server Error" {
+			t.Errorf("Unexpected message %q", last.Message)
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	if events, err := ParseEvents("all"); err != nil || events != nil {
+		t.Errorf("Expected all events, got %v, %v", events, err)
+	}
+	events, err := ParseEvents("finish, error-threshold")
+	if err != nil || len(events) != 2 || !events[EventFinish] || !events[EventErrorThreshold] {
+		t.Errorf("Unexpected events %v, %v", events, err)
+	}
+	for _, bad := range []string{"", "finish,done"} {
+		if _, err := ParseEvents(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix && !windows
+// +build !unix,!windows
+
+package ratelimit
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile is not implemented on this platform
+func lockFile(f *os.File) error {
+	return errors.New("file locking is not available on this platform")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
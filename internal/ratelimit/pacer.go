@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Pacer holds writers back while a gauge of write pressure, such as the amount of dirty
+// data waiting for writeback, is high. Writers pause once the gauge reaches High of its
+// limit and resume when it drops below Low, so the backlog drains instead of making
+// every writer on the system stall together.
+type Pacer struct {
+	// Sample returns the current level of the gauge and its limit
+	Sample func() (level, limit uint64, err error)
+	// High and Low are fractions of the limit
+	High, Low float64
+	// Interval is how often the gauge is sampled and a paused writer checks it again
+	Interval time.Duration
+	// MaxPause bounds a single pause, so a gauge stuck high only slows writers down
+	MaxPause time.Duration
+
+	mu         sync.Mutex
+	sampled    time.Time
+	pressured  bool
+	pauses     int64
+	pausedTime time.Duration
+
+	// now and sleep are replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Wait blocks while the gauge is high. The byte count is ignored.
+func (p *Pacer) Wait(n int) error {
+	now, sleep := p.now, p.sleep
+	if now == nil {
+		now = time.Now
+	}
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	start := now()
+	paused := false
+	for p.underPressure(now()) && now().Sub(start) < p.MaxPause {
+		paused = true
+		sleep(p.Interval)
+	}
+	if paused {
+		p.mu.Lock()
+		p.pauses++
+		p.pausedTime += now().Sub(start)
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// Stats returns how many times writers paused and for how long in total
+func (p *Pacer) Stats() (pauses int64, paused time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pauses, p.pausedTime
+}
+
+// underPressure samples the gauge at most once per interval. An unreadable gauge
+// never holds writers back.
+func (p *Pacer) underPressure(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.sampled.IsZero() && now.Sub(p.sampled) < p.Interval {
+		return p.pressured
+	}
+	p.sampled = now
+
+	level, limit, err := p.Sample()
+	if err != nil || limit == 0 {
+		p.pressured = false
+		return false
+	}
+	fill := float64(level) / float64(limit)
+	if p.pressured {
+		p.pressured = fill >= p.Low
+	} else {
+		p.pressured = fill >= p.High
+	}
+	return p.pressured
+}
@@ -0,0 +1,139 @@
+// Package ratelimit paces copies: a token bucket whose state lives in a small file, so
+// several processes can share one bandwidth budget, and a Pacer that holds writers back
+// while the system is under write pressure.
+package ratelimit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateSize is the length of the state file: rate, tokens and last refill time
+const stateSize = 24
+
+// burst is how many seconds of bandwidth may accumulate while the bucket is idle
+const burst = 1.0
+
+// SharedBucket is a token bucket stored in a file that every process using the same
+// path draws from. Access is serialized with an advisory lock on the file.
+type SharedBucket struct {
+	mu   sync.Mutex
+	file *os.File
+	rate float64 // bytes per second
+	now  func() time.Time
+	// sleep is replaced in tests
+	sleep func(time.Duration)
+}
+
+// StatePath returns the state file of the bucket for key (usually a pool name) in dir
+func StatePath(dir, key string) string {
+	return filepath.Join(dir, filepath.Base(filepath.Clean("/"+key))+".bucket")
+}
+
+// OpenShared opens or creates the bucket at path with the given rate in bytes per second.
+// The rate of the most recently opened instance applies to all of them; previousRate is
+// the rate stored by an earlier instance, 0 if there was none.
+func OpenShared(path string, bytesPerSec float64) (b *SharedBucket, previousRate float64, err error) {
+	if bytesPerSec <= 0 {
+		return nil, 0, errors.New("rate must be positive")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create bucket directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open bucket: %w", err)
+	}
+
+	b = &SharedBucket{file: f, rate: bytesPerSec, now: time.Now, sleep: time.Sleep}
+	err = b.locked(func(st *state) {
+		previousRate = st.rate
+		if st.rate == 0 {
+			// New bucket, start full
+			st.tokens = bytesPerSec * burst
+			st.last = b.now().UnixNano()
+		}
+		st.rate = bytesPerSec
+	})
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return b, previousRate, nil
+}
+
+// Close closes the state file; the bucket stays on disk for other processes
+func (b *SharedBucket) Close() error {
+	return b.file.Close()
+}
+
+// Wait takes n bytes from the bucket, sleeping until the shared rate allows them.
+// Tokens may go negative, so concurrent callers queue up behind each other's debt.
+func (b *SharedBucket) Wait(n int) error {
+	var wait time.Duration
+	err := b.locked(func(st *state) {
+		st.tokens -= float64(n)
+		if st.tokens < 0 {
+			wait = time.Duration(-st.tokens / st.rate * float64(time.Second))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		b.sleep(wait)
+	}
+	return nil
+}
+
+// state is the content of the bucket file
+type state struct {
+	rate   float64
+	tokens float64
+	last   int64 // UnixNano of the last refill
+}
+
+// locked refills the bucket and applies fn to its state under the file lock
+func (b *SharedBucket) locked(fn func(*state)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := lockFile(b.file); err != nil {
+		return fmt.Errorf("failed to lock bucket: %w", err)
+	}
+	defer unlockFile(b.file)
+
+	var buf [stateSize]byte
+	var st state
+	if n, _ := b.file.ReadAt(buf[:], 0); n == stateSize {
+		st.rate = math.Float64frombits(binary.LittleEndian.Uint64(buf[0:]))
+		st.tokens = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+		st.last = int64(binary.LittleEndian.Uint64(buf[16:]))
+	}
+
+	now := b.now().UnixNano()
+	if st.rate > 0 {
+		// The wall clock is the only one shared between processes. A step backwards
+		// refills nothing and a step forwards at most one burst.
+		if elapsed := now - st.last; elapsed > 0 {
+			st.tokens = math.Min(st.tokens+st.rate*float64(elapsed)/float64(time.Second), st.rate*burst)
+		}
+		st.last = now
+	}
+
+	fn(&st)
+
+	binary.LittleEndian.PutUint64(buf[0:], math.Float64bits(st.rate))
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(st.tokens))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(st.last))
+	if _, err := b.file.WriteAt(buf[:], 0); err != nil {
+		return fmt.Errorf("failed to update bucket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the bucket sleeps
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.slept += d
+	c.t = c.t.Add(d)
+}
+
+func openWithClock(t *testing.T, path string, rate float64, clock *fakeClock) *SharedBucket {
+	t.Helper()
+	b, _, err := OpenShared(path, rate)
+	if err != nil {
+		t.Fatalf("OpenShared failed: %v", err)
+	}
+	b.now, b.sleep = clock.now, clock.sleep
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestSharedBucket(t *testing.T) {
+	path := StatePath(t.TempDir(), "tank")
+	clock := &fakeClock{t: time.Now()}
+	const rate = 4 << 20
+
+	// Two instances on the same file stand in for two processes
+	a := openWithClock(t, path, rate, clock)
+	b := openWithClock(t, path, rate, clock)
+
+	// The initial burst is free...
+	if err := a.Wait(rate); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if clock.slept != 0 {
+		t.Errorf("Expected the burst not to wait, slept %s", clock.slept)
+	}
+
+	// ...after which both instances draw from the same budget
+	if err := b.Wait(rate / 4); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if err := a.Wait(rate / 4); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if clock.slept < 490*time.Millisecond || clock.slept > 510*time.Millisecond {
+		t.Errorf("Expected about 500ms of waiting for half a second of bandwidth, slept %s", clock.slept)
+	}
+}
+
+func TestOpenSharedRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.bucket")
+
+	a, previous, err := OpenShared(path, 100)
+	if err != nil {
+		t.Fatalf("OpenShared failed: %v", err)
+	}
+	defer a.Close()
+	if previous != 0 {
+		t.Errorf("Expected no previous rate for a new bucket, got %v", previous)
+	}
+
+	b, previous, err := OpenShared(path, 200)
+	if err != nil {
+		t.Fatalf("OpenShared failed: %v", err)
+	}
+	defer b.Close()
+	if previous != 100 {
+		t.Errorf("Expected the previous rate of 100, got %v", previous)
+	}
+
+	if _, _, err := OpenShared(path, 0); err == nil {
+		t.Errorf("Expected an error for a zero rate")
+	}
+}
+
+func TestStatePath(t *testing.T) {
+	if got := StatePath("/run/rebalance", "../tank/../x"); got != filepath.Join("/run/rebalance", "x.bucket") {
+		t.Errorf("Expected the key to stay inside the directory, got %s", got)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	// The dirty level drains by 10 per sampling interval while writers are paused
+	level := uint64(0)
+	p := &Pacer{
+		Sample:   func() (uint64, uint64, error) { return level, 100, nil },
+		High:     0.5,
+		Low:      0.25,
+		Interval: 100 * time.Millisecond,
+		MaxPause: time.Second,
+		now:      clock.now,
+		sleep: func(d time.Duration) {
+			clock.sleep(d)
+			level -= min(level, 10)
+		},
+	}
+
+	level = 40
+	p.Wait(1)
+	if clock.slept != 0 {
+		t.Fatalf("Expected no pause below the high mark, slept %s", clock.slept)
+	}
+
+	// Above the high mark writers wait until the level is below the low mark
+	clock.t = clock.t.Add(time.Second)
+	level = 60
+	p.Wait(1)
+	if level >= 25 || clock.slept != 400*time.Millisecond {
+		t.Errorf("Expected to resume below the low mark after 400ms, level %d after %s", level, clock.slept)
+	}
+
+	// A gauge that stays high only delays writers by MaxPause
+	clock.t = clock.t.Add(time.Second)
+	clock.slept = 0
+	p.sleep = clock.sleep
+	level = 90
+	p.Wait(1)
+	if clock.slept != time.Second {
+		t.Errorf("Expected a pause of MaxPause, got %s", clock.slept)
+	}
+	if pauses, paused := p.Stats(); pauses != 2 || paused != 1400*time.Millisecond {
+		t.Errorf("Expected 2 pauses of 1.4s in total, got %d of %s", pauses, paused)
+	}
+}
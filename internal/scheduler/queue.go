@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// queue hands tasks to workers while capping how many tasks from the same
+// group, and from the same pool, are processed at once. Groups are served
+// round robin so a group with many small tasks cannot starve one with a few
+// large tasks.
+type queue struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	limit      int
+	poolLimit  int
+	capacity   int
+	size       int
+	pending    map[uint64][]Task
+	order      []uint64
+	next       int
+	active     map[uint64]int
+	pools      map[uint64]string
+	poolActive map[string]int
+	closed     bool
+}
+
+// newQueue creates a queue allowing at most limit active tasks per group and poolLimit
+// per pool, and holding at most capacity pending tasks (0 = unlimited)
+func newQueue(limit, poolLimit, capacity int) *queue {
+	q := &queue{
+		limit:      limit,
+		poolLimit:  poolLimit,
+		capacity:   capacity,
+		pending:    make(map[uint64][]Task),
+		active:     make(map[uint64]int),
+		pools:      make(map[uint64]string),
+		poolActive: make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a task, blocking while the queue is full unless force is set
+func (q *queue) push(t Task, force bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !force && q.capacity > 0 && q.size >= q.capacity {
+		q.cond.Wait()
+	}
+	t.Queued = time.Now()
+	if _, ok := q.pending[t.Group]; !ok {
+		q.order = append(q.order, t.Group)
+		q.pools[t.Group] = t.Pool
+	}
+	q.pending[t.Group] = append(q.pending[t.Group], t)
+	q.size++
+	q.cond.Broadcast()
+}
+
+// close marks the end of input; pop returns false once the queue drains
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// pop blocks until a task from a group and pool below their limits is available.
+// It returns false when the queue is closed and empty, or once stop returns true; stop
+// is checked whenever the queue is woken.
+func (q *queue) pop(stop func() bool) (Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if stop != nil && stop() {
+			return Task{}, false
+		}
+		empty := true
+		for i := 0; i < len(q.order); i++ {
+			idx := (q.next + i) % len(q.order)
+			group := q.order[idx]
+			tasks := q.pending[group]
+			if len(tasks) == 0 {
+				continue
+			}
+			empty = false
+			if q.limit > 0 && q.active[group] >= q.limit {
+				continue
+			}
+			pool := q.pools[group]
+			if q.poolLimit > 0 && q.poolActive[pool] >= q.poolLimit {
+				continue
+			}
+
+			q.pending[group] = tasks[1:]
+			q.size--
+			q.active[group]++
+			q.poolActive[pool]++
+			q.next = idx + 1
+			// Wake producers waiting for room
+			q.cond.Broadcast()
+			return tasks[0], true
+		}
+
+		if empty && q.closed {
+			return Task{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// wake rechecks the stop condition of workers waiting in pop
+func (q *queue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// done releases the slot held by a task of the given group
+func (q *queue) done(group uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.active[group]--
+	q.poolActive[q.pools[group]]--
+	q.cond.Broadcast()
+}
@@ -0,0 +1,262 @@
+// Package scheduler runs tasks on a fixed pool of workers, with per-group and per-pool
+// concurrency limits, graceful and immediate cancellation, per-task timeouts and
+// recovery from panicking tasks. The number of workers can be changed while it runs.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Task is a unit of work, usually a file
+type Task struct {
+	// ID identifies the task, e.g. a file path
+	ID string
+	// Group and Pool are the units the concurrency limits apply to, e.g. a dataset and its pool
+	Group uint64
+	Pool  string
+	// Queued is when the task was pushed or last requeued, set by the scheduler so the
+	// handler can tell how long it waited for a worker
+	Queued time.Time
+}
+
+// Handler processes a task and records its outcome. Its context is canceled when the
+// scheduler's context is, or when the task exceeds Options.TaskTimeout.
+type Handler func(ctx context.Context, task Task)
+
+// Options configure a Scheduler
+type Options struct {
+	// Workers is the number of tasks processed concurrently, at least 1
+	Workers int
+	// GroupLimit and PoolLimit cap the active tasks per group and per pool, 0 = unlimited
+	GroupLimit int
+	PoolLimit  int
+	// QueueSize bounds the pending tasks; Push blocks while the queue is full. 0 = unlimited
+	QueueSize int
+	// TaskTimeout cancels the context of a task running longer than this, 0 = no timeout
+	TaskTimeout time.Duration
+	// Stopping is checked before each task is started; once it returns true no further
+	// task starts while running ones complete, for a graceful shutdown
+	Stopping func() bool
+	// OnPanic is called when a handler panics; the worker then carries on with the next
+	// task. Without it the panic is not recovered.
+	OnPanic func(task Task, err *PanicError)
+}
+
+// PanicError describes a recovered panic of a handler
+type PanicError struct {
+	Task  Task
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic while processing %s: %v", e.Task.ID, e.Value)
+}
+
+// Scheduler distributes tasks over a pool of workers
+type Scheduler struct {
+	opts  Options
+	queue *queue
+
+	// workers is the target number of workers and running the number started and not
+	// retired; start, set while Run is active, starts one more with mu held
+	mu      sync.Mutex
+	workers int
+	running int
+	start   func()
+}
+
+// New creates a scheduler; tasks can be pushed before and while it runs
+func New(opts Options) *Scheduler {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	return &Scheduler{
+		opts:    opts,
+		queue:   newQueue(opts.GroupLimit, opts.PoolLimit, opts.QueueSize),
+		workers: opts.Workers,
+	}
+}
+
+// SetWorkers changes the number of workers, at least 1. New workers start right away
+// while Run is active; surplus workers stop once they finish their current task.
+func (s *Scheduler) SetWorkers(n int) {
+	n = max(n, 1)
+	s.mu.Lock()
+	s.workers = n
+	for s.start != nil && s.running < s.workers {
+		s.running++
+		s.start()
+	}
+	s.mu.Unlock()
+	// Wake idle workers so surplus ones notice
+	s.queue.wake()
+}
+
+// Workers returns the number of workers the scheduler runs
+func (s *Scheduler) Workers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.workers
+}
+
+// retire reports whether a worker is surplus, in which case it must stop
+func (s *Scheduler) retire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running <= s.workers {
+		return false
+	}
+	s.running--
+	return true
+}
+
+// leave stops counting a worker that stops for another reason than retire
+func (s *Scheduler) leave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+}
+
+// rejoin counts a detached worker again if the pool is short of workers
+func (s *Scheduler) rejoin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.start == nil || s.running >= s.workers {
+		return false
+	}
+	s.running++
+	return true
+}
+
+// detachKey is the context key of the task a handler runs
+type detachKey struct{}
+
+// detachable is the task a handler runs, as seen by Detach
+type detachable struct {
+	s        *Scheduler
+	group    uint64
+	detached bool
+}
+
+// Detach frees the worker running the task of ctx, with the task's group and pool slots:
+// another worker takes its place, and the detached one stops once the handler returns,
+// unless the pool is short of workers by then. A handler detaches before waiting on
+// tasks that may still be queued, so they can run. Detach must be called from the
+// handler; it reports false if ctx is not the context of a task or was detached already.
+func Detach(ctx context.Context) bool {
+	d, ok := ctx.Value(detachKey{}).(*detachable)
+	if !ok || d.detached {
+		return false
+	}
+	d.detached = true
+	d.s.queue.done(d.group)
+
+	d.s.mu.Lock()
+	d.s.running--
+	for d.s.start != nil && d.s.running < d.s.workers {
+		d.s.running++
+		d.s.start()
+	}
+	d.s.mu.Unlock()
+	return true
+}
+
+// Push queues a task, blocking while a bounded queue is full
+func (s *Scheduler) Push(task Task) {
+	s.queue.push(task, false)
+}
+
+// Requeue puts a task back from within a handler. It never blocks, so a handler cannot
+// deadlock on a full queue that only the workers can drain.
+func (s *Scheduler) Requeue(task Task) {
+	s.queue.push(task, true)
+}
+
+// Close marks the end of input; Run returns once the queued tasks are processed
+func (s *Scheduler) Close() {
+	s.queue.close()
+}
+
+// Run processes tasks until the queue is closed and drained, ctx is canceled or
+// Options.Stopping returns true. Tasks not started by then stay unprocessed.
+func (s *Scheduler) Run(ctx context.Context, handle Handler) {
+	alive := 0
+	exited := sync.NewCond(&s.mu)
+	worker := func() {
+		defer func() {
+			s.mu.Lock()
+			alive--
+			exited.Broadcast()
+			s.mu.Unlock()
+		}()
+		for {
+			retired := false
+			task, ok := s.queue.pop(func() bool {
+				retired = s.retire()
+				return retired
+			})
+			if !ok {
+				if !retired {
+					s.leave()
+				}
+				return
+			}
+			if ctx.Err() != nil || (s.opts.Stopping != nil && s.opts.Stopping()) {
+				s.queue.done(task.Group)
+				s.leave()
+				return
+			}
+			if s.runTask(ctx, handle, task) {
+				// The slot was released and a replacement started by Detach
+				if !s.rejoin() {
+					return
+				}
+				continue
+			}
+			s.queue.done(task.Group)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = func() {
+		alive++
+		go worker()
+	}
+	for s.running < s.workers {
+		s.running++
+		s.start()
+	}
+	for alive > 0 {
+		exited.Wait()
+	}
+	s.start, s.running = nil, 0
+}
+
+// runTask calls the handler with the task's own context, recovering from panics. It
+// reports whether the handler detached from its worker.
+func (s *Scheduler) runTask(ctx context.Context, handle Handler, task Task) (detached bool) {
+	d := &detachable{s: s, group: task.Group}
+	ctx = context.WithValue(ctx, detachKey{}, d)
+	defer func() { detached = d.detached }()
+	if s.opts.TaskTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.TaskTimeout)
+		defer cancel()
+	}
+
+	if s.opts.OnPanic != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				s.opts.OnPanic(task, &PanicError{Task: task, Value: v, Stack: debug.Stack()})
+			}
+		}()
+	}
+	handle(ctx, task)
+	return
+}
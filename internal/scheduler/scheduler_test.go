@@ -0,0 +1,381 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueGroupLimit(t *testing.T) {
+	const limit = 2
+	q := newQueue(limit, 0, 0)
+	for i := 0; i < 20; i++ {
+		q.push(Task{ID: fmt.Sprintf("task-%d", i), Group: uint64(i % 2)}, false)
+	}
+	q.close()
+
+	var mu sync.Mutex
+	active := make(map[uint64]int)
+	maxActive := 0
+	popped := 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task, ok := q.pop(nil)
+				group := task.Group
+				if !ok {
+					return
+				}
+				mu.Lock()
+				active[group]++
+				popped++
+				if active[group] > maxActive {
+					maxActive = active[group]
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				active[group]--
+				mu.Unlock()
+				q.done(group)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if popped != 20 {
+		t.Errorf("Expected 20 tasks to be handed out, got %d", popped)
+	}
+	if maxActive > limit {
+		t.Errorf("Group limit %d exceeded: %d tasks active at once", limit, maxActive)
+	}
+}
+
+func TestQueuePoolLimit(t *testing.T) {
+	// Groups 0-2 are on tank, 3 on backup; tank may run 2 tasks at once, each group 1
+	q := newQueue(1, 2, 0)
+	pools := []string{"tank", "tank", "tank", "backup"}
+	for i := 0; i < 4; i++ {
+		q.push(Task{ID: fmt.Sprintf("task-%d", i), Group: uint64(i), Pool: pools[i]}, false)
+	}
+	q.close()
+
+	active := make(map[string]int)
+	var held []uint64
+	for i := 0; i < 3; i++ {
+		task, ok := q.pop(nil)
+		group := task.Group
+		if !ok {
+			t.Fatalf("Expected a task from a pool below its limit")
+		}
+		active[pools[group]]++
+		held = append(held, group)
+	}
+	if active["tank"] != 2 || active["backup"] != 1 {
+		t.Fatalf("Expected 2 tank tasks and 1 backup task, got %v", active)
+	}
+
+	// The third tank group waits until a tank slot is released
+	popped := make(chan uint64)
+	go func() {
+		task, _ := q.pop(nil)
+		popped <- task.Group
+	}()
+	select {
+	case group := <-popped:
+		t.Fatalf("Pool limit exceeded: group %d handed out", group)
+	case <-time.After(20 * time.Millisecond):
+	}
+	for _, group := range held {
+		if pools[group] == "tank" {
+			q.done(group)
+			break
+		}
+	}
+	if group := <-popped; pools[group] != "tank" {
+		t.Errorf("Expected the remaining tank task, got group %d", group)
+	}
+}
+
+func TestQueueCapacity(t *testing.T) {
+	q := newQueue(0, 0, 1)
+	q.push(Task{ID: "a"}, false)
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(Task{ID: "b"}, false)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatalf("Push into a full queue did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A forced push goes past the capacity
+	q.push(Task{ID: "c"}, true)
+
+	if _, ok := q.pop(nil); !ok {
+		t.Fatalf("Expected a task")
+	}
+	if _, ok := q.pop(nil); !ok {
+		t.Fatalf("Expected a task")
+	}
+	<-pushed
+}
+
+func TestRun(t *testing.T) {
+	s := New(Options{Workers: 4, QueueSize: 2})
+	go func() {
+		for i := 0; i < 50; i++ {
+			s.Push(Task{ID: fmt.Sprintf("task-%d", i), Group: uint64(i % 3)})
+		}
+		s.Close()
+	}()
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	s.Run(context.Background(), func(ctx context.Context, task Task) {
+		mu.Lock()
+		seen[task.ID]++
+		mu.Unlock()
+	})
+
+	if len(seen) != 50 {
+		t.Errorf("Expected 50 tasks to run, got %d", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("Task %s ran %d times", id, n)
+		}
+	}
+}
+
+func TestRunRequeue(t *testing.T) {
+	s := New(Options{Workers: 2, QueueSize: 1})
+	s.Push(Task{ID: "retry"})
+	s.Close()
+
+	var runs atomic.Int32
+	var last time.Time
+	s.Run(context.Background(), func(ctx context.Context, task Task) {
+		// Every push, including a requeue, restamps the task
+		if task.Queued.IsZero() || task.Queued.Before(last) || task.Queued.After(time.Now()) {
+			t.Errorf("Unexpected queue time %v, previous %v", task.Queued, last)
+		}
+		last = task.Queued
+		if runs.Add(1) < 3 {
+			s.Requeue(task)
+		}
+	})
+	if n := runs.Load(); n != 3 {
+		t.Errorf("Expected the task to run 3 times, got %d", n)
+	}
+}
+
+func TestRunStopping(t *testing.T) {
+	var stop atomic.Bool
+	s := New(Options{Workers: 1, Stopping: stop.Load})
+	for i := 0; i < 10; i++ {
+		s.Push(Task{ID: fmt.Sprintf("task-%d", i)})
+	}
+	s.Close()
+
+	var runs int
+	s.Run(context.Background(), func(ctx context.Context, task Task) {
+		runs++
+		if runs == 3 {
+			stop.Store(true)
+		}
+	})
+	if runs != 3 {
+		t.Errorf("Expected 3 tasks before stopping, got %d", runs)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(Options{Workers: 2})
+	for i := 0; i < 10; i++ {
+		s.Push(Task{ID: fmt.Sprintf("task-%d", i)})
+	}
+	s.Close()
+
+	var runs atomic.Int32
+	s.Run(ctx, func(ctx context.Context, task Task) {
+		runs.Add(1)
+		cancel()
+		<-ctx.Done()
+	})
+	if n := runs.Load(); n > 2 {
+		t.Errorf("Expected no new tasks after cancellation, got %d runs", n)
+	}
+}
+
+func TestRunTaskTimeout(t *testing.T) {
+	s := New(Options{TaskTimeout: 10 * time.Millisecond})
+	s.Push(Task{ID: "slow"})
+	s.Push(Task{ID: "fast"})
+	s.Close()
+
+	results := make(map[string]error)
+	s.Run(context.Background(), func(ctx context.Context, task Task) {
+		if task.ID == "slow" {
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		results[task.ID] = ctx.Err()
+	})
+	if results["slow"] != context.DeadlineExceeded {
+		t.Errorf("Expected the slow task to time out, got %v", results["slow"])
+	}
+	if results["fast"] != nil {
+		t.Errorf("Expected the fast task to get a fresh deadline, got %v", results["fast"])
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	var mu sync.Mutex
+	var panics []*PanicError
+	s := New(Options{
+		Workers: 2,
+		OnPanic: func(task Task, err *PanicError) {
+			mu.Lock()
+			panics = append(panics, err)
+			mu.Unlock()
+		},
+	})
+	for i := 0; i < 6; i++ {
+		s.Push(Task{ID: fmt.Sprintf("task-%d", i)})
+	}
+	s.Close()
+
+	var runs atomic.Int32
+	s.Run(context.Background(), func(ctx context.Context, task Task) {
+		runs.Add(1)
+		if task.ID == "task-2" {
+			panic("boom")
+		}
+	})
+
+	if n := runs.Load(); n != 6 {
+		t.Errorf("Expected the workers to carry on after a panic, got %d runs", n)
+	}
+	if len(panics) != 1 {
+		t.Fatalf("Expected 1 panic, got %d", len(panics))
+	}
+	if panics[0].Task.ID != "task-2" || panics[0].Value != "boom" || len(panics[0].Stack) == 0 {
+		t.Errorf("Unexpected panic error: %v", panics[0])
+	}
+}
+
+func TestRunSetWorkers(t *testing.T) {
+	s := New(Options{Workers: 1})
+	for i := 0; i < 20; i++ {
+		s.Push(Task{ID: fmt.Sprintf("task-%d", i)})
+	}
+	s.Close()
+
+	var active, peakAfterShrink atomic.Int32
+	var shrunk atomic.Bool
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(context.Background(), func(ctx context.Context, task Task) {
+			n := active.Add(1)
+			defer active.Add(-1)
+			if shrunk.Load() && n > peakAfterShrink.Load() {
+				peakAfterShrink.Store(n)
+			}
+			<-release
+		})
+	}()
+
+	waitFor := func(n int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for active.Load() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d active tasks, got %d", n, active.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(1)
+	s.SetWorkers(3)
+	if s.Workers() != 3 {
+		t.Errorf("Expected 3 workers, got %d", s.Workers())
+	}
+	waitFor(3)
+
+	// Surplus workers stop after their current task
+	s.SetWorkers(1)
+	shrunk.Store(true)
+	close(release)
+	<-done
+	if n := peakAfterShrink.Load(); n != 1 {
+		t.Errorf("Expected 1 task at a time after shrinking, saw %d", n)
+	}
+}
+
+func TestRunDetach(t *testing.T) {
+	// One worker per group: the waiting tasks only finish if detaching frees the slots
+	s := New(Options{Workers: 1, GroupLimit: 1})
+	for i := 0; i < 3; i++ {
+		s.Push(Task{ID: fmt.Sprintf("wait-%d", i)})
+	}
+	s.Push(Task{ID: "release"})
+	s.Close()
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	var requeued bool
+	s.Run(context.Background(), func(ctx context.Context, task Task) {
+		if task.ID == "release" {
+			close(release)
+			return
+		}
+		if task.ID == "late" {
+			mu.Lock()
+			order = append(order, task.ID)
+			mu.Unlock()
+			return
+		}
+		if !Detach(ctx) || Detach(ctx) {
+			t.Errorf("Expected %s to detach once", task.ID)
+		}
+		<-release
+		mu.Lock()
+		order = append(order, task.ID)
+		// A task requeued by a detached handler after the queue drained still runs
+		if !requeued {
+			requeued = true
+			s.Requeue(Task{ID: "late"})
+		}
+		mu.Unlock()
+	})
+
+	sort.Strings(order)
+	if strings.Join(order, " ") != "late wait-0 wait-1 wait-2" {
+		t.Errorf("Expected the 3 waiting tasks and the requeued one, got %v", order)
+	}
+	if Detach(context.Background()) {
+		t.Error("Expected Detach to fail outside a task")
+	}
+}
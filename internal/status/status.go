@@ -0,0 +1,235 @@
+// Package status serves the state of a rebalance over HTTP: a JSON snapshot at
+// /api/status and a single-page dashboard at / that polls it, showing progress, a
+// throughput graph, per-dataset totals and the latest errors. The server is read-only
+// and unauthenticated; bind it to localhost or a trusted network.
+package status
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Snapshot is the state of a run at one point in time
+type Snapshot struct {
+	Title string `json:"title"`
+	// State is one of the State constants
+	State string `json:"state"`
+	// Pass and Passes number the current pass; Done of Total files of it are finished,
+	// BytesDone of BytesTotal bytes. ETASeconds is the time left at BytesPerSecond, the
+	// throughput of the last few minutes; 0 when unknown.
+	Pass            int     `json:"pass"`
+	Passes          int     `json:"passes"`
+	Done            int64   `json:"done"`
+	Total           int64   `json:"total"`
+	BytesDone       int64   `json:"bytes_done"`
+	BytesTotal      int64   `json:"bytes_total"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+	ETASeconds      float64 `json:"eta_seconds"`
+	FilesRebalanced int64   `json:"files_rebalanced"`
+	FilesSkipped    int64   `json:"files_skipped"`
+	FilesFailed     int64   `json:"files_failed"`
+	BytesRebalanced int64   `json:"bytes_rebalanced"`
+	ElapsedSeconds  float64 `json:"elapsed_seconds"`
+	Concurrency     int     `json:"concurrency"`
+	// SkippedBy breaks FilesSkipped down by reason, such as "pass-limit" or "in-use"
+	SkippedBy map[string]int64 `json:"files_skipped_by,omitempty"`
+	// ARC is the state of the ZFS ARC, nil where it cannot be read
+	ARC *ARC `json:"arc,omitempty"`
+
+	Workers  []Worker  `json:"workers"`
+	Datasets []Dataset `json:"datasets"`
+	// Errors holds the latest errors, oldest first
+	Errors []string `json:"errors"`
+	// Throughput is filled in by the server from the samples it took of BytesRebalanced
+	Throughput []Sample `json:"throughput"`
+}
+
+// States of a Snapshot
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StatePaused   = "paused"
+	StateStopping = "stopping"
+	StateIdle     = "idle"
+	StateFinished = "finished"
+)
+
+// Worker is the file one worker is rebalancing
+type Worker struct {
+	Path           string  `json:"path"`
+	Stage          string  `json:"stage"`
+	Size           int64   `json:"size"`
+	Copied         int64   `json:"copied"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// ARC is the state of the ZFS adaptive replacement cache. HitRatio and GhostShare cover
+// the last few seconds, RunHitRatio the time since the first run started.
+type ARC struct {
+	Bytes       uint64  `json:"bytes"`
+	MaxBytes    uint64  `json:"max_bytes"`
+	HitRatio    float64 `json:"hit_ratio"`
+	RunHitRatio float64 `json:"run_hit_ratio"`
+	GhostShare  float64 `json:"ghost_share"`
+	Thrashing   bool    `json:"thrashing"`
+	// Throttled is how many workers --arc-throttle holds back
+	Throttled int `json:"throttled"`
+}
+
+// Dataset holds the totals of the files of one dataset
+type Dataset struct {
+	Name            string `json:"name"`
+	FilesRebalanced int64  `json:"files_rebalanced"`
+	BytesRebalanced int64  `json:"bytes_rebalanced"`
+	FilesSkipped    int64  `json:"files_skipped"`
+	FilesFailed     int64  `json:"files_failed"`
+}
+
+// Sample is the average rewrite rate over the interval ending at Time
+type Sample struct {
+	Time           time.Time `json:"time"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+}
+
+//go:embed index.html
+var indexHTML []byte
+
+// Server serves snapshots taken by a source function
+type Server struct {
+	source   func() Snapshot
+	interval time.Duration
+
+	mu      sync.Mutex
+	history history
+}
+
+// NewServer serves the snapshots returned by source, which must be safe to call from
+// several goroutines. The throughput graph samples it every interval.
+func NewServer(source func() Snapshot, interval time.Duration) *Server {
+	return &Server{
+		source:   source,
+		interval: interval,
+		history:  newHistory(maxSamples, interval),
+	}
+}
+
+// maxSamples bounds the throughput history. Once it is full, neighboring samples are
+// merged, so a multi-day run is still covered from its start at a coarser resolution.
+const maxSamples = 720
+
+// Handler returns the handler of the dashboard and the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(indexHTML)
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, req *http.Request) {
+		snap := s.source()
+		s.mu.Lock()
+		snap.Throughput = s.history.list()
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(snap)
+	})
+	return mux
+}
+
+// Serve samples the throughput and serves HTTP on ln until ctx is done
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.sample(now)
+			case <-ctx.Done():
+				shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = srv.Shutdown(shutdown)
+				return
+			}
+		}
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// sample records the bytes rebalanced so far for the throughput graph
+func (s *Server) sample(now time.Time) {
+	bytes := s.source().BytesRebalanced
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history.add(now, bytes)
+}
+
+// history turns readings of a byte counter, taken every step, into rates. Each sample
+// covers span; once limit samples are kept, pairs are merged and span doubles.
+type history struct {
+	limit int
+	step  time.Duration
+	span  time.Duration
+
+	samples  []Sample
+	last     int64
+	started  bool
+	readings int   // taken since the last sample
+	bytes    int64 // written since the last sample
+}
+
+// newHistory keeps up to limit samples of readings taken every step
+func newHistory(limit int, step time.Duration) history {
+	return history{limit: max(limit, 2), step: step, span: step}
+}
+
+// add takes a reading of the counter. A counter lower than the last reading was reset,
+// e.g. by a new run in daemon mode, and counts from zero.
+func (h *history) add(now time.Time, counter int64) {
+	delta := counter - h.last
+	if delta < 0 {
+		delta = counter
+	}
+	h.last = counter
+	if !h.started {
+		h.started = true
+		return
+	}
+
+	h.bytes += delta
+	h.readings++
+	if time.Duration(h.readings)*h.step < h.span {
+		return
+	}
+	h.samples = append(h.samples, Sample{Time: now, BytesPerSecond: float64(h.bytes) / h.span.Seconds()})
+	h.bytes, h.readings = 0, 0
+
+	if len(h.samples) >= h.limit {
+		merged := h.samples[:0]
+		for i := 0; i+1 < len(h.samples); i += 2 {
+			a, b := h.samples[i], h.samples[i+1]
+			merged = append(merged, Sample{Time: b.Time, BytesPerSecond: (a.BytesPerSecond + b.BytesPerSecond) / 2})
+		}
+		h.samples = merged
+		h.span *= 2
+	}
+}
+
+// list returns a copy of the samples, oldest first
+func (h *history) list() []Sample {
+	return append([]Sample{}, h.samples...)
+}
@@ -0,0 +1,85 @@
+package status
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	srv := NewServer(func() Snapshot {
+		return Snapshot{
+			Title:           "/tank/data",
+			State:           StateRunning,
+			BytesRebalanced: 4096,
+			Datasets:        []Dataset{{Name: "tank/data", FilesRebalanced: 2}},
+		}
+	}, time.Second)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv.sample(start)
+	srv.sample(start.Add(time.Second))
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("GET /api/status failed: %v", err)
+	}
+	defer res.Body.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(res.Body).Decode(&snap); err != nil {
+		t.Fatalf("Cannot decode the status: %v", err)
+	}
+	if snap.State != StateRunning || snap.Title != "/tank/data" || len(snap.Datasets) != 1 || len(snap.Throughput) != 1 {
+		t.Errorf("Unexpected status %+v", snap)
+	}
+
+	res, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("GET / failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "api/status") {
+		t.Errorf("Expected the dashboard page, got %d", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "/nothing")
+	if err != nil {
+		t.Fatalf("GET /nothing failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown path, got %d", res.StatusCode)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(4, time.Second)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	counter := int64(0)
+	for i := 0; i <= 4; i++ {
+		h.add(start.Add(time.Duration(i)*time.Second), counter)
+		counter += 100 * int64(i+1)
+	}
+	// Rates of 100, 200, 300 and 400 B/s, merged into two samples once four are kept
+	got := h.list()
+	if len(got) != 2 || got[0].BytesPerSecond != 150 || got[1].BytesPerSecond != 350 || h.span != 2*time.Second {
+		t.Fatalf("Unexpected merged history %+v, span %s", got, h.span)
+	}
+
+	// Samples now cover two readings; a reset counter counts from zero
+	h.add(start.Add(5*time.Second), 1000)
+	if len(h.list()) != 2 {
+		t.Fatalf("Expected no sample after one reading of a two second span, got %+v", h.list())
+	}
+	h.add(start.Add(6*time.Second), 200)
+	if got := h.list(); len(got) != 3 || got[2].BytesPerSecond != 100 {
+		t.Errorf("Unexpected history after a reset %+v", got)
+	}
+}
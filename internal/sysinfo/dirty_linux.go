@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DirtyPages returns the page cache data waiting for or under writeback, and the dirty
+// limit at which the kernel throttles writers: vm.dirty_bytes, or vm.dirty_ratio percent
+// of the available memory
+func DirtyPages() (dirty, limit uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	meminfo, err := parseMeminfo(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	dirty = meminfo["Dirty"] + meminfo["Writeback"]
+
+	if limit, err := readProcUint("/proc/sys/vm/dirty_bytes"); err == nil && limit > 0 {
+		return dirty, limit, nil
+	}
+	ratio, err := readProcUint("/proc/sys/vm/dirty_ratio")
+	if err != nil {
+		return 0, 0, err
+	}
+	return dirty, meminfo["MemAvailable"] * ratio / 100, nil
+}
+
+// parseMeminfo returns the fields of /proc/meminfo in bytes
+func parseMeminfo(r io.Reader) (map[string]uint64, error) {
+	fields := make(map[string]uint64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		unit := uint64(1)
+		if v, found := strings.CutSuffix(value, " kB"); found {
+			value, unit = v, 1024
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		fields[key] = n * unit
+	}
+	return fields, scanner.Err()
+}
+
+// readProcUint reads a file holding a single unsigned integer
+func readProcUint(path string) (uint64, error) {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %w", path, err)
+	}
+	return n, nil
+}
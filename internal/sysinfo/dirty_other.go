@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sysinfo
+
+import "errors"
+
+// DirtyPages is not implemented on this platform
+func DirtyPages() (dirty, limit uint64, err error) {
+	return 0, 0, errors.New("dirty page levels are not available on this platform")
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SelfIO returns the I/O counters of the current process from /proc/self/io and getrusage
+func SelfIO() (IOCounters, error) {
+	var counters IOCounters
+
+	f, err := os.Open("/proc/self/io")
+	if err != nil {
+		return counters, fmt.Errorf("failed to open /proc/self/io: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "rchar":
+			counters.ReadChars = n
+		case "wchar":
+			counters.WriteChars = n
+		case "syscr":
+			counters.ReadSyscalls = n
+		case "syscw":
+			counters.WriteSyscalls = n
+		case "read_bytes":
+			counters.ReadBytes = n
+		case "write_bytes":
+			counters.WriteBytes = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return counters, fmt.Errorf("failed to read /proc/self/io: %w", err)
+	}
+
+	var usage unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &usage); err == nil {
+		counters.BlockInputOps = uint64(usage.Inblock)
+		counters.BlockOutputOps = uint64(usage.Oublock)
+	}
+
+	return counters, nil
+}
@@ -0,0 +1,23 @@
+//go:build unix && !linux
+// +build unix,!linux
+
+package sysinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// SelfIO returns the block I/O operation counts of the current process from getrusage
+func SelfIO() (IOCounters, error) {
+	var usage unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &usage); err != nil {
+		return IOCounters{}, fmt.Errorf("getrusage failed: %w", err)
+	}
+
+	return IOCounters{
+		BlockInputOps:  uint64(usage.Inblock),
+		BlockOutputOps: uint64(usage.Oublock),
+	}, nil
+}
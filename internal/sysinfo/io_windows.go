@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package sysinfo
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetProcessIoCounters = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetProcessIoCounters")
+
+// SelfIO returns the I/O counters of the current process from GetProcessIoCounters
+func SelfIO() (IOCounters, error) {
+	var counters windows.IO_COUNTERS
+	ret, _, err := procGetProcessIoCounters.Call(uintptr(windows.CurrentProcess()), uintptr(unsafe.Pointer(&counters)))
+	if ret == 0 {
+		return IOCounters{}, err
+	}
+
+	return IOCounters{
+		ReadChars:     counters.ReadTransferCount,
+		WriteChars:    counters.WriteTransferCount,
+		ReadSyscalls:  counters.ReadOperationCount,
+		WriteSyscalls: counters.WriteOperationCount,
+	}, nil
+}
@@ -0,0 +1,24 @@
+//go:build darwin || freebsd || dragonfly || netbsd || openbsd
+// +build darwin freebsd dragonfly netbsd openbsd
+
+package sysinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// TotalMemory returns the physical memory of the system in bytes
+func TotalMemory() (uint64, error) {
+	// macOS names it hw.memsize, NetBSD and OpenBSD hw.physmem64, FreeBSD hw.physmem
+	var lastErr error
+	for _, name := range []string{"hw.memsize", "hw.physmem64", "hw.physmem"} {
+		mem, err := unix.SysctlUint64(name)
+		if err == nil && mem > 0 {
+			return mem, nil
+		}
+		lastErr = err
+	}
+	return 0, fmt.Errorf("sysctl failed: %w", lastErr)
+}
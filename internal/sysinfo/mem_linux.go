@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package sysinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// TotalMemory returns the physical memory of the system in bytes
+func TotalMemory() (uint64, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, fmt.Errorf("sysinfo failed: %w", err)
+	}
+	return uint64(info.Totalram) * uint64(info.Unit), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd,!windows
+
+package sysinfo
+
+import "errors"
+
+// TotalMemory is not implemented on this platform
+func TotalMemory() (uint64, error) {
+	return 0, errors.New("total memory is not available on this platform")
+}
@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package sysinfo
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// memoryStatusEx mirrors MEMORYSTATUSEX
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// TotalMemory returns the physical memory of the system in bytes
+func TotalMemory() (uint64, error) {
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+	ret, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
+		return 0, err
+	}
+	return status.TotalPhys, nil
+}
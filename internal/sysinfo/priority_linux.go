@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package sysinfo
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set arguments from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// LowerPriority gives the process the lowest CPU priority and the idle I/O scheduling
+// class, and reports whether it got the latter. Both are set per thread on Linux, so every
+// thread of the process is changed; threads started later inherit them from their parent.
+func LowerPriority() (idleIO bool, err error) {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return false, err
+	}
+	idleIO = true
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, 19); err != nil {
+			return false, fmt.Errorf("cannot lower the CPU priority: %w", err)
+		}
+		// The idle class is only honored by I/O schedulers that support it, such as BFQ
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift); errno != 0 {
+			idleIO = false
+		}
+	}
+	return idleIO, nil
+}
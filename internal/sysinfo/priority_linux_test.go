@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package sysinfo
+
+import (
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLowerPriority(t *testing.T) {
+	idleIO, err := LowerPriority()
+	if err != nil {
+		t.Skipf("Cannot lower the priority: %v", err)
+	}
+	if !idleIO {
+		t.Skip("Idle I/O class unavailable")
+	}
+
+	// Whichever thread runs the goroutine has the class
+	done := make(chan uintptr)
+	go func() {
+		runtime.LockOSThread()
+		prio, _, _ := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(unix.Gettid()), 0)
+		done <- prio
+	}()
+	if prio := <-done; prio>>ioprioClassShift != ioprioClassIdle {
+		t.Errorf("Expected the idle I/O class, got priority %#x", prio)
+	}
+}
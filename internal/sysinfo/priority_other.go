@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+// +build !unix,!windows
+
+package sysinfo
+
+import "errors"
+
+// LowerPriority is not implemented on this platform
+func LowerPriority() (idleIO bool, err error) {
+	return false, errors.New("process priorities are not available on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build unix && !linux
+// +build unix,!linux
+
+package sysinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// LowerPriority gives the process the lowest CPU priority. There is no idle I/O
+// scheduling class to set on this platform.
+func LowerPriority() (idleIO bool, err error) {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, 0, 19); err != nil {
+		return false, fmt.Errorf("cannot lower the CPU priority: %w", err)
+	}
+	return false, nil
+}
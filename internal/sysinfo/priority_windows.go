@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package sysinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// LowerPriority puts the process in background mode, which lowers its CPU, I/O and memory
+// priority
+func LowerPriority() (idleIO bool, err error) {
+	if err := windows.SetPriorityClass(windows.CurrentProcess(), windows.PROCESS_MODE_BACKGROUND_BEGIN); err != nil {
+		return false, fmt.Errorf("cannot enter background mode: %w", err)
+	}
+	return true, nil
+}
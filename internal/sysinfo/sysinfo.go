@@ -0,0 +1,33 @@
+// Package sysinfo reads process and system statistics used for run reporting.
+package sysinfo
+
+// IOCounters holds the I/O performed by the current process.
+// Fields that the platform cannot report are left at zero.
+type IOCounters struct {
+	// ReadChars and WriteChars count bytes passed to read and write syscalls
+	ReadChars  uint64
+	WriteChars uint64
+	// ReadSyscalls and WriteSyscalls count read and write syscalls
+	ReadSyscalls  uint64
+	WriteSyscalls uint64
+	// ReadBytes and WriteBytes count bytes fetched from or sent to the storage layer
+	ReadBytes  uint64
+	WriteBytes uint64
+	// BlockInputOps and BlockOutputOps count block I/O operations from getrusage
+	BlockInputOps  uint64
+	BlockOutputOps uint64
+}
+
+// Sub returns the counters accumulated since prev.
+func (c IOCounters) Sub(prev IOCounters) IOCounters {
+	return IOCounters{
+		ReadChars:      c.ReadChars - prev.ReadChars,
+		WriteChars:     c.WriteChars - prev.WriteChars,
+		ReadSyscalls:   c.ReadSyscalls - prev.ReadSyscalls,
+		WriteSyscalls:  c.WriteSyscalls - prev.WriteSyscalls,
+		ReadBytes:      c.ReadBytes - prev.ReadBytes,
+		WriteBytes:     c.WriteBytes - prev.WriteBytes,
+		BlockInputOps:  c.BlockInputOps - prev.BlockInputOps,
+		BlockOutputOps: c.BlockOutputOps - prev.BlockOutputOps,
+	}
+}
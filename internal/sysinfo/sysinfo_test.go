@@ -0,0 +1,69 @@
+package sysinfo
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSelfIO(t *testing.T) {
+	before, err := SelfIO()
+	if err != nil {
+		t.Skipf("Process I/O counters unavailable: %v", err)
+	}
+
+	// Generate some I/O
+	tempDir, err := os.MkdirTemp("", "sysinfo_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "data.bin")
+	if err := os.WriteFile(path, make([]byte, 64*1024), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if _, err := os.ReadFile(path); err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+
+	after, err := SelfIO()
+	if err != nil {
+		t.Fatalf("SelfIO failed on second call: %v", err)
+	}
+
+	delta := after.Sub(before)
+	if runtime.GOOS == "linux" {
+		if delta.ReadChars < 64*1024 {
+			t.Errorf("Expected at least 64KB read, got %d", delta.ReadChars)
+		}
+		if delta.WriteChars < 64*1024 {
+			t.Errorf("Expected at least 64KB written, got %d", delta.WriteChars)
+		}
+		if delta.ReadSyscalls == 0 || delta.WriteSyscalls == 0 {
+			t.Errorf("Expected read and write syscalls to be counted, got %d/%d", delta.ReadSyscalls, delta.WriteSyscalls)
+		}
+	}
+}
+
+func TestTotalMemory(t *testing.T) {
+	mem, err := TotalMemory()
+	if err != nil {
+		t.Skipf("Total memory unavailable: %v", err)
+	}
+	// Any machine running the tests has more than 64 MB
+	if mem < 64<<20 {
+		t.Errorf("Implausible total memory: %d bytes", mem)
+	}
+}
+
+func TestDirtyPages(t *testing.T) {
+	dirty, limit, err := DirtyPages()
+	if err != nil {
+		t.Skipf("Dirty page levels unavailable: %v", err)
+	}
+	if limit == 0 {
+		t.Errorf("Expected a dirty limit, got 0 with %d bytes dirty", dirty)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package tui
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnsupported is returned by Open where the dashboard cannot drive the terminal
+var ErrUnsupported = errors.New("the terminal UI is not supported on this platform")
+
+// Terminal is a terminal showing the dashboard; it cannot be opened on this platform
+type Terminal struct{}
+
+// Open returns ErrUnsupported
+func Open(in, out *os.File) (*Terminal, error) {
+	return nil, ErrUnsupported
+}
+
+// Keys delivers the keys pressed, one byte each
+func (t *Terminal) Keys() <-chan byte { return nil }
+
+// Size returns the width and height of the terminal
+func (t *Terminal) Size() (width, height int) { return 80, 24 }
+
+// Draw replaces the screen with lines
+func (t *Terminal) Draw(lines []string) {}
+
+// Close restores the terminal
+func (t *Terminal) Close() error { return nil }
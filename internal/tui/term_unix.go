@@ -0,0 +1,101 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package tui
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Terminal is a terminal showing the dashboard on its alternate screen
+type Terminal struct {
+	in, out *os.File
+	saved   unix.Termios
+	keys    chan byte
+}
+
+// Open switches the terminal of in and out to cbreak mode, without echo, and to its
+// alternate screen, so the scrollback is left as it was. It fails if either is not a
+// terminal. Close restores the terminal.
+func Open(in, out *os.File) (*Terminal, error) {
+	saved, err := unix.IoctlGetTermios(int(in.Fd()), ioctlGetTermios)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a terminal: %w", in.Name(), err)
+	}
+	if _, err := unix.IoctlGetWinsize(int(out.Fd()), unix.TIOCGWINSZ); err != nil {
+		return nil, fmt.Errorf("%s is not a terminal: %w", out.Name(), err)
+	}
+
+	cbreak := *saved
+	cbreak.Lflag &^= unix.ICANON | unix.ECHO
+	cbreak.Cc[unix.VMIN] = 1
+	cbreak.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(int(in.Fd()), ioctlSetTermios, &cbreak); err != nil {
+		return nil, fmt.Errorf("cannot set up the terminal: %w", err)
+	}
+
+	t := &Terminal{in: in, out: out, saved: *saved, keys: make(chan byte, 16)}
+	// Alternate screen, cursor hidden
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	go t.readKeys()
+	return t, nil
+}
+
+// readKeys forwards key presses until input ends. A read cannot be interrupted, so the
+// goroutine outlives Close until the next key or the end of the process.
+func (t *Terminal) readKeys() {
+	r := bufio.NewReader(t.in)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			close(t.keys)
+			return
+		}
+		select {
+		case t.keys <- b:
+		default:
+			// Drop keys nobody reads, e.g. after Close
+		}
+	}
+}
+
+// Keys delivers the keys pressed, one byte each
+func (t *Terminal) Keys() <-chan byte {
+	return t.keys
+}
+
+// Size returns the width and height of the terminal
+func (t *Terminal) Size() (width, height int) {
+	ws, err := unix.IoctlGetWinsize(int(t.out.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// Draw replaces the screen with lines, which must fit its width
+func (t *Terminal) Draw(lines []string) {
+	var b strings.Builder
+	// Overwrite in place rather than clearing first, which flickers
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprint(t.out, b.String())
+}
+
+// Close leaves the alternate screen and restores the terminal mode
+func (t *Terminal) Close() error {
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	return unix.IoctlSetTermios(int(t.in.Fd()), ioctlSetTermios, &t.saved)
+}
@@ -0,0 +1,241 @@
+// Package tui draws a live dashboard of a rebalance run on a terminal: progress of the
+// pass, what each worker is doing, and the latest errors. It uses plain ANSI escape
+// sequences and puts the terminal in cbreak mode, so single key presses can drive the
+// run; Ctrl-C still raises SIGINT.
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+	"github.com/sirupsen/logrus"
+)
+
+// State is what the dashboard shows
+type State struct {
+	// Title names the run, e.g. the paths being rebalanced
+	Title string
+	// Pass and Passes number the current pass; Done of Total files of it are finished,
+	// BytesDone of BytesTotal bytes. ETA is the time left at Rate, 0 when unknown.
+	Pass, Passes          int
+	Done, Total           int64
+	BytesDone, BytesTotal int64
+	Rate                  float64
+	ETA                   time.Duration
+	// Rebalanced, Skipped and Failed count files over all passes, Bytes the data rewritten
+	Rebalanced, Skipped, Failed int64
+	Bytes                       int64
+	Elapsed                     time.Duration
+	// Paused and Stopping describe the state of the run
+	Paused, Stopping bool
+	Concurrency      int
+	Workers          []Worker
+	// Errors holds the latest errors, oldest first
+	Errors []string
+	Units  units.Units
+}
+
+// Worker is the file one worker is rebalancing
+type Worker struct {
+	Path  string
+	Stage string
+	// Size is the size of the file and Copied how much of it was written
+	Size, Copied int64
+	// Speed is the average copy rate of the file in bytes per second
+	Speed float64
+}
+
+// Keys lists the key bindings shown at the bottom of the dashboard
+const Keys = "p pause/resume   +/- workers   q finish files in progress and quit"
+
+// minBarWidth is the narrowest progress bar drawn
+const minBarWidth = 10
+
+// Render lays the dashboard out in at most height lines of at most width columns
+func Render(s State, width, height int) []string {
+	status := "RUNNING"
+	switch {
+	case s.Stopping:
+		status = "STOPPING"
+	case s.Paused:
+		status = "PAUSED"
+	}
+
+	lines := []string{
+		spread("go-zfs-rebalance  "+s.Title, status, width),
+		"",
+		progressLine(fmt.Sprintf("Pass %d of %d", s.Pass, s.Passes), passFraction(s),
+			fmt.Sprintf("%d/%d files", s.Done, s.Total), width),
+		progressLine("Overall", overallFraction(s), "", width),
+		dataLine(s),
+		fmt.Sprintf("Rebalanced %d files, %s in %s; %d skipped, %d failed",
+			s.Rebalanced, s.Units.Size(uint64(max(s.Bytes, 0))), s.Elapsed.Round(time.Second), s.Skipped, s.Failed),
+		"",
+		fmt.Sprintf("Workers: %d busy of %d", len(s.Workers), s.Concurrency),
+	}
+
+	// Keep room for the errors and the key bindings below the workers
+	errorLines := min(len(s.Errors), 5)
+	footer := 2
+	if errorLines > 0 {
+		footer += 2 + errorLines
+	}
+	room := max(height-len(lines)-footer, 1)
+	for i, w := range s.Workers {
+		if i == room-1 && len(s.Workers) > room {
+			lines = append(lines, fmt.Sprintf("  ... %d more", len(s.Workers)-i))
+			break
+		}
+		lines = append(lines, workerLine(w, s.Units, width))
+	}
+
+	if errorLines > 0 {
+		lines = append(lines, "", "Recent errors:")
+		for _, e := range s.Errors[len(s.Errors)-errorLines:] {
+			lines = append(lines, "  "+e)
+		}
+	}
+	lines = append(lines, "", Keys)
+
+	for i := range lines {
+		lines[i] = truncate(lines[i], width)
+	}
+	if height > 0 && len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+// labelWidth and detailWidth align the bars of the progress lines
+const (
+	labelWidth  = 14
+	detailWidth = 28
+)
+
+// progressLine draws a labeled bar filled to fraction, followed by the percentage and detail
+func progressLine(label string, fraction float64, detail string, width int) string {
+	label = fmt.Sprintf("%-*s", labelWidth, label)
+	suffix := fmt.Sprintf(" %3.0f%%  %s", fraction*100, detail)
+	return label + bar(fraction, width-labelWidth-detailWidth) + suffix
+}
+
+// passFraction is the share of the current pass that is done, by bytes when they are
+// known: a few large files can take most of the time
+func passFraction(s State) float64 {
+	if s.BytesTotal > 0 {
+		return min(float64(s.BytesDone)/float64(s.BytesTotal), 1)
+	}
+	if s.Total <= 0 {
+		return 0
+	}
+	return min(float64(s.Done)/float64(s.Total), 1)
+}
+
+// dataLine tells the bytes of the pass done and the time left
+func dataLine(s State) string {
+	line := fmt.Sprintf("Data: %s of %s", s.Units.Size(uint64(max(s.BytesDone, 0))), s.Units.Size(uint64(max(s.BytesTotal, 0))))
+	if s.ETA > 0 {
+		eta := s.ETA.Round(time.Second)
+		if eta >= time.Hour {
+			eta = s.ETA.Round(time.Minute)
+		}
+		line += fmt.Sprintf(" at %s, ETA %s", s.Units.Rate(s.Rate), eta)
+	}
+	return line
+}
+
+// overallFraction is the share of all passes that is done, counting each pass alike
+func overallFraction(s State) float64 {
+	if s.Passes <= 0 || s.Pass <= 0 {
+		return 0
+	}
+	return min((float64(s.Pass-1)+passFraction(s))/float64(s.Passes), 1)
+}
+
+// workerLine describes the file of one worker, shortening its path to fit
+func workerLine(w Worker, u units.Units, width int) string {
+	fraction := 1.0
+	if w.Size > 0 {
+		fraction = min(float64(w.Copied)/float64(w.Size), 1)
+	}
+	prefix := fmt.Sprintf("  %-18s %12s %s %3.0f%%  ", w.Stage, u.Rate(w.Speed), bar(fraction, minBarWidth), fraction*100)
+	return prefix + shortenPath(w.Path, width-utf8.RuneCountInString(prefix))
+}
+
+// bar draws a progress bar of the given width, brackets included
+func bar(fraction float64, width int) string {
+	width = max(width, minBarWidth) - 2
+	fraction = min(max(fraction, 0), 1)
+	filled := int(fraction * float64(width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+// spread puts left and right at the two ends of a line of the given width
+func spread(left, right string, width int) string {
+	gap := width - utf8.RuneCountInString(left) - utf8.RuneCountInString(right)
+	if gap < 1 {
+		return truncate(left, max(width-utf8.RuneCountInString(right)-1, 0)) + " " + right
+	}
+	return left + strings.Repeat(" ", gap) + right
+}
+
+// shortenPath keeps the end of a path that is too long, where the file name is
+func shortenPath(path string, width int) string {
+	n := utf8.RuneCountInString(path)
+	if width <= 1 || n <= width {
+		return path
+	}
+	runes := []rune(path)
+	return "…" + string(runes[n-width+1:])
+}
+
+// truncate cuts s to width runes; a width of 0 or less leaves it alone
+func truncate(s string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
+
+// RecentErrors is a logrus hook keeping the latest error messages for the dashboard
+type RecentErrors struct {
+	mu    sync.Mutex
+	limit int
+	lines []string
+}
+
+// NewRecentErrors keeps up to limit messages
+func NewRecentErrors(limit int) *RecentErrors {
+	return &RecentErrors{limit: max(limit, 1)}
+}
+
+// Levels implements logrus.Hook
+func (h *RecentErrors) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+// Fire implements logrus.Hook
+func (h *RecentErrors) Fire(entry *logrus.Entry) error {
+	// Only the first line: panics carry a stack trace
+	message, _, _ := strings.Cut(entry.Message, "\n")
+	line := entry.Time.Format("3:04:05 PM") + " " + message
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lines = append(h.lines, line)
+	if len(h.lines) > h.limit {
+		h.lines = append([]string(nil), h.lines[len(h.lines)-h.limit:]...)
+	}
+	return nil
+}
+
+// Lines returns the kept messages, oldest first
+func (h *RecentErrors) Lines() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.lines...)
+}
@@ -0,0 +1,114 @@
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRender(t *testing.T) {
+	s := State{
+		Title:       "/tank/data",
+		Pass:        2,
+		Passes:      4,
+		Done:        50,
+		Total:       200,
+		BytesDone:   1 << 30,
+		BytesTotal:  4 << 30,
+		Rate:        1 << 20,
+		ETA:         3072 * time.Second,
+		Rebalanced:  250,
+		Bytes:       3 << 30,
+		Elapsed:     90 * time.Second,
+		Paused:      true,
+		Concurrency: 8,
+		Errors:      []string{"1", "2", "3", "4", "5", "6"},
+	}
+	for i := 0; i < 10; i++ {
+		s.Workers = append(s.Workers, Worker{
+			Path:   fmt.Sprintf("/tank/data/%s/file-%d.mkv", strings.Repeat("deep/", 20), i),
+			Stage:  "copying",
+			Size:   100,
+			Copied: 50,
+			Speed:  1 << 20,
+		})
+	}
+
+	const width, height = 80, 24
+	lines := Render(s, width, height)
+	if len(lines) > height {
+		t.Errorf("Expected at most %d lines, got %d", height, len(lines))
+	}
+	for _, line := range lines {
+		if n := utf8.RuneCountInString(line); n > width {
+			t.Errorf("Line of %d runes exceeds the width: %q", n, line)
+		}
+	}
+	text := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"PAUSED",
+		"Pass 2 of 4",
+		" 25%  50/200 files",
+		// One pass done and a quarter of the second, of four
+		" 31%",
+		"Data: 1.00 GiB of 4.00 GiB at 1.00 MiB/s, ETA 51m12s",
+		"3.00 GiB in 1m30s",
+		"Workers: 10 busy of 8",
+		"file-0.mkv",
+		"  ... 4 more",
+		"Recent errors:",
+		Keys,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in the dashboard:\n%s", want, text)
+		}
+	}
+	// Only the latest errors fit
+	if strings.Contains(text, "  1\n") || !strings.Contains(text, "  6\n") {
+		t.Errorf("Expected the latest errors only:\n%s", text)
+	}
+}
+
+func TestBar(t *testing.T) {
+	cases := []struct {
+		fraction float64
+		width    int
+		want     string
+	}{
+		{0, 12, "[----------]"},
+		{0.5, 12, "[#####-----]"},
+		{1.5, 12, "[##########]"},
+		// Never narrower than minBarWidth
+		{1, 4, "[########]"},
+	}
+	for _, c := range cases {
+		if got := bar(c.fraction, c.width); got != c.want {
+			t.Errorf("bar(%v, %d) = %q, want %q", c.fraction, c.width, got, c.want)
+		}
+	}
+	if got := shortenPath("/a/b/file.txt", 9); got != "…file.txt" {
+		t.Errorf("Expected the end of the path to be kept, got %q", got)
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	log := logrus.New()
+	log.Out = &strings.Builder{}
+	h := NewRecentErrors(2)
+	log.AddHook(h)
+
+	log.Warn("not an error")
+	log.Error("first")
+	log.WithError(errors.New("x")).Error("second")
+	log.Errorf("third\nstack trace")
+
+	lines := h.Lines()
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " second") || !strings.HasSuffix(lines[1], " third") {
+		t.Errorf("Expected the last two errors without stack traces, got %q", lines)
+	}
+}
@@ -0,0 +1,61 @@
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sizeSuffixes are the multipliers ParseSize accepts, in powers of 1024 as zfs uses them
+var sizeSuffixes = map[byte]float64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+	'P': 1 << 50,
+}
+
+// ParseSize parses a byte count such as "4096", "512K", "20M" or "1.5G". The number may
+// have a fraction and is followed by an optional K, M, G, T or P suffix (powers of 1024);
+// a trailing "iB" or "B" is accepted, so "20M", "20MB" and "20MiB" are the same size.
+func ParseSize(s string) (int64, error) {
+	return ParseSizeUnit(s, 1)
+}
+
+// ParseSizeUnit is ParseSize for values where a number without suffix counts in unit
+// bytes, such as options that used to take whole MiB
+func ParseSizeUnit(s string, unit int64) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := float64(unit)
+	if trimmed, ok := strings.CutSuffix(v, "B"); ok {
+		// A bare "B" means bytes, whatever unit plain numbers count in
+		v, multiplier = trimmed, 1
+	}
+	trimmed, binary := strings.CutSuffix(v, "I")
+	if m, ok := sizeSuffixes[lastByte(trimmed)]; ok {
+		v, multiplier = trimmed[:len(trimmed)-1], m
+	} else if binary {
+		return 0, fmt.Errorf("invalid size %q: expected a number with an optional K, M, G, T or P suffix", s)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q: expected a number with an optional K, M, G, T or P suffix", s)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid size %q: must not be negative", s)
+	}
+	bytes := n * multiplier
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(math.Round(bytes)), nil
+}
+
+// lastByte returns the last byte of s, or 0 if s is empty
+func lastByte(s string) byte {
+	if s == "" {
+		return 0
+	}
+	return s[len(s)-1]
+}
@@ -0,0 +1,97 @@
+// Package units formats sizes and transfer rates in the unit system chosen by the user:
+// binary (KiB, MiB, powers of 1024, as zpool and zfs report) or SI (kB, MB, powers of
+// 1000), with rates optionally in bits per second. ParseSize reads sizes given on the
+// command line, such as 512K or 1.5G.
+package units
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Units selects how sizes and rates are rendered. The zero value is binary units with
+// rates in bytes per second.
+type Units struct {
+	// SI uses powers of 1000 instead of 1024
+	SI bool
+	// Bits renders rates in bits per second; sizes stay in bytes
+	Bits bool
+}
+
+// Names accepted by Parse
+const (
+	Binary     = "binary"
+	SI         = "si"
+	BinaryBits = "binary-bits"
+	SIBits     = "si-bits"
+)
+
+// Parse returns the Units named by s: binary, si, binary-bits or si-bits
+func Parse(s string) (Units, error) {
+	switch strings.ToLower(s) {
+	case Binary, "":
+		return Units{}, nil
+	case SI:
+		return Units{SI: true}, nil
+	case BinaryBits:
+		return Units{Bits: true}, nil
+	case SIBits:
+		return Units{SI: true, Bits: true}, nil
+	default:
+		return Units{}, fmt.Errorf("invalid units %q: expected %s, %s, %s or %s", s, Binary, SI, BinaryBits, SIBits)
+	}
+}
+
+// String returns the name Parse accepts for u
+func (u Units) String() string {
+	switch {
+	case u.SI && u.Bits:
+		return SIBits
+	case u.SI:
+		return SI
+	case u.Bits:
+		return BinaryBits
+	default:
+		return Binary
+	}
+}
+
+// base and prefixes of the unit system
+func (u Units) base() (float64, []string) {
+	if u.SI {
+		return 1000, []string{"k", "M", "G", "T", "P"}
+	}
+	return 1024, []string{"Ki", "Mi", "Gi", "Ti", "Pi"}
+}
+
+// scale divides v by the largest power of the base not above it
+func (u Units) scale(v float64) (float64, string) {
+	base, prefixes := u.base()
+	prefix := ""
+	for i := 0; v >= base && i < len(prefixes); i++ {
+		v /= base
+		prefix = prefixes[i]
+	}
+	return v, prefix
+}
+
+// Size renders a byte count, e.g. "1.50 GiB" or "1.61 GB"
+func (u Units) Size(n uint64) string {
+	v, prefix := u.scale(float64(n))
+	if prefix == "" {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %sB", v, prefix)
+}
+
+// Rate renders a transfer rate given in bytes per second, e.g. "85.20 MiB/s" or
+// "714.70 Mbit/s"
+func (u Units) Rate(bytesPerSec float64) string {
+	unit := "B/s"
+	if u.Bits {
+		bytesPerSec *= 8
+		unit = "bit/s"
+	}
+	v, prefix := u.scale(bytesPerSec)
+	return fmt.Sprintf("%.2f %s%s", v, prefix, unit)
+}
@@ -0,0 +1,105 @@
+package units
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, name := range []string{Binary, SI, BinaryBits, SIBits} {
+		u, err := Parse(name)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", name, err)
+		}
+		if u.String() != name {
+			t.Errorf("Parse(%q).String() = %q", name, u.String())
+		}
+	}
+	if u, err := Parse("SI"); err != nil || !u.SI {
+		t.Errorf("Expected case-insensitive names, got %+v, %v", u, err)
+	}
+	if _, err := Parse("metric"); err == nil {
+		t.Error("Expected an error for unknown units")
+	}
+}
+
+func TestSize(t *testing.T) {
+	cases := []struct {
+		units Units
+		n     uint64
+		want  string
+	}{
+		{Units{}, 0, "0 B"},
+		{Units{}, 1023, "1023 B"},
+		{Units{}, 1536, "1.50 KiB"},
+		{Units{}, 3 << 30, "3.00 GiB"},
+		{Units{SI: true}, 999, "999 B"},
+		{Units{SI: true}, 1500, "1.50 kB"},
+		{Units{SI: true}, 3 << 30, "3.22 GB"},
+		// Bits only apply to rates
+		{Units{Bits: true}, 1536, "1.50 KiB"},
+	}
+	for _, c := range cases {
+		if got := c.units.Size(c.n); got != c.want {
+			t.Errorf("%s Size(%d) = %q, want %q", c.units, c.n, got, c.want)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	cases := []struct {
+		units Units
+		rate  float64
+		want  string
+	}{
+		{Units{}, 512, "512.00 B/s"},
+		{Units{}, 100 << 20, "100.00 MiB/s"},
+		{Units{SI: true}, 100 << 20, "104.86 MB/s"},
+		{Units{Bits: true}, 100 << 20, "800.00 Mibit/s"},
+		{Units{SI: true, Bits: true}, 125e6, "1.00 Gbit/s"},
+	}
+	for _, c := range cases {
+		if got := c.units.Rate(c.rate); got != c.want {
+			t.Errorf("%s Rate(%v) = %q, want %q", c.units, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"512K", 512 << 10},
+		{"20M", 20 << 20},
+		{"20mb", 20 << 20},
+		{"20MiB", 20 << 20},
+		{"1.5G", 3 << 29},
+		{" 2T ", 2 << 40},
+		{"1P", 1 << 50},
+		{"100B", 100},
+	}
+	for _, c := range cases {
+		got, err := ParseSize(c.s)
+		if err != nil {
+			t.Errorf("ParseSize(%q) failed: %v", c.s, err)
+		} else if got != c.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", c.s, got, c.want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1M", "12X", "1.5.1G", "5i", "inf", "9000P"} {
+		if n, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) = %d, expected an error", s, n)
+		}
+	}
+
+	// Plain numbers count in the given unit, suffixed ones don't
+	if n, err := ParseSizeUnit("20", 1<<20); err != nil || n != 20<<20 {
+		t.Errorf("ParseSizeUnit(20, MiB) = %d, %v", n, err)
+	}
+	if n, err := ParseSizeUnit("512K", 1<<20); err != nil || n != 512<<10 {
+		t.Errorf("ParseSizeUnit(512K, MiB) = %d, %v", n, err)
+	}
+	if n, err := ParseSizeUnit("100B", 1<<20); err != nil || n != 100 {
+		t.Errorf("ParseSizeUnit(100B, MiB) = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,32 @@
+// Package uring runs batches of positioned reads and writes through an io_uring on Linux,
+// so a copy can keep several chunks in flight with one system call per batch instead of
+// one per chunk. It covers what the copy engine needs and nothing more: no registered
+// buffers or files, no polling, no linked operations.
+package uring
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ErrUnsupported is returned by New where io_uring cannot be used: other platforms,
+// kernels before 5.6, or where it is disabled (kernel.io_uring_disabled, seccomp)
+var ErrUnsupported = errors.New("io_uring not supported")
+
+// Op is a read or write of Buf at offset Off of the file descriptor FD
+type Op struct {
+	Write bool
+	FD    int
+	Buf   []byte
+	Off   int64
+	// Res is set by Run: the bytes transferred, or a negated errno
+	Res int32
+}
+
+// Err returns the error of a completed operation, nil if it transferred data
+func (o *Op) Err() error {
+	if o.Res < 0 {
+		return syscall.Errno(-o.Res)
+	}
+	return nil
+}
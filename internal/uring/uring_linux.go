@@ -0,0 +1,221 @@
+package uring
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants of the io_uring ABI, from linux/io_uring.h
+const (
+	opRead  = 22 // IORING_OP_READ
+	opWrite = 23 // IORING_OP_WRITE
+
+	offSQRing = 0          // IORING_OFF_SQ_RING
+	offCQRing = 0x8000000  // IORING_OFF_CQ_RING
+	offSQEs   = 0x10000000 // IORING_OFF_SQES
+
+	enterGetEvents = 1 << 0 // IORING_ENTER_GETEVENTS
+	// featRWCurPos came with IORING_OP_READ and IORING_OP_WRITE in Linux 5.6
+	featRWCurPos = 1 << 3 // IORING_FEAT_RW_CUR_POS
+)
+
+// sqringOffsets is struct io_sqring_offsets
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// cqringOffsets is struct io_cqring_offsets
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// params is struct io_uring_params
+type params struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+// sqe is struct io_uring_sqe
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is struct io_uring_cqe
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// Ring is an io_uring. It is not safe for concurrent use.
+type Ring struct {
+	fd      int
+	entries uint32
+
+	sqRing, cqRing, sqeMem []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []sqe
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []cqe
+
+	// broken is set once a batch could not be run to completion
+	broken bool
+}
+
+var (
+	supportedOnce sync.Once
+	supportedErr  error
+)
+
+// Supported returns nil if io_uring can be used, the reason otherwise. The check is made once.
+func Supported() error {
+	supportedOnce.Do(func() {
+		r, err := setup(1)
+		if err == nil {
+			r.Close()
+		}
+		supportedErr = err
+	})
+	return supportedErr
+}
+
+// New creates a ring running up to entries operations per batch
+func New(entries uint32) (*Ring, error) {
+	if err := Supported(); err != nil {
+		return nil, err
+	}
+	return setup(entries)
+}
+
+func setup(entries uint32) (*Ring, error) {
+	var p params
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%w: io_uring_setup: %v", ErrUnsupported, errno)
+	}
+	r := &Ring{fd: int(fd), entries: p.sqEntries}
+	if p.features&featRWCurPos == 0 {
+		r.Close()
+		return nil, fmt.Errorf("%w: the kernel lacks IORING_OP_READ and IORING_OP_WRITE (Linux 5.6)", ErrUnsupported)
+	}
+
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, offSQRing, int(p.sqOff.array+p.sqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err == nil {
+		r.cqRing, err = unix.Mmap(r.fd, offCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(cqe{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	}
+	if err == nil {
+		r.sqeMem, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(sqe{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%w: cannot map the rings: %v", ErrUnsupported, err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+// Entries returns the most operations Run takes at once
+func (r *Ring) Entries() int {
+	return int(r.entries)
+}
+
+// Run submits ops and waits until all of them completed, setting their Res. It returns
+// an error if the batch could not be run; the ring cannot be used any further then.
+func (r *Ring) Run(ops []*Op) error {
+	if r.broken {
+		return fmt.Errorf("io_uring: ring unusable after an earlier failure")
+	}
+	if len(ops) > int(r.entries) {
+		return fmt.Errorf("io_uring: %d operations exceed the %d entries of the ring", len(ops), r.entries)
+	}
+
+	// The kernel consumed every earlier entry, as every batch is waited for
+	tail := atomic.LoadUint32(r.sqTail)
+	mask := *r.sqMask
+	for i, op := range ops {
+		index := tail & mask
+		e := sqe{opcode: opRead, fd: int32(op.FD), off: uint64(op.Off), len: uint32(len(op.Buf)), userData: uint64(i)}
+		if op.Write {
+			e.opcode = opWrite
+		}
+		if len(op.Buf) > 0 {
+			e.addr = uint64(uintptr(unsafe.Pointer(&op.Buf[0])))
+		}
+		r.sqes[index] = e
+		r.sqArray[index] = index
+		tail++
+	}
+	atomic.StoreUint32(r.sqTail, tail)
+
+	toSubmit, completed := len(ops), 0
+	for completed < len(ops) {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(len(ops)-completed), enterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			r.broken = true
+			return fmt.Errorf("io_uring_enter: %w", errno)
+		}
+		toSubmit -= int(n)
+
+		head := atomic.LoadUint32(r.cqHead)
+		cqTail := atomic.LoadUint32(r.cqTail)
+		for ; head != cqTail; head++ {
+			c := r.cqes[head&*r.cqMask]
+			if c.userData < uint64(len(ops)) {
+				ops[c.userData].Res = c.res
+				completed++
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	// The buffers must stay reachable until the kernel is done with them
+	runtime.KeepAlive(ops)
+	return nil
+}
+
+// Close releases the ring
+func (r *Ring) Close() error {
+	for _, m := range [][]byte{r.sqeMem, r.cqRing, r.sqRing} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	r.sqeMem, r.cqRing, r.sqRing = nil, nil, nil
+	return unix.Close(r.fd)
+}
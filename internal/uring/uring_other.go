@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package uring
+
+// Ring is an io_uring, which only Linux has
+type Ring struct{}
+
+// Supported returns ErrUnsupported
+func Supported() error {
+	return ErrUnsupported
+}
+
+// New returns ErrUnsupported
+func New(entries uint32) (*Ring, error) {
+	return nil, ErrUnsupported
+}
+
+// Entries returns 0
+func (r *Ring) Entries() int {
+	return 0
+}
+
+// Run returns ErrUnsupported
+func (r *Ring) Run(ops []*Op) error {
+	return ErrUnsupported
+}
+
+// Close does nothing
+func (r *Ring) Close() error {
+	return nil
+}
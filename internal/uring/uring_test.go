@@ -0,0 +1,66 @@
+package uring
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r, err := New(4)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer r.Close()
+	if r.Entries() < 4 {
+		t.Fatalf("Expected at least 4 entries, got %d", r.Entries())
+	}
+
+	path := filepath.Join(t.TempDir(), "data")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create the file: %v", err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	// Writes land at their offsets, in any order
+	writes := []*Op{
+		{Write: true, FD: fd, Buf: []byte("world"), Off: 6},
+		{Write: true, FD: fd, Buf: []byte("hello "), Off: 0},
+	}
+	if err := r.Run(writes); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, op := range writes {
+		if op.Err() != nil || int(op.Res) != len(op.Buf) {
+			t.Errorf("Expected %d bytes written, got %d: %v", len(op.Buf), op.Res, op.Err())
+		}
+	}
+
+	// Reads past the end are short, and an invalid descriptor fails on its own
+	head, tail := make([]byte, 6), make([]byte, 10)
+	reads := []*Op{{FD: fd, Buf: head}, {FD: fd, Buf: tail, Off: 6}, {FD: -1, Buf: make([]byte, 1)}}
+	if err := r.Run(reads); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if reads[0].Res != 6 || !bytes.Equal(head, []byte("hello ")) {
+		t.Errorf("Unexpected first read: %d bytes, %q", reads[0].Res, head)
+	}
+	if reads[1].Res != 5 || !bytes.Equal(tail[:5], []byte("world")) {
+		t.Errorf("Unexpected second read: %d bytes, %q", reads[1].Res, tail)
+	}
+	if !errors.Is(reads[2].Err(), syscall.EBADF) {
+		t.Errorf("Expected EBADF, got %v", reads[2].Err())
+	}
+
+	if err := r.Run(make([]*Op, r.Entries()+1)); err == nil {
+		t.Error("Expected an error for more operations than entries")
+	}
+}
@@ -0,0 +1,74 @@
+package zpool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ARCStats are counters of the ZFS adaptive replacement cache. The sizes are in bytes;
+// the hit and miss counters count since the module was loaded.
+type ARCStats struct {
+	// Size is the current size of the ARC, Target the size it aims for (c) and Max its
+	// upper bound (c_max)
+	Size   uint64
+	Target uint64
+	Max    uint64
+	Hits   uint64
+	Misses uint64
+	// GhostHits counts reads of data the ARC had evicted recently (mru_ghost_hits and
+	// mfu_ghost_hits): many of them mean the cache is too small for what is being read
+	GhostHits uint64
+}
+
+// fields maps the arcstats kstat names to the fields they fill
+func (s *ARCStats) fields() map[string]*uint64 {
+	return map[string]*uint64{
+		"size":           &s.Size,
+		"c":              &s.Target,
+		"c_max":          &s.Max,
+		"hits":           &s.Hits,
+		"misses":         &s.Misses,
+		"mru_ghost_hits": &s.GhostHits,
+		"mfu_ghost_hits": &s.GhostHits,
+	}
+}
+
+// ReadARC returns the current ARC counters: from the arcstats kstat of OpenZFS on
+// Linux, or the kstat.zfs.misc.arcstats sysctls on FreeBSD
+func ReadARC() (ARCStats, error) {
+	return readARC()
+}
+
+// parseArcstats reads the "name type data" lines of the arcstats kstat
+func parseArcstats(r io.Reader) (ARCStats, error) {
+	var stats ARCStats
+	fields := stats.fields()
+	found := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) != 3 {
+			continue
+		}
+		field, ok := fields[line[0]]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(line[2], 10, 64)
+		if err != nil {
+			return ARCStats{}, fmt.Errorf("invalid arcstats %s %q", line[0], line[2])
+		}
+		*field += n
+		found++
+	}
+	if err := scanner.Err(); err != nil {
+		return ARCStats{}, err
+	}
+	if found < len(fields) {
+		return ARCStats{}, fmt.Errorf("arcstats lacks some of %d counters", len(fields))
+	}
+	return stats, nil
+}
@@ -0,0 +1,17 @@
+package zpool
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func readARC() (ARCStats, error) {
+	var stats ARCStats
+	for name, field := range stats.fields() {
+		n, err := unix.SysctlUint64("kstat.zfs.misc.arcstats." + name)
+		if err != nil {
+			return ARCStats{}, err
+		}
+		*field += n
+	}
+	return stats, nil
+}
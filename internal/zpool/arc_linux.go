@@ -0,0 +1,15 @@
+package zpool
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func readARC() (ARCStats, error) {
+	f, err := os.Open(filepath.Join(kstatDir, "arcstats"))
+	if err != nil {
+		return ARCStats{}, err
+	}
+	defer f.Close()
+	return parseArcstats(f)
+}
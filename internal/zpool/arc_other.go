@@ -0,0 +1,10 @@
+//go:build !linux && !freebsd
+// +build !linux,!freebsd
+
+package zpool
+
+import "errors"
+
+func readARC() (ARCStats, error) {
+	return ARCStats{}, errors.New("ARC statistics are only available on Linux and FreeBSD")
+}
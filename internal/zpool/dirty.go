@@ -0,0 +1,79 @@
+package zpool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Locations of the OpenZFS statistics on Linux
+const (
+	kstatDir         = "/proc/spl/kstat/zfs"
+	dirtyDataMaxPath = "/sys/module/zfs/parameters/zfs_dirty_data_max"
+)
+
+// DirtyData returns the data of a pool waiting to be written out by transaction groups
+// that have not yet been committed, and zfs_dirty_data_max, the point at which ZFS blocks
+// writers until a transaction group has synced. It needs the txgs kstat of OpenZFS on Linux.
+func DirtyData(pool string) (dirty, max uint64, err error) {
+	value, err := os.ReadFile(dirtyDataMaxPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err = strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid zfs_dirty_data_max %q", strings.TrimSpace(string(value)))
+	}
+
+	f, err := os.Open(filepath.Join(kstatDir, pool, "txgs"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	dirty, err = parseTxgs(f)
+	return dirty, max, err
+}
+
+// parseTxgs sums the ndirty column of the transaction groups that are open, quiescing,
+// waiting for sync or syncing, skipping the kstat header line
+func parseTxgs(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	stateCol, dirtyCol := -1, -1
+	var dirty uint64
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[0] == "txg" {
+			for i, name := range fields {
+				switch name {
+				case "state":
+					stateCol = i
+				case "ndirty":
+					dirtyCol = i
+				}
+			}
+			continue
+		}
+		if stateCol < 0 || dirtyCol < 0 || len(fields) <= max(stateCol, dirtyCol) {
+			continue
+		}
+		if fields[stateCol] == "C" {
+			continue // committed
+		}
+		n, err := strconv.ParseUint(fields[dirtyCol], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ndirty %q", fields[dirtyCol])
+		}
+		dirty += n
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if dirtyCol < 0 {
+		return 0, fmt.Errorf("no ndirty column in txgs kstat")
+	}
+	return dirty, nil
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package zpool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsFlash reports whether a block device is non-rotational (SSD or NVMe),
+// using the queue/rotational attribute of the device or its parent disk
+func IsFlash(device string) (bool, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false, err
+	}
+
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(resolved)))
+	if err != nil {
+		return false, fmt.Errorf("no sysfs entry for %s: %w", device, err)
+	}
+
+	// Partitions have no queue directory of their own, their parent disk does
+	for _, dir := range []string{sysPath, filepath.Dir(sysPath)} {
+		data, err := os.ReadFile(filepath.Join(dir, "queue", "rotational"))
+		if err == nil {
+			return strings.TrimSpace(string(data)) == "0", nil
+		}
+	}
+	return false, fmt.Errorf("rotational attribute not found for %s", device)
+}
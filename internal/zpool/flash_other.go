@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package zpool
+
+import "errors"
+
+// IsFlash is not supported on this platform
+func IsFlash(device string) (bool, error) {
+	return false, errors.New("device type detection is only supported on Linux")
+}
@@ -0,0 +1,66 @@
+package zpool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Quota is the space charged to one user or group of a dataset and its limit
+type Quota struct {
+	ID uint32
+	// Used is the space charged to the owner, in bytes
+	Used uint64
+	// Limit is the userquota or groupquota in bytes, 0 if none is set
+	Limit uint64
+}
+
+// UserQuotas returns the per-user space accounting of a dataset
+func UserQuotas(dataset string) ([]Quota, error) {
+	return spaceAccounting("userspace", dataset)
+}
+
+// GroupQuotas is UserQuotas for groups
+func GroupQuotas(dataset string) ([]Quota, error) {
+	return spaceAccounting("groupspace", dataset)
+}
+
+// spaceAccounting runs zfs userspace or groupspace with numeric ids and exact values
+func spaceAccounting(command, dataset string) ([]Quota, error) {
+	out, err := exec.Command("zfs", command, "-H", "-p", "-n", "-o", "name,used,quota", dataset).Output()
+	if err != nil {
+		return nil, fmt.Errorf("zfs %s %s failed: %w", command, dataset, err)
+	}
+	return parseSpaceAccounting(strings.NewReader(string(out)))
+}
+
+// parseSpaceAccounting parses tab-separated name, used and quota columns. Quotas of
+// "none" or "-" are 0; names that are not numeric ids (SMB SIDs) are skipped.
+func parseSpaceAccounting(r io.Reader) ([]Quota, error) {
+	var quotas []Quota
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		q := Quota{ID: uint32(id)}
+		if q.Used, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid used space %q of id %d", fields[1], id)
+		}
+		if limit := fields[2]; limit != "none" && limit != "-" {
+			if q.Limit, err = strconv.ParseUint(limit, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid quota %q of id %d", limit, id)
+			}
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, scanner.Err()
+}
@@ -0,0 +1,195 @@
+// Package zpool inspects the vdev layout of a ZFS pool through the zpool and
+// zfs command line tools.
+package zpool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Class is the allocation class of a top-level vdev
+type Class string
+
+const (
+	// ClassData holds regular file data
+	ClassData Class = "data"
+	// ClassSpecial holds metadata and small blocks
+	ClassSpecial Class = "special"
+	// ClassDedup holds the deduplication table
+	ClassDedup Class = "dedup"
+	// ClassLog is a separate intent log (SLOG)
+	ClassLog Class = "logs"
+	// ClassCache is an L2ARC device
+	ClassCache Class = "cache"
+	// ClassSpare is a hot spare
+	ClassSpare Class = "spares"
+)
+
+// Vdev is a top-level vdev and the leaf devices below it
+type Vdev struct {
+	// Name is the vdev name as shown by zpool status, e.g. mirror-0, raidz2-1 or a device path
+	Name  string
+	Class Class
+	// Devices are the leaf device paths of the vdev
+	Devices []string
+}
+
+// WriteAmplification returns how many bytes the vdev writes to its devices per byte of data,
+// based on its redundancy (mirror width or RAID-Z parity). Padding and metadata are ignored.
+func (v Vdev) WriteAmplification() float64 {
+	n := len(v.Devices)
+	if n == 0 {
+		return 1
+	}
+
+	switch {
+	case strings.HasPrefix(v.Name, "mirror"):
+		return float64(n)
+	case strings.HasPrefix(v.Name, "raidz"), strings.HasPrefix(v.Name, "draid"):
+		// raidz-0 and raidz1-0 have single parity, raidz2-0 double; draid2:... likewise
+		parity := 1
+		if rest := v.Name[len("raidz"):]; rest != "" && rest[0] >= '1' && rest[0] <= '3' {
+			parity = int(rest[0] - '0')
+		}
+		if n <= parity {
+			return float64(n)
+		}
+		return float64(n) / float64(n-parity)
+	default:
+		return 1
+	}
+}
+
+// Status returns the top-level vdevs of a pool
+func Status(pool string) ([]Vdev, error) {
+	out, err := exec.Command("zpool", "status", "-P", "-L", pool).Output()
+	if err != nil {
+		return nil, fmt.Errorf("zpool status %s failed: %w", pool, err)
+	}
+	return parseStatus(strings.NewReader(string(out)), pool)
+}
+
+// DatasetProperty returns the parsable value of a ZFS dataset property
+func DatasetProperty(dataset, property string) (string, error) {
+	out, err := exec.Command("zfs", "get", "-H", "-p", "-o", "value", property, dataset).Output()
+	if err != nil {
+		return "", fmt.Errorf("zfs get %s %s failed: %w", property, dataset, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// PoolProperty returns the parsable value of a pool property
+func PoolProperty(pool, property string) (string, error) {
+	out, err := exec.Command("zpool", "get", "-H", "-p", "-o", "value", property, pool).Output()
+	if err != nil {
+		return "", fmt.Errorf("zpool get %s %s failed: %w", property, pool, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Fragmentation returns the FRAG percentage of a pool, the fragmentation of its free space
+func Fragmentation(pool string) (int, error) {
+	value, err := PoolProperty(pool, "fragmentation")
+	if err != nil {
+		return 0, err
+	}
+	frag, err := parsePercent(value)
+	if err != nil {
+		return 0, fmt.Errorf("fragmentation of pool %s: %w", pool, err)
+	}
+	return frag, nil
+}
+
+// Capacity returns the CAP percentage of a pool, the share of its space allocated
+func Capacity(pool string) (int, error) {
+	value, err := PoolProperty(pool, "capacity")
+	if err != nil {
+		return 0, err
+	}
+	capacity, err := parsePercent(value)
+	if err != nil {
+		return 0, fmt.Errorf("capacity of pool %s: %w", pool, err)
+	}
+	return capacity, nil
+}
+
+// parsePercent parses a percentage as printed by zpool get, with or without -p
+func parsePercent(value string) (int, error) {
+	if value == "-" || value == "" {
+		// Pools without the spacemap_histogram feature do not report fragmentation
+		return 0, fmt.Errorf("not reported by the pool")
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected value %q", value)
+	}
+	return n, nil
+}
+
+// parseStatus parses the config section of `zpool status -P` output.
+// Nesting is expressed by two spaces of indentation per level after a leading tab.
+func parseStatus(r io.Reader, pool string) ([]Vdev, error) {
+	var vdevs []Vdev
+	var current *Vdev
+	class := Class("")
+	inConfig := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inConfig {
+			fields := strings.Fields(line)
+			inConfig = len(fields) > 0 && fields[0] == "NAME"
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			// End of the config section (errors: ...)
+			break
+		}
+
+		body := strings.TrimPrefix(line, "\t")
+		trimmed := strings.TrimLeft(body, " ")
+		fields := strings.Fields(trimmed)
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		depth := (len(body) - len(trimmed)) / 2
+
+		switch depth {
+		case 0:
+			// The pool itself or an allocation class header
+			if name == pool {
+				class = ClassData
+			} else {
+				class = Class(name)
+			}
+			current = nil
+		case 1:
+			vdevs = append(vdevs, Vdev{Name: name, Class: class})
+			current = &vdevs[len(vdevs)-1]
+			if strings.HasPrefix(name, "/") {
+				current.Devices = append(current.Devices, name)
+			}
+		default:
+			// Leaves, possibly below replacing-N or spare-N
+			if current != nil && strings.HasPrefix(name, "/") {
+				current.Devices = append(current.Devices, name)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if class == "" {
+		return nil, fmt.Errorf("no config section found for pool %s", pool)
+	}
+	return vdevs, nil
+}
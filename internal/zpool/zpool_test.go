@@ -0,0 +1,159 @@
+package zpool
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const sampleStatus = `  pool: tank
+ state: ONLINE
+config:
+
+	NAME                STATE     READ WRITE CKSUM
+	tank                ONLINE       0     0     0
+	  raidz2-0          ONLINE       0     0     0
+	    /dev/sda1       ONLINE       0     0     0
+	    /dev/sdb1       ONLINE       0     0     0
+	    /dev/sdc1       ONLINE       0     0     0
+	    /dev/sdd1       ONLINE       0     0     0
+	    /dev/sde1       ONLINE       0     0     0
+	    /dev/sdf1       ONLINE       0     0     0
+	special
+	  mirror-1          ONLINE       0     0     0
+	    /dev/nvme0n1p1  ONLINE       0     0     0
+	    /dev/nvme1n1p1  ONLINE       0     0     0
+	logs
+	  /dev/nvme2n1p1    ONLINE       0     0     0
+	cache
+	  /dev/nvme3n1      ONLINE       0     0     0
+
+errors: No known data errors
+`
+
+func TestParseStatus(t *testing.T) {
+	vdevs, err := parseStatus(strings.NewReader(sampleStatus), "tank")
+	if err != nil {
+		t.Fatalf("parseStatus failed: %v", err)
+	}
+	if len(vdevs) != 4 {
+		t.Fatalf("Expected 4 top-level vdevs, got %d: %+v", len(vdevs), vdevs)
+	}
+
+	expected := []struct {
+		name    string
+		class   Class
+		devices int
+	}{
+		{"raidz2-0", ClassData, 6},
+		{"mirror-1", ClassSpecial, 2},
+		{"/dev/nvme2n1p1", ClassLog, 1},
+		{"/dev/nvme3n1", ClassCache, 1},
+	}
+	for i, e := range expected {
+		v := vdevs[i]
+		if v.Name != e.name || v.Class != e.class || len(v.Devices) != e.devices {
+			t.Errorf("vdev %d: got %s/%s with %d devices, want %s/%s with %d", i, v.Name, v.Class, len(v.Devices), e.name, e.class, e.devices)
+		}
+	}
+
+	if _, err := parseStatus(strings.NewReader("cannot open 'tank': no such pool\n"), "tank"); err == nil {
+		t.Errorf("Expected an error for output without a config section")
+	}
+}
+
+func TestWriteAmplification(t *testing.T) {
+	tests := []struct {
+		vdev Vdev
+		want float64
+	}{
+		{Vdev{Name: "mirror-0", Devices: []string{"a", "b", "c"}}, 3},
+		{Vdev{Name: "raidz2-0", Devices: []string{"a", "b", "c", "d", "e", "f"}}, 1.5},
+		{Vdev{Name: "raidz-0", Devices: []string{"a", "b", "c"}}, 1.5},
+		{Vdev{Name: "/dev/sda", Devices: []string{"/dev/sda"}}, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.vdev.WriteAmplification(); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %.2f, want %.2f", tt.vdev.Name, got, tt.want)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	for value, want := range map[string]int{"30": 30, "0": 0, "47%": 47} {
+		if got, err := parsePercent(value); err != nil || got != want {
+			t.Errorf("parsePercent(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"-", "", "high"} {
+		if _, err := parsePercent(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseSpaceAccounting(t *testing.T) {
+	out := "1000\t5368709120\t10737418240\n" +
+		"1001\t1024\tnone\n" +
+		"S-1-5-21-1-2-3-1001\t4096\tnone\n"
+	quotas, err := parseSpaceAccounting(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("parseSpaceAccounting failed: %v", err)
+	}
+	want := []Quota{
+		{ID: 1000, Used: 5 << 30, Limit: 10 << 30},
+		{ID: 1001, Used: 1024},
+	}
+	if len(quotas) != len(want) || quotas[0] != want[0] || quotas[1] != want[1] {
+		t.Errorf("Expected %+v, got %+v", want, quotas)
+	}
+
+	if _, err := parseSpaceAccounting(strings.NewReader("1000\tlots\tnone\n")); err == nil {
+		t.Error("Expected an error for a non-numeric used value")
+	}
+}
+
+func TestParseTxgs(t *testing.T) {
+	txgs := "18 0 0x01 100 11200 1349104185 2237540371788\n" +
+		"txg      birth            state ndirty       nread        nwritten     reads    writes   otime        qtime        wtime        stime\n" +
+		"2654     4389433455466    C     1048576      0            1179648      0        24       5000168436   2848         38120        41127264\n" +
+		"2655     4394433623902    S     4194304      0            0            0        0        4999908734   3044         31896        0\n" +
+		"2656     4399433532636    O     2097152      0            0            0        0        0            0            0            0\n"
+	dirty, err := parseTxgs(strings.NewReader(txgs))
+	if err != nil {
+		t.Fatalf("parseTxgs failed: %v", err)
+	}
+	if dirty != 6<<20 {
+		t.Errorf("Expected 6 MiB dirty in the uncommitted txgs, got %d", dirty)
+	}
+
+	if _, err := parseTxgs(strings.NewReader("18 0 0x01 100\n")); err == nil {
+		t.Error("Expected an error without a header line")
+	}
+}
+
+func TestParseArcstats(t *testing.T) {
+	arcstats := "13 1 0x01 147 39984 4225419432 1496521046219573\n" +
+		"name                            type data\n" +
+		"hits                            4    9000\n" +
+		"misses                          4    1000\n" +
+		"demand_data_hits                4    5000\n" +
+		"mru_ghost_hits                  4    30\n" +
+		"mfu_ghost_hits                  4    12\n" +
+		"c                               4    4294967296\n" +
+		"c_min                           4    1073741824\n" +
+		"c_max                           4    8589934592\n" +
+		"size                            4    4000000000\n"
+	stats, err := parseArcstats(strings.NewReader(arcstats))
+	if err != nil {
+		t.Fatalf("parseArcstats failed: %v", err)
+	}
+	want := ARCStats{Size: 4000000000, Target: 4 << 30, Max: 8 << 30, Hits: 9000, Misses: 1000, GhostHits: 42}
+	if stats != want {
+		t.Errorf("Expected %+v, got %+v", want, stats)
+	}
+
+	if _, err := parseArcstats(strings.NewReader("hits 4 1\nmisses 4 2\n")); err == nil {
+		t.Error("Expected an error for missing counters")
+	}
+}
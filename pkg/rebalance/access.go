@@ -0,0 +1,58 @@
+package rebalance
+
+import (
+	"os"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/accesswatch"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// startAccessWatch begins recording the files other processes open below the root
+// paths when Config.DeferOpenedWithin is set. It returns a function stopping the watch.
+// Without fanotify the run goes on with a warning, deferring nothing.
+func (r *Rebalancer) startAccessWatch() func() {
+	if r.config.DeferOpenedWithin <= 0 {
+		return func() {}
+	}
+	paths := append(append([]string{}, r.roots()...), r.config.IncludeMounts...)
+	watcher, err := accesswatch.Start(paths, r.config.DeferOpenedWithin)
+	if err != nil {
+		r.logger.Warnf("Cannot watch file accesses, recently opened files will not be deferred: %v", err)
+		return func() {}
+	}
+
+	r.accessMutex.Lock()
+	r.accessWatch = watcher
+	r.accessMutex.Unlock()
+	return func() {
+		r.accessMutex.Lock()
+		r.accessWatch = nil
+		r.accessMutex.Unlock()
+		if n := watcher.Overflows(); n > 0 {
+			r.logger.Warnf("The file access queue overflowed %d times; some opens by other processes were missed", n)
+		}
+		watcher.Close()
+	}
+}
+
+// recentlyOpened returns when another process last opened filePath, if that was within
+// Config.DeferOpenedWithin. Only opens since the run started are known.
+func (r *Rebalancer) recentlyOpened(filePath string) (time.Time, bool) {
+	r.accessMutex.Lock()
+	watcher := r.accessWatch
+	r.accessMutex.Unlock()
+	if watcher == nil {
+		return time.Time{}, false
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return time.Time{}, false
+	}
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return watcher.OpenedWithin(accesswatch.File{Dev: id.Dev, Ino: id.Ino})
+}
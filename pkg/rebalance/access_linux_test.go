@@ -0,0 +1,62 @@
+package rebalance
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/accesswatch"
+)
+
+func TestDeferOpenedFiles(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	if w, err := accesswatch.Start([]string{r.config.RootPath}, time.Minute); err != nil {
+		t.Skipf("fanotify unavailable: %v", err)
+	} else {
+		w.Close()
+	}
+
+	dir := filepath.Dir(testFile)
+	busy, last := filepath.Join(dir, "busy"), filepath.Join(dir, "last")
+	for _, f := range []string{busy, last} {
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	r.config.Concurrency = 1
+	r.config.Files = []string{testFile, busy, last}
+	r.config.DeferOpenedWithin = time.Minute
+
+	var order []string
+	r.config.Hooks = Hooks{PreFile: func(ctx context.Context, filePath string) error {
+		order = append(order, filePath)
+		if filePath != testFile {
+			return nil
+		}
+		// Another process reads the next file while the first is processed
+		if out, err := exec.Command("cat", busy).CombinedOutput(); err != nil {
+			t.Errorf("cat failed: %v: %s", err, out)
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, ok := r.recentlyOpened(busy); ok {
+				break
+			}
+		}
+		return nil
+	}}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if want := []string{testFile, last, busy}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Expected the opened file to be processed last, got %v", order)
+	}
+	if s := r.Summary(); s.FilesDeferred != 1 || s.FilesRebalanced != 3 {
+		t.Errorf("Expected 1 deferred and 3 rebalanced files, got %+v", s)
+	}
+}
@@ -0,0 +1,151 @@
+package rebalance
+
+import (
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+)
+
+const (
+	// arcSampleInterval is how often the ARC counters are read during a run
+	arcSampleInterval = 10 * time.Second
+	// arcThrashGhostShare is the share of ARC accesses hitting recently evicted data above
+	// which the ARC counts as thrashing: reads keep coming back for what was just evicted
+	arcThrashGhostShare = 0.05
+	// arcMinAccesses is the fewest ARC accesses an interval needs to be judged; quieter
+	// intervals are merged with the next one
+	arcMinAccesses = 1000
+)
+
+// ARCState is the state of the ZFS adaptive replacement cache while the Rebalancer runs.
+// Heavy rebalance reads can evict the data other applications keep hot.
+type ARCState struct {
+	// Size is the size of the ARC in bytes, Target the size it aims for and Max its bound
+	Size   uint64
+	Target uint64
+	Max    uint64
+	// HitRatio is the share of ARC accesses that hit over the last interval judged,
+	// RunHitRatio since the first sample
+	HitRatio    float64
+	RunHitRatio float64
+	// GhostShare is the share of the accesses of the last interval judged that asked for
+	// recently evicted data; Thrashing is set when it exceeds arcThrashGhostShare
+	GhostShare float64
+	Thrashing  bool
+	// Throttled is how many workers Config.ARCThrottle currently holds back
+	Throttled int
+}
+
+// arcMonitor samples the ARC counters
+type arcMonitor struct {
+	read func() (zpool.ARCStats, error)
+
+	mu      sync.Mutex
+	sampled bool
+	// first is the sample the run ratios start from, last the one the next interval does
+	first, last zpool.ARCStats
+	state       ARCState
+}
+
+// sample reads the counters and returns the updated state; judged is set when the
+// interval since the last judged sample had enough accesses to update the ratios
+func (m *arcMonitor) sample() (state ARCState, judged bool, err error) {
+	stats, err := m.read()
+	if err != nil {
+		return ARCState{}, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The counters start over when the module is reloaded
+	if !m.sampled || stats.Hits < m.last.Hits || stats.Misses < m.last.Misses {
+		m.first, m.last, m.sampled = stats, stats, true
+	}
+
+	s := &m.state
+	s.Size, s.Target, s.Max = stats.Size, stats.Target, stats.Max
+	if accesses := (stats.Hits - m.first.Hits) + (stats.Misses - m.first.Misses); accesses > 0 {
+		s.RunHitRatio = float64(stats.Hits-m.first.Hits) / float64(accesses)
+	}
+	hits, misses := stats.Hits-m.last.Hits, stats.Misses-m.last.Misses
+	if accesses := hits + misses; accesses >= arcMinAccesses {
+		s.HitRatio = float64(hits) / float64(accesses)
+		s.GhostShare = float64(stats.GhostHits-m.last.GhostHits) / float64(accesses)
+		s.Thrashing = s.GhostShare > arcThrashGhostShare
+		m.last = stats
+		judged = true
+	}
+	return *s, judged, nil
+}
+
+// current returns the state, false before the first sample
+func (m *arcMonitor) current() (ARCState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.sampled
+}
+
+// addThrottled changes the number of workers held back and returns the new number
+func (m *arcMonitor) addThrottled(n int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.Throttled += n
+	return m.state.Throttled
+}
+
+// ARC returns the state of the ZFS ARC during the runs so far, false when the ARC
+// counters could not be read: on platforms other than Linux and FreeBSD, or without ZFS
+func (r *Rebalancer) ARC() (ARCState, bool) {
+	return r.arc.current()
+}
+
+// watchARC samples the ARC counters until stop is closed and, with Config.ARCThrottle,
+// takes a worker away for every interval the ARC thrashes and gives it back for every
+// interval it does not. The workers held back are given back when the run ends.
+func (r *Rebalancer) watchARC(stop <-chan struct{}) {
+	if _, _, err := r.arc.sample(); err != nil {
+		r.logger.Debugf("ARC statistics unavailable: %v", err)
+		return
+	}
+	defer func() {
+		if throttled := r.arc.addThrottled(0); throttled > 0 {
+			r.arc.addThrottled(-throttled)
+			r.SetConcurrency(r.Concurrency() + throttled)
+		}
+	}()
+
+	ticker := time.NewTicker(arcSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		state, judged, err := r.arc.sample()
+		if err != nil {
+			r.logger.Debugf("Cannot read the ARC statistics: %v", err)
+			continue
+		}
+		if judged && r.config.ARCThrottle {
+			r.adjustForARC(state)
+		}
+	}
+}
+
+// adjustForARC lowers the concurrency by one while the ARC thrashes and raises it again
+// by one once it does not, up to the workers it took away
+func (r *Rebalancer) adjustForARC(state ARCState) {
+	workers := r.Concurrency()
+	switch {
+	case state.Thrashing && workers > 1:
+		r.logger.Warnf("ARC thrashing: %.1f%% of reads asked for recently evicted data, hit ratio %.1f%%; lowering concurrency",
+			state.GhostShare*100, state.HitRatio*100)
+		r.arc.addThrottled(1)
+		r.SetConcurrency(workers - 1)
+	case !state.Thrashing && state.Throttled > 0:
+		r.logger.Infof("ARC no longer thrashing, hit ratio %.1f%%; raising concurrency", state.HitRatio*100)
+		r.arc.addThrottled(-1)
+		r.SetConcurrency(workers + 1)
+	}
+}
@@ -0,0 +1,125 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// VerifyReport is the outcome of a verify-only run
+type VerifyReport struct {
+	// Checked files were hashed; each either Matched or is listed in Mismatched
+	Checked    int64
+	Matched    int64
+	Mismatched []string
+	// Modified files changed (or vanished) since their checksum was stored and were not hashed
+	Modified int64
+	// Unrecorded files have no stored checksum
+	Unrecorded int64
+	// Failed files could not be read
+	Failed int64
+}
+
+// VerifyOnly hashes the files below the root path that have a checksum stored by a previous
+// run and reports any divergence, without copying anything. Matching files get their last
+// verification time updated unless the database is read-only.
+func (r *Rebalancer) VerifyOnly() (VerifyReport, error) {
+	return r.VerifyOnlyContext(context.Background())
+}
+
+// VerifyOnlyContext is VerifyOnly with a context. Canceling it stops hashing and returns
+// the partial report along with the context's error.
+func (r *Rebalancer) VerifyOnlyContext(ctx context.Context) (VerifyReport, error) {
+	var report VerifyReport
+	ctx, cancel := r.withShutdown(ctx)
+	defer cancel()
+
+	files, err := r.GatherFiles()
+	if err != nil {
+		return report, err
+	}
+
+	var mu sync.Mutex
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < r.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				r.auditFile(ctx, f, &report, &mu)
+			}
+		}()
+	}
+
+	for _, f := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- f
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Strings(report.Mismatched)
+	if r.isShuttingDown() {
+		return report, nil
+	}
+	return report, ctx.Err()
+}
+
+// auditFile checks one file against its stored checksum and adds the outcome to report
+func (r *Rebalancer) auditFile(ctx context.Context, filePath string, report *VerifyReport, mu *sync.Mutex) {
+	rec, found, err := r.db.GetChecksum(filePath)
+	if err != nil {
+		r.logger.Errorf("Verify: failed to read stored checksum for %s: %v", filePath, err)
+		mu.Lock()
+		report.Failed++
+		mu.Unlock()
+		return
+	}
+	if !found {
+		r.logger.Infof("Verify: no stored checksum: %s", filePath)
+		mu.Lock()
+		report.Unrecorded++
+		mu.Unlock()
+		return
+	}
+
+	release, ok := r.acquireHash(ctx.Done())
+	if !ok {
+		return
+	}
+	result, digest, err := checkStoredChecksum(rec, ctx.Done())
+	release()
+	if errors.Is(err, errVerifyStopped) {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case err != nil:
+		r.logger.Errorf("Verify: failed to hash %s: %v", filePath, err)
+		report.Failed++
+	case result == verifyMissing || result == verifyModified:
+		r.logger.Infof("Verify: file changed since its checksum was stored: %s", filePath)
+		report.Modified++
+	case result == verifyMismatch:
+		r.logger.Errorf("Verify: %s checksum mismatch for %s: stored %s, found %s", rec.Algorithm, filePath, rec.Digest, digest)
+		report.Checked++
+		report.Mismatched = append(report.Mismatched, filePath)
+	default:
+		r.logger.Infof("Verify: checksum OK: %s", filePath)
+		report.Checked++
+		report.Matched++
+		if r.db.ReadOnly {
+			break
+		}
+		if err := r.db.MarkChecksumVerified(filePath, time.Now()); err != nil {
+			r.logger.Errorf("Verify: failed to record verification of %s: %v", filePath, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package rebalance
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+)
+
+// Operations recorded in the audit log
+const (
+	auditRemove  = report.AuditRemove
+	auditRename  = report.AuditRename
+	auditRecover = report.AuditRecover
+	auditRelink  = report.AuditRelink
+	auditCleanup = report.AuditCleanup
+)
+
+// AuditLog is an append-only record of the destructive operations of a run. Each entry
+// is written and synced to disk before the operation it describes, so the log lists
+// every original that may have been deleted even if the process dies mid-way.
+// report.ReadAuditLog parses it.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	now  func() time.Time
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	op     string
+	path   string
+	target string // destination of renames and links
+	size   int64  // -1 when unknown
+	digest string // "algorithm:hex", empty when the copy was not hashed
+	// protection names the flags a removal clears, to be set again on the copy restored
+	// after a crash
+	protection string
+	err        error // set on the follow-up line of an operation that failed
+}
+
+// OpenAuditLog opens or creates the audit log at path for appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &AuditLog{path: path, file: f, now: time.Now}, nil
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// record appends an entry and syncs it to disk. A nil log records nothing.
+func (a *AuditLog) record(e auditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.WriteString(formatAuditEntry(a.now(), e)); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := faultinject.Check(faultinject.Fsync, a.path); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	return nil
+}
+
+// removals replays the log and returns the last removal of each original, keyed by
+// the path of its copy. A rename is announced before it is carried out, so the log
+// cannot tell whether it happened: a copy still there while its original is missing is
+// one a crash kept from being renamed into place. A nil log returns none.
+func (a *AuditLog) removals(naming tempNaming) (map[string]report.AuditEntry, error) {
+	removed, err := a.removedFiles()
+	if err != nil {
+		return nil, err
+	}
+	renames := make(map[string]report.AuditEntry, len(removed))
+	for original, e := range removed {
+		if tmpPath, _, err := naming.pathFor(original); err == nil {
+			renames[tmpPath] = e
+		}
+	}
+	return renames, nil
+}
+
+// removedFiles replays the log and returns the last removal of each original, keyed by
+// its path. A nil log returns none.
+func (a *AuditLog) removedFiles() (map[string]report.AuditEntry, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	a.mu.Lock()
+	f, err := os.Open(a.path)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	entries, err := report.ReadAuditLog(f)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make(map[string]report.AuditEntry)
+	for _, e := range entries {
+		if e.Op != auditRemove {
+			continue
+		}
+		if e.Failed() {
+			delete(removed, e.Path)
+		} else {
+			removed[e.Path] = e
+		}
+	}
+	return removed, nil
+}
+
+// formatAuditEntry renders an entry as a line of the log
+func formatAuditEntry(t time.Time, e auditEntry) string {
+	line := report.AuditEntry{
+		Time:       t,
+		Op:         e.op,
+		Path:       e.path,
+		Target:     e.target,
+		Size:       e.size,
+		Digest:     e.digest,
+		Protection: e.protection,
+	}
+	if e.err != nil {
+		line.Error = e.err.Error()
+	}
+	return line.String() + "\n"
+}
+
+// audit records a destructive operation before it is carried out
+func (r *Rebalancer) audit(e auditEntry) error {
+	return r.config.AuditLog.record(e)
+}
+
+// auditFailed records that an operation announced with audit did not happen
+func (r *Rebalancer) auditFailed(e auditEntry, err error) {
+	e.err = err
+	if logErr := r.config.AuditLog.record(e); logErr != nil {
+		r.logger.Errorf("Audit log: %v", logErr)
+	}
+}
+
+// restoreRemoved renames the copy at tmpPath over its original, which the audit log
+// records as removed by removal, once the copy matches the digest of the removal. It
+// reports whether the copy was dealt with, so it is not cleaned up.
+func (r *Rebalancer) restoreRemoved(tmpPath string, removal report.AuditEntry) bool {
+	original := removal.Path
+	if _, err := os.Lstat(original); !os.IsNotExist(err) {
+		// The original is back, or cannot be checked: the copy is not the only one
+		return false
+	}
+
+	if algorithm, digest, ok := strings.Cut(removal.Digest, ":"); ok {
+		checksumType := fileutil.ChecksumType(algorithm)
+		copyDigest, err := fileutil.FileHash(tmpPath, checksumType)
+		if err == nil && copyDigest != digest {
+			err = fmt.Errorf("%s checksum mismatch: %s != %s", checksumType, digest, copyDigest)
+		}
+		if err != nil {
+			r.logger.Errorf("Not restoring %s from %s: %v", original, tmpPath, err)
+			return true
+		}
+	}
+
+	r.logger.Warnf("Restoring %s from %s: the audit log shows the original was removed and the copy never renamed into place", original, tmpPath)
+	rename := auditEntry{op: auditRename, path: tmpPath, target: original, size: removal.Size, digest: removal.Digest}
+	if err := r.audit(rename); err != nil {
+		r.logger.Errorf("Audit log: %v", err)
+	}
+	if err := os.Rename(tmpPath, original); err != nil {
+		r.auditFailed(rename, err)
+		r.logger.Errorf("Cannot restore %s, data left in %s: %v", original, tmpPath, err)
+		return true
+	}
+	r.restoreProtection(original, removal)
+	return true
+}
+
+// restoreProtection sets the flags removal cleared on the original again on path, the
+// copy restored in its place
+func (r *Rebalancer) restoreProtection(path string, removal report.AuditEntry) {
+	if removal.Protection == "" {
+		return
+	}
+	protection, err := fileutil.ParseProtection(removal.Protection)
+	if err == nil {
+		err = fileutil.RestoreProtection(path, protection)
+	}
+	if err != nil {
+		r.logger.Errorf("Cannot set the %s flags of %s again: %v", removal.Protection, path, err)
+	}
+}
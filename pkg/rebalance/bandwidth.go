@@ -0,0 +1,49 @@
+package rebalance
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/ratelimit"
+)
+
+// defaultBandwidthStateDir holds the shared bandwidth buckets when Config.BandwidthStateDir is unset
+func defaultBandwidthStateDir() string {
+	return filepath.Join(os.TempDir(), "go-zfs-rebalance")
+}
+
+// bandwidthKey names the shared bucket: the pool of the root path, or its filesystem
+// source when the root is not on ZFS
+func (r *Rebalancer) bandwidthKey() string {
+	r.nestedMounts()
+	if key := poolKey(r.rootMount); r.rootMountFound && key != "" {
+		return key
+	}
+	return "default"
+}
+
+// openBandwidthLimit joins the bandwidth budget shared by every instance working on the
+// same pool. It returns nil if no limit is configured.
+func (r *Rebalancer) openBandwidthLimit() (*ratelimit.SharedBucket, error) {
+	if r.config.PoolBandwidth <= 0 {
+		return nil, nil
+	}
+
+	dir := r.config.BandwidthStateDir
+	if dir == "" {
+		dir = defaultBandwidthStateDir()
+	}
+	path := ratelimit.StatePath(dir, r.bandwidthKey())
+	rate := float64(r.config.PoolBandwidth)
+	bucket, previous, err := ratelimit.OpenShared(path, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous > 0 && previous != rate {
+		r.logger.Warnf("Shared bandwidth limit %s was %s, now %s for every instance using it",
+			path, r.config.Units.Rate(previous), r.config.Units.Rate(rate))
+	}
+	r.logger.Infof("Sharing a %s bandwidth limit through %s", r.config.Units.Rate(rate), path)
+	return bucket, nil
+}
@@ -0,0 +1,192 @@
+package rebalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/scheduler"
+)
+
+// batchBarrier holds the verified copies of a run until Config.BatchSize of them are
+// written, so that every copy of a batch is read back once the whole batch is on disk and
+// no original of the batch is removed before all of them passed. A device error surfacing
+// after a copy was written then costs a batch of copies instead of originals.
+type batchBarrier struct {
+	size int
+
+	mu      sync.Mutex
+	current *fileBatch
+	// remaining counts the files of the run not finished yet, the ones in the batch included
+	remaining int
+
+	// verifySlots bounds the copies read back at once
+	verifySlots chan struct{}
+}
+
+// fileBatch is a group of copies replaced together
+type fileBatch struct {
+	members  int
+	reported int
+	// failed names a file whose copy failed verification, which holds back the batch
+	failed string
+	// full is closed once no further copy joins; settled once every member was read back
+	full    chan struct{}
+	settled chan struct{}
+}
+
+// newBatchBarrier creates the barrier of a run over files files
+func newBatchBarrier(size, files, readers int) *batchBarrier {
+	return &batchBarrier{size: size, remaining: files, verifySlots: make(chan struct{}, max(readers, 1))}
+}
+
+// join adds a copy to the batch being filled
+func (b *batchBarrier) join() *fileBatch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil {
+		b.current = &fileBatch{full: make(chan struct{}), settled: make(chan struct{})}
+	}
+	fb := b.current
+	fb.members++
+	if fb.members >= b.size || fb.members >= b.remaining {
+		b.closeLocked()
+	}
+	return fb
+}
+
+// closeLocked closes the batch being filled; later copies start a new one
+func (b *batchBarrier) closeLocked() {
+	if b.current != nil {
+		close(b.current.full)
+		b.current = nil
+	}
+}
+
+// finished counts a file of the run as done. Once every file left is waiting in the
+// batch, no further copy can fill it and it is closed.
+func (b *batchBarrier) finished() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remaining--
+	if b.current != nil && b.current.members >= b.remaining {
+		b.closeLocked()
+	}
+}
+
+// flush closes the batch being filled, because no further file will be started
+func (b *batchBarrier) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeLocked()
+}
+
+// leave takes a copy back out of fb, whose run was canceled
+func (b *batchBarrier) leave(fb *fileBatch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if fb == b.current {
+		if fb.members--; fb.members == 0 {
+			b.current = nil
+		}
+		return
+	}
+	b.reportLocked(fb, "")
+}
+
+// report records that the copy of a member of fb was read back, failed naming the file
+// if the copy did not match
+func (b *batchBarrier) report(fb *fileBatch, failed string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reportLocked(fb, failed)
+}
+
+func (b *batchBarrier) reportLocked(fb *fileBatch, failed string) {
+	if failed != "" && fb.failed == "" {
+		fb.failed = failed
+	}
+	if fb.reported++; fb.reported == fb.members {
+		close(fb.settled)
+	}
+}
+
+// failedFile returns the file holding back fb, if any
+func (b *batchBarrier) failedFile(fb *fileBatch) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fb.failed
+}
+
+// awaitBatch holds the verified copy of filePath until its batch is complete, reads it
+// back and waits for the other copies of the batch to be read back too. It returns an
+// error if the copy or another one of the batch failed, in which case the original must
+// be kept. Without Config.BatchSize it returns right away.
+func (r *Rebalancer) awaitBatch(ctx context.Context, tracker *inflightFile, filePath, tmpPath string,
+	checksumType fileutil.ChecksumType, digest string) error {
+	b := r.batch
+	if b == nil {
+		return nil
+	}
+
+	// Waiting must not hold a worker, or a batch larger than the concurrency could never fill
+	scheduler.Detach(ctx)
+	tracker.setStage(stageBatched)
+	fb := b.join()
+	select {
+	case <-fb.full:
+	case <-r.shutdown.Done():
+		// No further file starts: replace what the batch holds
+		b.flush()
+		<-fb.full
+	case <-ctx.Done():
+		b.leave(fb)
+		return fmt.Errorf("%w: %s not replaced: %v", errInterrupted, filePath, ctx.Err())
+	}
+
+	// Read the copy back from the pool now that the whole batch was written
+	tracker.setStage(stageVerifying)
+	b.verifySlots <- struct{}{}
+	release, hashing := r.acquireHash(ctx.Done())
+	var err error
+	switch {
+	case !hashing:
+		err = fmt.Errorf("%w: %s not verified: %v", errInterrupted, filePath, ctx.Err())
+	case digest != "":
+		var copyDigest string
+		copyDigest, err = fileutil.FileHash(tmpPath, checksumType)
+		copyDigest = faultinject.Digest(filePath, copyDigest)
+		r.stats.bytesRead.Add(r.sizeOf(filePath))
+		if err != nil {
+			err = fmt.Errorf("cannot read back the copy of %s: %w", filePath, err)
+		} else if copyDigest != digest {
+			err = fmt.Errorf("%s checksum mismatch for file %s on read-back: %s != %s", checksumType, filePath, digest, copyDigest)
+		}
+	default:
+		_, ok, reason := fileutil.CompareFileChecksumDigest(filePath, tmpPath, checksumType)
+		r.stats.bytesRead.Add(2 * r.sizeOf(filePath))
+		if !ok {
+			err = fmt.Errorf("%s checksum mismatch for file %s on read-back: %s", checksumType, filePath, reason)
+		}
+	}
+	release()
+	<-b.verifySlots
+	if err != nil {
+		b.report(fb, filePath)
+		return err
+	}
+	b.report(fb, "")
+
+	tracker.setStage(stageBatched)
+	select {
+	case <-fb.settled:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s not replaced: %v", errInterrupted, filePath, ctx.Err())
+	}
+	if failed := b.failedFile(fb); failed != "" {
+		return fmt.Errorf("batch not replaced: the copy of %s failed verification", failed)
+	}
+	return nil
+}
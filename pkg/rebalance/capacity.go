@@ -0,0 +1,148 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// capacityCheckInterval is how often the pool capacity is checked during a run with
+// Config.MaxPoolCapacity
+const capacityCheckInterval = 30 * time.Second
+
+// ErrPoolFull is returned by RunContext when a pool went above Config.MaxPoolCapacity
+// and Config.PauseAtCapacity was not set
+var ErrPoolFull = errors.New("pool capacity above the limit")
+
+// capacityGate holds workers back from new files while a pool is above
+// Config.MaxPoolCapacity with Config.PauseAtCapacity
+type capacityGate struct {
+	mu     sync.Mutex
+	resume chan struct{} // closed once the pools are below the limit again, nil while they are
+}
+
+// poolCapacities returns the capacity of each pool holding a root path
+func (r *Rebalancer) poolCapacities() (map[string]int, error) {
+	if r.readCapacity != nil {
+		return r.readCapacity()
+	}
+	return r.PoolCapacity()
+}
+
+// checkCapacity compares the pools against Config.MaxPoolCapacity before a run starts and
+// reports whether they should be watched during the run, false if their capacity cannot be read
+func (r *Rebalancer) checkCapacity() bool {
+	if r.config.MaxPoolCapacity <= 0 {
+		return false
+	}
+	capacities, err := r.poolCapacities()
+	if err != nil {
+		r.logger.Warnf("Cannot read the pool capacity, not enforcing the limit of %d%%: %v", r.config.MaxPoolCapacity, err)
+		return false
+	}
+	r.judgeCapacity(capacities)
+	return true
+}
+
+// watchCapacity checks the capacity of the pools until stop is closed. Paused workers are
+// let go when the run ends.
+func (r *Rebalancer) watchCapacity(stop <-chan struct{}) {
+	defer r.releaseCapacity()
+
+	ticker := time.NewTicker(capacityCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		capacities, err := r.poolCapacities()
+		if err != nil {
+			r.logger.Debugf("Cannot read the pool capacity: %v", err)
+			continue
+		}
+		r.judgeCapacity(capacities)
+	}
+}
+
+// judgeCapacity stops the run, or holds back new files with Config.PauseAtCapacity, while a
+// pool is above Config.MaxPoolCapacity. Rebalancing a nearly full pool only fragments it further.
+func (r *Rebalancer) judgeCapacity(capacities map[string]int) {
+	limit := r.config.MaxPoolCapacity
+	pools := make([]string, 0, len(capacities))
+	for pool := range capacities {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	full := ""
+	for _, pool := range pools {
+		if capacities[pool] > limit {
+			full = pool
+			break
+		}
+	}
+	if full == "" {
+		if r.releaseCapacity() {
+			r.logger.Infof("Pools below the capacity limit of %d%% again: resuming", limit)
+		}
+		return
+	}
+
+	if !r.config.PauseAtCapacity {
+		if r.stats.poolFull.Swap(true) {
+			return
+		}
+		r.logger.Errorf("Pool %s is %d%% full, above the limit of %d%%: stopping the run once the files in progress are done",
+			full, capacities[full], limit)
+		if b := r.batch; b != nil {
+			// No further file starts to fill the batch
+			b.flush()
+		}
+		return
+	}
+
+	g := &r.capacity
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+		r.stats.capacityPauses.Add(1)
+		r.logger.Warnf("Pool %s is %d%% full, above the limit of %d%%: not starting further files until it is below again",
+			full, capacities[full], limit)
+	}
+}
+
+// releaseCapacity lets the workers held back by the capacity limit carry on and reports
+// whether any were
+func (r *Rebalancer) releaseCapacity() bool {
+	g := &r.capacity
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume == nil {
+		return false
+	}
+	close(g.resume)
+	g.resume = nil
+	return true
+}
+
+// waitForCapacity blocks while a pool is above the capacity limit, until ctx is done or a
+// shutdown is requested. The files in progress are not held: they give their space back
+// once their original is removed.
+func (r *Rebalancer) waitForCapacity(ctx context.Context) {
+	r.capacity.mu.Lock()
+	resume := r.capacity.resume
+	r.capacity.mu.Unlock()
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-ctx.Done():
+	case <-r.shutdown.Done():
+	}
+}
@@ -0,0 +1,85 @@
+package rebalance
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+)
+
+// ChecksumRule selects the checksum of files of at least MinSize bytes
+type ChecksumRule struct {
+	MinSize int64
+	Type    fileutil.ChecksumType
+}
+
+// ParseChecksumRules parses a comma-separated list of SIZE:TYPE rules, e.g. "1G:xxh3" to
+// verify files of 1 GiB and more with XXH3. Sizes are read by units.ParseSize. The rules
+// are returned sorted by MinSize.
+func ParseChecksumRules(spec string) ([]ChecksumRule, error) {
+	var rules []ChecksumRule
+	seen := make(map[int64]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sizeStr, typeStr, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid checksum rule %q: expected SIZE:TYPE", item)
+		}
+		size, err := units.ParseSize(sizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum rule %q: %w", item, err)
+		}
+		checksumType, err := fileutil.ParseChecksumType(typeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum rule %q: %w", item, err)
+		}
+		if seen[size] {
+			return nil, fmt.Errorf("duplicate checksum rule for size %s", sizeStr)
+		}
+		seen[size] = true
+		rules = append(rules, ChecksumRule{MinSize: size, Type: checksumType})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].MinSize < rules[j].MinSize })
+	return rules, nil
+}
+
+// checksumFor returns the checksum used to verify a file of the given size: the rule with
+// the largest MinSize not above size, or ChecksumType (SHA256 by default)
+func (r *Rebalancer) checksumFor(size int64) fileutil.ChecksumType {
+	checksumType := r.config.ChecksumType
+	if checksumType == "" {
+		checksumType = fileutil.ChecksumSHA256 // Default to SHA256 if not specified
+	}
+
+	minSize := int64(-1)
+	for _, rule := range r.config.ChecksumBySize {
+		if size >= rule.MinSize && rule.MinSize > minSize {
+			checksumType, minSize = rule.Type, rule.MinSize
+		}
+	}
+	return checksumType
+}
+
+// acquireHash waits for one of the Config.HashWorkers slots for hashing a file and returns
+// its release, or false if done is closed first; the release may be called either way
+func (r *Rebalancer) acquireHash(done <-chan struct{}) (release func(), ok bool) {
+	r.hashSlotsOnce.Do(func() {
+		if r.config.HashWorkers > 0 {
+			r.hashSlots = make(chan struct{}, r.config.HashWorkers)
+		}
+	})
+	if r.hashSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case r.hashSlots <- struct{}{}:
+		return func() { <-r.hashSlots }, true
+	case <-done:
+		return func() {}, false
+	}
+}
@@ -0,0 +1,176 @@
+package rebalance
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/scheduler"
+)
+
+// ActiveFile is a file a worker is rebalancing
+type ActiveFile struct {
+	Path string
+	// Stage is what the worker is doing: copying, verifying, replacing original...
+	Stage string
+	// Size is the size of the original, Copied how much of it the temporary copy holds
+	Size    int64
+	Copied  int64
+	Started time.Time
+}
+
+// ActiveFiles returns the files workers are rebalancing, the longest running first
+func (r *Rebalancer) ActiveFiles() []ActiveFile {
+	r.inflightMutex.Lock()
+	files := make([]*inflightFile, 0, len(r.inflight))
+	for _, f := range r.inflight {
+		files = append(files, f)
+	}
+	r.inflightMutex.Unlock()
+
+	active := make([]ActiveFile, 0, len(files))
+	for _, f := range files {
+		f.mu.Lock()
+		stage := f.stage
+		f.mu.Unlock()
+		a := ActiveFile{Path: f.path, Stage: stage, Size: f.expectedSize, Started: f.started}
+		// Stat outside the lock, a hung filesystem must not block the workers
+		if info, err := os.Lstat(f.tmpPath); err == nil {
+			a.Copied = info.Size()
+		} else if stage != stageCopying {
+			a.Copied = a.Size
+		}
+		active = append(active, a)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Started.Before(active[j].Started) })
+	return active
+}
+
+// RunProgress returns how many files the current or last run has finished and how many
+// it queued
+func (r *Rebalancer) RunProgress() (finished, queued int64) {
+	return r.stats.runFinished.Load(), r.stats.runQueued.Load()
+}
+
+// Progress is the state of a run, sent on the progress channel of Run as each pass starts,
+// each time a file is done and once more when the pass ends
+type Progress struct {
+	// FilesDone counts the files the pass is done with, whatever their outcome, FilesTotal
+	// the files it queued
+	FilesDone  int
+	FilesTotal int
+	// BytesDone counts the bytes of the files done, BytesTotal those of the files queued;
+	// ByteProgress also counts the bytes copied of the files in progress
+	BytesDone  int64
+	BytesTotal int64
+	// Pass numbers the current pass of the run from 1 to Passes, Config.Passes; the
+	// counts above are those of the current pass
+	Pass   int
+	Passes int
+	// ActiveWorkers is the number of workers rebalancing a file
+	ActiveWorkers int
+	// LastError is the last failure of a file in the pass, nil if none failed
+	LastError error
+}
+
+// pauseGate holds workers while the Rebalancer is paused
+type pauseGate struct {
+	mu     sync.Mutex
+	resume chan struct{} // closed on Resume, nil while running
+}
+
+// Pause stops workers from starting files and holds the copies in progress at their
+// next chunk until Resume. A shutdown releases paused copies so they can finish.
+func (r *Rebalancer) Pause() {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+	if r.pause.resume == nil {
+		r.pause.resume = make(chan struct{})
+		r.logger.Warn("Paused")
+	}
+}
+
+// Resume lets paused workers carry on
+func (r *Rebalancer) Resume() {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+	if r.pause.resume != nil {
+		close(r.pause.resume)
+		r.pause.resume = nil
+		r.logger.Warn("Resumed")
+	}
+}
+
+// Paused reports whether the Rebalancer is paused
+func (r *Rebalancer) Paused() bool {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+	return r.pause.resume != nil
+}
+
+// waitWhilePaused blocks while the Rebalancer is paused, until ctx is done or a
+// shutdown is requested
+func (r *Rebalancer) waitWhilePaused(ctx context.Context) {
+	r.pause.mu.Lock()
+	resume := r.pause.resume
+	r.pause.mu.Unlock()
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-ctx.Done():
+	case <-r.shutdown.Done():
+	}
+}
+
+// pauseLimiter holds copies at their next chunk while the Rebalancer is paused
+type pauseLimiter struct {
+	r   *Rebalancer
+	ctx context.Context
+}
+
+func (l pauseLimiter) Wait(n int) error {
+	l.r.waitWhilePaused(l.ctx)
+	return nil
+}
+
+// pauseLimiter returns the limiter holding the copies of a run while paused
+func (r *Rebalancer) pauseLimiter(ctx context.Context) fileutil.Limiter {
+	return pauseLimiter{r: r, ctx: ctx}
+}
+
+// SetConcurrency changes the number of files processed at once, at least 1. It applies
+// to the run in progress, where surplus workers stop after their current file, and to
+// later runs.
+func (r *Rebalancer) SetConcurrency(n int) {
+	n = max(n, 1)
+	r.schedMutex.Lock()
+	defer r.schedMutex.Unlock()
+	r.workers = n
+	if r.sched != nil {
+		r.sched.SetWorkers(n)
+	}
+	r.logger.Warnf("Concurrency set to %d", n)
+}
+
+// Concurrency returns the number of files processed at once
+func (r *Rebalancer) Concurrency() int {
+	r.schedMutex.Lock()
+	defer r.schedMutex.Unlock()
+	if r.workers > 0 {
+		return r.workers
+	}
+	return r.config.Concurrency
+}
+
+// setScheduler makes the scheduler of the run in progress follow SetConcurrency, or
+// detaches it when sched is nil
+func (r *Rebalancer) setScheduler(sched *scheduler.Scheduler) {
+	r.schedMutex.Lock()
+	defer r.schedMutex.Unlock()
+	r.sched = sched
+}
@@ -0,0 +1,54 @@
+package rebalance
+
+import (
+	"sort"
+	"sync"
+)
+
+// DatasetStats are the totals of the files of one dataset, named as in the mount table
+// (e.g. tank/media), or by its root path where that is not known
+type DatasetStats struct {
+	Dataset         string
+	FilesRebalanced int64
+	BytesRebalanced int64
+	FilesSkipped    int64
+	FilesFailed     int64
+}
+
+// DatasetStats returns the totals of every dataset a file was processed in, by name
+func (r *Rebalancer) DatasetStats() []DatasetStats {
+	return r.stats.datasets.list()
+}
+
+// datasetTotals keeps DatasetStats by dataset
+type datasetTotals struct {
+	mu     sync.Mutex
+	totals map[string]*DatasetStats
+}
+
+// add updates the totals of a dataset with fn
+func (d *datasetTotals) add(dataset string, fn func(*DatasetStats)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.totals == nil {
+		d.totals = make(map[string]*DatasetStats)
+	}
+	t := d.totals[dataset]
+	if t == nil {
+		t = &DatasetStats{Dataset: dataset}
+		d.totals[dataset] = t
+	}
+	fn(t)
+}
+
+// list returns a copy of the totals sorted by dataset
+func (d *datasetTotals) list() []DatasetStats {
+	d.mu.Lock()
+	list := make([]DatasetStats, 0, len(d.totals))
+	for _, t := range d.totals {
+		list = append(list, *t)
+	}
+	d.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Dataset < list[j].Dataset })
+	return list
+}
@@ -0,0 +1,114 @@
+package rebalance
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// etaWindow is how far back the rate behind the ETA looks, so it follows changes in
+	// throughput such as a scrub starting, without jumping with every file
+	etaWindow = 5 * time.Minute
+	// etaSampleInterval spaces the samples of the windows
+	etaSampleInterval = 5 * time.Second
+)
+
+// ByteProgress is the progress of the current or last run in bytes, which tells the
+// work left better than file counts when a few large files dominate the run
+type ByteProgress struct {
+	// Done counts the bytes of the files finished, whatever their outcome, and the bytes
+	// copied so far of the files in progress; Total the bytes of the files queued
+	Done  int64
+	Total int64
+	// Rate is the throughput in bytes per second over the last few minutes, or since the
+	// run started if it is younger; 0 before any byte is done
+	Rate float64
+	// ETA is the time the remaining bytes take at Rate, 0 when unknown or done
+	ETA time.Duration
+}
+
+// Fraction is the share of the bytes that are done, 0 when the run has no data
+func (p ByteProgress) Fraction() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return min(float64(p.Done)/float64(p.Total), 1)
+}
+
+// byteSample is the bytes done at a point in time
+type byteSample struct {
+	at   time.Time
+	done int64
+}
+
+// rateWindow keeps the samples of the last span for the rolling rate, etaWindow if zero
+type rateWindow struct {
+	span    time.Duration
+	mu      sync.Mutex
+	start   time.Time
+	samples []byteSample
+}
+
+// reset starts the window of a new run
+func (w *rateWindow) reset(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.start = now
+	w.samples = w.samples[:0]
+}
+
+// rate records done at now and returns the rate over the window
+func (w *rateWindow) rate(now time.Time, done int64) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := len(w.samples); n == 0 || now.Sub(w.samples[n-1].at) >= etaSampleInterval {
+		w.samples = append(w.samples, byteSample{at: now, done: done})
+	}
+	span := w.span
+	if span <= 0 {
+		span = etaWindow
+	}
+	// Keep the newest sample at least span old, so the rate always covers the whole span
+	drop := 0
+	for drop < len(w.samples)-1 && now.Sub(w.samples[drop+1].at) >= span {
+		drop++
+	}
+	w.samples = append(w.samples[:0], w.samples[drop:]...)
+
+	// A young run has no sample old enough yet, its average since the start stands in
+	from := byteSample{at: w.start}
+	if oldest := w.samples[0]; now.Sub(oldest.at) >= etaSampleInterval {
+		from = oldest
+	}
+	elapsed := now.Sub(from.at).Seconds()
+	if elapsed <= 0 || done <= from.done {
+		return 0
+	}
+	return float64(done-from.done) / elapsed
+}
+
+// ByteProgress returns the progress of the current or last run in bytes, with the
+// throughput over the last few minutes and the time left at that rate
+func (r *Rebalancer) ByteProgress() ByteProgress {
+	p := ByteProgress{
+		Done:  r.stats.runBytesFinished.Load(),
+		Total: r.stats.runBytesQueued.Load(),
+	}
+	for _, f := range r.ActiveFiles() {
+		p.Done += min(f.Copied, f.Size)
+	}
+	p.Done = min(p.Done, p.Total)
+
+	p.Rate = r.stats.byteRate.rate(time.Now(), p.Done)
+	if p.Rate > 0 && p.Done < p.Total {
+		p.ETA = time.Duration(float64(p.Total-p.Done) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+// sizeOf returns the size a file had when it was gathered
+func (r *Rebalancer) sizeOf(path string) int64 {
+	r.datasetsMutex.RLock()
+	defer r.datasetsMutex.RUnlock()
+	return r.fileSizes[path]
+}
@@ -0,0 +1,75 @@
+package rebalance
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// sampleExtents counts the extents of the gathered files for OrderFragmented and
+// Config.MinExtents. Files whose filesystem cannot map extents, or that cannot be read,
+// are left out of the map.
+func (r *Rebalancer) sampleExtents(files []string) map[string]int {
+	r.logger.Infof("Mapping the extents of %d files...", len(files))
+	extents := make(map[string]int, len(files))
+	unsupported := 0
+	for _, path := range files {
+		n, err := fileutil.ExtentCount(path)
+		switch {
+		case errors.Is(err, fileutil.ErrExtentsUnsupported):
+			unsupported++
+		case err != nil:
+			r.logger.Debugf("Cannot map the extents of %s: %v", path, err)
+		default:
+			extents[path] = n
+		}
+	}
+
+	switch {
+	case unsupported == len(files) && unsupported > 0:
+		r.logger.Warnf("The filesystem cannot map extents (OpenZFS does not implement FIEMAP): %s", r.unmappedHandling(true))
+	case unsupported > 0:
+		r.logger.Warnf("%d of %d files are on filesystems that cannot map extents: %s", unsupported, len(files), r.unmappedHandling(false))
+	}
+	return extents
+}
+
+// unmappedHandling tells what becomes of the files whose extents are unknown, all of
+// them or only some
+func (r *Rebalancer) unmappedHandling(all bool) string {
+	var handling []string
+	if r.config.Order == OrderFragmented && r.config.Files == nil {
+		if all {
+			handling = append(handling, "processing files in directory order")
+		} else {
+			handling = append(handling, "they are processed after the others")
+		}
+	}
+	if r.config.MinExtents > 0 {
+		if all {
+			handling = append(handling, "no file is skipped as already balanced")
+		} else {
+			handling = append(handling, "they are never skipped as already balanced")
+		}
+	}
+	return strings.Join(handling, "; ")
+}
+
+// alreadyBalanced reports whether a file was laid out in fewer than Config.MinExtents
+// extents when it was gathered, with its extent count
+func (r *Rebalancer) alreadyBalanced(path string) (int, bool) {
+	if r.config.MinExtents <= 0 {
+		return 0, false
+	}
+	n, ok := r.extentsOf(path)
+	return n, ok && n < r.config.MinExtents
+}
+
+// extentsOf returns the extent count of a gathered file, false if it is unknown
+func (r *Rebalancer) extentsOf(path string) (int, bool) {
+	r.datasetsMutex.RLock()
+	defer r.datasetsMutex.RUnlock()
+	n, ok := r.fileExtents[path]
+	return n, ok
+}
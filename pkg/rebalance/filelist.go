@@ -0,0 +1,326 @@
+package rebalance
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+)
+
+// LoadFileList reads a list of files to process from path, or from stdin if path is "-"
+func LoadFileList(path string) ([]string, error) {
+	if path == "-" {
+		return ParseFileList(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseFileList(f)
+}
+
+// ParseFileList parses a plan printed by Plan, a JSON or CSV report written by
+// report.RunReport, or one path per line. Lines starting with "path=" are read as plan
+// entries; blank lines and lines starting with '#' are ignored. Reports list their files
+// in order with the exact bytes of their paths, so a report filtered down to e.g. the
+// failed files can be run again even where names are not valid UTF-8.
+func ParseFileList(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(csvReportHeader))
+	switch {
+	case bytes.HasPrefix(bytes.TrimLeft(head, " \t\r\n"), []byte("{")):
+		return reportFiles(report.ReadRunReport(br))
+	case bytes.Equal(head, []byte(csvReportHeader)):
+		return reportFiles(report.ReadRunReportCSV(br))
+	}
+
+	// Never nil: an empty list selects no files rather than the whole tree
+	files := []string{}
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "path="):
+			e, err := report.ParsePlanEntry(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			files = append(files, e.Path)
+		default:
+			files = append(files, line)
+		}
+	}
+	return files, scanner.Err()
+}
+
+// csvReportHeader starts the header row of a CSV report
+const csvReportHeader = "path,status,"
+
+// reportFiles returns the paths of the files of a report, in its order
+func reportFiles(rep *report.RunReport, err error) ([]string, error) {
+	if err != nil {
+		return nil, fmt.Errorf("invalid report: %w", err)
+	}
+	files := make([]string, 0, len(rep.Files))
+	for _, f := range rep.Files {
+		files = append(files, f.Path)
+	}
+	return files, nil
+}
+
+// walkFileList calls fn for each file of Config.Files, like walkRoots does for every
+// file below the roots. Listed files must lie below a root path; duplicates and files
+// below excluded nested mounts or directories ignored by a .rebalanceignore are skipped.
+func (r *Rebalancer) walkFileList(fn filepath.WalkFunc) error {
+	seen := make(map[string]bool, len(r.config.Files))
+	for _, path := range r.config.Files {
+		path = filepath.Clean(path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		root, ok := r.rootOf(path)
+		if !ok {
+			return fmt.Errorf("listed file %s is not below %s", path, strings.Join(r.roots(), ", "))
+		}
+		if dir := r.excludedMountOf(path, root); dir != "" {
+			r.logger.Infof("Skipping listed file in nested foreign mount %s: %s", dir, path)
+			continue
+		}
+		if dir := r.ignoredDirOf(path, root); dir != "" {
+			r.logger.Infof("Skipping listed file in %s, ignored by %s: %s", dir, IgnoreFileName, path)
+			continue
+		}
+
+		info, err := os.Lstat(path)
+		if err := fn(path, info, err); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootOf returns the root path that path lies below
+func (r *Rebalancer) rootOf(path string) (string, bool) {
+	for _, root := range r.roots() {
+		if pathWithin(path, filepath.Clean(root)) {
+			return filepath.Clean(root), true
+		}
+	}
+	return "", false
+}
+
+// excludedMountOf returns the excluded nested mount between root and path, if any
+func (r *Rebalancer) excludedMountOf(path, root string) string {
+	for dir := filepath.Dir(path); dir != root && pathWithin(dir, root); dir = filepath.Dir(dir) {
+		if r.isExcludedMount(dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Order is the order the files of a run are processed in
+type Order string
+
+const (
+	// OrderPath processes the files in directory order
+	OrderPath Order = "path"
+	// OrderRandom shuffles the files, spreading the I/O over the tree
+	OrderRandom Order = "random"
+	// OrderLargest starts with the largest files, so the longest copies do not come last
+	// and the estimated time left settles early
+	OrderLargest Order = "largest"
+	// OrderSmallest starts with the smallest files, to clear the bulk of the file count first
+	OrderSmallest Order = "smallest"
+	// OrderFragmented starts with the files spread over the most extents, where rewriting
+	// helps most, and leaves contiguous files for last. Extents are mapped with FIEMAP
+	// while gathering, on Linux only; files without an extent map come after the others.
+	OrderFragmented Order = "fragmented"
+)
+
+// ParseOrder returns the order named by s, ignoring case
+func ParseOrder(s string) (Order, error) {
+	switch o := Order(strings.ToLower(s)); o {
+	case OrderPath, OrderRandom, OrderLargest, OrderSmallest, OrderFragmented:
+		return o, nil
+	default:
+		return "", fmt.Errorf("invalid order %q: must be random, path, largest, smallest or fragmented", s)
+	}
+}
+
+// orderFiles puts the files in Config.Order, unless they come from a list, whose order
+// is kept. Files of equal size keep their directory order.
+func (r *Rebalancer) orderFiles(files []string) {
+	if r.config.Files != nil && !r.config.OrderListedFiles {
+		return
+	}
+	switch r.config.Order {
+	case OrderRandom:
+		r.logger.Info("Randomizing file processing order...")
+		shuffleFiles(files)
+	case OrderLargest, OrderSmallest:
+		r.logger.Infof("Ordering files by size, %s first...", r.config.Order)
+		r.datasetsMutex.RLock()
+		sizes := r.fileSizes
+		r.datasetsMutex.RUnlock()
+		largest := r.config.Order == OrderLargest
+		sort.SliceStable(files, func(i, j int) bool {
+			if largest {
+				return sizes[files[i]] > sizes[files[j]]
+			}
+			return sizes[files[i]] < sizes[files[j]]
+		})
+	case OrderFragmented:
+		r.datasetsMutex.RLock()
+		extents := r.fileExtents
+		r.datasetsMutex.RUnlock()
+		if len(extents) == 0 {
+			return
+		}
+		r.logger.Info("Ordering files by extent count, most fragmented first...")
+		sort.SliceStable(files, func(i, j int) bool {
+			ei, iKnown := extents[files[i]]
+			ej, jKnown := extents[files[j]]
+			if iKnown != jKnown {
+				return iKnown
+			}
+			return ei > ej
+		})
+	}
+}
+
+// queuedFileOverhead estimates the memory a queued file takes besides its path: its entries
+// in the file list, the size and pending maps and the scheduler queue
+const queuedFileOverhead = 256
+
+// warnFileListMemory warns when the files queued for a pass take a large share of the
+// memory limit of the Go runtime, set with debug.SetMemoryLimit: the list of a pass is held
+// in memory, and a runtime collecting garbage near its limit slows the run down
+func (r *Rebalancer) warnFileListMemory(files []string) {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return
+	}
+	var estimate int64
+	for _, f := range files {
+		estimate += int64(len(f)) + queuedFileOverhead
+	}
+	if estimate > limit/2 {
+		r.logger.Warnf("The %d files queued take about %s, more than half the memory limit of %s: rebalance fewer paths at a time",
+			len(files), r.config.Units.Size(uint64(estimate)), r.config.Units.Size(uint64(limit)))
+	}
+}
+
+// shuffleFiles puts files in a random order
+func shuffleFiles(files []string) {
+	rand.Shuffle(len(files), func(i, j int) {
+		files[i], files[j] = files[j], files[i]
+	})
+}
+
+// Plan returns the files a run would process, in the order it would process them, with
+// the reason each was selected. Files a run would skip (pass limit reached, hard links,
+// temporary copies) are left out. Nothing is modified.
+func (r *Rebalancer) Plan() ([]report.PlanEntry, error) {
+	files, err := r.GatherFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather files: %w", err)
+	}
+	r.orderFiles(files)
+
+	var plan []report.PlanEntry
+	for _, f := range files {
+		entry, ok, err := r.planEntry(f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			plan = append(plan, entry)
+		}
+	}
+	return plan, nil
+}
+
+// planEntry applies the checks of rebalanceFile that decide whether a file is skipped
+func (r *Rebalancer) planEntry(filePath string) (report.PlanEntry, bool, error) {
+	if r.tempNaming().isTemp(filePath) {
+		return report.PlanEntry{}, false, nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report.PlanEntry{}, false, nil
+		}
+		return report.PlanEntry{}, false, fmt.Errorf("failed to stat: %s => %w", filePath, err)
+	}
+	if !info.Mode().IsRegular() {
+		return report.PlanEntry{}, false, nil
+	}
+
+	var reasons []string
+	linkedPaths, isGroup := r.hardlinkGroup(filePath)
+	linkCount, err := fileutil.GetLinkCountFromFileInfo(filePath, info)
+	switch {
+	case err != nil:
+		return report.PlanEntry{}, false, fmt.Errorf("hardlink check failed for %s: %w", filePath, err)
+	case isGroup && linkCount != uint64(len(linkedPaths)+1):
+		return report.PlanEntry{}, false, nil
+	case isGroup:
+		reasons = append(reasons, fmt.Sprintf("hardlink group of %d paths", linkCount))
+	case r.config.SkipHardlinks && linkCount > 1:
+		return report.PlanEntry{}, false, nil
+	case linkCount > 1:
+		reasons = append(reasons, fmt.Sprintf("%d hard links", linkCount))
+	}
+
+	counted, _, err := r.passRecord(filePath, info)
+	if err != nil {
+		return report.PlanEntry{}, false, fmt.Errorf("db read error: %w", err)
+	}
+	count := counted.Count
+	switch {
+	case r.config.PassesLimit > 0 && count >= r.config.PassesLimit:
+		return report.PlanEntry{}, false, nil
+	case r.config.PassesLimit > 0:
+		reasons = append([]string{fmt.Sprintf("rebalanced %d of %d times", count, r.config.PassesLimit)}, reasons...)
+	default:
+		reasons = append([]string{fmt.Sprintf("rebalanced %d times, no pass limit", count)}, reasons...)
+	}
+
+	if _, ok := r.alreadyBalanced(filePath); ok {
+		return report.PlanEntry{}, false, nil
+	}
+	if n, ok := r.extentsOf(filePath); ok {
+		reasons = append(reasons, fmt.Sprintf("%d extents", n))
+	}
+	if r.config.IncludeInodes != nil {
+		reasons = append(reasons, "inode listed")
+	}
+	if r.config.Files != nil {
+		reasons = append(reasons, "file listed")
+	}
+
+	return report.PlanEntry{
+		Path:   filePath,
+		Size:   info.Size(),
+		Passes: count,
+		Reason: strings.Join(reasons, ", "),
+	}, true, nil
+}
@@ -0,0 +1,73 @@
+package rebalance
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// replacedFile is what the final check expects of a file once its copy was renamed into
+// place
+type replacedFile struct {
+	path string
+	// copyID identifies the copy before the rename, zero where inodes are unknown
+	copyID  fileutil.FileID
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	// checksumType and digest are those of the copy, digest empty without verification
+	checksumType fileutil.ChecksumType
+	digest       string
+}
+
+// checkReplaced stats the file at f.path again once it was replaced and its mode and times
+// restored: it must be the copy that was renamed into place, not a file another process
+// put there, with the size, mode and modification time of the original. With
+// Config.VerifyAfterReplace it is also hashed again and compared with the digest of the
+// copy. It returns whether the content was hashed.
+func (r *Rebalancer) checkReplaced(ctx context.Context, f replacedFile) (hashed bool, err error) {
+	info, err := os.Lstat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("final check of %s: %w", f.path, err)
+	}
+	if f.copyID.Ino != 0 {
+		if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil && id != f.copyID {
+			return false, fmt.Errorf("final check of %s: it is inode %d, not the copy renamed into place (inode %d)",
+				f.path, id.Ino, f.copyID.Ino)
+		}
+	}
+	switch {
+	case !info.Mode().IsRegular():
+		return false, fmt.Errorf("final check of %s: no longer a regular file (%v)", f.path, info.Mode())
+	case info.Size() != f.size:
+		return false, fmt.Errorf("final check of %s: size %d, expected %d", f.path, info.Size(), f.size)
+	case info.Mode() != f.mode:
+		return false, fmt.Errorf("final check of %s: mode %v, expected %v", f.path, info.Mode(), f.mode)
+	case !info.ModTime().Equal(f.modTime):
+		return false, fmt.Errorf("final check of %s: modified %s, expected %s", f.path,
+			info.ModTime().Format(time.RFC3339Nano), f.modTime.Format(time.RFC3339Nano))
+	}
+
+	if !r.config.VerifyAfterReplace || f.digest == "" {
+		return false, nil
+	}
+	release, ok := r.acquireHash(ctx.Done())
+	defer release()
+	if !ok {
+		// The file is in place and its attributes check out, only the hash is left out
+		return false, nil
+	}
+	digest, err := fileutil.FileHash(f.path, f.checksumType)
+	if err != nil {
+		return false, fmt.Errorf("final check of %s: %w", f.path, err)
+	}
+	r.stats.bytesRead.Add(f.size)
+	if digest != f.digest {
+		return false, fmt.Errorf("final check of %s: %s checksum mismatch after replacement: %s != %s",
+			f.path, f.checksumType, digest, f.digest)
+	}
+	return true, nil
+}
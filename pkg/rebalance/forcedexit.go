@@ -0,0 +1,83 @@
+package rebalance
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replaceGate keeps a forced exit from removing a temporary copy while its worker is
+// replacing the original with it
+type replaceGate struct {
+	mu        sync.RWMutex
+	abandoned atomic.Bool
+}
+
+// enterReplace is called before a worker removes an original. It returns false once
+// AbandonInflight was called, and the original must be kept; otherwise leaveReplace
+// must be called when the copy has taken the place of the original.
+func (r *Rebalancer) enterReplace() bool {
+	r.replace.mu.RLock()
+	if r.replace.abandoned.Load() {
+		r.replace.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+// leaveReplace ends the replacement started by enterReplace
+func (r *Rebalancer) leaveReplace() {
+	r.replace.mu.RUnlock()
+}
+
+// AbandonInflight prepares a forced exit while workers are still busy: no further
+// original is replaced, and the temporary copies of the files in progress are removed,
+// their originals being intact. It waits up to wait for replacements under way to
+// finish; if they do not, only the copies still being written are removed. It returns
+// the copies removed and the files whose copies were left, because they could be the
+// only data of the file or could not be removed.
+func (r *Rebalancer) AbandonInflight(wait time.Duration) (removed, kept []string) {
+	r.replace.abandoned.Store(true)
+
+	// Once the lock is held, no worker is between removing an original and renaming its copy
+	settled := false
+	for deadline := time.Now().Add(wait); ; time.Sleep(10 * time.Millisecond) {
+		if r.replace.mu.TryLock() {
+			r.replace.mu.Unlock()
+			settled = true
+			break
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+
+	r.inflightMutex.Lock()
+	files := make([]*inflightFile, 0, len(r.inflight))
+	for _, f := range r.inflight {
+		files = append(files, f)
+	}
+	r.inflightMutex.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+
+	for _, f := range files {
+		f.mu.Lock()
+		stage := f.stage
+		f.mu.Unlock()
+		// A verified copy may already be replacing its original unless the gate settled
+		safe := stage == stageCopying || (settled && (stage == stageVerifying || stage == stageBatched))
+		if !safe {
+			kept = append(kept, f.path)
+			continue
+		}
+		if err := os.Remove(f.tmpPath); err != nil && !os.IsNotExist(err) {
+			r.logger.Errorf("Cannot remove %s: %v", f.tmpPath, err)
+			kept = append(kept, f.path)
+			continue
+		}
+		removed = append(removed, f.tmpPath)
+	}
+	return removed, kept
+}
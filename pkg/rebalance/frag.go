@@ -0,0 +1,46 @@
+package rebalance
+
+import (
+	"fmt"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+)
+
+// PoolFragmentation returns the free space fragmentation (the FRAG column of zpool list),
+// in percent, of each pool holding a root path
+func (r *Rebalancer) PoolFragmentation() (map[string]int, error) {
+	return r.poolPercents(zpool.Fragmentation)
+}
+
+// PoolCapacity returns the capacity (the CAP column of zpool list), in percent, of each
+// pool holding a root path
+func (r *Rebalancer) PoolCapacity() (map[string]int, error) {
+	return r.poolPercents(zpool.Capacity)
+}
+
+// poolPercents reads a percentage of each pool holding a root path
+func (r *Rebalancer) poolPercents(read func(pool string) (int, error)) (map[string]int, error) {
+	r.nestedMounts()
+	percents := make(map[string]int)
+	for _, root := range r.roots() {
+		var pool string
+		for _, rf := range r.rootFilesystems {
+			if rf.path == root && rf.found {
+				pool = rf.mount.Pool()
+			}
+		}
+		if pool == "" {
+			return nil, fmt.Errorf("%s is not on a ZFS dataset", root)
+		}
+		if _, ok := percents[pool]; ok {
+			continue
+		}
+
+		percent, err := read(pool)
+		if err != nil {
+			return nil, err
+		}
+		percents[pool] = percent
+	}
+	return percents, nil
+}
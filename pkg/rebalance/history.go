@@ -0,0 +1,239 @@
+package rebalance
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+)
+
+// RecordRun stores the totals of the Rebalancer so far, with those of each dataset, as
+// one run in the database. Callers record a run once it is over, however many passes
+// it took. Nothing is stored in a read-only database.
+func (r *Rebalancer) RecordRun() error {
+	if r.db.ReadOnly {
+		return nil
+	}
+	summary := r.Summary()
+	rec := database.RunRecord{
+		Started:         r.stats.start,
+		Finished:        r.stats.start.Add(summary.Elapsed),
+		Paths:           r.roots(),
+		Interrupted:     summary.Interrupted || summary.TooManyErrors || summary.PoolFull || summary.ByteBudgetSpent || summary.RuntimeSpent,
+		FilesRebalanced: summary.FilesRebalanced,
+		BytesRebalanced: summary.BytesRebalanced,
+		FilesSkipped:    summary.FilesSkipped,
+		FilesFailed:     summary.FilesFailed,
+		FilesVerified:   summary.FilesReplaceVerified,
+	}
+	for _, d := range r.DatasetStats() {
+		rec.Datasets = append(rec.Datasets, database.DatasetRecord(d))
+	}
+	if _, err := r.db.AddRun(rec); err != nil {
+		return fmt.Errorf("cannot record the run: %w", err)
+	}
+	return nil
+}
+
+// PruneDatabase removes the records of files under the root paths that no longer exist,
+// so a database kept across runs does not grow with every file ever deleted. Callers
+// prune after a run that was not interrupted. Nothing is removed from a read-only
+// database.
+func (r *Rebalancer) PruneDatabase() (database.PruneStats, error) {
+	if r.db.ReadOnly {
+		return database.PruneStats{}, nil
+	}
+	stats, err := r.db.Prune(r.roots(), false)
+	if err != nil {
+		return stats, fmt.Errorf("cannot prune the database: %w", err)
+	}
+	return stats, nil
+}
+
+// LastCompleteRun returns the start of the last run that went through every file below
+// roots without failures, for Config.Since in incremental runs. Runs that were stopped
+// early or had failed files, and runs of other paths, do not count.
+func LastCompleteRun(runs []database.RunRecord, roots []string) (time.Time, bool) {
+	var last time.Time
+	for _, run := range runs {
+		if run.Interrupted || run.FilesFailed > 0 || !coversRoots(run.Paths, roots) {
+			continue
+		}
+		if run.Started.After(last) {
+			last = run.Started
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// coversRoots reports whether every root lies below one of paths
+func coversRoots(paths, roots []string) bool {
+	for _, root := range roots {
+		covered := false
+		for _, path := range paths {
+			if pathWithin(filepath.Clean(root), filepath.Clean(path)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// HistoryTotals add up the totals of several runs
+type HistoryTotals struct {
+	Runs            int
+	Interrupted     int
+	FilesRebalanced int64
+	BytesRebalanced int64
+	FilesSkipped    int64
+	FilesFailed     int64
+	// Duration is the time the runs took, zero for dataset totals
+	Duration time.Duration
+}
+
+// BytesPerSecond is the average rate data was rewritten at while runs were going
+func (t HistoryTotals) BytesPerSecond() float64 {
+	if t.Duration <= 0 {
+		return 0
+	}
+	return float64(t.BytesRebalanced) / t.Duration.Seconds()
+}
+
+// ErrorRate is the share of the files processed that failed
+func (t HistoryTotals) ErrorRate() float64 {
+	processed := t.FilesRebalanced + t.FilesSkipped + t.FilesFailed
+	if processed == 0 {
+		return 0
+	}
+	return float64(t.FilesFailed) / float64(processed)
+}
+
+// add counts a run in the totals
+func (t *HistoryTotals) add(run database.RunRecord) {
+	t.Runs++
+	if run.Interrupted {
+		t.Interrupted++
+	}
+	t.FilesRebalanced += run.FilesRebalanced
+	t.BytesRebalanced += run.BytesRebalanced
+	t.FilesSkipped += run.FilesSkipped
+	t.FilesFailed += run.FilesFailed
+	t.Duration += run.Finished.Sub(run.Started)
+}
+
+// History aggregates the runs recorded in a database
+type History struct {
+	HistoryTotals
+	// First and Last are the start times of the oldest and newest run
+	First, Last time.Time
+	// Datasets holds the totals of each dataset over the runs that processed files in it
+	Datasets []DatasetHistory
+	// Periods holds the totals of the runs started in each period, oldest first; periods
+	// without runs are left out
+	Periods []PeriodHistory
+}
+
+// DatasetHistory is the totals of one dataset over all runs
+type DatasetHistory struct {
+	Dataset string
+	HistoryTotals
+}
+
+// PeriodHistory is the totals of the runs started in one period
+type PeriodHistory struct {
+	// Label names the period, e.g. 2024-05-01, 2024-W18 or 2024-05
+	Label string
+	Start time.Time
+	HistoryTotals
+}
+
+// Period is the length of the periods of a History
+type Period string
+
+// Periods of a History
+const (
+	PeriodDay   Period = "day"
+	PeriodWeek  Period = "week"
+	PeriodMonth Period = "month"
+)
+
+// ParsePeriod parses day, week or month
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case PeriodDay, PeriodWeek, PeriodMonth:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid period %q: expected day, week or month", s)
+}
+
+// start returns the start of the period holding t, in t's location, and its label
+func (p Period) start(t time.Time) (time.Time, string) {
+	year, month, day := t.Date()
+	switch p {
+	case PeriodDay:
+		start := time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+		return start, start.Format("2006-01-02")
+	case PeriodWeek:
+		// ISO weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		start := time.Date(year, month, day-offset, 0, 0, 0, 0, t.Location())
+		isoYear, week := start.ISOWeek()
+		return start, fmt.Sprintf("%d-W%02d", isoYear, week)
+	default:
+		start := time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+		return start, start.Format("2006-01")
+	}
+}
+
+// SummarizeRuns aggregates runs, grouping them into periods by their local start time
+func SummarizeRuns(runs []database.RunRecord, period Period) History {
+	var h History
+	datasets := make(map[string]*DatasetHistory)
+	periods := make(map[string]*PeriodHistory)
+	for _, run := range runs {
+		h.add(run)
+		if h.First.IsZero() || run.Started.Before(h.First) {
+			h.First = run.Started
+		}
+		if run.Started.After(h.Last) {
+			h.Last = run.Started
+		}
+
+		start, label := period.start(run.Started.Local())
+		p := periods[label]
+		if p == nil {
+			p = &PeriodHistory{Label: label, Start: start}
+			periods[label] = p
+		}
+		p.add(run)
+
+		for _, d := range run.Datasets {
+			dh := datasets[d.Dataset]
+			if dh == nil {
+				dh = &DatasetHistory{Dataset: d.Dataset}
+				datasets[d.Dataset] = dh
+			}
+			dh.Runs++
+			dh.FilesRebalanced += d.FilesRebalanced
+			dh.BytesRebalanced += d.BytesRebalanced
+			dh.FilesSkipped += d.FilesSkipped
+			dh.FilesFailed += d.FilesFailed
+		}
+	}
+
+	for _, d := range datasets {
+		h.Datasets = append(h.Datasets, *d)
+	}
+	sort.Slice(h.Datasets, func(i, j int) bool { return h.Datasets[i].Dataset < h.Datasets[j].Dataset })
+	for _, p := range periods {
+		h.Periods = append(h.Periods, *p)
+	}
+	sort.Slice(h.Periods, func(i, j int) bool { return h.Periods[i].Start.Before(h.Periods[j].Start) })
+	return h
+}
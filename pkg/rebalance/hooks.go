@@ -0,0 +1,152 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Hooks are called around each file that is about to be rewritten, so users can snapshot,
+// notify or record externally per file. Files skipped before copying (pass limit reached,
+// hardlinks, vanished files) do not trigger them.
+type Hooks struct {
+	// PreFile runs before the copy starts
+	PreFile func(ctx context.Context, filePath string) error
+	// PostFile runs once the file is done, whatever the outcome
+	PostFile func(ctx context.Context, filePath string, result FileResult) error
+	// AbortOnPreFileError fails the file instead of rebalancing it when PreFile returns an error
+	AbortOnPreFileError bool
+	// MaxErrors runs once when Config.MaxErrors files have failed, as the run starts
+	// stopping, with the totals so far. It is called from a worker and should not block.
+	MaxErrors func(summary Summary)
+}
+
+// FileResult is the outcome of a file passed to Hooks.PostFile and Config.OnFileResult
+type FileResult struct {
+	Path string
+	// Status is "rebalanced", "skipped", "failed" or "interrupted"; Hooks.PostFile never
+	// sees skipped files
+	Status string
+	Size   int64
+	// Duration is the time spent on the file, 0 for a file interrupted before it started
+	Duration time.Duration
+	// Err is set when Status is "failed" or "interrupted"
+	Err error
+}
+
+// Statuses of FileResult
+const (
+	FileRebalanced  = "rebalanced"
+	FileSkipped     = "skipped"
+	FileFailed      = "failed"
+	FileInterrupted = "interrupted"
+)
+
+// CommandHooks returns Hooks that run shell commands (sh -c, or cmd /C on Windows) with
+// the file path as first argument and in REBALANCE_FILE. The post-file command also gets
+// REBALANCE_STATUS, REBALANCE_SIZE and, on failure, REBALANCE_ERROR. An empty command
+// leaves that hook unset.
+func CommandHooks(preCmd, postCmd string, abortOnPreError bool) Hooks {
+	hooks := Hooks{AbortOnPreFileError: abortOnPreError}
+	if preCmd != "" {
+		hooks.PreFile = func(ctx context.Context, filePath string) error {
+			return runHookCommand(ctx, preCmd, filePath, nil)
+		}
+	}
+	if postCmd != "" {
+		hooks.PostFile = func(ctx context.Context, filePath string, result FileResult) error {
+			env := []string{
+				"REBALANCE_STATUS=" + result.Status,
+				fmt.Sprintf("REBALANCE_SIZE=%d", result.Size),
+			}
+			if result.Err != nil {
+				env = append(env, "REBALANCE_ERROR="+result.Err.Error())
+			}
+			return runHookCommand(ctx, postCmd, filePath, env)
+		}
+	}
+	return hooks
+}
+
+// runHookCommand runs a hook command through the shell and returns its output on failure
+func runHookCommand(ctx context.Context, command, filePath string, env []string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command, filePath)
+	} else {
+		// $0 is the hook name, the file is $1
+		cmd = exec.CommandContext(ctx, "sh", "-c", command, "rebalance-hook", filePath)
+	}
+	cmd.Env = append(os.Environ(), "REBALANCE_FILE="+filePath)
+	cmd.Env = append(cmd.Env, env...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if out := strings.TrimSpace(string(output)); out != "" {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+// runPreFileHook calls Hooks.PreFile and returns an error only if the file should be aborted
+func (r *Rebalancer) runPreFileHook(ctx context.Context, filePath string) error {
+	if r.config.Hooks.PreFile == nil {
+		return nil
+	}
+	err := r.config.Hooks.PreFile(ctx, filePath)
+	if err == nil {
+		return nil
+	}
+	if r.config.Hooks.AbortOnPreFileError {
+		return fmt.Errorf("pre-file hook failed for %s: %w", filePath, err)
+	}
+	r.logger.Warnf("Pre-file hook failed for %s, rebalancing anyway: %v", filePath, err)
+	return nil
+}
+
+// runPostFileHook calls Hooks.PostFile with the outcome of rebalanceFile
+func (r *Rebalancer) runPostFileHook(ctx context.Context, filePath string, size int64, started time.Time, err error) {
+	if r.config.Hooks.PostFile == nil {
+		return
+	}
+
+	result := FileResult{Path: filePath, Status: FileRebalanced, Size: size, Duration: time.Since(started), Err: err}
+	switch {
+	case errors.Is(err, errInterrupted):
+		result.Status = FileInterrupted
+	case err != nil:
+		result.Status = FileFailed
+	}
+
+	// Report aborted files too, even though the caller's context is done
+	if hookErr := r.config.Hooks.PostFile(context.WithoutCancel(ctx), filePath, result); hookErr != nil {
+		r.logger.Warnf("Post-file hook failed for %s: %v", filePath, hookErr)
+	}
+}
+
+// reportFileResult calls Config.OnFileResult with the outcome of a file the run is done with
+func (r *Rebalancer) reportFileResult(filePath string, rebalanced bool, err error, duration time.Duration) {
+	if r.config.OnFileResult == nil {
+		return
+	}
+
+	result := FileResult{Path: filePath, Size: r.sizeOf(filePath), Duration: duration, Err: err}
+	switch {
+	case errors.Is(err, errInterrupted):
+		result.Status = FileInterrupted
+	case err != nil:
+		result.Status = FileFailed
+	case rebalanced:
+		result.Status = FileRebalanced
+	default:
+		result.Status = FileSkipped
+	}
+	r.config.OnFileResult(result)
+}
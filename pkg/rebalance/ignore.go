@@ -0,0 +1,219 @@
+package rebalance
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// IgnoreFileName is the per-directory file listing paths the walk leaves alone
+const IgnoreFileName = ".rebalanceignore"
+
+// ignorePattern is one line of an ignore file
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool // "!pattern" re-includes a path matched by an earlier pattern
+	dirOnly bool // "pattern/" only matches directories
+}
+
+// ignoreFiles caches the parsed ignore file of each directory visited, nil when it has none
+type ignoreFiles struct {
+	mu    sync.Mutex
+	byDir map[string][]ignorePattern
+}
+
+// parseIgnorePatterns parses ignore file lines with gitignore syntax: blank lines and lines
+// starting with '#' are skipped, '!' negates, a trailing '/' matches directories only and
+// a pattern containing another '/' is anchored to the directory of the file. '*' and '?'
+// do not match '/', "**" matches any number of directories. Invalid lines are returned
+// separately.
+func parseIgnorePatterns(lines []string) (patterns []ignorePattern, invalid []string) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{}
+		glob := line
+		if strings.HasPrefix(glob, "!") {
+			p.negate = true
+			glob = glob[1:]
+		} else if strings.HasPrefix(glob, `\`) {
+			// "\#" and "\!" match names starting with those characters
+			glob = glob[1:]
+		}
+		if strings.HasSuffix(glob, "/") {
+			p.dirOnly = true
+			glob = strings.TrimRight(glob, "/")
+		}
+		anchored := strings.Contains(glob, "/")
+		glob = strings.TrimPrefix(glob, "/")
+		if glob == "" {
+			invalid = append(invalid, line)
+			continue
+		}
+		expr := globToRegexp(glob)
+		if !anchored {
+			expr = "(?:.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			invalid = append(invalid, line)
+			continue
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns, invalid
+}
+
+// globToRegexp translates a gitignore glob into a regular expression
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// matchIgnorePatterns returns whether the patterns decide rel, a slash-separated path
+// relative to their directory, and if so whether it is ignored. The last match wins.
+func matchIgnorePatterns(patterns []ignorePattern, rel string, isDir bool) (ignored, matched bool) {
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(rel) {
+			ignored, matched = !p.negate, true
+		}
+	}
+	return ignored, matched
+}
+
+// patternsOf returns the parsed ignore file of dir, loading it on first use
+func (r *Rebalancer) patternsOf(dir string) []ignorePattern {
+	r.ignores.mu.Lock()
+	defer r.ignores.mu.Unlock()
+	if patterns, ok := r.ignores.byDir[dir]; ok {
+		return patterns
+	}
+	if r.ignores.byDir == nil {
+		r.ignores.byDir = make(map[string][]ignorePattern)
+	}
+
+	var patterns []ignorePattern
+	path := filepath.Join(dir, IgnoreFileName)
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		var lines []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			r.logger.Warnf("Failed to read %s: %v", path, err)
+		}
+		f.Close()
+		var invalid []string
+		patterns, invalid = parseIgnorePatterns(lines)
+		for _, line := range invalid {
+			r.logger.Warnf("Ignoring invalid pattern %q in %s", line, path)
+		}
+		r.logger.Infof("Loaded %d patterns from %s", len(patterns), path)
+	case !os.IsNotExist(err):
+		r.logger.Warnf("Cannot read %s: %v", path, err)
+	}
+	r.ignores.byDir[dir] = patterns
+	return patterns
+}
+
+// forgetIgnoreFile drops the cached ignore file of dir, so a changed file is read again
+func (r *Rebalancer) forgetIgnoreFile(dir string) {
+	r.ignores.mu.Lock()
+	defer r.ignores.mu.Unlock()
+	delete(r.ignores.byDir, dir)
+}
+
+// ignoredByFile reports whether the ignore files of the directories from root down to the
+// parent of path exclude it. The deepest ignore file with a matching pattern decides.
+func (r *Rebalancer) ignoredByFile(path, root string, isDir bool) bool {
+	if r.config.NoIgnoreFiles || path == root {
+		return false
+	}
+	var dirs []string
+	for dir := filepath.Dir(path); pathWithin(dir, root); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == root {
+			break
+		}
+	}
+	for _, dir := range dirs {
+		patterns := r.patternsOf(dir)
+		if len(patterns) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			continue
+		}
+		if ignored, matched := matchIgnorePatterns(patterns, filepath.ToSlash(rel), isDir); matched {
+			return ignored
+		}
+	}
+	return false
+}
+
+// ignoredDirOf returns the directory between root and path excluded by an ignore file,
+// if any, for listed files that the walk would not have reached
+func (r *Rebalancer) ignoredDirOf(path, root string) string {
+	if r.config.NoIgnoreFiles {
+		return ""
+	}
+	var dirs []string
+	for dir := filepath.Dir(path); dir != root && pathWithin(dir, root); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	// Check from the top, like the walk prunes
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if r.ignoredByFile(dirs[i], root, true) {
+			return dirs[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package rebalance
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// InodeSet is a list of files identified by inode number, optionally qualified by device,
+// as produced by external tools such as zdb or fanotify-based analyzers
+type InodeSet struct {
+	// exact holds device+inode entries, anyDevice inodes listed without a device
+	exact     map[fileutil.FileID]bool
+	anyDevice map[uint64]bool
+
+	mu    sync.Mutex
+	found map[fileutil.FileID]bool
+	// foundInodes records which device-less entries matched a file
+	foundInodes map[uint64]bool
+}
+
+// LoadInodeSet reads an inode list from a file, "-" meaning standard input
+func LoadInodeSet(path string) (*InodeSet, error) {
+	if path == "-" {
+		return ParseInodeSet(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseInodeSet(f)
+}
+
+// ParseInodeSet parses one entry per line: either "INODE" or "DEVICE INODE", with the
+// device given as the decimal st_dev value (stat -c %d). Blank lines and text after
+// '#' are ignored.
+func ParseInodeSet(r io.Reader) (*InodeSet, error) {
+	s := &InodeSet{
+		exact:       make(map[fileutil.FileID]bool),
+		anyDevice:   make(map[uint64]bool),
+		found:       make(map[fileutil.FileID]bool),
+		foundInodes: make(map[uint64]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			ino, err := strconv.ParseUint(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid inode %q", lineNo, fields[0])
+			}
+			s.anyDevice[ino] = true
+		case 2:
+			dev, err := strconv.ParseUint(fields[0], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid device %q", lineNo, fields[0])
+			}
+			ino, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid inode %q", lineNo, fields[1])
+			}
+			s.exact[fileutil.FileID{Dev: dev, Ino: ino}] = true
+		default:
+			return nil, fmt.Errorf("line %d: expected \"INODE\" or \"DEVICE INODE\"", lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the number of entries in the set
+func (s *InodeSet) Len() int {
+	return len(s.exact) + len(s.anyDevice)
+}
+
+// Contains reports whether a file is listed, and records the match for Unresolved
+func (s *InodeSet) Contains(id fileutil.FileID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exact[id] {
+		s.found[id] = true
+		return true
+	}
+	if s.anyDevice[id.Ino] {
+		s.foundInodes[id.Ino] = true
+		return true
+	}
+	return false
+}
+
+// Unresolved returns the entries that did not match any file seen so far, formatted as in the list
+func (s *InodeSet) Unresolved() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var missing []string
+	for id := range s.exact {
+		if !s.found[id] {
+			missing = append(missing, fmt.Sprintf("%d %d", id.Dev, id.Ino))
+		}
+	}
+	for ino := range s.anyDevice {
+		if !s.foundInodes[ino] {
+			missing = append(missing, strconv.FormatUint(ino, 10))
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// selectedByInode applies the IncludeInodes and ExcludeInodes lists to a gathered file
+func (r *Rebalancer) selectedByInode(path string, info os.FileInfo) bool {
+	if r.config.IncludeInodes == nil && r.config.ExcludeInodes == nil {
+		return true
+	}
+
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		r.logger.Warnf("Cannot identify %s for inode selection: %v", path, err)
+		return r.config.IncludeInodes == nil
+	}
+	if r.config.ExcludeInodes != nil && r.config.ExcludeInodes.Contains(id) {
+		r.logger.Infof("Skipping file excluded by inode list: %s", path)
+		return false
+	}
+	return r.config.IncludeInodes == nil || r.config.IncludeInodes.Contains(id)
+}
+
+// reportUnresolvedInodes logs the included inodes that were not found below the root path
+func (r *Rebalancer) reportUnresolvedInodes() {
+	if r.config.IncludeInodes == nil {
+		return
+	}
+	missing := r.config.IncludeInodes.Unresolved()
+	if len(missing) == 0 {
+		return
+	}
+	r.logger.Warnf("%d of %d listed inodes were not found under %s (deleted, or on another dataset)",
+		len(missing), r.config.IncludeInodes.Len(), strings.Join(r.roots(), ", "))
+	for _, entry := range missing {
+		r.logger.Infof("Unresolved inode: %s", entry)
+	}
+}
@@ -0,0 +1,31 @@
+package rebalance
+
+import (
+	"errors"
+	"os"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/filelocks"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// errFileInUse is returned by rebalanceFile for a file another process holds a lease or
+// mandatory lock on, e.g. Samba for an SMB client with an oplock
+var errFileInUse = errors.New("file in use")
+
+// activeLock returns the lease or mandatory lock another process holds on the file, if
+// the platform exposes it
+func (r *Rebalancer) activeLock(info os.FileInfo) (filelocks.Lock, bool) {
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		return filelocks.Lock{}, false
+	}
+	table, err := filelocks.Read()
+	if err != nil {
+		r.lockTableOnce.Do(func() {
+			r.logger.Warnf("Cannot read the lock table, files in use by clients will not be detected: %v", err)
+		})
+		return filelocks.Lock{}, false
+	}
+	lock, ok := table[filelocks.FileOf(id.Dev, id.Ino)]
+	return lock, ok
+}
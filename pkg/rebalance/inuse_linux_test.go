@@ -0,0 +1,43 @@
+package rebalance
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSkipFileWithLease(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.Concurrency = 1
+
+	f, err := os.Open(testFile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	defer f.Close()
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_SETLEASE, unix.F_RDLCK); err != nil {
+		t.Skipf("Cannot take a lease: %v", err)
+	}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if s := r.Summary(); s.FilesInUse != 1 || s.FilesSkipped != 1 || s.FilesFailed != 0 {
+		t.Errorf("Expected the leased file to be skipped as in use, got %+v", s)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the leased file not to be rebalanced, got count %d", count)
+	}
+
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_SETLEASE, unix.F_UNLCK); err != nil {
+		t.Fatalf("Failed to release the lease: %v", err)
+	}
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the released file to be rebalanced, got count %d", count)
+	}
+}
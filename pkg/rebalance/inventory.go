@@ -0,0 +1,59 @@
+package rebalance
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+)
+
+// Scan walks the root paths once and records the files a run would process, with their
+// size and dataset, as the inventory of the database, replacing what an earlier scan of
+// the same roots recorded. A run with Config.Files set from InventoryFiles then works
+// through them without walking the tree again. It returns the number of files and
+// bytes recorded.
+func (r *Rebalancer) Scan() (int, int64, error) {
+	if r.db.ReadOnly {
+		return 0, 0, errors.New("cannot record an inventory in a read-only database")
+	}
+	files, err := r.GatherFiles()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to gather files: %w", err)
+	}
+
+	now := time.Now()
+	entries := make([]database.InventoryEntry, 0, len(files))
+	var total int64
+	for _, f := range files {
+		size := r.sizeOf(f)
+		total += size
+		entries = append(entries, database.InventoryEntry{FilePath: f, Size: size, Dataset: r.filesystemOf(f), ScannedAt: now})
+	}
+	if err := r.db.ReplaceInventory(r.roots(), entries); err != nil {
+		return 0, 0, fmt.Errorf("cannot record the inventory: %w", err)
+	}
+	return len(entries), total, nil
+}
+
+// InventoryFiles returns the files a scan recorded below roots, for Config.Files, and when
+// the oldest of them was scanned. Scanning none is an error, as the run would otherwise
+// silently do nothing.
+func InventoryFiles(db *database.DB, roots []string) ([]string, time.Time, error) {
+	entries, err := db.Inventory(roots)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot read the inventory: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, time.Time{}, errors.New("no inventory below the paths: run rebalance scan first")
+	}
+	files := make([]string, len(entries))
+	oldest := entries[0].ScannedAt
+	for i, e := range entries {
+		files[i] = e.FilePath
+		if e.ScannedAt.Before(oldest) {
+			oldest = e.ScannedAt
+		}
+	}
+	return files, oldest, nil
+}
@@ -0,0 +1,67 @@
+package rebalance
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueueLatency summarizes how long files waited in the queue before a worker started
+// them. A long tail while most files start quickly points at parts of the tree being
+// starved, e.g. by huge files holding every worker of a dataset.
+type QueueLatency struct {
+	// Starts counts the files started; a requeued file counts again, with its wait
+	// measured from the requeue
+	Starts int64
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+	// MaxFile is the file that waited longest
+	MaxFile string
+}
+
+// latencyRecorder collects queue waits for QueueLatency
+type latencyRecorder struct {
+	mu      sync.Mutex
+	waits   []time.Duration
+	max     time.Duration
+	maxFile string
+}
+
+// record adds the wait of a file that was just started
+func (l *latencyRecorder) record(filePath string, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waits = append(l.waits, wait)
+	if wait >= l.max {
+		l.max, l.maxFile = wait, filePath
+	}
+}
+
+// summary returns the percentiles of the waits recorded so far, nil if there are none
+func (l *latencyRecorder) summary() *QueueLatency {
+	l.mu.Lock()
+	waits := append([]time.Duration(nil), l.waits...)
+	max, maxFile := l.max, l.maxFile
+	l.mu.Unlock()
+	if len(waits) == 0 {
+		return nil
+	}
+
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	return &QueueLatency{
+		Starts:  int64(len(waits)),
+		P50:     percentile(waits, 50),
+		P90:     percentile(waits, 90),
+		P99:     percentile(waits, 99),
+		Max:     max,
+		MaxFile: maxFile,
+	}
+}
+
+// percentile returns the p-th percentile of sorted, by the nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (len(sorted)*p + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
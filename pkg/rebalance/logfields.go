@@ -0,0 +1,40 @@
+package rebalance
+
+import (
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields attached to the per-file log entries, so formatters and log shippers don't
+// have to parse messages. report.ReadEvents parses them from JSON logs.
+const (
+	// FieldOperation is one of the Op constants
+	FieldOperation = report.FieldOperation
+	// FieldPath is the file the operation applies to, FieldTarget the destination of copies and renames
+	FieldPath   = report.FieldPath
+	FieldTarget = report.FieldTarget
+	// FieldBytes is the logical size of the file
+	FieldBytes = report.FieldBytes
+	// FieldSpeed is the copy speed in MiB/s, whatever Config.Units says
+	FieldSpeed = report.FieldSpeed
+	// FieldShowFullPaths mirrors Config.ShowFullPaths for formatters that shorten paths
+	FieldShowFullPaths = "show_full_paths"
+)
+
+// Operations reported in FieldOperation
+const (
+	OpCopy       = report.OpCopy
+	OpRemove     = report.OpRemove
+	OpRename     = report.OpRename
+	OpRebalanced = report.OpRebalanced
+	OpFailed     = report.OpFailed
+)
+
+// fileLog returns a log entry carrying the operation and path fields
+func (r *Rebalancer) fileLog(operation, filePath string) *log.Entry {
+	return r.logger.WithFields(log.Fields{
+		FieldOperation:     operation,
+		FieldPath:          filePath,
+		FieldShowFullPaths: r.config.ShowFullPaths,
+	})
+}
@@ -0,0 +1,125 @@
+package rebalance
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// MetadataDegradation is a class of metadata a filesystem could not preserve
+type MetadataDegradation struct {
+	// Filesystem is the mounted source, or the mount point if the mount table is unavailable
+	Filesystem string
+	Class      fileutil.MetadataClass
+	// Files counts the rewritten files that lost metadata of this class
+	Files int64
+}
+
+// degradationKey identifies a MetadataDegradation
+type degradationKey struct {
+	filesystem string
+	class      fileutil.MetadataClass
+}
+
+// preserveMetadata copies the extended attributes, ACLs, file flags and birth time of
+// filePath to its temporary copy; on macOS the extended attributes include the Finder info, quarantine and
+// resource fork. Metadata the filesystem does not support is recorded and the copy kept;
+// any other failure is returned, so the original is not replaced by a copy missing metadata.
+// A birth time that cannot be set is always recorded, never returned.
+func (r *Rebalancer) preserveMetadata(filePath, tmpFilePath string) error {
+	failures, err := fileutil.CopyXattrs(filePath, tmpFilePath)
+	if err != nil {
+		return err
+	}
+	for _, copyMeta := range []func(src, dst string) (*fileutil.MetadataError, error){
+		fileutil.CopyFileFlags, fileutil.CopyBirthTime,
+	} {
+		failure, err := copyMeta(filePath, tmpFilePath)
+		if err != nil {
+			return err
+		}
+		if failure != nil {
+			failures = append(failures, failure)
+		}
+	}
+
+	lost := make(map[fileutil.MetadataClass]bool)
+	for _, f := range failures {
+		if !f.Unsupported {
+			return f
+		}
+		lost[f.Class] = true
+	}
+	for class := range lost {
+		r.recordDegradation(r.filesystemOf(filePath), class, filePath)
+	}
+	return nil
+}
+
+// recordDegradation counts a file that lost a class of metadata, warning only the first
+// time a filesystem turns out not to support the class
+func (r *Rebalancer) recordDegradation(filesystem string, class fileutil.MetadataClass, filePath string) {
+	key := degradationKey{filesystem: filesystem, class: class}
+
+	r.degradationsMutex.Lock()
+	if r.degradations == nil {
+		r.degradations = make(map[degradationKey]int64)
+	}
+	_, seen := r.degradations[key]
+	r.degradations[key]++
+	r.degradationsMutex.Unlock()
+
+	if !seen {
+		r.logger.Warnf("%s does not support %s, continuing without preserving them (first file: %s)", filesystem, class, filePath)
+		return
+	}
+	r.logger.Infof("%s of %s not preserved", class, filePath)
+}
+
+// unsupportedMetadata returns the recorded degradations, sorted by filesystem and class
+func (r *Rebalancer) unsupportedMetadata() []MetadataDegradation {
+	r.degradationsMutex.Lock()
+	defer r.degradationsMutex.Unlock()
+
+	var list []MetadataDegradation
+	for key, files := range r.degradations {
+		list = append(list, MetadataDegradation{Filesystem: key.filesystem, Class: key.class, Files: files})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Filesystem != list[j].Filesystem {
+			return list[i].Filesystem < list[j].Filesystem
+		}
+		return list[i].Class < list[j].Class
+	})
+	return list
+}
+
+// filesystemOf names the filesystem holding path: the source of the innermost root or
+// processed nested mount containing it, or the root path itself if its mount is unknown
+func (r *Rebalancer) filesystemOf(path string) string {
+	r.nestedMounts()
+	name, depth := "", -1
+	consider := func(dir, source string) {
+		if n := len(dir); n > depth && pathWithin(path, filepath.Clean(dir)) {
+			name, depth = source, n
+		}
+	}
+	for _, rf := range r.rootFilesystems {
+		source := rf.path
+		if rf.found {
+			source = rf.mount.Source
+		}
+		consider(rf.path, source)
+	}
+	for _, nm := range r.mounts {
+		consider(nm.walkPath, nm.mount.Source)
+	}
+	if name == "" {
+		if root, ok := r.rootOf(path); ok {
+			return root
+		}
+		return filepath.Dir(path)
+	}
+	return name
+}
@@ -0,0 +1,200 @@
+package rebalance
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/mounts"
+)
+
+// nestedMount is a filesystem mounted below a root path
+type nestedMount struct {
+	mount    mounts.Mount
+	walkPath string // mount point as reached through its root path
+	foreign  bool   // bind mount, other filesystem type or other pool
+	included bool   // explicitly included with IncludeMounts
+	skipped  bool   // left out of the walk: foreign, or any with OneFileSystem, and not included
+}
+
+// rootFilesystem is the filesystem holding a root path
+type rootFilesystem struct {
+	path  string
+	mount mounts.Mount
+	found bool
+}
+
+// nestedMounts enumerates the mount table once and classifies the mounts below the root paths
+func (r *Rebalancer) nestedMounts() []nestedMount {
+	r.mountsOnce.Do(func() {
+		all, err := mounts.List()
+		if err != nil {
+			r.logger.Warnf("Cannot enumerate mounts, nested mounts will not be skipped: %v", err)
+			return
+		}
+
+		included := make(map[string]bool)
+		for _, p := range r.config.IncludeMounts {
+			included[canonicalPath(p)] = true
+		}
+
+		excluded := make(map[string]bool)
+		for i, rootPath := range r.roots() {
+			root := canonicalPath(rootPath)
+			parent, ok := mounts.Containing(all, root)
+			r.rootFilesystems = append(r.rootFilesystems, rootFilesystem{path: rootPath, mount: parent, found: ok})
+			if !ok {
+				continue
+			}
+			if i == 0 {
+				r.rootMount = parent
+				r.rootMountFound = true
+			}
+
+			for _, m := range mounts.Nested(all, root) {
+				rel, err := filepath.Rel(root, m.Path)
+				if err != nil {
+					continue
+				}
+				nm := nestedMount{
+					mount:    m,
+					walkPath: filepath.Join(rootPath, rel),
+					foreign:  mounts.IsForeign(m, parent),
+					included: included[m.Path],
+				}
+				nm.skipped = (nm.foreign || r.config.OneFileSystem) && !nm.included
+				if nm.skipped {
+					excluded[nm.walkPath] = true
+				}
+				r.mounts = append(r.mounts, nm)
+			}
+		}
+		r.excludedMounts = excluded
+	})
+	return r.mounts
+}
+
+// rootsOnPool returns the root paths whose filesystem belongs to pool
+func (r *Rebalancer) rootsOnPool(pool string) []string {
+	r.nestedMounts()
+	var roots []string
+	for _, rf := range r.rootFilesystems {
+		if rf.found && rf.mount.Pool() == pool {
+			roots = append(roots, rf.path)
+		}
+	}
+	return roots
+}
+
+// isExcludedMount reports whether the walk should not descend into dir
+func (r *Rebalancer) isExcludedMount(dir string) bool {
+	r.nestedMounts()
+	return r.excludedMounts[dir]
+}
+
+// poolKey names the pool of a mount: the ZFS pool, or the mounted source for other filesystems
+func poolKey(m mounts.Mount) string {
+	if pool := m.Pool(); pool != "" {
+		return pool
+	}
+	return m.Source
+}
+
+// poolsByDevice maps the device of each root path and of each processed nested mount to
+// its pool. Files on other devices are assigned to defaultPool, the pool of the first root.
+func (r *Rebalancer) poolsByDevice() (pools map[uint64]string, defaultPool string) {
+	r.nestedMounts()
+	if !r.rootMountFound {
+		return nil, ""
+	}
+
+	pools = make(map[uint64]string)
+	add := func(path string, m mounts.Mount) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+			pools[id.Dev] = poolKey(m)
+		}
+	}
+	for _, rf := range r.rootFilesystems {
+		if rf.found {
+			add(rf.path, rf.mount)
+		}
+	}
+	for _, nm := range r.mounts {
+		if !nm.skipped {
+			add(nm.walkPath, nm.mount)
+		}
+	}
+	return pools, poolKey(r.rootMount)
+}
+
+// crossesFilesystem reports whether a path found by the walk is on a device other than
+// those of the root paths and included mounts, with Config.OneFileSystem
+func (r *Rebalancer) crossesFilesystem(info os.FileInfo) bool {
+	if !r.config.OneFileSystem {
+		return false
+	}
+	r.walkDevicesOnce.Do(func() {
+		r.walkDevices = make(map[uint64]bool)
+		paths := r.roots()
+		for _, nm := range r.nestedMounts() {
+			if nm.included {
+				paths = append(paths, nm.walkPath)
+			}
+		}
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+					r.walkDevices[id.Dev] = true
+				}
+			}
+		}
+	})
+	if len(r.walkDevices) == 0 {
+		// Devices are unknown on this platform
+		return false
+	}
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	return err == nil && !r.walkDevices[id.Dev]
+}
+
+// canonicalPath returns an absolute path with symlinks resolved, falling back to the cleaned input
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// Preflight reports conditions worth knowing before any file is touched,
+// such as foreign filesystems mounted below the root paths
+func (r *Rebalancer) Preflight() error {
+	if err := r.checkRoots(); err != nil {
+		return err
+	}
+	r.reportFlashWrites()
+	if r.config.ChownEarly {
+		r.reportQuotaShortfalls()
+	}
+
+	for _, nm := range r.nestedMounts() {
+		switch {
+		case nm.included && nm.foreign:
+			r.logger.Warnf("Including nested foreign mount: %s", nm.mount)
+		case !nm.skipped:
+			r.logger.Infof("Nested dataset will be processed: %s", nm.mount)
+		case nm.foreign:
+			r.logger.Warnf("Skipping nested foreign mount: %s (use --include-mount %s to process it)", nm.mount, nm.walkPath)
+		default:
+			r.logger.Infof("Skipping nested dataset with --one-file-system: %s (use --include-mount %s to process it)", nm.mount, nm.walkPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package rebalance
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/ratelimit"
+	"github.com/astundzia/go-zfs-rebalance/internal/sysinfo"
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+)
+
+const (
+	// dirtyPauseAt and dirtyResumeAt are the fractions of the dirty limit at which copies
+	// pause and resume. ZFS starts delaying every writer at 60% of zfs_dirty_data_max.
+	dirtyPauseAt  = 0.5
+	dirtyResumeAt = 0.25
+	// dirtySampleInterval is how often the dirty level is read while copying
+	dirtySampleInterval = 100 * time.Millisecond
+	// dirtyMaxPause bounds one pause, so copies still progress if the level stays high
+	dirtyMaxPause = 10 * time.Second
+)
+
+// openDirtyPacer returns a pacer that holds copies back while much data is waiting to be
+// written out: the dirty data of the pool holding the first root path, or the dirty page
+// cache when that is not available. It returns nil if PaceDirty is off or neither level
+// can be read.
+func (r *Rebalancer) openDirtyPacer() *ratelimit.Pacer {
+	if !r.config.PaceDirty {
+		return nil
+	}
+
+	r.nestedMounts()
+	var sample func() (uint64, uint64, error)
+	var source string
+	if pool := r.rootMount.Pool(); r.rootMountFound && pool != "" {
+		if _, _, err := zpool.DirtyData(pool); err == nil {
+			sample = func() (uint64, uint64, error) { return zpool.DirtyData(pool) }
+			source = fmt.Sprintf("dirty data of pool %s", pool)
+		} else {
+			r.logger.Infof("Dirty data of pool %s unavailable, pacing by the page cache: %v", pool, err)
+		}
+	}
+	if sample == nil {
+		if _, _, err := sysinfo.DirtyPages(); err != nil {
+			r.logger.Infof("Dirty data pacing unavailable: %v", err)
+			return nil
+		}
+		sample = sysinfo.DirtyPages
+		source = "dirty page cache"
+	}
+
+	r.logger.Infof("Pacing copies by the %s: pausing at %.0f%% of its limit, resuming below %.0f%%",
+		source, dirtyPauseAt*100, dirtyResumeAt*100)
+	return &ratelimit.Pacer{
+		Sample:   sample,
+		High:     dirtyPauseAt,
+		Low:      dirtyResumeAt,
+		Interval: dirtySampleInterval,
+		MaxPause: dirtyMaxPause,
+	}
+}
+
+// limiterChain waits for each of its limiters in turn
+type limiterChain []fileutil.Limiter
+
+func (c limiterChain) Wait(n int) error {
+	for _, l := range c {
+		if err := l.Wait(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limiter returns the chain as a single limiter, nil if it is empty
+func (c limiterChain) limiter() fileutil.Limiter {
+	switch len(c) {
+	case 0:
+		return nil
+	case 1:
+		return c[0]
+	default:
+		return c
+	}
+}
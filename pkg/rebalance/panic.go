@@ -0,0 +1,48 @@
+package rebalance
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// tempCopy is how far the replacement of a file by its temporary copy got, so a panic
+// can leave the file in one piece
+type tempCopy struct {
+	path string
+	// originalRemoved is set once the original is gone and the copy has to take its place
+	originalRemoved bool
+	// replaced is set once the copy has been renamed over the original
+	replaced bool
+}
+
+// recoverFile turns a panic while rebalancing filePath into an error so the run carries
+// on with the other files. A copy made before the original was removed is deleted; a
+// copy that already stands in for a removed original is renamed into place.
+// It must be deferred directly, as recover only works there.
+func (r *Rebalancer) recoverFile(filePath string, tmp *tempCopy, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	r.fileLog(OpFailed, filePath).Errorf("Panic while rebalancing %s: %v\n%s", filePath, v, debug.Stack())
+
+	switch {
+	case tmp.replaced:
+	case tmp.originalRemoved:
+		rename := auditEntry{op: auditRename, path: tmp.path, target: filePath, size: -1}
+		if auditErr := r.audit(rename); auditErr != nil {
+			r.logger.Errorf("Audit log: %v", auditErr)
+		}
+		if renameErr := os.Rename(tmp.path, filePath); renameErr != nil {
+			r.auditFailed(rename, renameErr)
+			*err = fmt.Errorf("CRITICAL: panic after removing %s and the copy could not be renamed, data left in %s: %v", filePath, tmp.path, v)
+			return
+		}
+	default:
+		if removeErr := os.Remove(tmp.path); removeErr != nil && !os.IsNotExist(removeErr) {
+			r.logger.Errorf("Failed to remove %s after a panic: %v", tmp.path, removeErr)
+		}
+	}
+	*err = fmt.Errorf("panic while rebalancing %s: %v", filePath, v)
+}
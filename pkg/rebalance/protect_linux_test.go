@@ -0,0 +1,108 @@
+package rebalance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// setInodeFlags sets the chattr flags of path
+func setInodeFlags(t *testing.T, path string, flags int) error {
+	t.Helper()
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, flags)
+}
+
+// inodeFlags returns the chattr flags of path
+func inodeFlags(t *testing.T, path string) uint32 {
+	t.Helper()
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		t.Fatalf("Failed to read the flags of %s: %v", path, err)
+	}
+	return flags
+}
+
+func TestSkipImmutableFile(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.Concurrency = 1
+
+	const immutable = 0x10 // FS_IMMUTABLE_FL
+	if err := setInodeFlags(t, testFile, immutable); err != nil {
+		t.Skipf("Cannot set the immutable flag: %v", err)
+	}
+	// The temporary directory cannot be removed with the flag set
+	defer setInodeFlags(t, testFile, 0)
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	s := r.Summary()
+	if s.FilesProtected != 1 || s.FilesSkipped != 1 || s.FilesFailed != 0 {
+		t.Errorf("Expected the immutable file to be skipped, got %+v", s)
+	}
+	if by := r.Stats().SkippedBy[SkipProtected]; by != 1 {
+		t.Errorf("Expected 1 file skipped as immutable, got %d", by)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the immutable file not to be rebalanced, got count %d", count)
+	}
+
+	r.config.ClearProtection = true
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the immutable file to be rebalanced with ClearProtection, got count %d", count)
+	}
+	if flags := inodeFlags(t, testFile); flags&immutable == 0 {
+		t.Errorf("Expected the new copy to be immutable again, got flags %#x", flags)
+	}
+}
+
+func TestRestoreProtectionAfterCrash(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	auditLog, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	defer auditLog.Close()
+	r.config.AuditLog = auditLog
+
+	const immutable = 0x10 // FS_IMMUTABLE_FL
+	if err := setInodeFlags(t, testFile, immutable); err != nil {
+		t.Skipf("Cannot set the immutable flag: %v", err)
+	}
+	if err := setInodeFlags(t, testFile, 0); err != nil {
+		t.Fatalf("Cannot clear the immutable flag: %v", err)
+	}
+
+	// A run cleared the flag and removed the original, then died before the rename
+	tmpPath := testFile + DefaultTempSuffix
+	if err := os.Rename(testFile, tmpPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.audit(auditEntry{op: auditRemove, path: testFile, size: -1, protection: "immutable"}); err != nil {
+		t.Fatalf("audit failed: %v", err)
+	}
+	if err := r.cleanupBalanceFiles(); err != nil {
+		t.Fatalf("cleanupBalanceFiles failed: %v", err)
+	}
+	defer setInodeFlags(t, testFile, 0)
+	if flags := inodeFlags(t, testFile); flags&immutable == 0 {
+		t.Errorf("Expected the restored copy to be immutable again, got flags %#x", flags)
+	}
+}
@@ -0,0 +1,173 @@
+package rebalance
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+)
+
+// ownerKey is a user or group of a dataset
+type ownerKey struct {
+	dataset string
+	id      uint32
+}
+
+// ownerUsage is the space the files of one owner need for their copies
+type ownerUsage struct {
+	largest int64
+}
+
+// QuotaShortfall is an owner whose quota leaves less room than its largest file, so
+// copies charged to it can fail with "disk quota exceeded"
+type QuotaShortfall struct {
+	Dataset string
+	// Group is set when ID is a group rather than a user
+	Group bool
+	ID    uint32
+	// Free is the room left under the quota, Largest the largest file of the owner
+	Free    int64
+	Largest int64
+}
+
+// QuotaShortfalls compares the user and group quotas of the ZFS datasets below the root
+// paths against the largest file each owner has there. With ChownEarly a copy counts
+// against its owner while it is written, and as several files of an owner may be copied
+// at once, the headroom needed is at least the largest file.
+func (r *Rebalancer) QuotaShortfalls() ([]QuotaShortfall, error) {
+	datasets := r.datasetsByDevice()
+	if len(datasets) == 0 {
+		return nil, nil
+	}
+	users, groups, err := r.scanOwners(datasets)
+	if err != nil {
+		return nil, err
+	}
+
+	var shortfalls []QuotaShortfall
+	check := func(usage map[ownerKey]*ownerUsage, group bool, list func(string) ([]zpool.Quota, error)) error {
+		queried := make(map[string]bool)
+		for key := range usage {
+			if queried[key.dataset] {
+				continue
+			}
+			queried[key.dataset] = true
+			quotas, err := list(key.dataset)
+			if err != nil {
+				return err
+			}
+			for _, q := range quotas {
+				u, ok := usage[ownerKey{dataset: key.dataset, id: q.ID}]
+				if !ok || q.Limit == 0 {
+					continue
+				}
+				free := int64(q.Limit) - int64(q.Used)
+				if free < u.largest {
+					shortfalls = append(shortfalls, QuotaShortfall{
+						Dataset: key.dataset, Group: group, ID: q.ID, Free: max(free, 0), Largest: u.largest,
+					})
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(users, false, zpool.UserQuotas); err != nil {
+		return nil, err
+	}
+	if err := check(groups, true, zpool.GroupQuotas); err != nil {
+		return nil, err
+	}
+	return shortfalls, nil
+}
+
+// datasetsByDevice maps the device of each root path and processed nested mount on ZFS to its dataset
+func (r *Rebalancer) datasetsByDevice() map[uint64]string {
+	r.nestedMounts()
+	datasets := make(map[uint64]string)
+	add := func(path, fsType, source string) {
+		if fsType != "zfs" {
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+			datasets[id.Dev] = source
+		}
+	}
+	for _, rf := range r.rootFilesystems {
+		if rf.found {
+			add(rf.path, rf.mount.FSType, rf.mount.Source)
+		}
+	}
+	for _, nm := range r.mounts {
+		if !nm.skipped {
+			add(nm.walkPath, nm.mount.FSType, nm.mount.Source)
+		}
+	}
+	return datasets
+}
+
+// scanOwners walks the root paths and records the largest file of each user and group
+// per dataset
+func (r *Rebalancer) scanOwners(datasets map[uint64]string) (users, groups map[ownerKey]*ownerUsage, err error) {
+	users = make(map[ownerKey]*ownerUsage)
+	groups = make(map[ownerKey]*ownerUsage)
+	record := func(owners map[ownerKey]*ownerUsage, key ownerKey, size int64) {
+		u := owners[key]
+		if u == nil {
+			u = &ownerUsage{}
+			owners[key] = u
+		}
+		u.largest = max(u.largest, size)
+	}
+
+	naming := r.tempNaming()
+	err = r.walkRoots(func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return nil
+		}
+		if info.IsDir() && (r.isExcludedMount(path) || r.crossesFilesystem(info)) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || naming.isTemp(path) {
+			return nil
+		}
+		id, err := fileutil.GetFileIDFromFileInfo(info)
+		if err != nil {
+			return nil
+		}
+		dataset, ok := datasets[id.Dev]
+		if !ok {
+			return nil
+		}
+		uid, gid, err := fileutil.GetOwner(info)
+		if err != nil {
+			return nil
+		}
+		record(users, ownerKey{dataset: dataset, id: uid}, info.Size())
+		record(groups, ownerKey{dataset: dataset, id: gid}, info.Size())
+		return nil
+	})
+	return users, groups, err
+}
+
+// reportQuotaShortfalls warns about owners whose early-chowned copies may exceed their quota
+func (r *Rebalancer) reportQuotaShortfalls() {
+	shortfalls, err := r.QuotaShortfalls()
+	if err != nil {
+		r.logger.Warnf("Cannot check quota headroom: %v", err)
+		return
+	}
+	size := func(n int64) string { return r.config.Units.Size(uint64(n)) }
+	for _, s := range shortfalls {
+		kind := "User"
+		if s.Group {
+			kind = "Group"
+		}
+		r.logger.Warnf("%s %d has %s left under its quota on %s, less than its largest file (%s): its copies may fail with \"disk quota exceeded\"",
+			kind, s.ID, size(s.Free), s.Dataset, size(s.Largest))
+	}
+}
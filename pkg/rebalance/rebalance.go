@@ -1,65 +1,425 @@
 package rebalance
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/rand"
+	"hash"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/astundzia/go-zfs-rebalance/internal/accesswatch"
 	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
 	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/mounts"
+	"github.com/astundzia/go-zfs-rebalance/internal/scheduler"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
 	log "github.com/sirupsen/logrus"
 )
 
 // Config holds configuration for the rebalance operation
 type Config struct {
-	SkipHardlinks       bool
-	PassesLimit         int
-	Concurrency         int
-	RootPath            string
+	SkipHardlinks bool
+	PassesLimit   int
+	Concurrency   int
+	RootPath      string
+	// RootPaths lists several trees processed by one worker pool with shared progress,
+	// database and summary; RootPath is used when it is empty
+	RootPaths           []string
 	Logger              *log.Logger
 	CleanupBalanceFiles bool
-	RandomOrder         bool
-	SizeThresholdMB     int
-	ChecksumType        fileutil.ChecksumType
-	HaltOnFileMissing   bool
-	ShowFullPaths       bool
+	// Order is the order files are processed in; directory order if empty
+	Order Order
+	// RandomOrder processes the files in random order when Order is empty.
+	//
+	// Deprecated: set Order to OrderRandom.
+	RandomOrder bool
+	// Passes is the number of passes Run makes over the files, one if 0; files that
+	// reached PassesLimit are skipped in each, and no further pass starts once none is
+	// left below it. Every pass walks the root paths again, or with ReuseFileList
+	// processes the files of the first one again. ShufflePasses puts the files of the
+	// passes after the first in a new random order, whatever Order is.
+	Passes        int
+	ReuseFileList bool
+	ShufflePasses bool
+	// TempSuffix is appended to the name of the temporary copy of a file, DefaultTempSuffix
+	// if empty. TempSubdir puts the copies into a hidden TempSubdirName directory next to
+	// their originals instead, which is removed again once empty; only the files in such
+	// directories are then treated as temporary copies. The cleanup of stale copies
+	// follows the same naming, so copies made with another one are not found.
+	TempSuffix string
+	TempSubdir bool
+	// MinExtents skips files laid out in fewer extents as already balanced, as rewriting
+	// a contiguous file gains nothing; 0 rewrites every file. Files whose extents cannot
+	// be mapped, such as on OpenZFS, are never skipped.
+	MinExtents int
+	// ReserveFree is the free space copies leave on the filesystem of their file. A copy
+	// that would cut into it waits for the copies in progress on the same filesystem, or
+	// is skipped when there are none.
+	ReserveFree SpaceReserve
+	// SizeThreshold logs the success of files smaller than this many bytes at debug level
+	// only, 0 = log every file
+	SizeThreshold int64
+	// SizeThresholdMB is SizeThreshold in MiB, used when SizeThreshold is 0.
+	//
+	// Deprecated: set SizeThreshold.
+	SizeThresholdMB int
+	// MinSize and MaxSize limit the run to files of at least and at most this many bytes,
+	// 0 = no limit
+	MinSize int64
+	MaxSize int64
+	// Since, if set, limits the run to files modified at or after it, for incremental
+	// runs over mostly static trees
+	Since time.Time
+	// SkipLargerThan, above 0, leaves files larger than this many bytes out of the run like
+	// MaxSize, but logs each of them and counts them in Summary.FilesTooLarge, so files
+	// too large for a routine run can be handled in a maintenance window
+	SkipLargerThan int64
+	ChecksumType   fileutil.ChecksumType
+	// ChecksumBySize overrides ChecksumType for files of at least a given size, e.g. a
+	// faster hash for large media files
+	ChecksumBySize []ChecksumRule
+	// HashWorkers, above 0, caps the files hashed at once to spare the CPU: copies hashed
+	// as they are written, read-backs and checks of stored checksums wait for a slot
+	HashWorkers       int
+	HaltOnFileMissing bool
+	ShowFullPaths     bool
+	// Units selects binary or SI units, and bytes or bits for rates, in log messages
+	Units           units.Units
+	PreserveSparse  bool
+	RelinkHardlinks bool
+	// ClearProtection processes the files with immutable or append-only flags by clearing
+	// them for the replacement and setting them again on the new copy; such files are
+	// skipped otherwise
+	ClearProtection bool
+	// CacheBypass keeps the data of the copies out of the caches of the operating system,
+	// so rewriting a large tree does not evict the data other applications keep cached
+	CacheBypass fileutil.CacheBypass
+	// IOEngine moves the data of the copies, fileutil.IOEngineSync when empty
+	IOEngine fileutil.IOEngine
+	// ParallelCopy, above 1, copies files of at least ParallelCopyMinSize with this many
+	// streams each reading and writing its own chunks, so a single huge file is not limited
+	// to one request in flight
+	ParallelCopy        int
+	ParallelCopyMinSize int64
+	// MaxWorkersPerDataset caps concurrent files per dataset (filesystem device), 0 = unlimited
+	MaxWorkersPerDataset int
+	// MaxWorkersPerPool caps concurrent files per pool when the root and included nested
+	// mounts span several pools, 0 = unlimited
+	MaxWorkersPerPool int
+	// IncludeMounts lists nested foreign mount points that should be processed instead of skipped
+	IncludeMounts []string
+	// OneFileSystem keeps the walk on the filesystems of the root paths: nested datasets of
+	// the same pool are skipped too, unless listed in IncludeMounts, and so is any directory
+	// on another device, including mount points the mount table does not list
+	OneFileSystem bool
+	// NoIgnoreFiles disables the .rebalanceignore files that otherwise prune matching
+	// files and directories from the walk
+	NoIgnoreFiles bool
+	// BackgroundVerify records checksums of rebalanced files and re-checks stored checksums
+	// of files not scheduled for rewriting while workers are idle
+	BackgroundVerify bool
+	// RecordChecksums stores the checksum of every rebalanced file for later verify-only runs
+	RecordChecksums bool
+	// NoVerify skips the checksum comparison of each copy and relies on ZFS's own checksums
+	NoVerify bool
+	// NoSync skips flushing each copy and its directory to disk before the original is
+	// removed, leaving a window where a power loss loses a file whose copy was only cached
+	NoSync bool
+	// VerifyReadback re-reads the original after copying instead of hashing it while it
+	// is copied; the copy is read back from disk either way
+	VerifyReadback bool
+	// VerifyAfterReplace hashes each file again once its copy took the place of the
+	// original, and compares it with the digest of the copy. The size, identity, mode and
+	// modification time of the replaced file are checked regardless.
+	VerifyAfterReplace bool
+	// TempFileTimeout is how long a .balance file may go without progress before the
+	// watchdog warns about it, 0 = no watchdog
+	TempFileTimeout time.Duration
+	// RequeueStalled cancels the copy of a stalled file and puts it back in the queue
+	RequeueStalled bool
+	// Files, if set, replaces the scan of the root paths with this list, processed in its
+	// order; every file must lie below a root path
+	Files []string
+	// OrderListedFiles applies Order to Files too, for lists such as an inventory whose
+	// own order means nothing
+	OrderListedFiles bool
+	// IncludeInodes limits the run to the listed files, ExcludeInodes skips the listed files
+	IncludeInodes *InodeSet
+	ExcludeInodes *InodeSet
+	// Retries is how many times a copy, remove or rename failing with a transient error
+	// (EBUSY, stale NFS handle, permission race...) is retried, RetryBackoff the first wait
+	// between attempts, doubled after each retry
+	Retries      int
+	RetryBackoff time.Duration
+	// PoolBandwidth caps the combined copy rate in bytes per second of every instance
+	// working on the same pool, coordinated through a state file in BandwidthStateDir;
+	// 0 = unlimited
+	PoolBandwidth     int64
+	BandwidthStateDir string
+	// PoolBandwidthMBps is PoolBandwidth in MiB per second, used when PoolBandwidth is 0.
+	//
+	// Deprecated: set PoolBandwidth.
+	PoolBandwidthMBps int
+	// Hooks are called before and after each file that is rewritten
+	Hooks Hooks
+	// OnFileResult, if set, is called with the outcome of every file a run is done with,
+	// skipped ones included. It is called from the workers, concurrently, and should not
+	// block.
+	OnFileResult func(FileResult)
+	// AuditLog, if set, records every removal and rename before it happens
+	AuditLog *AuditLog
+	// SSDWriteBudget warns at preflight when the estimated bytes written to flash vdevs exceed it, 0 = no budget
+	SSDWriteBudget int64
+	// SSDWriteBudgetGB is SSDWriteBudget in GiB, used when SSDWriteBudget is 0.
+	//
+	// Deprecated: set SSDWriteBudget.
+	SSDWriteBudgetGB int
+	// ReportFiles keeps the outcome of every processed file for Report
+	ReportFiles bool
+	// MaxErrors stops the run once this many files have failed, on the assumption that
+	// something systemic such as a dying disk is wrong; 0 = no limit
+	MaxErrors int
+	// PaceDirty pauses copies while the pool (or page cache) holds much dirty data waiting
+	// to be written out, so other applications don't stall on a full write backlog
+	PaceDirty bool
+	// ChownEarly gives each temporary copy the owner of its file as soon as it is created,
+	// so user and group quotas charge the copy to the right owner while it is written
+	ChownEarly bool
+	// DeferOpenedWithin puts files another process opened within this window off to the
+	// end of the pass, once, to stay out of the way of active workloads; 0 = disabled.
+	// Opens are watched with fanotify, on Linux only and with CAP_SYS_ADMIN.
+	DeferOpenedWithin time.Duration
+	// BatchSize, above 1, holds verified copies until this many are written, then reads
+	// every copy of the batch back and replaces the originals of the batch only if all of
+	// them match. The copies of a batch take space on top of those in progress meanwhile.
+	BatchSize int
+	// RecoveryDir, if set, is where the copy of a file goes when it cannot be renamed over
+	// its removed original, ideally on another filesystem than the pool; the copy is saved
+	// next to the original as NAME.recovered otherwise. Saved copies are registered in the
+	// database either way.
+	RecoveryDir string
+	// ARCThrottle lowers the concurrency while the ZFS ARC thrashes, i.e. reads keep asking
+	// for data it evicted recently, and raises it again once the ARC settles
+	ARCThrottle bool
+	// MaxPoolCapacity, above 0, stops the run once a pool holding a root path is more than
+	// this percentage full, checked before the run and periodically during it: rebalancing a
+	// nearly full pool fragments it further. Files in progress are completed.
+	MaxPoolCapacity int
+	// PauseAtCapacity holds back new files while a pool is above MaxPoolCapacity instead of
+	// stopping, until it is below again
+	PauseAtCapacity bool
+	// MaxBytes, above 0, stops a run cleanly once the files it rebalanced add up to this
+	// many bytes: no further file or pass starts and the files in progress are completed.
+	// The pass counts in the database record the files done, so a later run carries on
+	// with the others.
+	MaxBytes int64
+	// MaxRuntime, above 0, stops a run cleanly once it has been running this long, in the
+	// same way as MaxBytes
+	MaxRuntime time.Duration
+	// Window, unless zero, is the time of day during which files are started: outside it
+	// new files wait for it to open while the files in progress are completed
+	Window Window
 }
 
 // Rebalancer holds the state for a rebalance operation
 type Rebalancer struct {
-	config       *Config
-	db           *database.DB
-	logger       *log.Logger
-	shutdownChan chan struct{}
-	wg           *sync.WaitGroup
+	config *Config
+	db     *database.DB
+	logger *log.Logger
+
+	// shutdown is canceled by InitiateShutdown
+	shutdown       context.Context
+	shutdownCancel context.CancelFunc
+
+	// hardlinkGroups maps the path chosen to represent a hardlink group to
+	// the other paths in the tree that share its inode
+	hardlinkGroups map[string][]string
+	groupsMutex    sync.RWMutex
+
+	// fileDatasets maps each gathered file to the device of its dataset, devicePools
+	// each device to its pool; files on unknown devices belong to defaultPool. fileSizes
+	// holds the size of each gathered file for ByteProgress, fileExtents its extent count
+	// for OrderFragmented.
+	fileDatasets  map[string]uint64
+	fileSizes     map[string]int64
+	fileExtents   map[string]int
+	devicePools   map[uint64]string
+	defaultPool   string
+	datasetsMutex sync.RWMutex
+
+	// space counts the free space claimed by the copies in progress for Config.ReserveFree
+	space spaceGuard
+
+	// tempDirs holds the TempSubdirName directories to remove once the run is done
+	tempDirs   map[string]bool
+	tempDirsMu sync.Mutex
+
+	// tooLarge holds the size of each file left out for Config.SkipLargerThan
+	tooLarge   map[string]int64
+	tooLargeMu sync.Mutex
+
+	stats *runStats
+
+	// mounts holds the filesystems mounted below the root paths, excludedMounts the walk paths skipped
+	mounts         []nestedMount
+	excludedMounts map[string]bool
+	mountsOnce     sync.Once
+	// rootFilesystems holds the filesystem of each root path. rootMount is the one holding
+	// the first root path, if it could be determined, which pool-wide features act on.
+	rootFilesystems []rootFilesystem
+	rootMount       mounts.Mount
+	rootMountFound  bool
+	// walkDevices holds the devices of the root paths and included mounts, the only ones
+	// the walk enters with Config.OneFileSystem
+	walkDevices     map[uint64]bool
+	walkDevicesOnce sync.Once
+	// ignores caches the .rebalanceignore files read during the walk
+	ignores ignoreFiles
+
+	// busyWorkers counts workers inside RebalanceFile; pending holds the files still queued in this run
+	busyWorkers  atomic.Int32
+	pending      map[string]bool
+	pendingMutex sync.Mutex
+
+	// limiter paces copies during a run, nil when unlimited
+	limiter fileutil.Limiter
+
+	// hashSlots bounds the files hashed at once to Config.HashWorkers
+	hashSlots     chan struct{}
+	hashSlotsOnce sync.Once
+
+	// pause holds workers while paused; sched is the scheduler of the run in progress,
+	// and workers the concurrency set by SetConcurrency, 0 for Config.Concurrency
+	pause      pauseGate
+	sched      *scheduler.Scheduler
+	workers    int
+	schedMutex sync.Mutex
+
+	// inflight holds the files workers are currently rebalancing, for the temp file watchdog
+	inflight      map[string]*inflightFile
+	inflightMutex sync.Mutex
+	// replace lets a forced exit remove temp copies without racing a replacement
+	replace replaceGate
+	// batch holds verified copies until their batch is complete, nil without Config.BatchSize
+	batch *batchBarrier
+
+	// degradations counts the files per filesystem and metadata class that could not be preserved
+	degradations      map[degradationKey]int64
+	degradationsMutex sync.Mutex
+
+	// lockTableOnce reports a lock table that cannot be read once
+	lockTableOnce sync.Once
+
+	// accessWatch records the files other processes open during a run, nil when not watching
+	accessWatch *accesswatch.Watcher
+	accessMutex sync.Mutex
+
+	// arc samples the ZFS ARC during runs
+	arc arcMonitor
+
+	// capacity holds back new files while a pool is above Config.MaxPoolCapacity;
+	// readCapacity replaces PoolCapacity in tests
+	capacity     capacityGate
+	readCapacity func() (map[string]int, error)
+
+	// window logs the waits for Config.Window once
+	window windowGate
+
+	// outcomes holds the finished files for Report when Config.ReportFiles is set
+	outcomes      []report.FileOutcome
+	outcomesMutex sync.Mutex
 }
 
 // NewRebalancer creates a new Rebalancer instance
 func NewRebalancer(config *Config, db *database.DB) *Rebalancer {
+	if config.RandomOrder && config.Order == "" {
+		config.Order = OrderRandom
+	}
+	const mib = 1024 * 1024
+	if config.SizeThreshold == 0 {
+		config.SizeThreshold = int64(config.SizeThresholdMB) * mib
+	}
+	if config.PoolBandwidth == 0 {
+		config.PoolBandwidth = int64(config.PoolBandwidthMBps) * mib
+	}
+	if config.SSDWriteBudget == 0 {
+		config.SSDWriteBudget = int64(config.SSDWriteBudgetGB) * 1024 * mib
+	}
+	shutdown, shutdownCancel := context.WithCancel(context.Background())
 	return &Rebalancer{
-		config:       config,
-		db:           db,
-		logger:       config.Logger,
-		shutdownChan: make(chan struct{}),
-		wg:           &sync.WaitGroup{},
+		config:         config,
+		db:             db,
+		logger:         config.Logger,
+		shutdown:       shutdown,
+		shutdownCancel: shutdownCancel,
+		stats:          newRunStats(),
+		arc:            arcMonitor{read: zpool.ReadARC},
 	}
 }
 
 // RebalanceFile copies a file, checks attributes and checksum, then removes the original and renames the copy.
 // If the passesLimit is > 0, it tracks how many times a file has been rebalanced in the SQLite DB.
 func (r *Rebalancer) RebalanceFile(filePath string) error {
-	// Skip files that already have .balance extension
-	if strings.HasSuffix(filePath, ".balance") {
-		r.logger.Infof("Skipping temporary .balance file: %s", filePath)
-		return nil
+	return r.RebalanceFileContext(context.Background(), filePath)
+}
+
+// RebalanceFileContext is RebalanceFile with a context. Canceling the context aborts the copy
+// and removes the temp file, leaving the original untouched, and returns the context's error;
+// once the original has been removed the file is always completed.
+func (r *Rebalancer) RebalanceFileContext(ctx context.Context, filePath string) error {
+	_, err := r.rebalanceFile(ctx, filePath)
+	if errors.Is(err, errInterrupted) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// rebalanceFile implements RebalanceFileContext and also reports whether the file was rewritten,
+// false meaning it was skipped. It returns errInterrupted if a shutdown or the context
+// stopped it before the original was touched.
+func (r *Rebalancer) rebalanceFile(ctx context.Context, filePath string) (rebalanced bool, err error) {
+	// Skip the temporary copies of earlier runs
+	if r.tempNaming().isTemp(filePath) {
+		r.logger.Infof("Skipping temporary copy: %s", filePath)
+		r.stats.skipReasons.add(SkipTempFile)
+		return false, nil
 	}
 
+	// Hardlink groups are rebalanced once and their links recreated afterwards
+	linkedPaths, isGroup := r.hardlinkGroup(filePath)
+
 	// Check for hardlinks - skip by default
-	if r.config.SkipHardlinks {
+	if isGroup {
+		linkCount, err := fileutil.GetLinkCount(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				r.logger.Warnf("File no longer on disk: %s", filePath)
+				if r.config.HaltOnFileMissing {
+					r.logger.Warnf("Initiating shutdown due to missing file (HaltOnFileMissing=true)")
+					r.InitiateShutdown()
+				}
+				r.stats.skipReasons.add(SkipMissing)
+				return false, nil
+			}
+			return false, fmt.Errorf("hardlink check failed for %s: %w", filePath, err)
+		}
+		if linkCount != uint64(len(linkedPaths)+1) {
+			// Links outside the tree would keep the old blocks alive and double space usage
+			r.logger.Infof("Skipping hardlink group with %d links but %d paths in tree: %s", linkCount, len(linkedPaths)+1, filePath)
+			r.stats.skipReasons.add(SkipHardlink)
+			return false, nil
+		}
+	} else if r.config.SkipHardlinks {
 		linkCount, err := fileutil.GetLinkCount(filePath)
 		if err != nil {
 			// If the file doesn't exist, it might have been deleted since gathering
@@ -69,27 +429,18 @@ func (r *Rebalancer) RebalanceFile(filePath string) error {
 					r.logger.Warnf("Initiating shutdown due to missing file (HaltOnFileMissing=true)")
 					r.InitiateShutdown()
 				}
-				return nil
+				r.stats.skipReasons.add(SkipMissing)
+				return false, nil
 			}
-			return fmt.Errorf("hardlink check failed for %s: %w", filePath, err)
+			return false, fmt.Errorf("hardlink check failed for %s: %w", filePath, err)
 		}
 		if linkCount > 1 {
 			r.logger.Infof("Skipping hard-linked file (use --process-hardlinks to include): %s", filePath)
-			return nil
+			r.stats.skipReasons.add(SkipHardlink)
+			return false, nil
 		}
 	}
 
-	// Check if passes are exceeded
-	oldCount, err := r.db.GetRebalanceCount(filePath)
-	if err != nil {
-		return fmt.Errorf("db read error: %w", err)
-	}
-
-	if r.config.PassesLimit > 0 && oldCount >= r.config.PassesLimit {
-		r.logger.Infof("Pass count (%d) reached, skipping: %s", r.config.PassesLimit, filePath)
-		return nil
-	}
-
 	// Check if file exists
 	srcInfo, err := os.Stat(filePath)
 	if err != nil {
@@ -99,14 +450,73 @@ func (r *Rebalancer) RebalanceFile(filePath string) error {
 				r.logger.Warnf("Initiating shutdown due to missing file (HaltOnFileMissing=true)")
 				r.InitiateShutdown()
 			}
-			return nil
+			r.stats.skipReasons.add(SkipMissing)
+			return false, nil
 		}
-		return fmt.Errorf("failed to stat: %s => %w", filePath, err)
+		return false, fmt.Errorf("failed to stat: %s => %w", filePath, err)
 	}
 
 	if !srcInfo.Mode().IsRegular() {
 		r.logger.Infof("Skipping non-regular file: %s", filePath)
-		return nil
+		r.stats.skipReasons.add(SkipNotRegular)
+		return false, nil
+	}
+
+	// Check if passes are exceeded
+	counted, _, err := r.passRecord(filePath, srcInfo)
+	if err != nil {
+		return false, fmt.Errorf("db read error: %w", err)
+	}
+	oldCount := counted.Count
+	if counted.FilePath != "" && counted.FilePath != filePath {
+		r.logger.Debugf("Pass count of %s recorded under %s, following the inode", filePath, counted.FilePath)
+	}
+
+	if r.config.PassesLimit > 0 && oldCount >= r.config.PassesLimit {
+		r.logger.Infof("Pass count (%d) reached, skipping: %s", r.config.PassesLimit, filePath)
+		if err := r.followRename(counted, filePath); err != nil {
+			return false, fmt.Errorf("db update error: %w", err)
+		}
+		r.stats.skipReasons.add(SkipPassLimit)
+		return false, nil
+	}
+
+	// Immutable and append-only files cannot be removed: skip them before copying
+	protection, err := fileutil.GetProtection(filePath)
+	if err != nil {
+		return false, fmt.Errorf("cannot read the file flags of %s: %w", filePath, err)
+	}
+	if !protection.IsZero() && (!r.config.ClearProtection || isGroup) {
+		if isGroup {
+			// Links cannot be made to the new copy once its flags are set again
+			r.logger.Infof("Skipping %s hardlink group: %s", protection, filePath)
+		} else {
+			r.logger.Infof("Skipping %s file (use --clear-immutable to include): %s", protection, filePath)
+		}
+		r.stats.filesProtected.Add(1)
+		r.stats.skipReasons.add(SkipProtected)
+		return false, nil
+	}
+
+	if n, ok := r.alreadyBalanced(filePath); ok {
+		r.logger.Infof("Skipping %s, already balanced in %d extents (--min-extents %d)", filePath, n, r.config.MinExtents)
+		r.stats.filesBalanced.Add(1)
+		r.stats.skipReasons.add(SkipAlreadyBalanced)
+		return false, nil
+	}
+
+	// Don't pull a file out from under a connected client
+	if lock, ok := r.activeLock(srcInfo); ok {
+		return false, fmt.Errorf("%w: %s", errFileInUse, lock)
+	}
+
+	// Remember the inode so the link-recreation phase only touches links that still point to it
+	var originalID fileutil.FileID
+	if isGroup {
+		originalID, err = fileutil.GetFileIDFromFileInfo(srcInfo)
+		if err != nil {
+			return false, fmt.Errorf("failed to identify hardlink group for %s: %w", filePath, err)
+		}
 	}
 
 	// Store original file permissions and timestamp
@@ -114,47 +524,279 @@ func (r *Rebalancer) RebalanceFile(filePath string) error {
 	originalTime := srcInfo.ModTime()
 	fileSize := srcInfo.Size()
 
-	tmpFilePath := filePath + ".balance"
-	r.logger.Infof("Copying '%s' to '%s'...", filePath, tmpFilePath)
+	// Names near the length limit get a shortened temp name instead of failing mid-copy
+	tmpFilePath, shortenedTemp, err := r.tempNaming().pathFor(filePath)
+	if err != nil {
+		return false, err
+	}
+	if err := r.makeTempDir(tmpFilePath); err != nil {
+		return false, err
+	}
+	r.fileLog(OpCopy, filePath).WithFields(log.Fields{FieldTarget: tmpFilePath, FieldBytes: fileSize}).
+		Infof("Copying '%s' to '%s'...", filePath, tmpFilePath)
+
+	// Keep the copy from filling the dataset or pool
+	var dev uint64
+	if id, err := fileutil.GetFileIDFromFileInfo(srcInfo); err == nil {
+		dev = id.Dev
+	}
+	releaseSpace, err := r.reserveSpace(ctx, filePath, dev, fileSize)
+	if err != nil {
+		return false, err
+	}
+	defer releaseSpace()
 
 	// Step 1: Copy file to file.balance
 	startTime := time.Now()
 
 	// Check for shutdown before starting a long operation
-	if r.isShuttingDown() {
+	if r.stopRequested(ctx) {
 		r.logger.Infof("Shutdown requested, skipping file: %s", filePath)
-		return nil
+		return false, errInterrupted
 	}
 
-	if err := fileutil.CopyFile(filePath, tmpFilePath); err != nil {
-		return fmt.Errorf("copy failed: %w", err)
+	if err := r.runPreFileHook(ctx, filePath); err != nil {
+		return false, err
+	}
+	started := time.Now()
+	defer func() {
+		r.runPostFileHook(ctx, filePath, fileSize, started, err)
+	}()
+
+	// Deferred after the post-file hook so the hook sees the error of a panic
+	tmp := &tempCopy{path: tmpFilePath}
+	defer r.recoverFile(filePath, tmp, &err)
+
+	if shortenedTemp {
+		r.logger.Infof("Name of %s is too long for the %s suffix, using %s", filePath, r.tempNaming().suffix, filepath.Base(tmpFilePath))
+		r.stats.tempNamesShortened.Add(1)
+	}
+
+	// retries counts the retried operations of this file for the summary
+	retries := 0
+	defer func() {
+		if retries > 0 {
+			r.stats.filesRetried.Add(1)
+			r.logger.Infof("%s needed %d retries", filePath, retries)
+		}
+	}()
+
+	tracker := r.startInflight(filePath, tmpFilePath, fileSize)
+	defer r.finishInflight(filePath)
+	// A canceled context aborts the copy the same way the watchdog does
+	stopAbort := context.AfterFunc(ctx, tracker.requestCancel)
+	defer stopAbort()
+
+	checksumType := r.checksumFor(fileSize)
+
+	// Hash the original while copying unless a full read-back was requested
+	copyOpts := fileutil.CopyOptions{
+		Sparse:        r.config.PreserveSparse,
+		Cancel:        tracker.cancel,
+		Limiter:       r.limiter,
+		PreserveOwner: true,
+		OwnerFirst:    r.config.ChownEarly,
+		BytesRead:     &r.stats.bytesRead,
+		BytesWritten:  &r.stats.bytesWritten,
+		CacheBypass:   r.config.CacheBypass,
+		Sync:          !r.config.NoSync,
+		Engine:        r.config.IOEngine,
+
+		Streams:         r.config.ParallelCopy,
+		ParallelMinSize: r.config.ParallelCopyMinSize,
+	}
+	streaming := !r.config.NoVerify && !r.config.VerifyReadback
+	var srcHash hash.Hash
+	releaseHash := func() {}
+	if streaming {
+		var ok bool
+		var release func()
+		if release, ok = r.acquireHash(ctx.Done()); !ok {
+			return false, fmt.Errorf("%w: copy of %s not started: %v", errInterrupted, filePath, ctx.Err())
+		}
+		// Held until the copy is read back
+		var once sync.Once
+		releaseHash = func() { once.Do(release) }
+		defer releaseHash()
+	}
+	err = r.withRetry(ctx, "Copy", filePath, &retries, func() error {
+		// Each attempt rewrites the temp file from the start
+		if streaming {
+			srcHash = fileutil.NewHash(checksumType)
+			copyOpts.SourceHash = srcHash
+		}
+		if err := faultinject.Check(faultinject.Copy, filePath); err != nil {
+			return err
+		}
+		return fileutil.CopyFileWithOptions(filePath, tmpFilePath, copyOpts)
+	})
+	if err != nil {
+		if errors.Is(err, fileutil.ErrCopyCanceled) {
+			os.Remove(tmpFilePath)
+			if ctx.Err() != nil {
+				return false, fmt.Errorf("%w: copy of %s aborted: %v", errInterrupted, filePath, ctx.Err())
+			}
+			return false, fmt.Errorf("%w: copy of %s canceled", errStalled, filePath)
+		}
+		return false, fmt.Errorf("copy failed: %w", err)
+	}
+
+	// Report logical vs allocated size so sparse handling is visible in the log
+	if allocated, err := fileutil.GetAllocatedSize(tmpFilePath); err == nil {
+		r.logger.Infof("Copied '%s': logical size %s, allocated %s", filePath,
+			r.config.Units.Size(uint64(fileSize)), r.config.Units.Size(uint64(allocated)))
 	}
 
 	// Log copy speed for informational purposes
-	elapsed := time.Since(startTime).Seconds()
-	speedMBps := 0.0
+	copyDuration := time.Since(startTime)
+	elapsed := copyDuration.Seconds()
+	bytesPerSec := 0.0
 	if elapsed > 0 {
-		bytesPerSec := float64(fileSize) / elapsed
-		speedMBps = bytesPerSec / (1024 * 1024)
+		bytesPerSec = float64(fileSize) / elapsed
 	}
+	speedMBps := bytesPerSec / (1024 * 1024)
 
 	// Step 2: Check checksums - Don't log the start of verification
-	checksumType := r.config.ChecksumType
-	if checksumType == "" {
-		checksumType = fileutil.ChecksumSHA256 // Default to SHA256 if not specified
+	tracker.setStage(stageVerifying)
+
+	var digest, copyDigest string
+	if r.config.NoVerify || streaming {
+		// Catch a truncated copy before hashing it, or at least without a read-back
+		tmpInfo, err := os.Stat(tmpFilePath)
+		if err != nil {
+			os.Remove(tmpFilePath)
+			return false, fmt.Errorf("failed to stat copy: %w", err)
+		}
+		if tmpInfo.Size() != fileSize {
+			os.Remove(tmpFilePath)
+			return false, fmt.Errorf("size mismatch for file %s: %d != %d", filePath, fileSize, tmpInfo.Size())
+		}
+	}
+
+	if streaming {
+		// The copy is read back from disk: hashing the buffers written would only see
+		// what was read from the original
+		digest = hex.EncodeToString(srcHash.Sum(nil))
+		copyDigest, err = fileutil.FileHash(tmpFilePath, checksumType)
+		releaseHash()
+		r.stats.bytesRead.Add(fileSize)
+		if err != nil {
+			os.Remove(tmpFilePath)
+			return false, fmt.Errorf("cannot read back the copy of %s: %w", filePath, err)
+		}
+		if copyDigest = faultinject.Digest(filePath, copyDigest); copyDigest != digest {
+			os.Remove(tmpFilePath)
+			r.logger.Errorf("Checksum mismatch for file: %s", filePath)
+			return false, fmt.Errorf("%s checksum mismatch for file %s: %s != %s", checksumType, filePath, digest, copyDigest)
+		}
+	} else if !r.config.NoVerify {
+		release, ok := r.acquireHash(ctx.Done())
+		if !ok {
+			os.Remove(tmpFilePath)
+			return false, fmt.Errorf("%w: %s not verified: %v", errInterrupted, filePath, ctx.Err())
+		}
+		var reason string
+		digest, ok, reason = fileutil.CompareFileChecksumDigest(filePath, tmpFilePath, checksumType)
+		release()
+		r.stats.bytesRead.Add(2 * fileSize)
+		if err := faultinject.Check(faultinject.Hash, filePath); ok && err != nil {
+			ok, reason = false, err.Error()
+		}
+		if !ok {
+			// Clean up the temporary file on checksum mismatch
+			os.Remove(tmpFilePath)
+			r.logger.Errorf("Checksum mismatch for file: %s", filePath)
+			return false, fmt.Errorf("%s checksum mismatch for file %s: %s", checksumType, filePath, reason)
+		}
+		// The read-back only returns the digest of both sides when they are equal
+		copyDigest = digest
+	}
+	hashedAt := time.Now()
+
+	// Carry over extended attributes and ACLs; a filesystem lacking support only degrades the copy
+	if err := r.preserveMetadata(filePath, tmpFilePath); err != nil {
+		os.Remove(tmpFilePath)
+		return false, fmt.Errorf("failed to preserve metadata of %s: %w", filePath, err)
 	}
 
-	ok, reason := fileutil.CompareFileChecksum(filePath, tmpFilePath, checksumType)
-	if !ok {
-		// Clean up the temporary file on checksum mismatch
+	if err := r.awaitBatch(ctx, tracker, filePath, tmpFilePath, checksumType, digest); err != nil {
 		os.Remove(tmpFilePath)
-		r.logger.Errorf("Checksum mismatch for file: %s", filePath)
-		return fmt.Errorf("%s checksum mismatch for file %s: %s", checksumType, filePath, reason)
+		return false, err
+	}
+
+	// The copy must be on disk, under its name, before the original is removed
+	if !r.config.NoSync {
+		if err := syncCopy(filePath, tmpFilePath); err != nil {
+			os.Remove(tmpFilePath)
+			return false, fmt.Errorf("cannot sync the copy of %s, keeping the original: %w", filePath, err)
+		}
+	}
+
+	// A client may have started using the file while it was copied
+	if lock, ok := r.activeLock(srcInfo); ok {
+		os.Remove(tmpFilePath)
+		return false, fmt.Errorf("%w: %s", errFileInUse, lock)
+	}
+
+	// Last chance to back out before the original is touched. A forced exit waits for
+	// the replacement to complete before removing the copies of the files in progress.
+	if !r.enterReplace() {
+		os.Remove(tmpFilePath)
+		return false, fmt.Errorf("%w: %s not replaced: forced exit", errInterrupted, filePath)
+	}
+	replacing := true
+	defer func() {
+		if replacing {
+			r.leaveReplace()
+		}
+	}()
+	if ctx.Err() != nil {
+		os.Remove(tmpFilePath)
+		return false, fmt.Errorf("%w: %s not replaced: %v", errInterrupted, filePath, ctx.Err())
 	}
 
 	// Step 3: Remove original file
-	r.logger.Infof("Removing original '%s'...", filePath)
-	if err := os.Remove(filePath); err != nil {
+	tracker.setStage(stageReplacing)
+	// The final check makes sure the copy is what ends up under the name
+	var copyID fileutil.FileID
+	if info, err := os.Lstat(tmpFilePath); err == nil {
+		if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+			copyID = id
+		}
+	}
+	auditDigest := ""
+	if digest != "" {
+		auditDigest = string(checksumType) + ":" + digest
+	}
+	removal := auditEntry{op: auditRemove, path: filePath, size: fileSize, digest: auditDigest, protection: protection.String()}
+	if err := r.audit(removal); err != nil {
+		os.Remove(tmpFilePath)
+		return false, fmt.Errorf("not removing %s without an audit record: %w", filePath, err)
+	}
+	if !protection.IsZero() {
+		if err := fileutil.ClearProtection(filePath, protection); err != nil {
+			r.auditFailed(removal, err)
+			os.Remove(tmpFilePath)
+			return false, fmt.Errorf("cannot clear the %s flags of %s: %w", protection, filePath, err)
+		}
+		r.logger.Infof("Cleared the %s flags of %s for the replacement", protection, filePath)
+		// Set last, as the flags would block the times and links of the new copy; the
+		// original gets them back if it could not be replaced
+		defer func() {
+			if err := fileutil.RestoreProtection(filePath, protection); err != nil && !os.IsNotExist(err) {
+				r.logger.Errorf("Cannot set the %s flags of %s again: %v", protection, filePath, err)
+			}
+		}()
+	}
+	r.fileLog(OpRemove, filePath).Infof("Removing original '%s'...", filePath)
+	err = r.withRetry(ctx, "Remove", filePath, &retries, func() error {
+		if err := faultinject.Check(faultinject.Remove, filePath); err != nil {
+			return err
+		}
+		return os.Remove(filePath)
+	})
+	if err != nil {
+		r.auditFailed(removal, err)
 		// Clean up the temporary file on error
 		os.Remove(tmpFilePath)
 
@@ -165,31 +807,49 @@ func (r *Rebalancer) RebalanceFile(filePath string) error {
 				r.logger.Warnf("Initiating shutdown due to missing file (HaltOnFileMissing=true)")
 				r.InitiateShutdown()
 			}
-			return nil
+			r.stats.skipReasons.add(SkipMissing)
+			return false, nil
 		}
 
-		return fmt.Errorf("remove failed: %w", err)
+		return false, fmt.Errorf("remove failed: %w", err)
 	}
+	tmp.originalRemoved = true
 
 	// Step 4: Rename temporary copy to original name
 	_, fileName := filepath.Split(filePath)
-	r.logger.Infof("Renaming '%s.balance' to '%s'", fileName, fileName)
-	if err := os.Rename(tmpFilePath, filePath); err != nil {
+	r.fileLog(OpRename, tmpFilePath).WithField(FieldTarget, filePath).Infof("Renaming '%s' to '%s'", filepath.Base(tmpFilePath), fileName)
+	rename := auditEntry{op: auditRename, path: tmpFilePath, target: filePath, size: fileSize, digest: auditDigest}
+	if err := r.audit(rename); err != nil {
+		// The original is gone, the copy has to take its place regardless
+		r.logger.Errorf("Audit log: %v", err)
+	}
+	// The original is gone, keep retrying even if the context is canceled
+	err = r.withRetry(context.WithoutCancel(ctx), "Rename", tmpFilePath, &retries, func() error {
+		if err := faultinject.Check(faultinject.Rename, filePath); err != nil {
+			return err
+		}
+		return os.Rename(tmpFilePath, filePath)
+	})
+	if err != nil {
+		r.auditFailed(rename, err)
 		// This is a critical failure - we've removed the original but can't rename the temp file
 		// Try to put the temp file in a safe location
-		emergencyPath := filePath + ".recovered"
-		os.Rename(tmpFilePath, emergencyPath)
-		return fmt.Errorf("CRITICAL: rename failed, data saved to %s: %w", emergencyPath, err)
+		emergencyPath := r.saveRecovered(filePath, tmpFilePath, fileSize, checksumType, digest, auditDigest)
+		return false, fmt.Errorf("CRITICAL: rename failed, data saved to %s: %w", emergencyPath, err)
 	}
+	tmp.replaced = true
+	replacing = false
+	r.leaveReplace()
 
 	// Step 5: Check permissions are the same as when it started
+	tracker.setStage(stageMetadata)
 	newInfo, err := os.Stat(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			r.logger.Warnf("File disappeared after rename: %s", filePath)
-			return fmt.Errorf("file disappeared after rename")
+			return false, fmt.Errorf("file disappeared after rename")
 		}
-		return fmt.Errorf("failed to stat file after rename: %w", err)
+		return false, fmt.Errorf("failed to stat file after rename: %w", err)
 	}
 
 	if newInfo.Mode() != originalMode {
@@ -198,7 +858,7 @@ func (r *Rebalancer) RebalanceFile(filePath string) error {
 
 		// Fix permissions quietly
 		if err := os.Chmod(filePath, originalMode); err != nil {
-			return fmt.Errorf("failed to fix permissions: %w", err)
+			return false, fmt.Errorf("failed to fix permissions: %w", err)
 		}
 
 		// Only log at debug level
@@ -208,47 +868,287 @@ func (r *Rebalancer) RebalanceFile(filePath string) error {
 	if newInfo.ModTime() != originalTime {
 		// Fix timestamps quietly
 		if err := os.Chtimes(filePath, originalTime, originalTime); err != nil {
-			return fmt.Errorf("failed to fix timestamps: %w", err)
+			return false, fmt.Errorf("failed to fix timestamps: %w", err)
 		}
 
 		// Only log at debug level
 		r.logger.Debugf("Fixed timestamps for '%s'", filePath)
 	}
 
-	// Update DB if passesLimit is in use
-	if r.config.PassesLimit > 0 {
-		newCount := oldCount + 1
-		err := r.db.SetRebalanceCount(filePath, newCount)
+	// Step 6: Check the file now under the name is the copy, with its attributes restored
+	tracker.setStage(stageChecking)
+	rehashed, err := r.checkReplaced(ctx, replacedFile{
+		path:         filePath,
+		copyID:       copyID,
+		size:         fileSize,
+		mode:         originalMode,
+		modTime:      originalTime,
+		checksumType: checksumType,
+		digest:       copyDigest,
+	})
+	if err != nil {
+		return false, err
+	}
+	r.stats.filesFinalChecked.Add(1)
+	var verifiedAt time.Time
+	if rehashed {
+		verifiedAt = time.Now()
+	}
+
+	// Remember the digests of the original and the copy, with the size and modification time
+	// they were taken at, so idle time, a later verify-only run or an external audit can
+	// check the new copy and tell a legitimate modification from corruption
+	if (r.config.BackgroundVerify || r.config.RecordChecksums) && !r.config.NoVerify {
+		err := r.db.SetChecksum(database.ChecksumRecord{
+			FilePath:   filePath,
+			Algorithm:  string(checksumType),
+			Digest:     digest,
+			CopyDigest: copyDigest,
+			Size:       newInfo.Size(),
+			ModTime:    originalTime,
+			HashedAt:   hashedAt,
+			VerifiedAt: verifiedAt,
+		})
 		if err != nil {
-			return fmt.Errorf("db update error: %w", err)
+			return false, fmt.Errorf("db update error: %w", err)
 		}
 	}
 
+	// Step 7: Recreate the other links of a hardlink group against the new inode
+	if isGroup {
+		tracker.setStage(stageRelinking)
+		if err := r.relinkGroup(filePath, linkedPaths, originalID); err != nil {
+			return false, err
+		}
+	}
+
+	// Update DB if passesLimit is in use, with the size and speed of this copy and the
+	// inode of the new file
+	if r.config.PassesLimit > 0 {
+		var newID fileutil.FileID
+		if id, err := fileutil.GetFileIDFromFileInfo(newInfo); err == nil {
+			newID = id
+		}
+		rec := database.RebalanceRecord{
+			Device:       newID.Dev,
+			Inode:        newID.Ino,
+			Count:        oldCount + 1,
+			Size:         fileSize,
+			Duration:     copyDuration,
+			BytesPerSec:  bytesPerSec,
+			RebalancedAt: time.Now(),
+		}
+		paths := append([]string{filePath}, linkedPaths...)
+		for _, path := range paths {
+			rec.FilePath = path
+			if err := r.db.RecordRebalance(rec); err != nil {
+				return false, fmt.Errorf("db update error: %w", err)
+			}
+		}
+		// The file was counted under the name it had before a rename
+		if counted.FilePath != "" && !slices.Contains(paths, counted.FilePath) {
+			if err := r.db.DeleteRebalance(counted.FilePath); err != nil {
+				return false, fmt.Errorf("db update error: %w", err)
+			}
+		}
+		if rec.Count < r.config.PassesLimit {
+			r.stats.passWorkLeft.Store(true)
+		}
+	}
+
+	r.stats.recordRebalanced(r.filesystemOf(filePath), fileSize)
+
 	// Log success - check file size against threshold
-	fileSizeMB := float64(fileSize) / (1024 * 1024)
-	if r.config.SizeThresholdMB > 0 && fileSizeMB < float64(r.config.SizeThresholdMB) {
+	success := r.fileLog(OpRebalanced, filePath).WithFields(log.Fields{FieldBytes: fileSize, FieldSpeed: speedMBps})
+	if r.config.SizeThreshold > 0 && fileSize < r.config.SizeThreshold {
 		// For small files, only log at debug level
-		r.logger.WithField("show_full_paths", r.config.ShowFullPaths).Debugf("Successfully rebalanced %s at %.2f MB/s", filePath, speedMBps)
+		success.Debugf("Successfully rebalanced %s at %s", filePath, r.config.Units.Rate(bytesPerSec))
 	} else {
 		// For larger files, or if threshold is disabled (0), log at warning level to show in normal output
-		r.logger.WithField("show_full_paths", r.config.ShowFullPaths).Warnf("Successfully rebalanced %s at %.2f MB/s", filePath, speedMBps)
+		success.Warnf("Successfully rebalanced %s at %s", filePath, r.config.Units.Rate(bytesPerSec))
+	}
+	return true, nil
+}
+
+// followRename moves the record of a skipped file that was counted under a name which no
+// longer exists to its current name, so pruning the database does not drop its count
+func (r *Rebalancer) followRename(counted database.RebalanceRecord, filePath string) error {
+	if counted.FilePath == "" || counted.FilePath == filePath {
+		return nil
+	}
+	if _, err := os.Lstat(counted.FilePath); !os.IsNotExist(err) {
+		// A hardlink, or a name that cannot be checked
+		return nil
+	}
+	moved := counted
+	moved.FilePath = filePath
+	if err := r.db.RecordRebalance(moved); err != nil {
+		return err
+	}
+	return r.db.DeleteRebalance(counted.FilePath)
+}
+
+// passRecord returns the pass count record of a file, found by its device and inode so
+// that it follows the file across renames, or by path where inodes are not available.
+// A record of another path whose size differs belongs to a deleted file whose inode
+// number was reused, and is ignored.
+func (r *Rebalancer) passRecord(filePath string, info os.FileInfo) (database.RebalanceRecord, bool, error) {
+	var dev, ino uint64
+	if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+		dev, ino = id.Dev, id.Ino
+	}
+	rec, found, err := r.db.LookupRebalance(filePath, dev, ino)
+	if found && rec.FilePath != filePath && rec.Size > 0 && rec.Size != info.Size() {
+		return database.RebalanceRecord{}, false, nil
+	}
+	return rec, found, err
+}
+
+// hardlinkGroup returns the other paths sharing an inode with filePath if it represents a hardlink group
+func (r *Rebalancer) hardlinkGroup(filePath string) ([]string, bool) {
+	if !r.config.RelinkHardlinks {
+		return nil, false
+	}
+
+	r.groupsMutex.RLock()
+	defer r.groupsMutex.RUnlock()
+	paths, ok := r.hardlinkGroups[filePath]
+	return paths, ok
+}
+
+// relinkGroup points every other path of a hardlink group at the freshly rebalanced file.
+// Each link is created under a temporary name and renamed over the old path, so a path
+// never disappears; paths that no longer refer to the original inode are left alone.
+func (r *Rebalancer) relinkGroup(filePath string, linkedPaths []string, originalID fileutil.FileID) error {
+	var failed []string
+	for _, linkPath := range linkedPaths {
+		info, err := os.Lstat(linkPath)
+		if err != nil {
+			r.logger.Warnf("Hardlink no longer on disk, not recreating: %s", linkPath)
+			continue
+		}
+		id, err := fileutil.GetFileIDFromFileInfo(info)
+		if err != nil || id != originalID {
+			r.logger.Warnf("Hardlink changed since scan, not recreating: %s", linkPath)
+			continue
+		}
+
+		tmpLinkPath, _, err := r.tempNaming().pathFor(linkPath)
+		if err == nil {
+			err = r.makeTempDir(tmpLinkPath)
+		}
+		if err != nil {
+			failed = append(failed, linkPath)
+			r.logger.Errorf("Failed to relink %s: %v", linkPath, err)
+			continue
+		}
+		r.logger.Infof("Relinking '%s' to '%s'", linkPath, filePath)
+		if err := os.Link(filePath, tmpLinkPath); err != nil {
+			failed = append(failed, linkPath)
+			r.logger.Errorf("Failed to create hardlink %s: %v", tmpLinkPath, err)
+			continue
+		}
+		relink := auditEntry{op: auditRelink, path: linkPath, target: filePath, size: -1}
+		if err := r.audit(relink); err != nil {
+			os.Remove(tmpLinkPath)
+			failed = append(failed, linkPath)
+			r.logger.Errorf("Not replacing hardlink %s without an audit record: %v", linkPath, err)
+			continue
+		}
+		if err := os.Rename(tmpLinkPath, linkPath); err != nil {
+			r.auditFailed(relink, err)
+			os.Remove(tmpLinkPath)
+			failed = append(failed, linkPath)
+			r.logger.Errorf("Failed to replace hardlink %s: %v", linkPath, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to recreate %d hardlink(s) of %s, they still reference the old copy: %s",
+			len(failed), filePath, strings.Join(failed, ", "))
 	}
 	return nil
 }
 
-// InitiateShutdown signals the rebalancer to gracefully shut down
+// errInterrupted is returned by rebalanceFile when a shutdown was requested before the copy started
+var errInterrupted = errors.New("interrupted by shutdown")
+
+// ErrTooManyErrors is returned by RunContext when Config.MaxErrors files have failed.
+// Later runs of the same Rebalancer return it without starting any file.
+var ErrTooManyErrors = errors.New("too many files failed")
+
+// spendErrorBudget stops the run once Config.MaxErrors files have failed
+func (r *Rebalancer) spendErrorBudget() {
+	limit := int64(r.config.MaxErrors)
+	if limit <= 0 || r.stats.filesFailed.Load() < limit || r.stats.errorBudgetSpent.Swap(true) {
+		return
+	}
+	r.logger.Errorf("Reached the limit of %d failed files: stopping the run once the files in progress are done", limit)
+	if b := r.batch; b != nil {
+		// No further file starts to fill the batch
+		b.flush()
+	}
+	if r.config.Hooks.MaxErrors != nil {
+		r.config.Hooks.MaxErrors(r.Summary())
+	}
+}
+
+// spendByteBudget counts size rebalanced bytes against Config.MaxBytes and stops the run
+// once they reach it
+func (r *Rebalancer) spendByteBudget(size int64) {
+	limit := r.config.MaxBytes
+	if limit <= 0 || r.stats.budgetBytes.Add(size) < limit || r.stats.byteBudgetSpent.Swap(true) {
+		return
+	}
+	r.logger.Warnf("Rebalanced %s, the limit of %s for this run: stopping once the files in progress are done",
+		r.config.Units.Size(uint64(r.stats.budgetBytes.Load())), r.config.Units.Size(uint64(limit)))
+	if b := r.batch; b != nil {
+		// No further file starts to fill the batch
+		b.flush()
+	}
+}
+
+// spendRuntime stops the run once it has been running for Config.MaxRuntime
+func (r *Rebalancer) spendRuntime() {
+	if r.stats.runtimeSpent.Swap(true) {
+		return
+	}
+	r.logger.Warnf("Ran for %s, the limit for this run: stopping once the files in progress are done", r.config.MaxRuntime)
+	if b := r.batch; b != nil {
+		// No further file starts to fill the batch
+		b.flush()
+	}
+}
+
+// runBudgetSpent reports whether the run reached Config.MaxBytes or MaxRuntime
+func (r *Rebalancer) runBudgetSpent() bool {
+	return r.stats.byteBudgetSpent.Load() || r.stats.runtimeSpent.Load()
+}
+
+// InitiateShutdown signals the rebalancer to gracefully shut down. Unlike canceling the
+// context of RunContext, files already being copied are completed.
 func (r *Rebalancer) InitiateShutdown() {
 	r.logger.Info("Initiating graceful shutdown - waiting for in-progress files to complete...")
-	close(r.shutdownChan)
+	r.shutdownCancel()
 }
 
 // isShuttingDown checks if a shutdown has been requested
 func (r *Rebalancer) isShuttingDown() bool {
-	select {
-	case <-r.shutdownChan:
-		return true
-	default:
-		return false
+	return r.shutdown.Err() != nil
+}
+
+// stopRequested checks if a shutdown has been requested or ctx is done
+func (r *Rebalancer) stopRequested(ctx context.Context) bool {
+	return ctx.Err() != nil || r.isShuttingDown()
+}
+
+// withShutdown returns a context that is also canceled by InitiateShutdown
+func (r *Rebalancer) withShutdown(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(r.shutdown, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
 	}
 }
 
@@ -257,34 +1157,32 @@ func (r *Rebalancer) GetFiles() ([]string, error) {
 	return r.GatherFiles()
 }
 
-// GetPassInfo returns the current pass number and total passes
+// GetPassInfo returns the pass the current or last run is making and the passes it plans,
+// 0 and 0 before the first run.
+//
+// Deprecated: use Stats, which reports the same along with the other counters.
 func (r *Rebalancer) GetPassInfo() (current, total int) {
-	// Get current pass from the first file in DB, or default to 1
-	current = 1
-
-	files, err := r.GatherFiles()
-	if err != nil || len(files) == 0 {
-		return 1, r.config.PassesLimit
-	}
+	return int(r.stats.pass.Load()), int(r.stats.passes.Load())
+}
 
-	// Try to get the count from the first file to estimate current pass
-	if len(files) > 0 {
-		count, err := r.db.GetRebalanceCount(files[0])
-		if err == nil {
-			current = count + 1 // +1 because we're about to do this pass
-		}
-	}
+// Run executes the rebalance operation on all files in the root path, in Config.Passes
+// passes. A non-nil progressChan receives the Progress of the run as each pass starts and
+// as files are done; sends block, so the caller must keep reading until Run returns.
+func (r *Rebalancer) Run(progressChan chan<- Progress) error {
+	return r.RunContext(context.Background(), progressChan)
+}
 
-	// If passes limit is 0, it means unlimited - return a large number
-	if r.config.PassesLimit <= 0 {
-		return current, 999
+// RunContext is Run with a context. Canceling the context stops workers from starting new
+// files and aborts the copies in progress, as RebalanceFileContext does; RunContext then
+// returns the context's error once the workers have stopped. A read-only database is
+// rejected, as the run could not record what it rewrote. No further pass starts after a
+// shutdown request, or once Config.MaxErrors, MaxPoolCapacity, MaxBytes or MaxRuntime
+// stopped a pass.
+func (r *Rebalancer) RunContext(ctx context.Context, progressChan chan<- Progress) error {
+	if r.db.ReadOnly {
+		return errors.New("cannot rebalance with a read-only database")
 	}
 
-	return current, r.config.PassesLimit
-}
-
-// Run executes the rebalance operation on all files in the root path
-func (r *Rebalancer) Run(progressChan chan<- int) error {
 	// Check if we need to clean up existing .balance files first
 	if r.config.CleanupBalanceFiles {
 		r.logger.Info("Cleaning up existing .balance files...")
@@ -294,130 +1192,553 @@ func (r *Rebalancer) Run(progressChan chan<- int) error {
 		}
 	}
 
-	files, err := r.GatherFiles()
-	if err != nil {
-		return fmt.Errorf("failed to gather files: %w", err)
+	passes := max(r.config.Passes, 1)
+	r.stats.passes.Store(int64(passes))
+	r.stats.budgetBytes.Store(0)
+	r.stats.byteBudgetSpent.Store(false)
+	r.stats.runtimeSpent.Store(false)
+	if r.config.MaxRuntime > 0 {
+		timer := time.AfterFunc(r.config.MaxRuntime, r.spendRuntime)
+		defer timer.Stop()
+	}
+	var files []string
+	var failed error
+	for pass := 1; pass <= passes; pass++ {
+		if pass > 1 && (r.stopRequested(ctx) || r.stats.errorBudgetSpent.Load() || r.stats.poolFull.Load() || r.runBudgetSpent()) {
+			break
+		}
+		if pass > 1 && r.config.PassesLimit > 0 && !r.stats.passWorkLeft.Load() {
+			r.logger.Infof("No file is left below the pass limit of %d after pass %d", r.config.PassesLimit, pass-1)
+			break
+		}
+		r.stats.pass.Store(int64(pass))
+		if !r.config.ReuseFileList {
+			files = nil
+		}
+		var err error
+		files, err = r.runPass(ctx, progressChan, pass, passes, files)
+		switch {
+		case errors.Is(err, errFilesFailed):
+			failed = err
+		case err != nil:
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	r.logger.Info("All files processed successfully")
+	return nil
+}
+
+// errFilesFailed is returned by a run in which files failed
+var errFilesFailed = errors.New("some files failed to rebalance")
+
+// runPass makes pass of the passes of a run over files, the files below the root paths if
+// nil, and returns the files it processed
+func (r *Rebalancer) runPass(ctx context.Context, progressChan chan<- Progress, pass, passes int, files []string) ([]string, error) {
+	// Watch from the start, so files opened while the tree is scanned count too
+	stopAccessWatch := r.startAccessWatch()
+	defer stopAccessWatch()
+
+	reused := files != nil
+	if !reused {
+		var err error
+		files, err = r.GatherFiles()
+		if err != nil {
+			return nil, fmt.Errorf("failed to gather files: %w", err)
+		}
 	}
 
 	r.logger.Infof("File count: %d", len(files))
+	if pass == 1 {
+		r.warnFileListMemory(files)
+	}
+
+	bucket, err := r.openBandwidthLimit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to join the shared bandwidth limit: %w", err)
+	}
+	limiters := limiterChain{r.pauseLimiter(ctx)}
+	if bucket != nil {
+		limiters = append(limiters, bucket)
+		defer bucket.Close()
+	}
+	if pacer := r.openDirtyPacer(); pacer != nil {
+		limiters = append(limiters, pacer)
+		defer func() {
+			pauses, paused := pacer.Stats()
+			r.stats.dirtyPauses.Add(pauses)
+			r.stats.dirtyPaused.Add(int64(paused))
+		}()
+	}
+	if limiter := limiters.limiter(); limiter != nil {
+		r.limiter = limiter
+		defer func() { r.limiter = nil }()
+	}
 
 	if len(files) == 0 {
 		r.logger.Info("No files to process.")
-		return nil
+		return nil, nil
 	}
 
-	// Randomize file order by default unless disabled
-	if r.config.RandomOrder {
-		r.logger.Info("Randomizing file processing order...")
-		// Seed the random number generator with current time
-		rand.Seed(time.Now().UnixNano())
-		rand.Shuffle(len(files), func(i, j int) {
-			files[i], files[j] = files[j], files[i]
-		})
+	if pass > 1 && r.config.ShufflePasses {
+		r.logger.Infof("Randomizing file processing order for pass %d...", pass)
+		shuffleFiles(files)
+	} else if !reused || r.config.Order == OrderRandom {
+		r.orderFiles(files)
+	}
+
+	runStart := time.Now()
+	r.setPending(files)
+	var totalBytes int64
+	for _, f := range files {
+		totalBytes += r.sizeOf(f)
+	}
+	r.stats.startRun(len(files), totalBytes)
+	if r.config.BatchSize > 1 {
+		r.batch = newBatchBarrier(r.config.BatchSize, len(files), r.Concurrency())
+		defer func() { r.batch = nil }()
 	}
 
-	fileChan := make(chan string, len(files))
-	resultChan := make(chan error, len(files))
-	processedCount := 0
+	progress := Progress{FilesTotal: len(files), BytesTotal: totalBytes, Pass: pass, Passes: passes}
+	r.logger.Infof("Starting pass %d of %d with %d files", pass, passes, len(files))
+	var failed atomic.Bool
 
-	// Create a mutex to protect the processed count
+	// Create a mutex to protect the progress and the stall retries
 	var countMutex sync.Mutex
+	sendProgress := func() {
+		if progressChan == nil {
+			return
+		}
+		progress.BytesDone = r.stats.runBytesFinished.Load()
+		progress.ActiveWorkers = int(r.busyWorkers.Load())
+		progressChan <- progress
+	}
+	sendProgress()
+	stallRequeues := make(map[string]int)
+	deferredInUse := make(map[string]bool)
+	deferredOpened := make(map[string]bool)
+
+	// finish records the outcome of a file that will not be processed again in this run
+	finish := func(f string, rebalanced bool, e error, queued, duration time.Duration) {
+		r.finishPending(f)
+		if r.batch != nil {
+			r.batch.finished()
+		}
+		r.recordOutcome(f, rebalanced, e, queued, duration)
+		r.reportFileResult(f, rebalanced, e, duration)
+
+		interrupted := errors.Is(e, errInterrupted)
+		switch {
+		case interrupted:
+			// Never started, the file still counts as remaining
+		case e != nil:
+			r.fileLog(OpFailed, f).WithError(e).Errorf("Failed to rebalance %s: %v", f, e)
+			r.stats.recordFailed(r.filesystemOf(f))
+			r.stats.passWorkLeft.Store(true)
+			failed.Store(true)
+			r.spendErrorBudget()
+		case !rebalanced:
+			r.stats.recordSkipped(r.filesystemOf(f))
+		default:
+			r.spendByteBudget(r.sizeOf(f))
+		}
+		if !interrupted {
+			r.stats.runFinished.Add(1)
+			r.stats.runBytesFinished.Add(r.sizeOf(f))
+		}
 
-	// Launch workers
-	r.logger.Infof("Starting %d workers...", r.config.Concurrency)
-	for i := 0; i < r.config.Concurrency; i++ {
-		r.wg.Add(1)
-		go func() {
-			defer r.wg.Done()
-			for f := range fileChan {
-				// Check if we're shutting down before starting a new file
-				if r.isShuttingDown() {
-					break
-				}
-
-				r.logger.Infof("Processing file: %s", f)
-				e := r.RebalanceFile(f)
+		countMutex.Lock()
+		progress.FilesDone++
+		if e != nil && !interrupted {
+			progress.LastError = fmt.Errorf("%s: %w", f, e)
+		}
+		sendProgress()
+		countMutex.Unlock()
+	}
 
-				if e != nil {
-					r.logger.Errorf("Failed to rebalance %s: %v", f, e)
-				}
+	sched := scheduler.New(scheduler.Options{
+		Workers:    r.Concurrency(),
+		GroupLimit: r.config.MaxWorkersPerDataset,
+		PoolLimit:  r.config.MaxWorkersPerPool,
+		Stopping: func() bool {
+			return r.stopRequested(ctx) || r.stats.errorBudgetSpent.Load() || r.stats.poolFull.Load() || r.runBudgetSpent()
+		},
+		OnPanic: func(task scheduler.Task, err *scheduler.PanicError) {
+			r.logger.Errorf("%v\n%s", err, err.Stack)
+			finish(task.ID, false, err, 0, 0)
+		},
+	})
+	for _, f := range files {
+		dataset := r.datasetOf(f)
+		sched.Push(scheduler.Task{ID: f, Group: dataset, Pool: r.poolOf(dataset)})
+	}
+	sched.Close()
+
+	r.setScheduler(sched)
+	defer r.setScheduler(nil)
+
+	process := func(ctx context.Context, task scheduler.Task) {
+		f := task.ID
+		// A file popped while paused waits, and stays queued if a shutdown ends the wait
+		r.waitWhilePaused(ctx)
+		r.waitForCapacity(ctx)
+		r.waitForWindow(ctx)
+		if r.stopRequested(ctx) || r.stats.poolFull.Load() || r.runBudgetSpent() {
+			return
+		}
+		start := time.Now()
+		queued := start.Sub(task.Queued)
+		r.stats.queueWaits.record(f, queued)
+
+		// Put files in active use off to the end of the pass, once
+		if at, ok := r.recentlyOpened(f); ok {
+			countMutex.Lock()
+			retry := !deferredOpened[f]
+			deferredOpened[f] = true
+			countMutex.Unlock()
+			if retry && !r.stopRequested(ctx) {
+				r.logger.Infof("Deferring %s to the end of the pass, opened by another process %s ago", f, time.Since(at).Round(time.Second))
+				r.stats.filesDeferred.Add(1)
+				sched.Requeue(task)
+				return
+			}
+		}
 
-				// Update processed count and send to progress channel
-				countMutex.Lock()
-				processedCount++
-				if progressChan != nil {
-					progressChan <- processedCount
-				}
-				countMutex.Unlock()
+		r.logger.Infof("Processing file: %s (queued %s)", f, queued.Round(time.Millisecond))
+		r.busyWorkers.Add(1)
+		defer r.busyWorkers.Add(-1)
+		rebalanced, e := r.rebalanceFile(ctx, f)
+
+		// Give a canceled stalled copy another chance instead of failing it
+		if errors.Is(e, errStalled) {
+			countMutex.Lock()
+			stallRequeues[f]++
+			attempt := stallRequeues[f]
+			countMutex.Unlock()
+			if attempt <= maxStallRequeues && !r.stopRequested(ctx) {
+				r.logger.Warnf("Requeued stalled file (retry %d of %d): %s", attempt, maxStallRequeues, f)
+				sched.Requeue(task)
+				return
+			}
+		}
 
-				resultChan <- e
+		// Retry files in use by clients once after the files queued so far, then skip them
+		if errors.Is(e, errFileInUse) {
+			countMutex.Lock()
+			retry := !deferredInUse[f]
+			deferredInUse[f] = true
+			countMutex.Unlock()
+			if retry && !r.stopRequested(ctx) {
+				r.logger.Warnf("Deferring %s to the end of the pass: %v", f, e)
+				sched.Requeue(task)
+				return
 			}
+			r.logger.Warnf("Skipping %s, still in use at the end of the pass: %v", f, e)
+			r.stats.filesInUse.Add(1)
+			r.stats.skipReasons.add(SkipInUse)
+			r.stats.passWorkLeft.Store(true)
+			rebalanced, e = false, nil
+		}
+		if errors.Is(e, errLowSpace) {
+			r.logger.Warnf("Skipping %v", e)
+			r.stats.filesLowSpace.Add(1)
+			r.stats.skipReasons.add(SkipLowSpace)
+			r.stats.passWorkLeft.Store(true)
+			rebalanced, e = false, nil
+		}
+		finish(f, rebalanced, e, queued, time.Since(start))
+	}
+
+	// Spot-check stored checksums with whatever capacity the workers leave unused
+	stopVerify := make(chan struct{})
+	verifyDone := make(chan struct{})
+	if r.config.BackgroundVerify {
+		go func() {
+			defer close(verifyDone)
+			r.backgroundVerify(stopVerify, runStart)
 		}()
+	} else {
+		close(verifyDone)
 	}
 
-	// Enqueue files for processing, but allow for interruption
-	for _, f := range files {
-		// Check for shutdown signal before adding more files to the queue
-		if r.isShuttingDown() {
-			break
-		}
+	// Watch for temp files that stop making progress
+	stopWatchdog := make(chan struct{})
+	if r.config.TempFileTimeout > 0 {
+		go r.tempFileWatchdog(stopWatchdog)
+	}
 
-		fileChan <- f
+	// Watch the ARC for the eviction of data other applications keep hot
+	stopARC := make(chan struct{})
+	arcDone := make(chan struct{})
+	go func() {
+		defer close(arcDone)
+		r.watchARC(stopARC)
+	}()
+
+	// Watch the pools for Config.MaxPoolCapacity, from before the first file starts
+	stopCapacity := make(chan struct{})
+	capacityDone := make(chan struct{})
+	if r.checkCapacity() {
+		go func() {
+			defer close(capacityDone)
+			r.watchCapacity(stopCapacity)
+		}()
+	} else {
+		close(capacityDone)
 	}
-	close(fileChan)
 
-	// Wait for workers to finish
-	r.wg.Wait()
-	close(resultChan)
+	// Process the files, returning once all are done or a shutdown was requested
+	r.logger.Infof("Starting %d workers...", r.Concurrency())
+	sched.Run(ctx, process)
+	close(stopVerify)
+	close(stopWatchdog)
+	close(stopARC)
+	close(stopCapacity)
+	<-verifyDone
+	<-arcDone
+	<-capacityDone
+
+	r.stats.runInterrupted.Store(ctx.Err() != nil)
 
 	// Final cleanup of any remaining .balance files if we're shutting down
-	if r.isShuttingDown() {
+	if r.stopRequested(ctx) {
 		r.logger.Info("Performing final cleanup of .balance files during shutdown...")
 		if err := r.cleanupBalanceFiles(); err != nil {
 			r.logger.Errorf("Error cleaning up .balance files: %v", err)
 		}
 	}
+	r.removeTempDirs()
 
 	// Final update to progress
-	if progressChan != nil {
-		progressChan <- processedCount
-	}
+	countMutex.Lock()
+	sendProgress()
+	countMutex.Unlock()
 
-	// Check for errors
-	failed := false
-	for e := range resultChan {
-		if e != nil {
-			failed = true
-		}
+	if err := ctx.Err(); err != nil {
+		return files, err
 	}
-
-	if failed {
-		return fmt.Errorf("some files failed to rebalance")
+	if r.stats.errorBudgetSpent.Load() {
+		return files, fmt.Errorf("%w: stopped after %d failures", ErrTooManyErrors, r.stats.filesFailed.Load())
 	}
-
-	r.logger.Info("All files processed successfully")
-	return nil
+	if r.stats.poolFull.Load() {
+		return files, fmt.Errorf("%w of %d%%: stopped with %d files remaining", ErrPoolFull, r.config.MaxPoolCapacity,
+			r.stats.runQueued.Load()-r.stats.runFinished.Load())
+	}
+	if failed.Load() {
+		r.logger.Warnf("Pass %d completed with some failures", pass)
+		return files, errFilesFailed
+	}
+	r.logger.Infof("Pass %d completed successfully", pass)
+	return files, nil
 }
 
-// GatherFiles collects all regular files in the given directory path
+// GatherFiles collects all regular files below the root paths.
+// When RelinkHardlinks is enabled it also indexes paths sharing an inode, keeping
+// only the first path of each hardlink group in the returned list.
 func (r *Rebalancer) GatherFiles() ([]string, error) {
 	var files []string
-	r.logger.Infof("Scanning directory: %s", r.config.RootPath)
-	err := filepath.Walk(r.config.RootPath, func(path string, info os.FileInfo, walkErr error) error {
+	inodePaths := make(map[fileutil.FileID][]string)
+	datasets := make(map[string]uint64)
+	sizes := make(map[string]int64)
+	if err := r.checkRoots(); err != nil {
+		return nil, err
+	}
+	walk := r.walkRoots
+	if r.config.Files != nil {
+		r.logger.Infof("Reading %d listed files below %s", len(r.config.Files), strings.Join(r.roots(), ", "))
+		walk = r.walkFileList
+	} else {
+		r.logger.Infof("Scanning directory: %s", strings.Join(r.roots(), ", "))
+	}
+	naming := r.tempNaming()
+	err := walk(func(path string, info os.FileInfo, walkErr error) error {
 		if walkErr != nil {
 			// If we cannot read a dir, skip it
 			r.logger.Warnf("Cannot access path %s: %v", path, walkErr)
 			return nil
 		}
+		if info.IsDir() && r.isExcludedMount(path) {
+			r.logger.Infof("Skipping nested mount: %s", path)
+			return filepath.SkipDir
+		}
+		if r.crossesFilesystem(info) {
+			if info.IsDir() {
+				r.logger.Infof("Skipping mount point on another filesystem: %s", path)
+				return filepath.SkipDir
+			}
+			r.logger.Debugf("Skipping file on another filesystem: %s", path)
+			return nil
+		}
+		if root, ok := r.rootOf(path); ok && r.ignoredByFile(filepath.Clean(path), root, info.IsDir()) {
+			if info.IsDir() {
+				r.logger.Infof("Skipping directory listed in %s: %s", IgnoreFileName, path)
+				return filepath.SkipDir
+			}
+			r.logger.Debugf("Skipping file listed in %s: %s", IgnoreFileName, path)
+			return nil
+		}
+		if info.IsDir() && naming.isTempDir(path) {
+			return filepath.SkipDir
+		}
 		if info.Mode().IsRegular() {
+			if !r.selectedByInode(path, info) || !r.selectedBySize(info) || !r.selectedBySince(info) || r.skippedAsTooLarge(path, info) {
+				return nil
+			}
 			files = append(files, path)
+			sizes[path] = info.Size()
+			if r.config.RelinkHardlinks {
+				r.indexHardlink(inodePaths, path, info)
+			}
+			if r.limitsDatasets() {
+				if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+					datasets[path] = id.Dev
+				}
+			}
 		}
 		return nil
 	})
 
+	if r.limitsDatasets() {
+		var pools map[uint64]string
+		var defaultPool string
+		if r.config.MaxWorkersPerPool > 0 {
+			pools, defaultPool = r.poolsByDevice()
+		}
+		r.datasetsMutex.Lock()
+		r.fileDatasets = datasets
+		r.devicePools, r.defaultPool = pools, defaultPool
+		r.datasetsMutex.Unlock()
+	}
+	var extents map[string]int
+	if (r.config.Order == OrderFragmented && r.config.Files == nil) || r.config.MinExtents > 0 {
+		extents = r.sampleExtents(files)
+	}
+	r.datasetsMutex.Lock()
+	r.fileSizes = sizes
+	r.fileExtents = extents
+	r.datasetsMutex.Unlock()
+
+	if r.config.RelinkHardlinks {
+		files = r.buildHardlinkGroups(files, inodePaths)
+	}
+
+	r.reportUnresolvedInodes()
+
 	return files, err
 }
 
+// selectedBySize applies MinSize and MaxSize to a gathered file
+func (r *Rebalancer) selectedBySize(info os.FileInfo) bool {
+	size := info.Size()
+	return (r.config.MinSize <= 0 || size >= r.config.MinSize) &&
+		(r.config.MaxSize <= 0 || size <= r.config.MaxSize)
+}
+
+// selectedBySince applies Since to a gathered file
+func (r *Rebalancer) selectedBySince(info os.FileInfo) bool {
+	return r.config.Since.IsZero() || !info.ModTime().Before(r.config.Since)
+}
+
+// skippedAsTooLarge reports whether a gathered file is larger than Config.SkipLargerThan,
+// logging it the first time
+func (r *Rebalancer) skippedAsTooLarge(path string, info os.FileInfo) bool {
+	limit := r.config.SkipLargerThan
+	if limit <= 0 || info.Size() <= limit {
+		return false
+	}
+	r.tooLargeMu.Lock()
+	defer r.tooLargeMu.Unlock()
+	if _, ok := r.tooLarge[path]; !ok {
+		if r.tooLarge == nil {
+			r.tooLarge = make(map[string]int64)
+		}
+		r.tooLarge[path] = info.Size()
+		r.logger.Warnf("Skipping %s: %s is larger than the limit of %s", path,
+			r.config.Units.Size(uint64(info.Size())), r.config.Units.Size(uint64(limit)))
+	}
+	return true
+}
+
+// limitsDatasets reports whether files must be mapped to their dataset at gather time
+func (r *Rebalancer) limitsDatasets() bool {
+	return r.config.MaxWorkersPerDataset > 0 || r.config.MaxWorkersPerPool > 0
+}
+
+// datasetOf returns the dataset (filesystem device) a gathered file belongs to.
+// All files share one dataset when no per-dataset or per-pool limit is configured.
+func (r *Rebalancer) datasetOf(path string) uint64 {
+	if !r.limitsDatasets() {
+		return 0
+	}
+
+	r.datasetsMutex.RLock()
+	defer r.datasetsMutex.RUnlock()
+	return r.fileDatasets[path]
+}
+
+// poolOf returns the pool of a dataset returned by datasetOf, "" when no per-pool
+// limit is configured
+func (r *Rebalancer) poolOf(dataset uint64) string {
+	r.datasetsMutex.RLock()
+	defer r.datasetsMutex.RUnlock()
+	if pool, ok := r.devicePools[dataset]; ok {
+		return pool
+	}
+	return r.defaultPool
+}
+
+// indexHardlink records a multi-link file in the inode to paths index
+func (r *Rebalancer) indexHardlink(inodePaths map[fileutil.FileID][]string, path string, info os.FileInfo) {
+	linkCount, err := fileutil.GetLinkCountFromFileInfo(path, info)
+	if err != nil || linkCount < 2 {
+		return
+	}
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		r.logger.Debugf("Cannot identify inode of %s: %v", path, err)
+		return
+	}
+	inodePaths[id] = append(inodePaths[id], path)
+}
+
+// buildHardlinkGroups stores the hardlink groups found by the walk and removes
+// every path but the group representative from the file list
+func (r *Rebalancer) buildHardlinkGroups(files []string, inodePaths map[fileutil.FileID][]string) []string {
+	groups := make(map[string][]string)
+	secondary := make(map[string]struct{})
+	for _, paths := range inodePaths {
+		if len(paths) < 2 {
+			continue
+		}
+		groups[paths[0]] = paths[1:]
+		for _, p := range paths[1:] {
+			secondary[p] = struct{}{}
+		}
+	}
+
+	r.groupsMutex.Lock()
+	r.hardlinkGroups = groups
+	r.groupsMutex.Unlock()
+
+	if len(groups) > 0 {
+		r.logger.Infof("Found %d hardlink groups covering %d additional paths", len(groups), len(secondary))
+	}
+
+	filtered := files[:0]
+	for _, f := range files {
+		if _, ok := secondary[f]; !ok {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
 // truncatePath shortens a path for display purposes
 func truncatePath(path string, maxLen int) string {
 	if len(path) <= maxLen {
@@ -452,14 +1773,21 @@ func truncatePath(path string, maxLen int) string {
 // cleanupBalanceFiles finds and removes any existing .balance files
 func (r *Rebalancer) cleanupBalanceFiles() error {
 	var balanceFiles []string
+	naming := r.tempNaming()
 
 	// Find all .balance files
-	err := filepath.Walk(r.config.RootPath, func(path string, info os.FileInfo, walkErr error) error {
+	err := r.walkRoots(func(path string, info os.FileInfo, walkErr error) error {
 		if walkErr != nil {
 			r.logger.Warnf("Cannot access path %s: %v", path, walkErr)
 			return nil
 		}
-		if info.Mode().IsRegular() && strings.HasSuffix(path, ".balance") {
+		if info.IsDir() && (r.isExcludedMount(path) || r.crossesFilesystem(info)) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && naming.isTempDir(path) {
+			r.addTempDir(path)
+		}
+		if info.Mode().IsRegular() && naming.isTemp(path) {
 			balanceFiles = append(balanceFiles, path)
 		}
 		return nil
@@ -472,15 +1800,35 @@ func (r *Rebalancer) cleanupBalanceFiles() error {
 	// Report the number of .balance files found
 	r.logger.Infof("Found %d .balance files to clean up", len(balanceFiles))
 
+	// A run that died between removing an original and renaming its copy left the only
+	// copy of the file behind; the audit log tells which ones
+	removed, err := r.config.AuditLog.removals(naming)
+	if err != nil {
+		r.logger.Warnf("Cannot replay the audit log: %v", err)
+	}
+
 	// Remove each .balance file
 	for _, path := range balanceFiles {
+		if removal, ok := removed[path]; ok && r.restoreRemoved(path, removal) {
+			continue
+		}
 		_, fileName := filepath.Split(path)
 		r.logger.Infof("Removing stale balance file: %s", fileName)
+		cleanup := auditEntry{op: auditCleanup, path: path, size: -1}
+		if info, err := os.Lstat(path); err == nil {
+			cleanup.size = info.Size()
+		}
+		if err := r.audit(cleanup); err != nil {
+			r.logger.Warnf("Not removing %s without an audit record: %v", path, err)
+			continue
+		}
 		err := os.Remove(path)
 		if err != nil {
+			r.auditFailed(cleanup, err)
 			r.logger.Warnf("Failed to remove %s: %v", path, err)
 		}
 	}
+	r.removeTempDirs()
 
 	return nil
 }
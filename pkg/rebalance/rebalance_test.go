@@ -1,13 +1,30 @@
 package rebalance
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/astundzia/go-zfs-rebalance/internal/database"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
 	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func setupTest(t *testing.T) (*Rebalancer, *database.DB, string, func()) {
@@ -103,6 +120,10 @@ func TestRebalanceCounting(t *testing.T) {
 	if count != 3 {
 		t.Errorf("Expected rebalance count 3, got %d", count)
 	}
+	rec, ok, err := db.GetRebalance(testFile)
+	if err != nil || !ok || rec.Size != int64(len("rebalance test data")) || rec.RebalancedAt.IsZero() {
+		t.Errorf("Expected the size and time of the last rebalance recorded, got %+v (%v)", rec, err)
+	}
 
 	// Try rebalancing a 4th time (should be skipped due to passes limit)
 	err = r.RebalanceFile(testFile)
@@ -121,6 +142,222 @@ func TestRebalanceCounting(t *testing.T) {
 	}
 }
 
+func TestRebalanceCountFollowsRename(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode numbers are not available on Windows")
+	}
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	renamed := filepath.Join(filepath.Dir(testFile), "renamed.txt")
+	if err := os.Rename(testFile, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RebalanceFile(renamed); err != nil {
+		t.Fatalf("RebalanceFile failed after rename: %v", err)
+	}
+
+	// The count moved with the file instead of starting over under the new name
+	if count, _ := db.GetRebalanceCount(renamed); count != 2 {
+		t.Errorf("Expected rebalance count 2 after the rename, got %d", count)
+	}
+	if _, found, _ := db.GetRebalance(testFile); found {
+		t.Errorf("Expected the record of the old name removed")
+	}
+
+	// A new file at the old name is not the counted file
+	if err := os.WriteFile(testFile, []byte("new data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := r.passRecord(testFile, info); err != nil || found {
+		t.Errorf("Expected no record for a new file at the old name, found=%t err=%v", found, err)
+	}
+}
+
+func TestPruneDatabase(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode numbers are not available on Windows")
+	}
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	deleted := filepath.Join(filepath.Dir(testFile), "deleted.txt")
+	if err := db.SetRebalanceCount(deleted, 1); err != nil {
+		t.Fatal(err)
+	}
+	// A file at its pass limit, renamed since it was counted
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	rec, _, _ := db.GetRebalance(testFile)
+	rec.Count = r.config.PassesLimit
+	if err := db.RecordRebalance(rec); err != nil {
+		t.Fatal(err)
+	}
+	renamed := filepath.Join(filepath.Dir(testFile), "renamed.txt")
+	if err := os.Rename(testFile, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RebalanceFile(renamed); err != nil {
+		t.Fatalf("RebalanceFile failed after rename: %v", err)
+	}
+
+	stats, err := r.PruneDatabase()
+	if err != nil {
+		t.Fatalf("PruneDatabase failed: %v", err)
+	}
+	if stats.Rebalances != 1 {
+		t.Errorf("Expected 1 pass count pruned, got %d", stats.Rebalances)
+	}
+	if _, found, _ := db.GetRebalance(deleted); found {
+		t.Errorf("Expected the record of the deleted file pruned")
+	}
+	// The skipped file's count moved to its new name and survived
+	if count, _ := db.GetRebalanceCount(renamed); count != r.config.PassesLimit {
+		t.Errorf("Expected the renamed file to keep count %d, got %d", r.config.PassesLimit, count)
+	}
+}
+
+func TestScanInventory(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	root := filepath.Dir(testFile)
+	other := filepath.Join(root, "sub", "other.txt")
+	if err := os.MkdirAll(filepath.Dir(other), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, size, err := r.Scan()
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if n != 2 || size != int64(len("rebalance test data")+len("other")) {
+		t.Errorf("Expected 2 files of %d bytes scanned, got %d of %d", len("rebalance test data")+len("other"), n, size)
+	}
+
+	// A file created after the scan is not part of the inventory
+	if err := os.WriteFile(filepath.Join(root, "late.txt"), []byte("late"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, scanned, err := InventoryFiles(db, []string{root})
+	if err != nil {
+		t.Fatalf("InventoryFiles failed: %v", err)
+	}
+	if scanned.IsZero() {
+		t.Errorf("Expected the scan time recorded")
+	}
+	r.config.Files = files
+	gathered, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	sort.Strings(gathered)
+	if want := []string{other, testFile}; !reflect.DeepEqual(gathered, want) {
+		t.Errorf("Expected the scanned files %v, got %v", want, gathered)
+	}
+
+	if _, _, err := InventoryFiles(db, []string{filepath.Join(root, "sub", "none")}); err == nil {
+		t.Errorf("Expected an error for paths without an inventory")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	root := filepath.Dir(testFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- r.Watch(ctx, 100*time.Millisecond) }()
+	// Let the watch be set up before writing
+	time.Sleep(500 * time.Millisecond)
+
+	written := filepath.Join(root, "sub", "new.txt")
+	if err := os.MkdirAll(filepath.Dir(written), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(written, []byte("written while watching"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if count, _ := db.GetRebalanceCount(written); count > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("File written while watching was not rebalanced")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The tool's own rename is not taken for another write
+	time.Sleep(ownEventGrace + time.Second)
+	if count, _ := db.GetRebalanceCount(written); count != 1 {
+		t.Errorf("Expected the written file rebalanced once, got %d", count)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the untouched file left alone, got count %d", count)
+	}
+
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Errorf("Watch returned %v", err)
+	}
+}
+
+func TestSince(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(testFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	recent := filepath.Join(filepath.Dir(testFile), "recent.txt")
+	if err := os.WriteFile(recent, []byte("recent"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r.config.Since = time.Now().Add(-24 * time.Hour)
+	files, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{recent}) {
+		t.Errorf("Expected only the recently modified file, got %v", files)
+	}
+}
+
+func TestLastCompleteRun(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 6, d, 3, 0, 0, 0, time.UTC) }
+	runs := []database.RunRecord{
+		{Started: day(1), Paths: []string{"/tank"}},
+		{Started: day(2), Paths: []string{"/tank/a"}},
+		{Started: day(3), Paths: []string{"/tank"}, FilesFailed: 1},
+		{Started: day(4), Paths: []string{"/tank"}, Interrupted: true},
+		{Started: day(5), Paths: []string{"/other"}},
+	}
+
+	if last, ok := LastCompleteRun(runs, []string{"/tank"}); !ok || !last.Equal(day(1)) {
+		t.Errorf("Expected the run of June 1st for /tank, got %v %t", last, ok)
+	}
+	if last, ok := LastCompleteRun(runs, []string{"/tank/a/"}); !ok || !last.Equal(day(2)) {
+		t.Errorf("Expected the run of June 2nd for /tank/a, got %v %t", last, ok)
+	}
+	if _, ok := LastCompleteRun(runs, []string{"/tank", "/other"}); ok {
+		t.Errorf("Expected no run covering both /tank and /other")
+	}
+}
+
 func TestGatherFiles(t *testing.T) {
 	r, _, testFile, cleanup := setupTest(t)
 	defer cleanup()
@@ -175,7 +412,7 @@ func TestRun(t *testing.T) {
 	defer cleanup()
 
 	// Create nil channel since we don't need progress updates in the test
-	var progressChan chan<- int = nil
+	var progressChan chan<- Progress = nil
 
 	// Test Run
 	err := r.Run(progressChan)
@@ -183,3 +420,2729 @@ func TestRun(t *testing.T) {
 		t.Errorf("Run failed: %v", err)
 	}
 }
+
+func TestRunProgress(t *testing.T) {
+	r, _, _, cleanup := setupTest(t)
+	defer cleanup()
+
+	files, err := r.GatherFiles()
+	if err != nil || len(files) == 0 {
+		t.Fatalf("GatherFiles: %v, %d files", err, len(files))
+	}
+	for pass := 1; pass <= 2; pass++ {
+		progressChan := make(chan Progress, len(files)+2)
+		if err := r.Run(progressChan); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		close(progressChan)
+		var sent []Progress
+		for p := range progressChan {
+			sent = append(sent, p)
+		}
+		if len(sent) != len(files)+2 {
+			t.Fatalf("Pass %d: got %d progress updates, want %d", pass, len(sent), len(files)+2)
+		}
+		if first := sent[0]; first.FilesDone != 0 || first.FilesTotal != len(files) || first.Pass != 1 || first.Passes != 1 {
+			t.Errorf("Pass %d: expected the pass start first, got %+v", pass, first)
+		}
+		last := sent[len(sent)-1]
+		if last.FilesDone != len(files) || last.FilesTotal != len(files) {
+			t.Errorf("Pass %d: files done %d of %d, want %d", pass, last.FilesDone, last.FilesTotal, len(files))
+		}
+		if last.BytesTotal == 0 || last.BytesDone != last.BytesTotal {
+			t.Errorf("Pass %d: bytes done %d of %d", pass, last.BytesDone, last.BytesTotal)
+		}
+		if last.Pass != 1 || last.ActiveWorkers != 0 || last.LastError != nil {
+			t.Errorf("Pass %d: got pass %d, %d active workers, last error %v", pass, last.Pass, last.ActiveWorkers, last.LastError)
+		}
+	}
+}
+
+func TestRunPasses(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		r, db, testFile, cleanup := setupTest(t)
+		r.config.Passes = 4
+		r.config.ReuseFileList = reuse
+		r.config.ShufflePasses = true
+
+		progressChan := make(chan Progress, 100)
+		if err := r.Run(progressChan); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		close(progressChan)
+		var passes []int
+		for p := range progressChan {
+			if p.FilesDone == 0 {
+				passes = append(passes, p.Pass)
+				if p.Passes != 4 {
+					t.Errorf("Reuse %v: expected pass %d of 4, got %+v", reuse, p.Pass, p)
+				}
+			}
+		}
+		// No fourth pass, the file reached the limit of 3
+		if !reflect.DeepEqual(passes, []int{1, 2, 3}) {
+			t.Errorf("Reuse %v: expected 3 passes to start, got %v", reuse, passes)
+		}
+		if count, _ := db.GetRebalanceCount(testFile); count != 3 {
+			t.Errorf("Reuse %v: expected the file rebalanced 3 times, got %d", reuse, count)
+		}
+		if s := r.Stats(); s.Rebalanced != 3 || s.Skipped != 0 || s.Pass != 3 || s.Passes != 4 {
+			t.Errorf("Reuse %v: expected 3 rebalances in pass 3 of 4, got %+v", reuse, s)
+		}
+		cleanup()
+	}
+}
+
+func TestRebalanceHardlinkGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hardlink groups are not supported on Windows")
+	}
+
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	r.config.SkipHardlinks = true
+	r.config.RelinkHardlinks = true
+
+	// Link the test file from a subdirectory
+	subDir := filepath.Join(r.config.RootPath, "subdir")
+	if err := os.Mkdir(subDir, 0755); err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+	linkFile := filepath.Join(subDir, "link.txt")
+	if err := os.Link(testFile, linkFile); err != nil {
+		t.Fatalf("Failed to create hardlink: %v", err)
+	}
+
+	originalInode, err := fileutil.GetInode(testFile)
+	if err != nil {
+		t.Fatalf("Failed to get inode: %v", err)
+	}
+
+	// Only one path of the group should be scheduled
+	files, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 file for the hardlink group, got %d", len(files))
+	}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	inode1, err := fileutil.GetInode(testFile)
+	if err != nil {
+		t.Fatalf("Failed to get inode: %v", err)
+	}
+	inode2, err := fileutil.GetInode(linkFile)
+	if err != nil {
+		t.Fatalf("Failed to get inode: %v", err)
+	}
+
+	if inode1 != inode2 {
+		t.Errorf("Hardlink group was split: %d != %d", inode1, inode2)
+	}
+	if inode1 == originalInode {
+		t.Errorf("Hardlink group was not rebalanced (inode unchanged)")
+	}
+
+	linkCount, err := fileutil.GetLinkCount(testFile)
+	if err != nil {
+		t.Fatalf("GetLinkCount failed: %v", err)
+	}
+	if linkCount != 2 {
+		t.Errorf("Expected link count 2 after relinking, got %d", linkCount)
+	}
+
+	content, err := os.ReadFile(linkFile)
+	if err != nil {
+		t.Fatalf("Failed to read relinked file: %v", err)
+	}
+	if string(content) != "rebalance test data" {
+		t.Errorf("Relinked content changed. Got: %s", string(content))
+	}
+}
+
+func TestSummary(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	summary := r.Summary()
+	if summary.FilesRebalanced != 1 {
+		t.Errorf("Expected 1 file rebalanced, got %d", summary.FilesRebalanced)
+	}
+	if summary.BytesRebalanced != int64(len("rebalance test data")) {
+		t.Errorf("Expected %d bytes rebalanced, got %d", len("rebalance test data"), summary.BytesRebalanced)
+	}
+	if datasets := r.DatasetStats(); len(datasets) != 1 || datasets[0].Dataset == "" ||
+		datasets[0].FilesRebalanced != 1 || datasets[0].BytesRebalanced != summary.BytesRebalanced {
+		t.Errorf("Expected the file to be counted in its dataset, got %+v", datasets)
+	}
+	if runtime.GOOS == "linux" {
+		if summary.IO == nil {
+			t.Fatalf("Expected process I/O counters on Linux")
+		}
+		// The copy reads the file at least once, hashing it on the way
+		if summary.IO.ReadChars < uint64(summary.BytesRebalanced) {
+			t.Errorf("Expected at least %d bytes read, got %d", summary.BytesRebalanced, summary.IO.ReadChars)
+		}
+	}
+}
+
+func TestBackgroundVerify(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.BackgroundVerify = true
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	rec, found, err := db.GetChecksum(testFile)
+	if err != nil || !found {
+		t.Fatalf("Expected a stored checksum after rebalancing, found=%t err=%v", found, err)
+	}
+	if rec.CopyDigest != rec.Digest || rec.HashedAt.IsZero() {
+		t.Errorf("Expected the copy's digest and the hash time stored, got %+v", rec)
+	}
+
+	stop := make(chan struct{})
+	if err := r.verifyStoredChecksum(rec, stop); err != nil {
+		t.Fatalf("verifyStoredChecksum failed: %v", err)
+	}
+	if s := r.Summary(); s.FilesVerified != 1 || s.VerifyMismatches != 0 {
+		t.Errorf("Expected 1 clean verification, got %d verified, %d mismatches", s.FilesVerified, s.VerifyMismatches)
+	}
+
+	// Silent corruption: same size and mtime, different content
+	info, _ := os.Stat(testFile)
+	if err := os.WriteFile(testFile, []byte("REBALANCE TEST DATA"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+	os.Chtimes(testFile, info.ModTime(), info.ModTime())
+	if err := r.verifyStoredChecksum(rec, stop); err != nil {
+		t.Fatalf("verifyStoredChecksum failed: %v", err)
+	}
+	if s := r.Summary(); s.VerifyMismatches != 1 {
+		t.Errorf("Expected the corruption to be detected, got %d mismatches", s.VerifyMismatches)
+	}
+
+	// A legitimate modification drops the stale record instead of reporting it
+	if err := os.WriteFile(testFile, []byte("new content"), 0644); err != nil {
+		t.Fatalf("Failed to modify file: %v", err)
+	}
+	if err := r.verifyStoredChecksum(rec, stop); err != nil {
+		t.Fatalf("verifyStoredChecksum failed: %v", err)
+	}
+	if _, found, _ := db.GetChecksum(testFile); found {
+		t.Errorf("Expected the stale checksum to be forgotten")
+	}
+	if s := r.Summary(); s.FilesVerified != 2 {
+		t.Errorf("Expected 2 verifications, got %d", s.FilesVerified)
+	}
+
+	// Files still queued in the run are left to the workers
+	r.setPending([]string{testFile})
+	if !r.isPending(testFile) {
+		t.Errorf("Expected %s to be pending", testFile)
+	}
+	r.finishPending(testFile)
+	if r.isPending(testFile) {
+		t.Errorf("Expected %s to no longer be pending", testFile)
+	}
+}
+
+func TestRebalanceFileNoVerify(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.NoVerify = true
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	content, err := os.ReadFile(testFile)
+	if err != nil || string(content) != "rebalance test data" {
+		t.Errorf("Unexpected content after rebalance: %q (err=%v)", content, err)
+	}
+
+	summary := r.Summary()
+	if summary.FilesRebalanced != 1 || !summary.VerificationDisabled {
+		t.Errorf("Expected 1 file rebalanced with verification disabled, got %+v", summary)
+	}
+}
+
+func TestActiveFiles(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	tmpPath := testFile + ".balance"
+	if err := os.WriteFile(tmpPath, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	r.startInflight(testFile, tmpPath, 100)
+	verifying := r.startInflight(testFile+"2", testFile+"2.balance", 100)
+	verifying.setStage(stageVerifying)
+
+	active := r.ActiveFiles()
+	if len(active) != 2 {
+		t.Fatalf("Expected 2 active files, got %+v", active)
+	}
+	if a := active[0]; a.Path != testFile || a.Stage != stageCopying || a.Size != 100 || a.Copied != 7 {
+		t.Errorf("Unexpected copying file %+v", a)
+	}
+	// Past the copy the temp file may be gone, the data is all there
+	if a := active[1]; a.Stage != stageVerifying || a.Copied != 100 {
+		t.Errorf("Unexpected verifying file %+v", a)
+	}
+
+	r.finishInflight(testFile)
+	r.finishInflight(testFile + "2")
+	if active := r.ActiveFiles(); len(active) != 0 {
+		t.Errorf("Expected no active files, got %+v", active)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	r.SetConcurrency(3)
+	if n := r.Concurrency(); n != 3 {
+		t.Errorf("Expected a concurrency of 3, got %d", n)
+	}
+
+	r.Pause()
+	if !r.Paused() {
+		t.Fatal("Expected the rebalancer to be paused")
+	}
+	done := make(chan error)
+	go func() { done <- r.Run(nil) }()
+
+	time.Sleep(100 * time.Millisecond)
+	if finished, queued := r.RunProgress(); finished != 0 || queued != 1 {
+		t.Errorf("Expected the queued file to wait while paused, got %d of %d finished", finished, queued)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected no rebalance while paused, got count %d", count)
+	}
+
+	r.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not finish after Resume")
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the file to be rebalanced after Resume, got count %d", count)
+	}
+
+	// A shutdown releases a paused run, leaving the queued files for later
+	r.Pause()
+	go func() { done <- r.Run(nil) }()
+	time.Sleep(50 * time.Millisecond)
+	r.InitiateShutdown()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after a shutdown while paused")
+	}
+	if s := r.Summary(); s.FilesRemaining != 1 || !s.Interrupted {
+		t.Errorf("Expected the file to remain after the shutdown, got %+v", s)
+	}
+}
+
+func TestTempFileWatchdog(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.TempFileTimeout = time.Minute
+	r.config.RequeueStalled = true
+
+	tmpPath := testFile + ".balance"
+	if err := os.WriteFile(tmpPath, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+
+	copying := r.startInflight(testFile, tmpPath, 100)
+	verifying := r.startInflight(testFile+"2", testFile+"2.balance", 100)
+	verifying.setStage(stageVerifying)
+
+	// First look records the temp file size, which counts as progress
+	now := time.Now()
+	r.checkInflight(now)
+	select {
+	case <-copying.cancel:
+		t.Fatalf("Copy canceled before the timeout elapsed")
+	default:
+	}
+
+	// No growth for longer than the timeout: the copy is canceled, other stages are left alone
+	r.checkInflight(now.Add(2 * time.Minute))
+	select {
+	case <-copying.cancel:
+	default:
+		t.Errorf("Expected the stalled copy to be canceled")
+	}
+	select {
+	case <-verifying.cancel:
+		t.Errorf("A worker past the copy stage must not be canceled")
+	default:
+	}
+
+	r.finishInflight(testFile)
+	r.finishInflight(testFile + "2")
+	if len(r.inflight) != 0 {
+		t.Errorf("Expected no in-flight files, got %d", len(r.inflight))
+	}
+}
+
+func TestEstimateFlashWrites(t *testing.T) {
+	const gb = int64(1024 * 1024 * 1024)
+	usage := treeUsage{files: 1000, bytes: 10 * gb, smallBytes: 1 * gb}
+	metadata := float64(1000*metadataBytesPerFile) + float64(10*gb)*metadataFraction
+
+	// HDD raidz2 with a flash special mirror: metadata and small files hit flash
+	hybrid := []zpool.Vdev{
+		{Name: "raidz2-0", Class: zpool.ClassData, Devices: []string{"a", "b", "c", "d", "e", "f"}},
+		{Name: "mirror-1", Class: zpool.ClassSpecial, Devices: []string{"n0", "n1"}},
+		{Name: "/dev/nvme2n1", Class: zpool.ClassLog, Devices: []string{"/dev/nvme2n1"}},
+	}
+	flash := map[string]bool{"mirror-1": true, "/dev/nvme2n1": true}
+	est := estimateFlashWrites(hybrid, flash, usage, 2)
+	if est.DataBytes != 0 {
+		t.Errorf("Expected no flash data writes on HDD data vdevs, got %d", est.DataBytes)
+	}
+	wantSpecial := int64((metadata+float64(1*gb))*2) * 2
+	if est.SpecialBytes != wantSpecial {
+		t.Errorf("Expected %d special vdev bytes, got %d", wantSpecial, est.SpecialBytes)
+	}
+
+	// All-flash mirror pool without special vdev: everything is written twice per pass
+	allFlash := []zpool.Vdev{{Name: "mirror-0", Class: zpool.ClassData, Devices: []string{"n0", "n1"}}}
+	est = estimateFlashWrites(allFlash, map[string]bool{"mirror-0": true}, usage, 0)
+	wantData := int64((float64(10*gb) + metadata) * 2)
+	if est.Passes != 1 || est.DataBytes != wantData || est.TotalBytes() != wantData {
+		t.Errorf("Expected %d data bytes over 1 pass, got %+v", wantData, est)
+	}
+}
+
+func TestRebalanceFileVerifyReadback(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.VerifyReadback = true
+	r.config.BackgroundVerify = true
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	// Read-back and streaming verification must record the same digest
+	rec, found, err := db.GetChecksum(testFile)
+	if err != nil || !found {
+		t.Fatalf("Expected a stored checksum, found=%t err=%v", found, err)
+	}
+	want, err := fileutil.FileHashSHA256(testFile)
+	if err != nil {
+		t.Fatalf("FileHashSHA256 failed: %v", err)
+	}
+	if rec.Digest != want || rec.CopyDigest != want || rec.HashedAt.IsZero() {
+		t.Errorf("Stored digests %s and %s (hashed at %v) do not match %s", rec.Digest, rec.CopyDigest, rec.HashedAt, want)
+	}
+}
+
+func TestGatherFilesBySize(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	largeFile := filepath.Join(r.config.RootPath, "large.bin")
+	if err := os.WriteFile(largeFile, make([]byte, 64<<10), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	cases := []struct {
+		minSize, maxSize int64
+		want             []string
+	}{
+		{0, 0, []string{largeFile, testFile}},
+		{1 << 10, 0, []string{largeFile}},
+		{0, 1 << 10, []string{testFile}},
+		{64 << 10, 64 << 10, []string{largeFile}},
+		{1 << 10, 2 << 10, nil},
+	}
+	for _, c := range cases {
+		r.config.MinSize, r.config.MaxSize = c.minSize, c.maxSize
+		files, err := r.GatherFiles()
+		if err != nil {
+			t.Fatalf("GatherFiles failed: %v", err)
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, c.want) {
+			t.Errorf("MinSize %d, MaxSize %d: expected %v, got %v", c.minSize, c.maxSize, c.want, files)
+		}
+	}
+}
+
+func TestSkipLargerThan(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	largeFile := filepath.Join(r.config.RootPath, "large.bin")
+	if err := os.WriteFile(largeFile, make([]byte, 64<<10), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	r.config.SkipLargerThan = 1 << 10
+
+	// Gathered twice, as by a second pass, the file is counted once
+	for i := 0; i < 2; i++ {
+		files, err := r.GatherFiles()
+		if err != nil {
+			t.Fatalf("GatherFiles failed: %v", err)
+		}
+		if !reflect.DeepEqual(files, []string{testFile}) {
+			t.Fatalf("Expected only %s gathered, got %v", testFile, files)
+		}
+	}
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(largeFile); count != 0 {
+		t.Errorf("Expected the large file left alone, rebalanced %d times", count)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the small file rebalanced once, got %d", count)
+	}
+	s := r.Summary()
+	if s.FilesTooLarge != 1 || s.BytesTooLarge != 64<<10 || s.FilesSkipped != 0 {
+		t.Errorf("Expected one file of 64K too large and none skipped, got %d of %d bytes, %d skipped",
+			s.FilesTooLarge, s.BytesTooLarge, s.FilesSkipped)
+	}
+	if totals := s.Totals(); totals.FilesTooLarge != 1 {
+		t.Errorf("Expected the file in the run report totals, got %d", totals.FilesTooLarge)
+	}
+}
+
+func TestGatherFilesByInode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode numbers are not available on Windows")
+	}
+
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	otherFile := filepath.Join(r.config.RootPath, "other.txt")
+	if err := os.WriteFile(otherFile, []byte("other data"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	info, err := os.Stat(testFile)
+	if err != nil {
+		t.Fatalf("Failed to stat test file: %v", err)
+	}
+	id, err := fileutil.GetFileIDFromFileInfo(info)
+	if err != nil {
+		t.Fatalf("GetFileIDFromFileInfo failed: %v", err)
+	}
+
+	list := fmt.Sprintf("# from zdb\n%d %d\n999999999 # no longer exists\n", id.Dev, id.Ino)
+	include, err := ParseInodeSet(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("ParseInodeSet failed: %v", err)
+	}
+	r.config.IncludeInodes = include
+
+	files, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != testFile {
+		t.Errorf("Expected only %s to be selected, got %v", testFile, files)
+	}
+	if missing := include.Unresolved(); len(missing) != 1 || missing[0] != "999999999" {
+		t.Errorf("Expected the stale inode to be unresolved, got %v", missing)
+	}
+
+	// The same list used as an exclusion selects everything else
+	exclude, _ := ParseInodeSet(strings.NewReader(fmt.Sprintf("%d", id.Ino)))
+	r.config.IncludeInodes, r.config.ExcludeInodes = nil, exclude
+	files, err = r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != otherFile {
+		t.Errorf("Expected only %s to remain, got %v", otherFile, files)
+	}
+
+	if _, err := ParseInodeSet(strings.NewReader("1 2 3\n")); err == nil {
+		t.Errorf("Expected an error for a malformed line")
+	}
+}
+
+func TestVerifyOnly(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.RecordChecksums = true
+
+	otherFile := filepath.Join(r.config.RootPath, "other.txt")
+	if err := os.WriteFile(otherFile, []byte("other data"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	report, err := r.VerifyOnly()
+	if err != nil {
+		t.Fatalf("VerifyOnly failed: %v", err)
+	}
+	if report.Checked != 1 || report.Matched != 1 || report.Unrecorded != 1 || len(report.Mismatched) != 0 {
+		t.Errorf("Unexpected report for an intact tree: %+v", report)
+	}
+
+	// Same size and mtime but different content is reported, without touching the file
+	info, _ := os.Stat(testFile)
+	if err := os.WriteFile(testFile, []byte("REBALANCE TEST DATA"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+	os.Chtimes(testFile, info.ModTime(), info.ModTime())
+
+	report, err = r.VerifyOnly()
+	if err != nil {
+		t.Fatalf("VerifyOnly failed: %v", err)
+	}
+	if len(report.Mismatched) != 1 || report.Mismatched[0] != testFile {
+		t.Errorf("Expected %s to be reported as mismatched, got %+v", testFile, report)
+	}
+	if _, err := os.Stat(testFile + ".balance"); !os.IsNotExist(err) {
+		t.Errorf("Verify-only must not create copies")
+	}
+}
+
+func TestRunInterruptedSummary(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		extra := filepath.Join(filepath.Dir(testFile), fmt.Sprintf("extra_%d.txt", i))
+		if err := os.WriteFile(extra, []byte("more test data"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	s := r.Summary()
+	if s.FilesRebalanced != 3 || s.FilesRemaining != 0 || s.Interrupted {
+		t.Errorf("Expected 3 rebalanced, 0 remaining, not interrupted; got %d, %d, %t", s.FilesRebalanced, s.FilesRemaining, s.Interrupted)
+	}
+
+	// Files at the pass limit are skipped
+	r.config.PassesLimit = 1
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if s := r.Summary(); s.FilesSkipped != 3 || s.FilesRemaining != 0 {
+		t.Errorf("Expected 3 skipped, 0 remaining; got %d, %d", s.FilesSkipped, s.FilesRemaining)
+	}
+
+	// A run started after a shutdown request leaves everything for later
+	r.config.PassesLimit = 3
+	r.InitiateShutdown()
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	s = r.Summary()
+	if !s.Interrupted || s.FilesRemaining != 3 {
+		t.Errorf("Expected an interrupted run with 3 remaining, got interrupted=%t remaining=%d", s.Interrupted, s.FilesRemaining)
+	}
+	if s.FilesRebalanced != 3 || s.FilesSkipped != 3 || s.FilesFailed != 0 {
+		t.Errorf("Expected totals from earlier runs to be kept, got %d rebalanced, %d skipped, %d failed", s.FilesRebalanced, s.FilesSkipped, s.FilesFailed)
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.RebalanceFileContext(ctx, testFile); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from RebalanceFileContext, got %v", err)
+	}
+	if err := r.RunContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from RunContext, got %v", err)
+	}
+
+	if _, err := os.Stat(testFile + ".balance"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temp file to be left behind, stat returned %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the file not to be rebalanced, got count %d", count)
+	}
+	s := r.Summary()
+	if !s.Interrupted || s.FilesRemaining != 1 {
+		t.Errorf("Expected an interrupted run with 1 remaining, got interrupted=%t remaining=%d", s.Interrupted, s.FilesRemaining)
+	}
+
+	// A fresh context runs normally on the same Rebalancer
+	if err := r.RunContext(context.Background(), nil); err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if s := r.Summary(); s.Interrupted || s.FilesRebalanced != 1 {
+		t.Errorf("Expected a completed run with 1 file rebalanced, got interrupted=%t rebalanced=%d", s.Interrupted, s.FilesRebalanced)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	logPath := filepath.Join(t.TempDir(), "logs", "audit.log")
+	auditLog, err := OpenAuditLog(logPath)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	r.config.AuditLog = auditLog
+	r.config.ChecksumType = fileutil.ChecksumSHA256
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a remove and a rename entry, got %q", lines)
+	}
+	size := fmt.Sprintf("size=%d", len("rebalance test data"))
+	for i, op := range []string{"op=remove path=" + fmt.Sprintf("%q", testFile), "op=rename path=" + fmt.Sprintf("%q", testFile+".balance")} {
+		if !strings.Contains(lines[i], op) || !strings.Contains(lines[i], size) || !strings.Contains(lines[i], "digest=sha256:") {
+			t.Errorf("Unexpected entry %d: %s", i, lines[i])
+		}
+	}
+	if !strings.Contains(lines[1], "target="+fmt.Sprintf("%q", testFile)) {
+		t.Errorf("Expected the rename entry to name its target: %s", lines[1])
+	}
+
+	// The published parser reads what was written
+	entries, err := report.ReadAuditLog(bytes.NewReader(data))
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ReadAuditLog returned %d entries, err=%v", len(entries), err)
+	}
+	if entries[1].Op != report.AuditRename || entries[1].Target != testFile || entries[1].Size != int64(len("rebalance test data")) {
+		t.Errorf("Unexpected parsed rename entry %+v", entries[1])
+	}
+}
+
+func TestFormatAuditEntry(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	got := formatAuditEntry(at, auditEntry{op: auditRemove, path: "/tank/a b\n", size: -1, err: errors.New("busy")})
+	want := "2024-05-01T12:30:00Z op=remove status=failed path=\"/tank/a b\\n\" error=\"busy\"\n"
+	if got != want {
+		t.Errorf("formatAuditEntry = %q, want %q", got, want)
+	}
+}
+
+func TestAuditLogReplay(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	auditLog, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	defer auditLog.Close()
+	r.config.AuditLog = auditLog
+
+	// Two originals removed by a run that died before renaming their copies, one of
+	// which was damaged since, and a stale copy whose original is still there
+	digest, err := fileutil.FileHash(testFile, fileutil.ChecksumSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(filepath.Dir(testFile), "damaged.txt")
+	stale := filepath.Join(filepath.Dir(testFile), "stale.txt")
+	for _, path := range []string{testFile, damaged} {
+		if err := r.audit(auditEntry{op: auditRemove, path: path, size: 19, digest: "sha256:" + digest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(testFile, testFile+DefaultTempSuffix); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]string{damaged + DefaultTempSuffix: "rebalance test dat4", stale: "stale", stale + DefaultTempSuffix: "stale"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.cleanupBalanceFiles(); err != nil {
+		t.Fatalf("cleanupBalanceFiles failed: %v", err)
+	}
+	if data, err := os.ReadFile(testFile); err != nil || string(data) != "rebalance test data" {
+		t.Errorf("Expected %s to be restored, got %q, %v", testFile, data, err)
+	}
+	if _, err := os.Stat(damaged + DefaultTempSuffix); err != nil {
+		t.Errorf("Expected the damaged copy to be kept: %v", err)
+	}
+	if _, err := os.Stat(damaged); !os.IsNotExist(err) {
+		t.Errorf("Expected the damaged copy not to be restored: %v", err)
+	}
+	if _, err := os.Stat(stale + DefaultTempSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale copy to be cleaned up: %v", err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	var calls []string
+	r.config.Hooks = Hooks{
+		PreFile: func(ctx context.Context, filePath string) error {
+			calls = append(calls, "pre "+filePath)
+			return errors.New("snapshot failed")
+		},
+		PostFile: func(ctx context.Context, filePath string, result FileResult) error {
+			calls = append(calls, fmt.Sprintf("post %s %s %d", filePath, result.Status, result.Size))
+			return nil
+		},
+	}
+
+	// A failing pre-file hook is only logged by default
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	size := len("rebalance test data")
+	want := []string{"pre " + testFile, fmt.Sprintf("post %s rebalanced %d", testFile, size)}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected hook calls %q, got %q", want, calls)
+	}
+
+	// ...and aborts the file when requested
+	calls = nil
+	r.config.Hooks.AbortOnPreFileError = true
+	if err := r.RebalanceFile(testFile); err == nil || !strings.Contains(err.Error(), "snapshot failed") {
+		t.Errorf("Expected the pre-file hook error, got %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the aborted file not to be rebalanced again, got count %d", count)
+	}
+	if len(calls) != 1 {
+		t.Errorf("Expected only the pre-file hook to run for an aborted file, got %q", calls)
+	}
+}
+
+func TestCommandHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands are tested with sh")
+	}
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	out := filepath.Join(t.TempDir(), "hook.out")
+	r.config.Hooks = CommandHooks(
+		`echo "pre $1" >> `+out,
+		`echo "post $REBALANCE_FILE $REBALANCE_STATUS $REBALANCE_SIZE" >> `+out,
+		true)
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Failed to read hook output: %v", err)
+	}
+	want := fmt.Sprintf("pre %s\npost %s rebalanced %d\n", testFile, testFile, len("rebalance test data"))
+	if string(data) != want {
+		t.Errorf("Expected hook output %q, got %q", want, string(data))
+	}
+
+	// A failing command reports its output
+	r.config.Hooks = CommandHooks("echo no space left >&2; exit 3", "", true)
+	if err := r.RebalanceFile(testFile); err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Errorf("Expected the failing pre-file command to abort the file with its output, got %v", err)
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	hook := logtest.NewLocal(r.logger)
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	ops := make(map[string]*log.Entry)
+	for _, entry := range hook.AllEntries() {
+		if op, ok := entry.Data[FieldOperation].(string); ok {
+			ops[op] = entry
+		}
+	}
+	for _, op := range []string{OpCopy, OpRemove, OpRename, OpRebalanced} {
+		if ops[op] == nil {
+			t.Fatalf("Expected a log entry for operation %q", op)
+		}
+	}
+
+	if path := ops[OpRemove].Data[FieldPath]; path != testFile {
+		t.Errorf("Expected remove path %s, got %v", testFile, path)
+	}
+	if target := ops[OpRename].Data[FieldTarget]; target != testFile {
+		t.Errorf("Expected rename target %s, got %v", testFile, target)
+	}
+	success := ops[OpRebalanced].Data
+	if success[FieldBytes] != int64(len("rebalance test data")) {
+		t.Errorf("Expected bytes field of %d, got %v", len("rebalance test data"), success[FieldBytes])
+	}
+	if _, ok := success[FieldSpeed].(float64); !ok {
+		t.Errorf("Expected a float speed field, got %v", success[FieldSpeed])
+	}
+
+	// The published parser reads the JSON log format
+	var buf bytes.Buffer
+	formatter := &log.JSONFormatter{}
+	for _, entry := range hook.AllEntries() {
+		line, err := formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("JSONFormatter failed: %v", err)
+		}
+		buf.Write(line)
+	}
+	events, err := report.ReadEvents(&buf)
+	if err != nil {
+		t.Fatalf("ReadEvents failed: %v", err)
+	}
+	var parsed *report.Event
+	for i := range events {
+		if events[i].Operation == report.OpRebalanced {
+			parsed = &events[i]
+		}
+	}
+	if parsed == nil || parsed.Path != testFile || parsed.Bytes != int64(len("rebalance test data")) {
+		t.Errorf("Expected a parsed rebalanced event for %s, got %+v", testFile, parsed)
+	}
+}
+
+func TestUnitsInLogs(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	if err := os.WriteFile(testFile, make([]byte, 1500), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	r.config.Units = units.Units{SI: true}
+
+	hook := logtest.NewLocal(r.logger)
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+
+	var copied string
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Copied '") {
+			copied = entry.Message
+		}
+	}
+	if copied == "" {
+		t.Skip("Allocated size not available on this filesystem")
+	}
+	if !strings.Contains(copied, "logical size 1.50 kB, allocated ") || strings.Contains(copied, "bytes") {
+		t.Errorf("Expected the copied sizes in SI units, got %q", copied)
+	}
+}
+
+func TestTempPathFor(t *testing.T) {
+	dir := string(filepath.Separator) + "tank"
+	naming := tempNaming{suffix: DefaultTempSuffix}
+
+	tmp, shortened, err := naming.pathFor(filepath.Join(dir, "file.txt"))
+	if err != nil || shortened || tmp != filepath.Join(dir, "file.txt.balance") {
+		t.Errorf("Expected the plain suffix, got %q shortened=%t err=%v", tmp, shortened, err)
+	}
+
+	// Two long names sharing a prefix get distinct temp names within the limit
+	long1 := strings.Repeat("é", 122) + "-1.mkv"
+	long2 := strings.Repeat("é", 122) + "-2.mkv"
+	tmp1, shortened, err := naming.pathFor(filepath.Join(dir, long1))
+	if err != nil || !shortened {
+		t.Fatalf("Expected a shortened temp name, got shortened=%t err=%v", shortened, err)
+	}
+	tmp2, _, _ := naming.pathFor(filepath.Join(dir, long2))
+	for _, tmp := range []string{tmp1, tmp2} {
+		name := filepath.Base(tmp)
+		if len(name) > maxNameBytes || !strings.HasSuffix(name, DefaultTempSuffix) || !utf8.ValidString(name) {
+			t.Errorf("Invalid shortened temp name %q (%d bytes)", name, len(name))
+		}
+	}
+	if tmp1 == tmp2 {
+		t.Errorf("Expected distinct temp names, both are %q", tmp1)
+	}
+	// Only unshortened names lead back to their original
+	if original, ok := naming.originalOf(filepath.Join(dir, "file.txt.balance")); !ok || original != filepath.Join(dir, "file.txt") {
+		t.Errorf("Expected the original of the copy, got %q, %t", original, ok)
+	}
+	if _, ok := naming.originalOf(tmp1); ok {
+		t.Error("Expected no original for a shortened temp name")
+	}
+
+	deep := dir + strings.Repeat(string(filepath.Separator)+strings.Repeat("d", 200), 200)
+	if _, _, err := naming.pathFor(filepath.Join(deep, "file")); !errors.Is(err, errPathTooLong) {
+		t.Errorf("Expected errPathTooLong, got %v", err)
+	}
+
+	// A custom suffix in a hidden subdirectory; only the files there are temporary copies
+	naming = tempNaming{suffix: ".rebal", subdir: true}
+	tmp, _, err = naming.pathFor(filepath.Join(dir, "file.txt"))
+	if err != nil || tmp != filepath.Join(dir, TempSubdirName, "file.txt.rebal") {
+		t.Errorf("Expected the copy in the temp subdirectory, got %q, %v", tmp, err)
+	}
+	if !naming.isTemp(tmp) || naming.isTemp(filepath.Join(dir, "file.txt.rebal")) || naming.isTemp(filepath.Join(dir, TempSubdirName, "file.txt")) {
+		t.Error("Expected only files with the suffix in the temp subdirectory to be temporary copies")
+	}
+	if original, ok := naming.originalOf(tmp); !ok || original != filepath.Join(dir, "file.txt") {
+		t.Errorf("Expected the original of the copy in the temp subdirectory, got %q, %t", original, ok)
+	}
+	for _, bad := range []string{"", "/x", `.a\b`, ".."} {
+		if err := CheckTempSuffix(bad); err == nil {
+			t.Errorf("Expected an error for the suffix %q", bad)
+		}
+	}
+}
+
+func TestTempSubdir(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := OpenAuditLog(logPath)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	defer auditLog.Close()
+	r.config.AuditLog = auditLog
+	r.config.TempSuffix, r.config.TempSubdir = ".rebal", true
+	r.config.CleanupBalanceFiles = true
+
+	// A file of an application that happens to use the suffix, and a stale copy
+	appFile := filepath.Join(dir, "app.rebal")
+	stale := filepath.Join(dir, TempSubdirName, "gone.txt.rebal")
+	if err := os.WriteFile(appFile, []byte("application data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(stale), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, path := range []string{testFile, appFile} {
+		if count, err := db.GetRebalanceCount(path); err != nil || count != 1 {
+			t.Errorf("Expected %s rebalanced once, got %d, %v", filepath.Base(path), count, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, TempSubdirName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp subdirectory to be removed after the run: %v", err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("op=rename path=%q", filepath.Join(dir, TempSubdirName, "test_file.txt.rebal")); !strings.Contains(string(data), want) {
+		t.Errorf("Expected the copy to be made in the temp subdirectory, audit log:\n%s", data)
+	}
+	if !strings.Contains(string(data), fmt.Sprintf("op=cleanup path=%q", stale)) {
+		t.Errorf("Expected the stale copy to be cleaned up, audit log:\n%s", data)
+	}
+}
+
+func TestRebalanceFileLongName(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	longFile := filepath.Join(filepath.Dir(testFile), strings.Repeat("n", 250))
+	if err := os.WriteFile(longFile, []byte("long name data"), 0644); err != nil {
+		t.Skipf("Filesystem does not accept a 250 byte name: %v", err)
+	}
+
+	if err := r.RebalanceFile(longFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	data, err := os.ReadFile(longFile)
+	if err != nil || string(data) != "long name data" {
+		t.Errorf("Expected the content to survive, got %q err=%v", data, err)
+	}
+	if s := r.Summary(); s.TempNamesShortened != 1 || s.FilesRebalanced != 1 {
+		t.Errorf("Expected 1 shortened temp name and 1 file rebalanced, got %d and %d", s.TempNamesShortened, s.FilesRebalanced)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	r, _, _, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.Retries = 3
+	r.config.RetryBackoff = time.Millisecond
+
+	// Transient failures are retried until the operation succeeds
+	calls, retries := 0, 0
+	err := r.withRetry(context.Background(), "Copy", "/tank/file", &retries, func() error {
+		calls++
+		if calls < 3 {
+			return &os.PathError{Op: "open", Path: "/tank/file", Err: syscall.EBUSY}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || retries != 2 {
+		t.Errorf("Expected success on the third call with 2 retries, got err=%v calls=%d retries=%d", err, calls, retries)
+	}
+
+	// Other errors fail at once
+	calls = 0
+	err = r.withRetry(context.Background(), "Copy", "/tank/file", &retries, func() error {
+		calls++
+		return os.ErrNotExist
+	})
+	if !errors.Is(err, os.ErrNotExist) || calls != 1 {
+		t.Errorf("Expected one call for a permanent error, got err=%v calls=%d", err, calls)
+	}
+
+	// The retry budget is bounded
+	calls = 0
+	err = r.withRetry(context.Background(), "Copy", "/tank/file", &retries, func() error {
+		calls++
+		return syscall.EBUSY
+	})
+	if !errors.Is(err, syscall.EBUSY) || calls != 4 {
+		t.Errorf("Expected 1 attempt and 3 retries, got err=%v calls=%d", err, calls)
+	}
+
+	if s := r.Summary(); s.RetryAttempts != 5 {
+		t.Errorf("Expected 5 retry attempts in the summary, got %d", s.RetryAttempts)
+	}
+}
+
+func TestPoolBandwidthLimit(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	stateDir := t.TempDir()
+	r.config.PoolBandwidth = 100 << 20
+	r.config.BandwidthStateDir = stateDir
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the file to be rebalanced under the limit, got count %d", count)
+	}
+	if r.limiter != nil {
+		t.Error("Expected the limiter to be released after the run")
+	}
+
+	buckets, _ := filepath.Glob(filepath.Join(stateDir, "*.bucket"))
+	if len(buckets) != 1 {
+		t.Errorf("Expected one shared bucket in the state directory, got %v", buckets)
+	}
+}
+
+func TestRunPerPoolLimit(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.MaxWorkersPerPool = 1
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the file to be rebalanced, got count %d", count)
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.Hooks.PreFile = func(ctx context.Context, filePath string) error {
+		panic("hook bug")
+	}
+
+	if err := r.Run(nil); err == nil {
+		t.Fatal("Expected the run to report the failed file")
+	}
+	if s := r.Summary(); s.FilesFailed != 1 {
+		t.Errorf("Expected 1 failed file, got %d", s.FilesFailed)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the file not to be rebalanced, got count %d", count)
+	}
+}
+
+// panicLimiter panics in the middle of a copy
+type panicLimiter struct{}
+
+func (panicLimiter) Wait(n int) error { panic("limiter bug") }
+
+func TestRebalanceFilePanicCleanup(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.limiter = panicLimiter{}
+
+	var status string
+	r.config.Hooks.PostFile = func(ctx context.Context, filePath string, result FileResult) error {
+		status = result.Status
+		return nil
+	}
+
+	_, err := r.rebalanceFile(context.Background(), testFile)
+	if err == nil || !strings.Contains(err.Error(), "limiter bug") {
+		t.Fatalf("Expected the panic as an error, got %v", err)
+	}
+	if _, err := os.Stat(testFile + ".balance"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp copy to be removed, got %v", err)
+	}
+	content, err := os.ReadFile(testFile)
+	if err != nil || string(content) != "rebalance test data" {
+		t.Errorf("Expected the original to be untouched, got %q (%v)", content, err)
+	}
+	if status != FileFailed {
+		t.Errorf("Expected the post-file hook to see a failure, got %q", status)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected no rebalance to be recorded, got count %d", count)
+	}
+}
+
+func TestOnFileResult(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	var results []FileResult
+	r.config.OnFileResult = func(result FileResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+	}
+	var hookPath string
+	r.config.Hooks.PostFile = func(ctx context.Context, filePath string, result FileResult) error {
+		hookPath = result.Path
+		return nil
+	}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected one file result, got %v", results)
+	}
+	result := results[0]
+	if result.Path != testFile || result.Status != FileRebalanced || result.Err != nil {
+		t.Errorf("Expected %s rebalanced, got %+v", testFile, result)
+	}
+	if result.Size != int64(len("rebalance test data")) || result.Duration <= 0 {
+		t.Errorf("Expected the size and duration of the file, got %d bytes in %s", result.Size, result.Duration)
+	}
+	if hookPath != testFile {
+		t.Errorf("Expected the post-file hook to get the path, got %q", hookPath)
+	}
+}
+
+func TestStats(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.PassesLimit = 1
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, err := r.rebalanceFile(context.Background(), testFile); err != nil {
+		t.Fatalf("rebalanceFile failed: %v", err)
+	}
+
+	stats := r.Stats()
+	if stats.Queued != 1 || stats.Done != 1 || stats.Rebalanced != 1 || stats.Failed != 0 {
+		t.Errorf("Expected 1 file queued, done and rebalanced, got %+v", stats)
+	}
+	size := int64(len("rebalance test data"))
+	if stats.BytesRebalanced != size || stats.Bytes.Done != size || stats.Bytes.Total != size {
+		t.Errorf("Expected %d bytes rebalanced and done, got %d, %d of %d", size, stats.BytesRebalanced, stats.Bytes.Done, stats.Bytes.Total)
+	}
+	if !reflect.DeepEqual(stats.SkippedBy, map[SkipReason]int64{SkipPassLimit: 1}) {
+		t.Errorf("Expected one file skipped at the pass limit, got %v", stats.SkippedBy)
+	}
+	if stats.Interrupted || stats.Elapsed <= 0 {
+		t.Errorf("Expected an uninterrupted run with its elapsed time, got %+v", stats)
+	}
+}
+
+func TestOneFileSystem(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("device numbers are not available on Windows")
+	}
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.OneFileSystem = true
+
+	files, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{testFile}) {
+		t.Errorf("Expected the file on the root filesystem gathered, got %v", files)
+	}
+
+	// A directory on a device other than the root's is not entered
+	info, err := os.Stat(r.config.RootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := fileutil.GetFileIDFromFileInfo(info)
+	r.walkDevices = map[uint64]bool{id.Dev + 1: true}
+	if files, err = r.GatherFiles(); err != nil || len(files) != 0 {
+		t.Errorf("Expected nothing gathered on another device, got %v (%v)", files, err)
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	root := r.config.RootPath
+	write := func(rel, content string) string {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rootIgnore := write(IgnoreFileName, "# databases and VMs\n*.db\n!keep.db\nvm/\n/top.log\n")
+	keep := write("keep.db", "x")
+	write("a.db", "x")
+	write("vm/disk.img", "x")
+	write("top.log", "x")
+	nestedLog := write("sub/top.log", "x")
+	subIgnore := write("sub/"+IgnoreFileName, "!*.db\n")
+	subDB := write("sub/b.db", "x")
+	deepDB := write("sub/deep/c.db", "x")
+
+	files, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	sort.Strings(files)
+	expected := []string{rootIgnore, keep, subIgnore, subDB, deepDB, nestedLog, testFile}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v gathered, got %v", expected, files)
+	}
+
+	// Listed files below an ignored directory are skipped too
+	r.config.Files = []string{filepath.Join(root, "vm", "disk.img"), subDB}
+	if files, err = r.GatherFiles(); err != nil || !reflect.DeepEqual(files, []string{subDB}) {
+		t.Errorf("Expected only %s of the listed files, got %v (%v)", subDB, files, err)
+	}
+
+	r.config.Files = nil
+	r.config.NoIgnoreFiles = true
+	if files, err = r.GatherFiles(); err != nil || len(files) != 10 {
+		t.Errorf("Expected all 10 files with NoIgnoreFiles, got %v (%v)", files, err)
+	}
+}
+
+func TestPoolFragmentationNotZFS(t *testing.T) {
+	r, _, _, cleanup := setupTest(t)
+	defer cleanup()
+
+	r.nestedMounts()
+	if r.rootMountFound && r.rootMount.Pool() != "" {
+		t.Skip("Test directory is on ZFS")
+	}
+	if _, err := r.PoolFragmentation(); err == nil {
+		t.Error("Expected an error for a root path outside ZFS")
+	}
+}
+
+func TestClockAdjustment(t *testing.T) {
+	cases := []struct {
+		elapsed, wall, want time.Duration
+	}{
+		{time.Hour, time.Hour, 0},
+		{time.Hour, time.Hour + 300*time.Millisecond, 0},
+		{time.Hour, 2 * time.Hour, time.Hour},
+		{time.Hour, 50 * time.Minute, -10 * time.Minute},
+		{time.Minute, -time.Minute, -2 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := clockAdjustment(c.elapsed, c.wall); got != c.want {
+			t.Errorf("clockAdjustment(%s, %s) = %s, want %s", c.elapsed, c.wall, got, c.want)
+		}
+	}
+
+	// A run without clock steps reports none
+	r, _, _, cleanup := setupTest(t)
+	defer cleanup()
+	if s := r.Summary(); s.ClockAdjustment != 0 {
+		t.Errorf("Expected no clock adjustment, got %s", s.ClockAdjustment)
+	}
+}
+
+func TestRunMultipleRoots(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	otherRoot := t.TempDir()
+	otherFile := filepath.Join(otherRoot, "other.txt")
+	if err := os.WriteFile(otherFile, []byte("second tree"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	r.config.RootPaths = []string{r.config.RootPath, otherRoot}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, f := range []string{testFile, otherFile} {
+		if count, _ := db.GetRebalanceCount(f); count != 1 {
+			t.Errorf("Expected %s to be rebalanced once, got count %d", f, count)
+		}
+	}
+	if s := r.Summary(); s.FilesRebalanced != 2 {
+		t.Errorf("Expected a combined summary of 2 files, got %d", s.FilesRebalanced)
+	}
+
+	// A root inside another would have its files rebalanced twice per pass
+	r.config.RootPaths = []string{otherRoot, filepath.Join(r.config.RootPath, "."), r.config.RootPath}
+	if _, err := r.GatherFiles(); err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("Expected overlapping root paths to be rejected, got %v", err)
+	}
+}
+
+func TestChecksumBySize(t *testing.T) {
+	rules, err := ParseChecksumRules("1G:xxh3, 100M:blake3")
+	if err != nil {
+		t.Fatalf("ParseChecksumRules failed: %v", err)
+	}
+	want := []ChecksumRule{{100 << 20, fileutil.ChecksumBLAKE3}, {1 << 30, fileutil.ChecksumXXH3}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Fatalf("ParseChecksumRules = %v, want %v", rules, want)
+	}
+	for _, bad := range []string{"1G", "1G:crc32", "big:xxh3", "1G:xxh3,1024M:md5", "-1:md5"} {
+		if _, err := ParseChecksumRules(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.ChecksumBySize = rules
+	for size, want := range map[int64]fileutil.ChecksumType{
+		0:           fileutil.ChecksumSHA256,
+		100<<20 - 1: fileutil.ChecksumSHA256,
+		100 << 20:   fileutil.ChecksumBLAKE3,
+		1 << 30:     fileutil.ChecksumXXH3,
+		5 << 40:     fileutil.ChecksumXXH3,
+	} {
+		if got := r.checksumFor(size); got != want {
+			t.Errorf("checksumFor(%d) = %s, want %s", size, got, want)
+		}
+	}
+
+	// The selected algorithm is recorded with the stored checksum
+	r.config.ChecksumBySize = []ChecksumRule{{MinSize: 1, Type: fileutil.ChecksumXXH3}}
+	r.config.RecordChecksums = true
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	rec, found, err := db.GetChecksum(testFile)
+	if err != nil || !found || rec.Algorithm != string(fileutil.ChecksumXXH3) {
+		t.Errorf("Expected an xxh3 checksum record, got %+v err=%v", rec, err)
+	}
+}
+
+func TestPlanAndFilesFrom(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+	var files []string
+	for i := 0; i < 4; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("file %d", i))
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		files = append(files, f)
+	}
+	db.SetRebalanceCount(files[0], r.config.PassesLimit)
+
+	plan, err := r.Plan()
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan) != 4 {
+		t.Fatalf("Expected 4 planned files without the one at its pass limit, got %v", plan)
+	}
+	for _, e := range plan {
+		if e.Path == files[0] {
+			t.Errorf("File at its pass limit was planned: %s", e)
+		}
+		if e.Reason == "" || e.Size <= 0 {
+			t.Errorf("Expected a size and a reason: %s", e)
+		}
+	}
+
+	// Run a reversed, edited plan: only the listed files are processed, in order
+	var b strings.Builder
+	b.WriteString("# reviewed\n")
+	b.WriteString(plan[1].String() + "\n")
+	b.WriteString(plan[0].String() + "\n")
+	b.WriteString(plan[0].Path + "\n")
+	listed, err := ParseFileList(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("ParseFileList failed: %v", err)
+	}
+	r.config.Files = listed
+	r.config.Order = OrderRandom
+	r.config.PassesLimit = 1
+	r.config.Concurrency = 1
+
+	gathered, err := r.GatherFiles()
+	if err != nil {
+		t.Fatalf("GatherFiles failed: %v", err)
+	}
+	if len(gathered) != 2 || gathered[0] != plan[1].Path || gathered[1] != plan[0].Path {
+		t.Errorf("Expected the listed files once each in list order, got %v", gathered)
+	}
+	var order []string
+	r.config.Hooks.PreFile = func(ctx context.Context, filePath string) error {
+		order = append(order, filePath)
+		return nil
+	}
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if s := r.Summary(); s.FilesRebalanced != 2 {
+		t.Errorf("Expected 2 files rebalanced, got %d", s.FilesRebalanced)
+	}
+	if !reflect.DeepEqual(order, gathered) {
+		t.Errorf("Expected the run to keep the list order %v, got %v", gathered, order)
+	}
+	r.config.Hooks.PreFile = nil
+
+	r.config.Files = []string{"/elsewhere/file"}
+	if _, err := r.GatherFiles(); err == nil {
+		t.Error("Expected an error for a listed file outside the root path")
+	}
+
+	if empty, err := ParseFileList(strings.NewReader("\n")); err != nil || empty == nil {
+		t.Errorf("Expected an empty, non-nil list, got %v, %v", empty, err)
+	}
+}
+
+func TestParseFileListReports(t *testing.T) {
+	rep := &report.RunReport{Files: []report.FileOutcome{
+		{Path: "/tank/b\xe9", Status: report.StatusFailed},
+		{Path: "/tank/a", Status: report.StatusRebalanced},
+	}}
+	want := []string{"/tank/b\xe9", "/tank/a"}
+
+	var js, csv bytes.Buffer
+	if err := rep.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	if err := rep.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	for name, list := range map[string]string{"JSON": js.String(), "CSV": csv.String()} {
+		files, err := ParseFileList(strings.NewReader(list))
+		if err != nil {
+			t.Fatalf("ParseFileList of the %s report failed: %v", name, err)
+		}
+		if !reflect.DeepEqual(files, want) {
+			t.Errorf("Expected the %s report to list %q, got %q", name, want, files)
+		}
+	}
+
+	if _, err := ParseFileList(strings.NewReader(`{"files": [`)); err == nil {
+		t.Error("Expected an error for a truncated JSON report")
+	}
+}
+
+func TestRecordDegradation(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	hook := logtest.NewLocal(r.logger)
+
+	fs := r.filesystemOf(testFile)
+	if fs == "" {
+		t.Fatal("Expected a filesystem name")
+	}
+	for i := 0; i < 3; i++ {
+		r.recordDegradation(fs, fileutil.MetadataACL, testFile)
+	}
+	r.recordDegradation(fs, fileutil.MetadataXattr, testFile)
+
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("Expected one warning per class, got %d", warnings)
+	}
+	want := []MetadataDegradation{
+		{Filesystem: fs, Class: fileutil.MetadataACL, Files: 3},
+		{Filesystem: fs, Class: fileutil.MetadataXattr, Files: 1},
+	}
+	if got := r.Summary().UnsupportedMetadata; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestReport(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.ReportFiles = true
+
+	skipped := filepath.Join(filepath.Dir(testFile), "done.txt")
+	if err := os.WriteFile(skipped, []byte("done"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	db.SetRebalanceCount(skipped, r.config.PassesLimit)
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	rep := r.Report()
+	if rep.Totals.FilesRebalanced != 1 || rep.Totals.FilesSkipped != 1 || len(rep.Files) != 2 {
+		t.Fatalf("Unexpected report: %+v", rep)
+	}
+	statuses := make(map[string]report.FileOutcome)
+	for _, f := range rep.Files {
+		statuses[f.Path] = f
+	}
+	if f := statuses[testFile]; f.Status != report.StatusRebalanced || f.Bytes != int64(len("rebalance test data")) || f.BytesPerSecond <= 0 {
+		t.Errorf("Unexpected outcome of the rebalanced file: %+v", f)
+	}
+	if f := statuses[skipped]; f.Status != report.StatusSkipped || f.Error != "" {
+		t.Errorf("Unexpected outcome of the skipped file: %+v", f)
+	}
+}
+
+func TestChownEarly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing the owner of a file requires root")
+	}
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.ChownEarly = true
+	if err := os.Chown(testFile, 1234, 5678); err != nil {
+		t.Fatalf("Failed to chown test file: %v", err)
+	}
+
+	if err := r.Preflight(); err != nil {
+		t.Fatalf("Preflight failed: %v", err)
+	}
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	info, err := os.Stat(testFile)
+	if err != nil {
+		t.Fatalf("Failed to stat rebalanced file: %v", err)
+	}
+	if uid, gid, err := fileutil.GetOwner(info); err != nil || uid != 1234 || gid != 5678 {
+		t.Errorf("Expected the rebalanced file to keep owner 1234:5678, got %d:%d (%v)", uid, gid, err)
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		f := filepath.Join(filepath.Dir(testFile), fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	r.config.Concurrency = 1
+	r.config.MaxErrors = 2
+	var reached []Summary
+	r.config.Hooks = Hooks{
+		PreFile:             func(ctx context.Context, filePath string) error { return errors.New("disk on fire") },
+		AbortOnPreFileError: true,
+		MaxErrors:           func(summary Summary) { reached = append(reached, summary) },
+	}
+
+	err := r.Run(nil)
+	if !errors.Is(err, ErrTooManyErrors) {
+		t.Fatalf("Expected ErrTooManyErrors, got %v", err)
+	}
+	s := r.Summary()
+	if s.FilesFailed != 2 || s.FilesRemaining != 4 || !s.TooManyErrors {
+		t.Errorf("Expected 2 failures and 4 files left, got %+v", s)
+	}
+	if len(reached) != 1 || reached[0].FilesFailed != 2 {
+		t.Errorf("Expected the MaxErrors hook to run once with 2 failures, got %+v", reached)
+	}
+
+	// The budget stays spent for later passes
+	if err := r.Run(nil); !errors.Is(err, ErrTooManyErrors) || r.Summary().FilesFailed != 2 {
+		t.Errorf("Expected a later run to start nothing, got %v", err)
+	}
+}
+
+func TestQueueLatency(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	for i := 0; i < 2; i++ {
+		f := filepath.Join(filepath.Dir(testFile), fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	r.config.Concurrency = 1
+	r.config.ReportFiles = true
+	var last string
+	r.config.Hooks = Hooks{PreFile: func(ctx context.Context, filePath string) error {
+		last = filePath
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	q := r.Summary().QueueLatency
+	if q == nil || q.Starts != 3 {
+		t.Fatalf("Expected the waits of 3 files, got %+v", q)
+	}
+	// With one worker the last file waits for the other two
+	if q.MaxFile != last || q.Max < 40*time.Millisecond || q.P50 > q.P90 || q.P90 > q.Max {
+		t.Errorf("Unexpected queue latency %+v, last file %s", q, last)
+	}
+	if files := r.Report().Files; len(files) != 3 || files[2].QueueSeconds < 0.04 {
+		t.Errorf("Expected the report to carry the waits, got %+v", files)
+	}
+
+	waits := make([]time.Duration, 100)
+	for i := range waits {
+		waits[i] = time.Duration(i+1) * time.Second
+	}
+	if p := percentile(waits, 50); p != 50*time.Second {
+		t.Errorf("Expected p50 of 50s, got %s", p)
+	}
+	if p := percentile(waits, 99); p != 99*time.Second {
+		t.Errorf("Expected p99 of 99s, got %s", p)
+	}
+	if p := percentile(waits[:1], 99); p != time.Second {
+		t.Errorf("Expected p99 of a single wait to be that wait, got %s", p)
+	}
+}
+
+func TestPaceDirty(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.PaceDirty = true
+	r.config.PoolBandwidth = 100 << 20
+	r.config.BandwidthStateDir = t.TempDir()
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 1 {
+		t.Errorf("Expected the file to be rebalanced while pacing, got count %d", count)
+	}
+	if r.limiter != nil {
+		t.Error("Expected the limiters to be released after the run")
+	}
+}
+
+func TestLimiterChain(t *testing.T) {
+	var calls []string
+	limiter := func(name string, err error) fileutil.Limiter {
+		return limiterFunc(func(n int) error {
+			calls = append(calls, name)
+			return err
+		})
+	}
+	if (limiterChain{}).limiter() != nil {
+		t.Error("Expected an empty chain to be no limiter")
+	}
+	single := limiter("a", nil)
+	if l := (limiterChain{single}).limiter(); l == nil {
+		t.Error("Expected a single limiter to be returned as is")
+	}
+
+	chain := limiterChain{limiter("a", nil), limiter("b", errors.New("closed")), limiter("c", nil)}
+	if err := chain.limiter().Wait(1); err == nil || !reflect.DeepEqual(calls, []string{"a", "b"}) {
+		t.Errorf("Expected the chain to stop at the first error, got %v after %v", err, calls)
+	}
+}
+
+// limiterFunc adapts a function to fileutil.Limiter
+type limiterFunc func(n int) error
+
+func (f limiterFunc) Wait(n int) error { return f(n) }
+
+func TestRecordRun(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := r.RebalanceFile(testFile); err != nil {
+		t.Fatalf("RebalanceFile failed: %v", err)
+	}
+	if err := r.RecordRun(); err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	runs, err := db.Runs()
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].FilesRebalanced != 1 || len(runs[0].Datasets) != 1 || runs[0].Datasets[0].FilesRebalanced != 1 {
+		t.Fatalf("Expected the run and its dataset to be recorded, got %+v", runs)
+	}
+	if !runs[0].Started.Equal(r.stats.start) || runs[0].Finished.Before(runs[0].Started) {
+		t.Errorf("Unexpected run times %s to %s", runs[0].Started, runs[0].Finished)
+	}
+}
+
+func TestSummarizeRuns(t *testing.T) {
+	day := func(d, hour int) time.Time { return time.Date(2024, 5, d, hour, 0, 0, 0, time.Local) }
+	runs := []database.RunRecord{
+		{
+			Started: day(6, 1), Finished: day(6, 3), FilesRebalanced: 8, BytesRebalanced: 7200, FilesFailed: 2,
+			Datasets: []database.DatasetRecord{{Dataset: "tank/a", FilesRebalanced: 8, BytesRebalanced: 7200, FilesFailed: 2}},
+		},
+		{
+			Started: day(7, 1), Finished: day(7, 2), FilesRebalanced: 10, BytesRebalanced: 3600, Interrupted: true,
+			Datasets: []database.DatasetRecord{
+				{Dataset: "tank/b", FilesRebalanced: 4, BytesRebalanced: 1600},
+				{Dataset: "tank/a", FilesRebalanced: 6, BytesRebalanced: 2000},
+			},
+		},
+		{Started: day(30, 1), Finished: day(30, 1), FilesSkipped: 5},
+	}
+
+	h := SummarizeRuns(runs, PeriodWeek)
+	if h.Runs != 3 || h.Interrupted != 1 || h.BytesRebalanced != 10800 || h.Duration != 3*time.Hour {
+		t.Errorf("Unexpected totals %+v", h.HistoryTotals)
+	}
+	if h.BytesPerSecond() != 1 || h.ErrorRate() != 2.0/25 {
+		t.Errorf("Expected 1 B/s and an error rate of 8%%, got %v and %v", h.BytesPerSecond(), h.ErrorRate())
+	}
+	if !h.First.Equal(day(6, 1)) || !h.Last.Equal(day(30, 1)) {
+		t.Errorf("Unexpected range %s to %s", h.First, h.Last)
+	}
+	if len(h.Datasets) != 2 || h.Datasets[0].Dataset != "tank/a" || h.Datasets[0].Runs != 2 || h.Datasets[0].BytesRebalanced != 9200 {
+		t.Errorf("Unexpected datasets %+v", h.Datasets)
+	}
+	// May 6 2024 was a Monday: the first two runs share week 19
+	if len(h.Periods) != 2 || h.Periods[0].Label != "2024-W19" || h.Periods[0].Runs != 2 || h.Periods[1].Label != "2024-W22" {
+		t.Errorf("Unexpected weeks %+v", h.Periods)
+	}
+	if !h.Periods[0].Start.Equal(day(6, 0)) {
+		t.Errorf("Expected week 19 to start on Monday May 6, got %s", h.Periods[0].Start)
+	}
+
+	if months := SummarizeRuns(runs, PeriodMonth).Periods; len(months) != 1 || months[0].Label != "2024-05" || months[0].Runs != 3 {
+		t.Errorf("Unexpected months %+v", months)
+	}
+	if days := SummarizeRuns(runs, PeriodDay).Periods; len(days) != 3 || days[1].Label != "2024-05-07" {
+		t.Errorf("Unexpected days %+v", days)
+	}
+	if _, err := ParsePeriod("year"); err == nil {
+		t.Error("Expected an error for an unknown period")
+	}
+}
+
+func TestAbandonInflight(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+
+	inflight := func(name, stage string) (string, string) {
+		path := filepath.Join(dir, name)
+		for _, p := range []string{path, path + ".balance"} {
+			if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.startInflight(path, path+".balance", int64(len(name))).setStage(stage)
+		return path, path + ".balance"
+	}
+	copying, copyingTmp := inflight("copying", stageCopying)
+	verifying, verifyingTmp := inflight("verifying", stageVerifying)
+	replacing, replacingTmp := inflight("replacing", stageReplacing)
+
+	// A worker between removing an original and renaming its copy holds the gate
+	if !r.enterReplace() {
+		t.Fatal("Expected replacements to be allowed before a forced exit")
+	}
+	removed, kept := r.AbandonInflight(50 * time.Millisecond)
+	if !reflect.DeepEqual(removed, []string{copyingTmp}) || !reflect.DeepEqual(kept, []string{replacing, verifying}) {
+		t.Errorf("Expected only the copy being written to go while a replacement is under way, removed %v, kept %v", removed, kept)
+	}
+	r.leaveReplace()
+	if r.enterReplace() {
+		t.Error("Expected no replacement after a forced exit began")
+	}
+
+	// Once no replacement is under way, verified copies go too
+	removed, kept = r.AbandonInflight(time.Second)
+	if !reflect.DeepEqual(removed, []string{copyingTmp, verifyingTmp}) || !reflect.DeepEqual(kept, []string{replacing}) {
+		t.Errorf("Unexpected removed %v, kept %v", removed, kept)
+	}
+	for _, p := range []string{copyingTmp, verifyingTmp} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", p, err)
+		}
+	}
+	for _, p := range []string{copying, verifying, replacing, replacingTmp} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Expected %s to be kept: %v", p, err)
+		}
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+	for i := 0; i < 5; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf("data%d", i)), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	// A single worker still fills batches of 3: copies waiting for their batch free it
+	r.config.Concurrency = 1
+	r.config.BatchSize = 3
+	waiting := make(map[string]int)
+	r.config.Hooks.PreFile = func(ctx context.Context, filePath string) error {
+		copies, _ := filepath.Glob(filepath.Join(dir, "*"+DefaultTempSuffix))
+		waiting[filepath.Base(filePath)] = len(copies)
+		if filepath.Base(filePath) == "file2" {
+			// Damage a copy of the first batch after it was verified
+			tmpPath, _, _ := tempNaming{suffix: DefaultTempSuffix}.pathFor(filepath.Join(dir, "file0"))
+			f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Errorf("Expected the copy of file0 to wait for its batch: %v", err)
+				return nil
+			}
+			f.WriteString("x")
+			f.Close()
+		}
+		return nil
+	}
+
+	if err := r.Run(nil); err == nil {
+		t.Fatal("Expected the damaged batch to fail")
+	}
+	if waiting["file1"] != 1 || waiting["file2"] != 2 {
+		t.Errorf("Expected the copies of the batch to wait, saw %v", waiting)
+	}
+	s := r.Summary()
+	if s.FilesFailed != 3 || s.FilesRebalanced != 3 {
+		t.Errorf("Expected the first batch to fail and the second to be replaced, got %+v", s)
+	}
+	for i := 0; i < 3; i++ {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("file%d", i)))
+		if err != nil || string(data) != fmt.Sprintf("data%d", i) {
+			t.Errorf("Expected the original of file%d to be kept, got %q, %v", i, data, err)
+		}
+	}
+	if copies, _ := filepath.Glob(filepath.Join(dir, "*"+DefaultTempSuffix)); len(copies) != 0 {
+		t.Errorf("Expected the copies of the failed batch to be removed, found %v", copies)
+	}
+}
+
+func TestByteProgress(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	big := filepath.Join(filepath.Dir(testFile), "big")
+	if err := os.WriteFile(big, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	total := int64(1<<20 + len("rebalance test data"))
+
+	var during []ByteProgress
+	r.config.Concurrency = 1
+	r.config.Hooks.PostFile = func(ctx context.Context, filePath string, result FileResult) error {
+		during = append(during, r.ByteProgress())
+		return nil
+	}
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(during) != 2 || during[0].Total != total || during[0].Done >= total {
+		t.Errorf("Expected the first file to leave bytes to do, got %+v", during)
+	}
+	p := r.ByteProgress()
+	if p.Done != total || p.Total != total || p.ETA != 0 || p.Fraction() != 1 {
+		t.Errorf("Expected all %d bytes done, got %+v", total, p)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	size := int64(len("rebalance test data"))
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	// The copy is read back from disk after it is written
+	got := r.Throughput()
+	if got.BytesRead != 2*size || got.BytesWritten != size || got.Read1m <= 0 || got.Write5m <= 0 {
+		t.Errorf("Expected %d bytes read and %d written at a positive rate, got %+v", 2*size, size, got)
+	}
+
+	// A full read-back reads the original again too
+	r.config.VerifyReadback = true
+	r.config.PassesLimit = 0
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := r.Throughput(); got.BytesRead != 5*size || got.BytesWritten != 2*size {
+		t.Errorf("Expected the read-back of %s to count, got %+v", testFile, got)
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	var w rateWindow
+	start := time.Now()
+	w.reset(start)
+	// A young run is measured from its start
+	if rate := w.rate(start.Add(2*time.Second), 200); rate != 100 {
+		t.Errorf("Expected 100 B/s since the start, got %v", rate)
+	}
+	// Then over the window only: the burst of the first minute no longer counts
+	at, done := start, int64(0)
+	for ; at.Before(start.Add(10 * time.Minute)); at = at.Add(etaSampleInterval) {
+		w.rate(at, done)
+		if at.Before(start.Add(time.Minute)) {
+			done += 1 << 20
+		} else {
+			done += 1000
+		}
+	}
+	if rate := w.rate(at, done); rate < 199 || rate > 201 {
+		t.Errorf("Expected about 200 B/s over the window, got %v", rate)
+	}
+	if len(w.samples) > int(etaWindow/etaSampleInterval)+1 {
+		t.Errorf("Expected samples older than the window to be dropped, kept %d", len(w.samples))
+	}
+}
+
+func TestSaveRecovered(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	recoveryDir := filepath.Join(filepath.Dir(testFile), "safe")
+
+	save := func(name string) string {
+		tmpPath := testFile + ".balance"
+		if err := os.WriteFile(tmpPath, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create copy: %v", err)
+		}
+		saved := r.saveRecovered(testFile, tmpPath, int64(len(name)), fileutil.ChecksumSHA256, "", "")
+		if data, err := os.ReadFile(saved); err != nil || string(data) != name {
+			t.Errorf("Expected %q saved at %s, got %q, %v", name, saved, data, err)
+		}
+		if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+			t.Errorf("Expected the copy to be moved, got %v", err)
+		}
+		return saved
+	}
+
+	// Without a recovery directory the copy lands next to the original
+	if saved := save("sibling"); saved != testFile+".recovered" {
+		t.Errorf("Expected the copy next to the original, got %s", saved)
+	}
+	// With one the tree of the original is mirrored below it, without overwriting
+	r.config.RecoveryDir = recoveryDir
+	first, second := save("first"), save("second")
+	if first != filepath.Join(recoveryDir, testFile) || second != first+".1" {
+		t.Errorf("Unexpected paths %s and %s", first, second)
+	}
+
+	files, err := db.RecoveredFiles()
+	if err != nil {
+		t.Fatalf("RecoveredFiles failed: %v", err)
+	}
+	if len(files) != 3 || files[2].SavedPath != second || files[2].OriginalPath != testFile || files[2].Size != int64(len("second")) {
+		t.Errorf("Expected the saved copies to be registered, got %+v", files)
+	}
+}
+
+func TestMoveVerified(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+
+	// Failures other than a move between filesystems are not copied around
+	missing := filepath.Join(dir, "missing")
+	if err := r.moveVerified(missing, filepath.Join(dir, "safe", "missing"), fileutil.ChecksumSHA256, ""); !os.IsNotExist(err) {
+		t.Errorf("Expected the failed rename, got %v", err)
+	}
+
+	// The injected rename fault takes the path of a move to another filesystem
+	disable, err := faultinject.Enable("rename=moved")
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	defer disable()
+	atime, mtime := time.Now().Add(-48*time.Hour).Truncate(time.Second), time.Now().Add(-72*time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(testFile, atime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	dst := filepath.Join(dir, "safe", "moved")
+	if err := r.moveVerified(testFile, dst, fileutil.ChecksumSHA256, ""); err != nil {
+		t.Fatalf("moveVerified failed: %v", err)
+	}
+	if _, err := os.Stat(testFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the source to be removed, got %v", err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) || !fileutil.AccessTime(info).Equal(atime) {
+		t.Errorf("Expected the times %v and %v, got %v and %v", atime, mtime, fileutil.AccessTime(info), info.ModTime())
+	}
+}
+
+func TestOrderBySize(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+	for name, size := range map[string]int{"a_big": 4096, "b_tiny": 1, "c_mid": 100, "d_mid": 100} {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		order Order
+		want  []string
+	}{
+		// Files of equal size stay in directory order
+		{OrderLargest, []string{"a_big", "c_mid", "d_mid", "test_file.txt", "b_tiny"}},
+		{OrderSmallest, []string{"b_tiny", "test_file.txt", "c_mid", "d_mid", "a_big"}},
+		{OrderPath, []string{"a_big", "b_tiny", "c_mid", "d_mid", "test_file.txt"}},
+	} {
+		r.config.Order = tc.order
+		plan, err := r.Plan()
+		if err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+		var got []string
+		for _, entry := range plan {
+			got = append(got, filepath.Base(entry.Path))
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s: expected %v, got %v", tc.order, tc.want, got)
+		}
+	}
+
+	if order, err := ParseOrder("Largest"); err != nil || order != OrderLargest {
+		t.Errorf("Expected largest, got %q, %v", order, err)
+	}
+	if _, err := ParseOrder("newest"); err == nil {
+		t.Error("Expected an error for an unknown order")
+	}
+}
+
+func TestOrderFragmented(t *testing.T) {
+	r, _, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	if _, err := fileutil.ExtentCount(testFile); err != nil {
+		t.Skipf("Cannot map extents: %v", err)
+	}
+	dir := filepath.Dir(testFile)
+	if err := os.WriteFile(filepath.Join(dir, "a_contiguous"), make([]byte, 1<<20), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	// Data separated by holes takes an extent per run of data
+	f, err := os.Create(filepath.Join(dir, "b_fragmented"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	for i := int64(0); i < 4; i++ {
+		if _, err := f.WriteAt([]byte("data"), i<<20); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	f.Close()
+
+	r.config.Order = OrderFragmented
+	plan, err := r.Plan()
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan) != 3 || filepath.Base(plan[0].Path) != "b_fragmented" || !strings.Contains(plan[0].Reason, "4 extents") {
+		t.Errorf("Expected the fragmented file first, got %+v", plan)
+	}
+}
+
+func TestMinExtents(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	if _, err := fileutil.ExtentCount(testFile); err != nil {
+		t.Skipf("Cannot map extents: %v", err)
+	}
+	dir := filepath.Dir(testFile)
+	contiguous := filepath.Join(dir, "contiguous")
+	if err := os.WriteFile(contiguous, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	fragmented := filepath.Join(dir, "fragmented")
+	f, err := os.Create(fragmented)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	for i := int64(0); i < 4; i++ {
+		if _, err := f.WriteAt([]byte("data"), i<<20); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	f.Close()
+
+	r.config.MinExtents = 2
+	plan, err := r.Plan()
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	for _, entry := range plan {
+		if entry.Path == contiguous {
+			t.Errorf("Expected the contiguous file left out of the plan, got %+v", plan)
+		}
+	}
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for path, want := range map[string]int{contiguous: 0, fragmented: 1} {
+		if count, err := db.GetRebalanceCount(path); err != nil || count != want {
+			t.Errorf("Expected %s rebalanced %d times, got %d, %v", filepath.Base(path), want, count, err)
+		}
+	}
+	if s := r.Summary(); s.FilesAlreadyBalanced < 1 || s.FilesAlreadyBalanced > s.FilesSkipped {
+		t.Errorf("Expected the contiguous file counted as already balanced and skipped, got %d of %d", s.FilesAlreadyBalanced, s.FilesSkipped)
+	}
+}
+
+func TestARCMonitor(t *testing.T) {
+	r, _, _, cleanup := setupTest(t)
+	defer cleanup()
+	if _, ok := r.ARC(); ok {
+		t.Fatal("Expected no ARC state before the first sample")
+	}
+
+	stats := zpool.ARCStats{Size: 1 << 30, Target: 1 << 30, Max: 2 << 30, Hits: 5000, Misses: 5000}
+	r.arc.read = func() (zpool.ARCStats, error) { return stats, nil }
+	sample := func(hits, misses, ghostHits uint64) (ARCState, bool) {
+		stats.Hits += hits
+		stats.Misses += misses
+		stats.GhostHits += ghostHits
+		state, judged, err := r.arc.sample()
+		if err != nil {
+			t.Fatalf("sample failed: %v", err)
+		}
+		return state, judged
+	}
+
+	if _, judged := sample(0, 0, 0); judged {
+		t.Error("Expected the first sample to only set the baseline")
+	}
+	if state, judged := sample(900, 100, 10); !judged || state.HitRatio != 0.9 || state.Thrashing {
+		t.Errorf("Expected a 90%% hit ratio without thrashing, got %+v, %t", state, judged)
+	}
+	// Quiet intervals are merged with the next one
+	if _, judged := sample(50, 50, 0); judged {
+		t.Error("Expected too few accesses to be judged")
+	}
+	state, judged := sample(450, 450, 100)
+	if !judged || state.HitRatio != 0.5 || !state.Thrashing || state.RunHitRatio != 0.7 {
+		t.Errorf("Expected thrashing at a 50%% hit ratio, got %+v, %t", state, judged)
+	}
+
+	// Throttling takes a worker away while thrashing and gives it back afterwards
+	r.SetConcurrency(3)
+	r.adjustForARC(state)
+	if state, _ = r.ARC(); r.Concurrency() != 2 || state.Throttled != 1 {
+		t.Errorf("Expected a worker held back, got concurrency %d, %+v", r.Concurrency(), state)
+	}
+	state.Thrashing = false
+	r.adjustForARC(state)
+	if state, _ = r.ARC(); r.Concurrency() != 3 || state.Throttled != 0 {
+		t.Errorf("Expected the worker back, got concurrency %d, %+v", r.Concurrency(), state)
+	}
+
+	if summary := r.Summary(); summary.ARC == nil || summary.Totals().ARCMaxBytes != 2<<30 {
+		t.Errorf("Expected the ARC in the summary and report totals, got %+v", summary.ARC)
+	}
+}
+
+func TestReserveFree(t *testing.T) {
+	for in, want := range map[string]SpaceReserve{"5%": {Percent: 5}, " 2.5 %": {Percent: 2.5}, "50G": {Bytes: 50 << 30}, "0": {}} {
+		if got, err := ParseSpaceReserve(in); err != nil || got != want {
+			t.Errorf("ParseSpaceReserve(%q) = %+v, %v, want %+v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "100%", "-1%", "five"} {
+		if _, err := ParseSpaceReserve(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	free, _, err := fileutil.DiskSpace(testFile)
+	if err != nil {
+		t.Skipf("Cannot check the free space: %v", err)
+	}
+
+	// A reserve no copy can respect skips the file
+	r.config.ReserveFree = SpaceReserve{Percent: 99.9999}
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the file skipped, rebalanced %d times", count)
+	}
+	if s := r.Summary(); s.FilesLowSpace != 1 || s.FilesSkipped != 1 {
+		t.Errorf("Expected the file counted as skipped for low space, got %d of %d", s.FilesLowSpace, s.FilesSkipped)
+	}
+
+	// A copy waits for the copies in progress to give their space back
+	r.config.ReserveFree = SpaceReserve{Bytes: 1}
+	r.space.claimed, r.space.released = map[uint64]int64{7: int64(free)}, make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.space.release(7, int64(free))
+	}()
+	release, err := r.reserveSpace(context.Background(), testFile, 7, 19)
+	if err != nil {
+		t.Fatalf("reserveSpace failed: %v", err)
+	}
+	if r.space.claimed[7] != 19 || r.Summary().SpaceWaits != 1 {
+		t.Errorf("Expected the copy to wait once and claim its size, got %d claimed", r.space.claimed[7])
+	}
+	release()
+	if len(r.space.claimed) != 0 {
+		t.Errorf("Expected no claim left, got %v", r.space.claimed)
+	}
+}
+
+func TestMaxPoolCapacity(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.readCapacity = func() (map[string]int, error) { return map[string]int{"tank": 95}, nil }
+	r.config.MaxPoolCapacity = 90
+
+	// Holding back new files while the pool is full, until it is below the limit again
+	r.config.PauseAtCapacity = true
+	r.judgeCapacity(map[string]int{"tank": 95, "backup": 50})
+	waited := make(chan struct{})
+	go func() {
+		r.waitForCapacity(context.Background())
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Expected new files held back above the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.judgeCapacity(map[string]int{"tank": 90})
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Expected new files let go below the limit")
+	}
+	if s := r.Summary(); s.CapacityPauses != 1 || s.PoolFull {
+		t.Errorf("Expected one pause without stopping, got %d pauses, full %v", s.CapacityPauses, s.PoolFull)
+	}
+
+	// Stopping before the first file when the pool is already full
+	r.config.PauseAtCapacity = false
+	err := r.Run(nil)
+	if !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("Expected ErrPoolFull, got %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected the file not rebalanced, rebalanced %d times", count)
+	}
+	if s := r.Summary(); !s.PoolFull || s.FilesRemaining != 1 {
+		t.Errorf("Expected the run stopped with the file remaining, got full %v, %d remaining", s.PoolFull, s.FilesRemaining)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("rebalance test data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.config.Concurrency = 1
+	r.config.Order = OrderPath
+	r.config.PassesLimit = 1
+	r.config.MaxBytes = 30
+
+	// The second file reaches the limit, no further file starts
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Expected a clean stop, got %v", err)
+	}
+	s := r.Summary()
+	if !s.ByteBudgetSpent || s.FilesRebalanced != 2 || s.FilesRemaining != 2 {
+		t.Errorf("Expected the run stopped after 2 files with 2 remaining, got spent %v, %d rebalanced, %d remaining",
+			s.ByteBudgetSpent, s.FilesRebalanced, s.FilesRemaining)
+	}
+	if count, _ := db.GetRebalanceCount(filepath.Join(dir, "c")); count != 0 {
+		t.Errorf("Expected the last file left for the next run, rebalanced %d times", count)
+	}
+	if err := r.RecordRun(); err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	if runs, err := db.Runs(); err != nil || len(runs) != 1 || !runs[0].Interrupted {
+		t.Errorf("Expected the run recorded as interrupted, got %+v (%v)", runs, err)
+	}
+
+	// The next run skips the files done and carries on with a budget of its own
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(filepath.Join(dir, "c")); count != 1 {
+		t.Errorf("Expected the next run to rebalance the last file, rebalanced %d times", count)
+	}
+}
+
+func TestMaxRuntime(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("rebalance test data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.config.Concurrency = 1
+	r.config.Order = OrderPath
+	r.config.PassesLimit = 1
+	r.config.MaxRuntime = 50 * time.Millisecond
+	// The first file outlasts the limit
+	r.config.OnFileResult = func(FileResult) { time.Sleep(100 * time.Millisecond) }
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Expected a clean stop, got %v", err)
+	}
+	s := r.Summary()
+	if !s.RuntimeSpent || s.FilesRebalanced != 1 || s.FilesRemaining != 3 {
+		t.Errorf("Expected the run stopped after 1 file with 3 remaining, got spent %v, %d rebalanced, %d remaining",
+			s.RuntimeSpent, s.FilesRebalanced, s.FilesRemaining)
+	}
+	if err := r.RecordRun(); err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	if runs, err := db.Runs(); err != nil || len(runs) != 1 || !runs[0].Interrupted {
+		t.Errorf("Expected the run recorded as interrupted, got %+v (%v)", runs, err)
+	}
+
+	// The next run has a time budget of its own
+	r.config.OnFileResult = nil
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if r.Summary().RuntimeSpent {
+		t.Error("Expected the next run to finish within its limit")
+	}
+	for _, name := range []string{"b", "c", "test_file.txt"} {
+		if count, _ := db.GetRebalanceCount(filepath.Join(dir, name)); count != 1 {
+			t.Errorf("Expected the next run to rebalance %s, rebalanced %d times", name, count)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	for in, want := range map[string]Window{
+		"01:00-07:00":   {Start: time.Hour, End: 7 * time.Hour},
+		" 22:30-06:00 ": {Start: 22*time.Hour + 30*time.Minute, End: 6 * time.Hour},
+	} {
+		if got, err := ParseWindow(in); err != nil || got != want {
+			t.Errorf("ParseWindow(%q) = %+v, %v, want %+v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "01:00", "01:00-25:00", "1h-2h", "03:00-03:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+
+	day := func(hour, minute int) time.Time { return time.Date(2024, 6, 1, hour, minute, 0, 0, time.Local) }
+	night, _ := ParseWindow("22:00-06:00")
+	early, _ := ParseWindow("01:00-07:00")
+	for _, c := range []struct {
+		w     Window
+		at    time.Time
+		open  bool
+		opens time.Time
+	}{
+		{early, day(3, 0), true, day(3, 0)},
+		{early, day(0, 59), false, day(1, 0)},
+		{early, day(7, 0), false, day(25, 0)},
+		{night, day(23, 0), true, day(23, 0)},
+		{night, day(5, 59), true, day(5, 59)},
+		{night, day(12, 0), false, day(22, 0)},
+		{Window{}, day(12, 0), true, day(12, 0)},
+	} {
+		if open := c.w.Contains(c.at); open != c.open {
+			t.Errorf("%s contains %s: got %v, want %v", c.w, c.at.Format("15:04"), open, c.open)
+		}
+		if opens := c.w.NextOpen(c.at); !opens.Equal(c.opens) {
+			t.Errorf("%s next opens after %s: got %s, want %s", c.w, c.at, opens, c.opens)
+		}
+	}
+
+	// Outside the window no file starts
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	start := sinceMidnight(time.Now()).Truncate(time.Minute) + time.Hour
+	r.config.Window = Window{Start: start % (24 * time.Hour), End: (start + time.Hour) % (24 * time.Hour)}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := r.RunContext(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the run to wait for the window until canceled, got %v", err)
+	}
+	if count, _ := db.GetRebalanceCount(testFile); count != 0 {
+		t.Errorf("Expected no file rebalanced outside the window, rebalanced %d times", count)
+	}
+	if pauses := r.Summary().WindowPauses; pauses != 1 {
+		t.Errorf("Expected 1 wait for the window, got %d", pauses)
+	}
+}
+
+func TestHashWorkers(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.HashWorkers = 1
+
+	release, ok := r.acquireHash(nil)
+	if !ok {
+		t.Fatal("Expected a free hashing slot")
+	}
+	done := make(chan struct{})
+	close(done)
+	if _, ok := r.acquireHash(done); ok {
+		t.Error("Expected the second file to wait for the slot")
+	}
+	release()
+
+	// Streamed and read-back verification both get their slot back
+	dir := filepath.Dir(testFile)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("rebalance test data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.config.PassesLimit = 2
+	for _, readback := range []bool{false, true} {
+		r.config.VerifyReadback = readback
+		if err := r.Run(nil); err != nil {
+			t.Fatalf("Run with VerifyReadback %v failed: %v", readback, err)
+		}
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if count, _ := db.GetRebalanceCount(filepath.Join(dir, name)); count != 2 {
+			t.Errorf("Expected %s rebalanced twice, got %d", name, count)
+		}
+	}
+}
+
+func TestVerifyAfterReplace(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	r.config.VerifyAfterReplace = true
+	r.config.RecordChecksums = true
+
+	if err := r.Run(nil); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if s := r.Summary(); s.FilesReplaceVerified != 1 || s.FilesFailed != 0 {
+		t.Errorf("Expected 1 file verified after replacement, got %d (%d failed)", s.FilesReplaceVerified, s.FilesFailed)
+	}
+	sum, ok, err := db.GetChecksum(testFile)
+	if err != nil || !ok || sum.VerifiedAt.IsZero() {
+		t.Errorf("Expected the checksum recorded as verified, got %+v (%v)", sum, err)
+	}
+	if err := r.RecordRun(); err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	if runs, err := db.Runs(); err != nil || len(runs) != 1 || runs[0].FilesVerified != 1 {
+		t.Errorf("Expected the run recorded with 1 verified file, got %+v (%v)", runs, err)
+	}
+
+	// A file that is not the copy, or lost its attributes, fails the check
+	info, err := os.Lstat(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := replacedFile{path: testFile, size: info.Size(), mode: info.Mode(), modTime: info.ModTime(),
+		checksumType: fileutil.ChecksumType(sum.Algorithm), digest: sum.CopyDigest}
+	if _, err := r.checkReplaced(context.Background(), want); err != nil {
+		t.Errorf("Expected the replaced file to pass, got %v", err)
+	}
+	for name, f := range map[string]replacedFile{
+		"size":     {path: want.path, size: want.size + 1, mode: want.mode, modTime: want.modTime},
+		"mode":     {path: want.path, size: want.size, mode: want.mode ^ 0o200, modTime: want.modTime},
+		"time":     {path: want.path, size: want.size, mode: want.mode, modTime: want.modTime.Add(time.Second)},
+		"checksum": {path: want.path, size: want.size, mode: want.mode, modTime: want.modTime, checksumType: want.checksumType, digest: "00"},
+	} {
+		if _, err := r.checkReplaced(context.Background(), f); err == nil {
+			t.Errorf("Expected a %s mismatch to fail the check", name)
+		}
+	}
+	if id, err := fileutil.GetFileIDFromFileInfo(info); err == nil {
+		other := want
+		other.copyID = fileutil.FileID{Dev: id.Dev, Ino: id.Ino + 1}
+		if _, err := r.checkReplaced(context.Background(), other); err == nil {
+			t.Error("Expected another inode under the name to fail the check")
+		}
+	}
+}
+
+func TestRecoverCopies(t *testing.T) {
+	r, db, testFile, cleanup := setupTest(t)
+	defer cleanup()
+	dir := filepath.Dir(testFile)
+
+	auditLog, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	defer auditLog.Close()
+	r.config.AuditLog = auditLog
+
+	digest, err := fileutil.FileHash(testFile, fileutil.ChecksumSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+	// orphan.txt lost its original, with the removal in the audit log; saved.txt and
+	// damaged.txt were saved after failed renames; unknown.txt has no checksum anywhere;
+	// kept.txt has its original back
+	if err := r.audit(auditEntry{op: auditRemove, path: path("orphan.txt"), size: 19, digest: "sha256:" + digest}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"saved.txt", "damaged.txt"} {
+		err := db.AddRecovered(database.RecoveredFile{OriginalPath: path(name), SavedPath: path(name) + ".recovered",
+			Algorithm: "sha256", Digest: digest, Size: 19, SavedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{
+		"orphan.txt" + DefaultTempSuffix:  "rebalance test data",
+		"saved.txt.recovered":             "rebalance test data",
+		"damaged.txt.recovered":           "rebalance test dat4",
+		"unknown.txt" + DefaultTempSuffix: "rebalance test data",
+		"kept.txt":                        "rebalance test data",
+		"kept.txt.recovered":              "rebalance test data",
+	} {
+		if err := os.WriteFile(path(name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outcome := func(copies []RecoveredCopy) map[string]string {
+		got := make(map[string]string)
+		for _, c := range copies {
+			switch {
+			case c.Restored:
+				got[filepath.Base(c.Original)] = "restored"
+			case c.Err != nil:
+				got[filepath.Base(c.Original)] = "left"
+			case c.Verified:
+				got[filepath.Base(c.Original)] = "verified"
+			}
+		}
+		return got
+	}
+
+	copies, err := r.RecoverCopies(context.Background(), true)
+	if err != nil {
+		t.Fatalf("RecoverCopies failed: %v", err)
+	}
+	want := map[string]string{"orphan.txt": "verified", "saved.txt": "verified", "damaged.txt": "left", "unknown.txt": "left", "kept.txt": "left"}
+	if got := outcome(copies); !reflect.DeepEqual(got, want) {
+		t.Errorf("Dry run: expected %v, got %v", want, got)
+	}
+	if _, err := os.Stat(path("orphan.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected a dry run to restore nothing: %v", err)
+	}
+
+	copies, err = r.RecoverCopies(context.Background(), false)
+	if err != nil {
+		t.Fatalf("RecoverCopies failed: %v", err)
+	}
+	want["orphan.txt"], want["saved.txt"] = "restored", "restored"
+	if got := outcome(copies); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for _, name := range []string{"orphan.txt", "saved.txt"} {
+		if data, err := os.ReadFile(path(name)); err != nil || string(data) != "rebalance test data" {
+			t.Errorf("Expected %s to be restored, got %q, %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"damaged.txt.recovered", "unknown.txt" + DefaultTempSuffix, "kept.txt.recovered"} {
+		if _, err := os.Stat(path(name)); err != nil {
+			t.Errorf("Expected %s to be left alone: %v", name, err)
+		}
+	}
+	if recovered, err := db.RecoveredFiles(); err != nil || len(recovered) != 1 || recovered[0].OriginalPath != path("damaged.txt") {
+		t.Errorf("Expected only the damaged copy to stay registered, got %+v (%v)", recovered, err)
+	}
+}
+
+func TestDeprecatedConfig(t *testing.T) {
+	r := NewRebalancer(&Config{RandomOrder: true}, nil)
+	if r.config.Order != OrderRandom {
+		t.Errorf("Expected RandomOrder to select %q, got %q", OrderRandom, r.config.Order)
+	}
+	r = NewRebalancer(&Config{RandomOrder: true, Order: OrderLargest}, nil)
+	if r.config.Order != OrderLargest {
+		t.Errorf("Expected Order to win over RandomOrder, got %q", r.config.Order)
+	}
+
+	r = NewRebalancer(&Config{SizeThresholdMB: 2, PoolBandwidthMBps: 100, SSDWriteBudgetGB: 3}, nil)
+	if r.config.SizeThreshold != 2<<20 || r.config.PoolBandwidth != 100<<20 || r.config.SSDWriteBudget != 3<<30 {
+		t.Errorf("Expected the deprecated sizes in bytes, got %d, %d and %d",
+			r.config.SizeThreshold, r.config.PoolBandwidth, r.config.SSDWriteBudget)
+	}
+	r = NewRebalancer(&Config{SizeThreshold: 512, SizeThresholdMB: 2}, nil)
+	if r.config.SizeThreshold != 512 {
+		t.Errorf("Expected SizeThreshold to win over SizeThresholdMB, got %d", r.config.SizeThreshold)
+	}
+}
@@ -0,0 +1,214 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+)
+
+// CopyKind is where a copy left behind by a rebalance comes from
+type CopyKind string
+
+const (
+	// CopySaved is a copy saved after its rename over the removed original failed, as
+	// NAME.recovered or below Config.RecoveryDir
+	CopySaved CopyKind = "saved"
+	// CopyOrphaned is a temporary copy whose original is missing, left by a run that
+	// died between removing the original and renaming the copy
+	CopyOrphaned CopyKind = "orphaned"
+)
+
+var (
+	// errOriginalExists leaves a copy alone whose original is in place
+	errOriginalExists = errors.New("the original exists: compare the copy with it and remove one of them by hand")
+	// errNoChecksum leaves a copy alone that cannot be validated
+	errNoChecksum = errors.New("no checksum recorded to validate it against: check it and rename it by hand")
+)
+
+// RecoveredCopy is a copy found by RecoverCopies and what became of it
+type RecoveredCopy struct {
+	Kind CopyKind
+	// Path is where the copy is, Original the name it is restored to
+	Path     string
+	Original string
+	// Verified is set when the copy matched its recorded checksum, Restored once it took
+	// its original name; Err tells why it was left where it is
+	Verified bool
+	Restored bool
+	Err      error
+}
+
+// copyChecksum is the checksum a copy must match to be restored
+type copyChecksum struct {
+	checksumType fileutil.ChecksumType
+	digest       string
+	size         int64 // -1 when unknown
+}
+
+// RecoverCopies restores the copies the rebalance of files below the root paths left
+// behind in place of their removed originals: the copies registered in the database or
+// named NAME.recovered after a failed rename, and the temporary copies whose original is
+// missing. Each copy must match the checksum recorded for it, in the database or the
+// audit log of Config.AuditLog, and its original must still be missing; it is then
+// renamed, or copied back from Config.RecoveryDir, to its original name. With dryRun the
+// copies are only found and validated.
+func (r *Rebalancer) RecoverCopies(ctx context.Context, dryRun bool) ([]RecoveredCopy, error) {
+	removed, err := r.config.AuditLog.removedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot replay the audit log: %w", err)
+	}
+	registered, err := r.db.RecoveredFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the recovered files of the database: %w", err)
+	}
+
+	var copies []RecoveredCopy
+	sums := make(map[string]copyChecksum)
+	seen := make(map[string]bool)
+	for _, rec := range registered {
+		if _, ok := r.rootOf(rec.OriginalPath); !ok {
+			continue
+		}
+		seen[rec.SavedPath] = true
+		if rec.Digest != "" {
+			sums[rec.SavedPath] = copyChecksum{fileutil.ChecksumType(rec.Algorithm), rec.Digest, rec.Size}
+		}
+		copies = append(copies, RecoveredCopy{Kind: CopySaved, Path: rec.SavedPath, Original: rec.OriginalPath})
+	}
+
+	naming := r.tempNaming()
+	tempCopies, _ := r.config.AuditLog.removals(naming)
+	err = r.walkRoots(func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			r.logger.Warnf("Cannot access path %s: %v", path, walkErr)
+			return nil
+		}
+		if info.IsDir() && (r.isExcludedMount(path) || r.crossesFilesystem(info)) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || seen[path] {
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(path, recoveredSuffix) && len(filepath.Base(path)) > len(recoveredSuffix):
+			copies = append(copies, RecoveredCopy{Kind: CopySaved, Path: path, Original: strings.TrimSuffix(path, recoveredSuffix)})
+		case naming.isTemp(path):
+			original, ok := naming.originalOf(path)
+			if removal, found := tempCopies[path]; found {
+				original, ok = removal.Path, true
+			}
+			if !ok {
+				r.logger.Warnf("Cannot tell the original of %s from its shortened name without the audit log of its run", path)
+				return nil
+			}
+			// A temporary copy next to its original is only a stale one
+			if _, err := os.Lstat(original); os.IsNotExist(err) {
+				copies = append(copies, RecoveredCopy{Kind: CopyOrphaned, Path: path, Original: original})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(copies, func(i, j int) bool { return copies[i].Original < copies[j].Original })
+
+	for i := range copies {
+		if ctx.Err() != nil {
+			return copies, ctx.Err()
+		}
+		c := &copies[i]
+		sum, ok := sums[c.Path]
+		if !ok {
+			sum, ok = r.recordedChecksum(c.Original, removed)
+		}
+		c.Err = r.recoverCopy(c, sum, ok, dryRun)
+		switch {
+		case c.Restored:
+			r.restoreProtection(c.Original, removed[c.Original])
+			r.logger.Warnf("Restored %s from %s", c.Original, c.Path)
+		case c.Err != nil:
+			r.logger.Errorf("Not restoring %s from %s: %v", c.Original, c.Path, c.Err)
+		default:
+			r.logger.Infof("Would restore %s from %s", c.Original, c.Path)
+		}
+	}
+	return copies, nil
+}
+
+// recordedChecksum returns the checksum a copy of original must match: that of the
+// removal of the original in the audit log, else the checksum recorded for it in the
+// database
+func (r *Rebalancer) recordedChecksum(original string, removed map[string]report.AuditEntry) (copyChecksum, bool) {
+	if removal, ok := removed[original]; ok {
+		if algorithm, digest, ok := strings.Cut(removal.Digest, ":"); ok {
+			return copyChecksum{fileutil.ChecksumType(algorithm), digest, removal.Size}, true
+		}
+	}
+	if rec, ok, err := r.db.GetChecksum(original); err == nil && ok {
+		return copyChecksum{fileutil.ChecksumType(rec.Algorithm), rec.Digest, rec.Size}, true
+	}
+	return copyChecksum{}, false
+}
+
+// recoverCopy validates the copy c against sum and, unless dryRun, restores it
+func (r *Rebalancer) recoverCopy(c *RecoveredCopy, sum copyChecksum, hasSum, dryRun bool) error {
+	if _, err := os.Lstat(c.Original); !os.IsNotExist(err) {
+		if err != nil {
+			return err
+		}
+		return errOriginalExists
+	}
+	if !hasSum {
+		return errNoChecksum
+	}
+	info, err := os.Lstat(c.Path)
+	if err != nil {
+		return err
+	}
+	if sum.size >= 0 && info.Size() != sum.size {
+		return fmt.Errorf("size %d, the original had %d", info.Size(), sum.size)
+	}
+	digest, err := fileutil.FileHash(c.Path, sum.checksumType)
+	if err != nil {
+		return err
+	}
+	if digest != sum.digest {
+		return fmt.Errorf("%s checksum mismatch: %s != %s", sum.checksumType, sum.digest, digest)
+	}
+	c.Verified = true
+	if dryRun {
+		return nil
+	}
+
+	dir := filepath.Dir(c.Original)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("the directory of the original is gone: %w", err)
+	}
+	rename := auditEntry{op: auditRename, path: c.Path, target: c.Original, size: info.Size(),
+		digest: string(sum.checksumType) + ":" + sum.digest}
+	if err := r.audit(rename); err != nil {
+		return fmt.Errorf("not restoring without an audit record: %w", err)
+	}
+	if err := r.moveVerified(c.Path, c.Original, sum.checksumType, sum.digest); err != nil {
+		r.auditFailed(rename, err)
+		return err
+	}
+	c.Restored = true
+	if err := fileutil.SyncDir(dir); err != nil {
+		r.logger.Warnf("Cannot sync %s: %v", dir, err)
+	}
+	if c.Kind == CopySaved {
+		if err := r.db.DeleteRecovered(c.Path); err != nil {
+			r.logger.Warnf("Cannot forget the restored copy %s: %v", c.Path, err)
+		}
+	}
+	return nil
+}
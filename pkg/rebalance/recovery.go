@@ -0,0 +1,173 @@
+package rebalance
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+// recoveredSuffix names the copy saved next to its original when it could not be renamed
+const recoveredSuffix = ".recovered"
+
+// saveRecovered puts the copy at tmpPath somewhere safe after it could not be renamed
+// over its removed original filePath: into Config.RecoveryDir if set, which may be on
+// another filesystem than a failing dataset, else next to the original. The saved copy
+// is registered in the database so it can be found and restored later. It returns where
+// the data is, tmpPath itself if it could not be moved at all.
+func (r *Rebalancer) saveRecovered(filePath, tmpPath string, size int64, checksumType fileutil.ChecksumType, digest, auditDigest string) string {
+	saved := ""
+	if r.config.RecoveryDir != "" {
+		target := recoveryPath(r.config.RecoveryDir, filePath)
+		recovery := auditEntry{op: auditRecover, path: tmpPath, target: target, size: size, digest: auditDigest}
+		if err := r.audit(recovery); err != nil {
+			r.logger.Errorf("Audit log: %v", err)
+		}
+		if err := r.moveVerified(tmpPath, target, checksumType, digest); err != nil {
+			r.auditFailed(recovery, err)
+			r.logger.Errorf("Cannot save the copy of %s to the recovery directory, keeping it next to the original: %v", filePath, err)
+		} else {
+			saved = target
+		}
+	}
+	if saved == "" {
+		target := filePath + recoveredSuffix
+		recovery := auditEntry{op: auditRecover, path: tmpPath, target: target, size: size, digest: auditDigest}
+		if err := r.audit(recovery); err != nil {
+			r.logger.Errorf("Audit log: %v", err)
+		}
+		if err := os.Rename(tmpPath, target); err != nil {
+			r.auditFailed(recovery, err)
+			target = tmpPath
+		}
+		saved = target
+	}
+
+	algorithm := ""
+	if digest != "" {
+		algorithm = string(checksumType)
+	}
+	err := r.db.AddRecovered(database.RecoveredFile{
+		OriginalPath: filePath,
+		SavedPath:    saved,
+		Algorithm:    algorithm,
+		Digest:       digest,
+		Size:         size,
+		SavedAt:      time.Now(),
+	})
+	if err != nil {
+		r.logger.Errorf("Cannot register the copy of %s saved to %s: %v", filePath, saved, err)
+	}
+	return saved
+}
+
+// recoveryPath returns a free path for the copy of filePath below dir, which mirrors
+// the tree of the original so the copies of equally named files do not clash
+func recoveryPath(dir, filePath string) string {
+	volume := filepath.VolumeName(filePath)
+	base := filepath.Join(dir, strings.TrimSuffix(volume, ":"), filePath[len(volume):])
+	target := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return target
+		}
+		target = base + "." + strconv.Itoa(i)
+	}
+}
+
+// moveVerified moves the file at src to dst, creating the directory of dst. Across
+// filesystems the data is copied, checked against digest (or against src without one)
+// and synced before src is removed, and the copy gets the access and modification times
+// of src. Other failures to rename are returned.
+func (r *Rebalancer) moveVerified(src, dst string, checksumType fileutil.ChecksumType, digest string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	// An injected rename fault stands in for a move between filesystems
+	err := faultinject.Check(faultinject.Rename, dst)
+	if err == nil {
+		err = os.Rename(src, dst)
+	}
+	if err == nil {
+		return nil
+	} else if !fileutil.IsCrossDevice(err) && !errors.Is(err, faultinject.ErrInjected) {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	srcHash := fileutil.NewHash(checksumType)
+	err = fileutil.CopyFileWithOptions(src, dst, fileutil.CopyOptions{
+		PreserveOwner: true,
+		SourceHash:    srcHash,
+	})
+	if err == nil {
+		err = syncFile(dst)
+	}
+	if err == nil {
+		// The copy is read back, as the destination hash of a copy only sees what was written
+		var saved string
+		if saved, err = fileutil.FileHash(dst, checksumType); err == nil {
+			if digest == "" {
+				digest = hex.EncodeToString(srcHash.Sum(nil))
+			}
+			if saved != digest {
+				err = fmt.Errorf("%s checksum mismatch: %s != %s", checksumType, digest, saved)
+			}
+		}
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if err := r.preserveMetadata(src, dst); err != nil {
+		r.logger.Warnf("Cannot carry over the metadata of %s: %v", dst, err)
+	}
+	// Reading the copy back has set its access time
+	if err := os.Chtimes(dst, fileutil.AccessTime(info), info.ModTime()); err != nil {
+		r.logger.Warnf("Cannot carry over the times of %s: %v", dst, err)
+	}
+	return os.Remove(src)
+}
+
+// syncCopy flushes the directory entry of tmpPath, the copy of filePath whose data was
+// synced when it was written, and the entry of its temporary directory if it has one
+func syncCopy(filePath, tmpPath string) error {
+	if err := faultinject.Check(faultinject.Fsync, tmpPath); err != nil {
+		return err
+	}
+	dir := filepath.Dir(tmpPath)
+	if err := fileutil.SyncDir(dir); err != nil {
+		return err
+	}
+	if parent := filepath.Dir(filePath); parent != dir {
+		return fileutil.SyncDir(parent)
+	}
+	return nil
+}
+
+// syncFile flushes the data of the file at path to disk
+func syncFile(path string) error {
+	if err := faultinject.Check(faultinject.Fsync, path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,68 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultRetryBackoff is the wait before the first retry when Config.RetryBackoff is unset
+	defaultRetryBackoff = time.Second
+	// maxRetryBackoff caps the doubling wait between retries
+	maxRetryBackoff = time.Minute
+)
+
+// transientErrors are failures that may go away on their own: busy files, interrupted
+// or timed out calls, stale NFS handles and permission races with other processes
+var transientErrors = []error{
+	syscall.EBUSY,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	fs.ErrPermission,
+}
+
+// isTransient reports whether an operation that failed with err is worth retrying
+func isTransient(err error) bool {
+	for _, target := range transientErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry runs op and retries transient failures up to Config.Retries times, doubling
+// the wait from Config.RetryBackoff each time. Waiting stops early when ctx is done; pass
+// a context without cancellation for steps that must not be abandoned. retries is
+// incremented for every retry made.
+func (r *Rebalancer) withRetry(ctx context.Context, what, path string, retries *int, op func() error) error {
+	backoff := r.config.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > r.config.Retries || !isTransient(err) {
+			return err
+		}
+
+		r.logger.Warnf("%s of %s failed, retrying in %s (%d of %d): %v", what, path, backoff, attempt, r.config.Retries, err)
+		*retries++
+		r.stats.retryAttempts.Add(1)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
@@ -0,0 +1,51 @@
+package rebalance
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// roots returns the trees to process: Config.RootPaths, or Config.RootPath alone
+func (r *Rebalancer) roots() []string {
+	if len(r.config.RootPaths) > 0 {
+		return r.config.RootPaths
+	}
+	return []string{r.config.RootPath}
+}
+
+// checkRoots rejects root paths that are the same tree or contain one another, whose
+// files would otherwise be rebalanced twice per pass
+func (r *Rebalancer) checkRoots() error {
+	roots := r.roots()
+	canonical := make([]string, len(roots))
+	for i, root := range roots {
+		if root == "" {
+			return errors.New("empty root path")
+		}
+		canonical[i] = canonicalPath(root)
+		for j := 0; j < i; j++ {
+			if pathWithin(canonical[i], canonical[j]) || pathWithin(canonical[j], canonical[i]) {
+				return fmt.Errorf("root paths %s and %s overlap", roots[j], roots[i])
+			}
+		}
+	}
+	return nil
+}
+
+// walkRoots walks every root path in turn
+func (r *Rebalancer) walkRoots(fn filepath.WalkFunc) error {
+	for _, root := range r.roots() {
+		if err := filepath.Walk(root, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathWithin reports whether path is dir or lies below it
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
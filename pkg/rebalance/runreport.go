@@ -0,0 +1,92 @@
+package rebalance
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+)
+
+// recordOutcome keeps the outcome of a finished file for Report when Config.ReportFiles is set
+func (r *Rebalancer) recordOutcome(filePath string, rebalanced bool, err error, queued, duration time.Duration) {
+	if !r.config.ReportFiles {
+		return
+	}
+
+	outcome := report.FileOutcome{Path: filePath, QueueSeconds: queued.Seconds(), DurationSeconds: duration.Seconds()}
+	switch {
+	case errors.Is(err, errInterrupted):
+		outcome.Status = report.StatusInterrupted
+	case err != nil:
+		outcome.Status = report.StatusFailed
+	case rebalanced:
+		outcome.Status = report.StatusRebalanced
+	default:
+		outcome.Status = report.StatusSkipped
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	if info, statErr := os.Lstat(filePath); statErr == nil {
+		outcome.Bytes = info.Size()
+	}
+	if rebalanced && duration > 0 {
+		outcome.BytesPerSecond = float64(outcome.Bytes) / duration.Seconds()
+	}
+
+	r.outcomesMutex.Lock()
+	r.outcomes = append(r.outcomes, outcome)
+	r.outcomesMutex.Unlock()
+}
+
+// Report returns the outcome of every file processed since the Rebalancer was created,
+// in the order they finished, with the totals of Summary. A file processed by several
+// passes is listed once per pass. Files are only listed when Config.ReportFiles is set.
+func (r *Rebalancer) Report() *report.RunReport {
+	summary := r.Summary()
+	r.outcomesMutex.Lock()
+	files := append([]report.FileOutcome{}, r.outcomes...)
+	r.outcomesMutex.Unlock()
+
+	return &report.RunReport{
+		Started:     r.stats.start,
+		Finished:    r.stats.start.Add(summary.Elapsed),
+		Paths:       r.roots(),
+		Interrupted: summary.Interrupted,
+		Totals:      summary.Totals(),
+		Files:       files,
+	}
+}
+
+// Totals converts the summary to the totals of a run report
+func (s Summary) Totals() report.RunTotals {
+	totals := report.RunTotals{
+		FilesRebalanced: s.FilesRebalanced,
+		FilesSkipped:    s.FilesSkipped,
+		FilesFailed:     s.FilesFailed,
+		FilesRemaining:  s.FilesRemaining,
+		BytesRebalanced: s.BytesRebalanced,
+		ElapsedSeconds:  s.Elapsed.Seconds(),
+		RetryAttempts:   s.RetryAttempts,
+
+		FilesAlreadyBalanced: s.FilesAlreadyBalanced,
+		FilesLowSpace:        s.FilesLowSpace,
+		FilesProtected:       s.FilesProtected,
+		FilesTooLarge:        s.FilesTooLarge,
+	}
+	if q := s.QueueLatency; q != nil {
+		totals.QueueP50Seconds = q.P50.Seconds()
+		totals.QueueP90Seconds = q.P90.Seconds()
+		totals.QueueP99Seconds = q.P99.Seconds()
+		totals.QueueMaxSeconds = q.Max.Seconds()
+	}
+	if a := s.ARC; a != nil {
+		totals.ARCHitRatio = a.RunHitRatio
+		totals.ARCBytes, totals.ARCMaxBytes = a.Size, a.Max
+	}
+	if s.Elapsed > 0 {
+		totals.BytesPerSecond = float64(s.BytesRebalanced) / s.Elapsed.Seconds()
+	}
+	return totals
+}
@@ -0,0 +1,149 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+	"github.com/astundzia/go-zfs-rebalance/internal/units"
+)
+
+// spaceRecheckInterval is how often a copy waiting for free space checks again, in case
+// space was freed by something other than the copies of the run
+const spaceRecheckInterval = 5 * time.Second
+
+// errLowSpace is returned by rebalanceFile for a file whose copy would cut into
+// Config.ReserveFree while no other copy on its filesystem could give space back
+var errLowSpace = errors.New("not enough free space")
+
+// SpaceReserve is the free space copies must leave on the filesystem of their file, a
+// share of its size or a number of bytes. The zero value reserves nothing.
+type SpaceReserve struct {
+	Percent float64
+	Bytes   int64
+}
+
+// ParseSpaceReserve parses a reserve such as "5%" or "50G"
+func ParseSpaceReserve(s string) (SpaceReserve, error) {
+	s = strings.TrimSpace(s)
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || p < 0 || p >= 100 {
+			return SpaceReserve{}, fmt.Errorf("invalid reserve %q: the percentage must be at least 0 and below 100", s)
+		}
+		return SpaceReserve{Percent: p}, nil
+	}
+	n, err := units.ParseSize(s)
+	if err != nil {
+		return SpaceReserve{}, fmt.Errorf("invalid reserve %q: expected a percentage such as 5%% or a size such as 50G", s)
+	}
+	return SpaceReserve{Bytes: n}, nil
+}
+
+// IsZero reports whether the reserve is empty
+func (s SpaceReserve) IsZero() bool {
+	return s.Percent <= 0 && s.Bytes <= 0
+}
+
+func (s SpaceReserve) String() string {
+	if s.Percent > 0 {
+		return strconv.FormatFloat(s.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatInt(s.Bytes, 10)
+}
+
+// of returns the bytes reserved on a filesystem of total bytes
+func (s SpaceReserve) of(total uint64) int64 {
+	if s.Percent > 0 {
+		return int64(float64(total) * s.Percent / 100)
+	}
+	return s.Bytes
+}
+
+// spaceGuard keeps count of the space the copies in progress still claim, per filesystem
+type spaceGuard struct {
+	mu sync.Mutex
+	// claimed holds the bytes of the copies in progress by device
+	claimed map[uint64]int64
+	// released is closed and replaced whenever a copy gives its claim back
+	released chan struct{}
+}
+
+// reserveSpace waits until the copy of filePath, size bytes on device dev, leaves
+// Config.ReserveFree free. The copies in progress on the device count with their full
+// size although they are partly written, which errs on the safe side. While such copies
+// are in progress it waits for them, as their originals are removed once they are done;
+// without any, the space cannot come back and errLowSpace is returned. The returned
+// function gives the claim back once the copy replaced its original or was removed.
+func (r *Rebalancer) reserveSpace(ctx context.Context, filePath string, dev uint64, size int64) (release func(), err error) {
+	reserve := r.config.ReserveFree
+	if reserve.IsZero() {
+		return func() {}, nil
+	}
+
+	g := &r.space
+	waiting := false
+	for {
+		free, total, err := fileutil.DiskSpace(filePath)
+		if err != nil {
+			r.logger.Debugf("Cannot check the free space for %s, not enforcing the reserve: %v", filePath, err)
+			return func() {}, nil
+		}
+		reserved := reserve.of(total)
+
+		g.mu.Lock()
+		if g.claimed == nil {
+			g.claimed = make(map[uint64]int64)
+			g.released = make(chan struct{})
+		}
+		claimed := g.claimed[dev]
+		if int64(free)-claimed-size >= reserved {
+			g.claimed[dev] += size
+			g.mu.Unlock()
+			if waiting {
+				r.logger.Infof("Enough free space for %s again", filePath)
+			}
+			return func() { g.release(dev, size) }, nil
+		}
+		released := g.released
+		g.mu.Unlock()
+
+		if claimed == 0 {
+			return nil, fmt.Errorf("%w: copying %s (%d bytes) would leave less than the reserve of %s, %d of %d bytes free",
+				errLowSpace, filePath, size, reserve, free, total)
+		}
+		if !waiting {
+			r.logger.Warnf("Waiting for the copies in progress before copying %s: it would leave less than the reserve of %s free", filePath, reserve)
+			r.stats.spaceWaits.Add(1)
+			waiting = true
+		}
+		timer := time.NewTimer(spaceRecheckInterval)
+		select {
+		case <-released:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: waiting for free space for %s: %v", errInterrupted, filePath, ctx.Err())
+		case <-r.shutdown.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: waiting for free space for %s", errInterrupted, filePath)
+		}
+		timer.Stop()
+	}
+}
+
+// release gives back the claim of a copy and wakes the copies waiting for space
+func (g *spaceGuard) release(dev uint64, size int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.claimed[dev] -= size; g.claimed[dev] <= 0 {
+		delete(g.claimed, dev)
+	}
+	close(g.released)
+	g.released = make(chan struct{})
+}
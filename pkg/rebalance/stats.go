@@ -0,0 +1,390 @@
+package rebalance
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/sysinfo"
+)
+
+// IOUsage is the I/O performed by the process, as reported by the operating system.
+// Counters the platform does not provide are zero.
+type IOUsage struct {
+	ReadChars      uint64 // bytes passed to read syscalls
+	WriteChars     uint64 // bytes passed to write syscalls
+	ReadSyscalls   uint64
+	WriteSyscalls  uint64
+	ReadBytes      uint64 // bytes fetched from the storage layer
+	WriteBytes     uint64 // bytes sent to the storage layer
+	BlockInputOps  uint64
+	BlockOutputOps uint64
+}
+
+// Summary describes the work done by a Rebalancer across all of its runs
+type Summary struct {
+	FilesRebalanced int64
+	BytesRebalanced int64
+	// FilesSkipped were left alone (pass limit reached, hardlinks, vanished files...), FilesFailed hit an error
+	FilesSkipped int64
+	FilesFailed  int64
+	// FilesInUse were skipped, and counted in FilesSkipped, because another process held
+	// a lease or mandatory lock on them at both attempts
+	FilesInUse int64
+	// FilesAlreadyBalanced were skipped, and counted in FilesSkipped, because they were
+	// laid out in fewer than Config.MinExtents extents
+	FilesAlreadyBalanced int64
+	// FilesLowSpace were skipped, and counted in FilesSkipped, because their copy would
+	// have cut into Config.ReserveFree; SpaceWaits counts the copies that waited for the
+	// copies in progress to give space back first
+	FilesLowSpace int64
+	SpaceWaits    int64
+	// FilesProtected were skipped, and counted in FilesSkipped, because they had the
+	// immutable or append-only flag and Config.ClearProtection was off
+	FilesProtected int64
+	// FilesTooLarge were left out of the runs for being larger than Config.SkipLargerThan,
+	// BytesTooLarge is their size; they are not counted in FilesSkipped
+	FilesTooLarge int64
+	BytesTooLarge int64
+	// FilesDeferred were put off to the end of their pass because another process opened
+	// them within Config.DeferOpenedWithin
+	FilesDeferred int64
+	// FilesRemaining were queued by the current or last run but not processed, because it was interrupted
+	FilesRemaining int64
+	// DirtyPauses counts the times copies paused for dirty data to be written out, and
+	// DirtyPaused the time they spent waiting
+	DirtyPauses int64
+	DirtyPaused time.Duration
+	// QueueLatency is how long files waited for a worker, nil before the first file starts
+	QueueLatency *QueueLatency
+	// TempNamesShortened counts files whose name was too long for the .balance suffix
+	// and got a shortened, hashed temp name instead
+	TempNamesShortened int64
+	// RetryAttempts counts retried copies, removes and renames, FilesRetried the files that needed any
+	RetryAttempts int64
+	FilesRetried  int64
+	// Interrupted is set once a shutdown was requested, or if the last run's context was canceled
+	Interrupted bool
+	// TooManyErrors is set when the run stopped because Config.MaxErrors files failed
+	TooManyErrors bool
+	// PoolFull is set when the run stopped because a pool went above Config.MaxPoolCapacity,
+	// and CapacityPauses counts the times new files were held back for it instead
+	PoolFull       bool
+	CapacityPauses int64
+	// WindowPauses counts the times new files waited for Config.Window to open
+	WindowPauses int64
+	// ByteBudgetSpent is set when the run stopped because the files it rebalanced reached
+	// Config.MaxBytes
+	ByteBudgetSpent bool
+	// RuntimeSpent is set when the run stopped because it ran for Config.MaxRuntime
+	RuntimeSpent bool
+	// FilesReplaceVerified counts the rewritten files that passed the final check once
+	// their copy took the place of the original
+	FilesReplaceVerified int64
+	// FilesVerified and VerifyMismatches count background checks of stored checksums
+	FilesVerified    int64
+	VerifyMismatches int64
+	// VerificationDisabled is set when copies were not compared against their originals
+	VerificationDisabled bool
+	// UnsupportedMetadata lists the metadata classes filesystems could not preserve
+	UnsupportedMetadata []MetadataDegradation
+	// Elapsed is measured on the monotonic clock, so clock adjustments do not affect it
+	Elapsed time.Duration
+	// ClockAdjustment is how far the wall clock moved relative to Elapsed, e.g. because
+	// NTP stepped it or the machine was suspended; zero unless it exceeds clockStepThreshold
+	ClockAdjustment time.Duration
+	// IO is the process I/O footprint since the Rebalancer was created, nil if unavailable
+	IO *IOUsage
+	// ARC is the state of the ZFS ARC at the last sample, nil if it could not be read
+	ARC *ARCState
+}
+
+// clockStepThreshold is the smallest wall-clock adjustment reported in the summary
+const clockStepThreshold = time.Second
+
+// SkipReason is why a file was left alone, the keys of Stats.SkippedBy
+type SkipReason string
+
+// Reasons for skipping a file
+const (
+	SkipTempFile        SkipReason = "temp-file"
+	SkipMissing         SkipReason = "missing"
+	SkipHardlink        SkipReason = "hardlink"
+	SkipNotRegular      SkipReason = "not-regular"
+	SkipPassLimit       SkipReason = "pass-limit"
+	SkipAlreadyBalanced SkipReason = "already-balanced"
+	SkipInUse           SkipReason = "in-use"
+	SkipLowSpace        SkipReason = "low-space"
+	SkipProtected       SkipReason = "immutable"
+)
+
+// Stats is a snapshot of the counters of a Rebalancer, safe to take at any time during or
+// after a run. It is cheaper than Summary, which also reads the process I/O and the ARC,
+// and is meant to be polled.
+type Stats struct {
+	// Pass numbers the pass of the current or last run from 1 to Passes, Config.Passes;
+	// both are 0 before the first run
+	Pass   int
+	Passes int
+	// Queued and Done count the files of the current or last pass, Done whatever their
+	// outcome
+	Queued int64
+	Done   int64
+	// Rebalanced, Skipped and Failed count files over all runs, SkippedBy breaks Skipped
+	// down by reason
+	Rebalanced int64
+	Skipped    int64
+	SkippedBy  map[SkipReason]int64
+	Failed     int64
+	// BytesRebalanced is the size of the files rebalanced over all runs
+	BytesRebalanced int64
+	// Bytes is the progress of the current or last run in bytes, Throughput the data
+	// moved through the pool over all runs
+	Bytes      ByteProgress
+	Throughput Throughput
+	// Interrupted is set as in Summary
+	Interrupted bool
+	Elapsed     time.Duration
+}
+
+// skipCounts counts skipped files by reason
+type skipCounts struct {
+	mu       sync.Mutex
+	byReason map[SkipReason]int64
+}
+
+// add counts a file skipped for reason
+func (c *skipCounts) add(reason SkipReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byReason == nil {
+		c.byReason = make(map[SkipReason]int64)
+	}
+	c.byReason[reason]++
+}
+
+// snapshot returns a copy of the counts
+func (c *skipCounts) snapshot() map[SkipReason]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[SkipReason]int64, len(c.byReason))
+	for reason, n := range c.byReason {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// runStats holds the counters behind Summary
+type runStats struct {
+	filesRebalanced    atomic.Int64
+	bytesRebalanced    atomic.Int64
+	filesVerified      atomic.Int64
+	verifyMismatches   atomic.Int64
+	filesSkipped       atomic.Int64
+	filesFailed        atomic.Int64
+	filesInUse         atomic.Int64
+	filesBalanced      atomic.Int64
+	filesLowSpace      atomic.Int64
+	filesProtected     atomic.Int64
+	filesFinalChecked  atomic.Int64
+	spaceWaits         atomic.Int64
+	filesDeferred      atomic.Int64
+	dirtyPauses        atomic.Int64
+	dirtyPaused        atomic.Int64 // nanoseconds
+	tempNamesShortened atomic.Int64
+	retryAttempts      atomic.Int64
+	filesRetried       atomic.Int64
+	skipReasons        skipCounts
+	queueWaits         latencyRecorder
+	datasets           datasetTotals
+
+	// runQueued and runFinished track the files of the current run, runBytesQueued and
+	// runBytesFinished their bytes, runInterrupted whether it was stopped by its context
+	runQueued        atomic.Int64
+	runFinished      atomic.Int64
+	runBytesQueued   atomic.Int64
+	runBytesFinished atomic.Int64
+	runInterrupted   atomic.Bool
+	byteRate         rateWindow
+
+	// pass numbers the pass of the current or last run from 1 to passes; passWorkLeft is
+	// set when a file of the pass is left below Config.PassesLimit, so another pass has work
+	pass         atomic.Int64
+	passes       atomic.Int64
+	passWorkLeft atomic.Bool
+
+	// bytesRead and bytesWritten count the data the Rebalancer moved through the pool over
+	// its lifetime: copies, read-backs and background verification
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	throughput   throughputWindows
+
+	// errorBudgetSpent is set once Config.MaxErrors files have failed
+	errorBudgetSpent atomic.Bool
+	// poolFull is set once a pool went above Config.MaxPoolCapacity; capacityPauses counts
+	// the times new files were held back for it with Config.PauseAtCapacity
+	poolFull       atomic.Bool
+	capacityPauses atomic.Int64
+	// windowPauses counts the times new files waited for Config.Window to open
+	windowPauses atomic.Int64
+	// budgetBytes counts the bytes rebalanced by the current run against Config.MaxBytes,
+	// byteBudgetSpent is set once they reached it
+	budgetBytes     atomic.Int64
+	byteBudgetSpent atomic.Bool
+	// runtimeSpent is set once the current run ran for Config.MaxRuntime
+	runtimeSpent atomic.Bool
+
+	start      time.Time
+	startIO    sysinfo.IOCounters
+	startIOErr error
+}
+
+// newRunStats starts the clock and takes the baseline I/O snapshot
+func newRunStats() *runStats {
+	s := &runStats{start: time.Now()}
+	s.startIO, s.startIOErr = sysinfo.SelfIO()
+	s.throughput.start(s.start)
+	return s
+}
+
+// recordRebalanced counts a successfully rebalanced file of a dataset
+func (s *runStats) recordRebalanced(dataset string, size int64) {
+	s.filesRebalanced.Add(1)
+	s.bytesRebalanced.Add(size)
+	s.datasets.add(dataset, func(d *DatasetStats) {
+		d.FilesRebalanced++
+		d.BytesRebalanced += size
+	})
+}
+
+// startRun resets the per-run counters for a run over the given number of files and bytes
+func (s *runStats) startRun(files int, bytes int64) {
+	s.runQueued.Store(int64(files))
+	s.runFinished.Store(0)
+	s.runBytesQueued.Store(bytes)
+	s.runBytesFinished.Store(0)
+	s.runInterrupted.Store(false)
+	s.passWorkLeft.Store(false)
+	s.byteRate.reset(time.Now())
+}
+
+// recordSkipped counts a file of a dataset that did not need rebalancing
+func (s *runStats) recordSkipped(dataset string) {
+	s.filesSkipped.Add(1)
+	s.datasets.add(dataset, func(d *DatasetStats) { d.FilesSkipped++ })
+}
+
+// recordFailed counts a file of a dataset that could not be rebalanced
+func (s *runStats) recordFailed(dataset string) {
+	s.filesFailed.Add(1)
+	s.datasets.add(dataset, func(d *DatasetStats) { d.FilesFailed++ })
+}
+
+// recordVerified counts a background checksum verification and whether it matched
+func (s *runStats) recordVerified(match bool) {
+	s.filesVerified.Add(1)
+	if !match {
+		s.verifyMismatches.Add(1)
+	}
+}
+
+// Stats returns a snapshot of the counters of the Rebalancer
+func (r *Rebalancer) Stats() Stats {
+	return Stats{
+		Pass:            int(r.stats.pass.Load()),
+		Passes:          int(r.stats.passes.Load()),
+		Queued:          r.stats.runQueued.Load(),
+		Done:            r.stats.runFinished.Load(),
+		Rebalanced:      r.stats.filesRebalanced.Load(),
+		Skipped:         r.stats.filesSkipped.Load(),
+		SkippedBy:       r.stats.skipReasons.snapshot(),
+		Failed:          r.stats.filesFailed.Load(),
+		BytesRebalanced: r.stats.bytesRebalanced.Load(),
+		Bytes:           r.ByteProgress(),
+		Throughput:      r.Throughput(),
+		Interrupted:     r.isShuttingDown() || r.stats.runInterrupted.Load(),
+		Elapsed:         time.Since(r.stats.start),
+	}
+}
+
+// Summary returns the totals accumulated so far, including the process I/O
+// footprint so the real cost can be compared against the logical bytes rewritten
+func (r *Rebalancer) Summary() Summary {
+	now := time.Now()
+	elapsed := now.Sub(r.stats.start)
+	// Round(0) strips the monotonic reading, leaving the wall-clock difference
+	wallElapsed := now.Round(0).Sub(r.stats.start.Round(0))
+
+	summary := Summary{
+		FilesRebalanced:      r.stats.filesRebalanced.Load(),
+		BytesRebalanced:      r.stats.bytesRebalanced.Load(),
+		FilesSkipped:         r.stats.filesSkipped.Load(),
+		FilesFailed:          r.stats.filesFailed.Load(),
+		FilesInUse:           r.stats.filesInUse.Load(),
+		FilesAlreadyBalanced: r.stats.filesBalanced.Load(),
+		FilesLowSpace:        r.stats.filesLowSpace.Load(),
+		FilesProtected:       r.stats.filesProtected.Load(),
+		SpaceWaits:           r.stats.spaceWaits.Load(),
+		FilesDeferred:        r.stats.filesDeferred.Load(),
+		FilesRemaining:       r.stats.runQueued.Load() - r.stats.runFinished.Load(),
+		TempNamesShortened:   r.stats.tempNamesShortened.Load(),
+		DirtyPauses:          r.stats.dirtyPauses.Load(),
+		DirtyPaused:          time.Duration(r.stats.dirtyPaused.Load()),
+		QueueLatency:         r.stats.queueWaits.summary(),
+		RetryAttempts:        r.stats.retryAttempts.Load(),
+		FilesRetried:         r.stats.filesRetried.Load(),
+		Interrupted:          r.isShuttingDown() || r.stats.runInterrupted.Load(),
+		TooManyErrors:        r.stats.errorBudgetSpent.Load(),
+		PoolFull:             r.stats.poolFull.Load(),
+		ByteBudgetSpent:      r.stats.byteBudgetSpent.Load(),
+		RuntimeSpent:         r.stats.runtimeSpent.Load(),
+		CapacityPauses:       r.stats.capacityPauses.Load(),
+		WindowPauses:         r.stats.windowPauses.Load(),
+		FilesVerified:        r.stats.filesVerified.Load(),
+		FilesReplaceVerified: r.stats.filesFinalChecked.Load(),
+		VerifyMismatches:     r.stats.verifyMismatches.Load(),
+		VerificationDisabled: r.config.NoVerify,
+		UnsupportedMetadata:  r.unsupportedMetadata(),
+		Elapsed:              elapsed,
+		ClockAdjustment:      clockAdjustment(elapsed, wallElapsed),
+	}
+
+	r.tooLargeMu.Lock()
+	for _, size := range r.tooLarge {
+		summary.FilesTooLarge++
+		summary.BytesTooLarge += size
+	}
+	r.tooLargeMu.Unlock()
+
+	if arc, ok := r.ARC(); ok {
+		summary.ARC = &arc
+	}
+
+	if r.stats.startIOErr == nil {
+		if current, err := sysinfo.SelfIO(); err == nil {
+			delta := current.Sub(r.stats.startIO)
+			summary.IO = &IOUsage{
+				ReadChars:      delta.ReadChars,
+				WriteChars:     delta.WriteChars,
+				ReadSyscalls:   delta.ReadSyscalls,
+				WriteSyscalls:  delta.WriteSyscalls,
+				ReadBytes:      delta.ReadBytes,
+				WriteBytes:     delta.WriteBytes,
+				BlockInputOps:  delta.BlockInputOps,
+				BlockOutputOps: delta.BlockOutputOps,
+			}
+		}
+	}
+
+	return summary
+}
+
+// clockAdjustment returns by how much the wall clock moved beyond the monotonic elapsed
+// time, or zero if the difference is below clockStepThreshold
+func clockAdjustment(elapsed, wallElapsed time.Duration) time.Duration {
+	adjustment := wallElapsed - elapsed
+	if adjustment > -clockStepThreshold && adjustment < clockStepThreshold {
+		return 0
+	}
+	return adjustment
+}
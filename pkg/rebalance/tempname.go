@@ -0,0 +1,184 @@
+package rebalance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultTempSuffix marks the temporary copies made while rebalancing, unless
+	// Config.TempSuffix names another suffix
+	DefaultTempSuffix = ".balance"
+	// TempSubdirName is the hidden directory that holds the temporary copies of the files
+	// of a directory with Config.TempSubdir
+	TempSubdirName = ".rebalance-tmp"
+	// maxNameBytes is the longest file name ZFS and most other filesystems accept
+	maxNameBytes = 255
+	// shortNameHashLen is the number of hex digits identifying a shortened temp name
+	shortNameHashLen = 12
+)
+
+// errPathTooLong is returned when no temp path within the platform limits exists for a file
+var errPathTooLong = errors.New("path too long for a temp file")
+
+// maxPathBytes is the longest path the platform accepts in a system call
+func maxPathBytes() int {
+	switch runtime.GOOS {
+	case "linux":
+		return 4095 // PATH_MAX includes the terminating NUL
+	case "windows":
+		return 32767 // extended-length paths, used by the os package for long names
+	default:
+		return 1023 // macOS and the BSDs
+	}
+}
+
+// tempNaming is where the temporary copy of a file goes and what it is called. Copies
+// are renamed over their originals, so they always stay on the dataset of the original.
+type tempNaming struct {
+	suffix string
+	// subdir puts the copies into TempSubdirName below the directory of their original
+	subdir bool
+}
+
+// tempNaming returns the naming of Config.TempSuffix and Config.TempSubdir
+func (r *Rebalancer) tempNaming() tempNaming {
+	n := tempNaming{suffix: r.config.TempSuffix, subdir: r.config.TempSubdir}
+	if n.suffix == "" {
+		n.suffix = DefaultTempSuffix
+	}
+	return n
+}
+
+// CheckTempSuffix returns an error if suffix cannot mark temporary copies
+func CheckTempSuffix(suffix string) error {
+	switch {
+	case suffix == "":
+		return errors.New("the temp suffix must not be empty")
+	case strings.ContainsAny(suffix, `/\`) || suffix == "." || suffix == "..":
+		return fmt.Errorf("invalid temp suffix %q: it must be a plain name ending", suffix)
+	case len(suffix) > maxNameBytes/2:
+		return fmt.Errorf("temp suffix %q is too long", suffix)
+	}
+	return nil
+}
+
+// pathFor returns the path of the temporary copy of filePath, normally filePath with the
+// suffix appended. When that name would exceed the file name limit, the name is truncated
+// and a hash of the full name is added to keep it unique; shortened reports this.
+// errPathTooLong is returned if even a shortened path would exceed the path length limit.
+func (n tempNaming) pathFor(filePath string) (tmpPath string, shortened bool, err error) {
+	dir, name := filepath.Split(filePath)
+	if n.subdir {
+		dir = filepath.Join(dir, TempSubdirName) + string(filepath.Separator)
+	}
+
+	tmpName := name + n.suffix
+	if len(tmpName) > maxNameBytes {
+		sum := sha256.Sum256([]byte(name))
+		tag := "~" + hex.EncodeToString(sum[:])[:shortNameHashLen]
+		keep := truncateUTF8(name, maxNameBytes-len(tag)-len(n.suffix))
+		tmpName = keep + tag + n.suffix
+		shortened = true
+	}
+
+	tmpPath = dir + tmpName
+	if len(tmpPath) > maxPathBytes() {
+		return "", false, fmt.Errorf("%w: %s", errPathTooLong, filePath)
+	}
+	return tmpPath, shortened, nil
+}
+
+// isTemp reports whether path names a temporary copy. With subdir, only the files in a
+// TempSubdirName directory are, so files of applications that happen to end in the
+// suffix are rebalanced like any other.
+func (n tempNaming) isTemp(path string) bool {
+	if !strings.HasSuffix(path, n.suffix) {
+		return false
+	}
+	return !n.subdir || filepath.Base(filepath.Dir(path)) == TempSubdirName
+}
+
+// originalOf returns the path of the file whose temporary copy is at tmpPath, false for
+// a shortened name, which cannot be traced back to its original
+func (n tempNaming) originalOf(tmpPath string) (string, bool) {
+	if !n.isTemp(tmpPath) {
+		return "", false
+	}
+	dir, name := filepath.Split(tmpPath)
+	if n.subdir {
+		dir = filepath.Dir(filepath.Clean(dir))
+	}
+	base := strings.TrimSuffix(name, n.suffix)
+	// A shortened name fills the name limit and ends in the tag of the hash of the full name
+	if tag := len(base) - shortNameHashLen - 1; len(name) > maxNameBytes-utf8.UTFMax && tag >= 0 && base[tag] == '~' {
+		if _, err := hex.DecodeString(base[tag+1:]); err == nil {
+			return "", false
+		}
+	}
+	original := filepath.Join(dir, base)
+	if p, shortened, err := n.pathFor(original); err != nil || shortened || p != tmpPath {
+		return "", false
+	}
+	return original, true
+}
+
+// isTempDir reports whether the directory at path only holds temporary copies
+func (n tempNaming) isTempDir(path string) bool {
+	return n.subdir && filepath.Base(path) == TempSubdirName
+}
+
+// makeTempDir creates the directory of the temporary copy at tmpPath if it is a
+// TempSubdirName directory, remembering it so removeTempDirs can remove it after the run
+func (r *Rebalancer) makeTempDir(tmpPath string) error {
+	if !r.tempNaming().subdir {
+		return nil
+	}
+	dir := filepath.Dir(tmpPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create the temp directory %s: %w", dir, err)
+	}
+	r.addTempDir(dir)
+	return nil
+}
+
+// addTempDir remembers a TempSubdirName directory for removeTempDirs
+func (r *Rebalancer) addTempDir(dir string) {
+	r.tempDirsMu.Lock()
+	defer r.tempDirsMu.Unlock()
+	if r.tempDirs == nil {
+		r.tempDirs = make(map[string]bool)
+	}
+	r.tempDirs[dir] = true
+}
+
+// removeTempDirs removes the TempSubdirName directories created or found during the run
+// that are empty again. It must only be called with no file in progress.
+func (r *Rebalancer) removeTempDirs() {
+	r.tempDirsMu.Lock()
+	defer r.tempDirsMu.Unlock()
+	for dir := range r.tempDirs {
+		// Fails for a directory still holding copies, which is left in place
+		if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+			delete(r.tempDirs, dir)
+		}
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a multi-byte character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
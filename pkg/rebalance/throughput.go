@@ -0,0 +1,51 @@
+package rebalance
+
+import (
+	"time"
+)
+
+// Throughput is the data the Rebalancer moved through the pool since it was created,
+// so the load the tool puts on the pool is visible beyond the speed of single files
+type Throughput struct {
+	// BytesRead counts the bytes read from the pool: originals while copying, and the
+	// files read back for verification; BytesWritten the bytes of the copies written
+	BytesRead    int64
+	BytesWritten int64
+	// Read1m and Read5m are the read rates in bytes per second over the last minute and
+	// the last five minutes, or since the Rebalancer was created if that is more recent;
+	// Write1m and Write5m the write rates
+	Read1m  float64
+	Read5m  float64
+	Write1m float64
+	Write5m float64
+}
+
+// throughputWindows keeps the rolling windows behind Throughput
+type throughputWindows struct {
+	read1m, read5m, write1m, write5m rateWindow
+}
+
+// start sets the spans of the windows and starts them at now
+func (w *throughputWindows) start(now time.Time) {
+	w.read1m.span, w.write1m.span = time.Minute, time.Minute
+	w.read5m.span, w.write5m.span = 5*time.Minute, 5*time.Minute
+	for _, window := range []*rateWindow{&w.read1m, &w.read5m, &w.write1m, &w.write5m} {
+		window.reset(now)
+	}
+}
+
+// Throughput returns the bytes read and written so far with their rolling rates. The
+// rates are sampled by the calls, so it is meant to be polled, e.g. with the progress output.
+func (r *Rebalancer) Throughput() Throughput {
+	now := time.Now()
+	t := Throughput{
+		BytesRead:    r.stats.bytesRead.Load(),
+		BytesWritten: r.stats.bytesWritten.Load(),
+	}
+	w := &r.stats.throughput
+	t.Read1m = w.read1m.rate(now, t.BytesRead)
+	t.Read5m = w.read5m.rate(now, t.BytesRead)
+	t.Write1m = w.write1m.rate(now, t.BytesWritten)
+	t.Write5m = w.write5m.rate(now, t.BytesWritten)
+	return t
+}
@@ -0,0 +1,223 @@
+package rebalance
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+const (
+	// verifyBatchSize is the number of stored checksums fetched from the DB at a time
+	verifyBatchSize = 64
+	// verifyIdlePoll is how long the verifier waits before checking again for an idle worker slot
+	verifyIdlePoll = 500 * time.Millisecond
+)
+
+// errVerifyStopped aborts a background verification when the run ends
+var errVerifyStopped = errors.New("background verification stopped")
+
+// stoppableReader fails reads once stop is closed so a large file does not delay the end of a run
+type stoppableReader struct {
+	r    io.Reader
+	stop <-chan struct{}
+}
+
+func (s stoppableReader) Read(p []byte) (int, error) {
+	select {
+	case <-s.stop:
+		return 0, errVerifyStopped
+	default:
+		return s.r.Read(p)
+	}
+}
+
+// setPending records the files queued for this run so the verifier leaves them to the workers
+func (r *Rebalancer) setPending(files []string) {
+	r.pendingMutex.Lock()
+	defer r.pendingMutex.Unlock()
+
+	r.pending = make(map[string]bool, len(files))
+	for _, f := range files {
+		r.pending[f] = true
+		if linkedPaths, ok := r.hardlinkGroup(f); ok {
+			for _, linkPath := range linkedPaths {
+				r.pending[linkPath] = true
+			}
+		}
+	}
+}
+
+// finishPending marks a file (and the other links of its group) as no longer scheduled
+func (r *Rebalancer) finishPending(filePath string) {
+	r.pendingMutex.Lock()
+	defer r.pendingMutex.Unlock()
+
+	delete(r.pending, filePath)
+	if linkedPaths, ok := r.hardlinkGroup(filePath); ok {
+		for _, linkPath := range linkedPaths {
+			delete(r.pending, linkPath)
+		}
+	}
+}
+
+// isPending reports whether a file is still waiting to be rewritten in this run
+func (r *Rebalancer) isPending(filePath string) bool {
+	r.pendingMutex.Lock()
+	defer r.pendingMutex.Unlock()
+	return r.pending[filePath]
+}
+
+// hasIdleWorker reports whether fewer workers are copying than the configured concurrency,
+// e.g. because the per-dataset limit holds them back or the queue is draining
+func (r *Rebalancer) hasIdleWorker() bool {
+	return int(r.busyWorkers.Load()) < r.Concurrency()
+}
+
+// backgroundVerify repeatedly walks the stored checksums that have not been checked since
+// the run started and re-hashes one file at a time whenever a worker slot is idle. Files
+// rebalanced during the run become candidates once they leave the queue. It returns when
+// the run ends (stop is closed) or on shutdown.
+func (r *Rebalancer) backgroundVerify(stop <-chan struct{}, runStart time.Time) {
+	after := ""
+	checked := false
+	for {
+		records, err := r.db.ChecksumsToVerify(after, runStart, verifyBatchSize)
+		if err != nil {
+			r.logger.Errorf("Background verify: failed to read stored checksums: %v", err)
+			return
+		}
+		if len(records) == 0 {
+			// End of the table: start over, waiting first if the sweep found nothing to check
+			if !checked {
+				select {
+				case <-stop:
+					return
+				case <-time.After(verifyIdlePoll):
+				}
+			}
+			after = ""
+			checked = false
+			continue
+		}
+
+		for _, rec := range records {
+			after = rec.FilePath
+
+			// Wait for spare capacity
+			for !r.hasIdleWorker() {
+				select {
+				case <-stop:
+					return
+				case <-time.After(verifyIdlePoll):
+				}
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if r.isShuttingDown() {
+				return
+			}
+
+			if r.isPending(rec.FilePath) {
+				continue
+			}
+
+			checked = true
+			if err := r.verifyStoredChecksum(rec, stop); err != nil {
+				if errors.Is(err, errVerifyStopped) {
+					return
+				}
+				r.logger.Errorf("Background verify: %s: %v", rec.FilePath, err)
+			}
+		}
+	}
+}
+
+// verifyResult is the outcome of checking a file against its stored checksum
+type verifyResult int
+
+const (
+	verifyMatch verifyResult = iota
+	verifyMismatch
+	verifyModified // size or modification time changed since the checksum was stored
+	verifyMissing  // file no longer exists
+)
+
+// checkStoredChecksum re-hashes a file whose size and modification time still match its
+// stored checksum record and compares the digests. It returns the digest found, if hashed.
+func checkStoredChecksum(rec database.ChecksumRecord, stop <-chan struct{}) (verifyResult, string, error) {
+	info, err := os.Stat(rec.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return verifyMissing, "", nil
+		}
+		return 0, "", err
+	}
+	if info.Size() != rec.Size || !info.ModTime().Equal(rec.ModTime) {
+		return verifyModified, "", nil
+	}
+
+	f, err := os.Open(rec.FilePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if stop != nil {
+		src = stoppableReader{r: f, stop: stop}
+	}
+	h := fileutil.NewHash(fileutil.ChecksumType(rec.Algorithm))
+	if _, err := io.Copy(h, src); err != nil {
+		return 0, "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	if digest != rec.Digest {
+		return verifyMismatch, digest, nil
+	}
+	return verifyMatch, digest, nil
+}
+
+// verifyStoredChecksum re-hashes a file and compares it with its stored checksum.
+// Records of files that were deleted or modified since they were stored are dropped.
+func (r *Rebalancer) verifyStoredChecksum(rec database.ChecksumRecord, stop <-chan struct{}) error {
+	release, ok := r.acquireHash(stop)
+	if !ok {
+		return errVerifyStopped
+	}
+	result, digest, err := checkStoredChecksum(rec, stop)
+	release()
+	if err != nil {
+		return err
+	}
+
+	if result == verifyMatch || result == verifyMismatch {
+		r.stats.bytesRead.Add(rec.Size)
+	}
+	switch result {
+	case verifyMissing:
+		r.logger.Infof("Background verify: file no longer on disk, forgetting checksum: %s", rec.FilePath)
+		return r.db.DeleteChecksum(rec.FilePath)
+	case verifyModified:
+		r.logger.Infof("Background verify: file modified since checksum was stored, forgetting it: %s", rec.FilePath)
+		return r.db.DeleteChecksum(rec.FilePath)
+	case verifyMismatch:
+		r.stats.recordVerified(false)
+		r.logger.Errorf("Background verify: %s checksum mismatch for unmodified file %s: stored %s, found %s",
+			rec.Algorithm, rec.FilePath, rec.Digest, digest)
+	default:
+		r.stats.recordVerified(true)
+		r.logger.Infof("Background verify: checksum OK: %s", rec.FilePath)
+	}
+
+	return r.db.MarkChecksumVerified(rec.FilePath, time.Now())
+}
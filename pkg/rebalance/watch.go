@@ -0,0 +1,247 @@
+package rebalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchTick is how often Watch looks for files that have settled
+const watchTick = time.Second
+
+// ownEventGrace is how long after a batch the events on its files are taken for those of
+// the batch's own copies and renames, which arrive after the run returned
+const ownEventGrace = 2 * time.Second
+
+// watchQueue holds the files written since they were last rebalanced until they settle
+type watchQueue struct {
+	mu sync.Mutex
+	// pending maps a file to the time of its last event
+	pending map[string]time.Time
+	// running holds the files of the batch in progress, quiet those of finished batches
+	// until their own events are over
+	running map[string]bool
+	quiet   map[string]time.Time
+}
+
+func newWatchQueue() *watchQueue {
+	return &watchQueue{
+		pending: make(map[string]time.Time),
+		running: make(map[string]bool),
+		quiet:   make(map[string]time.Time),
+	}
+}
+
+// touch notes an event on path, unless the tool is or was just rewriting it
+func (q *watchQueue) touch(path string, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running[path] || at.Before(q.quiet[path]) {
+		return
+	}
+	q.pending[path] = at
+}
+
+// forget drops a file that was removed or renamed away
+func (q *watchQueue) forget(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, path)
+}
+
+// settled takes the files without an event for settle out of the queue, sorted by path,
+// and marks them running
+func (q *watchQueue) settled(settle time.Duration, now time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var files []string
+	for path, at := range q.pending {
+		if now.Sub(at) >= settle {
+			files = append(files, path)
+			delete(q.pending, path)
+			q.running[path] = true
+		}
+	}
+	for path, until := range q.quiet {
+		if now.After(until) {
+			delete(q.quiet, path)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// finished ends the batch of files, ignoring their events for ownEventGrace more
+func (q *watchQueue) finished(files []string, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, path := range files {
+		delete(q.running, path)
+		q.quiet[path] = now.Add(ownEventGrace)
+	}
+}
+
+// Watch rebalances the files created or written below the root paths once no event was
+// seen on them for settle, until ctx is canceled or a shutdown is requested. Callers run
+// it after a full pass, which took care of the files written before. Settled files are
+// processed in batches as a run with Config.Files would, with the same filters and pass
+// limit; the tool's own copies and renames are not taken for new writes.
+func (r *Rebalancer) Watch(ctx context.Context, settle time.Duration) error {
+	if r.db.ReadOnly {
+		return errors.New("cannot rebalance with a read-only database")
+	}
+	// Batches are runs over a list of files, without the startup cleanup of a full walk
+	orig := r.config
+	cfg := *orig
+	cfg.CleanupBalanceFiles = false
+	cfg.Passes = 1
+	r.config = &cfg
+	defer func() { r.config = orig }()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot watch for file events: %w", err)
+	}
+	events := make(chan struct{})
+	defer func() {
+		watcher.Close()
+		<-events
+	}()
+
+	queue := newWatchQueue()
+	go func() {
+		defer close(events)
+		r.readWatchEvents(watcher, queue)
+	}()
+
+	dirs := 0
+	for _, root := range r.roots() {
+		n, err := r.watchTree(watcher, queue, root, false)
+		dirs += n
+		if err != nil {
+			return err
+		}
+	}
+	r.logger.Warnf("Watching %d directories below %s for new and written files, rebalanced after %s without changes",
+		dirs, strings.Join(r.roots(), ", "), settle)
+
+	ticker := time.NewTicker(watchTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.shutdown.Done():
+			return nil
+		case <-events:
+			return errors.New("file event watch stopped")
+		case <-ticker.C:
+		}
+
+		files := queue.settled(settle, time.Now())
+		if len(files) == 0 {
+			continue
+		}
+		r.logger.Infof("Rebalancing %d settled files", len(files))
+		cfg.Files = files
+		err := r.RunContext(ctx, nil)
+		queue.finished(files, time.Now())
+		switch {
+		case errors.Is(err, ErrTooManyErrors), errors.Is(err, ErrPoolFull):
+			return err
+		case err != nil && !r.stopRequested(ctx):
+			r.logger.Warnf("Rebalancing settled files: %v", err)
+		}
+	}
+}
+
+// readWatchEvents queues the files of the events of watcher until it is closed
+func (r *Rebalancer) readWatchEvents(watcher *fsnotify.Watcher, queue *watchQueue) {
+	naming := r.tempNaming()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			path := ev.Name
+			if naming.isTemp(path) {
+				continue
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				queue.forget(path)
+				continue
+			}
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+				continue
+			}
+			if filepath.Base(path) == IgnoreFileName {
+				r.forgetIgnoreFile(filepath.Dir(path))
+				continue
+			}
+			info, err := os.Lstat(path)
+			switch {
+			case err != nil:
+				continue
+			case info.IsDir() && ev.Has(fsnotify.Create):
+				// Files may have been written before the directory was watched
+				if _, err := r.watchTree(watcher, queue, path, true); err != nil {
+					r.logger.Warnf("%v", err)
+				}
+			case info.Mode().IsRegular():
+				queue.touch(path, time.Now())
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				r.logger.Warnf("File events were lost: files written meanwhile are left for the next full pass")
+				continue
+			}
+			r.logger.Warnf("File event watch: %v", err)
+		}
+	}
+}
+
+// watchTree watches dir and the directories below it that a walk would enter, and
+// returns how many it added. With queueFiles the regular files found are queued, as
+// they may have been written before their directory was watched.
+func (r *Rebalancer) watchTree(watcher *fsnotify.Watcher, queue *watchQueue, dir string, queueFiles bool) (int, error) {
+	naming := r.tempNaming()
+	root, _ := r.rootOf(dir)
+	added := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			if queueFiles && info.Mode().IsRegular() && !naming.isTemp(path) {
+				queue.touch(path, time.Now())
+			}
+			return nil
+		}
+		if r.isExcludedMount(path) || r.crossesFilesystem(info) || naming.isTempDir(path) ||
+			(root != "" && r.ignoredByFile(filepath.Clean(path), root, true)) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				return fmt.Errorf("cannot watch %s: out of watches, raise fs.inotify.max_user_watches: %w", path, err)
+			}
+			return fmt.Errorf("cannot watch %s: %w", path, err)
+		}
+		added++
+		return nil
+	})
+	return added, err
+}
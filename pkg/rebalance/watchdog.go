@@ -0,0 +1,179 @@
+package rebalance
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/fileutil"
+)
+
+const (
+	// maxStallRequeues is how many times a stalled file is retried before it counts as failed
+	maxStallRequeues = 2
+	// watchdog check interval bounds
+	minWatchdogInterval = time.Second
+	maxWatchdogInterval = time.Minute
+)
+
+// errStalled is returned by RebalanceFile when the watchdog canceled a copy that stopped making progress
+var errStalled = errors.New("temp file made no progress")
+
+// Stages of RebalanceFile reported by the watchdog
+const (
+	stageCopying   = "copying"
+	stageVerifying = "verifying"
+	stageBatched   = "waiting for batch"
+	stageReplacing = "replacing original"
+	stageMetadata  = "restoring metadata"
+	stageChecking  = "checking replacement"
+	stageRelinking = "relinking"
+)
+
+// inflightFile is the watchdog's view of a file a worker is rebalancing
+type inflightFile struct {
+	path         string
+	tmpPath      string
+	expectedSize int64
+	started      time.Time
+	cancel       chan struct{}
+	cancelOnce   sync.Once
+
+	mu            sync.Mutex
+	stage         string
+	lastProgress  time.Time
+	lastSize      int64
+	lastAllocated int64
+	warned        bool
+}
+
+// setStage records that the worker moved on to another step, which counts as progress
+func (f *inflightFile) setStage(stage string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stage = stage
+	f.lastProgress = time.Now()
+	f.warned = false
+}
+
+// requestCancel aborts the copy of a stalled file
+func (f *inflightFile) requestCancel() {
+	f.cancelOnce.Do(func() { close(f.cancel) })
+}
+
+// startInflight registers a file with the watchdog before its temp file is created
+func (r *Rebalancer) startInflight(filePath, tmpPath string, expectedSize int64) *inflightFile {
+	now := time.Now()
+	f := &inflightFile{
+		path:          filePath,
+		tmpPath:       tmpPath,
+		expectedSize:  expectedSize,
+		started:       now,
+		cancel:        make(chan struct{}),
+		stage:         stageCopying,
+		lastProgress:  now,
+		lastSize:      -1,
+		lastAllocated: -1,
+	}
+
+	r.inflightMutex.Lock()
+	defer r.inflightMutex.Unlock()
+	if r.inflight == nil {
+		r.inflight = make(map[string]*inflightFile)
+	}
+	r.inflight[filePath] = f
+	return f
+}
+
+// finishInflight removes a file from the watchdog once its worker is done with it
+func (r *Rebalancer) finishInflight(filePath string) {
+	r.inflightMutex.Lock()
+	defer r.inflightMutex.Unlock()
+	delete(r.inflight, filePath)
+}
+
+// tempFileWatchdog periodically checks the in-flight temp files until stop is closed
+func (r *Rebalancer) tempFileWatchdog(stop <-chan struct{}) {
+	interval := r.config.TempFileTimeout / 4
+	if interval < minWatchdogInterval {
+		interval = minWatchdogInterval
+	}
+	if interval > maxWatchdogInterval {
+		interval = maxWatchdogInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.checkInflight(now)
+		}
+	}
+}
+
+// checkInflight warns about temp files that have not grown and whose worker has not changed
+// stage for longer than TempFileTimeout, and cancels their copy if RequeueStalled is set
+func (r *Rebalancer) checkInflight(now time.Time) {
+	r.inflightMutex.Lock()
+	files := make([]*inflightFile, 0, len(r.inflight))
+	for _, f := range r.inflight {
+		files = append(files, f)
+	}
+	r.inflightMutex.Unlock()
+
+	for _, f := range files {
+		// Stat outside the lock, a hung filesystem must not block the workers
+		size, allocated := int64(-1), int64(-1)
+		var statErr error
+		if info, err := os.Lstat(f.tmpPath); err == nil {
+			size = info.Size()
+			allocated, _ = fileutil.GetAllocatedSize(f.tmpPath)
+		} else {
+			statErr = err
+		}
+
+		f.mu.Lock()
+		if size != f.lastSize || allocated != f.lastAllocated {
+			f.lastSize, f.lastAllocated = size, allocated
+			f.lastProgress = now
+			f.warned = false
+		}
+		idle := now.Sub(f.lastProgress)
+		stage := f.stage
+		// Copies waiting for their batch make no progress by design
+		stalled := idle >= r.config.TempFileTimeout && !f.warned && stage != stageBatched
+		if stalled {
+			f.warned = true
+		}
+		f.mu.Unlock()
+
+		if !stalled {
+			continue
+		}
+
+		tempState := "missing"
+		if statErr == nil {
+			tempState = fmt.Sprintf("at %d of %d bytes, %d allocated", size, f.expectedSize, allocated)
+		} else if !os.IsNotExist(statErr) {
+			tempState = statErr.Error()
+		}
+		r.logger.Warnf("STALLED: no progress on '%s' for %s (stage: %s, temp file %s, worker busy for %s)",
+			f.path, idle.Round(time.Second), stage, tempState, now.Sub(f.started).Round(time.Second))
+
+		if r.config.RequeueStalled {
+			if stage == stageCopying {
+				r.logger.Warnf("Canceling stalled copy of '%s', it will be requeued", f.path)
+				f.requestCancel()
+			} else {
+				r.logger.Warnf("Cannot cancel '%s' while %s, waiting for the worker", f.path, stage)
+			}
+		}
+	}
+}
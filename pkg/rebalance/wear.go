@@ -0,0 +1,213 @@
+package rebalance
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/zpool"
+)
+
+const (
+	// metadataBytesPerFile approximates the dnode, directory entry and indirect blocks rewritten per file
+	metadataBytesPerFile = 4096
+	// metadataFraction approximates block pointer overhead relative to the file data
+	metadataFraction = 0.002
+)
+
+// FlashWriteEstimate is the approximate amount of data a run will write to flash devices.
+// Log (SLOG) and cache (L2ARC) devices are not counted.
+type FlashWriteEstimate struct {
+	Pool string
+	// Files and LogicalBytes describe one pass over the tree
+	Files        int64
+	LogicalBytes int64
+	// Passes is the number of passes the estimate covers
+	Passes int
+	// DataBytes and SpecialBytes are written to flash data and special vdevs, including redundancy
+	DataBytes    int64
+	SpecialBytes int64
+}
+
+// TotalBytes is the estimated number of bytes written to flash
+func (e FlashWriteEstimate) TotalBytes() int64 {
+	return e.DataBytes + e.SpecialBytes
+}
+
+// treeUsage summarizes the files below the root path
+type treeUsage struct {
+	files      int64
+	bytes      int64
+	smallBytes int64 // bytes in files small enough for the special vdev
+}
+
+// EstimateFlashWrites estimates how much a run will write to the flash vdevs of the pool
+// holding the (first) root path, counting the files of every root path on that pool. It
+// returns nil if the root is not on ZFS or the pool has no flash vdevs besides log and
+// cache devices.
+func (r *Rebalancer) EstimateFlashWrites() (*FlashWriteEstimate, error) {
+	r.nestedMounts()
+	if !r.rootMountFound || r.rootMount.Pool() == "" {
+		return nil, nil
+	}
+	pool := r.rootMount.Pool()
+
+	vdevs, err := zpool.Status(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	flash := make(map[string]bool)
+	anyFlash, hasSpecial := false, false
+	for _, v := range vdevs {
+		switch v.Class {
+		case zpool.ClassData, zpool.ClassSpecial, zpool.ClassDedup:
+		default:
+			continue
+		}
+		if v.Class == zpool.ClassSpecial {
+			hasSpecial = true
+		}
+
+		allFlash := len(v.Devices) > 0
+		for _, dev := range v.Devices {
+			isFlash, err := zpool.IsFlash(dev)
+			if err != nil {
+				return nil, fmt.Errorf("cannot determine device type of %s: %w", dev, err)
+			}
+			allFlash = allFlash && isFlash
+		}
+		flash[v.Name] = allFlash
+		anyFlash = anyFlash || allFlash
+	}
+	if !anyFlash {
+		return nil, nil
+	}
+
+	// Blocks up to special_small_blocks go to the special vdev with the metadata
+	var smallBlocks int64
+	if hasSpecial {
+		if value, err := zpool.DatasetProperty(r.rootMount.Source, "special_small_blocks"); err == nil {
+			smallBlocks, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+
+	usage, err := r.scanUsage(smallBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := estimateFlashWrites(vdevs, flash, usage, r.config.PassesLimit)
+	estimate.Pool = pool
+	return &estimate, nil
+}
+
+// estimateFlashWrites splits the rewritten bytes between data and special vdevs and
+// counts the share landing on flash. Data is assumed to spread evenly over the data vdevs.
+func estimateFlashWrites(vdevs []zpool.Vdev, flash map[string]bool, usage treeUsage, passes int) FlashWriteEstimate {
+	if passes <= 0 {
+		passes = 1
+	}
+
+	metadata := float64(usage.files*metadataBytesPerFile) + float64(usage.bytes)*metadataFraction
+	dataPayload := float64(usage.bytes) + metadata
+	specialPayload := 0.0
+
+	var dataVdevs, flashDataVdevs int
+	var flashDataAmp, specialAmp float64
+	var specialVdevs, flashSpecialVdevs int
+	for _, v := range vdevs {
+		switch v.Class {
+		case zpool.ClassData:
+			dataVdevs++
+			if flash[v.Name] {
+				flashDataVdevs++
+				flashDataAmp += v.WriteAmplification()
+			}
+		case zpool.ClassSpecial:
+			specialVdevs++
+			if flash[v.Name] {
+				flashSpecialVdevs++
+				specialAmp += v.WriteAmplification()
+			}
+		}
+	}
+
+	if specialVdevs > 0 {
+		dataPayload = float64(usage.bytes - usage.smallBytes)
+		specialPayload = metadata + float64(usage.smallBytes)
+	}
+
+	estimate := FlashWriteEstimate{
+		Files:        usage.files,
+		LogicalBytes: usage.bytes,
+		Passes:       passes,
+	}
+	if flashDataVdevs > 0 {
+		// Share of the data vdevs on flash, times their average redundancy
+		share := float64(flashDataVdevs) / float64(dataVdevs)
+		avgAmp := flashDataAmp / float64(flashDataVdevs)
+		estimate.DataBytes = int64(dataPayload*share*avgAmp) * int64(passes)
+	}
+	if flashSpecialVdevs > 0 {
+		share := float64(flashSpecialVdevs) / float64(specialVdevs)
+		avgAmp := specialAmp / float64(flashSpecialVdevs)
+		estimate.SpecialBytes = int64(specialPayload*share*avgAmp) * int64(passes)
+	}
+	return estimate
+}
+
+// scanUsage totals the regular files below the root paths on the estimated pool that a
+// run would rewrite
+func (r *Rebalancer) scanUsage(smallBlocks int64) (treeUsage, error) {
+	var usage treeUsage
+	naming := r.tempNaming()
+	walkFn := func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return nil
+		}
+		if info.IsDir() && (r.isExcludedMount(path) || r.crossesFilesystem(info)) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || naming.isTemp(path) {
+			return nil
+		}
+		usage.files++
+		usage.bytes += info.Size()
+		if smallBlocks > 0 && info.Size() <= smallBlocks {
+			usage.smallBytes += info.Size()
+		}
+		return nil
+	}
+
+	for _, root := range r.rootsOnPool(r.rootMount.Pool()) {
+		if err := filepath.Walk(root, walkFn); err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+// reportFlashWrites logs the SSD wear estimate and warns when it exceeds the configured budget
+func (r *Rebalancer) reportFlashWrites() {
+	estimate, err := r.EstimateFlashWrites()
+	if err != nil {
+		r.logger.Infof("SSD wear estimate unavailable: %v", err)
+		return
+	}
+	if estimate == nil {
+		return
+	}
+
+	size := func(n int64) string { return r.config.Units.Size(uint64(n)) }
+	r.logger.Warnf("SSD wear estimate for pool %s: ~%s written to flash over %d pass(es) (%s to data vdevs, %s to special vdevs) for %d files, %s logical per pass",
+		estimate.Pool, size(estimate.TotalBytes()), estimate.Passes,
+		size(estimate.DataBytes), size(estimate.SpecialBytes),
+		estimate.Files, size(estimate.LogicalBytes))
+
+	if budget := r.config.SSDWriteBudget; budget > 0 && estimate.TotalBytes() > budget {
+		r.logger.Warnf("SSD wear estimate of %s exceeds the write budget of %s; consider fewer --passes or a smaller path",
+			size(estimate.TotalBytes()), size(budget))
+	}
+}
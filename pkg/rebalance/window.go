@@ -0,0 +1,135 @@
+package rebalance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window is the time of day, in local time, during which files may be started. It spans
+// midnight when End is before Start. The zero value allows any time.
+type Window struct {
+	// Start and End are offsets from midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a window such as "01:00-07:00" or "22:30-06:00"
+func ParseWindow(s string) (Window, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid window %q: expected a range such as 01:00-07:00", s)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if start == end {
+		return Window{}, fmt.Errorf("invalid window %q: it starts and ends at the same time", s)
+	}
+	return Window{Start: start, End: end}, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into an offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("expected a time such as 01:00, got %q", strings.TrimSpace(s))
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// IsZero reports whether the window allows any time
+func (w Window) IsZero() bool {
+	return w.Start == w.End
+}
+
+func (w Window) String() string {
+	if w.IsZero() {
+		return "any time"
+	}
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+// Contains reports whether t is within the window
+func (w Window) Contains(t time.Time) bool {
+	if w.IsZero() {
+		return true
+	}
+	at := sinceMidnight(t)
+	if w.Start < w.End {
+		return at >= w.Start && at < w.End
+	}
+	return at >= w.Start || at < w.End
+}
+
+// NextOpen returns the time the window opens next after t, t itself when it is open
+func (w Window) NextOpen(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	y, m, d := t.Date()
+	hour, minute := int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute)
+	opens := time.Date(y, m, d, hour, minute, 0, 0, t.Location())
+	if !opens.After(t) {
+		opens = time.Date(y, m, d+1, hour, minute, 0, 0, t.Location())
+	}
+	return opens
+}
+
+// sinceMidnight returns the time of day of t as an offset from midnight
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+// windowGate notes the opening of Config.Window that workers wait for, to log the pause
+// and the resume once
+type windowGate struct {
+	mu    sync.Mutex
+	opens time.Time // zero while the window is open
+}
+
+// waitForWindow blocks outside Config.Window until it opens, ctx is done or a shutdown is
+// requested. The files in progress are not held, only new files wait.
+func (r *Rebalancer) waitForWindow(ctx context.Context) {
+	w := r.config.Window
+	now := time.Now()
+	if w.Contains(now) {
+		return
+	}
+	opens := w.NextOpen(now)
+	g := &r.window
+	g.mu.Lock()
+	if !g.opens.Equal(opens) {
+		g.opens = opens
+		r.stats.windowPauses.Add(1)
+		r.logger.Warnf("Outside the window %s: not starting further files until %s", w, opens.Format("Mon 15:04"))
+	}
+	g.mu.Unlock()
+
+	timer := time.NewTimer(opens.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	case <-r.shutdown.Done():
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.opens.Equal(opens) {
+		g.opens = time.Time{}
+		r.logger.Warnf("Window %s open: resuming", w)
+	}
+}
@@ -0,0 +1,137 @@
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations recorded in the audit log
+const (
+	AuditRemove  = "remove"  // original deleted after its copy was verified
+	AuditRename  = "rename"  // verified copy moved over the original name
+	AuditRecover = "recover" // copy moved aside after a failed rename
+	AuditRelink  = "relink"  // hardlink replaced with a link to the new copy
+	AuditCleanup = "cleanup" // stale .balance file deleted
+)
+
+// AuditEntry is one line of the audit log. Each operation is logged before it is carried
+// out; if it then fails, a second entry with Error set follows.
+type AuditEntry struct {
+	Time   time.Time
+	Op     string
+	Path   string
+	Target string // destination of renames and links
+	Size   int64  // -1 when unknown
+	Digest string // "algorithm:hex", empty when the copy was not hashed
+	// Protection names the flags a removal cleared on the original, such as
+	// "immutable, append-only", for the file that takes its place
+	Protection string
+	Error      string // set when the operation failed
+}
+
+// Failed reports whether the entry records a failed operation
+func (e AuditEntry) Failed() bool {
+	return e.Error != ""
+}
+
+// String renders the entry as a single line, without the newline, of space-separated
+// key=value fields with quoted paths, so names containing spaces or newlines stay on one line
+func (e AuditEntry) String() string {
+	var b strings.Builder
+	b.WriteString(e.Time.UTC().Format(time.RFC3339Nano))
+	b.WriteString(" op=")
+	b.WriteString(e.Op)
+	if e.Failed() {
+		b.WriteString(" status=failed")
+	}
+	b.WriteString(" path=")
+	b.WriteString(strconv.Quote(e.Path))
+	if e.Target != "" {
+		b.WriteString(" target=")
+		b.WriteString(strconv.Quote(e.Target))
+	}
+	if e.Size >= 0 {
+		b.WriteString(" size=")
+		b.WriteString(strconv.FormatInt(e.Size, 10))
+	}
+	if e.Digest != "" {
+		b.WriteString(" digest=")
+		b.WriteString(e.Digest)
+	}
+	if e.Protection != "" {
+		b.WriteString(" protection=")
+		b.WriteString(strconv.Quote(e.Protection))
+	}
+	if e.Failed() {
+		b.WriteString(" error=")
+		b.WriteString(strconv.Quote(e.Error))
+	}
+	return b.String()
+}
+
+// ParseAuditEntry parses a line produced by AuditEntry.String. Unknown fields are
+// ignored so that logs from newer versions can still be read.
+func ParseAuditEntry(line string) (AuditEntry, error) {
+	e := AuditEntry{Size: -1}
+
+	stamp, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	t, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return AuditEntry{}, fmt.Errorf("invalid timestamp %q", stamp)
+	}
+	e.Time = t
+
+	err = parseFields(rest, func(key, value string) error {
+		var err error
+		switch key {
+		case "op":
+			e.Op = value
+		case "path":
+			e.Path = value
+		case "target":
+			e.Target = value
+		case "size":
+			if e.Size, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("invalid size %q", value)
+			}
+		case "digest":
+			e.Digest = value
+		case "protection":
+			e.Protection = value
+		case "error":
+			e.Error = value
+		}
+		return nil
+	})
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	if e.Op == "" || e.Path == "" {
+		return AuditEntry{}, fmt.Errorf("missing op or path")
+	}
+	return e, nil
+}
+
+// ReadAuditLog parses every entry of an audit log, skipping blank lines
+func ReadAuditLog(r io.Reader) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // paths can be long
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e, err := ParseAuditEntry(line)
+		if err != nil {
+			return entries, fmt.Errorf("audit log line %d: %w", lineNo, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,62 @@
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Fields of the per-file log entries
+const (
+	FieldOperation = "operation"
+	FieldPath      = "path"
+	FieldTarget    = "target"
+	FieldBytes     = "bytes"
+	FieldSpeed     = "speed_mbps"
+)
+
+// Operations reported in FieldOperation
+const (
+	OpCopy       = "copy"
+	OpRemove     = "remove"
+	OpRename     = "rename"
+	OpRebalanced = "rebalanced"
+	OpFailed     = "failed"
+)
+
+// Event is one line of the --log-format json output. Operation is empty for messages
+// that are not about a single file.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Message   string    `json:"msg"`
+	Error     string    `json:"error,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	SpeedMBps float64   `json:"speed_mbps,omitempty"`
+}
+
+// ReadEvents parses a --log-format json stream, skipping blank lines. Unknown fields
+// are ignored so that logs from newer versions can still be read.
+func ReadEvents(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Bytes()
+		if strings.TrimSpace(string(line)) == "" {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return events, fmt.Errorf("log line %d: %w", lineNo, err)
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
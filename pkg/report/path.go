@@ -0,0 +1,54 @@
+package report
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Paths are byte strings that need not be valid UTF-8, e.g. names written under a legacy
+// encoding such as Latin-1 or Shift JIS. JSON cannot carry such bytes, and most CSV
+// tools replace them, so the run report writes the path of such a file with its invalid
+// bytes escaped as \xNN for reading, and its exact bytes in base64 alongside.
+
+// escapePath replaces every byte of path that is not part of valid UTF-8 with \xNN.
+// Valid paths are returned unchanged.
+func escapePath(path string) string {
+	if utf8.ValidString(path) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); {
+		r, size := utf8.DecodeRuneInString(path[i:])
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, `\x%02x`, path[i])
+		} else {
+			b.WriteString(path[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// encodePath returns the text and base64 forms of path written to reports. The base64
+// form is empty unless path is not valid UTF-8 or always is set.
+func encodePath(path string, always bool) (text, b64 string) {
+	if always || !utf8.ValidString(path) {
+		b64 = base64.StdEncoding.EncodeToString([]byte(path))
+	}
+	return escapePath(path), b64
+}
+
+// decodePath returns the exact path of a report entry: the base64 form if there is one,
+// the text form otherwise
+func decodePath(text, b64 string) (string, error) {
+	if b64 == "" {
+		return text, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("invalid path_base64 %q: %w", b64, err)
+	}
+	return string(raw), nil
+}
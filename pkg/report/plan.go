@@ -0,0 +1,88 @@
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PlanEntry is one line of the work list printed by "rebalance plan", in the order the
+// files would be processed. The list can be reviewed or edited and then run with
+// --files-from.
+type PlanEntry struct {
+	Path string
+	Size int64
+	// Passes is how many times the file has been rebalanced according to the database
+	Passes int
+	// Reason explains why the file was selected
+	Reason string
+}
+
+// String renders the entry as a single line, without the newline, of space-separated
+// key=value fields with quoted path and reason
+func (e PlanEntry) String() string {
+	var b strings.Builder
+	b.WriteString("path=")
+	b.WriteString(strconv.Quote(e.Path))
+	b.WriteString(" size=")
+	b.WriteString(strconv.FormatInt(e.Size, 10))
+	b.WriteString(" passes=")
+	b.WriteString(strconv.Itoa(e.Passes))
+	if e.Reason != "" {
+		b.WriteString(" reason=")
+		b.WriteString(strconv.Quote(e.Reason))
+	}
+	return b.String()
+}
+
+// ParsePlanEntry parses a line produced by PlanEntry.String. Unknown fields are ignored.
+func ParsePlanEntry(line string) (PlanEntry, error) {
+	var e PlanEntry
+	err := parseFields(strings.TrimRight(line, "\r\n"), func(key, value string) error {
+		var err error
+		switch key {
+		case "path":
+			e.Path = value
+		case "size":
+			if e.Size, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("invalid size %q", value)
+			}
+		case "passes":
+			if e.Passes, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid passes %q", value)
+			}
+		case "reason":
+			e.Reason = value
+		}
+		return nil
+	})
+	if err != nil {
+		return PlanEntry{}, err
+	}
+
+	if e.Path == "" {
+		return PlanEntry{}, fmt.Errorf("missing path")
+	}
+	return e, nil
+}
+
+// ReadPlan parses every entry of a plan, skipping blank lines
+func ReadPlan(r io.Reader) ([]PlanEntry, error) {
+	var entries []PlanEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e, err := ParsePlanEntry(line)
+		if err != nil {
+			return entries, fmt.Errorf("plan line %d: %w", lineNo, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
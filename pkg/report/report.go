@@ -0,0 +1,37 @@
+// Package report reads the machine-readable output of go-zfs-rebalance: the audit log
+// written with --audit-log, the per-file events of --log-format json, the work list
+// printed by the plan command and the run report of --report. The tool writes
+// these formats with the types of this package, so parsers built on it stay in step
+// with the output as fields are added.
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseFields calls fn for each field of a line of space-separated key=value fields,
+// with quoted values unquoted
+func parseFields(line string, fn func(key, value string) error) error {
+	for line != "" {
+		var key, value string
+		key, line, _ = strings.Cut(line, "=")
+		if strings.HasPrefix(line, `"`) {
+			// Quoted values may contain spaces
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return fmt.Errorf("invalid quoted value of %s", key)
+			}
+			value, _ = strconv.Unquote(quoted)
+			line = strings.TrimPrefix(line[len(quoted):], " ")
+		} else {
+			value, line, _ = strings.Cut(line, " ")
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package report
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditEntryRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC)
+	entries := []AuditEntry{
+		{Time: at, Op: AuditRemove, Path: "/tank/big.img", Size: 1 << 30, Digest: "sha256:9f86d0"},
+		{Time: at, Op: AuditRename, Path: "/tank/a b.balance", Target: "/tank/a b", Size: 0},
+		{Time: at, Op: AuditCleanup, Path: "/tank/odd \"name\"\n.balance", Size: -1, Error: "device busy"},
+		{Time: at, Op: AuditRemove, Path: "/tank/locked", Size: 4, Protection: "immutable, append-only"},
+	}
+	for _, want := range entries {
+		got, err := ParseAuditEntry(want.String())
+		if err != nil {
+			t.Fatalf("ParseAuditEntry(%q) failed: %v", want.String(), err)
+		}
+		if !got.Time.Equal(want.Time) {
+			t.Errorf("Time = %v, want %v", got.Time, want.Time)
+		}
+		got.Time = want.Time
+		if got != want {
+			t.Errorf("ParseAuditEntry = %+v, want %+v", got, want)
+		}
+	}
+	if !entries[2].Failed() || !strings.Contains(entries[2].String(), "status=failed") {
+		t.Errorf("Expected the entry with an error to be marked failed: %s", entries[2])
+	}
+}
+
+func TestReadAuditLog(t *testing.T) {
+	log := `2024-05-01T12:30:00Z op=remove path="/tank/a" size=3 digest=xxh3:00ff
+
+2024-05-01T12:30:01Z op=rename path="/tank/a.balance" target="/tank/a" size=3 pool="tank"
+`
+	entries, err := ReadAuditLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("ReadAuditLog failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Digest != "xxh3:00ff" || entries[1].Target != "/tank/a" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+
+	for _, bad := range []string{
+		"yesterday op=remove path=\"/tank/a\"",
+		"2024-05-01T12:30:00Z op=remove",
+		"2024-05-01T12:30:00Z op=remove path=\"/tank/a\" size=big",
+		"2024-05-01T12:30:00Z op=remove path=\"/tank/a",
+	} {
+		if _, err := ReadAuditLog(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	log := `{"level":"info","msg":"Scanning","time":"2024-05-01T12:30:00Z"}
+{"bytes":1048576,"level":"warning","msg":"Rebalanced /tank/a","operation":"rebalanced","path":"/tank/a","speed_mbps":512.5,"time":"2024-05-01T12:30:01Z","new_field":true}
+{"error":"device busy","level":"error","msg":"Failed","operation":"failed","path":"/tank/b","time":"2024-05-01T12:30:02Z"}
+`
+	events, err := ReadEvents(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("ReadEvents failed: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	if events[0].Operation != "" || events[0].Message != "Scanning" {
+		t.Errorf("Unexpected general event %+v", events[0])
+	}
+	if ev := events[1]; ev.Operation != OpRebalanced || ev.Bytes != 1<<20 || ev.SpeedMBps != 512.5 || ev.Path != "/tank/a" {
+		t.Errorf("Unexpected rebalanced event %+v", ev)
+	}
+	if ev := events[2]; ev.Operation != OpFailed || ev.Error != "device busy" {
+		t.Errorf("Unexpected failed event %+v", ev)
+	}
+
+	if _, err := ReadEvents(strings.NewReader("Summary: 3 files\n")); err == nil {
+		t.Error("Expected an error for a line that is not JSON")
+	}
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	plan := []PlanEntry{
+		{Path: "/tank/big.img", Size: 1 << 30, Passes: 2, Reason: "rebalanced 2 of 10 times"},
+		{Path: "/tank/a \"b\"\nc", Size: 0},
+	}
+	var b strings.Builder
+	for _, e := range plan {
+		b.WriteString(e.String() + "\n\n")
+	}
+	got, err := ReadPlan(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("ReadPlan failed: %v", err)
+	}
+	if len(got) != len(plan) {
+		t.Fatalf("Expected %d entries, got %d", len(plan), len(got))
+	}
+	for i := range plan {
+		if got[i] != plan[i] {
+			t.Errorf("Entry %d = %+v, want %+v", i, got[i], plan[i])
+		}
+	}
+
+	if _, err := ParsePlanEntry(`size=3 passes=0`); err == nil {
+		t.Error("Expected an error for an entry without path")
+	}
+	if _, err := ParsePlanEntry(`path="/tank/a" size=x`); err == nil {
+		t.Error("Expected an error for an invalid size")
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rep := &RunReport{
+		Started:  started,
+		Finished: started.Add(time.Minute),
+		Paths:    []string{"/tank/data"},
+		Totals:   RunTotals{FilesRebalanced: 1, FilesFailed: 1, BytesRebalanced: 4096, ElapsedSeconds: 60},
+		Files: []FileOutcome{
+			{Path: "/tank/data/a", Status: StatusRebalanced, Bytes: 4096, QueueSeconds: 2.25, DurationSeconds: 0.5, BytesPerSecond: 8192},
+			{Path: "/tank/data/b, \"c\"", Status: StatusFailed, Bytes: 10, Error: "copy failed: no space left on device"},
+		},
+	}
+
+	var js strings.Builder
+	if err := rep.WriteJSON(&js); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	got, err := ReadRunReport(strings.NewReader(js.String()))
+	if err != nil {
+		t.Fatalf("ReadRunReport failed: %v", err)
+	}
+	if !got.Started.Equal(rep.Started) || got.Totals != rep.Totals || len(got.Files) != 2 || got.Files[1] != rep.Files[1] {
+		t.Errorf("Round trip changed the report: %+v", got)
+	}
+
+	var csv strings.Builder
+	if err := rep.WriteCSV(&csv); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	want := "path,status,bytes,queue_seconds,duration_seconds,bytes_per_second,error,path_base64\n" +
+		"/tank/data/a,rebalanced,4096,2.250,0.500,8192,,\n" +
+		"\"/tank/data/b, \"\"c\"\"\",failed,10,0.000,0.000,0,copy failed: no space left on device,\n"
+	if csv.String() != want {
+		t.Errorf("Unexpected CSV:\n%s\nwant:\n%s", csv.String(), want)
+	}
+}
+
+func TestRunReportPaths(t *testing.T) {
+	// Latin-1 and truncated UTF-8 names, next to a valid one that looks escaped
+	paths := []string{"/tank/caf\xe9", "/tank/\xe6\x97", `/tank/\xe9 ü`}
+	rep := &RunReport{}
+	for _, p := range paths {
+		rep.Files = append(rep.Files, FileOutcome{Path: p, Status: StatusRebalanced})
+	}
+
+	var js strings.Builder
+	if err := rep.WriteJSON(&js); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	if !strings.Contains(js.String(), `"path": "/tank/caf\\xe9"`) || !strings.Contains(js.String(), `"path_base64": "L3RhbmsvY2Fm6Q=="`) {
+		t.Errorf("Expected an escaped path with its base64 form:\n%s", js.String())
+	}
+	if strings.Count(js.String(), "path_base64") != 2 {
+		t.Errorf("Expected path_base64 only for the invalid paths:\n%s", js.String())
+	}
+	var csv strings.Builder
+	if err := rep.WriteCSV(&csv); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+
+	for name, read := range map[string]func() (*RunReport, error){
+		"JSON": func() (*RunReport, error) { return ReadRunReport(strings.NewReader(js.String())) },
+		"CSV":  func() (*RunReport, error) { return ReadRunReportCSV(strings.NewReader(csv.String())) },
+	} {
+		got, err := read()
+		if err != nil {
+			t.Fatalf("Reading the %s report failed: %v", name, err)
+		}
+		if len(got.Files) != len(paths) {
+			t.Fatalf("Expected %d files in the %s report, got %d", len(paths), name, len(got.Files))
+		}
+		for i, f := range got.Files {
+			if f.Path != paths[i] || f.PathBase64 != "" || f.Status != StatusRebalanced {
+				t.Errorf("%s report: file %d = %+v, want path %q", name, i, f, paths[i])
+			}
+		}
+	}
+
+	rep.Base64Paths = true
+	js.Reset()
+	if err := rep.WriteJSON(&js); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	if strings.Count(js.String(), "path_base64") != len(paths) {
+		t.Errorf("Expected path_base64 for every file:\n%s", js.String())
+	}
+	if rep.Files[0].PathBase64 != "" {
+		t.Error("Expected writing to leave the report unchanged")
+	}
+
+	if _, err := ReadRunReportCSV(strings.NewReader("status\nrebalanced\n")); err == nil {
+		t.Error("Expected an error for a CSV report without a path column")
+	}
+	if _, err := ReadRunReportCSV(strings.NewReader("path,path_base64\n/a,!!\n")); err == nil {
+		t.Error("Expected an error for invalid base64")
+	}
+}
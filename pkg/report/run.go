@@ -0,0 +1,212 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Statuses of FileOutcome
+const (
+	StatusRebalanced  = "rebalanced"
+	StatusSkipped     = "skipped"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+// RunReport is the outcome of one run, written with --report so runs can be archived,
+// compared or loaded into dashboards
+type RunReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Paths    []string  `json:"paths"`
+	// Interrupted is set when a shutdown stopped the run before every file was processed
+	Interrupted bool          `json:"interrupted"`
+	Totals      RunTotals     `json:"totals"`
+	Files       []FileOutcome `json:"files"`
+	// Base64Paths writes path_base64 for every file, not only for paths that are not
+	// valid UTF-8, for consumers that would rather always decode the exact bytes
+	Base64Paths bool `json:"-"`
+}
+
+// RunTotals aggregates the files of a RunReport
+type RunTotals struct {
+	FilesRebalanced int64 `json:"files_rebalanced"`
+	FilesSkipped    int64 `json:"files_skipped"`
+	FilesFailed     int64 `json:"files_failed"`
+	// FilesAlreadyBalanced were skipped, and counted in FilesSkipped, because they were
+	// laid out in fewer extents than --min-extents
+	FilesAlreadyBalanced int64 `json:"files_already_balanced,omitempty"`
+	// FilesLowSpace were skipped, and counted in FilesSkipped, because their copy would
+	// have cut into the free space reserved with --reserve-free
+	FilesLowSpace int64 `json:"files_low_space,omitempty"`
+	// FilesProtected were skipped, and counted in FilesSkipped, because they had the
+	// immutable or append-only flag and --clear-immutable was not given
+	FilesProtected int64 `json:"files_protected,omitempty"`
+	// FilesTooLarge were left out of the run, not counted in FilesSkipped, for being
+	// larger than --skip-larger-than
+	FilesTooLarge int64 `json:"files_too_large,omitempty"`
+	// FilesRemaining were queued but not processed because the run was interrupted
+	FilesRemaining  int64   `json:"files_remaining"`
+	BytesRebalanced int64   `json:"bytes_rebalanced"`
+	ElapsedSeconds  float64 `json:"elapsed_seconds"`
+	// BytesPerSecond is BytesRebalanced over the elapsed time of the run
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	RetryAttempts  int64   `json:"retry_attempts"`
+	// Queue* are percentiles of how long files waited for a worker
+	QueueP50Seconds float64 `json:"queue_p50_seconds"`
+	QueueP90Seconds float64 `json:"queue_p90_seconds"`
+	QueueP99Seconds float64 `json:"queue_p99_seconds"`
+	QueueMaxSeconds float64 `json:"queue_max_seconds"`
+	// ARC* describe the ZFS ARC during the run: its hit ratio since the run started and
+	// its size at the end; omitted where the ARC could not be read
+	ARCHitRatio float64 `json:"arc_hit_ratio,omitempty"`
+	ARCBytes    uint64  `json:"arc_bytes,omitempty"`
+	ARCMaxBytes uint64  `json:"arc_max_bytes,omitempty"`
+}
+
+// FileOutcome is what happened to one file
+type FileOutcome struct {
+	// Path holds the exact bytes of the path. Written reports escape the bytes that are
+	// not valid UTF-8 as \xNN and add PathBase64; readers restore the exact path from it.
+	Path       string `json:"path"`
+	PathBase64 string `json:"path_base64,omitempty"`
+	// Status is one of the Status constants
+	Status string `json:"status"`
+	// Bytes is the logical size of the file, 0 if it could not be determined
+	Bytes int64 `json:"bytes"`
+	// QueueSeconds is how long the file waited for a worker before it was started
+	QueueSeconds    float64 `json:"queue_seconds"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// BytesPerSecond is set for rebalanced files
+	BytesPerSecond float64 `json:"bytes_per_second,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// WriteJSON writes the report as an indented JSON document
+func (rep *RunReport) WriteJSON(w io.Writer) error {
+	encoded := *rep
+	encoded.Files = make([]FileOutcome, len(rep.Files))
+	for i, f := range rep.Files {
+		f.Path, f.PathBase64 = encodePath(f.Path, rep.Base64Paths)
+		encoded.Files[i] = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&encoded)
+}
+
+// csvHeader names the columns written by WriteCSV
+var csvHeader = []string{"path", "status", "bytes", "queue_seconds", "duration_seconds", "bytes_per_second", "error", "path_base64"}
+
+// WriteCSV writes one row per file under a header row. The totals are left out, as
+// they are the sums of the rows.
+func (rep *RunReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, f := range rep.Files {
+		path, b64 := encodePath(f.Path, rep.Base64Paths)
+		err := cw.Write([]string{
+			path,
+			f.Status,
+			strconv.FormatInt(f.Bytes, 10),
+			strconv.FormatFloat(f.QueueSeconds, 'f', 3, 64),
+			strconv.FormatFloat(f.DurationSeconds, 'f', 3, 64),
+			strconv.FormatFloat(f.BytesPerSecond, 'f', 0, 64),
+			f.Error,
+			b64,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadRunReport parses a report written by WriteJSON. Unknown fields are ignored so
+// that reports from newer versions can still be read.
+func ReadRunReport(r io.Reader) (*RunReport, error) {
+	var rep RunReport
+	if err := json.NewDecoder(r).Decode(&rep); err != nil {
+		return nil, err
+	}
+	for i := range rep.Files {
+		if err := rep.Files[i].decodePath(); err != nil {
+			return nil, err
+		}
+	}
+	return &rep, nil
+}
+
+// ReadRunReportCSV parses the file rows of a report written by WriteCSV. Columns are
+// found by their header, so reports from other versions can be read; only path is
+// required. The totals are left empty.
+func ReadRunReportCSV(r io.Reader) (*RunReport, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	if _, ok := columns["path"]; !ok {
+		return nil, fmt.Errorf("no path column in CSV report header")
+	}
+
+	rep := &RunReport{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		number := func(name string) float64 {
+			v, _ := strconv.ParseFloat(field(name), 64)
+			return v
+		}
+
+		bytes, _ := strconv.ParseInt(field("bytes"), 10, 64)
+		f := FileOutcome{
+			Path:            field("path"),
+			PathBase64:      field("path_base64"),
+			Status:          field("status"),
+			Bytes:           bytes,
+			QueueSeconds:    number("queue_seconds"),
+			DurationSeconds: number("duration_seconds"),
+			BytesPerSecond:  number("bytes_per_second"),
+			Error:           field("error"),
+		}
+		if err := f.decodePath(); err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rep.Files = append(rep.Files, f)
+	}
+	return rep, nil
+}
+
+// decodePath restores the exact path from PathBase64, which is cleared
+func (f *FileOutcome) decodePath() error {
+	path, err := decodePath(f.Path, f.PathBase64)
+	if err != nil {
+		return err
+	}
+	f.Path, f.PathBase64 = path, ""
+	return nil
+}
@@ -6,7 +6,7 @@ set -e
 
 TOTAL_TIMEOUT_MINUTES=30
 START_TIME=$(date +%s)
-PLATFORMS="linux/amd64 linux/arm64 windows/amd64 darwin/amd64 darwin/arm64"
+PLATFORMS="linux/amd64 linux/arm64 windows/amd64 darwin/amd64 darwin/arm64 freebsd/amd64"
 
 # Check if we should build with the race detector
 RACE_FLAG=""
@@ -66,8 +66,8 @@ build_for_platform() {
     elif [ "$os" = "linux" ] && [ "$arch" = "arm64" ]; then
         # Linux ARM64 build - use cross compiler
         docker run --platform linux/amd64 --rm ${docker_args} bash -c "apt-get update && apt-get install -y gcc-aarch64-linux-gnu && CGO_ENABLED=1 GOOS=${os} GOARCH=${arch} CC=aarch64-linux-gnu-gcc ${build_cmd} ./cmd/rebalance"
-    elif [ "$os" = "darwin" ]; then
-        # macOS builds - no CGO needed
+    elif [ "$os" = "darwin" ] || [ "$os" = "freebsd" ]; then
+        # macOS and FreeBSD builds - no CGO needed, the pure-Go SQLite driver is used
         docker run --platform linux/amd64 --rm ${docker_args} bash -c "CGO_ENABLED=0 GOOS=${os} GOARCH=${arch} ${build_cmd} ./cmd/rebalance"
     else
         # Default Linux AMD64 build
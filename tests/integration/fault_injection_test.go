@@ -0,0 +1,248 @@
+package integration
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/astundzia/go-zfs-rebalance/internal/database"
+	"github.com/astundzia/go-zfs-rebalance/internal/faultinject"
+	"github.com/astundzia/go-zfs-rebalance/pkg/rebalance"
+	"github.com/astundzia/go-zfs-rebalance/pkg/report"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashHelperEnv names the directory TestFaultCrashHelper rebalances when the test binary
+// is started again as the process that crashes
+const crashHelperEnv = "REBALANCE_CRASH_HELPER_DIR"
+
+// faultScenario is a tree with a file the faults target and a bystander that must be
+// rebalanced regardless, plus an audit log and a database outside the tree
+type faultScenario struct {
+	root, victim, bystander string
+	auditPath               string
+	dbPath                  string
+	checksums               map[string]string
+}
+
+func newFaultScenario(t *testing.T) *faultScenario {
+	base := t.TempDir()
+	s := &faultScenario{
+		root:      filepath.Join(base, "data"),
+		auditPath: filepath.Join(base, "audit.log"),
+		dbPath:    filepath.Join(base, "rebalance.db"),
+	}
+	require.NoError(t, os.Mkdir(s.root, 0755))
+	s.victim = createTestFile(t, s.root, "victim.bin", strings.Repeat("victim data ", 1000))
+	s.bystander = createTestFile(t, s.root, "bystander.txt", "bystander data")
+
+	var err error
+	s.checksums, err = calculateChecksums(s.root)
+	require.NoError(t, err)
+	return s
+}
+
+// run rebalances the tree once with the faults of spec in effect, empty for none, and
+// returns the database of the run and its error
+func (s *faultScenario) run(t *testing.T, spec string, configure func(*rebalance.Config)) (*database.DB, error) {
+	if spec != "" {
+		disable, err := faultinject.Enable(spec)
+		require.NoError(t, err)
+		defer disable()
+	}
+
+	auditLog, err := rebalance.OpenAuditLog(s.auditPath)
+	require.NoError(t, err)
+	defer auditLog.Close()
+	db, err := database.OpenSQLiteDBAt(s.dbPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close(false) })
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	config := &rebalance.Config{
+		RootPath:            s.root,
+		Concurrency:         1,
+		PassesLimit:         1,
+		CleanupBalanceFiles: true,
+		AuditLog:            auditLog,
+		Logger:              logger,
+	}
+	if configure != nil {
+		configure(config)
+	}
+	return db, rebalance.NewRebalancer(config, db).Run(nil)
+}
+
+// assertIntact checks that every file of the tree still has its data and no temporary
+// copy was left behind
+func (s *faultScenario) assertIntact(t *testing.T) {
+	checksums, err := calculateChecksums(s.root)
+	require.NoError(t, err)
+	assert.Equal(t, s.checksums, checksums, "Data changed")
+	leftovers, err := filepath.Glob(filepath.Join(s.root, "*.balance"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers, "Temporary copies left behind")
+}
+
+// assertRebalanced checks whether path was rewritten since inode was taken
+func assertRebalanced(t *testing.T, path string, inode uint64, rebalanced bool) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	assert.Equal(t, rebalanced, getInode(t, path) != inode, "Unexpected rebalance state of %s", path)
+}
+
+func TestFaultInjection(t *testing.T) {
+	t.Run("RemoveFailureKeepsOriginal", func(t *testing.T) {
+		s := newFaultScenario(t)
+		inode := inodeOf(t, s.victim)
+		_, err := s.run(t, "remove=victim.bin", nil)
+		require.Error(t, err, "Expected the run to report the failed file")
+
+		s.assertIntact(t)
+		assertRebalanced(t, s.victim, inode, false)
+	})
+
+	t.Run("HashMismatchKeepsOriginal", func(t *testing.T) {
+		for _, readback := range []bool{false, true} {
+			s := newFaultScenario(t)
+			inode, bystander := inodeOf(t, s.victim), inodeOf(t, s.bystander)
+			_, err := s.run(t, "hash=victim.bin", func(c *rebalance.Config) { c.VerifyReadback = readback })
+			require.Error(t, err, "Expected the run to report the mismatch")
+
+			s.assertIntact(t)
+			assertRebalanced(t, s.victim, inode, false)
+			assertRebalanced(t, s.bystander, bystander, true)
+		}
+	})
+
+	t.Run("AuditSyncFailureRemovesNothing", func(t *testing.T) {
+		s := newFaultScenario(t)
+		inode, bystander := inodeOf(t, s.victim), inodeOf(t, s.bystander)
+		_, err := s.run(t, "fsync=audit.log", nil)
+		require.Error(t, err, "Expected the run to report the files it could not replace")
+
+		s.assertIntact(t)
+		assertRebalanced(t, s.victim, inode, false)
+		assertRebalanced(t, s.bystander, bystander, false)
+	})
+
+	t.Run("CopySyncFailureKeepsOriginal", func(t *testing.T) {
+		s := newFaultScenario(t)
+		inode, bystander := inodeOf(t, s.victim), inodeOf(t, s.bystander)
+		_, err := s.run(t, "fsync=victim.bin.balance", nil)
+		require.Error(t, err, "Expected the run to report the copy it could not sync")
+
+		s.assertIntact(t)
+		assertRebalanced(t, s.victim, inode, false)
+		assertRebalanced(t, s.bystander, bystander, true)
+
+		// Without the barrier the fault is never reached
+		_, err = s.run(t, "fsync=victim.bin.balance", func(c *rebalance.Config) { c.NoSync = true })
+		require.NoError(t, err)
+		s.assertIntact(t)
+		assertRebalanced(t, s.victim, inode, true)
+	})
+
+	t.Run("RenameFailureSavesRecovered", func(t *testing.T) {
+		s := newFaultScenario(t)
+		db, err := s.run(t, "rename=victim.bin", nil)
+		require.Error(t, err, "Expected the run to report the failed rename")
+
+		_, err = os.Stat(s.victim)
+		require.True(t, os.IsNotExist(err), "Expected the original to be gone")
+		recovered, err := db.RecoveredFiles()
+		require.NoError(t, err)
+		require.Len(t, recovered, 1)
+		assert.Equal(t, s.victim, recovered[0].OriginalPath)
+		assert.Equal(t, s.victim+".recovered", recovered[0].SavedPath)
+
+		// Restoring the registered copy brings the data back
+		require.NoError(t, os.Rename(recovered[0].SavedPath, recovered[0].OriginalPath))
+		require.NoError(t, db.DeleteRecovered(recovered[0].SavedPath))
+		s.assertIntact(t)
+	})
+
+	t.Run("RecoveryDirFallsBackWithoutFsync", func(t *testing.T) {
+		s := newFaultScenario(t)
+		recoveryDir := filepath.Join(filepath.Dir(s.root), "recovery")
+		// The rename into the recovery directory fails too, and the copy made instead cannot be synced
+		db, err := s.run(t, "rename=victim.bin,fsync=victim.bin", func(c *rebalance.Config) { c.RecoveryDir = recoveryDir })
+		require.Error(t, err)
+
+		saved, err := filepath.Glob(filepath.Join(recoveryDir, "*", "*", "*", "victim.bin*"))
+		require.NoError(t, err)
+		assert.Empty(t, saved, "Expected no unsynced copy in the recovery directory")
+		recovered, err := db.RecoveredFiles()
+		require.NoError(t, err)
+		require.Len(t, recovered, 1)
+		assert.Equal(t, s.victim+".recovered", recovered[0].SavedPath)
+		digest, err := calculateSHA256(recovered[0].SavedPath)
+		require.NoError(t, err)
+		assert.Equal(t, s.checksums["victim.bin"], digest)
+	})
+}
+
+// TestFaultCrashHelper is the process TestCrashRecovery crashes: it rebalances the
+// directory named by crashHelperEnv with the faults of the environment
+func TestFaultCrashHelper(t *testing.T) {
+	dir := os.Getenv(crashHelperEnv)
+	if dir == "" {
+		t.Skip("Only run by TestCrashRecovery")
+	}
+	spec, err := faultinject.Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, spec)
+
+	s := &faultScenario{root: dir, auditPath: filepath.Join(filepath.Dir(dir), "audit.log"), dbPath: filepath.Join(filepath.Dir(dir), "rebalance.db")}
+	s.run(t, "", nil)
+	t.Fatal("Expected the process to crash")
+}
+
+func TestCrashRecovery(t *testing.T) {
+	s := newFaultScenario(t)
+
+	// Die between removing the original and renaming its copy into place
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFaultCrashHelper$")
+	cmd.Env = append(os.Environ(), crashHelperEnv+"="+s.root, faultinject.EnvVar+"=crash:rename=victim.bin")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(err, &exitErr), "Expected the helper to crash, got %v:\n%s", err, out)
+	require.Equal(t, faultinject.CrashExitCode, exitErr.ExitCode(), "Unexpected exit of the helper:\n%s", out)
+
+	_, err = os.Stat(s.victim)
+	require.True(t, os.IsNotExist(err), "Expected the original to be removed before the crash")
+	_, err = os.Stat(s.victim + ".balance")
+	require.NoError(t, err, "Expected the copy to be left behind")
+
+	f, err := os.Open(s.auditPath)
+	require.NoError(t, err)
+	entries, err := report.ReadAuditLog(f)
+	f.Close()
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	last := entries[len(entries)-1]
+	assert.Equal(t, report.AuditRename, last.Op, "Expected the rename to be the last step announced")
+	assert.Equal(t, s.victim, last.Target)
+
+	// The next run replays the audit log and puts the copy back before cleaning up
+	_, err = s.run(t, "", nil)
+	require.NoError(t, err)
+	s.assertIntact(t)
+}
+
+// inodeOf returns the inode of path, 0 on Windows where rebalancing is not checked by inode
+func inodeOf(t *testing.T, path string) uint64 {
+	if runtime.GOOS == "windows" {
+		return 0
+	}
+	return getInode(t, path)
+}
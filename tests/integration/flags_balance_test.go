@@ -87,7 +87,7 @@ func runRebalancer(t *testing.T, config *rebalance.Config) error {
 	}
 
 	r := rebalance.NewRebalancer(config, db)
-	var progressChan chan<- int = nil // No progress reporting needed for tests
+	var progressChan chan<- rebalance.Progress = nil // No progress reporting needed for tests
 
 	err = r.Run(progressChan)
 	if err != nil {
@@ -217,9 +217,8 @@ func TestConcurrencyFlag(t *testing.T) {
 }
 
 // TestSkipHardlinksFlag verifies the functionality of the SkipHardlinks flag.
-// It checks that hardlinks are NOT created when the flag is true, and implicitly
-// tests that they *would* be created (or attempted) when false (though that
-// specific check is currently skipped as the hardlinking feature isn't fully implemented).
+// It checks that hardlinks are NOT created when the flag is true, and that a
+// hardlink group is rebalanced once and its links recreated with RelinkHardlinks.
 func TestSkipHardlinksFlag(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("Hardlink test skipped on Windows")
@@ -230,9 +229,39 @@ func TestSkipHardlinksFlag(t *testing.T) {
 	defer os.RemoveAll(testDir)
 
 	// --- Test Cases ---
-	// Test WITH hardlinks (default behavior - currently skipped)
+	// Test WITH hardlinks (--relink-hardlinks)
 	t.Run("WithHardlinks", func(t *testing.T) {
-		t.Skip("Skipping hardlink creation test as the feature is not implemented.")
+		// Setup isolated directory with file3.txt linked to file3_dup.txt
+		tempDirLink, err := os.MkdirTemp("", "rebalance_relink_")
+		require.NoError(t, err)
+		defer os.RemoveAll(tempDirLink)
+		err = copyDir(testDir, tempDirLink)
+		require.NoError(t, err, "Failed to copy test dir for relink test")
+		dupPath := filepath.Join(tempDirLink, "file3_dup.txt")
+		linkPath := filepath.Join(tempDirLink, "file3.txt")
+		require.NoError(t, os.Link(dupPath, linkPath), "Failed to create hardlink")
+		oldInode := getInode(t, dupPath)
+
+		// Configure and run rebalancer with relinking
+		config := &rebalance.Config{
+			RootPath:            tempDirLink,
+			Concurrency:         1,
+			SkipHardlinks:       true,
+			RelinkHardlinks:     true,
+			PassesLimit:         1,
+			CleanupBalanceFiles: true,
+		}
+		err = runRebalancer(t, config)
+		require.NoError(t, err, "Rebalancer failed with relink-hardlinks enabled")
+
+		// Verify both paths share one inode, the new copy of the group
+		inode1 := getInode(t, linkPath)
+		inode2 := getInode(t, dupPath)
+		assert.Equal(t, inode1, inode2, "Hardlinks should share an inode after relinking")
+		assert.NotEqual(t, oldInode, inode1, "The hardlink group should be rewritten to a new inode")
+		content, err := os.ReadFile(linkPath)
+		require.NoError(t, err)
+		assert.Equal(t, "duplicate content", string(content))
 	})
 
 	// Test WITHOUT hardlinks (--skip-hardlinks)
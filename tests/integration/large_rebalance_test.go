@@ -76,13 +76,13 @@ func TestLargeRebalanceWithChecksums(t *testing.T) {
 		RootPath:            testDir,
 		Logger:              logger,
 		CleanupBalanceFiles: true,
-		RandomOrder:         false,
-		SizeThresholdMB:     0,
+		Order:               rebalance.OrderPath,
+		SizeThreshold:       0,
 	}
 
 	r := rebalance.NewRebalancer(config, db)
 
-	var progressChan chan<- int = nil
+	var progressChan chan<- rebalance.Progress = nil
 
 	err = r.Run(progressChan)
 	if err != nil {